@@ -15,6 +15,7 @@
 package calc
 
 import (
+	"fmt"
 	"reflect"
 	"time"
 
@@ -85,6 +86,16 @@ type AsyncCalcGraph struct {
 	flushLeakyBucket int
 	dirty            bool
 
+	// firstRevision and lastRevision are the datastore revisions of the first and last of the
+	// updates since the last flush; if sendRevisions is set, we pass them on, after the flush,
+	// in a DatastoreUpdateBatch message.  numEventsSent counts the events that we've emitted.
+	// The revisions are only used to correlate dataplane update traces with the datastore so
+	// sendRevisions is only set if trace export is configured.
+	sendRevisions bool
+	firstRevision string
+	lastRevision  string
+	numEventsSent int
+
 	debugHangC <-chan time.Time
 }
 
@@ -102,6 +113,7 @@ func NewAsyncCalcGraph(conf *config.Config, outputEvents chan<- interface{}, hea
 		Dispatcher:       disp,
 		eventBuffer:      eventBuffer,
 		healthAggregator: healthAggregator,
+		sendRevisions:    conf.TracingOTLPEndpoint != "",
 	}
 	if conf.DebugSimulateCalcGraphHangAfter != 0 {
 		log.WithField("delay", conf.DebugSimulateCalcGraphHangAfter).Warn(
@@ -149,6 +161,7 @@ func (acg *AsyncCalcGraph) loop() {
 					typeName := reflect.TypeOf(upd.Key).Name()
 					count := countUpdatesProcessed.WithLabelValues(typeName)
 					count.Inc()
+					acg.recordRevision(upd.Revision)
 				}
 			case api.SyncStatus:
 				// Sync status changed, check if we're now in-sync.
@@ -204,7 +217,18 @@ func (acg *AsyncCalcGraph) maybeFlush() {
 	if acg.flushLeakyBucket > 0 {
 		log.Debug("Not throttled: flushing event buffer")
 		acg.flushLeakyBucket--
+		numEventsSent := acg.numEventsSent
 		acg.eventBuffer.Flush()
+		if acg.numEventsSent != numEventsSent && acg.lastRevision != "" {
+			// Only send the revisions if the updates had an effect, otherwise we'd wake
+			// the dataplane for nothing.
+			acg.onEvent(&proto.DatastoreUpdateBatch{
+				FirstRevision: acg.firstRevision,
+				LastRevision:  acg.lastRevision,
+			})
+		}
+		acg.firstRevision = ""
+		acg.lastRevision = ""
 		if acg.needToSendInSync {
 			log.Info("First flush after becoming in sync, sending InSync message.")
 			acg.onEvent(&proto.InSync{})
@@ -216,8 +240,26 @@ func (acg *AsyncCalcGraph) maybeFlush() {
 	}
 }
 
+// recordRevision records the datastore revision of an update for the next
+// DatastoreUpdateBatch message, if we send them.  Some updates, such as those that the syncer generates itself,
+// have no revision.
+func (acg *AsyncCalcGraph) recordRevision(revision interface{}) {
+	if !acg.sendRevisions || revision == nil {
+		return
+	}
+	rev := fmt.Sprint(revision)
+	if rev == "" {
+		return
+	}
+	if acg.firstRevision == "" {
+		acg.firstRevision = rev
+	}
+	acg.lastRevision = rev
+}
+
 func (acg *AsyncCalcGraph) onEvent(event interface{}) {
 	log.Debug("Sending output event on channel")
+	acg.numEventsSent++
 	acg.outputEvents <- event
 	countOutputEvents.Inc()
 	log.Debug("Sent output event on channel")
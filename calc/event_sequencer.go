@@ -230,8 +230,9 @@ func (buf *EventSequencer) flushPolicyUpdates() {
 					rulesOrNil.OutboundRules,
 					"pol-out-default/"+key.Name,
 				),
-				Untracked: rulesOrNil.Untracked,
-				PreDnat:   rulesOrNil.PreDNAT,
+				Untracked:         rulesOrNil.Untracked,
+				PreDnat:           rulesOrNil.PreDNAT,
+				IcmpRelatedErrors: rulesOrNil.ICMPRelatedErrors,
 			},
 		})
 		buf.sentPolicies.Add(key)
@@ -85,9 +85,30 @@ func (rs *RuleScanner) OnProfileInactive(key model.ProfileRulesKey) {
 
 func (rs *RuleScanner) OnPolicyActive(key model.PolicyKey, policy *model.Policy) {
 	parsedRules := rs.updateRules(key, policy.InboundRules, policy.OutboundRules, policy.DoNotTrack, policy.PreDNAT)
+	parsedRules.ICMPRelatedErrors = icmpRelatedErrorsFromAnnotations(key, policy.Annotations)
 	rs.RulesUpdateCallbacks.OnPolicyActive(key, parsedRules)
 }
 
+// ICMPRelatedErrorsAnnotation is the policy annotation that asks for ICMP error packets that
+// reach the policy to be accepted ("Accept") or dropped ("Drop") ahead of its rules.
+const ICMPRelatedErrorsAnnotation = "projectcalico.org/icmp-related-errors"
+
+func icmpRelatedErrorsFromAnnotations(key model.PolicyKey, annotations map[string]string) string {
+	value, ok := annotations[ICMPRelatedErrorsAnnotation]
+	if !ok {
+		return ""
+	}
+	switch value {
+	case "Accept", "Drop":
+		return value
+	}
+	log.WithFields(log.Fields{
+		"policy": key,
+		"value":  value,
+	}).Warn("Ignoring invalid " + ICMPRelatedErrorsAnnotation + " annotation; should be Accept or Drop")
+	return ""
+}
+
 func (rs *RuleScanner) OnPolicyInactive(key model.PolicyKey) {
 	rs.updateRules(key, nil, nil, false, false)
 	rs.RulesUpdateCallbacks.OnPolicyInactive(key)
@@ -187,6 +208,10 @@ type ParsedRules struct {
 
 	// PreDNAT is true if these rules should be applied before any DNAT.
 	PreDNAT bool
+
+	// ICMPRelatedErrors is "Accept" or "Drop" if ICMP error packets should be accepted or
+	// dropped ahead of the rules; see ICMPRelatedErrorsAnnotation.
+	ICMPRelatedErrors string
 }
 
 // Rule is like a backend.model.Rule, except the tag and selector matches are
@@ -36,6 +36,13 @@ var (
 	AuthorityRegexp = regexp.MustCompile(`^[^:/]+:\d+$`)
 	HostnameRegexp  = regexp.MustCompile(`^[a-zA-Z0-9_.-]+$`)
 	StringRegexp    = regexp.MustCompile(`^.*$`)
+	// LogPrefixRegexp limits the iptables log prefix to characters that are safe to render
+	// inside a quoted --log-prefix argument.  The kernel limits the whole prefix to 29
+	// characters and we append ": ".
+	LogPrefixRegexp = regexp.MustCompile(`^[a-zA-Z0-9_ .:/-]{1,27}$`)
+	// HashCommentPrefixRegexp limits the prefix of our rule-tracking comments to characters
+	// that are safe to render inside a quoted --comment argument.
+	HashCommentPrefixRegexp = regexp.MustCompile(`^[a-zA-Z0-9_.:/-]{1,32}$`)
 )
 
 const (
@@ -111,13 +118,43 @@ type Config struct {
 	Ipv6Support    bool `config:"bool;true"`
 	IgnoreLooseRPF bool `config:"bool;false"`
 
-	IptablesBackend                    string        `config:"oneof(legacy,nft);legacy"`
+	IptablesBackend                    string        `config:"oneof(legacy,nft,auto);legacy"`
+	IptablesBackendRecheckInterval     time.Duration `config:"seconds;60"`
+	IptablesBackendMigration           string        `config:"oneof(immediate,guided);immediate"`
+	FirewalldReloadDetectionEnabled    bool          `config:"bool;false"`
 	RouteRefreshInterval               time.Duration `config:"seconds;90"`
 	IptablesRefreshInterval            time.Duration `config:"seconds;90"`
 	IptablesPostWriteCheckIntervalSecs time.Duration `config:"seconds;1"`
+	IptablesPostWriteCheckMaxSecs      time.Duration `config:"seconds;3600"`
+	IptablesPostWriteCheckBackoff      float64       `config:"float;2"`
+	IptablesPostWriteCheckEnabled      bool          `config:"bool;true"`
 	IptablesLockFilePath               string        `config:"file;/run/xtables.lock"`
 	IptablesLockTimeoutSecs            time.Duration `config:"seconds;0"`
 	IptablesLockProbeIntervalMillis    time.Duration `config:"millis;50"`
+	IptablesVerifyAfterWrite           bool          `config:"bool;false"`
+	IptablesStrictVerify               bool          `config:"bool;false"`
+	IptablesPreserveCounters           bool          `config:"bool;false"`
+	IptablesMaxRulesPerChain           int           `config:"int;0"`
+	IptablesChainQuarantineThreshold   int           `config:"int;0"`
+	IptablesTamperDetectionEnabled     bool          `config:"bool;false"`
+	IptablesCoalesceWindowMillis       time.Duration `config:"millis;0"`
+	IptablesInvalidationBurst          int           `config:"int;0"`
+	IptablesInvalidationIntervalSecs   time.Duration `config:"seconds;1"`
+	IptablesStreamRestoreInput         bool          `config:"bool;false"`
+	IptablesRestorePreflight           bool          `config:"bool;false"`
+	IptablesMaxLinesPerRestore         int           `config:"int;0"`
+	IptablesChainCleanupDelaySecs      time.Duration `config:"seconds;0"`
+	IptablesRuleHashLength             int           `config:"int(0,128);0"`
+	IptablesRuleHashAlphabet           string        `config:"oneof(base64url,hex);base64url;non-zero"`
+	IptablesRuleHashAlgorithm          string        `config:"oneof(sha224,sha256,sha512);sha224;non-zero"`
+	IptablesRuleHashSalt               string        `config:"string;"`
+	IptablesForeignTailChainPrefixes   string        `config:"string;"`
+	IptablesForeignRulePolicy          string        `config:"oneof(rewrite,preserve,quarantine);rewrite;non-zero"`
+	IptablesUnmanagedChains            string        `config:"string;"`
+	IptablesInsertLeaseFile            string        `config:"string;"`
+	IptablesInsertLeaseOwner           string        `config:"string;calico-felix;non-zero"`
+	IptablesInsertLeaseSecs            time.Duration `config:"seconds;30"`
+	IptablesHashCommentPrefix          string        `config:"hash-comment-prefix;cali:;non-zero"`
 	IpsetsRefreshInterval              time.Duration `config:"seconds;10"`
 	MaxIpsetSize                       int           `config:"int;1048576;non-zero"`
 
@@ -126,13 +163,22 @@ type Config struct {
 	MetadataAddr string `config:"hostname;127.0.0.1;die-on-fail"`
 	MetadataPort int    `config:"int(0,65535);8775;die-on-fail"`
 
+	EndpointReadySocket string `config:"file;;local"`
+	// ControlSocket, if set, is the path of a Unix socket on which Felix serves requests that
+	// change the dataplane: warm standby activation (see StandbyActivationFile) and packet
+	// traces (if DebugPacketTraceEnabled is set).  For example:
+	//
+	//     curl --unix-socket <socket> -X POST \
+	//         'http://felix/packet-trace?protocol=tcp&dst=10.0.0.2&dport=80&duration=30s'
+	ControlSocket string `config:"file;;local"`
+
 	InterfacePrefix string `config:"iface-list;cali;non-zero,die-on-fail"`
 
 	ChainInsertMode             string `config:"oneof(insert,append);insert;non-zero,die-on-fail"`
 	DefaultEndpointToHostAction string `config:"oneof(DROP,RETURN,ACCEPT);DROP;non-zero,die-on-fail"`
 	IptablesFilterAllowAction   string `config:"oneof(ACCEPT,RETURN);ACCEPT;non-zero,die-on-fail"`
 	IptablesMangleAllowAction   string `config:"oneof(ACCEPT,RETURN);ACCEPT;non-zero,die-on-fail"`
-	LogPrefix                   string `config:"string;calico-packet"`
+	LogPrefix                   string `config:"log-prefix;calico-packet"`
 
 	LogFilePath string `config:"file;/var/log/calico/felix.log;die-on-fail"`
 
@@ -153,6 +199,10 @@ type Config struct {
 	IptablesMarkMask uint32 `config:"mark-bitmask;0xff000000;non-zero,die-on-fail"`
 
 	DisableConntrackInvalidCheck bool `config:"bool;false"`
+	// ICMPRelatedErrors controls how ICMP error packets to and from endpoints are treated:
+	// "Conntrack" accepts those that conntrack relates to an allowed connection, "Accept"
+	// accepts all of them, even those about denied flows, and "Drop" leaves them to policy.
+	ICMPRelatedErrors string `config:"oneof(Conntrack,Accept,Drop);Conntrack;non-zero"`
 
 	HealthEnabled                   bool `config:"bool;false"`
 	HealthPort                      int  `config:"int(0,65535);9099"`
@@ -161,9 +211,50 @@ type Config struct {
 	PrometheusGoMetricsEnabled      bool `config:"bool;true"`
 	PrometheusProcessMetricsEnabled bool `config:"bool;true"`
 
+	TracingOTLPEndpoint string `config:"string;"`
+
 	FailsafeInboundHostPorts  []ProtoPort `config:"port-list;tcp:22,udp:68;die-on-fail"`
 	FailsafeOutboundHostPorts []ProtoPort `config:"port-list;tcp:2379,tcp:2380,tcp:4001,tcp:7001,udp:53,udp:67;die-on-fail"`
 
+	// BreakGlassFile, if set, enables break-glass access: while the file exists and was
+	// modified less than BreakGlassTTL ago, all traffic to/from BreakGlassCIDRs is accepted
+	// ahead of policy.
+	BreakGlassFile  string        `config:"file;;"`
+	BreakGlassCIDRs []string      `config:"cidr-list;;"`
+	BreakGlassTTL   time.Duration `config:"seconds;3600"`
+
+	// StandbyActivationFile, if set, starts Felix in warm standby: it keeps its desired
+	// dataplane state up to date but doesn't program the dataplane until the file exists or
+	// it's activated through the /activate endpoint of the ControlSocket.  For active-passive
+	// node pairs.
+	StandbyActivationFile string `config:"file;;"`
+
+	// DatastoreInSyncTimeoutSecs, if non-zero, bounds how long Felix waits for the datastore
+	// to be in sync before it first programs the dataplane.  After the timeout, it programs
+	// the state that it has received so far and reports itself as not ready until the
+	// datastore is in sync, so that a flaky datastore doesn't leave a rebooted node
+	// unprotected indefinitely.
+	DatastoreInSyncTimeoutSecs time.Duration `config:"seconds;0"`
+
+	// NodeLocalDNSAddresses, if set, are the link-local addresses that a node-local DNS cache
+	// listens on.  Felix exempts DNS traffic to and from them from conntrack and accepts it
+	// ahead of policy.
+	NodeLocalDNSAddresses []string `config:"ip-list;;"`
+	NodeLocalDNSPort      int      `config:"int(1,65535);53"`
+
+	// MaxRulesPerPolicy, MaxCIDRsPerRule and MaxPolicyChains, if non-zero, limit the size of
+	// the policies and profiles that Felix renders.  One that exceeds a limit is rejected and
+	// rendered as chains that drop all traffic.
+	MaxRulesPerPolicy int `config:"int;0"`
+	MaxCIDRsPerRule   int `config:"int;0"`
+	MaxPolicyChains   int `config:"int;0"`
+
+	// HostEndpointVLANs lists the VLANs of workload traffic that is carried directly by a host
+	// interface, such as an SR-IOV physical function, as comma-separated "<iface>:<vlan>"
+	// pairs.  Felix applies the interface's host endpoint policy to traffic on the VLAN
+	// sub-interfaces ("<iface>.<vlan>") too.
+	HostEndpointVLANs map[string][]int `config:"iface-vlan-list;;"`
+
 	UsageReportingEnabled bool   `config:"bool;true"`
 	ClusterGUID           string `config:"string;baddecaf"`
 	ClusterType           string `config:"string;"`
@@ -173,6 +264,7 @@ type Config struct {
 	DebugDisableLogDropping         bool          `config:"bool;false"`
 	DebugSimulateCalcGraphHangAfter time.Duration `config:"seconds;0"`
 	DebugSimulateDataplaneHangAfter time.Duration `config:"seconds;0"`
+	DebugPacketTraceEnabled         bool          `config:"bool;false"`
 
 	// State tracking.
 
@@ -218,6 +310,31 @@ func (c *Config) InterfacePrefixes() []string {
 	return strings.Split(c.InterfacePrefix, ",")
 }
 
+// IptablesForeignTailChainPrefixList returns the chain name prefixes in
+// IptablesForeignTailChainPrefixes.
+func (c *Config) IptablesForeignTailChainPrefixList() []string {
+	var prefixes []string
+	for _, prefix := range strings.Split(c.IptablesForeignTailChainPrefixes, ",") {
+		prefix = strings.TrimSpace(prefix)
+		if prefix != "" {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	return prefixes
+}
+
+// IptablesUnmanagedChainList returns the "<table>/<chain>" entries in IptablesUnmanagedChains.
+func (c *Config) IptablesUnmanagedChainList() []string {
+	var chains []string
+	for _, chain := range strings.Split(c.IptablesUnmanagedChains, ",") {
+		chain = strings.TrimSpace(chain)
+		if chain != "" {
+			chains = append(chains, chain)
+		}
+	}
+	return chains
+}
+
 func (config *Config) OpenstackActive() bool {
 	if strings.Contains(strings.ToLower(config.ClusterType), "openstack") {
 		// OpenStack is explicitly known to be present.  Newer versions of the OpenStack plugin
@@ -481,6 +598,8 @@ func loadParams() {
 		case "iface-list":
 			param = &RegexpParam{Regexp: IfaceListRegexp,
 				Msg: "invalid Linux interface name"}
+		case "iface-vlan-list":
+			param = &IfaceVLANListParam{}
 		case "file":
 			param = &FileParam{
 				MustExist:  strings.Contains(kindParams, "must-exist"),
@@ -495,6 +614,10 @@ func loadParams() {
 			param = &EndpointListParam{}
 		case "port-list":
 			param = &PortListParam{}
+		case "cidr-list":
+			param = &CIDRListParam{}
+		case "ip-list":
+			param = &IPListParam{}
 		case "hostname":
 			param = &RegexpParam{Regexp: HostnameRegexp,
 				Msg: "invalid hostname"}
@@ -509,6 +632,12 @@ func loadParams() {
 		case "string":
 			param = &RegexpParam{Regexp: StringRegexp,
 				Msg: "invalid string"}
+		case "log-prefix":
+			param = &RegexpParam{Regexp: LogPrefixRegexp,
+				Msg: "invalid iptables log prefix"}
+		case "hash-comment-prefix":
+			param = &RegexpParam{Regexp: HashCommentPrefixRegexp,
+				Msg: "invalid iptables hash comment prefix"}
 		default:
 			log.Panicf("Unknown type of parameter: %v", kind)
 		}
@@ -74,8 +74,19 @@ var _ = DescribeTable("Config parsing",
 
 	Entry("ChainInsertMode append", "ChainInsertMode", "append", "append"),
 
+	Entry("IptablesBackend auto", "IptablesBackend", "auto", "auto"),
+	Entry("IptablesBackend garbage", "IptablesBackend", "ebpf", "legacy"),
+	Entry("IptablesBackendRecheckInterval", "IptablesBackendRecheckInterval",
+		"30", 30*time.Second),
+	Entry("IptablesBackendMigration", "IptablesBackendMigration", "guided", "guided"),
+	Entry("FirewalldReloadDetectionEnabled", "FirewalldReloadDetectionEnabled",
+		"true", true),
+
 	Entry("IptablesPostWriteCheckIntervalSecs", "IptablesPostWriteCheckIntervalSecs",
 		"1.5", 1500*time.Millisecond),
+	Entry("IptablesPostWriteCheckMaxSecs", "IptablesPostWriteCheckMaxSecs", "600", 600*time.Second),
+	Entry("IptablesPostWriteCheckBackoff", "IptablesPostWriteCheckBackoff", "1.5", 1.5),
+	Entry("IptablesPostWriteCheckEnabled", "IptablesPostWriteCheckEnabled", "false", false),
 	Entry("IptablesLockFilePath", "IptablesLockFilePath",
 		"/host/run/xtables.lock", "/host/run/xtables.lock"),
 	Entry("IptablesLockTimeoutSecs", "IptablesLockTimeoutSecs",
@@ -84,12 +95,73 @@ var _ = DescribeTable("Config parsing",
 		"123", 123*time.Millisecond),
 	Entry("IptablesLockProbeIntervalMillis garbage", "IptablesLockProbeIntervalMillis",
 		"garbage", 50*time.Millisecond),
+	Entry("IptablesVerifyAfterWrite", "IptablesVerifyAfterWrite",
+		"true", true),
+	Entry("IptablesStrictVerify", "IptablesStrictVerify",
+		"true", true),
+	Entry("IptablesPreserveCounters", "IptablesPreserveCounters",
+		"true", true),
+	Entry("IptablesMaxRulesPerChain", "IptablesMaxRulesPerChain",
+		"1000", 1000),
+	Entry("IptablesChainQuarantineThreshold", "IptablesChainQuarantineThreshold",
+		"5", 5),
+	Entry("IptablesTamperDetectionEnabled", "IptablesTamperDetectionEnabled",
+		"true", true),
+	Entry("IptablesCoalesceWindowMillis", "IptablesCoalesceWindowMillis",
+		"100", 100*time.Millisecond),
+	Entry("IptablesInvalidationBurst", "IptablesInvalidationBurst",
+		"5", 5),
+	Entry("IptablesInvalidationIntervalSecs", "IptablesInvalidationIntervalSecs",
+		"10", 10*time.Second),
+	Entry("IptablesStreamRestoreInput", "IptablesStreamRestoreInput",
+		"true", true),
+	Entry("IptablesRestorePreflight", "IptablesRestorePreflight",
+		"true", true),
+	Entry("IptablesMaxLinesPerRestore", "IptablesMaxLinesPerRestore",
+		"10000", 10000),
+	Entry("IptablesChainCleanupDelaySecs", "IptablesChainCleanupDelaySecs",
+		"30", 30*time.Second),
+	Entry("IptablesRuleHashLength", "IptablesRuleHashLength",
+		"12", 12),
+	Entry("IptablesRuleHashAlphabet", "IptablesRuleHashAlphabet",
+		"hex", "hex"),
+	Entry("IptablesRuleHashAlgorithm", "IptablesRuleHashAlgorithm",
+		"sha512", "sha512"),
+	Entry("IptablesRuleHashSalt", "IptablesRuleHashSalt",
+		"s3cret", "s3cret"),
+	Entry("IptablesForeignTailChainPrefixes", "IptablesForeignTailChainPrefixes",
+		"cali-fw-,cali-tw-", "cali-fw-,cali-tw-"),
+	Entry("IptablesForeignRulePolicy", "IptablesForeignRulePolicy",
+		"quarantine", "quarantine"),
+	Entry("IptablesUnmanagedChains", "IptablesUnmanagedChains",
+		"mangle/POSTROUTING", "mangle/POSTROUTING"),
+	Entry("IptablesInsertLeaseFile", "IptablesInsertLeaseFile",
+		"/run/calico/inserts.lease", "/run/calico/inserts.lease"),
+	Entry("IptablesInsertLeaseOwner", "IptablesInsertLeaseOwner",
+		"felix-fork", "felix-fork"),
+	Entry("IptablesInsertLeaseSecs", "IptablesInsertLeaseSecs",
+		"60", 60*time.Second),
+	Entry("IptablesHashCommentPrefix", "IptablesHashCommentPrefix",
+		"acme:", "acme:"),
+	Entry("IptablesHashCommentPrefix with quote", "IptablesHashCommentPrefix",
+		`acme"`, "cali:"),
+	Entry("DebugPacketTraceEnabled", "DebugPacketTraceEnabled",
+		"true", true),
+	Entry("EndpointReadySocket", "EndpointReadySocket",
+		"/var/run/calico/endpoint-ready.sock", "/var/run/calico/endpoint-ready.sock"),
+	Entry("ControlSocket", "ControlSocket",
+		"/var/run/calico/felix-control.sock", "/var/run/calico/felix-control.sock"),
+	Entry("TracingOTLPEndpoint", "TracingOTLPEndpoint",
+		"http://otel-collector:4318/v1/traces", "http://otel-collector:4318/v1/traces"),
 
 	Entry("DefaultEndpointToHostAction", "DefaultEndpointToHostAction",
 		"RETURN", "RETURN"),
 	Entry("DefaultEndpointToHostAction", "DefaultEndpointToHostAction",
 		"ACCEPT", "ACCEPT"),
 
+	Entry("ICMPRelatedErrors", "ICMPRelatedErrors", "Drop", "Drop"),
+	Entry("ICMPRelatedErrors garbage", "ICMPRelatedErrors", "Reject", "Conntrack"),
+
 	Entry("IptablesFilterAllowAction", "IptablesFilterAllowAction",
 		"RETURN", "RETURN"),
 	Entry("IptablesMangleAllowAction", "IptablesMangleAllowAction",
@@ -97,6 +169,10 @@ var _ = DescribeTable("Config parsing",
 
 	Entry("LogFilePath", "LogFilePath", "/tmp/felix.log", "/tmp/felix.log"),
 
+	Entry("LogPrefix", "LogPrefix", "my-prefix", "my-prefix"),
+	Entry("LogPrefix with quote", "LogPrefix", `bad"prefix`, "calico-packet"),
+	Entry("LogPrefix too long", "LogPrefix", "0123456789012345678901234567", "calico-packet"),
+
 	Entry("LogSeverityFile", "LogSeverityFile", "debug", "DEBUG"),
 	Entry("LogSeverityFile", "LogSeverityFile", "warning", "WARNING"),
 	Entry("LogSeverityFile", "LogSeverityFile", "error", "ERROR"),
@@ -188,6 +264,32 @@ var _ = DescribeTable("Config parsing",
 		true,
 	),
 
+	Entry("BreakGlassCIDRs", "BreakGlassCIDRs", "10.0.0.0/8, 192.168.1.5/32",
+		[]string{"10.0.0.0/8", "192.168.1.5/32"}),
+	Entry("BreakGlassCIDRs normalised", "BreakGlassCIDRs", "10.1.2.3/8", []string{"10.0.0.0/8"}),
+	Entry("BreakGlassCIDRs bad -> defaulted", "BreakGlassCIDRs", "10.0.0.1", []string(nil)),
+	Entry("BreakGlassTTL", "BreakGlassTTL", "600", 10*time.Minute),
+	Entry("StandbyActivationFile", "StandbyActivationFile",
+		"/run/calico/activate", "/run/calico/activate"),
+	Entry("DatastoreInSyncTimeoutSecs", "DatastoreInSyncTimeoutSecs", "90", 90*time.Second),
+
+	Entry("NodeLocalDNSAddresses", "NodeLocalDNSAddresses", "169.254.20.10, fd00::a",
+		[]string{"169.254.20.10", "fd00::a"}),
+	Entry("NodeLocalDNSAddresses bad -> defaulted", "NodeLocalDNSAddresses", "169.254.20.0/24", []string(nil)),
+	Entry("NodeLocalDNSPort", "NodeLocalDNSPort", "5353", 5353),
+	Entry("NodeLocalDNSPort bad -> defaulted", "NodeLocalDNSPort", "0", 53),
+
+	Entry("MaxRulesPerPolicy", "MaxRulesPerPolicy", "1000", 1000),
+	Entry("MaxCIDRsPerRule", "MaxCIDRsPerRule", "500", 500),
+	Entry("MaxPolicyChains", "MaxPolicyChains", "20000", 20000),
+
+	Entry("HostEndpointVLANs", "HostEndpointVLANs", "ens1f0:200, ens1f0:100,ens1f1:300,ens1f0:100",
+		map[string][]int{"ens1f0": {100, 200}, "ens1f1": {300}}),
+	Entry("HostEndpointVLANs bad VLAN -> defaulted", "HostEndpointVLANs", "ens1f0:4095",
+		map[string][]int(nil)),
+	Entry("HostEndpointVLANs sub-interface name too long -> defaulted", "HostEndpointVLANs",
+		"enp129s0f0np0:100", map[string][]int(nil)),
+
 	Entry("FailsafeInboundHostPorts none", "FailsafeInboundHostPorts", "none", []ProtoPort(nil)),
 	Entry("FailsafeOutboundHostPorts none", "FailsafeOutboundHostPorts", "none", []ProtoPort(nil)),
 
@@ -304,3 +406,62 @@ var _ = Describe("DatastoreConfig tests", func() {
 		})
 	})
 })
+
+var _ = Describe("Live reload tests", func() {
+	var config *Config
+
+	BeforeEach(func() {
+		config = New()
+		config.UpdateFrom(map[string]string{
+			"IptablesRefreshInterval": "60",
+			"LogSeverityScreen":       "info",
+		}, DatastoreGlobal)
+	})
+
+	It("should allow live reload of iptables tuning changes only", func() {
+		oldRaw := config.RawValues()
+		Expect(OnlyLiveReloadChanges(oldRaw, map[string]string{
+			"IptablesRefreshInterval": "30",
+			"LogSeverityScreen":       "info",
+			"ChainInsertMode":         "append",
+		})).To(BeTrue())
+		Expect(OnlyLiveReloadChanges(oldRaw, map[string]string{
+			"IptablesRefreshInterval":   "60",
+			"LogSeverityScreen":         "info",
+			"IptablesHashCommentPrefix": "acme:",
+		})).To(BeTrue())
+		Expect(OnlyLiveReloadChanges(oldRaw, map[string]string{
+			"IptablesRefreshInterval": "30",
+			"LogSeverityScreen":       "debug",
+		})).To(BeFalse())
+		Expect(OnlyLiveReloadChanges(oldRaw, map[string]string{
+			"IptablesRefreshInterval": "60",
+		})).To(BeFalse())
+		Expect(OnlyLiveReloadChanges(oldRaw, map[string]string{
+			"IptablesRefreshInterval": "60",
+			"LogSeverityScreen":       "info",
+			"IptablesBackend":         "nft",
+		})).To(BeTrue())
+	})
+
+	It("should parse the live reload values", func() {
+		newConfig, err := config.WithLiveReloadValues(map[string]string{
+			"IptablesLockTimeoutSecs": "5",
+			"ChainInsertMode":         "append",
+			"LogSeverityScreen":       "info",
+			"IptablesBackend":         "nft",
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(newConfig.IptablesRefreshInterval).To(Equal(90 * time.Second))
+		Expect(newConfig.IptablesLockTimeoutSecs).To(Equal(5 * time.Second))
+		Expect(newConfig.ChainInsertMode).To(Equal("append"))
+		Expect(newConfig.IptablesBackend).To(Equal("nft"))
+		Expect(config.IptablesRefreshInterval).To(Equal(60 * time.Second))
+		Expect(config.ChainInsertMode).To(Equal("insert"))
+	})
+
+	It("should reject an invalid value", func() {
+		_, err := config.WithLiveReloadValues(map[string]string{"ChainInsertMode": "sideways"})
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,90 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"reflect"
+	"strings"
+)
+
+// liveReloadParams lists the parameters that Felix applies without restarting when they change.
+// They are iptables tuning parameters, which often need to be set per-node (in the node's
+// FelixConfiguration) to suit the node's kernel or distro.  A change to any other parameter
+// still causes a restart since the dataplane would need rebuilding.
+var liveReloadParams = map[string]bool{
+	"IptablesRefreshInterval":         true,
+	"IptablesLockTimeoutSecs":         true,
+	"IptablesLockProbeIntervalMillis": true,
+	"ChainInsertMode":                 true,
+	// Changing the prefix of our rule-tracking comments replaces our rules gradually; see
+	// iptables.Tuning.
+	"IptablesHashCommentPrefix": true,
+	// The dataplane moves our rules to the new backend as it would if it detected a change
+	// of backend; see IptablesBackendMigration.
+	"IptablesBackend": true,
+}
+
+// IsLiveReloadParam returns true if a change to the named parameter can be applied without
+// restarting Felix.
+func IsLiveReloadParam(name string) bool {
+	return liveReloadParams[name]
+}
+
+// OnlyLiveReloadChanges returns true if the only differences between two sets of raw config
+// values, as returned by RawValues() and sent in ConfigUpdate messages, are to parameters that
+// can be applied without restarting Felix.
+func OnlyLiveReloadChanges(oldRaw, newRaw map[string]string) bool {
+	for name, oldValue := range oldRaw {
+		if newValue, ok := newRaw[name]; (!ok || newValue != oldValue) && !liveReloadParams[name] {
+			return false
+		}
+	}
+	for name := range newRaw {
+		if _, ok := oldRaw[name]; !ok && !liveReloadParams[name] {
+			return false
+		}
+	}
+	return true
+}
+
+// WithLiveReloadValues returns a copy of the config with the parameters that can be applied
+// without a restart parsed from the given raw values, which should be a complete set of raw
+// values, as sent in a ConfigUpdate message.  Parameters that are missing from the raw values
+// revert to their defaults.
+func (config *Config) WithLiveReloadValues(newRaw map[string]string) (*Config, error) {
+	newConfig := *config
+	newConfig.rawValues = make(map[string]string, len(newRaw))
+	for name, value := range newRaw {
+		newConfig.rawValues[name] = value
+	}
+	for name := range liveReloadParams {
+		param := knownParams[strings.ToLower(name)]
+		metadata := param.GetMetadata()
+		value := metadata.Default
+		if rawValue, ok := newRaw[name]; ok {
+			if strings.ToLower(rawValue) == "none" && !metadata.NonZero {
+				value = metadata.ZeroValue
+			} else {
+				var err error
+				value, err = param.Parse(rawValue)
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+		reflect.ValueOf(&newConfig).Elem().FieldByName(name).Set(reflect.ValueOf(value))
+	}
+	return &newConfig, nil
+}
@@ -23,6 +23,7 @@ import (
 	"os/exec"
 	"reflect"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -323,6 +324,89 @@ func (p *EndpointListParam) Parse(raw string) (result interface{}, err error) {
 	return
 }
 
+type CIDRListParam struct {
+	Metadata
+}
+
+func (p *CIDRListParam) Parse(raw string) (interface{}, error) {
+	result := []string{}
+	for _, cidr := range strings.Split(raw, ",") {
+		cidr = strings.Trim(cidr, " ")
+		if cidr == "" {
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, p.parseFailed(raw, fmt.Sprintf("%v is not a valid CIDR", cidr))
+		}
+		result = append(result, ipNet.String())
+	}
+	return result, nil
+}
+
+type IPListParam struct {
+	Metadata
+}
+
+func (p *IPListParam) Parse(raw string) (interface{}, error) {
+	result := []string{}
+	for _, ipStr := range strings.Split(raw, ",") {
+		ipStr = strings.Trim(ipStr, " ")
+		if ipStr == "" {
+			continue
+		}
+		ip := net.ParseIP(ipStr)
+		if ip == nil {
+			return nil, p.parseFailed(raw, fmt.Sprintf("%v is not a valid IP", ipStr))
+		}
+		result = append(result, ip.String())
+	}
+	return result, nil
+}
+
+type IfaceVLANListParam struct {
+	Metadata
+}
+
+func (p *IfaceVLANListParam) Parse(raw string) (interface{}, error) {
+	result := map[string][]int{}
+	for _, pair := range strings.Split(raw, ",") {
+		pair = strings.Trim(pair, " ")
+		if pair == "" {
+			continue
+		}
+		parts := strings.Split(pair, ":")
+		if len(parts) != 2 {
+			return nil, p.parseFailed(raw, "entries should be of the form <iface>:<vlan>")
+		}
+		ifaceName := parts[0]
+		vlan, err := strconv.Atoi(parts[1])
+		if err != nil || vlan < 1 || vlan > 4094 {
+			return nil, p.parseFailed(raw, "VLAN IDs must be in range 1-4094")
+		}
+		if !IfaceListRegexp.MatchString(ifaceName) {
+			return nil, p.parseFailed(raw, fmt.Sprintf("invalid Linux interface name %v", ifaceName))
+		}
+		if len(ifaceName)+1+len(strconv.Itoa(vlan)) > 15 {
+			return nil, p.parseFailed(raw,
+				fmt.Sprintf("VLAN sub-interface name %v.%v is too long", ifaceName, vlan))
+		}
+		duplicate := false
+		for _, v := range result[ifaceName] {
+			if v == vlan {
+				duplicate = true
+			}
+		}
+		if !duplicate {
+			result[ifaceName] = append(result[ifaceName], vlan)
+		}
+	}
+	for _, vlans := range result {
+		sort.Ints(vlans)
+	}
+	return result, nil
+}
+
 type MarkBitmaskParam struct {
 	Metadata
 }
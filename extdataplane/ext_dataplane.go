@@ -165,6 +165,8 @@ func (fc *extDataplaneConn) SendMessage(msg interface{}) error {
 		envelope.Payload = &proto.ToDataplane_IpamPoolUpdate{msg}
 	case *proto.IPAMPoolRemove:
 		envelope.Payload = &proto.ToDataplane_IpamPoolRemove{msg}
+	case *proto.DatastoreUpdateBatch:
+		envelope.Payload = &proto.ToDataplane_DatastoreUpdateBatch{msg}
 	default:
 		log.WithField("msg", msg).Panic("Unknown message type")
 	}
@@ -47,10 +47,14 @@ import (
 	"github.com/projectcalico/felix/extdataplane"
 	"github.com/projectcalico/felix/intdataplane"
 	"github.com/projectcalico/felix/ipsets"
+	"github.com/projectcalico/felix/iptables"
 	"github.com/projectcalico/felix/logutils"
 	"github.com/projectcalico/felix/proto"
 	"github.com/projectcalico/felix/rules"
+	"github.com/projectcalico/felix/selftest"
 	"github.com/projectcalico/felix/statusrep"
+	"github.com/projectcalico/felix/supportmatrix"
+	"github.com/projectcalico/felix/tracing"
 	"github.com/projectcalico/felix/usagerep"
 	"github.com/projectcalico/libcalico-go/lib/backend"
 	bapi "github.com/projectcalico/libcalico-go/lib/backend/api"
@@ -63,6 +67,18 @@ const usage = `Felix, the Calico per-host daemon.
 
 Usage:
   calico-felix [options]
+  calico-felix selftest
+  calico-felix support-matrix
+  calico-felix take-over-inserts <lease-file> [<owner>]
+
+Commands:
+  selftest                     Exercise the iptables programming machinery in a scratch
+                               network namespace, report pass/fail and exit.
+  support-matrix               Probe the host for the dataplane features that Felix can
+                               use, print them as JSON and exit.
+  take-over-inserts            Hand the lease on the kernel chain inserts (see the
+                               IptablesInsertLeaseFile config parameter) to the agent
+                               with the given owner ID (calico-felix if omitted) and exit.
 
 Options:
   -c --config-file=<filename>  Config file to load [default: /etc/calico/felix.cfg].
@@ -128,6 +144,33 @@ func main() {
 		println(usage)
 		log.Fatalf("Failed to parse usage, exiting: %v", err)
 	}
+	if arguments["selftest"] == true {
+		// Check that we can program iptables on this host, without touching its rules.
+		if !selftest.Run(os.Stdout) {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	if arguments["support-matrix"] == true {
+		// Report which dataplane modes this host supports, for installers to act on.
+		if err := supportmatrix.Write(os.Stdout); err != nil {
+			log.WithError(err).Fatal("Failed to write support matrix")
+		}
+		os.Exit(0)
+	}
+	if arguments["take-over-inserts"] == true {
+		// Stop another agent on this host from programming the kernel chain inserts.
+		leaseFile := arguments["<lease-file>"].(string)
+		owner, _ := arguments["<owner>"].(string)
+		if owner == "" {
+			owner = "calico-felix"
+		}
+		if err := iptables.TakeOverInsertLease(leaseFile, owner); err != nil {
+			log.WithError(err).Fatal("Failed to take over insert lease")
+		}
+		fmt.Printf("Insert lease in %s now held by %q.\n", leaseFile, owner)
+		os.Exit(0)
+	}
 	buildInfoLogCxt := log.WithFields(log.Fields{
 		"version":    buildinfo.GitVersion,
 		"buildDate":  buildinfo.BuildDate,
@@ -287,18 +330,58 @@ configRetry:
 				FailsafeOutboundHostPorts: configParams.FailsafeOutboundHostPorts,
 
 				DisableConntrackInvalid: configParams.DisableConntrackInvalidCheck,
+				ICMPRelatedErrors:       configParams.ICMPRelatedErrors,
+
+				NodeLocalDNSAddresses: configParams.NodeLocalDNSAddresses,
+				NodeLocalDNSPort:      uint16(configParams.NodeLocalDNSPort),
+
+				MaxRulesPerPolicy: configParams.MaxRulesPerPolicy,
+				MaxCIDRsPerRule:   configParams.MaxCIDRsPerRule,
+
+				HostEndpointVLANs: configParams.HostEndpointVLANs,
 			},
 			IPIPMTU:                        configParams.IpInIpMtu,
 			IptablesBackend:                configParams.IptablesBackend,
+			IptablesBackendRecheckInterval: configParams.IptablesBackendRecheckInterval,
+			IptablesBackendMigration:       configParams.IptablesBackendMigration,
+			FirewalldReloadDetection:       configParams.FirewalldReloadDetectionEnabled,
 			IptablesRefreshInterval:        configParams.IptablesRefreshInterval,
 			RouteRefreshInterval:           configParams.RouteRefreshInterval,
 			IPSetsRefreshInterval:          configParams.IpsetsRefreshInterval,
 			IptablesPostWriteCheckInterval: configParams.IptablesPostWriteCheckIntervalSecs,
+			IptablesPostWriteCheckMax:      configParams.IptablesPostWriteCheckMaxSecs,
+			IptablesPostWriteCheckBackoff:  configParams.IptablesPostWriteCheckBackoff,
+			IptablesPostWriteCheckDisabled: !configParams.IptablesPostWriteCheckEnabled,
 			IptablesInsertMode:             configParams.ChainInsertMode,
 			IptablesLockFilePath:           configParams.IptablesLockFilePath,
 			IptablesLockTimeout:            configParams.IptablesLockTimeoutSecs,
 			IptablesLockProbeInterval:      configParams.IptablesLockProbeIntervalMillis,
+			IptablesVerifyAfterWrite:       configParams.IptablesVerifyAfterWrite,
+			IptablesStrictVerify:           configParams.IptablesStrictVerify,
+			IptablesPreserveCounters:       configParams.IptablesPreserveCounters,
+			IptablesMaxRulesPerChain:       configParams.IptablesMaxRulesPerChain,
+			IptablesQuarantineThreshold:    configParams.IptablesChainQuarantineThreshold,
+			IptablesTamperDetection:        configParams.IptablesTamperDetectionEnabled,
+			IptablesCoalesceWindow:         configParams.IptablesCoalesceWindowMillis,
+			IptablesInvalidationBurst:      configParams.IptablesInvalidationBurst,
+			IptablesInvalidationInterval:   configParams.IptablesInvalidationIntervalSecs,
+			IptablesStreamRestoreInput:     configParams.IptablesStreamRestoreInput,
+			IptablesRestorePreflight:       configParams.IptablesRestorePreflight,
+			IptablesMaxLinesPerRestore:     configParams.IptablesMaxLinesPerRestore,
+			IptablesChainCleanupDelay:      configParams.IptablesChainCleanupDelaySecs,
+			IptablesRuleHashLength:         configParams.IptablesRuleHashLength,
+			IptablesRuleHashAlphabet:       configParams.IptablesRuleHashAlphabet,
+			IptablesRuleHashAlgorithm:      configParams.IptablesRuleHashAlgorithm,
+			IptablesRuleHashSalt:           configParams.IptablesRuleHashSalt,
+			IptablesForeignTailChains:      configParams.IptablesForeignTailChainPrefixList(),
+			IptablesForeignRulePolicy:      configParams.IptablesForeignRulePolicy,
+			IptablesUnmanagedChains:        configParams.IptablesUnmanagedChainList(),
+			IptablesInsertLeaseFile:        configParams.IptablesInsertLeaseFile,
+			IptablesInsertLeaseOwner:       configParams.IptablesInsertLeaseOwner,
+			IptablesInsertLeaseDuration:    configParams.IptablesInsertLeaseSecs,
+			IptablesHashCommentPrefix:      configParams.IptablesHashCommentPrefix,
 			MaxIPSetSize:                   configParams.MaxIpsetSize,
+			MaxPolicyChains:                configParams.MaxPolicyChains,
 			IgnoreLooseRPF:                 configParams.IgnoreLooseRPF,
 			IPv6Enabled:                    configParams.Ipv6Support,
 			StatusReportingInterval:        configParams.ReportingIntervalSecs,
@@ -309,10 +392,58 @@ configRetry:
 			HealthAggregator:   healthAggregator,
 
 			DebugSimulateDataplaneHangAfter: configParams.DebugSimulateDataplaneHangAfter,
+
+			BreakGlassFile:  configParams.BreakGlassFile,
+			BreakGlassCIDRs: configParams.BreakGlassCIDRs,
+			BreakGlassTTL:   configParams.BreakGlassTTL,
+
+			StandbyActivationFile:  configParams.StandbyActivationFile,
+			PacketTraceEnabled:     configParams.DebugPacketTraceEnabled,
+			DatastoreInSyncTimeout: configParams.DatastoreInSyncTimeoutSecs,
+		}
+		if configParams.TracingOTLPEndpoint != "" {
+			log.WithField("endpoint", configParams.TracingOTLPEndpoint).Info(
+				"Exporting dataplane update traces.")
+			tracer := tracing.NewOTLPTracer(configParams.TracingOTLPEndpoint, configParams.FelixHostname)
+			tracer.Start()
+			dpConfig.Tracer = tracer
 		}
 		intDP := intdataplane.NewIntDataplaneDriver(dpConfig)
 		intDP.Start()
 		dpDriver = intDP
+
+		// Let configuration review tools fetch the static chains that we render for the
+		// current config.  Served alongside the Prometheus metrics, if they're enabled.
+		http.HandleFunc("/static-chains", intDP.ServeStaticChains)
+		// Dump the state of our iptables tables, for attaching to bug reports.
+		http.HandleFunc("/iptables-snapshot", intDP.ServeIptablesSnapshot)
+		if configParams.ControlSocket != "" {
+			// Serve the operations that change the dataplane, such as warm standby
+			// activation and packet traces, on a Unix socket rather than alongside the
+			// Prometheus metrics.
+			go func() {
+				for {
+					err := intDP.ServeControlAPI(configParams.ControlSocket)
+					log.WithError(err).Error(
+						"Control API failed, trying to restart it...")
+					time.Sleep(1 * time.Second)
+				}
+			}()
+		} else if configParams.DebugPacketTraceEnabled {
+			log.Warn("DebugPacketTraceEnabled is set but ControlSocket isn't, packet traces are unavailable.")
+		}
+		if configParams.EndpointReadySocket != "" {
+			// Let the CNI plugin wait for a new pod's policy to be in place before it
+			// completes the pod's set-up.
+			go func() {
+				for {
+					err := intDP.ServeEndpointReadiness(configParams.EndpointReadySocket)
+					log.WithError(err).Error(
+						"Endpoint readiness API failed, trying to restart it...")
+					time.Sleep(1 * time.Second)
+				}
+			}()
+		}
 	} else {
 		log.WithField("driver", configParams.DataplaneDriver).Info(
 			"Using external dataplane driver.")
@@ -818,8 +949,16 @@ func (fc *DataplaneConnector) sendMessagesToDataplaneDriver() {
 			})
 			logCxt.Info("Possible config update")
 			if config != nil && !reflect.DeepEqual(msg.Config, config) {
-				logCxt.Warn("Felix configuration changed. Need to restart.")
-				fc.shutDownProcess("config changed")
+				if fc.applyLiveConfigUpdate(config, msg.Config) {
+					logCxt.Info("Applied config update without restarting.")
+					config = make(map[string]string)
+					for k, v := range msg.Config {
+						config[k] = v
+					}
+				} else {
+					logCxt.Warn("Felix configuration changed. Need to restart.")
+					fc.shutDownProcess("config changed")
+				}
 			} else if config == nil {
 				logCxt.Info("Config resolved.")
 				config = make(map[string]string)
@@ -837,6 +976,29 @@ func (fc *DataplaneConnector) sendMessagesToDataplaneDriver() {
 	}
 }
 
+// applyLiveConfigUpdate passes a config update to the dataplane without restarting, if the only
+// changes are to parameters that the dataplane can apply live (see config.IsLiveReloadParam).
+// Returns false if Felix needs to restart instead.
+func (fc *DataplaneConnector) applyLiveConfigUpdate(oldRaw, newRaw map[string]string) bool {
+	if !fc.config.UseInternalDataplaneDriver || !config.OnlyLiveReloadChanges(oldRaw, newRaw) {
+		return false
+	}
+	newConfig, err := fc.config.WithLiveReloadValues(newRaw)
+	if err != nil {
+		log.WithError(err).Warn("Failed to parse config update")
+		return false
+	}
+	err = fc.dataplane.SendMessage(&intdataplane.IptablesTuningUpdate{
+		RefreshInterval:   newConfig.IptablesRefreshInterval,
+		InsertMode:        newConfig.ChainInsertMode,
+		LockTimeout:       newConfig.IptablesLockTimeoutSecs,
+		LockProbeInterval: newConfig.IptablesLockProbeIntervalMillis,
+		HashCommentPrefix: newConfig.IptablesHashCommentPrefix,
+		Backend:           newConfig.IptablesBackend,
+	})
+	return err == nil
+}
+
 func (fc *DataplaneConnector) shutDownProcess(reason string) {
 	// Send a failure report to the managed shutdown thread then give it
 	// a few seconds to do the shutdown.
@@ -0,0 +1,139 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package firewalld watches for firewalld reloads.  When firewalld reloads or restarts, it
+// rewrites the iptables tables wholesale, removing all of Felix's rules, so Felix should re-read
+// and repair the dataplane straight away rather than waiting for its next refresh.
+package firewalld
+
+import (
+	"bufio"
+	"io"
+	"os/exec"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	firewalldInterface = "org.fedoraproject.FirewallD1"
+
+	// restartDelay is how long we wait before restarting dbus-monitor after it exits.
+	restartDelay = 30 * time.Second
+)
+
+// matchRules are the D-Bus match rules for the signals that we're interested in: firewalld's
+// Reloaded signal and changes of ownership of its bus name, which happen when it restarts.
+var matchRules = []string{
+	"type='signal',interface='" + firewalldInterface + "',member='Reloaded'",
+	"type='signal',sender='org.freedesktop.DBus',member='NameOwnerChanged',arg0='" + firewalldInterface + "'",
+}
+
+// Cmd is the subset of exec.Cmd that we use, so that it can be shimmed in tests.
+type Cmd interface {
+	StdoutPipe() (io.ReadCloser, error)
+	Start() error
+	Wait() error
+}
+
+type CmdFactory func(name string, arg ...string) Cmd
+
+func newRealCmd(name string, arg ...string) Cmd {
+	return exec.Command(name, arg...)
+}
+
+// ReloadMonitor listens for firewalld reloads on the system D-Bus.  To avoid a dependency on a
+// D-Bus client library, it runs dbus-monitor and parses its output.
+type ReloadMonitor struct {
+	// Callback is called, from the monitor's goroutine, each time firewalld reloads or
+	// restarts.
+	Callback func()
+
+	newCmd CmdFactory
+	sleep  func(time.Duration)
+}
+
+func New(callback func()) *ReloadMonitor {
+	return NewWithStubs(callback, newRealCmd, time.Sleep)
+}
+
+func NewWithStubs(callback func(), newCmd CmdFactory, sleep func(time.Duration)) *ReloadMonitor {
+	return &ReloadMonitor{
+		Callback: callback,
+		newCmd:   newCmd,
+		sleep:    sleep,
+	}
+}
+
+// MonitorReloads runs dbus-monitor and calls the callback for each reload.  It never returns;
+// if dbus-monitor fails or exits, it is restarted after a delay.
+func (m *ReloadMonitor) MonitorReloads() {
+	log.Info("firewalld reload monitoring thread started.")
+	failures := 0
+	for {
+		err := m.monitorOnce()
+		logCxt := log.WithError(err).WithField("retryAfter", restartDelay)
+		if failures == 0 {
+			logCxt.Warn("firewalld reload monitor stopped, will restart it")
+		} else {
+			// Most likely dbus-monitor isn't installed; don't spam the log.
+			logCxt.Debug("firewalld reload monitor stopped again, will restart it")
+		}
+		failures++
+		m.sleep(restartDelay)
+	}
+}
+
+// monitorOnce runs dbus-monitor until it exits.
+func (m *ReloadMonitor) monitorOnce() error {
+	args := append([]string{"--system"}, matchRules...)
+	cmd := m.newCmd("dbus-monitor", args...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	log.Info("Listening for firewalld reloads")
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		if isReloadSignal(scanner.Text()) {
+			log.Info("firewalld reloaded")
+			m.Callback()
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		log.WithError(err).Warn("Failed to read from dbus-monitor")
+	}
+	return cmd.Wait()
+}
+
+// isReloadSignal returns true if the given line of dbus-monitor output is the header of one of
+// the signals that we're interested in, such as "signal time=1556000000.1 sender=:1.5 ->
+// destination=(null destination) serial=12 path=/org/fedoraproject/FirewallD1;
+// interface=org.fedoraproject.FirewallD1; member=Reloaded".  dbus-monitor also reports signals
+// about its own connection to the bus, which we ignore.
+func isReloadSignal(line string) bool {
+	if !strings.HasPrefix(line, "signal ") {
+		return false
+	}
+	if strings.Contains(line, "interface="+firewalldInterface+";") &&
+		strings.HasSuffix(line, "member=Reloaded") {
+		return true
+	}
+	// Our match rule filters NameOwnerChanged by bus name so any we see are for firewalld.
+	return strings.HasSuffix(line, "member=NameOwnerChanged")
+}
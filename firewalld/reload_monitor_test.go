@@ -0,0 +1,111 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package firewalld
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+const (
+	ownConnectionSignal = "signal time=1556000000.0 sender=org.freedesktop.DBus -> destination=:1.9 " +
+		"serial=2 path=/org/freedesktop/DBus; interface=org.freedesktop.DBus; member=NameAcquired"
+	reloadedSignal = "signal time=1556000000.1 sender=:1.5 -> destination=(null destination) " +
+		"serial=12 path=/org/fedoraproject/FirewallD1; interface=org.fedoraproject.FirewallD1; " +
+		"member=Reloaded"
+	ownerChangedSignal = "signal time=1556000000.2 sender=org.freedesktop.DBus -> " +
+		"destination=(null destination) serial=7 path=/org/freedesktop/DBus; " +
+		"interface=org.freedesktop.DBus; member=NameOwnerChanged"
+)
+
+type mockCmd struct {
+	output   string
+	startErr error
+	args     []string
+}
+
+func (c *mockCmd) StdoutPipe() (io.ReadCloser, error) {
+	return ioutil.NopCloser(strings.NewReader(c.output)), nil
+}
+
+func (c *mockCmd) Start() error {
+	return c.startErr
+}
+
+func (c *mockCmd) Wait() error {
+	return nil
+}
+
+var _ = Describe("isReloadSignal", func() {
+	It("should spot a reload", func() {
+		Expect(isReloadSignal(reloadedSignal)).To(BeTrue())
+	})
+	It("should spot a restart", func() {
+		Expect(isReloadSignal(ownerChangedSignal)).To(BeTrue())
+	})
+	It("should ignore dbus-monitor's own signals", func() {
+		Expect(isReloadSignal(ownConnectionSignal)).To(BeFalse())
+	})
+	It("should ignore signal arguments", func() {
+		Expect(isReloadSignal(`   string "member=Reloaded"`)).To(BeFalse())
+	})
+})
+
+var _ = Describe("ReloadMonitor", func() {
+	var cmd *mockCmd
+	var numReloads int
+	var monitor *ReloadMonitor
+
+	BeforeEach(func() {
+		numReloads = 0
+		cmd = &mockCmd{}
+		monitor = NewWithStubs(
+			func() {
+				numReloads++
+			},
+			func(name string, arg ...string) Cmd {
+				Expect(name).To(Equal("dbus-monitor"))
+				cmd.args = arg
+				return cmd
+			},
+			func(time.Duration) {},
+		)
+	})
+
+	It("should call the callback for each reload", func() {
+		cmd.output = strings.Join([]string{
+			ownConnectionSignal,
+			reloadedSignal,
+			`   string "ignored"`,
+			ownerChangedSignal,
+		}, "\n") + "\n"
+		Expect(monitor.monitorOnce()).To(Succeed())
+		Expect(numReloads).To(Equal(2))
+		Expect(cmd.args[0]).To(Equal("--system"))
+		Expect(cmd.args[1:]).To(Equal(matchRules))
+	})
+
+	It("should return an error if dbus-monitor can't be started", func() {
+		cmd.startErr = errors.New("not found")
+		Expect(monitor.monitorOnce()).To(HaveOccurred())
+		Expect(numReloads).To(Equal(0))
+	})
+})
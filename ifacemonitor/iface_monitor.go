@@ -43,14 +43,23 @@ const (
 type InterfaceStateCallback func(ifaceName string, ifaceState State)
 type AddrStateCallback func(ifaceName string, addrs set.Set)
 
+// AliasChangedCallback is called when the alias (IFLA_IFALIAS) of an interface changes.  alias
+// is "" if the alias has been cleared or the interface has gone away.
+type AliasChangedCallback func(ifaceName string, alias string)
+
 type InterfaceMonitor struct {
 	netlinkStub  netlinkStub
 	resyncC      <-chan time.Time
 	upIfaces     set.Set
 	Callback     InterfaceStateCallback
 	AddrCallback AddrStateCallback
-	ifaceName    map[int]string
-	ifaceAddrs   map[int]set.Set
+	// AliasCallback, if set, is called whenever an interface's alias changes.  Note: the
+	// netlink library doesn't decode alternative names (IFLA_ALT_IFNAME) so only the alias is
+	// reported.
+	AliasCallback AliasChangedCallback
+	ifaceName     map[int]string
+	ifaceAddrs    map[int]set.Set
+	ifaceAlias    map[int]string
 }
 
 func New() *InterfaceMonitor {
@@ -66,6 +75,7 @@ func NewWithStubs(netlinkStub netlinkStub, resyncC <-chan time.Time) *InterfaceM
 		upIfaces:    set.New(),
 		ifaceName:   map[int]string{},
 		ifaceAddrs:  map[int]set.Set{},
+		ifaceAlias:  map[int]string{},
 	}
 }
 
@@ -187,6 +197,28 @@ func (m *InterfaceMonitor) notifyIfaceAddrs(ifIndex int) {
 	}
 }
 
+// storeAndNotifyAlias records the new alias of the given interface and, if it has changed,
+// notifies the alias callback.
+func (m *InterfaceMonitor) storeAndNotifyAlias(ifIndex int, ifaceName string, alias string) {
+	oldAlias := m.ifaceAlias[ifIndex]
+	if alias == "" {
+		delete(m.ifaceAlias, ifIndex)
+	} else {
+		m.ifaceAlias[ifIndex] = alias
+	}
+	if alias == oldAlias {
+		return
+	}
+	log.WithFields(log.Fields{
+		"ifaceName": ifaceName,
+		"oldAlias":  oldAlias,
+		"newAlias":  alias,
+	}).Info("Interface alias changed.")
+	if m.AliasCallback != nil {
+		m.AliasCallback(ifaceName, alias)
+	}
+}
+
 func (m *InterfaceMonitor) storeAndNotifyLink(ifaceExists bool, link netlink.Link) {
 	log.WithFields(log.Fields{
 		"ifaceExists": ifaceExists,
@@ -220,10 +252,12 @@ func (m *InterfaceMonitor) storeAndNotifyLinkInner(ifaceExists bool, ifaceName s
 	ifIndex := attrs.Index
 	if ifaceExists {
 		m.ifaceName[ifIndex] = ifaceName
+		m.storeAndNotifyAlias(ifIndex, ifaceName, attrs.Alias)
 	} else {
 		log.Debug("Notify link non-existence to address callback consumers")
 		delete(m.ifaceAddrs, ifIndex)
 		m.notifyIfaceAddrs(ifIndex)
+		m.storeAndNotifyAlias(ifIndex, ifaceName, "")
 		delete(m.ifaceName, ifIndex)
 	}
 
@@ -288,6 +322,11 @@ func (m *InterfaceMonitor) resync() error {
 		currentIfaces.Add(attrs.Name)
 		m.storeAndNotifyLink(true, link)
 	}
+	for ifIndex, name := range m.ifaceName {
+		if !currentIfaces.Contains(name) {
+			m.storeAndNotifyAlias(ifIndex, name, "")
+		}
+	}
 	m.upIfaces.Iter(func(name interface{}) error {
 		if currentIfaces.Contains(name) {
 			return nil
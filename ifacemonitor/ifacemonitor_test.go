@@ -34,6 +34,7 @@ type linkModel struct {
 	index int
 	state string
 	addrs set.Set
+	alias string
 }
 
 type netlinkTest struct {
@@ -61,9 +62,15 @@ type linkUpdate struct {
 	state ifacemonitor.State
 }
 
+type aliasUpdate struct {
+	name  string
+	alias string
+}
+
 type mockDataplane struct {
-	linkC chan linkUpdate
-	addrC chan addrState
+	linkC  chan linkUpdate
+	addrC  chan addrState
+	aliasC chan aliasUpdate
 }
 
 func (nl *netlinkTest) addLink(name string) {
@@ -91,6 +98,15 @@ func (nl *netlinkTest) renameLink(oldName, newName string) {
 	nl.signalLink(newName, 0)
 }
 
+func (nl *netlinkTest) setLinkAlias(name string, alias string) {
+	nl.linksMutex.Lock()
+	link := nl.links[name]
+	link.alias = alias
+	nl.links[name] = link
+	nl.linksMutex.Unlock()
+	nl.signalLink(name, 0)
+}
+
 func (nl *netlinkTest) changeLinkState(name string, state string) {
 	nl.linksMutex.Lock()
 	link := nl.links[name]
@@ -118,6 +134,7 @@ func (nl *netlinkTest) signalLink(name string, oldIndex int) {
 	// Values for a link that does not exist...
 	index := oldIndex
 	var rawFlags uint32 = 0
+	var alias string
 	var msgType uint16 = syscall.RTM_DELLINK
 
 	// If the link does exist, overwrite appropriately.
@@ -126,6 +143,7 @@ func (nl *netlinkTest) signalLink(name string, oldIndex int) {
 	if prs {
 		msgType = syscall.RTM_NEWLINK
 		index = link.index
+		alias = link.alias
 		if link.state == "up" {
 			rawFlags = syscall.IFF_RUNNING
 		}
@@ -142,6 +160,7 @@ func (nl *netlinkTest) signalLink(name string, oldIndex int) {
 				Name:     name,
 				Index:    index,
 				RawFlags: rawFlags,
+				Alias:    alias,
 			},
 		},
 	}
@@ -213,6 +232,7 @@ func (nl *netlinkTest) LinkList() ([]netlink.Link, error) {
 				Name:     name,
 				Index:    link.index,
 				RawFlags: rawFlags,
+				Alias:    link.alias,
 			},
 		})
 	}
@@ -311,6 +331,23 @@ func (dp *mockDataplane) expectAddrStateCb(ifaceName string, addr string, presen
 	}
 }
 
+func (dp *mockDataplane) aliasCallback(ifaceName string, alias string) {
+	log.WithFields(log.Fields{
+		"ifaceName": ifaceName,
+		"alias":     alias,
+	}).Info("Alias changed")
+	dp.aliasC <- aliasUpdate{name: ifaceName, alias: alias}
+	log.Info("mock dataplane reported alias callback")
+}
+
+func (dp *mockDataplane) expectAliasCb(ifaceName string, alias string) {
+	upd := <-dp.aliasC
+	Expect(upd).To(Equal(aliasUpdate{
+		name:  ifaceName,
+		alias: alias,
+	}))
+}
+
 var _ = Describe("ifacemonitor", func() {
 	var nl *netlinkTest
 	var resyncC chan time.Time
@@ -335,11 +372,13 @@ var _ = Describe("ifacemonitor", func() {
 		// expectAddrStateCb takes care to check that we eventually get the callback that we
 		// expect.
 		dp = &mockDataplane{
-			linkC: make(chan linkUpdate, 1),
-			addrC: make(chan addrState, 2),
+			linkC:  make(chan linkUpdate, 1),
+			addrC:  make(chan addrState, 2),
+			aliasC: make(chan aliasUpdate, 1),
 		}
 		im.Callback = dp.linkStateCallback
 		im.AddrCallback = dp.addrStateCallback
+		im.AliasCallback = dp.aliasCallback
 
 		// Start the monitor running, and wait until it has subscribed to our test netlink
 		// stub.
@@ -439,4 +478,33 @@ var _ = Describe("ifacemonitor", func() {
 		resyncC <- time.Time{}
 		resyncC <- time.Time{}
 	})
+
+	It("should report interface alias changes", func() {
+		nl.addLink("eth0")
+		resyncC <- time.Time{}
+		dp.expectAddrStateCb("eth0", "", true)
+
+		// Setting an alias should be reported; re-signalling the same alias should not.
+		nl.setLinkAlias("eth0", "uplink-a")
+		dp.expectAliasCb("eth0", "uplink-a")
+		nl.changeLinkState("eth0", "up")
+		dp.expectLinkStateCb("eth0", ifacemonitor.StateUp)
+
+		// Change and then clear the alias.
+		nl.setLinkAlias("eth0", "uplink-b")
+		dp.expectAliasCb("eth0", "uplink-b")
+		nl.setLinkAlias("eth0", "")
+		dp.expectAliasCb("eth0", "")
+
+		// Deleting the link should clear the alias.
+		nl.setLinkAlias("eth0", "uplink-c")
+		dp.expectAliasCb("eth0", "uplink-c")
+		nl.delLink("eth0")
+		dp.expectLinkStateCb("eth0", ifacemonitor.StateDown)
+		dp.expectAddrStateCb("eth0", "", false)
+		dp.expectAliasCb("eth0", "")
+
+		resyncC <- time.Time{}
+		resyncC <- time.Time{}
+	})
 })
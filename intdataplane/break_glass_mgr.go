@@ -0,0 +1,120 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intdataplane
+
+import (
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/projectcalico/felix/rules"
+)
+
+// breakGlassManager manages the break-glass chains, which give operators a supported way to
+// regain access to a node whose policy locks them out.  Break-glass access is enabled by
+// creating (or touching) the configured file; it stays enabled until the file is removed or
+// its modification time is older than the TTL.  While enabled, the chains accept all traffic
+// to/from the management CIDRs ahead of all other Calico rules.
+//
+// Since use of break-glass access bypasses policy, each transition is logged as an audit
+// event.
+type breakGlassManager struct {
+	ipVersion    uint8
+	filterTable  iptablesTable
+	ruleRenderer rules.RuleRenderer
+
+	file  string
+	cidrs []string
+	ttl   time.Duration
+
+	active bool
+	dirty  bool
+
+	// Shims for test purposes.
+	statFile func(name string) (os.FileInfo, error)
+	timeNow  func() time.Time
+
+	logCxt *log.Entry
+}
+
+func newBreakGlassManager(
+	filterTable iptablesTable,
+	ruleRenderer rules.RuleRenderer,
+	file string,
+	cidrs []string,
+	ttl time.Duration,
+	ipVersion uint8,
+) *breakGlassManager {
+	return &breakGlassManager{
+		ipVersion:    ipVersion,
+		filterTable:  filterTable,
+		ruleRenderer: ruleRenderer,
+		file:         file,
+		cidrs:        cidrs,
+		ttl:          ttl,
+		dirty:        true,
+		statFile:     os.Stat,
+		timeNow:      time.Now,
+		logCxt:       log.WithField("ipVersion", ipVersion),
+	}
+}
+
+func (m *breakGlassManager) OnUpdate(msg interface{}) {
+}
+
+// CheckFile re-examines the break-glass file and returns true if break-glass access has been
+// enabled or disabled as a result.  It is called periodically since the TTL may expire
+// without any other dataplane activity.
+func (m *breakGlassManager) CheckFile() bool {
+	active := false
+	var expiry time.Time
+	info, err := m.statFile(m.file)
+	if err == nil {
+		expiry = info.ModTime().Add(m.ttl)
+		active = m.timeNow().Before(expiry)
+	} else if !os.IsNotExist(err) {
+		m.logCxt.WithError(err).WithField("file", m.file).Warn(
+			"Failed to stat break-glass file, treating break-glass access as disabled")
+	}
+	if active == m.active {
+		return false
+	}
+
+	m.active = active
+	m.dirty = true
+	logCxt := m.logCxt.WithFields(log.Fields{
+		"audit": "break-glass",
+		"file":  m.file,
+		"cidrs": m.cidrs,
+	})
+	if active {
+		logCxt.WithField("expiry", expiry).Warn(
+			"Break-glass access enabled: accepting all traffic to/from the management CIDRs")
+	} else {
+		logCxt.Warn("Break-glass access disabled")
+	}
+	return true
+}
+
+func (m *breakGlassManager) CompleteDeferredWork() error {
+	m.CheckFile()
+	if !m.dirty {
+		return nil
+	}
+	m.filterTable.UpdateChains(m.ruleRenderer.BreakGlassChains(m.cidrs, m.active, m.ipVersion))
+	m.dirty = false
+	return nil
+}
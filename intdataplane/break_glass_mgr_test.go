@@ -0,0 +1,144 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intdataplane
+
+import (
+	"os"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/projectcalico/felix/ipsets"
+	"github.com/projectcalico/felix/iptables"
+	"github.com/projectcalico/felix/rules"
+)
+
+var _ = Describe("Break-glass manager", func() {
+	var (
+		mgr         *breakGlassManager
+		filterTable *mockTable
+		now         time.Time
+		modTime     time.Time
+		fileExists  bool
+	)
+
+	BeforeEach(func() {
+		filterTable = newMockTable("filter")
+		ruleRenderer := rules.NewRenderer(rules.Config{
+			IPSetConfigV4: ipsets.NewIPVersionConfig(
+				ipsets.IPFamilyV4,
+				"cali",
+				nil,
+				nil,
+			),
+			IptablesMarkPass:     0x1,
+			IptablesMarkAccept:   0x2,
+			IptablesMarkScratch0: 0x4,
+			IptablesMarkScratch1: 0x8,
+		})
+		mgr = newBreakGlassManager(filterTable, ruleRenderer,
+			"/var/run/calico/break-glass", []string{"10.0.0.0/8"}, time.Hour, 4)
+		now = time.Date(2019, 1, 1, 12, 0, 0, 0, time.UTC)
+		fileExists = false
+		mgr.timeNow = func() time.Time { return now }
+		mgr.statFile = func(name string) (os.FileInfo, error) {
+			Expect(name).To(Equal("/var/run/calico/break-glass"))
+			if !fileExists {
+				return nil, os.ErrNotExist
+			}
+			return fakeFileInfo{modTime: modTime}, nil
+		}
+	})
+
+	activeChains := []*iptables.Chain{
+		{
+			Name: "cali-break-glass-in",
+			Rules: []iptables.Rule{{
+				Match:   iptables.Match().SourceNet("10.0.0.0/8"),
+				Action:  iptables.AcceptAction{},
+				Comment: "Break-glass access",
+			}},
+		},
+		{
+			Name: "cali-break-glass-out",
+			Rules: []iptables.Rule{{
+				Match:   iptables.Match().DestNet("10.0.0.0/8"),
+				Action:  iptables.AcceptAction{},
+				Comment: "Break-glass access",
+			}},
+		},
+	}
+	inactiveChains := []*iptables.Chain{
+		{Name: "cali-break-glass-in"},
+		{Name: "cali-break-glass-out"},
+	}
+
+	It("should program empty chains on startup if the file doesn't exist", func() {
+		Expect(mgr.CompleteDeferredWork()).To(Succeed())
+		filterTable.checkChains([][]*iptables.Chain{inactiveChains})
+	})
+
+	Describe("with a fresh break-glass file", func() {
+		BeforeEach(func() {
+			fileExists = true
+			modTime = now.Add(-time.Minute)
+			Expect(mgr.CompleteDeferredWork()).To(Succeed())
+		})
+
+		It("should accept the management CIDRs", func() {
+			filterTable.checkChains([][]*iptables.Chain{activeChains})
+		})
+
+		It("should disable access once the TTL expires", func() {
+			now = now.Add(time.Hour)
+			Expect(mgr.CheckFile()).To(BeTrue())
+			Expect(mgr.CompleteDeferredWork()).To(Succeed())
+			filterTable.checkChains([][]*iptables.Chain{inactiveChains})
+		})
+
+		It("should disable access when the file is removed", func() {
+			fileExists = false
+			Expect(mgr.CheckFile()).To(BeTrue())
+			Expect(mgr.CompleteDeferredWork()).To(Succeed())
+			filterTable.checkChains([][]*iptables.Chain{inactiveChains})
+		})
+
+		It("should not report a change if nothing changed", func() {
+			filterTable.UpdateCalled = false
+			Expect(mgr.CheckFile()).To(BeFalse())
+			Expect(mgr.CompleteDeferredWork()).To(Succeed())
+			Expect(filterTable.UpdateCalled).To(BeFalse())
+		})
+	})
+
+	It("should ignore a stale break-glass file", func() {
+		fileExists = true
+		modTime = now.Add(-2 * time.Hour)
+		Expect(mgr.CompleteDeferredWork()).To(Succeed())
+		filterTable.checkChains([][]*iptables.Chain{inactiveChains})
+	})
+})
+
+type fakeFileInfo struct {
+	modTime time.Time
+}
+
+func (f fakeFileInfo) Name() string       { return "break-glass" }
+func (f fakeFileInfo) Size() int64        { return 0 }
+func (f fakeFileInfo) Mode() os.FileMode  { return 0644 }
+func (f fakeFileInfo) ModTime() time.Time { return f.modTime }
+func (f fakeFileInfo) IsDir() bool        { return false }
+func (f fakeFileInfo) Sys() interface{}   { return nil }
@@ -0,0 +1,66 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intdataplane
+
+import (
+	"fmt"
+
+	"github.com/projectcalico/felix/proto"
+	"github.com/projectcalico/felix/rules"
+)
+
+// chainProvenance maps the names of the iptables chains that we render for policies and
+// profiles back to the policy or profile that each came from.  The chain names are hashed if
+// the policy name is long so they can't simply be decoded.  It is only accessed from the main
+// loop goroutine.
+type chainProvenance struct {
+	chainToSource map[string]string
+}
+
+func newChainProvenance() *chainProvenance {
+	return &chainProvenance{
+		chainToSource: map[string]string{},
+	}
+}
+
+func (p *chainProvenance) onPolicyUpdate(id *proto.PolicyID) {
+	p.chainToSource[rules.PolicyChainName(rules.PolicyInboundPfx, id)] =
+		fmt.Sprintf("policy %s/%s (inbound)", id.Tier, id.Name)
+	p.chainToSource[rules.PolicyChainName(rules.PolicyOutboundPfx, id)] =
+		fmt.Sprintf("policy %s/%s (outbound)", id.Tier, id.Name)
+}
+
+func (p *chainProvenance) onPolicyRemove(id *proto.PolicyID) {
+	delete(p.chainToSource, rules.PolicyChainName(rules.PolicyInboundPfx, id))
+	delete(p.chainToSource, rules.PolicyChainName(rules.PolicyOutboundPfx, id))
+}
+
+func (p *chainProvenance) onProfileUpdate(id *proto.ProfileID) {
+	p.chainToSource[rules.ProfileChainName(rules.ProfileInboundPfx, id)] =
+		fmt.Sprintf("profile %s (inbound)", id.Name)
+	p.chainToSource[rules.ProfileChainName(rules.ProfileOutboundPfx, id)] =
+		fmt.Sprintf("profile %s (outbound)", id.Name)
+}
+
+func (p *chainProvenance) onProfileRemove(id *proto.ProfileID) {
+	delete(p.chainToSource, rules.ProfileChainName(rules.ProfileInboundPfx, id))
+	delete(p.chainToSource, rules.ProfileChainName(rules.ProfileOutboundPfx, id))
+}
+
+// lookup returns a description of the policy or profile that the given chain implements.
+func (p *chainProvenance) lookup(chainName string) (string, bool) {
+	source, ok := p.chainToSource[chainName]
+	return source, ok
+}
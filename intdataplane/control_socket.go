@@ -0,0 +1,57 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intdataplane
+
+import (
+	"net"
+	"net/http"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ServeControlAPI serves the operations that change the dataplane on request, activation from
+// warm standby (at "/activate", if we started in standby) and packet traces (at
+// "/packet-trace", if Config.PacketTraceEnabled is set), on a Unix socket at the given path.
+// They're kept off the Prometheus port, which is reachable from other hosts and has no
+// authentication; the socket is only accessible to root.  Any existing socket is replaced.  It
+// only returns if the server fails.
+func (d *InternalDataplane) ServeControlAPI(socketPath string) error {
+	if err := os.Remove(socketPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	if err := os.Chmod(socketPath, 0600); err != nil {
+		return err
+	}
+	log.WithField("path", socketPath).Info("Serving control API")
+	return http.Serve(listener, d.controlAPIHandler())
+}
+
+func (d *InternalDataplane) controlAPIHandler() http.Handler {
+	mux := http.NewServeMux()
+	if d.standby != nil {
+		// Let failover tooling activate a warm standby without going via the filesystem.
+		mux.HandleFunc("/activate", d.ServeActivate)
+	}
+	if d.currentConfig().PacketTraceEnabled {
+		mux.HandleFunc("/packet-trace", d.ServePacketTrace)
+	}
+	return mux
+}
@@ -0,0 +1,212 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intdataplane
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/projectcalico/felix/proto"
+)
+
+// maxEndpointReadyWait is the longest that a caller of the endpoint readiness API can ask us to
+// wait for an endpoint's policy to be programmed.
+const maxEndpointReadyWait = 5 * time.Minute
+
+// endpointReadiness tracks which local workload endpoints have had their latest update, and
+// hence their policy, programmed into the dataplane.  It's updated from the main loop and
+// queried, via the endpoint readiness API, by the CNI plugin, which can hold up the pod's
+// start until its policy is in place.
+type endpointReadiness struct {
+	lock sync.Mutex
+	// idToReady contains an entry for each known endpoint, which is true once the endpoint's
+	// latest update has been programmed.
+	idToReady map[proto.WorkloadEndpointID]bool
+	// changed is closed, and replaced, whenever an endpoint becomes ready or is removed.
+	changed chan struct{}
+}
+
+func newEndpointReadiness() *endpointReadiness {
+	return &endpointReadiness{
+		idToReady: map[proto.WorkloadEndpointID]bool{},
+		changed:   make(chan struct{}),
+	}
+}
+
+// OnEvent is our event bus handler.
+func (r *endpointReadiness) OnEvent(event interface{}) {
+	switch event := event.(type) {
+	case EndpointUpdateEvent:
+		if event.WorkloadEndpointID == nil {
+			return
+		}
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		if event.Removed {
+			delete(r.idToReady, *event.WorkloadEndpointID)
+			r.notifyLocked()
+		} else {
+			r.idToReady[*event.WorkloadEndpointID] = false
+		}
+	case ApplyResultEvent:
+		r.OnDataplaneApplied(event.Succeeded)
+	}
+}
+
+// OnUpdate handles a message from the calculation graph directly, as if it had come from the
+// event bus.
+func (r *endpointReadiness) OnUpdate(msg interface{}) {
+	if event, ok := endpointUpdateEvent(msg); ok {
+		r.OnEvent(event)
+	}
+}
+
+// OnDataplaneApplied is called from the main loop after each apply.  If the apply succeeded
+// completely, the endpoints that were updated before it are now ready.
+func (r *endpointReadiness) OnDataplaneApplied(succeeded bool) {
+	if !succeeded {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	numNewlyReady := 0
+	for id, ready := range r.idToReady {
+		if !ready {
+			r.idToReady[id] = true
+			numNewlyReady++
+		}
+	}
+	if numNewlyReady > 0 {
+		log.WithField("numEndpoints", numNewlyReady).Debug("Endpoints now programmed")
+		r.notifyLocked()
+	}
+}
+
+func (r *endpointReadiness) notifyLocked() {
+	close(r.changed)
+	r.changed = make(chan struct{})
+}
+
+// endpointMatches returns true if the ID matches the given workload and, if non-empty, the
+// given orchestrator and endpoint.
+func endpointMatches(id proto.WorkloadEndpointID, orchestrator, workload, endpoint string) bool {
+	return id.WorkloadId == workload &&
+		(orchestrator == "" || id.OrchestratorId == orchestrator) &&
+		(endpoint == "" || id.EndpointId == endpoint)
+}
+
+// ready returns true if we know about at least one matching endpoint and all of them are
+// ready.  It also returns a channel that is closed when that may have changed.
+func (r *endpointReadiness) ready(orchestrator, workload, endpoint string) (bool, <-chan struct{}) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	found := false
+	for id, ready := range r.idToReady {
+		if !endpointMatches(id, orchestrator, workload, endpoint) {
+			continue
+		}
+		if !ready {
+			return false, r.changed
+		}
+		found = true
+	}
+	return found, r.changed
+}
+
+// WaitForEndpoint waits until the policy of the given workload's endpoints (or just the given
+// endpoint, if non-empty) has been programmed, or the context is done.  Returns whether the
+// endpoints are ready.
+func (r *endpointReadiness) WaitForEndpoint(ctx context.Context, orchestrator, workload, endpoint string) bool {
+	for {
+		ready, changed := r.ready(orchestrator, workload, endpoint)
+		if ready {
+			return true
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// ServeHTTP implements the endpoint readiness API.  It takes the "workload" query parameter
+// (for example, "namespace/pod-name") and, optionally, "orchestrator", "endpoint" and
+// "timeout" (for example, "10s").  It responds with 200 if the endpoint's policy is in place
+// and 503 if it isn't, after waiting for up to the timeout.
+func (r *endpointReadiness) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	workload := query.Get("workload")
+	if workload == "" {
+		http.Error(w, "missing workload parameter", http.StatusBadRequest)
+		return
+	}
+	var timeout time.Duration
+	if v := query.Get("timeout"); v != "" {
+		var err error
+		if timeout, err = time.ParseDuration(v); err != nil || timeout < 0 {
+			http.Error(w, fmt.Sprintf("invalid timeout %q", v), http.StatusBadRequest)
+			return
+		}
+		if timeout > maxEndpointReadyWait {
+			timeout = maxEndpointReadyWait
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), timeout)
+	defer cancel()
+	logCxt := log.WithFields(log.Fields{
+		"workload": workload,
+		"endpoint": query.Get("endpoint"),
+		"timeout":  timeout,
+	})
+	logCxt.Debug("Endpoint readiness request")
+	if !r.WaitForEndpoint(ctx, query.Get("orchestrator"), workload, query.Get("endpoint")) {
+		logCxt.Info("Endpoint not ready within timeout")
+		http.Error(w, "not ready", http.StatusServiceUnavailable)
+		return
+	}
+	if _, err := w.Write([]byte("ready\n")); err != nil {
+		logCxt.WithError(err).Debug("Failed to write endpoint readiness response")
+	}
+}
+
+// ServeEndpointReadiness serves the endpoint readiness API (see endpointReadiness.ServeHTTP)
+// on a Unix socket at the given path, at "/ready".  The socket is only accessible to root, like
+// the control API's.  Any existing socket is replaced.  It only returns if the server fails.
+func (d *InternalDataplane) ServeEndpointReadiness(socketPath string) error {
+	if err := os.Remove(socketPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	if err := os.Chmod(socketPath, 0600); err != nil {
+		return err
+	}
+	log.WithField("path", socketPath).Info("Serving endpoint readiness API")
+	mux := http.NewServeMux()
+	mux.Handle("/ready", d.endpointReadiness)
+	return http.Serve(listener, mux)
+}
@@ -0,0 +1,140 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intdataplane
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/projectcalico/felix/proto"
+)
+
+var _ = Describe("Endpoint readiness", func() {
+	var readiness *endpointReadiness
+
+	podID := proto.WorkloadEndpointID{OrchestratorId: "k8s", WorkloadId: "default/pod1", EndpointId: "eth0"}
+	otherID := proto.WorkloadEndpointID{OrchestratorId: "k8s", WorkloadId: "default/pod2", EndpointId: "eth0"}
+
+	isReady := func(workload, endpoint string) bool {
+		ready, _ := readiness.ready("", workload, endpoint)
+		return ready
+	}
+
+	serve := func(query string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		readiness.ServeHTTP(recorder, httptest.NewRequest("GET", "/ready?"+query, nil))
+		return recorder
+	}
+
+	BeforeEach(func() {
+		readiness = newEndpointReadiness()
+	})
+
+	It("should only let root use the socket", func() {
+		dir, err := ioutil.TempDir("", "felix-readiness")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(dir)
+		socketPath := filepath.Join(dir, "ready.sock")
+		d := &InternalDataplane{endpointReadiness: readiness}
+		go d.ServeEndpointReadiness(socketPath)
+		Eventually(func() os.FileMode {
+			info, err := os.Stat(socketPath)
+			if err != nil {
+				return 0
+			}
+			return info.Mode().Perm()
+		}).Should(Equal(os.FileMode(0600)))
+	})
+
+	It("should not report unknown endpoints as ready", func() {
+		readiness.OnDataplaneApplied(true)
+		Expect(isReady("default/pod1", "")).To(BeFalse())
+	})
+
+	It("should report an endpoint as ready once it has been applied", func() {
+		readiness.OnUpdate(&proto.WorkloadEndpointUpdate{Id: &podID})
+		Expect(isReady("default/pod1", "")).To(BeFalse())
+		readiness.OnDataplaneApplied(false)
+		Expect(isReady("default/pod1", "")).To(BeFalse(), "Failed apply shouldn't count")
+		readiness.OnDataplaneApplied(true)
+		Expect(isReady("default/pod1", "")).To(BeTrue())
+		Expect(isReady("default/pod1", "eth0")).To(BeTrue())
+		Expect(isReady("default/pod1", "eth1")).To(BeFalse())
+		Expect(isReady("default/pod2", "")).To(BeFalse())
+	})
+
+	It("should match the orchestrator", func() {
+		readiness.OnUpdate(&proto.WorkloadEndpointUpdate{Id: &podID})
+		readiness.OnDataplaneApplied(true)
+		ready, _ := readiness.ready("k8s", "default/pod1", "")
+		Expect(ready).To(BeTrue())
+		ready, _ = readiness.ready("openstack", "default/pod1", "")
+		Expect(ready).To(BeFalse())
+	})
+
+	It("should forget removed endpoints", func() {
+		readiness.OnUpdate(&proto.WorkloadEndpointUpdate{Id: &podID})
+		readiness.OnDataplaneApplied(true)
+		readiness.OnUpdate(&proto.WorkloadEndpointRemove{Id: &podID})
+		Expect(isReady("default/pod1", "")).To(BeFalse())
+	})
+
+	It("should wait for the endpoint to become ready", func() {
+		done := make(chan bool)
+		go func() {
+			defer GinkgoRecover()
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			done <- readiness.WaitForEndpoint(ctx, "", "default/pod1", "")
+		}()
+		Consistently(done, "50ms").ShouldNot(Receive())
+		readiness.OnUpdate(&proto.WorkloadEndpointUpdate{Id: &otherID})
+		readiness.OnDataplaneApplied(true)
+		Consistently(done, "50ms").ShouldNot(Receive())
+		readiness.OnUpdate(&proto.WorkloadEndpointUpdate{Id: &podID})
+		readiness.OnDataplaneApplied(true)
+		Eventually(done).Should(Receive(BeTrue()))
+	})
+
+	Describe("HTTP API", func() {
+		It("should require the workload", func() {
+			Expect(serve("").Code).To(Equal(http.StatusBadRequest))
+			Expect(serve("workload=default/pod1&timeout=bad").Code).To(Equal(http.StatusBadRequest))
+		})
+
+		It("should respond immediately without a timeout", func() {
+			Expect(serve("workload=default/pod1").Code).To(Equal(http.StatusServiceUnavailable))
+			readiness.OnUpdate(&proto.WorkloadEndpointUpdate{Id: &podID})
+			readiness.OnDataplaneApplied(true)
+			recorder := serve("workload=default/pod1&endpoint=eth0")
+			Expect(recorder.Code).To(Equal(http.StatusOK))
+			Expect(recorder.Body.String()).To(Equal("ready\n"))
+		})
+
+		It("should give up after the timeout", func() {
+			start := time.Now()
+			Expect(serve("workload=default/pod1&timeout=50ms").Code).To(Equal(http.StatusServiceUnavailable))
+			Expect(time.Since(start)).To(BeNumerically(">=", 50*time.Millisecond))
+		})
+	})
+})
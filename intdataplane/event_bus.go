@@ -0,0 +1,267 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intdataplane
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/projectcalico/felix/ifacemonitor"
+	"github.com/projectcalico/felix/iptables"
+	"github.com/projectcalico/felix/proto"
+	"github.com/projectcalico/libcalico-go/lib/set"
+)
+
+// The event bus lets parts of the dataplane driver, and optional extensions, find out what the
+// main loop is doing without each of them needing its own callback.  The main loop publishes
+// the events below; subscribers type-switch on them, as managers do in OnUpdate, and ignore the
+// types that they don't care about.  Events are values and they're shared between subscribers
+// so subscribers must not modify the slices in them.
+//
+// Ordering: events are only published from the main loop so every subscriber sees them in the
+// same order, which is the order in which they happened.  Components that run on other
+// goroutines, such as the iptables Tables, which apply the IPv4 and IPv6 tables concurrently,
+// queue their events for the main loop (see eventQueue) rather than publishing them.  The
+// DriftEvents that the Tables report during an apply are published after the apply, before its
+// ApplyResultEvent.  A TamperEvent is published when the main loop picks it up, after the
+// apply's ApplyResultEvent; the resulting re-check of all our tables is the next apply.
+//
+// Backpressure: publishing never blocks the main loop.  Handlers (AddHandler) are called
+// synchronously, in the order in which they were added, so they must be quick and must not
+// block; they're for our own components.  Subscriptions (Subscribe) receive events on a
+// buffered channel.  If a subscriber falls behind and its buffer fills up, further events are
+// dropped for that subscriber only and counted; a subscriber that sees drops should re-read
+// whatever state it needs rather than relying on the events.
+
+// EndpointUpdateEvent is published when the calculation graph updates or removes one of our
+// local endpoints.  Exactly one of WorkloadEndpointID and HostEndpointID is set.
+type EndpointUpdateEvent struct {
+	WorkloadEndpointID *proto.WorkloadEndpointID
+	HostEndpointID     *proto.HostEndpointID
+	Removed            bool
+}
+
+// ApplyResultEvent is published after each attempt to apply updates to the dataplane.
+type ApplyResultEvent struct {
+	// Succeeded is false if some updates failed and will be retried.
+	Succeeded bool
+	Duration  time.Duration
+}
+
+// DriftEvent is published when one of our iptables tables finds that another process has
+// modified one of our chains.
+type DriftEvent struct {
+	ChainName string
+	// Reason is one of the iptables.OutOfSync... reasons.
+	Reason string
+}
+
+// TamperEvent is published when one of our iptables tables finds that another process has
+// removed our rules from a kernel chain (see TableOptions.TamperDetection).
+type TamperEvent iptables.TamperEvent
+
+// EndpointStatusEvent is published when the IPv4 or IPv6 endpoint manager reports the status of
+// one of our local endpoints.  ID is a proto.WorkloadEndpointID or proto.HostEndpointID.
+// Status is "up", "down" or "error", or empty if the endpoint has gone.
+type EndpointStatusEvent struct {
+	IPVersion uint8
+	ID        interface{}
+	Status    string
+}
+
+// InterfaceStateEvent is published when an interface changes state.
+type InterfaceStateEvent struct {
+	Name  string
+	State ifacemonitor.State
+}
+
+// InterfaceAddrsEvent is published when an interface's addresses change.  Addrs is sorted and
+// empty if the interface has gone.
+type InterfaceAddrsEvent struct {
+	Name  string
+	Addrs []string
+}
+
+// defaultSubscriptionBuffer is the buffer size that Subscribe uses if it's given a size <= 0.
+const defaultSubscriptionBuffer = 100
+
+var countDroppedEvents = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "felix_int_dataplane_events_dropped",
+	Help: "Number of dataplane events dropped because a subscriber fell behind, by subscriber.",
+}, []string{"subscriber"})
+
+// EventBus distributes the main loop's events to handlers and subscriptions.  Its methods may
+// be called from any goroutine but Publish should only be called from the main loop.
+type EventBus struct {
+	lock     sync.Mutex
+	handlers []func(event interface{})
+	subs     []*Subscription
+}
+
+func NewEventBus() *EventBus {
+	return &EventBus{}
+}
+
+// AddHandler adds a handler that is called synchronously, from the main loop, with each event.
+func (b *EventBus) AddHandler(handler func(event interface{})) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.handlers = append(b.handlers, handler)
+}
+
+// Subscribe returns a new Subscription that receives the events that are published from now
+// on.  The name identifies the subscriber in logs and metrics.
+func (b *EventBus) Subscribe(name string, bufferSize int) *Subscription {
+	if bufferSize <= 0 {
+		bufferSize = defaultSubscriptionBuffer
+	}
+	sub := &Subscription{
+		name: name,
+		c:    make(chan interface{}, bufferSize),
+		bus:  b,
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.subs = append(b.subs, sub)
+	log.WithField("subscriber", name).Info("New dataplane event subscription")
+	return sub
+}
+
+// Publish passes the event to the handlers and then offers it to the subscriptions.
+func (b *EventBus) Publish(event interface{}) {
+	b.lock.Lock()
+	handlers := b.handlers
+	b.lock.Unlock()
+	for _, handler := range handlers {
+		handler(event)
+	}
+
+	// Hold the lock while we send so that a concurrent Close can't close the channel under us.
+	// The sends don't block.
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for _, sub := range b.subs {
+		select {
+		case sub.c <- event:
+		default:
+			if atomic.AddUint64(&sub.dropped, 1) == 1 {
+				log.WithField("subscriber", sub.name).Warn(
+					"Dataplane event subscriber is falling behind, dropping events")
+			}
+			countDroppedEvents.WithLabelValues(sub.name).Inc()
+		}
+	}
+}
+
+func (b *EventBus) unsubscribe(sub *Subscription) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for i, s := range b.subs {
+		if s == sub {
+			b.subs = append(b.subs[:i:i], b.subs[i+1:]...)
+			close(sub.c)
+			return
+		}
+	}
+}
+
+// Subscription is a subscriber's handle on the EventBus.
+type Subscription struct {
+	name    string
+	c       chan interface{}
+	dropped uint64
+	bus     *EventBus
+}
+
+// Events returns the channel on which the subscription receives events.  It's closed by Close.
+func (s *Subscription) Events() <-chan interface{} {
+	return s.c
+}
+
+// Dropped returns the number of events that have been dropped because the subscription's
+// buffer was full.
+func (s *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// Close ends the subscription.  It's safe to call more than once.
+func (s *Subscription) Close() {
+	s.bus.unsubscribe(s)
+}
+
+// Events returns the dataplane's event bus, which extensions can subscribe to.
+func (d *InternalDataplane) Events() *EventBus {
+	return d.events
+}
+
+// eventQueue holds events that other goroutines report until the main loop publishes them.
+type eventQueue struct {
+	lock   sync.Mutex
+	events []interface{}
+}
+
+// Add queues the event.  It may be called from any goroutine.
+func (q *eventQueue) Add(event interface{}) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.events = append(q.events, event)
+}
+
+// PublishTo publishes the queued events, in the order in which they were added, and empties the
+// queue.  It should only be called from the main loop.
+func (q *eventQueue) PublishTo(bus *EventBus) {
+	q.lock.Lock()
+	events := q.events
+	q.events = nil
+	q.lock.Unlock()
+	for _, event := range events {
+		bus.Publish(event)
+	}
+}
+
+// endpointUpdateEvent converts a message from the calculation graph to an EndpointUpdateEvent,
+// if it's an endpoint update or removal.
+func endpointUpdateEvent(msg interface{}) (EndpointUpdateEvent, bool) {
+	switch msg := msg.(type) {
+	case *proto.WorkloadEndpointUpdate:
+		return EndpointUpdateEvent{WorkloadEndpointID: msg.Id}, true
+	case *proto.WorkloadEndpointRemove:
+		return EndpointUpdateEvent{WorkloadEndpointID: msg.Id, Removed: true}, true
+	case *proto.HostEndpointUpdate:
+		return EndpointUpdateEvent{HostEndpointID: msg.Id}, true
+	case *proto.HostEndpointRemove:
+		return EndpointUpdateEvent{HostEndpointID: msg.Id, Removed: true}, true
+	}
+	return EndpointUpdateEvent{}, false
+}
+
+// sortedAddrs converts a set of interface addresses to a sorted slice.
+func sortedAddrs(addrs set.Set) []string {
+	sorted := []string{}
+	if addrs == nil {
+		return sorted
+	}
+	addrs.Iter(func(item interface{}) error {
+		sorted = append(sorted, item.(string))
+		return nil
+	})
+	sort.Strings(sorted)
+	return sorted
+}
@@ -0,0 +1,129 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intdataplane
+
+import (
+	"sync"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/projectcalico/felix/proto"
+	"github.com/projectcalico/libcalico-go/lib/set"
+)
+
+var _ = Describe("Event bus", func() {
+	var bus *EventBus
+
+	BeforeEach(func() {
+		bus = NewEventBus()
+	})
+
+	It("should call handlers in order, before subscriptions", func() {
+		var calls []string
+		sub := bus.Subscribe("test", 10)
+		bus.AddHandler(func(event interface{}) {
+			Expect(sub.Events()).To(BeEmpty())
+			calls = append(calls, "first")
+		})
+		bus.AddHandler(func(event interface{}) {
+			calls = append(calls, "second")
+		})
+		bus.Publish(DriftEvent{ChainName: "cali-foo"})
+		Expect(calls).To(Equal([]string{"first", "second"}))
+		Expect(sub.Events()).To(Receive(Equal(DriftEvent{ChainName: "cali-foo"})))
+	})
+
+	It("should deliver events to every subscription in order", func() {
+		sub1 := bus.Subscribe("sub1", 10)
+		sub2 := bus.Subscribe("sub2", 10)
+		bus.Publish(ApplyResultEvent{Succeeded: false})
+		bus.Publish(ApplyResultEvent{Succeeded: true})
+		for _, sub := range []*Subscription{sub1, sub2} {
+			Expect(sub.Events()).To(Receive(Equal(ApplyResultEvent{Succeeded: false})))
+			Expect(sub.Events()).To(Receive(Equal(ApplyResultEvent{Succeeded: true})))
+		}
+	})
+
+	It("should drop events for a subscriber that falls behind without blocking", func() {
+		slow := bus.Subscribe("slow", 1)
+		fast := bus.Subscribe("fast", 10)
+		for i := 0; i < 3; i++ {
+			bus.Publish(InterfaceStateEvent{Name: "eth0"})
+		}
+		Expect(slow.Dropped()).To(BeEquivalentTo(2))
+		Expect(slow.Events()).To(HaveLen(1))
+		Expect(fast.Dropped()).To(BeZero())
+		Expect(fast.Events()).To(HaveLen(3))
+	})
+
+	It("should close the channel and stop delivering after Close", func() {
+		sub := bus.Subscribe("test", 0)
+		sub.Close()
+		sub.Close()
+		Expect(sub.Events()).To(BeClosed())
+		bus.Publish(DriftEvent{})
+	})
+
+	It("should publish queued events in order, from the main loop", func() {
+		var queue eventQueue
+		var wg sync.WaitGroup
+		for _, chainName := range []string{"cali-foo", "cali-bar"} {
+			wg.Add(1)
+			go func(chainName string) {
+				defer wg.Done()
+				queue.Add(DriftEvent{ChainName: chainName})
+			}(chainName)
+		}
+		wg.Wait()
+		queue.Add(DriftEvent{ChainName: "cali-baz"})
+
+		var published []interface{}
+		bus.AddHandler(func(event interface{}) {
+			published = append(published, event)
+		})
+		queue.PublishTo(bus)
+		Expect(published).To(ConsistOf(
+			DriftEvent{ChainName: "cali-foo"},
+			DriftEvent{ChainName: "cali-bar"},
+			DriftEvent{ChainName: "cali-baz"},
+		))
+		Expect(published[2]).To(Equal(DriftEvent{ChainName: "cali-baz"}))
+
+		published = nil
+		queue.PublishTo(bus)
+		Expect(published).To(BeEmpty())
+	})
+
+	It("should convert endpoint messages", func() {
+		wepID := &proto.WorkloadEndpointID{WorkloadId: "pod"}
+		event, ok := endpointUpdateEvent(&proto.WorkloadEndpointRemove{Id: wepID})
+		Expect(ok).To(BeTrue())
+		Expect(event).To(Equal(EndpointUpdateEvent{WorkloadEndpointID: wepID, Removed: true}))
+
+		hepID := &proto.HostEndpointID{EndpointId: "eth0"}
+		event, ok = endpointUpdateEvent(&proto.HostEndpointUpdate{Id: hepID})
+		Expect(ok).To(BeTrue())
+		Expect(event).To(Equal(EndpointUpdateEvent{HostEndpointID: hepID}))
+
+		_, ok = endpointUpdateEvent(&proto.PolicyID{Name: "policy"})
+		Expect(ok).To(BeFalse())
+	})
+
+	It("should sort interface addresses", func() {
+		Expect(sortedAddrs(set.From("10.0.0.2", "10.0.0.1"))).To(Equal([]string{"10.0.0.1", "10.0.0.2"}))
+		Expect(sortedAddrs(nil)).To(BeEmpty())
+	})
+})
@@ -0,0 +1,147 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intdataplane
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// failedApplyWindow is the period over which felix_dataplane_failed_applies_last_hour counts
+// failed applies.
+const failedApplyWindow = time.Hour
+
+// dataplaneHealth is the summary that backs the high-level dataplane health gauges.  It's
+// shared by all InternalDataplanes since the gauges are registered once, with the standard
+// registry.
+var dataplaneHealth = newHealthSummary(time.Now)
+
+// healthSummary derives a few high-level gauges from the results of our dataplane updates, so
+// that dashboards can show the dataplane's health without complex queries over the low-level
+// metrics:
+//
+// felix_dataplane_in_sync is 1 if the most recent apply programmed everything and we haven't
+// since found the dataplane modified by another process, 0 otherwise.
+//
+// felix_dataplane_seconds_since_drift is the time since we last found the dataplane out of
+// sync, either because an apply failed or because another process modified our iptables
+// rules.  Until that first happens, it's the time since Felix started.
+//
+// felix_dataplane_failed_applies_last_hour counts the applies in the last hour that failed
+// to program everything.
+//
+// The gauges are calculated when they're scraped so they're always up to date.
+type healthSummary struct {
+	lock sync.Mutex
+	now  func() time.Time
+
+	inSync    bool
+	lastDrift time.Time
+	// failedApplies holds the times of the failed applies in the last failedApplyWindow, in
+	// order.
+	failedApplies []time.Time
+}
+
+func newHealthSummary(now func() time.Time) *healthSummary {
+	return &healthSummary{
+		now:       now,
+		lastDrift: now(),
+	}
+}
+
+// OnApplied is called from the main loop after each apply, with whether it succeeded.
+func (s *healthSummary) OnApplied(succeeded bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.inSync = succeeded
+	if succeeded {
+		return
+	}
+	now := s.now()
+	s.lastDrift = now
+	s.failedApplies = append(s.failedApplies, now)
+	s.expireFailures(now)
+}
+
+// OnDrift is called when we find that another process has modified the dataplane.  It may be
+// called from any goroutine.
+func (s *healthSummary) OnDrift() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.inSync = false
+	s.lastDrift = s.now()
+}
+
+// OnEvent is our event bus handler.
+func (s *healthSummary) OnEvent(event interface{}) {
+	switch event := event.(type) {
+	case ApplyResultEvent:
+		s.OnApplied(event.Succeeded)
+	case DriftEvent:
+		s.OnDrift()
+	}
+}
+
+func (s *healthSummary) InSync() float64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.inSync {
+		return 1
+	}
+	return 0
+}
+
+func (s *healthSummary) SecondsSinceDrift() float64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.now().Sub(s.lastDrift).Seconds()
+}
+
+func (s *healthSummary) FailedAppliesLastHour() float64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.expireFailures(s.now())
+	return float64(len(s.failedApplies))
+}
+
+// expireFailures discards the failed applies that are older than failedApplyWindow.
+func (s *healthSummary) expireFailures(now time.Time) {
+	cutoff := now.Add(-failedApplyWindow)
+	i := 0
+	for i < len(s.failedApplies) && !s.failedApplies[i].After(cutoff) {
+		i++
+	}
+	s.failedApplies = s.failedApplies[i:]
+}
+
+// Collectors returns the gauges, for registration.
+func (s *healthSummary) Collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "felix_dataplane_in_sync",
+			Help: "1 if the dataplane is in sync with the desired state, 0 otherwise.",
+		}, s.InSync),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "felix_dataplane_seconds_since_drift",
+			Help: "Seconds since the dataplane was last found out of sync (or since Felix started).",
+		}, s.SecondsSinceDrift),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "felix_dataplane_failed_applies_last_hour",
+			Help: "Number of dataplane updates in the last hour that failed to program everything.",
+		}, s.FailedAppliesLastHour),
+	}
+}
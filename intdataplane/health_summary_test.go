@@ -0,0 +1,83 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intdataplane
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Dataplane health summary", func() {
+	var summary *healthSummary
+	var now time.Time
+
+	BeforeEach(func() {
+		now = time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+		summary = newHealthSummary(func() time.Time { return now })
+	})
+
+	It("should start out of sync, with no drift or failures", func() {
+		now = now.Add(30 * time.Second)
+		Expect(summary.InSync()).To(Equal(0.0))
+		Expect(summary.SecondsSinceDrift()).To(Equal(30.0))
+		Expect(summary.FailedAppliesLastHour()).To(Equal(0.0))
+	})
+
+	It("should be in sync after a successful apply", func() {
+		summary.OnApplied(true)
+		Expect(summary.InSync()).To(Equal(1.0))
+	})
+
+	It("should record a failed apply as drift", func() {
+		summary.OnApplied(true)
+		now = now.Add(time.Minute)
+		summary.OnApplied(false)
+		now = now.Add(10 * time.Second)
+		Expect(summary.InSync()).To(Equal(0.0))
+		Expect(summary.SecondsSinceDrift()).To(Equal(10.0))
+		Expect(summary.FailedAppliesLastHour()).To(Equal(1.0))
+
+		summary.OnApplied(true)
+		Expect(summary.InSync()).To(Equal(1.0))
+		Expect(summary.SecondsSinceDrift()).To(Equal(10.0))
+	})
+
+	It("should record modifications by other processes as drift", func() {
+		summary.OnApplied(true)
+		now = now.Add(time.Minute)
+		summary.OnDrift()
+		Expect(summary.InSync()).To(Equal(0.0))
+		Expect(summary.SecondsSinceDrift()).To(Equal(0.0))
+		Expect(summary.FailedAppliesLastHour()).To(Equal(0.0))
+	})
+
+	It("should only count failures in the last hour", func() {
+		summary.OnApplied(false)
+		now = now.Add(30 * time.Minute)
+		summary.OnApplied(false)
+		summary.OnApplied(false)
+		Expect(summary.FailedAppliesLastHour()).To(Equal(3.0))
+		now = now.Add(31 * time.Minute)
+		Expect(summary.FailedAppliesLastHour()).To(Equal(2.0))
+		now = now.Add(30 * time.Minute)
+		Expect(summary.FailedAppliesLastHour()).To(Equal(0.0))
+	})
+
+	It("should provide a gauge for each value", func() {
+		Expect(summary.Collectors()).To(HaveLen(3))
+	})
+})
@@ -0,0 +1,79 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intdataplane
+
+import (
+	log "github.com/sirupsen/logrus"
+)
+
+// onInSyncTimeout is called from the main loop if the datastore hasn't come into sync within
+// Config.DatastoreInSyncTimeout.  Normally, we don't program the dataplane until the datastore
+// is in sync, since programming a partial picture of the desired state could remove rules that
+// are still needed.  However, after a reboot, there are no rules to remove and waiting leaves
+// the node unprotected for as long as the datastore is unavailable.  So, if the dataplane has
+// none of our rules, we program our best-known state, which is everything that we've received
+// so far (the static chains, such as the failsafe rules, and whatever endpoints and policies
+// have been synced), and we report ourselves as not ready until the datastore is in sync.
+//
+// We don't persist the state that we programmed so, after a restart of Felix, we can't tell
+// which of the rules in the dataplane are still wanted.  If the dataplane already has some of
+// our rules, we leave it alone and keep waiting for the datastore.  Even on a clean host, we
+// don't remove any chains or IP sets that we don't know about until the datastore is in sync.
+func (d *InternalDataplane) onInSyncTimeout() {
+	logCxt := log.WithField("timeout", d.config.DatastoreInSyncTimeout)
+	if d.dataplaneHasOurState() {
+		logCxt.Warn("Datastore not in sync after timeout but the dataplane already has " +
+			"Calico rules; waiting for the datastore before updating them")
+		return
+	}
+	logCxt.Warn("Datastore not in sync after timeout, programming the dataplane with the state " +
+		"received so far; reporting not ready until the datastore is in sync")
+	d.inSyncTimedOut = true
+	for _, t := range d.allIptablesTables {
+		t.KeepUnknownChains(true)
+	}
+	d.dataplaneNeedsSync = true
+	d.reportHealth()
+}
+
+// dataplaneHasOurState returns true if any of our iptables tables has our rules in it, or if
+// we can't tell.
+func (d *InternalDataplane) dataplaneHasOurState() bool {
+	for _, t := range d.allIptablesTables {
+		hasRules, err := t.HasOurRules()
+		if err != nil {
+			log.WithError(err).Warn("Failed to check the dataplane for Calico rules")
+			return true
+		}
+		if hasRules {
+			return true
+		}
+	}
+	return false
+}
+
+// onDatastoreInSync is called from the main loop when the datastore comes into sync.
+func (d *InternalDataplane) onDatastoreInSync() {
+	if !d.inSyncTimedOut {
+		return
+	}
+	log.Info("Datastore now in sync after programming the dataplane on timeout")
+	d.inSyncTimedOut = false
+	for _, t := range d.allIptablesTables {
+		t.KeepUnknownChains(false)
+	}
+	// The apply that follows brings the dataplane up to date, including the removal of any
+	// chains and IP sets that we no longer want; our health is updated after it.
+}
@@ -0,0 +1,130 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intdataplane
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/projectcalico/felix/iptables"
+)
+
+// saveCmd simulates "iptables-save", returning the given output, and "iptables --version".
+type saveCmd struct {
+	output string
+}
+
+func (c *saveCmd) SetStdin(r io.Reader)  {}
+func (c *saveCmd) SetStdout(w io.Writer) {}
+func (c *saveCmd) SetStderr(w io.Writer) {}
+func (c *saveCmd) Run() error            { return nil }
+func (c *saveCmd) Start() error          { return nil }
+func (c *saveCmd) Wait() error           { return nil }
+func (c *saveCmd) Kill() error           { return nil }
+func (c *saveCmd) String() string        { return "saveCmd" }
+
+func (c *saveCmd) Output() ([]byte, error) {
+	return []byte("iptables v1.6.0\n"), nil
+}
+
+func (c *saveCmd) StdoutPipe() (io.ReadCloser, error) {
+	if c.output == "" {
+		return nil, errors.New("not implemented")
+	}
+	return ioutil.NopCloser(strings.NewReader(c.output)), nil
+}
+
+var _ = Describe("Datastore in-sync timeout", func() {
+	var d *InternalDataplane
+
+	BeforeEach(func() {
+		d = &InternalDataplane{
+			config: Config{DatastoreInSyncTimeout: time.Minute},
+		}
+	})
+
+	It("should flag the timeout and request an apply", func() {
+		d.onInSyncTimeout()
+		Expect(d.inSyncTimedOut).To(BeTrue())
+		Expect(d.dataplaneNeedsSync).To(BeTrue())
+	})
+
+	It("should clear the flag once the datastore is in sync", func() {
+		d.onInSyncTimeout()
+		d.onDatastoreInSync()
+		Expect(d.inSyncTimedOut).To(BeFalse())
+	})
+
+	It("should do nothing if the datastore comes into sync in time", func() {
+		d.onDatastoreInSync()
+		Expect(d.inSyncTimedOut).To(BeFalse())
+		Expect(d.dataplaneNeedsSync).To(BeFalse())
+	})
+
+	Describe("with an iptables table", func() {
+		var saveOutput string
+
+		BeforeEach(func() {
+			newCmd := func(name string, arg ...string) iptables.CmdIface {
+				return &saveCmd{output: saveOutput}
+			}
+			detector := iptables.NewFeatureDetector()
+			detector.NewCmd = newCmd
+			table := iptables.NewTable(
+				"filter",
+				4,
+				"cali:",
+				&sync.Mutex{},
+				detector,
+				iptables.TableOptions{
+					HistoricChainPrefixes: []string{"cali-"},
+					NewCmdOverride:        newCmd,
+					LookPathOverride: func(file string) (string, error) {
+						return file, nil
+					},
+				},
+			)
+			d.allIptablesTables = []*iptables.Table{table}
+		})
+
+		It("should program a dataplane that has none of our rules", func() {
+			saveOutput = "*filter\n" +
+				":INPUT ACCEPT [0:0]\n" +
+				"-A INPUT -j ACCEPT\n" +
+				"COMMIT\n"
+			d.onInSyncTimeout()
+			Expect(d.inSyncTimedOut).To(BeTrue())
+			Expect(d.dataplaneNeedsSync).To(BeTrue())
+		})
+
+		It("should leave a dataplane that has our rules alone", func() {
+			saveOutput = "*filter\n" +
+				":INPUT ACCEPT [0:0]\n" +
+				":cali-INPUT - [0:0]\n" +
+				"-A INPUT -j cali-INPUT\n" +
+				"COMMIT\n"
+			d.onInSyncTimeout()
+			Expect(d.inSyncTimedOut).To(BeFalse())
+			Expect(d.dataplaneNeedsSync).To(BeFalse())
+		})
+	})
+})
@@ -15,7 +15,10 @@
 package intdataplane
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"reflect"
@@ -28,6 +31,7 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
 
+	"github.com/projectcalico/felix/firewalld"
 	"github.com/projectcalico/felix/ifacemonitor"
 	"github.com/projectcalico/felix/ipsets"
 	"github.com/projectcalico/felix/iptables"
@@ -86,6 +90,8 @@ func init() {
 	prometheus.MustRegister(summaryBatchSize)
 	prometheus.MustRegister(summaryIfaceBatchSize)
 	prometheus.MustRegister(summaryAddrBatchSize)
+	prometheus.MustRegister(dataplaneHealth.Collectors()...)
+	prometheus.MustRegister(countDroppedEvents)
 	processStartTime = monotime.Now()
 }
 
@@ -95,17 +101,50 @@ type Config struct {
 	IPIPMTU              int
 	IgnoreLooseRPF       bool
 
-	MaxIPSetSize int
+	MaxIPSetSize    int
+	MaxPolicyChains int
 
 	IPSetsRefreshInterval          time.Duration
 	RouteRefreshInterval           time.Duration
 	IptablesBackend                string
+	IptablesBackendRecheckInterval time.Duration
+	IptablesBackendMigration       string
+	FirewalldReloadDetection       bool
 	IptablesRefreshInterval        time.Duration
 	IptablesPostWriteCheckInterval time.Duration
+	IptablesPostWriteCheckMax      time.Duration
+	IptablesPostWriteCheckBackoff  float64
+	IptablesPostWriteCheckDisabled bool
 	IptablesInsertMode             string
 	IptablesLockFilePath           string
 	IptablesLockTimeout            time.Duration
 	IptablesLockProbeInterval      time.Duration
+	IptablesVerifyAfterWrite       bool
+	IptablesStrictVerify           bool
+	IptablesPreserveCounters       bool
+	IptablesMaxRulesPerChain       int
+	IptablesQuarantineThreshold    int
+	IptablesTamperDetection        bool
+	IptablesCoalesceWindow         time.Duration
+	IptablesInvalidationBurst      int
+	IptablesInvalidationInterval   time.Duration
+	IptablesStreamRestoreInput     bool
+	IptablesRestorePreflight       bool
+	IptablesMaxLinesPerRestore     int
+	IptablesChainCleanupDelay      time.Duration
+	IptablesRuleHashLength         int
+	IptablesRuleHashAlphabet       string
+	IptablesRuleHashAlgorithm      string
+	IptablesRuleHashSalt           string
+	IptablesForeignTailChains      []string
+	IptablesForeignRulePolicy      string
+	IptablesUnmanagedChains        []string
+	IptablesInsertLeaseFile        string
+	IptablesInsertLeaseOwner       string
+	IptablesInsertLeaseDuration    time.Duration
+	// IptablesHashCommentPrefix, if set, replaces rules.RuleHashPrefix as the prefix of our
+	// rule-tracking comments.
+	IptablesHashCommentPrefix string
 
 	NetlinkTimeout time.Duration
 
@@ -118,6 +157,23 @@ type Config struct {
 
 	DebugSimulateDataplaneHangAfter time.Duration
 
+	BreakGlassFile  string
+	BreakGlassCIDRs []string
+	BreakGlassTTL   time.Duration
+
+	// StandbyActivationFile, if set, starts the dataplane in warm standby; see warmStandby.
+	StandbyActivationFile string
+	// PacketTraceEnabled, if set, enables packet traces through the control API; see
+	// ServeControlAPI.
+	PacketTraceEnabled bool
+	// DatastoreInSyncTimeout, if non-zero, is how long we wait for the datastore to be in
+	// sync before we program the dataplane anyway; see onInSyncTimeout.
+	DatastoreInSyncTimeout time.Duration
+
+	// Tracer, if non-nil, receives a span for each dataplane update, with the iptables
+	// Tables' spans as its children.
+	Tracer iptables.Tracer
+
 	LookPathOverride func(file string) (string, error)
 }
 
@@ -154,6 +210,7 @@ type InternalDataplane struct {
 	fromDataplane chan interface{}
 
 	allIptablesTables    []*iptables.Table
+	iptablesTableSets    []*iptables.TableSet
 	iptablesMangleTables []*iptables.Table
 	iptablesNATTables    []*iptables.Table
 	iptablesRawTables    []*iptables.Table
@@ -162,16 +219,66 @@ type InternalDataplane struct {
 
 	ipipManager *ipipManager
 
-	ifaceMonitor     *ifacemonitor.InterfaceMonitor
-	ifaceUpdates     chan *ifaceUpdate
-	ifaceAddrUpdates chan *ifaceAddrsUpdate
+	breakGlassManagers []*breakGlassManager
+
+	// standby is non-nil if we were started in warm standby.
+	standby *warmStandby
+	// inSyncTimedOut is set if we gave up waiting for the datastore to be in sync and it
+	// still isn't.
+	inSyncTimedOut bool
+
+	ifaceMonitor      *ifacemonitor.InterfaceMonitor
+	ifaceUpdates      chan *ifaceUpdate
+	ifaceAddrUpdates  chan *ifaceAddrsUpdate
+	ifaceAliasUpdates chan *ifaceAliasUpdate
+
+	// firewalldMonitor is non-nil if FirewalldReloadDetection is enabled; it sends to
+	// firewalldReloads when firewalld wipes our iptables rules.
+	firewalldMonitor *firewalld.ReloadMonitor
+	firewalldReloads chan struct{}
+
+	// iptablesTamperEvents carries reports of tampering from the iptables Tables, which detect
+	// it while they're being applied, to the main loop.
+	iptablesTamperEvents chan iptables.TamperEvent
+
+	// loopFuncs carries functions from other goroutines to be run on the main loop, which owns
+	// the iptables Tables.  See runInLoop.
+	loopFuncs chan func()
+
+	// chainProvenance records which policy or profile each of our policy chains came from.
+	chainProvenance *chainProvenance
+	// packetTraceActive is set (atomically) while a packet trace is running.
+	packetTraceActive int32
+	// openKernelLog is a shim for opening /dev/kmsg, for test purposes.
+	openKernelLog func() (io.ReadCloser, error)
 
 	endpointStatusCombiner *endpointStatusCombiner
+	// endpointReadiness tracks which workload endpoints have had their policy programmed; see
+	// ServeEndpointReadiness.
+	endpointReadiness *endpointReadiness
+
+	// events distributes the main loop's events to our components and to extensions; see
+	// event_bus.go.
+	events *EventBus
+	// tableEvents queues the DriftEvents that the iptables Tables report from their apply
+	// goroutines until the main loop publishes them.
+	tableEvents eventQueue
 
 	allManagers []Manager
 
 	ruleRenderer rules.RuleRenderer
 
+	// iptablesFeatureDetector is shared by all our iptables Tables.
+	iptablesFeatureDetector *iptables.FeatureDetector
+	// iptablesLock is shared by all our iptables Tables; it's a *iptables.SharedLock if we use
+	// our own implementation of the xtables lock.
+	iptablesLock sync.Locker
+	// iptablesBackend is the backend that our tables are using.  iptablesBackendDetector is
+	// non-nil if IptablesBackend is "auto", in which case iptablesBackend is the backend that we
+	// detected most recently.
+	iptablesBackendDetector *iptables.BackendDetector
+	iptablesBackend         string
+
 	interfacePrefixes []string
 
 	routeTables []*routetable.RouteTable
@@ -188,13 +295,29 @@ type InternalDataplane struct {
 	// doneFirstApply is set after we finish the first update to the dataplane. It indicates
 	// that the dataplane should now be in sync.
 	doneFirstApply bool
+	// kernelHooksVerified is set once we've checked that our rules in the kernel chains are
+	// in place; see checkKernelHooks.
+	kernelHooksVerified bool
+	// numQuarantinedChains is the number of iptables chains that we've given up on programming
+	// due to repeated failures; we report non-ready while it is non-zero.
+	numQuarantinedChains int
+
+	// firstUnappliedRevision and lastUnappliedRevision are the range of datastore revisions,
+	// from the calculation graph's DatastoreUpdateBatch messages, that we haven't applied yet,
+	// or empty if there aren't any.  Used to correlate dataplane update traces with the
+	// datastore (and Typha) updates.
+	firstUnappliedRevision string
+	lastUnappliedRevision  string
 
 	reschedTimer *time.Timer
 	reschedC     <-chan time.Time
 
 	applyThrottle *throttle.Throttle
 
-	config Config
+	// config is owned by the main loop, which only needs to hold configLock to change it.
+	// Other goroutines, such as the HTTP handlers, must read it with currentConfig().
+	config     Config
+	configLock sync.RWMutex
 
 	debugHangC <-chan time.Time
 }
@@ -218,78 +341,148 @@ func NewIntDataplaneDriver(config Config) *InternalDataplane {
 		ifaceMonitor:      ifacemonitor.New(),
 		ifaceUpdates:      make(chan *ifaceUpdate, 100),
 		ifaceAddrUpdates:  make(chan *ifaceAddrsUpdate, 100),
+		ifaceAliasUpdates: make(chan *ifaceAliasUpdate, 100),
 		config:            config,
 		applyThrottle:     throttle.New(10),
+
+		iptablesTamperEvents: make(chan iptables.TamperEvent, 10),
+		firewalldReloads:     make(chan struct{}, 1),
+		loopFuncs:            make(chan func()),
+		chainProvenance:      newChainProvenance(),
+		openKernelLog:        openKernelLog,
+		endpointReadiness:    newEndpointReadiness(),
+		events:               NewEventBus(),
 	}
+	dp.events.AddHandler(dataplaneHealth.OnEvent)
+	dp.events.AddHandler(dp.endpointReadiness.OnEvent)
+	dp.events.AddHandler(dp.onTamperEvent)
 	dp.applyThrottle.Refill() // Allow the first apply() immediately.
 
 	dp.ifaceMonitor.Callback = dp.onIfaceStateChange
 	dp.ifaceMonitor.AddrCallback = dp.onIfaceAddrsChange
+	dp.ifaceMonitor.AliasCallback = dp.onIfaceAliasChange
+	if config.FirewalldReloadDetection {
+		dp.firewalldMonitor = firewalld.New(dp.onFirewalldReload)
+	}
 
 	// Most iptables tables need the same options.
 	iptablesOptions := iptables.TableOptions{
-		HistoricChainPrefixes: rules.AllHistoricChainNamePrefixes,
-		InsertMode:            config.IptablesInsertMode,
-		RefreshInterval:       config.IptablesRefreshInterval,
-		PostWriteInterval:     config.IptablesPostWriteCheckInterval,
-		BackendMode:           config.IptablesBackend,
-		LookPathOverride:      config.LookPathOverride,
+		CompatTable:              rules.HistoricCompatTable,
+		InsertMode:               config.IptablesInsertMode,
+		RefreshInterval:          config.IptablesRefreshInterval,
+		PostWriteInterval:        config.IptablesPostWriteCheckInterval,
+		PostWriteMaxInterval:     config.IptablesPostWriteCheckMax,
+		PostWriteBackoffFactor:   config.IptablesPostWriteCheckBackoff,
+		DisablePostWriteChecks:   config.IptablesPostWriteCheckDisabled,
+		BackendMode:              config.IptablesBackend,
+		LookPathOverride:         config.LookPathOverride,
+		VerifyAfterWrite:         config.IptablesVerifyAfterWrite,
+		StrictVerify:             config.IptablesStrictVerify,
+		PreserveCounters:         config.IptablesPreserveCounters,
+		MaxRulesPerChain:         config.IptablesMaxRulesPerChain,
+		QuarantineThreshold:      config.IptablesQuarantineThreshold,
+		TamperDetection:          config.IptablesTamperDetection,
+		OnTamperDetected:         dp.onIptablesTamperDetected,
+		OnOutOfSync:              dp.onIptablesOutOfSync,
+		CoalesceWindow:           config.IptablesCoalesceWindow,
+		StreamRestoreInput:       config.IptablesStreamRestoreInput,
+		RestorePreflight:         config.IptablesRestorePreflight,
+		MaxLinesPerRestore:       config.IptablesMaxLinesPerRestore,
+		UnknownChainGracePeriod:  config.IptablesChainCleanupDelay,
+		ForeignTailChainPrefixes: config.IptablesForeignTailChains,
+		ForeignRulePolicy:        iptables.ForeignRulePolicy(config.IptablesForeignRulePolicy),
+		UnmanagedChains:          config.IptablesUnmanagedChains,
+		Tracer:                   config.Tracer,
+		HashFormat: iptables.HashFormat{
+			Length:    config.IptablesRuleHashLength,
+			Alphabet:  iptables.HashAlphabet(config.IptablesRuleHashAlphabet),
+			Algorithm: iptables.HashAlgorithm(config.IptablesRuleHashAlgorithm),
+			Salt:      config.IptablesRuleHashSalt,
+		},
+		InvalidationBurst:          config.IptablesInvalidationBurst,
+		InvalidationRefillInterval: config.IptablesInvalidationInterval,
+	}
+	hashPrefix := rules.RuleHashPrefix
+	if config.IptablesHashCommentPrefix != "" && config.IptablesHashCommentPrefix != rules.RuleHashPrefix {
+		// Take over, and then forget, the rules that we wrote with the default prefix.
+		hashPrefix = config.IptablesHashCommentPrefix
+		iptablesOptions.RetiredHashPrefixes = []string{rules.RuleHashPrefix}
+	}
+	if config.IptablesInsertLeaseFile != "" {
+		// Another agent on this host may be sharing the kernel chains with us; only one of
+		// us should program the inserts.
+		iptablesOptions.InsertOwner = iptables.NewInsertLease(
+			config.IptablesInsertLeaseFile,
+			config.IptablesInsertLeaseOwner,
+			config.IptablesInsertLeaseDuration,
+			iptables.InsertLeaseOptions{},
+		)
 	}
 
-	// However, the NAT tables need an extra cleanup regex.
-	iptablesNATOptions := iptablesOptions
-	iptablesNATOptions.ExtraCleanupRegexPattern = rules.HistoricInsertedNATRuleRegex
+	dp.iptablesBackend = config.IptablesBackend
+	if config.IptablesBackend == iptables.BackendAuto {
+		detector := newIptablesBackendDetector(config)
+		dp.iptablesBackendDetector = detector
+		dp.iptablesBackend = detector.Detect("")
+		log.WithField("backend", dp.iptablesBackend).Info("Detected iptables backend")
+		iptablesOptions.BackendMode = dp.iptablesBackend
+	}
 
 	featureDetector := iptables.NewFeatureDetector()
 	iptablesFeatures := featureDetector.GetFeatures()
+	dp.iptablesFeatureDetector = featureDetector
 
 	var iptablesLock sync.Locker
 	if iptablesFeatures.RestoreSupportsLock {
 		log.Debug("Calico implementation of iptables lock disabled (because detected version of " +
 			"iptables-restore will use its own implementation).")
 		iptablesLock = dummyLock{}
-	} else if config.IptablesLockTimeout <= 0 {
-		log.Info("iptables lock disabled.")
-		iptablesLock = dummyLock{}
 	} else {
 		// Create the shared iptables lock.  This allows us to block other processes from
 		// manipulating iptables while we make our updates.  We use a shared lock because we
 		// actually do multiple updates in parallel (but to different tables), which is safe.
-		log.WithField("timeout", config.IptablesLockTimeout).Info(
-			"iptables lock enabled")
+		// The lock does nothing while its timeout is zero but we create it anyway so that
+		// it can be enabled by a later IptablesTuningUpdate.
+		if config.IptablesLockTimeout <= 0 {
+			log.Info("iptables lock disabled.")
+		} else {
+			log.WithField("timeout", config.IptablesLockTimeout).Info(
+				"iptables lock enabled")
+		}
 		iptablesLock = iptables.NewSharedLock(
 			config.IptablesLockFilePath,
 			config.IptablesLockTimeout,
 			config.IptablesLockProbeInterval,
 		)
 	}
+	dp.iptablesLock = iptablesLock
 
 	mangleTableV4 := iptables.NewTable(
 		"mangle",
 		4,
-		rules.RuleHashPrefix,
+		hashPrefix,
 		iptablesLock,
 		featureDetector,
 		iptablesOptions)
 	natTableV4 := iptables.NewTable(
 		"nat",
 		4,
-		rules.RuleHashPrefix,
+		hashPrefix,
 		iptablesLock,
 		featureDetector,
-		iptablesNATOptions,
+		iptablesOptions,
 	)
 	rawTableV4 := iptables.NewTable(
 		"raw",
 		4,
-		rules.RuleHashPrefix,
+		hashPrefix,
 		iptablesLock,
 		featureDetector,
 		iptablesOptions)
 	filterTableV4 := iptables.NewTable(
 		"filter",
 		4,
-		rules.RuleHashPrefix,
+		hashPrefix,
 		iptablesLock,
 		featureDetector,
 		iptablesOptions)
@@ -299,15 +492,19 @@ func NewIntDataplaneDriver(config Config) *InternalDataplane {
 	dp.iptablesRawTables = append(dp.iptablesRawTables, rawTableV4)
 	dp.iptablesMangleTables = append(dp.iptablesMangleTables, mangleTableV4)
 	dp.iptablesFilterTables = append(dp.iptablesFilterTables, filterTableV4)
+	dp.iptablesTableSets = append(dp.iptablesTableSets, iptables.NewTableSet(4,
+		[]*iptables.Table{rawTableV4, mangleTableV4, natTableV4, filterTableV4},
+		iptables.TableSetOptions{}))
 	dp.ipSets = append(dp.ipSets, ipSetsV4)
 
 	routeTableV4 := routetable.New(config.RulesConfig.WorkloadIfacePrefixes, 4, config.NetlinkTimeout)
 	dp.routeTables = append(dp.routeTables, routeTableV4)
 
 	dp.endpointStatusCombiner = newEndpointStatusCombiner(dp.fromDataplane, config.IPv6Enabled)
+	dp.events.AddHandler(dp.endpointStatusCombiner.OnEvent)
 
 	dp.RegisterManager(newIPSetsManager(ipSetsV4, config.MaxIPSetSize))
-	dp.RegisterManager(newPolicyManager(rawTableV4, mangleTableV4, filterTableV4, ruleRenderer, 4))
+	dp.RegisterManager(newPolicyManager(rawTableV4, mangleTableV4, filterTableV4, ruleRenderer, 4, dp.chainProvenance, config.MaxPolicyChains))
 	dp.RegisterManager(newEndpointManager(
 		rawTableV4,
 		mangleTableV4,
@@ -316,9 +513,16 @@ func NewIntDataplaneDriver(config Config) *InternalDataplane {
 		routeTableV4,
 		4,
 		config.RulesConfig.WorkloadIfacePrefixes,
-		dp.endpointStatusCombiner.OnEndpointStatusUpdate))
+		dp.publishEndpointStatus))
 	dp.RegisterManager(newFloatingIPManager(natTableV4, ruleRenderer, 4))
 	dp.RegisterManager(newMasqManager(ipSetsV4, natTableV4, ruleRenderer, config.MaxIPSetSize, 4))
+	if config.BreakGlassFile != "" {
+		dp.registerBreakGlassManager(newBreakGlassManager(filterTableV4, ruleRenderer,
+			config.BreakGlassFile, config.BreakGlassCIDRs, config.BreakGlassTTL, 4))
+	}
+	if config.StandbyActivationFile != "" {
+		dp.standby = newWarmStandby(config.StandbyActivationFile)
+	}
 	if config.RulesConfig.IPIPEnabled {
 		// Add a manger to keep the all-hosts IP set up to date.
 		dp.ipipManager = newIPIPManager(ipSetsV4, config.MaxIPSetSize)
@@ -328,7 +532,7 @@ func NewIntDataplaneDriver(config Config) *InternalDataplane {
 		mangleTableV6 := iptables.NewTable(
 			"mangle",
 			6,
-			rules.RuleHashPrefix,
+			hashPrefix,
 			iptablesLock,
 			featureDetector,
 			iptablesOptions,
@@ -336,15 +540,15 @@ func NewIntDataplaneDriver(config Config) *InternalDataplane {
 		natTableV6 := iptables.NewTable(
 			"nat",
 			6,
-			rules.RuleHashPrefix,
+			hashPrefix,
 			iptablesLock,
 			featureDetector,
-			iptablesNATOptions,
+			iptablesOptions,
 		)
 		rawTableV6 := iptables.NewTable(
 			"raw",
 			6,
-			rules.RuleHashPrefix,
+			hashPrefix,
 			iptablesLock,
 			featureDetector,
 			iptablesOptions,
@@ -352,7 +556,7 @@ func NewIntDataplaneDriver(config Config) *InternalDataplane {
 		filterTableV6 := iptables.NewTable(
 			"filter",
 			6,
-			rules.RuleHashPrefix,
+			hashPrefix,
 			iptablesLock,
 			featureDetector,
 			iptablesOptions,
@@ -365,12 +569,15 @@ func NewIntDataplaneDriver(config Config) *InternalDataplane {
 		dp.iptablesRawTables = append(dp.iptablesRawTables, rawTableV6)
 		dp.iptablesMangleTables = append(dp.iptablesMangleTables, mangleTableV6)
 		dp.iptablesFilterTables = append(dp.iptablesFilterTables, filterTableV6)
+		dp.iptablesTableSets = append(dp.iptablesTableSets, iptables.NewTableSet(6,
+			[]*iptables.Table{rawTableV6, mangleTableV6, natTableV6, filterTableV6},
+			iptables.TableSetOptions{}))
 
 		routeTableV6 := routetable.New(config.RulesConfig.WorkloadIfacePrefixes, 6, config.NetlinkTimeout)
 		dp.routeTables = append(dp.routeTables, routeTableV6)
 
 		dp.RegisterManager(newIPSetsManager(ipSetsV6, config.MaxIPSetSize))
-		dp.RegisterManager(newPolicyManager(rawTableV6, mangleTableV6, filterTableV6, ruleRenderer, 6))
+		dp.RegisterManager(newPolicyManager(rawTableV6, mangleTableV6, filterTableV6, ruleRenderer, 6, dp.chainProvenance, config.MaxPolicyChains))
 		dp.RegisterManager(newEndpointManager(
 			rawTableV6,
 			mangleTableV6,
@@ -379,9 +586,13 @@ func NewIntDataplaneDriver(config Config) *InternalDataplane {
 			routeTableV6,
 			6,
 			config.RulesConfig.WorkloadIfacePrefixes,
-			dp.endpointStatusCombiner.OnEndpointStatusUpdate))
+			dp.publishEndpointStatus))
 		dp.RegisterManager(newFloatingIPManager(natTableV6, ruleRenderer, 6))
 		dp.RegisterManager(newMasqManager(ipSetsV6, natTableV6, ruleRenderer, config.MaxIPSetSize, 6))
+		if config.BreakGlassFile != "" {
+			dp.registerBreakGlassManager(newBreakGlassManager(filterTableV6, ruleRenderer,
+				config.BreakGlassFile, config.BreakGlassCIDRs, config.BreakGlassTTL, 6))
+		}
 	}
 
 	for _, t := range dp.iptablesMangleTables {
@@ -431,6 +642,18 @@ func (d *InternalDataplane) RegisterManager(mgr Manager) {
 	d.allManagers = append(d.allManagers, mgr)
 }
 
+func (d *InternalDataplane) registerBreakGlassManager(mgr *breakGlassManager) {
+	d.breakGlassManagers = append(d.breakGlassManagers, mgr)
+	d.RegisterManager(mgr)
+}
+
+// currentConfig returns a copy of the config, for use off the main loop.
+func (d *InternalDataplane) currentConfig() Config {
+	d.configLock.RLock()
+	defer d.configLock.RUnlock()
+	return d.config
+}
+
 func (d *InternalDataplane) Start() {
 	// Do our start-of-day configuration.
 	d.doStaticDataplaneConfig()
@@ -439,6 +662,9 @@ func (d *InternalDataplane) Start() {
 	go d.loopUpdatingDataplane()
 	go d.loopReportingStatus()
 	go d.ifaceMonitor.MonitorInterfaces()
+	if d.firewalldMonitor != nil {
+		go d.firewalldMonitor.MonitorReloads()
+	}
 }
 
 // onIfaceStateChange is our interface monitor callback.  It gets called from the monitor's thread.
@@ -476,6 +702,26 @@ type ifaceAddrsUpdate struct {
 	Addrs set.Set
 }
 
+// onIfaceAliasChange is our interface alias monitor callback.  It gets called
+// from the monitor's thread.
+func (d *InternalDataplane) onIfaceAliasChange(ifaceName string, alias string) {
+	log.WithFields(log.Fields{
+		"ifaceName": ifaceName,
+		"alias":     alias,
+	}).Info("Linux interface alias changed.")
+	d.ifaceAliasUpdates <- &ifaceAliasUpdate{
+		Name:  ifaceName,
+		Alias: alias,
+	}
+}
+
+// ifaceAliasUpdate is sent to the managers when an interface's alias changes.  Alias is ""
+// if the alias was removed or the interface has gone away.
+type ifaceAliasUpdate struct {
+	Name  string
+	Alias string
+}
+
 func (d *InternalDataplane) SendMessage(msg interface{}) error {
 	d.toDataplane <- msg
 	return nil
@@ -497,29 +743,15 @@ func (d *InternalDataplane) doStaticDataplaneConfig() {
 	// Felix being able to configure it.
 	writeProcSys("/proc/sys/net/ipv4/conf/default/rp_filter", "1")
 
-	for _, t := range d.iptablesRawTables {
-		rawChains := d.ruleRenderer.StaticRawTableChains(t.IPVersion)
-		t.UpdateChains(rawChains)
-		t.SetRuleInsertions("PREROUTING", []iptables.Rule{{
-			Action: iptables.JumpAction{Target: rules.ChainRawPrerouting},
-		}})
-		t.SetRuleInsertions("OUTPUT", []iptables.Rule{{
-			Action: iptables.JumpAction{Target: rules.ChainRawOutput},
-		}})
-	}
-
-	for _, t := range d.iptablesFilterTables {
-		filterChains := d.ruleRenderer.StaticFilterTableChains(t.IPVersion)
-		t.UpdateChains(filterChains)
-		t.SetRuleInsertions("FORWARD", []iptables.Rule{{
-			Action: iptables.JumpAction{Target: rules.ChainFilterForward},
-		}})
-		t.SetRuleInsertions("INPUT", []iptables.Rule{{
-			Action: iptables.JumpAction{Target: rules.ChainFilterInput},
-		}})
-		t.SetRuleInsertions("OUTPUT", []iptables.Rule{{
-			Action: iptables.JumpAction{Target: rules.ChainFilterOutput},
-		}})
+	for _, t := range d.allIptablesTables {
+		static := d.staticIptablesChains(t.IPVersion)[t.Name]
+		if static == nil {
+			continue
+		}
+		t.UpdateChains(static.Chains)
+		for chainName, insertedRules := range static.Insertions {
+			t.SetRuleInsertions(chainName, insertedRules)
+		}
 	}
 
 	if d.config.RulesConfig.IPIPEnabled {
@@ -531,26 +763,16 @@ func (d *InternalDataplane) doStaticDataplaneConfig() {
 	} else {
 		log.Info("IPIP disabled. Not starting tunnel update thread.")
 	}
+}
 
-	for _, t := range d.iptablesNATTables {
-		t.UpdateChains(d.ruleRenderer.StaticNATTableChains(t.IPVersion))
-		t.SetRuleInsertions("PREROUTING", []iptables.Rule{{
-			Action: iptables.JumpAction{Target: rules.ChainNATPrerouting},
-		}})
-		t.SetRuleInsertions("POSTROUTING", []iptables.Rule{{
-			Action: iptables.JumpAction{Target: rules.ChainNATPostrouting},
-		}})
-		t.SetRuleInsertions("OUTPUT", []iptables.Rule{{
-			Action: iptables.JumpAction{Target: rules.ChainNATOutput},
-		}})
-	}
-
-	for _, t := range d.iptablesMangleTables {
-		t.UpdateChains(d.ruleRenderer.StaticMangleTableChains(t.IPVersion))
-		t.SetRuleInsertions("PREROUTING", []iptables.Rule{{
-			Action: iptables.JumpAction{Target: rules.ChainManglePrerouting},
-		}})
+// precomputeIptablesHashes renders and hashes the chains that are queued in our iptables
+// Tables so that the next apply() only needs to compare them with the dataplane.
+func (d *InternalDataplane) precomputeIptablesHashes() {
+	start := time.Now()
+	for _, t := range d.allIptablesTables {
+		t.PrecomputeHashes()
 	}
+	log.WithField("duration", time.Since(start)).Debug("Precomputed iptables rule hashes")
 }
 
 func (d *InternalDataplane) loopUpdatingDataplane() {
@@ -558,6 +780,22 @@ func (d *InternalDataplane) loopUpdatingDataplane() {
 	healthTicks := time.NewTicker(healthInterval).C
 	d.reportHealth()
 
+	// We can't apply any updates until the datastore is in sync but, while we wait, we can get
+	// a head start on rendering our static chains so that the first apply has less to do.
+	d.precomputeIptablesHashes()
+
+	// If we're in warm standby, poll for the activation file.  The file may already exist, in
+	// which case we activate straight away.
+	var standbyC <-chan time.Time
+	d.checkStandbyActivationFile()
+	if d.inStandby() {
+		log.WithField("file", d.standby.file).Info(
+			"Starting in warm standby, dataplane won't be programmed until activated")
+		standbyTicker := time.NewTicker(standbyCheckInterval)
+		defer standbyTicker.Stop()
+		standbyC = standbyTicker.C
+	}
+
 	// Retry any failed operations every 10s.
 	retryTicker := time.NewTicker(10 * time.Second)
 
@@ -582,6 +820,18 @@ func (d *InternalDataplane) loopUpdatingDataplane() {
 		)
 		routeRefreshC = refreshTicker.C
 	}
+	var backendRecheckC <-chan time.Time
+	if d.config.IptablesBackendRecheckInterval > 0 {
+		// IptablesBackend can change to "auto" without a restart so we need the timer even if
+		// we're not detecting the backend yet.
+		log.WithField("interval", d.config.IptablesBackendRecheckInterval).Info(
+			"Will re-detect iptables backend on timer if IptablesBackend is auto")
+		recheckTicker := jitter.NewTicker(
+			d.config.IptablesBackendRecheckInterval,
+			d.config.IptablesBackendRecheckInterval/10,
+		)
+		backendRecheckC = recheckTicker.C
+	}
 
 	// Fill the apply throttle leaky bucket.
 	throttleC := jitter.NewTicker(100*time.Millisecond, 10*time.Millisecond).C
@@ -589,19 +839,48 @@ func (d *InternalDataplane) loopUpdatingDataplane() {
 
 	datastoreInSync := false
 
-	processMsgFromCalcGraph := func(msg interface{}) {
+	// If configured, don't wait for the datastore indefinitely.
+	var inSyncTimeoutC <-chan time.Time
+	if d.config.DatastoreInSyncTimeout > 0 {
+		inSyncTimer := time.NewTimer(d.config.DatastoreInSyncTimeout)
+		defer inSyncTimer.Stop()
+		inSyncTimeoutC = inSyncTimer.C
+	}
+
+	// processMsgFromCalcGraph returns false for messages that don't change the dataplane, which
+	// don't need an apply.
+	processMsgFromCalcGraph := func(msg interface{}) bool {
+		if msg, ok := msg.(*proto.DatastoreUpdateBatch); ok {
+			// Only sent when tracing is enabled; the revisions are attached to the trace
+			// of the next apply.
+			log.WithField("msg", msg).Debug("Received datastore revisions from calculation graph")
+			d.recordMsgStat(msg)
+			if d.firstUnappliedRevision == "" {
+				d.firstUnappliedRevision = msg.FirstRevision
+			}
+			d.lastUnappliedRevision = msg.LastRevision
+			return false
+		}
 		log.WithField("msg", msgStringer{msg: msg}).Infof(
 			"Received %T update from calculation graph", msg)
 		d.recordMsgStat(msg)
 		for _, mgr := range d.allManagers {
 			mgr.OnUpdate(msg)
 		}
-		switch msg.(type) {
+		if event, ok := endpointUpdateEvent(msg); ok {
+			d.events.Publish(event)
+		}
+		switch msg := msg.(type) {
+		case *IptablesTuningUpdate:
+			d.onIptablesTuningUpdate(msg)
 		case *proto.InSync:
 			log.WithField("timeSinceStart", monotime.Since(processStartTime)).Info(
 				"Datastore in sync, flushing the dataplane for the first time...")
 			datastoreInSync = true
+			inSyncTimeoutC = nil
+			d.onDatastoreInSync()
 		}
+		return true
 	}
 
 	processIfaceUpdate := func(ifaceUpdate *ifaceUpdate) {
@@ -612,6 +891,7 @@ func (d *InternalDataplane) loopUpdatingDataplane() {
 		for _, routeTable := range d.routeTables {
 			routeTable.OnIfaceStateChanged(ifaceUpdate.Name, ifaceUpdate.State)
 		}
+		d.events.Publish(InterfaceStateEvent{Name: ifaceUpdate.Name, State: ifaceUpdate.State})
 	}
 
 	processAddrsUpdate := func(ifaceAddrsUpdate *ifaceAddrsUpdate) {
@@ -619,6 +899,10 @@ func (d *InternalDataplane) loopUpdatingDataplane() {
 		for _, mgr := range d.allManagers {
 			mgr.OnUpdate(ifaceAddrsUpdate)
 		}
+		d.events.Publish(InterfaceAddrsEvent{
+			Name:  ifaceAddrsUpdate.Name,
+			Addrs: sortedAddrs(ifaceAddrsUpdate.Addrs),
+		})
 	}
 
 	for {
@@ -627,20 +911,28 @@ func (d *InternalDataplane) loopUpdatingDataplane() {
 			// Process the message we received, then opportunistically process any other
 			// pending messages.
 			batchSize := 1
-			processMsgFromCalcGraph(msg)
+			needsSync := processMsgFromCalcGraph(msg)
 		msgLoop1:
 			for i := 0; i < msgPeekLimit; i++ {
 				select {
 				case msg := <-d.toDataplane:
-					processMsgFromCalcGraph(msg)
+					if processMsgFromCalcGraph(msg) {
+						needsSync = true
+					}
 					batchSize++
 				default:
 					// Channel blocked so we must be caught up.
 					break msgLoop1
 				}
 			}
-			d.dataplaneNeedsSync = true
+			if needsSync {
+				d.dataplaneNeedsSync = true
+			}
 			summaryBatchSize.Observe(float64(batchSize))
+			if !datastoreInSync || d.inStandby() {
+				// Likewise, render the chains that the managers have queued so far.
+				d.precomputeIptablesHashes()
+			}
 		case ifaceUpdate := <-d.ifaceUpdates:
 			// Process the message we received, then opportunistically process any other
 			// pending messages.
@@ -675,6 +967,28 @@ func (d *InternalDataplane) loopUpdatingDataplane() {
 			}
 			summaryAddrBatchSize.Observe(float64(batchSize))
 			d.dataplaneNeedsSync = true
+		case ifaceAliasUpdate := <-d.ifaceAliasUpdates:
+			// Alias changes are rare so we don't bother to batch them.
+			log.WithField("msg", ifaceAliasUpdate).Info("Received interface alias update")
+			for _, mgr := range d.allManagers {
+				mgr.OnUpdate(ifaceAliasUpdate)
+			}
+			d.dataplaneNeedsSync = true
+		case event := <-d.iptablesTamperEvents:
+			// Handled by onTamperEvent, along with any other subscribers.
+			d.events.Publish(TamperEvent(event))
+		case <-d.firewalldReloads:
+			// firewalld rewrites the tables wholesale when it reloads so all our rules are
+			// likely to be gone; re-check every table now rather than waiting for the
+			// refresh timers.
+			log.Warn("firewalld reloaded, re-checking all iptables tables")
+			for _, t := range d.allIptablesTables {
+				t.InvalidateDataplaneCache("firewalld reloaded")
+			}
+			d.dataplaneNeedsSync = true
+		case f := <-d.loopFuncs:
+			f()
+			d.dataplaneNeedsSync = true
 		case <-ipSetsRefreshC:
 			log.Debug("Refreshing IP sets state")
 			d.forceIPSetsRefresh = true
@@ -683,6 +997,9 @@ func (d *InternalDataplane) loopUpdatingDataplane() {
 			log.Debug("Refreshing routes")
 			d.forceRouteRefresh = true
 			d.dataplaneNeedsSync = true
+		case <-backendRecheckC:
+			log.Debug("Re-detecting iptables backend")
+			d.redetectIptablesBackend()
 		case <-d.reschedC:
 			log.Debug("Reschedule kick received")
 			d.dataplaneNeedsSync = true
@@ -693,14 +1010,30 @@ func (d *InternalDataplane) loopUpdatingDataplane() {
 			d.applyThrottle.Refill()
 		case <-healthTicks:
 			d.reportHealth()
+		case <-inSyncTimeoutC:
+			inSyncTimeoutC = nil
+			if !datastoreInSync {
+				d.onInSyncTimeout()
+				datastoreInSync = true
+			}
+		case <-standbyC:
+			d.checkStandbyActivationFile()
+			if !d.inStandby() {
+				standbyC = nil
+			}
 		case <-retryTicker.C:
+			for _, mgr := range d.breakGlassManagers {
+				if mgr.CheckFile() {
+					d.dataplaneNeedsSync = true
+				}
+			}
 		case <-d.debugHangC:
 			log.Warning("Debug hang simulation timer popped, hanging the dataplane!!")
 			time.Sleep(1 * time.Hour)
 			log.Panic("Woke up after 1 hour, something's probably wrong with the test.")
 		}
 
-		if datastoreInSync && d.dataplaneNeedsSync {
+		if datastoreInSync && d.dataplaneNeedsSync && !d.inStandby() {
 			// Dataplane is out-of-sync, check if we're throttled.
 			if d.applyThrottle.Admit() {
 				if beingThrottled && d.applyThrottle.WouldAdmit() {
@@ -712,6 +1045,7 @@ func (d *InternalDataplane) loopUpdatingDataplane() {
 
 				// Actually apply the changes to the dataplane.
 				d.apply()
+				d.tableEvents.PublishTo(d.events)
 
 				// Record stats.
 				applyTime := monotime.Since(applyStart)
@@ -721,6 +1055,10 @@ func (d *InternalDataplane) loopUpdatingDataplane() {
 					// Dataplane is still dirty, record an error.
 					countDataplaneSyncErrors.Inc()
 				}
+				d.events.Publish(ApplyResultEvent{
+					Succeeded: !d.dataplaneNeedsSync,
+					Duration:  applyTime,
+				})
 				log.WithField("msecToApply", applyTime.Seconds()*1000.0).Info(
 					"Finished applying updates to dataplane.")
 
@@ -820,6 +1158,25 @@ func (d *InternalDataplane) apply() {
 	// Unset the needs-sync flag, we'll set it again if something fails.
 	d.dataplaneNeedsSync = false
 
+	ctx := context.Background()
+	if d.config.Tracer != nil {
+		var span iptables.Span
+		ctx, span = d.config.Tracer.StartSpan(ctx, "dataplane.apply")
+		if d.lastUnappliedRevision != "" {
+			span.SetAttribute("felix.first_revision", d.firstUnappliedRevision)
+			span.SetAttribute("felix.last_revision", d.lastUnappliedRevision)
+		}
+		defer func() {
+			var err error
+			if d.dataplaneNeedsSync {
+				err = errors.New("dataplane update incomplete, will retry")
+			}
+			span.End(err)
+		}()
+	}
+	d.firstUnappliedRevision = ""
+	d.lastUnappliedRevision = ""
+
 	// First, give the managers a chance to update IP sets and iptables.
 	for _, mgr := range d.allManagers {
 		err := mgr.CompleteDeferredWork()
@@ -875,14 +1232,17 @@ func (d *InternalDataplane) apply() {
 	// Wait for the IP sets update to finish.  We can't update iptables until it has.
 	ipSetsWG.Wait()
 
-	// Update iptables, this should sever any references to now-unused IP sets.
+	// Update iptables, this should sever any references to now-unused IP sets.  Each TableSet
+	// applies its tables in order, with a shared iptables-save; the IPv4 and IPv6 TableSets
+	// are independent so we apply them in parallel.
 	var reschedDelayMutex sync.Mutex
 	var reschedDelay time.Duration
 	var iptablesWG sync.WaitGroup
-	for _, t := range d.allIptablesTables {
+	for _, ts := range d.iptablesTableSets {
 		iptablesWG.Add(1)
-		go func(t *iptables.Table) {
-			tableReschedAfter := t.Apply()
+		go func(ts *iptables.TableSet) {
+			// Our Tables panic rather than returning an error.
+			tableReschedAfter, _ := ts.ApplyContext(ctx)
 
 			reschedDelayMutex.Lock()
 			defer reschedDelayMutex.Unlock()
@@ -890,19 +1250,24 @@ func (d *InternalDataplane) apply() {
 				reschedDelay = tableReschedAfter
 			}
 			iptablesWG.Done()
-		}(t)
+		}(ts)
 	}
 	iptablesWG.Wait()
-
-	// Now clean up any left-over IP sets.
-	for _, ipSets := range d.ipSets {
-		ipSetsWG.Add(1)
-		go func(s *ipsets.IPSets) {
-			s.ApplyDeletions()
-			ipSetsWG.Done()
-		}(ipSets)
+	d.checkQuarantinedChains()
+	d.checkKernelHooks()
+
+	// Now clean up any left-over IP sets.  If we're programming the dataplane on the in-sync
+	// timeout, we don't know all the IP sets that we need yet so we leave them in place.
+	if !d.inSyncTimedOut {
+		for _, ipSets := range d.ipSets {
+			ipSetsWG.Add(1)
+			go func(s *ipsets.IPSets) {
+				s.ApplyDeletions()
+				ipSetsWG.Done()
+			}(ipSets)
+		}
+		ipSetsWG.Wait()
 	}
-	ipSetsWG.Wait()
 
 	// Wait for the route updates to finish.
 	routesWG.Wait()
@@ -1002,11 +1367,92 @@ func (d *InternalDataplane) reportHealth() {
 	if d.config.HealthAggregator != nil {
 		d.config.HealthAggregator.Report(
 			healthName,
-			&health.HealthReport{Live: true, Ready: d.doneFirstApply},
+			&health.HealthReport{
+				Live: true,
+				Ready: d.doneFirstApply && d.kernelHooksVerified && d.numQuarantinedChains == 0 &&
+					!d.inSyncTimedOut,
+			},
 		)
 	}
 }
 
+// onIptablesTamperDetected is called by the iptables Tables, from within apply(), when they
+// detect that another process has removed our rules.  It passes the event to the main loop
+// without blocking.
+func (d *InternalDataplane) onIptablesTamperDetected(event iptables.TamperEvent) {
+	select {
+	case d.iptablesTamperEvents <- event:
+	default:
+		// Main loop already has events queued, it'll re-check everything anyway.
+		log.WithField("event", event).Debug("Tamper event channel full, dropping event")
+	}
+}
+
+// onTamperEvent is our event bus handler for TamperEvents.  Whoever removed our rules from one
+// chain may have interfered with others so we re-check all our tables rather than waiting for
+// their refresh timers.
+func (d *InternalDataplane) onTamperEvent(event interface{}) {
+	tamper, ok := event.(TamperEvent)
+	if !ok {
+		return
+	}
+	log.WithFields(log.Fields{
+		"ipVersion": tamper.IPVersion,
+		"table":     tamper.Table,
+		"chainName": tamper.ChainName,
+	}).Error("Detected tampering with Felix's iptables rules, re-checking all tables")
+	for _, t := range d.allIptablesTables {
+		t.InvalidateDataplaneCache("tampering detected")
+	}
+	d.dataplaneNeedsSync = true
+}
+
+// onIptablesOutOfSync is called by the iptables Tables, from within apply(), when they find
+// that another process has modified one of our chains.  The IPv4 and IPv6 tables are applied
+// concurrently so it queues the DriftEvent for the main loop, which publishes it after the
+// apply.
+func (d *InternalDataplane) onIptablesOutOfSync(chainName string, reason string) {
+	d.tableEvents.Add(DriftEvent{ChainName: chainName, Reason: reason})
+}
+
+// publishEndpointStatus is the endpoint managers' status callback.  They call it from
+// CompleteDeferredWork, on the main loop, so it publishes the status directly; the
+// endpointStatusCombiner handles it.
+func (d *InternalDataplane) publishEndpointStatus(ipVersion uint8, id interface{}, status string) {
+	d.events.Publish(EndpointStatusEvent{IPVersion: ipVersion, ID: id, Status: status})
+}
+
+// onFirewalldReload is our firewalld reload monitor callback.  It gets called from the monitor's
+// thread and passes the event to the main loop without blocking.
+func (d *InternalDataplane) onFirewalldReload() {
+	select {
+	case d.firewalldReloads <- struct{}{}:
+	default:
+		// Main loop already has a reload queued.
+	}
+}
+
+// checkQuarantinedChains logs any iptables chains that are quarantined and updates our health
+// accordingly.
+func (d *InternalDataplane) checkQuarantinedChains() {
+	numQuarantined := 0
+	for _, t := range d.allIptablesTables {
+		for _, qc := range t.QuarantinedChains() {
+			numQuarantined++
+			log.WithFields(log.Fields{
+				"ipVersion":  t.IPVersion,
+				"table":      t.Name,
+				"chainName":  qc.Name,
+				"failedLine": qc.FailedLine,
+			}).Error("iptables chain is quarantined due to repeated failures")
+		}
+	}
+	if numQuarantined != d.numQuarantinedChains {
+		d.numQuarantinedChains = numQuarantined
+		d.reportHealth()
+	}
+}
+
 type dummyLock struct{}
 
 func (d dummyLock) Lock() {
@@ -16,6 +16,8 @@ package intdataplane_test
 
 import (
 	"net"
+	"net/http"
+	"net/http/httptest"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -77,6 +79,27 @@ var _ = Describe("Constructor test", func() {
 		Expect(dp).ToNot(BeNil())
 	})
 
+	It("should render its static chains", func() {
+		var dp = intdataplane.NewIntDataplaneDriver(dpConfig)
+		rendered := string(dp.RenderStaticChains(4))
+		Expect(rendered).To(HavePrefix("*raw\n"))
+		Expect(rendered).To(ContainSubstring(":cali-failsafe-in - -\n"))
+		Expect(rendered).To(ContainSubstring("-I FORWARD 1 --jump cali-FORWARD\n"))
+		Expect(rendered).NotTo(ContainSubstring("cali:"))
+	})
+
+	It("should serve its static chains", func() {
+		var dp = intdataplane.NewIntDataplaneDriver(dpConfig)
+		recorder := httptest.NewRecorder()
+		dp.ServeStaticChains(recorder, httptest.NewRequest("GET", "/static-chains", nil))
+		Expect(recorder.Code).To(Equal(http.StatusOK))
+		Expect(recorder.Body.String()).To(Equal(string(dp.RenderStaticChains(4))))
+
+		recorder = httptest.NewRecorder()
+		dp.ServeStaticChains(recorder, httptest.NewRequest("GET", "/static-chains?ipVersion=5", nil))
+		Expect(recorder.Code).To(Equal(http.StatusBadRequest))
+	})
+
 	Context("with health aggregator", func() {
 
 		BeforeEach(func() {
@@ -0,0 +1,134 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intdataplane
+
+import (
+	"context"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/projectcalico/felix/iptables"
+	"github.com/projectcalico/felix/rules"
+)
+
+// newIptablesBackendDetector returns the detector that we use when IptablesBackend is "auto".
+func newIptablesBackendDetector(config Config) *iptables.BackendDetector {
+	detector := iptables.NewBackendDetector(rules.AllHistoricChainNamePrefixes)
+	if config.LookPathOverride != nil {
+		detector.LookPath = config.LookPathOverride
+	}
+	return detector
+}
+
+// redetectIptablesBackend is called periodically.  If IptablesBackend is "auto" and the host
+// has moved to the other iptables backend, it moves all our tables over to it.
+func (d *InternalDataplane) redetectIptablesBackend() {
+	if d.iptablesBackendDetector == nil {
+		return
+	}
+	d.moveIptablesBackend(d.iptablesBackendDetector.Detect(d.iptablesBackend))
+}
+
+// onIptablesBackendUpdate applies a change to IptablesBackend without a restart.  "auto" detects
+// the backend, as at start of day, and keeps re-detecting it; "legacy" or "nft" moves our tables
+// to that backend.  If the tables can't be moved, the old setting stays in effect.
+func (d *InternalDataplane) onIptablesBackendUpdate(mode string) {
+	log.WithFields(log.Fields{
+		"oldMode": d.config.IptablesBackend,
+		"newMode": mode,
+	}).Info("IptablesBackend changed")
+	var detector *iptables.BackendDetector
+	backend := mode
+	if mode == iptables.BackendAuto {
+		detector = d.iptablesBackendDetector
+		if detector == nil {
+			detector = newIptablesBackendDetector(d.config)
+		}
+		backend = detector.Detect(d.iptablesBackend)
+	}
+	if !d.moveIptablesBackend(backend) {
+		return
+	}
+	d.iptablesBackendDetector = detector
+	d.configLock.Lock()
+	d.config.IptablesBackend = mode
+	d.configLock.Unlock()
+}
+
+// moveIptablesBackend moves all our tables to the given backend, if they aren't already using
+// it.  By default, the tables switch immediately and clean up the old backend after their next
+// apply; in "guided" IptablesBackendMigration mode, each table is migrated in stages, with
+// rollback on failure.  Returns false if the tables are still using their old backend.
+func (d *InternalDataplane) moveIptablesBackend(backend string) bool {
+	if backend == d.iptablesBackend {
+		return true
+	}
+	if d.config.IptablesBackendMigration == "guided" {
+		if !migrateIptablesBackend(d.allIptablesTables, d.iptablesBackend, backend) {
+			// If we're detecting the backend, we'll try again on the next tick.
+			return false
+		}
+	} else if !switchIptablesBackend(d.allIptablesTables, backend) {
+		return false
+	}
+	d.iptablesBackend = backend
+	d.dataplaneNeedsSync = true
+	return true
+}
+
+// switchIptablesBackend moves each table to the given backend.  Returns false if the backend
+// isn't valid, in which case none of the tables will have been changed.
+func switchIptablesBackend(tables []*iptables.Table, backend string) bool {
+	log.WithField("backend", backend).Warn("Changing iptables backend, migrating our rules")
+	for _, t := range tables {
+		// All the tables validate the backend in the same way so, if the first one rejects
+		// it, none of them will have been changed.
+		if err := t.SwitchBackend(backend); err != nil {
+			log.WithError(err).Error("Failed to switch iptables backend")
+			return false
+		}
+	}
+	return true
+}
+
+// migrateIptablesBackend does a guided migration of each table to the given backend.  If any
+// table fails to migrate, the tables that have already been migrated are moved back so that all
+// the tables stay on the same backend.  Returns true if all the tables were migrated.
+func migrateIptablesBackend(tables []*iptables.Table, oldBackend, newBackend string) bool {
+	logCxt := log.WithFields(log.Fields{
+		"oldBackend": oldBackend,
+		"newBackend": newBackend,
+	})
+	logCxt.Warn("Changing iptables backend, starting guided migration")
+	ctx := context.Background()
+	for i, t := range tables {
+		err := t.MigrateBackend(ctx, newBackend)
+		if err == nil {
+			continue
+		}
+		logCxt.WithError(err).Error("Failed to migrate iptables table, moving other tables back")
+		for _, migrated := range tables[:i] {
+			if err := migrated.MigrateBackend(ctx, oldBackend); err != nil {
+				// Leave the table to clean up after itself; it'll program the old backend
+				// on its next apply.
+				logCxt.WithError(err).Error("Failed to move iptables table back, switching it")
+				_ = migrated.SwitchBackend(oldBackend)
+			}
+		}
+		return false
+	}
+	logCxt.Info("Migrated all iptables tables")
+	return true
+}
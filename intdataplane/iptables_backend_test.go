@@ -0,0 +1,110 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intdataplane
+
+import (
+	"errors"
+	"sync"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/projectcalico/felix/iptables"
+)
+
+var _ = Describe("Iptables backend switching", func() {
+	var tables []*iptables.Table
+
+	BeforeEach(func() {
+		tables = nil
+		for _, name := range []string{"filter", "nat"} {
+			tables = append(tables, iptables.NewTable(
+				name,
+				4,
+				"cali:",
+				&sync.Mutex{},
+				iptables.NewFeatureDetector(),
+				iptables.TableOptions{
+					HistoricChainPrefixes: []string{"cali-"},
+					BackendMode:           iptables.BackendLegacy,
+					LookPathOverride: func(file string) (string, error) {
+						return file, nil
+					},
+				},
+			))
+		}
+	})
+
+	It("should switch all the tables", func() {
+		Expect(switchIptablesBackend(tables, iptables.BackendNFT)).To(BeTrue())
+		for _, t := range tables {
+			Expect(t.BackendMode()).To(Equal(iptables.BackendNFT))
+		}
+	})
+
+	It("should reject an invalid backend", func() {
+		Expect(switchIptablesBackend(tables, iptables.BackendAuto)).To(BeFalse())
+		for _, t := range tables {
+			Expect(t.BackendMode()).To(Equal(iptables.BackendLegacy))
+		}
+	})
+
+	It("should reject an invalid backend when migrating", func() {
+		Expect(migrateIptablesBackend(tables, iptables.BackendLegacy, iptables.BackendAuto)).To(BeFalse())
+		for _, t := range tables {
+			Expect(t.BackendMode()).To(Equal(iptables.BackendLegacy))
+		}
+	})
+
+	Describe("on a change of IptablesBackend", func() {
+		var d *InternalDataplane
+
+		BeforeEach(func() {
+			d = &InternalDataplane{
+				allIptablesTables: tables,
+				iptablesBackend:   iptables.BackendLegacy,
+				config:            Config{IptablesBackend: iptables.BackendLegacy},
+			}
+		})
+
+		It("should move the tables to the new backend", func() {
+			d.onIptablesTuningUpdate(&IptablesTuningUpdate{Backend: iptables.BackendNFT})
+			for _, t := range tables {
+				Expect(t.BackendMode()).To(Equal(iptables.BackendNFT))
+			}
+			Expect(d.iptablesBackend).To(Equal(iptables.BackendNFT))
+			Expect(d.currentConfig().IptablesBackend).To(Equal(iptables.BackendNFT))
+			Expect(d.dataplaneNeedsSync).To(BeTrue())
+		})
+
+		It("should keep the old backend if the new one is invalid", func() {
+			d.onIptablesTuningUpdate(&IptablesTuningUpdate{Backend: "ebpf"})
+			for _, t := range tables {
+				Expect(t.BackendMode()).To(Equal(iptables.BackendLegacy))
+			}
+			Expect(d.currentConfig().IptablesBackend).To(Equal(iptables.BackendLegacy))
+		})
+
+		It("should start detecting the backend if it changes to auto", func() {
+			d.config.LookPathOverride = func(file string) (string, error) {
+				return "", errors.New("not found")
+			}
+			d.onIptablesTuningUpdate(&IptablesTuningUpdate{Backend: iptables.BackendAuto})
+			Expect(d.iptablesBackendDetector).NotTo(BeNil())
+			Expect(d.iptablesBackend).To(Equal(iptables.BackendLegacy))
+			Expect(d.currentConfig().IptablesBackend).To(Equal(iptables.BackendAuto))
+		})
+	})
+})
@@ -0,0 +1,64 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intdataplane
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/projectcalico/felix/iptables"
+)
+
+// IptablesSnapshot returns snapshots of all our iptables tables.  The tables are owned by the
+// main loop so this waits for the main loop to take the snapshots.
+func (d *InternalDataplane) IptablesSnapshot(ctx context.Context) ([]iptables.TableSnapshot, error) {
+	var snaps []iptables.TableSnapshot
+	err := d.runInLoop(ctx, func() {
+		for _, t := range d.allIptablesTables {
+			snaps = append(snaps, t.Snapshot())
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return snaps, nil
+}
+
+// ServeIptablesSnapshot is an http.HandlerFunc that responds with the output of
+// IptablesSnapshot, as JSON.  With "?compact=true", the dataplane hashes are sent in the compact
+// encoding of iptables.EncodeHashes, which keeps the response small on nodes with very large
+// numbers of rules.
+func (d *InternalDataplane) ServeIptablesSnapshot(w http.ResponseWriter, req *http.Request) {
+	snaps, err := d.IptablesSnapshot(req.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if req.URL.Query().Get("compact") == "true" {
+		// The snapshots are copies so we can encode them here, off the main loop.
+		for i := range snaps {
+			snaps[i].CompactDataplaneHashes()
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(snaps); err != nil {
+		log.WithError(err).Debug("Failed to write iptables snapshot response")
+	}
+}
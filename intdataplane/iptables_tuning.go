@@ -0,0 +1,80 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intdataplane
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/projectcalico/felix/iptables"
+)
+
+// IptablesTuningUpdate is sent to the dataplane, instead of restarting Felix, when the only
+// config changes are to the iptables tuning parameters, which can differ from node to node.
+type IptablesTuningUpdate struct {
+	RefreshInterval   time.Duration
+	InsertMode        string
+	LockTimeout       time.Duration
+	LockProbeInterval time.Duration
+	HashCommentPrefix string
+	// Backend is the new IptablesBackend: "legacy", "nft" or "auto".
+	Backend string
+}
+
+func (d *InternalDataplane) onIptablesTuningUpdate(msg *IptablesTuningUpdate) {
+	if !applyIptablesTuning(d.allIptablesTables, d.iptablesLock, msg) {
+		return
+	}
+	d.configLock.Lock()
+	d.config.IptablesRefreshInterval = msg.RefreshInterval
+	d.config.IptablesInsertMode = msg.InsertMode
+	d.config.IptablesLockTimeout = msg.LockTimeout
+	d.config.IptablesLockProbeInterval = msg.LockProbeInterval
+	if msg.HashCommentPrefix != "" {
+		d.config.IptablesHashCommentPrefix = msg.HashCommentPrefix
+	}
+	d.configLock.Unlock()
+	if msg.Backend != "" && msg.Backend != d.config.IptablesBackend {
+		d.onIptablesBackendUpdate(msg.Backend)
+	}
+}
+
+// applyIptablesTuning passes the new tuning parameters to each table and to our implementation
+// of the xtables lock, if it's in use.  Returns false, having changed nothing, if the
+// parameters are invalid.
+func applyIptablesTuning(tables []*iptables.Table, lock sync.Locker, msg *IptablesTuningUpdate) bool {
+	log.WithField("update", *msg).Info("Applying new iptables tuning parameters")
+	tuning := iptables.Tuning{
+		RefreshInterval:   msg.RefreshInterval,
+		InsertMode:        msg.InsertMode,
+		LockTimeout:       msg.LockTimeout,
+		LockProbeInterval: msg.LockProbeInterval,
+		HashCommentPrefix: msg.HashCommentPrefix,
+	}
+	for _, t := range tables {
+		// All the tables validate the update in the same way so, if the first one rejects
+		// it, none of them will have been changed.
+		if err := t.UpdateTuning(tuning); err != nil {
+			log.WithError(err).Error("Ignoring invalid iptables tuning parameters")
+			return false
+		}
+	}
+	if sharedLock, ok := lock.(*iptables.SharedLock); ok {
+		sharedLock.SetTimeouts(msg.LockTimeout, msg.LockProbeInterval)
+	}
+	return true
+}
@@ -0,0 +1,106 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intdataplane
+
+import (
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/projectcalico/felix/iptables"
+)
+
+var _ = Describe("Iptables tuning updates", func() {
+	var tables []*iptables.Table
+
+	BeforeEach(func() {
+		tables = nil
+		for _, name := range []string{"filter", "nat"} {
+			tables = append(tables, iptables.NewTable(
+				name,
+				4,
+				"cali:",
+				&sync.Mutex{},
+				iptables.NewFeatureDetector(),
+				iptables.TableOptions{
+					HistoricChainPrefixes: []string{"cali-"},
+					RefreshInterval:       90 * time.Second,
+					LookPathOverride: func(file string) (string, error) {
+						return file, nil
+					},
+				},
+			))
+		}
+	})
+
+	It("should update all the tables", func() {
+		ok := applyIptablesTuning(tables, dummyLock{}, &IptablesTuningUpdate{
+			RefreshInterval:   30 * time.Second,
+			InsertMode:        "append",
+			LockTimeout:       5 * time.Second,
+			LockProbeInterval: 100 * time.Millisecond,
+			HashCommentPrefix: "acme:",
+		})
+		Expect(ok).To(BeTrue())
+		for _, t := range tables {
+			Expect(t.Tuning()).To(Equal(iptables.Tuning{
+				RefreshInterval:   30 * time.Second,
+				InsertMode:        "append",
+				LockTimeout:       5 * time.Second,
+				LockProbeInterval: 100 * time.Millisecond,
+				HashCommentPrefix: "acme:",
+			}))
+		}
+	})
+
+	It("should reject an invalid insert mode", func() {
+		ok := applyIptablesTuning(tables, dummyLock{}, &IptablesTuningUpdate{
+			RefreshInterval: 30 * time.Second,
+			InsertMode:      "sideways",
+		})
+		Expect(ok).To(BeFalse())
+		for _, t := range tables {
+			Expect(t.Tuning().RefreshInterval).To(Equal(90 * time.Second))
+			Expect(t.Tuning().InsertMode).To(Equal("insert"))
+		}
+	})
+
+	It("should update our shared lock", func() {
+		lock := iptables.NewSharedLock("/dev/null", 0, time.Millisecond)
+		grabs := 0
+		lock.GrabIptablesLocks = func(path, socket string, timeout, probe time.Duration) (io.Closer, error) {
+			grabs++
+			Expect(timeout).To(Equal(5 * time.Second))
+			return ioutil.NopCloser(nil), nil
+		}
+
+		// Disabled to start with.
+		lock.Lock()
+		lock.Unlock()
+		Expect(grabs).To(BeZero())
+
+		applyIptablesTuning(tables, lock, &IptablesTuningUpdate{
+			LockTimeout:       5 * time.Second,
+			LockProbeInterval: time.Millisecond,
+		})
+		lock.Lock()
+		lock.Unlock()
+		Expect(grabs).To(Equal(1))
+	})
+})
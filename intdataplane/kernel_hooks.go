@@ -0,0 +1,54 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intdataplane
+
+import (
+	log "github.com/sirupsen/logrus"
+)
+
+// checkKernelHooks is called at the end of each apply() until it has confirmed, with "iptables
+// -C", that our rules in the kernel chains are in place; we don't report ready until then.
+// After a restart, our cached view of the dataplane comes from the first iptables-save, and a
+// node that looks in sync but whose FORWARD hook is missing silently enforces nothing.  If any
+// hooks are missing, we invalidate the table's cache so that the next apply() reprograms them.
+func (d *InternalDataplane) checkKernelHooks() {
+	if d.kernelHooksVerified || d.dataplaneNeedsSync {
+		// Already verified, or the apply failed and we'll be back.
+		return
+	}
+	allPresent := true
+	for _, t := range d.allIptablesTables {
+		missing := t.CheckKernelHooks()
+		if len(missing) == 0 {
+			continue
+		}
+		allPresent = false
+		for _, m := range missing {
+			log.WithFields(log.Fields{
+				"ipVersion": t.IPVersion,
+				"table":     t.Name,
+				"chainName": m.Chain,
+				"rule":      m.Rule,
+			}).Warn("Kernel chain hook missing after apply, will reprogram")
+		}
+		t.InvalidateDataplaneCache("kernel chain hook missing")
+	}
+	if !allPresent {
+		d.dataplaneNeedsSync = true
+		return
+	}
+	log.Info("Verified kernel chain hooks")
+	d.kernelHooksVerified = true
+}
@@ -0,0 +1,125 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intdataplane
+
+import (
+	"errors"
+	"io"
+	"sync"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/projectcalico/felix/iptables"
+)
+
+// hookCheckCmd simulates "iptables -C", which succeeds if the rule is present, and "iptables
+// --version".
+type hookCheckCmd struct {
+	present bool
+}
+
+func (c *hookCheckCmd) SetStdin(r io.Reader)  {}
+func (c *hookCheckCmd) SetStdout(w io.Writer) {}
+func (c *hookCheckCmd) SetStderr(w io.Writer) {}
+func (c *hookCheckCmd) Start() error          { return nil }
+func (c *hookCheckCmd) Wait() error           { return c.Run() }
+func (c *hookCheckCmd) Kill() error           { return nil }
+func (c *hookCheckCmd) String() string        { return "hookCheckCmd" }
+
+func (c *hookCheckCmd) Run() error {
+	if !c.present {
+		return errors.New("iptables: Bad rule (does a matching rule exist in that chain?)")
+	}
+	return nil
+}
+
+func (c *hookCheckCmd) Output() ([]byte, error) {
+	return []byte("iptables v1.6.0\n"), nil
+}
+
+func (c *hookCheckCmd) StdoutPipe() (io.ReadCloser, error) {
+	return nil, errors.New("not implemented")
+}
+
+var _ = Describe("Kernel hook verification", func() {
+	var d *InternalDataplane
+	var hooksPresent bool
+	var checkedCmds []string
+
+	BeforeEach(func() {
+		hooksPresent = true
+		checkedCmds = nil
+		newCmd := func(name string, arg ...string) iptables.CmdIface {
+			checkedCmds = append(checkedCmds, name)
+			return &hookCheckCmd{present: hooksPresent}
+		}
+		detector := iptables.NewFeatureDetector()
+		detector.NewCmd = newCmd
+		table := iptables.NewTable(
+			"filter",
+			4,
+			"cali:",
+			&sync.Mutex{},
+			detector,
+			iptables.TableOptions{
+				HistoricChainPrefixes: []string{"cali-"},
+				NewCmdOverride:        newCmd,
+				LookPathOverride: func(file string) (string, error) {
+					return file, nil
+				},
+			},
+		)
+		table.SetRuleInsertions("FORWARD", []iptables.Rule{
+			{Action: iptables.JumpAction{Target: "cali-FORWARD"}},
+		})
+		d = &InternalDataplane{
+			allIptablesTables: []*iptables.Table{table},
+		}
+	})
+
+	It("should mark the hooks verified if they're present", func() {
+		d.checkKernelHooks()
+		Expect(d.kernelHooksVerified).To(BeTrue())
+		Expect(d.dataplaneNeedsSync).To(BeFalse())
+		Expect(checkedCmds).To(ContainElement("iptables-legacy"))
+	})
+
+	It("should only check once", func() {
+		d.checkKernelHooks()
+		checkedCmds = nil
+		d.checkKernelHooks()
+		Expect(checkedCmds).To(BeEmpty())
+	})
+
+	It("should request a resync if a hook is missing", func() {
+		hooksPresent = false
+		d.checkKernelHooks()
+		Expect(d.kernelHooksVerified).To(BeFalse())
+		Expect(d.dataplaneNeedsSync).To(BeTrue())
+
+		hooksPresent = true
+		d.dataplaneNeedsSync = false
+		d.checkKernelHooks()
+		Expect(d.kernelHooksVerified).To(BeTrue())
+	})
+
+	It("should wait for a failed apply to be retried", func() {
+		d.dataplaneNeedsSync = true
+		d.checkKernelHooks()
+		Expect(d.kernelHooksVerified).To(BeFalse())
+		Expect(checkedCmds).To(BeEmpty())
+	})
+})
@@ -0,0 +1,504 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intdataplane
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/projectcalico/felix/iptables"
+)
+
+const (
+	defaultPacketTraceDuration = 10 * time.Second
+	maxPacketTraceDuration     = time.Minute
+
+	// packetTraceLogPrefix is the prefix of the LOG rule that we add alongside the TRACE rule,
+	// which records each matching packet even if the kernel isn't set up to log traces.
+	packetTraceLogPrefix = "calico-packet-trace"
+)
+
+var errPacketTraceInProgress = errors.New("another packet trace is already in progress")
+
+// packetTraceProtocols are the protocol names that we accept in a PacketTraceRequest.  The
+// protocol is passed to iptables so anything else, apart from a protocol number, is rejected.
+var packetTraceProtocols = map[string]bool{
+	"tcp":     true,
+	"udp":     true,
+	"udplite": true,
+	"sctp":    true,
+	"icmp":    true,
+	"icmpv6":  true,
+	"esp":     true,
+	"ah":      true,
+	"gre":     true,
+}
+
+// PacketTraceRequest selects the packets to trace.  Empty fields match any value but at least
+// one of the addresses must be given.
+type PacketTraceRequest struct {
+	// Protocol is the IP protocol name, such as "tcp", "udp" or "icmp", or number.  Ports can
+	// only be given for "tcp", "udp" and "sctp".
+	Protocol string
+	SrcIP    string
+	DstIP    string
+	SrcPort  uint16
+	DstPort  uint16
+	// Duration is the time for which to trace.  Defaults to 10s; at most 1 minute.
+	Duration time.Duration
+}
+
+func (r *PacketTraceRequest) validate() (ipVersion uint8, err error) {
+	if r.SrcIP == "" && r.DstIP == "" {
+		return 0, errors.New("at least one of the source and destination IPs is required")
+	}
+	for _, addr := range []string{r.SrcIP, r.DstIP} {
+		if addr == "" {
+			continue
+		}
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return 0, fmt.Errorf("invalid IP address %q", addr)
+		}
+		v := uint8(6)
+		if ip.To4() != nil {
+			v = 4
+		}
+		if ipVersion != 0 && v != ipVersion {
+			return 0, errors.New("source and destination IPs have different IP versions")
+		}
+		ipVersion = v
+	}
+	if r.Protocol != "" && !packetTraceProtocols[r.Protocol] {
+		if n, err := strconv.ParseUint(r.Protocol, 10, 8); err != nil || strconv.FormatUint(n, 10) != r.Protocol {
+			return 0, fmt.Errorf("unknown protocol %q", r.Protocol)
+		}
+	}
+	if r.SrcPort != 0 || r.DstPort != 0 {
+		switch r.Protocol {
+		case "tcp", "udp", "sctp":
+		default:
+			return 0, fmt.Errorf("ports require protocol tcp, udp or sctp, not %q", r.Protocol)
+		}
+	}
+	if r.Duration < 0 || r.Duration > maxPacketTraceDuration {
+		return 0, fmt.Errorf("duration must be at most %v", maxPacketTraceDuration)
+	}
+	return ipVersion, nil
+}
+
+func (r *PacketTraceRequest) match() iptables.MatchCriteria {
+	match := iptables.Match()
+	if r.Protocol != "" {
+		match = match.Protocol(r.Protocol)
+	}
+	if r.SrcIP != "" {
+		match = match.SourceNet(r.SrcIP)
+	}
+	if r.DstIP != "" {
+		match = match.DestNet(r.DstIP)
+	}
+	if r.SrcPort != 0 {
+		match = match.SourcePorts(r.SrcPort)
+	}
+	if r.DstPort != 0 {
+		match = match.DestPorts(r.DstPort)
+	}
+	return match
+}
+
+// PacketTraceHop is one step in a traced packet's path through iptables.
+type PacketTraceHop struct {
+	Table   string
+	Chain   string
+	Kind    string
+	RuleNum int
+	// Description describes the rule that the packet hit, or what happened at the end of the
+	// chain, including the policy or profile that the chain implements, if any.
+	Description string
+
+	// action is the action of the rule, if it is one of ours.
+	action iptables.Action
+}
+
+// TracedPacket is the path of one traced packet.
+type TracedPacket struct {
+	// Packet summarises the packet, for example, "TCP 10.0.0.1:1234 -> 10.0.0.2:80".
+	Packet string
+	Hops   []PacketTraceHop
+	// Verdict describes the fate of the packet, as far as we can tell from its path.
+	Verdict string
+}
+
+// PacketTraceResult is the result of a packet trace.
+type PacketTraceResult struct {
+	Packets []TracedPacket
+}
+
+// String formats the result for humans.
+func (r *PacketTraceResult) String() string {
+	if len(r.Packets) == 0 {
+		return "No matching packets were traced.\n"
+	}
+	var buf bytes.Buffer
+	for i, p := range r.Packets {
+		fmt.Fprintf(&buf, "Packet %d: %s\n", i+1, p.Packet)
+		for _, hop := range p.Hops {
+			fmt.Fprintf(&buf, "  %s/%s:%d %s\n", hop.Table, hop.Chain, hop.RuleNum, hop.Description)
+		}
+		fmt.Fprintf(&buf, "  Verdict: %s\n", p.Verdict)
+	}
+	return buf.String()
+}
+
+// TracePacket programs temporary TRACE and LOG rules, in the raw table, that match the given
+// packets.  It then collects the kernel's trace output for the requested duration (or until the
+// context is cancelled), removes the rules and maps the traced rules back to our rules and
+// policies.  The kernel only logs traces to the kernel log with the legacy iptables backend
+// and a packet logger (such as nf_log_ipv4) loaded.  Only one trace can run at a time.
+func (d *InternalDataplane) TracePacket(ctx context.Context, req PacketTraceRequest) (*PacketTraceResult, error) {
+	ipVersion, err := req.validate()
+	if err != nil {
+		return nil, err
+	}
+	if ipVersion == 6 && !d.currentConfig().IPv6Enabled {
+		return nil, errors.New("IPv6 support is disabled")
+	}
+	duration := req.Duration
+	if duration == 0 {
+		duration = defaultPacketTraceDuration
+	}
+	if !atomic.CompareAndSwapInt32(&d.packetTraceActive, 0, 1) {
+		return nil, errPacketTraceInProgress
+	}
+	defer atomic.StoreInt32(&d.packetTraceActive, 0)
+
+	var rawTable *iptables.Table
+	for _, t := range d.iptablesRawTables {
+		if t.IPVersion == ipVersion {
+			rawTable = t
+		}
+	}
+
+	// Open the kernel log before we add the rules so that we don't miss anything.
+	kernelLog, err := d.openKernelLog()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open kernel log: %v", err)
+	}
+	defer kernelLog.Close()
+	lines := make(chan string, 1000)
+	go readKernelLog(kernelLog, lines)
+
+	match := req.match()
+	traceRules := []iptables.Rule{
+		{Match: match, Action: iptables.LogAction{Prefix: packetTraceLogPrefix}},
+		{Match: match, Action: iptables.TraceAction{}, Comment: "Packet trace"},
+	}
+	logCxt := log.WithField("request", req)
+	logCxt.Info("Starting packet trace")
+	var startErr error
+	err = d.runInLoop(ctx, func() {
+		if !d.doneFirstApply {
+			startErr = errors.New("dataplane isn't in sync yet")
+			return
+		}
+		rawTable.SetTraceRules("PREROUTING", traceRules)
+		rawTable.SetTraceRules("OUTPUT", traceRules)
+	})
+	if err == nil {
+		err = startErr
+	}
+	if err != nil {
+		// If the context was cancelled, the trace rules may or may not have been set.
+		d.stopPacketTrace(rawTable, nil)
+		return nil, err
+	}
+
+	var events []iptables.TraceEvent
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+collect:
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				logCxt.Warn("Kernel log closed during packet trace")
+				break collect
+			}
+			if event, ok := iptables.ParseTraceLine(line); ok {
+				events = append(events, event)
+			}
+		case <-timer.C:
+			break collect
+		case <-ctx.Done():
+			break collect
+		}
+	}
+
+	result := d.stopPacketTrace(rawTable, events)
+	logCxt.WithField("numPackets", len(result.Packets)).Info("Finished packet trace")
+	return result, nil
+}
+
+// stopPacketTrace removes the trace rules and maps the given trace events back to our rules.
+// The events are resolved before the trace rules are removed so that the rule numbers still
+// match our view of the dataplane.
+func (d *InternalDataplane) stopPacketTrace(rawTable *iptables.Table, events []iptables.TraceEvent) *PacketTraceResult {
+	var result *PacketTraceResult
+	// Not cancellable: we must remove the rules.
+	_ = d.runInLoop(context.Background(), func() {
+		tables := map[string]ruleLookup{}
+		for _, t := range d.allIptablesTables {
+			if t.IPVersion == rawTable.IPVersion {
+				tables[t.Name] = t
+			}
+		}
+		result = resolvePacketTrace(events, tables, d.chainProvenance)
+		rawTable.SetTraceRules("PREROUTING", nil)
+		rawTable.SetTraceRules("OUTPUT", nil)
+	})
+	return result
+}
+
+// runInLoop runs f on the main loop goroutine, which owns the iptables Tables, and waits for it
+// to finish.  The main loop applies the dataplane afterwards.  Returns the context's error if
+// it's cancelled before f has finished, in which case f may still run.
+func (d *InternalDataplane) runInLoop(ctx context.Context, f func()) error {
+	done := make(chan struct{})
+	select {
+	case d.loopFuncs <- func() { f(); close(done) }:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func openKernelLog() (io.ReadCloser, error) {
+	f, err := os.Open("/dev/kmsg")
+	if err != nil {
+		return nil, err
+	}
+	// Skip the existing messages, we only want the ones that are logged during the trace.
+	if _, err := f.Seek(0, io.SeekEnd); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// readKernelLog sends the lines of the kernel log to the channel until the log is closed.
+// Lines are dropped if the channel is full.
+func readKernelLog(kernelLog io.Reader, lines chan<- string) {
+	defer close(lines)
+	scanner := bufio.NewScanner(kernelLog)
+	for scanner.Scan() {
+		select {
+		case lines <- scanner.Text():
+		default:
+			log.Debug("Packet trace line channel full, dropping line")
+		}
+	}
+	log.WithError(scanner.Err()).Debug("Stopped reading kernel log")
+}
+
+// ruleLookup is the part of iptables.Table that we use to map trace events back to our rules.
+type ruleLookup interface {
+	RuleAt(chainName string, ruleNum int) (iptables.Rule, bool)
+}
+
+// resolvePacketTrace groups the trace events by packet and describes each hop.
+func resolvePacketTrace(
+	events []iptables.TraceEvent,
+	tables map[string]ruleLookup,
+	provenance *chainProvenance,
+) *PacketTraceResult {
+	result := &PacketTraceResult{}
+	packetIdx := map[string]int{}
+	for _, event := range events {
+		key := packetKey(event)
+		idx, ok := packetIdx[key]
+		if !ok {
+			idx = len(result.Packets)
+			packetIdx[key] = idx
+			result.Packets = append(result.Packets, TracedPacket{Packet: summarisePacket(event)})
+		}
+		result.Packets[idx].Hops = append(result.Packets[idx].Hops, resolveHop(event, tables, provenance))
+	}
+	for i := range result.Packets {
+		result.Packets[i].Verdict = packetVerdict(result.Packets[i].Hops)
+	}
+	return result
+}
+
+// packetKey returns a key that distinguishes the packets in the trace.  The kernel logs the
+// packet headers with each event; the interfaces change as the packet moves through the hooks
+// so we only use fields that identify the packet.
+func packetKey(event iptables.TraceEvent) string {
+	var parts []string
+	for _, field := range []string{"SRC", "DST", "PROTO", "SPT", "DPT", "ID", "FLOWLBL", "SEQ"} {
+		parts = append(parts, event.Packet[field])
+	}
+	return strings.Join(parts, " ")
+}
+
+func summarisePacket(event iptables.TraceEvent) string {
+	src := event.Packet["SRC"]
+	dst := event.Packet["DST"]
+	if spt := event.Packet["SPT"]; spt != "" {
+		src = net.JoinHostPort(src, spt)
+	}
+	if dpt := event.Packet["DPT"]; dpt != "" {
+		dst = net.JoinHostPort(dst, dpt)
+	}
+	return fmt.Sprintf("%s %s -> %s", event.Packet["PROTO"], src, dst)
+}
+
+func resolveHop(event iptables.TraceEvent, tables map[string]ruleLookup, provenance *chainProvenance) PacketTraceHop {
+	hop := PacketTraceHop{
+		Table:   event.Table,
+		Chain:   event.Chain,
+		Kind:    event.Kind,
+		RuleNum: event.RuleNum,
+	}
+	switch event.Kind {
+	case iptables.TraceKindReturn:
+		hop.Description = "end of chain, returned to calling chain"
+	case iptables.TraceKindPolicy:
+		hop.Description = "end of built-in chain, chain policy applied"
+	default:
+		var rule iptables.Rule
+		ok := false
+		if table := tables[event.Table]; table != nil {
+			rule, ok = table.RuleAt(event.Chain, event.RuleNum)
+		}
+		if !ok {
+			hop.Description = "rule not programmed by Felix"
+			break
+		}
+		hop.action = rule.Action
+		hop.Description = fmt.Sprint(rule.Action)
+		if match := rule.Match.Render(); match != "" {
+			hop.Description += " if " + match
+		}
+		if rule.Comment != "" {
+			hop.Description += " (" + rule.Comment + ")"
+		}
+	}
+	if source, ok := provenance.lookup(event.Chain); ok {
+		hop.Description = source + ": " + hop.Description
+	}
+	return hop
+}
+
+// packetVerdict works out what happened to the packet from its hops.  A drop anywhere is
+// final; otherwise, the filter table decides.
+func packetVerdict(hops []PacketTraceHop) string {
+	verdict := "no verdict from Felix's rules"
+	for _, hop := range hops {
+		where := hop.Table + "/" + hop.Chain
+		switch hop.action.(type) {
+		case iptables.DropAction:
+			return "dropped at " + where + ": " + hop.Description
+		case iptables.RejectAction:
+			return "rejected at " + where + ": " + hop.Description
+		case iptables.AcceptAction:
+			if hop.Table == "filter" {
+				verdict = "accepted at " + where + ": " + hop.Description
+			}
+		}
+		if hop.Kind == iptables.TraceKindPolicy && hop.Table == "filter" {
+			verdict = "reached the policy of " + where
+		}
+	}
+	return verdict
+}
+
+// ServePacketTrace is an http.HandlerFunc that runs a packet trace and responds with the
+// result, formatted for humans.  The packets are selected by the "protocol", "src", "dst",
+// "sport" and "dport" query parameters; "duration" (such as "30s") sets the trace duration.
+// Only POST is allowed since it changes the dataplane.
+func (d *InternalDataplane) ServePacketTrace(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "Packet trace requires POST", http.StatusMethodNotAllowed)
+		return
+	}
+	query := req.URL.Query()
+	traceReq := PacketTraceRequest{
+		Protocol: query.Get("protocol"),
+		SrcIP:    query.Get("src"),
+		DstIP:    query.Get("dst"),
+	}
+	var err error
+	if traceReq.SrcPort, err = parsePortParam(query.Get("sport")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if traceReq.DstPort, err = parsePortParam(query.Get("dport")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if v := query.Get("duration"); v != "" {
+		if traceReq.Duration, err = time.ParseDuration(v); err != nil {
+			http.Error(w, fmt.Sprintf("invalid duration %q", v), http.StatusBadRequest)
+			return
+		}
+	}
+	if _, err := traceReq.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	result, err := d.TracePacket(req.Context(), traceReq)
+	if err == errPacketTraceInProgress {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if _, err := w.Write([]byte(result.String())); err != nil {
+		log.WithError(err).Debug("Failed to write packet trace response")
+	}
+}
+
+func parsePortParam(v string) (uint16, error) {
+	if v == "" {
+		return 0, nil
+	}
+	port, err := strconv.ParseUint(v, 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid port %q", v)
+	}
+	return uint16(port), nil
+}
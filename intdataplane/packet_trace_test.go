@@ -0,0 +1,168 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intdataplane
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/projectcalico/felix/iptables"
+	"github.com/projectcalico/felix/proto"
+)
+
+type mockRuleLookup map[string][]iptables.Rule
+
+func (m mockRuleLookup) RuleAt(chainName string, ruleNum int) (iptables.Rule, bool) {
+	rules := m[chainName]
+	if ruleNum < 1 || ruleNum > len(rules) {
+		return iptables.Rule{}, false
+	}
+	return rules[ruleNum-1], true
+}
+
+func traceEvent(table, chain, kind string, ruleNum int, srcPort string) iptables.TraceEvent {
+	event, ok := iptables.ParseTraceLine(fmt.Sprintf(
+		"TRACE: %s:%s:%s:%d IN=eth0 OUT= SRC=10.0.0.1 DST=10.0.0.2 ID=1 PROTO=TCP SPT=%s DPT=80",
+		table, chain, kind, ruleNum, srcPort))
+	Expect(ok).To(BeTrue())
+	return event
+}
+
+var _ = Describe("Packet trace", func() {
+	Describe("request validation", func() {
+		It("should accept a full 5-tuple", func() {
+			req := PacketTraceRequest{Protocol: "tcp", SrcIP: "10.0.0.1", DstIP: "10.0.0.2", SrcPort: 1234, DstPort: 80}
+			ipVersion, err := req.validate()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ipVersion).To(Equal(uint8(4)))
+			Expect(req.match().Render()).To(Equal(
+				"-p tcp --source 10.0.0.1 --destination 10.0.0.2 -m multiport --source-ports 1234 -m multiport --destination-ports 80"))
+		})
+
+		It("should accept a protocol number", func() {
+			req := PacketTraceRequest{Protocol: "47", DstIP: "10.0.0.2"}
+			_, err := req.validate()
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("should detect IPv6", func() {
+			req := PacketTraceRequest{DstIP: "fd00::1"}
+			Expect(req.validate()).To(Equal(uint8(6)))
+		})
+
+		for _, req := range []PacketTraceRequest{
+			{},
+			{SrcIP: "10.0.0.1", DstIP: "fd00::1"},
+			{SrcIP: "bad"},
+			{SrcIP: "10.0.0.1", DstPort: 80},
+			{SrcIP: "10.0.0.1", Protocol: "icmp", DstPort: 80},
+			{SrcIP: "10.0.0.1", Duration: time.Hour},
+			{SrcIP: "10.0.0.1", Protocol: "tcp\nCOMMIT"},
+			{SrcIP: "10.0.0.1", Protocol: "tcp -j ACCEPT"},
+			{SrcIP: "10.0.0.1", Protocol: "256"},
+			{SrcIP: "10.0.0.1", Protocol: "+6"},
+		} {
+			req := req
+			It(fmt.Sprintf("should reject %+v", req), func() {
+				_, err := req.validate()
+				Expect(err).To(HaveOccurred())
+			})
+		}
+	})
+
+	Describe("resolving a trace", func() {
+		var result *PacketTraceResult
+
+		BeforeEach(func() {
+			provenance := newChainProvenance()
+			provenance.onPolicyUpdate(&proto.PolicyID{Tier: "default", Name: "web"})
+			tables := map[string]ruleLookup{
+				"filter": mockRuleLookup{
+					"FORWARD": {
+						{Action: iptables.JumpAction{Target: "cali-FORWARD"}},
+					},
+					"cali-pi-web": {
+						{
+							Match:  iptables.Match().Protocol("tcp").DestPorts(80),
+							Action: iptables.AcceptAction{},
+						},
+						{Action: iptables.DropAction{}, Comment: "Drop everything else"},
+					},
+				},
+			}
+			result = resolvePacketTrace([]iptables.TraceEvent{
+				traceEvent("raw", "PREROUTING", "policy", 3, "1234"),
+				traceEvent("filter", "FORWARD", "rule", 1, "1234"),
+				traceEvent("raw", "PREROUTING", "policy", 3, "1235"),
+				traceEvent("filter", "cali-pi-web", "rule", 1, "1234"),
+				traceEvent("filter", "FORWARD", "rule", 1, "1235"),
+				traceEvent("filter", "cali-pi-web", "rule", 2, "1235"),
+			}, tables, provenance)
+		})
+
+		It("should group the events by packet", func() {
+			Expect(result.Packets).To(HaveLen(2))
+			Expect(result.Packets[0].Packet).To(Equal("TCP 10.0.0.1:1234 -> 10.0.0.2:80"))
+			Expect(result.Packets[0].Hops).To(HaveLen(3))
+			Expect(result.Packets[1].Packet).To(Equal("TCP 10.0.0.1:1235 -> 10.0.0.2:80"))
+			Expect(result.Packets[1].Hops).To(HaveLen(3))
+		})
+
+		It("should describe each hop", func() {
+			hops := result.Packets[0].Hops
+			Expect(hops[0].Description).To(Equal("end of built-in chain, chain policy applied"))
+			Expect(hops[1].Description).To(Equal("Jump->cali-FORWARD"))
+			Expect(hops[2].Description).To(Equal(
+				"policy default/web (inbound): Accept if -p tcp -m multiport --destination-ports 80"))
+		})
+
+		It("should work out the verdicts", func() {
+			Expect(result.Packets[0].Verdict).To(Equal(
+				"accepted at filter/cali-pi-web: policy default/web (inbound): Accept if -p tcp -m multiport --destination-ports 80"))
+			Expect(result.Packets[1].Verdict).To(Equal(
+				"dropped at filter/cali-pi-web: policy default/web (inbound): Drop (Drop everything else)"))
+		})
+
+		It("should format the result", func() {
+			Expect(result.String()).To(ContainSubstring("Packet 2: TCP 10.0.0.1:1235 -> 10.0.0.2:80\n"))
+			Expect(result.String()).To(ContainSubstring("  filter/FORWARD:1 Jump->cali-FORWARD\n"))
+			Expect(result.String()).To(ContainSubstring("  Verdict: dropped at filter/cali-pi-web"))
+		})
+	})
+
+	It("should report rules that aren't ours", func() {
+		result := resolvePacketTrace([]iptables.TraceEvent{
+			traceEvent("nat", "PREROUTING", "rule", 1, "1234"),
+		}, map[string]ruleLookup{}, newChainProvenance())
+		Expect(result.Packets[0].Hops[0].Description).To(Equal("rule not programmed by Felix"))
+		Expect(result.Packets[0].Verdict).To(Equal("no verdict from Felix's rules"))
+	})
+
+	It("should only run a trace for POST", func() {
+		d := &InternalDataplane{}
+		w := httptest.NewRecorder()
+		d.ServePacketTrace(w, httptest.NewRequest("GET", "/packet-trace?dst=10.0.0.2", nil))
+		Expect(w.Code).To(Equal(http.StatusMethodNotAllowed))
+	})
+
+	It("should format an empty result", func() {
+		Expect((&PacketTraceResult{}).String()).To(Equal("No matching packets were traced.\n"))
+	})
+})
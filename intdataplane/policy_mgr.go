@@ -30,6 +30,15 @@ type policyManager struct {
 	filterTable  iptablesTable
 	ruleRenderer policyRenderer
 	ipVersion    uint8
+	// provenance records which policy or profile each of our chains came from.  It's shared
+	// with the other IP version's policyManager, which renders chains with the same names.
+	provenance *chainProvenance
+	// maxChains, if non-zero, limits the number of policy and profile chains that we render in
+	// full; policies and profiles beyond the limit get chains that drop all traffic.
+	// fullChains contains the names of the chains that we've rendered in full.  A rejected
+	// policy is only reconsidered when it's next updated.
+	maxChains  int
+	fullChains map[string]bool
 }
 
 type policyRenderer interface {
@@ -37,13 +46,22 @@ type policyRenderer interface {
 	ProfileToIptablesChains(profileID *proto.ProfileID, policy *proto.Profile, ipVersion uint8) []*iptables.Chain
 }
 
-func newPolicyManager(rawTable, mangleTable, filterTable iptablesTable, ruleRenderer policyRenderer, ipVersion uint8) *policyManager {
+func newPolicyManager(
+	rawTable, mangleTable, filterTable iptablesTable,
+	ruleRenderer policyRenderer,
+	ipVersion uint8,
+	provenance *chainProvenance,
+	maxChains int,
+) *policyManager {
 	return &policyManager{
 		rawTable:     rawTable,
 		mangleTable:  mangleTable,
 		filterTable:  filterTable,
 		ruleRenderer: ruleRenderer,
 		ipVersion:    ipVersion,
+		provenance:   provenance,
+		maxChains:    maxChains,
+		fullChains:   map[string]bool{},
 	}
 }
 
@@ -52,29 +70,39 @@ func (m *policyManager) OnUpdate(msg interface{}) {
 	case *proto.ActivePolicyUpdate:
 		log.WithField("id", msg.Id).Debug("Updating policy chains")
 		chains := m.ruleRenderer.PolicyToIptablesChains(msg.Id, msg.Policy, m.ipVersion)
+		chains = m.limitChains("policy", msg.Id.Tier+"/"+msg.Id.Name, chains)
 		m.rawTable.UpdateChains(chains)
 		m.mangleTable.UpdateChains(chains)
 		m.filterTable.UpdateChains(chains)
+		m.provenance.onPolicyUpdate(msg.Id)
 	case *proto.ActivePolicyRemove:
 		log.WithField("id", msg.Id).Debug("Removing policy chains")
 		inName := rules.PolicyChainName(rules.PolicyInboundPfx, msg.Id)
 		outName := rules.PolicyChainName(rules.PolicyOutboundPfx, msg.Id)
+		delete(m.fullChains, inName)
+		delete(m.fullChains, outName)
 		m.filterTable.RemoveChainByName(inName)
 		m.filterTable.RemoveChainByName(outName)
 		m.mangleTable.RemoveChainByName(inName)
 		m.mangleTable.RemoveChainByName(outName)
 		m.rawTable.RemoveChainByName(inName)
 		m.rawTable.RemoveChainByName(outName)
+		m.provenance.onPolicyRemove(msg.Id)
 	case *proto.ActiveProfileUpdate:
 		log.WithField("id", msg.Id).Debug("Updating profile chains")
 		chains := m.ruleRenderer.ProfileToIptablesChains(msg.Id, msg.Profile, m.ipVersion)
+		chains = m.limitChains("profile", msg.Id.Name, chains)
 		m.filterTable.UpdateChains(chains)
+		m.provenance.onProfileUpdate(msg.Id)
 	case *proto.ActiveProfileRemove:
 		log.WithField("id", msg.Id).Debug("Removing profile chains")
 		inName := rules.ProfileChainName(rules.ProfileInboundPfx, msg.Id)
 		outName := rules.ProfileChainName(rules.ProfileOutboundPfx, msg.Id)
+		delete(m.fullChains, inName)
+		delete(m.fullChains, outName)
 		m.filterTable.RemoveChainByName(inName)
 		m.filterTable.RemoveChainByName(outName)
+		m.provenance.onProfileRemove(msg.Id)
 	}
 }
 
@@ -82,3 +110,36 @@ func (m *policyManager) CompleteDeferredWork() error {
 	// Nothing to do, we don't defer any work.
 	return nil
 }
+
+// limitChains enforces maxChains for the rendered chains of a policy or profile.  If the chains
+// fit, or we've already rendered them in full, it returns them unchanged.  Otherwise, it
+// returns chains with the same names that drop all traffic.
+func (m *policyManager) limitChains(kind, name string, chains []*iptables.Chain) []*iptables.Chain {
+	if m.maxChains <= 0 {
+		return chains
+	}
+	numNew := 0
+	for _, chain := range chains {
+		if !m.fullChains[chain.Name] {
+			numNew++
+		}
+	}
+	if numChains := len(m.fullChains) + numNew; numChains > m.maxChains {
+		chainNames := make([]string, 0, len(chains))
+		for _, chain := range chains {
+			chainNames = append(chainNames, chain.Name)
+		}
+		return rules.RejectedPolicyChains(&rules.PolicyLimitError{
+			Kind:      kind,
+			Name:      name,
+			Limit:     rules.LimitMaxPolicyChains,
+			RuleIndex: -1,
+			Max:       m.maxChains,
+			Actual:    numChains,
+		}, chainNames...)
+	}
+	for _, chain := range chains {
+		m.fullChains[chain.Name] = true
+	}
+	return chains
+}
@@ -37,7 +37,7 @@ var _ = Describe("Policy manager", func() {
 		mangleTable = newMockTable("mangle")
 		filterTable = newMockTable("filter")
 		ruleRenderer = newMockPolRenderer()
-		policyMgr = newPolicyManager(rawTable, mangleTable, filterTable, ruleRenderer, 4)
+		policyMgr = newPolicyManager(rawTable, mangleTable, filterTable, ruleRenderer, 4, newChainProvenance(), 0)
 	})
 
 	It("shouldn't touch iptables", func() {
@@ -72,6 +72,15 @@ var _ = Describe("Policy manager", func() {
 			}})
 		})
 
+		It("should record where the chains came from", func() {
+			source, ok := policyMgr.provenance.lookup("cali-pi-pol1")
+			Expect(ok).To(BeTrue())
+			Expect(source).To(Equal("policy default/pol1 (inbound)"))
+			source, ok = policyMgr.provenance.lookup("cali-po-pol1")
+			Expect(ok).To(BeTrue())
+			Expect(source).To(Equal("policy default/pol1 (outbound)"))
+		})
+
 		Describe("after a policy remove", func() {
 			BeforeEach(func() {
 				policyMgr.OnUpdate(&proto.ActivePolicyRemove{
@@ -83,6 +92,11 @@ var _ = Describe("Policy manager", func() {
 				filterTable.checkChains([][]*iptables.Chain{})
 				mangleTable.checkChains([][]*iptables.Chain{})
 			})
+
+			It("should forget where the chains came from", func() {
+				_, ok := policyMgr.provenance.lookup("cali-pi-pol1")
+				Expect(ok).To(BeFalse())
+			})
 		})
 	})
 
@@ -236,6 +250,68 @@ var _ = Describe("Policy manager", func() {
 			})
 		})
 	})
+	Describe("with MaxPolicyChains set", func() {
+		rejected := func(name, kind string) *iptables.Chain {
+			return &iptables.Chain{
+				Name: name,
+				Rules: []iptables.Rule{{
+					Action:  iptables.DropAction{},
+					Comment: "Rejected " + kind + ", exceeds MaxPolicyChains",
+				}},
+			}
+		}
+
+		BeforeEach(func() {
+			policyMgr = newPolicyManager(rawTable, mangleTable, filterTable, ruleRenderer, 4, newChainProvenance(), 4)
+			policyMgr.OnUpdate(&proto.ActivePolicyUpdate{
+				Id:     &proto.PolicyID{Name: "pol1", Tier: "default"},
+				Policy: &proto.Policy{},
+			})
+			policyMgr.OnUpdate(&proto.ActiveProfileUpdate{
+				Id:      &proto.ProfileID{Name: "prof1"},
+				Profile: &proto.Profile{},
+			})
+			policyMgr.OnUpdate(&proto.ActivePolicyUpdate{
+				Id:     &proto.PolicyID{Name: "pol2", Tier: "default"},
+				Policy: &proto.Policy{},
+			})
+		})
+
+		It("should reject the policy that goes over the limit", func() {
+			filterTable.checkChains([][]*iptables.Chain{{
+				{Name: "cali-pi-pol1"},
+				{Name: "cali-po-pol1"},
+				{Name: "cali-pri-prof1"},
+				{Name: "cali-pro-prof1"},
+				rejected("cali-pi-pol2", "policy"),
+				rejected("cali-po-pol2", "policy"),
+			}})
+		})
+
+		It("should still accept updates to policies within the limit", func() {
+			policyMgr.OnUpdate(&proto.ActivePolicyUpdate{
+				Id:     &proto.PolicyID{Name: "pol1", Tier: "default"},
+				Policy: &proto.Policy{InboundRules: []*proto.Rule{{Action: "allow"}}},
+			})
+			Expect(filterTable.currentChains["cali-pi-pol1"]).To(Equal(&iptables.Chain{Name: "cali-pi-pol1"}))
+		})
+
+		It("should accept the rejected policy once there's room", func() {
+			policyMgr.OnUpdate(&proto.ActiveProfileRemove{
+				Id: &proto.ProfileID{Name: "prof1"},
+			})
+			policyMgr.OnUpdate(&proto.ActivePolicyUpdate{
+				Id:     &proto.PolicyID{Name: "pol2", Tier: "default"},
+				Policy: &proto.Policy{},
+			})
+			filterTable.checkChains([][]*iptables.Chain{{
+				{Name: "cali-pi-pol1"},
+				{Name: "cali-po-pol1"},
+				{Name: "cali-pi-pol2"},
+				{Name: "cali-po-pol2"},
+			}})
+		})
+	})
 })
 
 type mockPolRenderer struct {
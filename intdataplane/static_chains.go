@@ -0,0 +1,151 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intdataplane
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/projectcalico/felix/iptables"
+	"github.com/projectcalico/felix/rules"
+)
+
+// staticTableOrder is the order in which RenderStaticChains renders the tables.
+var staticTableOrder = []string{"raw", "mangle", "nat", "filter"}
+
+// staticTableChains holds the static chains that we program into one iptables table, along
+// with the rules that we insert into the kernel's chains to hook them.
+type staticTableChains struct {
+	Chains     []*iptables.Chain
+	Insertions map[string][]iptables.Rule
+}
+
+// staticIptablesChains renders the static chains for the given IP version, indexed by table
+// name.  It only depends on our configuration so it is safe to call from any goroutine.
+func (d *InternalDataplane) staticIptablesChains(ipVersion uint8) map[string]*staticTableChains {
+	jumpTo := func(target string) iptables.Rule {
+		return iptables.Rule{Action: iptables.JumpAction{Target: target}}
+	}
+
+	filterInputRules := []iptables.Rule{jumpTo(rules.ChainFilterInput)}
+	filterOutputRules := []iptables.Rule{jumpTo(rules.ChainFilterOutput)}
+	if d.currentConfig().BreakGlassFile != "" {
+		// Hook the break-glass chains ahead of our main chains so that they take priority
+		// over any policy.  The break-glass managers keep them up to date.
+		filterInputRules = append([]iptables.Rule{jumpTo(rules.ChainBreakGlassIn)}, filterInputRules...)
+		filterOutputRules = append([]iptables.Rule{jumpTo(rules.ChainBreakGlassOut)}, filterOutputRules...)
+	}
+
+	return map[string]*staticTableChains{
+		"raw": {
+			Chains: d.ruleRenderer.StaticRawTableChains(ipVersion),
+			Insertions: map[string][]iptables.Rule{
+				"PREROUTING": {jumpTo(rules.ChainRawPrerouting)},
+				"OUTPUT":     {jumpTo(rules.ChainRawOutput)},
+			},
+		},
+		"mangle": {
+			Chains: d.ruleRenderer.StaticMangleTableChains(ipVersion),
+			Insertions: map[string][]iptables.Rule{
+				"PREROUTING": {jumpTo(rules.ChainManglePrerouting)},
+			},
+		},
+		"nat": {
+			Chains: d.ruleRenderer.StaticNATTableChains(ipVersion),
+			Insertions: map[string][]iptables.Rule{
+				"PREROUTING":  {jumpTo(rules.ChainNATPrerouting)},
+				"POSTROUTING": {jumpTo(rules.ChainNATPostrouting)},
+				"OUTPUT":      {jumpTo(rules.ChainNATOutput)},
+			},
+		},
+		"filter": {
+			Chains: d.ruleRenderer.StaticFilterTableChains(ipVersion),
+			Insertions: map[string][]iptables.Rule{
+				"FORWARD": {jumpTo(rules.ChainFilterForward)},
+				"INPUT":   filterInputRules,
+				"OUTPUT":  filterOutputRules,
+			},
+		},
+	}
+}
+
+// RenderStaticChains renders the static chains (failsafes, dispatch skeleton and so on) that
+// we program for the given IP version, along with the rules that we insert into the kernel's
+// chains, without programming them.  The output is in iptables-save format, one table at a
+// time, without the hash comments that we add to the rules that we program, so that it can
+// be diffed across configuration changes.  It only depends on our configuration so it is safe
+// to call from any goroutine.
+func (d *InternalDataplane) RenderStaticChains(ipVersion uint8) []byte {
+	features := d.iptablesFeatureDetector.GetFeatures()
+	renderer := iptables.IptablesRenderer{}
+	tableToChains := d.staticIptablesChains(ipVersion)
+
+	var buf iptables.RestoreInputBuilder
+	for _, tableName := range staticTableOrder {
+		static := tableToChains[tableName]
+		buf.StartTransaction(tableName)
+		for _, chain := range static.Chains {
+			buf.WriteForwardReference(chain.Name)
+		}
+		for _, chain := range static.Chains {
+			for _, rule := range chain.ForIPVersion(ipVersion).Rules {
+				buf.WriteLine(rule.RenderAppend(chain.Name, "", features))
+			}
+		}
+		var kernelChainNames []string
+		for chainName := range static.Insertions {
+			kernelChainNames = append(kernelChainNames, chainName)
+		}
+		sort.Strings(kernelChainNames)
+		for _, chainName := range kernelChainNames {
+			ruleNum := 1
+			for _, rule := range static.Insertions[chainName] {
+				if !rule.AppliesToIPVersion(ipVersion) {
+					continue
+				}
+				buf.WriteLine(renderer.RenderInsertAt(rule, chainName, ruleNum, "", features))
+				ruleNum++
+			}
+		}
+		buf.EndTransaction()
+	}
+	return buf.GetBytesAndReset()
+}
+
+// ServeStaticChains is an http.HandlerFunc that responds with the output of
+// RenderStaticChains.  The IP version is taken from the "ipVersion" query parameter, which
+// defaults to 4.
+func (d *InternalDataplane) ServeStaticChains(w http.ResponseWriter, req *http.Request) {
+	ipVersion := uint8(4)
+	switch v := req.URL.Query().Get("ipVersion"); v {
+	case "", "4":
+	case "6":
+		if !d.currentConfig().IPv6Enabled {
+			http.Error(w, "IPv6 support is disabled", http.StatusNotFound)
+			return
+		}
+		ipVersion = 6
+	default:
+		http.Error(w, fmt.Sprintf("invalid ipVersion %q", v), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if _, err := w.Write(d.RenderStaticChains(ipVersion)); err != nil {
+		log.WithError(err).Debug("Failed to write static chains response")
+	}
+}
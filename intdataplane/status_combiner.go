@@ -64,6 +64,14 @@ func (e *endpointStatusCombiner) OnEndpointStatusUpdate(
 	}
 }
 
+// OnEvent is our event bus handler.  The endpoint managers publish their status reports as
+// EndpointStatusEvents.
+func (e *endpointStatusCombiner) OnEvent(event interface{}) {
+	if event, ok := event.(EndpointStatusEvent); ok {
+		e.OnEndpointStatusUpdate(event.IPVersion, event.ID, event.Status)
+	}
+}
+
 func (e *endpointStatusCombiner) Apply() {
 	e.dirtyIDs.Iter(func(id interface{}) error {
 		statusToReport := ""
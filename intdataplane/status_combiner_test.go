@@ -147,4 +147,23 @@ var _ = Describe("StatusCombiner", func() {
 			Entry("error == error", "error"),
 		)
 	})
+
+	It("should take status reports from the event bus", func() {
+		statusCombiner = newEndpointStatusCombiner(fromDataplane, false)
+		bus := NewEventBus()
+		bus.AddHandler(statusCombiner.OnEvent)
+		go func() {
+			bus.Publish(ApplyResultEvent{Succeeded: true})
+			bus.Publish(EndpointStatusEvent{IPVersion: 4, ID: epID, Status: "up"})
+			statusCombiner.Apply()
+		}()
+		Eventually(fromDataplane).Should(Receive(Equal(
+			&proto.WorkloadEndpointStatusUpdate{
+				Id: &epID,
+				Status: &proto.EndpointStatus{
+					Status: "up",
+				},
+			},
+		)))
+	})
 })
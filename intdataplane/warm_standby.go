@@ -0,0 +1,104 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intdataplane
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// standbyCheckInterval is how often we look for the activation file while in warm standby.
+// It's short since it bounds how long a failover takes.
+const standbyCheckInterval = 100 * time.Millisecond
+
+// warmStandby tracks warm standby mode, which lets a standby node of an active-passive pair take
+// over policy enforcement quickly.  While in standby, the main loop processes updates from the
+// calculation graph and renders and hashes the resulting iptables chains as usual but it doesn't
+// program the dataplane.  Once activated, either by the creation of the activation file or by a
+// call to Activate(), the first apply only has to write the pre-computed state.
+//
+// Activation is one-way; to go back to standby, Felix must be restarted.
+type warmStandby struct {
+	file   string
+	active bool
+
+	// Shim for test purposes.
+	statFile func(name string) (os.FileInfo, error)
+}
+
+func newWarmStandby(file string) *warmStandby {
+	return &warmStandby{
+		file:     file,
+		statFile: os.Stat,
+	}
+}
+
+// inStandby returns true if we're in warm standby and haven't been activated yet.
+func (d *InternalDataplane) inStandby() bool {
+	return d.standby != nil && !d.standby.active
+}
+
+// checkStandbyActivationFile activates the dataplane if the activation file exists.
+func (d *InternalDataplane) checkStandbyActivationFile() {
+	if !d.inStandby() {
+		return
+	}
+	_, err := d.standby.statFile(d.standby.file)
+	if err == nil {
+		d.activate("activation file")
+		return
+	}
+	if !os.IsNotExist(err) {
+		log.WithError(err).WithField("file", d.standby.file).Warn(
+			"Failed to check for warm standby activation file")
+	}
+}
+
+// activate takes the dataplane out of warm standby.  Must be called from the main loop.
+func (d *InternalDataplane) activate(trigger string) {
+	if !d.inStandby() {
+		return
+	}
+	log.WithField("trigger", trigger).Warn("Activated from warm standby, programming the dataplane")
+	d.standby.active = true
+	d.dataplaneNeedsSync = true
+}
+
+// Activate takes the dataplane out of warm standby, if it's in standby.  The dataplane is
+// owned by the main loop so this waits for the main loop to process the activation; it
+// doesn't wait for the following apply.
+func (d *InternalDataplane) Activate(ctx context.Context) error {
+	return d.runInLoop(ctx, func() {
+		d.activate("API")
+	})
+}
+
+// ServeActivate is an http.HandlerFunc that calls Activate.  Only POST is allowed since it
+// changes the dataplane.
+func (d *InternalDataplane) ServeActivate(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "Activation requires POST", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := d.Activate(req.Context()); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
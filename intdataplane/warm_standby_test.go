@@ -0,0 +1,122 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intdataplane
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Warm standby", func() {
+	var d *InternalDataplane
+	var statErr error
+	var stopLoop chan struct{}
+
+	BeforeEach(func() {
+		statErr = os.ErrNotExist
+		d = &InternalDataplane{
+			loopFuncs: make(chan func()),
+			standby:   newWarmStandby("/run/calico/activate"),
+		}
+		d.standby.statFile = func(name string) (os.FileInfo, error) {
+			Expect(name).To(Equal("/run/calico/activate"))
+			return nil, statErr
+		}
+		stopLoop = make(chan struct{})
+		loopFuncs, stop := d.loopFuncs, stopLoop
+		go func() {
+			for {
+				select {
+				case f := <-loopFuncs:
+					f()
+				case <-stop:
+					return
+				}
+			}
+		}()
+	})
+
+	AfterEach(func() {
+		close(stopLoop)
+	})
+
+	It("should start in standby", func() {
+		Expect(d.inStandby()).To(BeTrue())
+	})
+
+	It("should not be in standby if it isn't configured", func() {
+		d.standby = nil
+		Expect(d.inStandby()).To(BeFalse())
+	})
+
+	It("should stay in standby while the file is missing", func() {
+		d.checkStandbyActivationFile()
+		Expect(d.inStandby()).To(BeTrue())
+		Expect(d.dataplaneNeedsSync).To(BeFalse())
+	})
+
+	It("should stay in standby if the file can't be checked", func() {
+		statErr = errors.New("permission denied")
+		d.checkStandbyActivationFile()
+		Expect(d.inStandby()).To(BeTrue())
+	})
+
+	It("should activate when the file appears", func() {
+		statErr = nil
+		d.checkStandbyActivationFile()
+		Expect(d.inStandby()).To(BeFalse())
+		Expect(d.dataplaneNeedsSync).To(BeTrue())
+	})
+
+	It("should not go back to standby when the file is removed", func() {
+		statErr = nil
+		d.checkStandbyActivationFile()
+		statErr = os.ErrNotExist
+		d.checkStandbyActivationFile()
+		Expect(d.inStandby()).To(BeFalse())
+	})
+
+	It("should activate via the API", func() {
+		Expect(d.Activate(context.Background())).To(Succeed())
+		Expect(d.inStandby()).To(BeFalse())
+	})
+
+	It("should activate via HTTP POST", func() {
+		w := httptest.NewRecorder()
+		d.ServeActivate(w, httptest.NewRequest("POST", "/activate", nil))
+		Expect(w.Code).To(Equal(http.StatusNoContent))
+		Expect(d.inStandby()).To(BeFalse())
+	})
+
+	It("should reject HTTP GET", func() {
+		w := httptest.NewRecorder()
+		d.ServeActivate(w, httptest.NewRequest("GET", "/activate", nil))
+		Expect(w.Code).To(Equal(http.StatusMethodNotAllowed))
+		Expect(d.inStandby()).To(BeTrue())
+	})
+
+	It("should serve activation on the control API", func() {
+		w := httptest.NewRecorder()
+		d.controlAPIHandler().ServeHTTP(w, httptest.NewRequest("POST", "/activate", nil))
+		Expect(w.Code).To(Equal(http.StatusNoContent))
+		Expect(d.inStandby()).To(BeFalse())
+	})
+})
@@ -14,10 +14,15 @@
 
 package iptables
 
-import "fmt"
+import (
+	"fmt"
+	"strings"
+)
 
+// Action is the backend-agnostic model of what a rule does with a matching packet.  Actions
+// don't render themselves; a Renderer converts them to the syntax of a particular backend.
 type Action interface {
-	ToFragment(features *Features) string
+	String() string
 }
 
 type GotoAction struct {
@@ -25,10 +30,6 @@ type GotoAction struct {
 	TypeGoto struct{}
 }
 
-func (g GotoAction) ToFragment(features *Features) string {
-	return "--goto " + g.Target
-}
-
 func (g GotoAction) String() string {
 	return "Goto->" + g.Target
 }
@@ -38,10 +39,6 @@ type JumpAction struct {
 	TypeJump struct{}
 }
 
-func (g JumpAction) ToFragment(features *Features) string {
-	return "--jump " + g.Target
-}
-
 func (g JumpAction) String() string {
 	return "Jump->" + g.Target
 }
@@ -50,10 +47,6 @@ type ReturnAction struct {
 	TypeReturn struct{}
 }
 
-func (r ReturnAction) ToFragment(features *Features) string {
-	return "--jump RETURN"
-}
-
 func (r ReturnAction) String() string {
 	return "Return"
 }
@@ -62,33 +55,308 @@ type DropAction struct {
 	TypeDrop struct{}
 }
 
-func (g DropAction) ToFragment(features *Features) string {
-	return "--jump DROP"
-}
-
 func (g DropAction) String() string {
 	return "Drop"
 }
 
+// RejectAction drops the packet and sends an error back to the sender.  With, if set, is the
+// --reject-with type, for example "icmp-port-unreachable" for IPv4, "icmp6-port-unreachable"
+// for IPv6 or "tcp-reset", which is valid for both but only for TCP packets.  Otherwise, the
+// kernel sends its default, which is a port unreachable error.  See Validate.
+type RejectAction struct {
+	With       string
+	TypeReject struct{}
+}
+
+// Validate checks that With is a --reject-with type that both IP versions support.  Use
+// ValidateForIPVersion for the rules of one IP version.
+func (g RejectAction) Validate() error {
+	if err := g.ValidateForIPVersion(4); err != nil {
+		return err
+	}
+	return g.ValidateForIPVersion(6)
+}
+
+// ValidateForIPVersion checks that With is a --reject-with type that the given IP version
+// supports.
+func (g RejectAction) ValidateForIPVersion(ipVersion uint8) error {
+	if g.With == "" {
+		return nil
+	}
+	for _, with := range rejectWithTypes[ipVersion] {
+		if g.With == with {
+			return nil
+		}
+	}
+	return ValidationError{
+		Field:  "RejectWith",
+		Value:  g.With,
+		Reason: fmt.Sprintf("not a valid reject type for IPv%d", ipVersion),
+	}
+}
+
+func (g RejectAction) String() string {
+	if g.With == "" {
+		return "Reject"
+	}
+	return "Reject:" + g.With
+}
+
+// rejectWithTypes maps from IP version to the --reject-with types that the REJECT target
+// accepts, including the aliases.
+var rejectWithTypes = map[uint8][]string{
+	4: {
+		"icmp-net-unreachable", "net-unreach",
+		"icmp-host-unreachable", "host-unreach",
+		"icmp-port-unreachable", "port-unreach",
+		"icmp-proto-unreachable", "proto-unreach",
+		"icmp-net-prohibited", "net-prohib",
+		"icmp-host-prohibited", "host-prohib",
+		"icmp-admin-prohibited", "admin-prohib",
+		"tcp-reset", "tcp-rst",
+	},
+	6: {
+		"icmp6-no-route", "no-route",
+		"icmp6-adm-prohibited", "adm-prohibited",
+		"icmp6-addr-unreachable", "addr-unreach",
+		"icmp6-port-unreachable", "port-unreach",
+		"icmp6-policy-fail", "policy-fail",
+		"icmp6-reject-route", "reject-route",
+		"tcp-reset", "tcp-rst",
+	},
+}
+
+// LogAction writes the packet's headers to the kernel log with the given Prefix.  Level defaults
+// to notice.  UID, TCPOptions and IPOptions add the socket's UID and the packet's TCP and IP
+// options to the log.  If Limit is set, the action only logs packets within the rate limit.
 type LogAction struct {
-	Prefix  string
-	TypeLog struct{}
+	Prefix     string
+	Level      LogLevel
+	UID        bool
+	TCPOptions bool
+	IPOptions  bool
+	Limit      *LogLimit
+	TypeLog    struct{}
+}
+
+// LogLevel is the syslog level of a LogAction.  The zero value is LogLevelDefault, which logs
+// at LogLevelNotice.
+type LogLevel uint8
+
+const (
+	LogLevelDefault LogLevel = iota
+	LogLevelEmerg
+	LogLevelAlert
+	LogLevelCrit
+	LogLevelErr
+	LogLevelWarning
+	LogLevelNotice
+	LogLevelInfo
+	LogLevelDebug
+)
+
+// syslogLevel returns the level as iptables and syslog number it: 0 (emerg) to 7 (debug).
+func (l LogLevel) syslogLevel() uint8 {
+	if l == LogLevelDefault {
+		l = LogLevelNotice
+	}
+	return uint8(l - LogLevelEmerg)
+}
+
+// LogLimit is the rate limit of a LogAction: on average, at most Rate packets are logged per
+// Unit ("second", "minute", "hour" or "day"), with bursts of up to Burst packets if Burst is
+// non-zero.
+type LogLimit struct {
+	Rate  uint32
+	Unit  string
+	Burst uint32
 }
 
-func (g LogAction) ToFragment(features *Features) string {
-	return fmt.Sprintf(`--jump LOG --log-prefix "%s: " --log-level 5`, g.Prefix)
+func (g LogAction) Validate() error {
+	if err := ValidateLogPrefix(g.Prefix); err != nil {
+		return err
+	}
+	if g.Level > LogLevelDebug {
+		return ValidationError{Field: "LogLevel", Value: fmt.Sprint(g.Level), Reason: "unknown log level"}
+	}
+	if g.Limit != nil {
+		if g.Limit.Rate == 0 {
+			return ValidationError{Field: "LogLimit", Value: "0", Reason: "rate should be non-zero"}
+		}
+		switch g.Limit.Unit {
+		case "second", "minute", "hour", "day":
+		default:
+			return ValidationError{
+				Field:  "LogLimit",
+				Value:  g.Limit.Unit,
+				Reason: "unit should be second, minute, hour or day",
+			}
+		}
+	}
+	return nil
 }
 
 func (g LogAction) String() string {
 	return "Log"
 }
 
-type AcceptAction struct {
-	TypeAccept struct{}
+// NflogAction passes a copy of the packet to userspace over NFLOG netlink group Group, for
+// example for a flow log collector; unlike LogAction, it doesn't go to the kernel log.  Prefix,
+// if set, is sent with the packet.  Size, if non-zero, limits the bytes of the packet that are
+// copied and Threshold, if non-zero, is the number of packets that the kernel queues before
+// sending them.  Like LogAction, it doesn't stop the packet's traversal of the chain.
+type NflogAction struct {
+	Group     uint16
+	Prefix    string
+	Size      uint32
+	Threshold uint16
+	TypeNflog struct{}
+}
+
+func (g NflogAction) Validate() error {
+	return ValidateNflogPrefix(g.Prefix)
+}
+
+func (g NflogAction) String() string {
+	return fmt.Sprintf("Nflog:%d", g.Group)
+}
+
+// SetMemberOp is the operation of a SetMemberAction.
+type SetMemberOp string
+
+const (
+	SetMemberAdd SetMemberOp = "add"
+	SetMemberDel SetMemberOp = "del"
+)
+
+// SetMemberAction adds the packet's address (and/or port) to the IP set Set, or removes it,
+// for example, to add the source of a port scan to a set that a later rule blocks.  Flags is
+// the comma-separated list of "src" and "dst" that selects the packet fields for each
+// dimension of the set, for example, "src" for a hash:ip set of source addresses.  It doesn't
+// stop the packet's traversal of the chain.
+type SetMemberAction struct {
+	Set           string
+	Flags         string
+	Op            SetMemberOp
+	TypeSetMember struct{}
+}
+
+func (g SetMemberAction) Validate() error {
+	if g.Op != SetMemberAdd && g.Op != SetMemberDel {
+		return ValidationError{Field: "SetMemberOp", Value: string(g.Op), Reason: "should be add or del"}
+	}
+	if err := ValidateIPSetName(g.Set); err != nil {
+		return err
+	}
+	flags := strings.Split(g.Flags, ",")
+	if len(flags) > maxIPSetDimensions {
+		return ValidationError{
+			Field:  "SetMemberFlags",
+			Value:  g.Flags,
+			Reason: fmt.Sprintf("more than %d dimensions", maxIPSetDimensions),
+		}
+	}
+	for _, flag := range flags {
+		if flag != "src" && flag != "dst" {
+			return ValidationError{Field: "SetMemberFlags", Value: g.Flags, Reason: "should be a list of src and dst"}
+		}
+	}
+	return nil
+}
+
+func (g SetMemberAction) String() string {
+	return fmt.Sprintf("SetMember:%s:%s", g.Op, g.Set)
+}
+
+// maxIPSetDimensions is the most dimensions (such as IP and port) that an IP set can have.
+const maxIPSetDimensions = 6
+
+// TTLOp is the operation of a TTLAction.
+type TTLOp string
+
+const (
+	TTLSet TTLOp = "set"
+	TTLInc TTLOp = "inc"
+	TTLDec TTLOp = "dec"
+)
+
+// TTLAction sets, increments or decrements the TTL (IPv4) or hop limit (IPv6) of the packet by
+// Value, for example, to hide a hop or to make sure that tunnelled traffic has enough TTL left.
+// iptables has different targets for the two IP versions so the rule must have an IPVersion.
+// Only valid in the mangle table; it needs the xt_HL kernel module (see Features.TTL).
+type TTLAction struct {
+	Op      TTLOp
+	Value   uint8
+	TypeTTL struct{}
+}
+
+// Validate rejects the action since a rule for both IP versions can't use it.
+func (g TTLAction) Validate() error {
+	return ValidationError{
+		Field:  "Action",
+		Value:  g.String(),
+		Reason: "TTL action needs a rule with an IPVersion",
+	}
+}
+
+func (g TTLAction) ValidateForIPVersion(ipVersion uint8) error {
+	switch g.Op {
+	case TTLSet:
+	case TTLInc, TTLDec:
+		if g.Value == 0 {
+			return ValidationError{Field: "TTLValue", Value: "0", Reason: "can't increment or decrement by 0"}
+		}
+	default:
+		return ValidationError{Field: "TTLOp", Value: string(g.Op), Reason: "should be set, inc or dec"}
+	}
+	return nil
+}
+
+func (g TTLAction) ValidateFeatures(features *Features) error {
+	if !features.TTL {
+		return ValidationError{Field: "Action", Value: g.String(), Reason: "xt_HL kernel module not available"}
+	}
+	return nil
+}
+
+func (g TTLAction) String() string {
+	return fmt.Sprintf("TTL:%s:%d", g.Op, g.Value)
+}
+
+// TraceAction marks the packet for tracing; the kernel then logs each rule that the packet
+// hits in every table.  Only valid in the raw table.
+type TraceAction struct {
+	TypeTrace struct{}
+}
+
+func (g TraceAction) String() string {
+	return "Trace"
+}
+
+// TproxyAction redirects the packet to a local socket listening on Port, without changing its
+// destination, and sets Mark on it so that a routing rule can deliver it locally.  For example,
+// for a transparent L7 proxy.  It's only valid in the mangle table's PREROUTING chain (and
+// chains called from there) and for TCP and UDP packets; it needs the xt_TPROXY kernel module
+// (see Features.TPROXY).
+type TproxyAction struct {
+	Mark       uint32
+	Port       uint16
+	TypeTproxy struct{}
 }
 
-func (g AcceptAction) ToFragment(features *Features) string {
-	return "--jump ACCEPT"
+func (g TproxyAction) ValidateFeatures(features *Features) error {
+	if !features.TPROXY {
+		return ValidationError{Field: "Action", Value: g.String(), Reason: "xt_TPROXY kernel module not available"}
+	}
+	return nil
+}
+
+func (g TproxyAction) String() string {
+	return fmt.Sprintf("Tproxy->%d:%#x", g.Port, g.Mark)
+}
+
+type AcceptAction struct {
+	TypeAccept struct{}
 }
 
 func (g AcceptAction) String() string {
@@ -101,16 +369,27 @@ type DNATAction struct {
 	TypeDNAT struct{}
 }
 
-func (g DNATAction) ToFragment(features *Features) string {
-	if g.DestPort == 0 {
-		return fmt.Sprintf("--jump DNAT --to-destination %s", g.DestAddr)
-	} else {
-		return fmt.Sprintf("--jump DNAT --to-destination %s:%d", g.DestAddr, g.DestPort)
+func (g DNATAction) String() string {
+	return fmt.Sprintf("DNAT->%s:%d", g.DestAddr, g.DestPort)
+}
+
+// RedirectAction redirects the packet to the local host, for example, to intercept DNS traffic
+// with a local proxy.  If ToPorts is set, the destination port is changed to that port or range
+// of ports, such as "8000-8010".  Only valid in the nat table.
+type RedirectAction struct {
+	ToPorts      string
+	TypeRedirect struct{}
+}
+
+func (g RedirectAction) Validate() error {
+	if g.ToPorts == "" {
+		return nil
 	}
+	return ValidatePortRange(g.ToPorts)
 }
 
-func (g DNATAction) String() string {
-	return fmt.Sprintf("DNAT->%s:%d", g.DestAddr, g.DestPort)
+func (g RedirectAction) String() string {
+	return "Redirect->" + g.ToPorts
 }
 
 type SNATAction struct {
@@ -118,14 +397,6 @@ type SNATAction struct {
 	TypeSNAT struct{}
 }
 
-func (g SNATAction) ToFragment(features *Features) string {
-	fullyRand := ""
-	if features.SNATFullyRandom {
-		fullyRand = " --random-fully"
-	}
-	return fmt.Sprintf("--jump SNAT --to-source %s%s", g.ToAddr, fullyRand)
-}
-
 func (g SNATAction) String() string {
 	return fmt.Sprintf("SNAT->%s", g.ToAddr)
 }
@@ -135,17 +406,6 @@ type MasqAction struct {
 	TypeMasq struct{}
 }
 
-func (g MasqAction) ToFragment(features *Features) string {
-	fullyRand := ""
-	if features.MASQFullyRandom {
-		fullyRand = " --random-fully"
-	}
-	if g.ToPorts != "" {
-		return fmt.Sprintf("--jump MASQUERADE --to-ports %s"+fullyRand, g.ToPorts)
-	}
-	return "--jump MASQUERADE" + fullyRand
-}
-
 func (g MasqAction) String() string {
 	return "Masq"
 }
@@ -155,10 +415,6 @@ type ClearMarkAction struct {
 	TypeClearMark struct{}
 }
 
-func (c ClearMarkAction) ToFragment(features *Features) string {
-	return fmt.Sprintf("--jump MARK --set-mark 0/%#x", c.Mark)
-}
-
 func (c ClearMarkAction) String() string {
 	return fmt.Sprintf("Clear:%#x", c.Mark)
 }
@@ -168,10 +424,6 @@ type SetMarkAction struct {
 	TypeSetMark struct{}
 }
 
-func (c SetMarkAction) ToFragment(features *Features) string {
-	return fmt.Sprintf("--jump MARK --set-mark %#x/%#x", c.Mark, c.Mark)
-}
-
 func (c SetMarkAction) String() string {
 	return fmt.Sprintf("Set:%#x", c.Mark)
 }
@@ -182,10 +434,6 @@ type SetMaskedMarkAction struct {
 	TypeSetMaskedMark struct{}
 }
 
-func (c SetMaskedMarkAction) ToFragment(features *Features) string {
-	return fmt.Sprintf("--jump MARK --set-mark %#x/%#x", c.Mark, c.Mask)
-}
-
 func (c SetMaskedMarkAction) String() string {
 	return fmt.Sprintf("Set:%#x", c.Mark)
 }
@@ -194,10 +442,123 @@ type NoTrackAction struct {
 	TypeNoTrack struct{}
 }
 
-func (g NoTrackAction) ToFragment(features *Features) string {
-	return "--jump NOTRACK"
-}
-
 func (g NoTrackAction) String() string {
 	return "NOTRACK"
-}
\ No newline at end of file
+}
+
+// CTAction sets up connection tracking for the packet using the CT target: NoTrack exempts the
+// packet from connection tracking, like NoTrackAction; otherwise, a non-zero Zone puts the
+// connection into that conntrack zone, so that overlapping flows in different zones are tracked
+// separately, and Helper attaches that conntrack helper, such as "ftp", whose kernel module must
+// be loaded.  Only valid in the raw table.  Needs the xt_CT kernel module (see Features.CT).
+type CTAction struct {
+	NoTrack bool
+	Zone    uint16
+	Helper  string
+	TypeCT  struct{}
+}
+
+func (g CTAction) Validate() error {
+	if g.NoTrack {
+		if g.Zone != 0 || g.Helper != "" {
+			return ValidationError{
+				Field:  "Action",
+				Value:  g.String(),
+				Reason: "an untracked packet can't have a zone or helper",
+			}
+		}
+		return nil
+	}
+	if g.Zone == 0 && g.Helper == "" {
+		return ValidationError{Field: "Action", Value: g.String(), Reason: "should set NoTrack, Zone or Helper"}
+	}
+	if g.Helper != "" {
+		return ValidateCTHelper(g.Helper)
+	}
+	return nil
+}
+
+func (g CTAction) ValidateFeatures(features *Features) error {
+	if !features.CT {
+		return ValidationError{Field: "Action", Value: g.String(), Reason: "xt_CT kernel module not available"}
+	}
+	return nil
+}
+
+func (g CTAction) String() string {
+	if g.NoTrack {
+		return "CT:notrack"
+	}
+	return fmt.Sprintf("CT:zone=%d:helper=%s", g.Zone, g.Helper)
+}
+
+// ChecksumAction fills in the checksum of a packet whose checksum the kernel left for the NIC to
+// calculate, for example, a DHCP response to a VM behind virtio, whose DHCP client can't handle
+// the missing checksum.  Only valid in the mangle table.
+type ChecksumAction struct {
+	TypeChecksum struct{}
+}
+
+func (g ChecksumAction) String() string {
+	return "ChecksumFill"
+}
+
+// ClampMSSAction rewrites the MSS option of TCP SYN packets, for example, so that connections
+// through an IPIP, VXLAN or WireGuard tunnel don't send segments that are too big for the
+// tunnel's reduced MTU.  If ToPMTU is set, the MSS is clamped to the path MTU less the IP and TCP
+// headers, otherwise, it's set to MSS.  iptables only allows it in rules that match TCP SYN
+// packets (see MatchCriteria.TCPSyn).  Only valid in the mangle table.
+type ClampMSSAction struct {
+	ToPMTU       bool
+	MSS          uint16
+	TypeClampMSS struct{}
+}
+
+func (g ClampMSSAction) Validate() error {
+	if g.ToPMTU && g.MSS != 0 {
+		return ValidationError{
+			Field:  "MSS",
+			Value:  fmt.Sprint(g.MSS),
+			Reason: "can't set the MSS and clamp to the path MTU",
+		}
+	}
+	if !g.ToPMTU && g.MSS == 0 {
+		return ValidationError{Field: "MSS", Value: "0", Reason: "should be non-zero"}
+	}
+	return nil
+}
+
+func (g ClampMSSAction) String() string {
+	if g.ToPMTU {
+		return "ClampMSS:pmtu"
+	}
+	return fmt.Sprintf("ClampMSS:%d", g.MSS)
+}
+
+// DSCPAction sets the 6-bit DSCP field of the packet to Value.  Only valid in the mangle table.
+type DSCPAction struct {
+	Value    uint8
+	TypeDSCP struct{}
+}
+
+func (c DSCPAction) Validate() error {
+	return ValidateDSCP(c.Value)
+}
+
+func (c DSCPAction) String() string {
+	return fmt.Sprintf("DSCP:%#x", c.Value)
+}
+
+// TOSAction sets the bits of the packet's TOS (IPv4) or traffic class (IPv6) byte that are set
+// in Mask to the corresponding bits of Value, for peers that still use TOS rather than DSCP.
+// Unlike DSCPAction, it can set the two ECN bits too, which is rarely what's wanted.  A zero
+// Mask means 0xff.  Only valid in the mangle table.
+type TOSAction struct {
+	Value   uint8
+	Mask    uint8
+	TypeTOS struct{}
+}
+
+func (c TOSAction) String() string {
+	return fmt.Sprintf("TOS:%#x", c.Value)
+}
@@ -23,15 +23,49 @@ import (
 
 var _ = DescribeTable("Actions",
 	func(action Action, expRendering string) {
-		Expect(action.ToFragment()).To(Equal(expRendering))
+		Expect(IptablesRenderer{}.RenderAction(action, &Features{})).To(Equal(expRendering))
 	},
 	Entry("GotoAction", GotoAction{Target: "cali-abcd"}, "--goto cali-abcd"),
 	Entry("JumpAction", JumpAction{Target: "cali-abcd"}, "--jump cali-abcd"),
 	Entry("ReturnAction", ReturnAction{}, "--jump RETURN"),
 	Entry("DropAction", DropAction{}, "--jump DROP"),
+	Entry("RejectAction", RejectAction{}, "--jump REJECT"),
+	Entry("RejectAction with type", RejectAction{With: "tcp-reset"}, "--jump REJECT --reject-with tcp-reset"),
 	Entry("AcceptAction", AcceptAction{}, "--jump ACCEPT"),
 	Entry("LogAction", LogAction{Prefix: "prefix"}, `--jump LOG --log-prefix "prefix: " --log-level 5`),
+	Entry("LogAction with level", LogAction{Prefix: "prefix", Level: LogLevelDebug},
+		`--jump LOG --log-prefix "prefix: " --log-level 7`),
+	Entry("LogAction with emerg level", LogAction{Prefix: "prefix", Level: LogLevelEmerg},
+		`--jump LOG --log-prefix "prefix: " --log-level 0`),
+	Entry("LogAction with options", LogAction{Prefix: "prefix", UID: true, TCPOptions: true, IPOptions: true},
+		`--jump LOG --log-prefix "prefix: " --log-level 5 --log-tcp-options --log-ip-options --log-uid`),
+	Entry("LogAction with limit", LogAction{Prefix: "prefix", Limit: &LogLimit{Rate: 10, Unit: "minute"}},
+		`-m limit --limit 10/minute --jump LOG --log-prefix "prefix: " --log-level 5`),
+	Entry("LogAction with limit and burst", LogAction{Prefix: "prefix", Limit: &LogLimit{Rate: 1, Unit: "second", Burst: 20}},
+		`-m limit --limit 1/second --limit-burst 20 --jump LOG --log-prefix "prefix: " --log-level 5`),
+	Entry("NflogAction", NflogAction{Group: 1}, "--jump NFLOG --nflog-group 1"),
+	Entry("NflogAction with all options", NflogAction{
+		Group:     20,
+		Prefix:    "A|cali-pi-pol1",
+		Size:      80,
+		Threshold: 10,
+	}, `--jump NFLOG --nflog-group 20 --nflog-prefix "A|cali-pi-pol1" --nflog-size 80 --nflog-threshold 10`),
+	Entry("TproxyAction", TproxyAction{Mark: 0x400, Port: 15001}, "--jump TPROXY --on-port 15001 --tproxy-mark 0x400/0x400"),
+	Entry("SetMemberAction add", SetMemberAction{Set: "cali40blocked", Flags: "src", Op: SetMemberAdd},
+		"--jump SET --add-set cali40blocked src"),
+	Entry("SetMemberAction del", SetMemberAction{Set: "cali40scanners", Flags: "src,dst", Op: SetMemberDel},
+		"--jump SET --del-set cali40scanners src,dst"),
+	Entry("ClampMSSAction to PMTU", ClampMSSAction{ToPMTU: true}, "--jump TCPMSS --clamp-mss-to-pmtu"),
+	Entry("ClampMSSAction with MSS", ClampMSSAction{MSS: 1400}, "--jump TCPMSS --set-mss 1400"),
+	Entry("RedirectAction", RedirectAction{}, "--jump REDIRECT"),
+	Entry("RedirectAction to port", RedirectAction{ToPorts: "53"}, "--jump REDIRECT --to-ports 53"),
+	Entry("RedirectAction to ports", RedirectAction{ToPorts: "8000-8010"}, "--jump REDIRECT --to-ports 8000-8010"),
+	Entry("CTAction notrack", CTAction{NoTrack: true}, "--jump CT --notrack"),
+	Entry("CTAction zone", CTAction{Zone: 10}, "--jump CT --zone 10"),
+	Entry("CTAction helper and zone", CTAction{Helper: "ftp", Zone: 10}, "--jump CT --helper ftp --zone 10"),
+	Entry("TTLAction", TTLAction{Op: TTLSet, Value: 64}, "--jump TTL --ttl-set 64"),
 	Entry("DNATAction", DNATAction{DestAddr: "10.0.0.1", DestPort: 8081}, "--jump DNAT --to-destination 10.0.0.1:8081"),
+	Entry("DNATAction IPv6", DNATAction{DestAddr: "fd00::1", DestPort: 8081}, "--jump DNAT --to-destination [fd00::1]:8081"),
 	Entry("MasqAction", MasqAction{}, "--jump MASQUERADE"),
 	Entry("ClearMarkAction", ClearMarkAction{Mark: 0x1000}, "--jump MARK --set-mark 0/0x1000"),
 	Entry("SetMarkAction", SetMarkAction{Mark: 0x1000}, "--jump MARK --set-mark 0x1000/0x1000"),
@@ -39,4 +73,8 @@ var _ = DescribeTable("Actions",
 		Mark: 0x1000,
 		Mask: 0xf000,
 	}, "--jump MARK --set-mark 0x1000/0xf000"),
+	Entry("ChecksumAction", ChecksumAction{}, "--jump CHECKSUM --checksum-fill"),
+	Entry("DSCPAction", DSCPAction{Value: 46}, "--jump DSCP --set-dscp 0x2e"),
+	Entry("TOSAction", TOSAction{Value: 0x10}, "--jump TOS --set-tos 0x10/0xff"),
+	Entry("TOSAction with mask", TOSAction{Value: 0x10, Mask: 0x3f}, "--jump TOS --set-tos 0x10/0x3f"),
 )
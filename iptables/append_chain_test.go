@@ -0,0 +1,66 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/projectcalico/felix/iptables"
+	"github.com/projectcalico/libcalico-go/lib/set"
+)
+
+var _ = Describe("Table.AppendToChain", func() {
+	var dataplane *mockDataplane
+	var table *Table
+
+	BeforeEach(func() {
+		dataplane = newMockDataplane("filter", map[string][]string{
+			"FORWARD": {},
+			"INPUT":   {},
+			"OUTPUT":  {},
+		})
+		table = dataplane.newTable(nil)
+		table.UpdateChains([]*Chain{
+			{Name: "cali-foo", Rules: []Rule{{Action: JumpAction{Target: "cali-a"}}}},
+			{Name: "cali-a"},
+			{Name: "cali-b"},
+		})
+		table.Apply()
+	})
+
+	It("should only write the appended rules", func() {
+		table.AppendToChain("cali-foo", []Rule{
+			{Action: JumpAction{Target: "cali-b"}},
+			{Action: DropAction{}},
+		})
+		dataplane.FlushedChains = set.New()
+		dataplane.ChainMods = set.New()
+		table.Apply()
+
+		Expect(dataplane.Chains["cali-foo"]).To(HaveLen(3))
+		Expect(dataplane.Chains["cali-foo"][1]).To(HaveSuffix("--jump cali-b"))
+		Expect(dataplane.Chains["cali-foo"][2]).To(HaveSuffix("--jump DROP"))
+		Expect(dataplane.RuleTouched("cali-foo", 1)).To(BeFalse())
+		Expect(dataplane.RuleTouched("cali-foo", 2)).To(BeTrue())
+		Expect(dataplane.RuleTouched("cali-foo", 3)).To(BeTrue())
+	})
+
+	It("should panic for an unknown chain", func() {
+		Expect(func() {
+			table.AppendToChain("cali-unknown", []Rule{{Action: DropAction{}}})
+		}).To(Panic())
+	})
+})
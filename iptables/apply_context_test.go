@@ -0,0 +1,110 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables_test
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/projectcalico/felix/iptables"
+)
+
+var _ = Describe("Table.ApplyContext", func() {
+	var dataplane *mockDataplane
+	var table *Table
+	var ctx context.Context
+	var cancel context.CancelFunc
+	var onSleep func()
+
+	BeforeEach(func() {
+		dataplane = newMockDataplane("filter", map[string][]string{
+			"FORWARD": {},
+			"INPUT":   {},
+			"OUTPUT":  {},
+		})
+		onSleep = nil
+		table = dataplane.newTable(func(options *TableOptions) {
+			options.SleepOverride = func(d time.Duration) {
+				dataplane.sleep(d)
+				if onSleep != nil {
+					onSleep()
+				}
+			}
+		})
+		table.UpdateChain(&Chain{Name: "cali-foo", Rules: []Rule{{Action: DropAction{}}}})
+		ctx, cancel = context.WithCancel(context.Background())
+	})
+
+	AfterEach(func() {
+		cancel()
+	})
+
+	It("should program the dataplane with a live context", func() {
+		_, err := table.ApplyContext(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(dataplane.Chains["cali-foo"]).To(HaveLen(1))
+	})
+
+	It("should do nothing if the context is already cancelled", func() {
+		cancel()
+		_, err := table.ApplyContext(ctx)
+		Expect(err).To(Equal(context.Canceled))
+		Expect(dataplane.CmdNames).To(BeEmpty())
+
+		// The update should still be queued.
+		table.Apply()
+		Expect(dataplane.Chains["cali-foo"]).To(HaveLen(1))
+	})
+
+	It("should stop retrying once the context is cancelled", func() {
+		dataplane.FailAllRestores = true
+		onSleep = cancel
+		var err error
+		Expect(func() {
+			_, err = table.ApplyContext(ctx)
+		}).NotTo(Panic())
+		Expect(err).To(Equal(context.Canceled))
+		Expect(dataplane.CmdNames).To(Equal([]string{"iptables-save", "iptables-restore"}))
+	})
+
+	It("should time out at the context's deadline", func() {
+		dataplane.FailAllRestores = true
+		ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+		onSleep = func() { time.Sleep(5 * time.Millisecond) }
+		var err error
+		Expect(func() {
+			_, err = table.ApplyContext(ctx)
+		}).NotTo(Panic())
+		Expect(err).To(Equal(context.DeadlineExceeded))
+	})
+
+	It("should stop waiting for the backoff once the context is cancelled", func() {
+		// Use the real sleep, with a backoff that would outlast the test.
+		table = dataplane.newTable(func(options *TableOptions) {
+			options.SleepOverride = nil
+			options.InitialBackoff = time.Hour
+		})
+		table.UpdateChain(&Chain{Name: "cali-foo", Rules: []Rule{{Action: DropAction{}}}})
+		dataplane.FailAllRestores = true
+		ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+		start := time.Now()
+		_, err := table.ApplyContext(ctx)
+		Expect(err).To(Equal(context.DeadlineExceeded))
+		Expect(time.Since(start)).To(BeNumerically("<", 10*time.Second))
+	})
+})
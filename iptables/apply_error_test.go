@@ -0,0 +1,90 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables_test
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/projectcalico/felix/iptables"
+)
+
+var _ = Describe("Table with ReturnErrorOnFailure", func() {
+	var dataplane *mockDataplane
+	var table *Table
+
+	BeforeEach(func() {
+		dataplane = newMockDataplane("filter", map[string][]string{
+			"FORWARD": {},
+			"INPUT":   {},
+			"OUTPUT":  {},
+		})
+		table = dataplane.newTable(func(options *TableOptions) {
+			options.ReturnErrorOnFailure = true
+		})
+		table.UpdateChain(&Chain{Name: "cali-foo", Rules: []Rule{{Action: DropAction{}}}})
+	})
+
+	Describe("with a persistent iptables-restore error", func() {
+		BeforeEach(func() {
+			dataplane.FailAllRestores = true
+		})
+
+		It("should return an ApplyError with the input and diags", func() {
+			var err error
+			Expect(func() {
+				_, err = table.ApplyContext(context.Background())
+			}).NotTo(Panic())
+			Expect(err).To(BeAssignableToTypeOf(&ApplyError{}))
+			applyErr := err.(*ApplyError)
+			Expect(applyErr.Table).To(Equal("filter"))
+			Expect(applyErr.Err).To(HaveOccurred())
+			Expect(applyErr.Input).To(ContainSubstring("-A cali-foo"))
+			Expect(applyErr.Diags).To(ContainSubstring("*filter"))
+		})
+
+		It("should not panic from Apply()", func() {
+			Expect(func() {
+				table.Apply()
+			}).NotTo(Panic())
+		})
+
+		It("should program the dataplane once the error clears", func() {
+			_, err := table.ApplyContext(context.Background())
+			Expect(err).To(HaveOccurred())
+			dataplane.FailAllRestores = false
+			_, err = table.ApplyContext(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(dataplane.Chains["cali-foo"]).To(HaveLen(1))
+		})
+	})
+
+	Describe("with a persistent iptables-save error", func() {
+		BeforeEach(func() {
+			dataplane.FailAllSaves = true
+		})
+
+		It("should return an ApplyError with no input", func() {
+			var err error
+			Expect(func() {
+				_, err = table.ApplyContext(context.Background())
+			}).NotTo(Panic())
+			Expect(err).To(BeAssignableToTypeOf(&ApplyError{}))
+			Expect(err.(*ApplyError).Input).To(BeEmpty())
+		})
+	})
+})
@@ -0,0 +1,65 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"reflect"
+	"time"
+)
+
+// ApplyResult describes what one call to Apply, ApplyContext or Flush did, so that callers can
+// log and alert on how the dataplane is being programmed.  It's all zero if the call had
+// nothing to do or was held back by coalescing.
+type ApplyResult struct {
+	// LinesWritten is the number of lines of iptables-restore input that we wrote, including
+	// those of failed attempts.
+	LinesWritten int
+	// ChainsTouched is the number of chains that the successful write created, modified or
+	// removed.
+	ChainsTouched int
+	// RulesAdded and RulesDeleted count our rules that the successful write added and
+	// deleted; as for AuditEvent, a rule that was modified counts as both.
+	RulesAdded   int
+	RulesDeleted int
+	// RestoreDuration is the total time spent running iptables-restore, including failed
+	// attempts.
+	RestoreDuration time.Duration
+	// Retries is the number of times that the write was retried after a failure.
+	Retries int
+	// Resynced is true if we re-read the dataplane before writing.
+	Resynced bool
+}
+
+// LastApplyResult returns the result of the most recent Apply, ApplyContext or Flush.
+func (t *Table) LastApplyResult() ApplyResult {
+	t.opLock.Lock()
+	defer t.opLock.Unlock()
+	return t.lastApplyResult
+}
+
+// recordWriteStats adds the changes that a successful write made to the current ApplyResult.
+// Like reportAudit, it must be called before chainToDataplaneHashes is updated.
+func (t *Table) recordWriteStats(newHashes map[string][]string) {
+	for chainName, hashes := range newHashes {
+		oldHashes, existed := t.chainToDataplaneHashes[chainName]
+		if existed == (hashes != nil) && reflect.DeepEqual(oldHashes, hashes) {
+			continue
+		}
+		t.lastApplyResult.ChainsTouched++
+		added, deleted := diffHashes(oldHashes, hashes)
+		t.lastApplyResult.RulesAdded += len(added)
+		t.lastApplyResult.RulesDeleted += len(deleted)
+	}
+}
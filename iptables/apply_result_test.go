@@ -0,0 +1,115 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables_test
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/projectcalico/felix/iptables"
+)
+
+var _ = Describe("Table ApplyResult", func() {
+	var dataplane *mockDataplane
+	var table *Table
+
+	fooRules := []Rule{
+		{Match: Match().Protocol("tcp"), Action: AcceptAction{}},
+		{Match: Match().Protocol("udp"), Action: AcceptAction{}},
+	}
+
+	BeforeEach(func() {
+		dataplane = newMockDataplane("filter", map[string][]string{
+			"FORWARD": {},
+			"INPUT":   {},
+			"OUTPUT":  {},
+		})
+		table = dataplane.newTable(nil)
+		table.UpdateChain(&Chain{Name: "cali-foo", Rules: fooRules})
+		table.SetRuleInsertions("FORWARD", []Rule{{Action: JumpAction{Target: "cali-foo"}}})
+	})
+
+	It("should describe the first write", func() {
+		_, result := table.Apply()
+		Expect(result.Resynced).To(BeTrue())
+		Expect(result.Retries).To(BeZero())
+		// *filter, the forward reference, two appends, the insert and COMMIT.
+		Expect(result.LinesWritten).To(Equal(6))
+		Expect(result.ChainsTouched).To(Equal(2))
+		Expect(result.RulesAdded).To(Equal(3))
+		Expect(result.RulesDeleted).To(BeZero())
+		Expect(table.LastApplyResult()).To(Equal(result))
+	})
+
+	It("should time iptables-restore with the table's clock", func() {
+		dataplane.OnPreRestore = func() {
+			dataplane.AdvanceTimeBy(3 * time.Second)
+		}
+		_, result := table.Apply()
+		Expect(result.RestoreDuration).To(Equal(3 * time.Second))
+	})
+
+	Describe("after the first write", func() {
+		BeforeEach(func() {
+			table.Apply()
+		})
+
+		It("should be zero if there's nothing to do", func() {
+			_, result := table.Apply()
+			Expect(result).To(Equal(ApplyResult{}))
+		})
+
+		It("should count a modified rule as an addition and a deletion", func() {
+			table.UpdateChain(&Chain{Name: "cali-foo", Rules: []Rule{
+				fooRules[0],
+				{Action: DropAction{}},
+			}})
+			_, result := table.Apply()
+			Expect(result.ChainsTouched).To(Equal(1))
+			Expect(result.RulesAdded).To(Equal(1))
+			Expect(result.RulesDeleted).To(Equal(1))
+		})
+
+		It("should count a removed chain", func() {
+			table.SetRuleInsertions("FORWARD", nil)
+			table.RemoveChainByName("cali-foo")
+			_, result := table.Apply()
+			Expect(result.ChainsTouched).To(Equal(2))
+			Expect(result.RulesAdded).To(BeZero())
+			Expect(result.RulesDeleted).To(Equal(3))
+		})
+
+		It("should count retries and the lines of failed attempts", func() {
+			table.UpdateChain(&Chain{Name: "cali-bar", Rules: fooRules})
+			dataplane.FailNextRestore = true
+			_, result := table.Apply()
+			Expect(result.Retries).To(Equal(1))
+			Expect(result.Resynced).To(BeTrue())
+			// Two attempts at *filter, the forward reference, two appends and COMMIT.
+			Expect(result.LinesWritten).To(Equal(10))
+			Expect(result.ChainsTouched).To(Equal(1))
+		})
+
+		It("should be available after ApplyContext", func() {
+			table.UpdateChain(&Chain{Name: "cali-bar", Rules: fooRules})
+			_, err := table.ApplyContext(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(table.LastApplyResult().RulesAdded).To(Equal(2))
+		})
+	})
+})
@@ -0,0 +1,121 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"sort"
+	"time"
+)
+
+// AuditSink receives a description of every change that the Table makes to the dataplane, for
+// example, to keep an audit trail.  OnApply is called from Apply() with the Table's lock held
+// so it must not call back into the Table; a slow sink holds up the dataplane.
+type AuditSink interface {
+	OnApply(event AuditEvent)
+}
+
+// AuditEvent describes the changes that one successful write made to a table.  Rules are
+// identified by their hashes, so a rule that was modified in place appears as a deletion of
+// the old rule and an addition of the new one.  Rules that belong to other processes aren't
+// included.
+type AuditEvent struct {
+	Table     string
+	IPVersion uint8
+	Time      time.Time
+
+	ChainsCreated []string
+	ChainsRemoved []string
+	RulesAdded    []AuditRule
+	RulesDeleted  []AuditRule
+}
+
+// AuditRule identifies one of our rules in an AuditEvent.
+type AuditRule struct {
+	ChainName string
+	Hash      string
+}
+
+// Empty returns true if the event doesn't record any changes.
+func (e AuditEvent) Empty() bool {
+	return len(e.ChainsCreated) == 0 && len(e.ChainsRemoved) == 0 &&
+		len(e.RulesAdded) == 0 && len(e.RulesDeleted) == 0
+}
+
+// reportAudit calculates the AuditEvent for a write from the hashes that were in the dataplane
+// before the write and the new hashes for the chains that it updated, and passes it to the
+// sink.  Must be called before chainToDataplaneHashes is updated.
+func (t *Table) reportAudit(newHashes map[string][]string) {
+	if t.auditSink == nil {
+		return
+	}
+	event := AuditEvent{
+		Table:     t.Name,
+		IPVersion: t.IPVersion,
+		Time:      t.timeNow(),
+	}
+	chainNames := make([]string, 0, len(newHashes))
+	for chainName := range newHashes {
+		chainNames = append(chainNames, chainName)
+	}
+	sort.Strings(chainNames)
+	for _, chainName := range chainNames {
+		hashes := newHashes[chainName]
+		oldHashes, existed := t.chainToDataplaneHashes[chainName]
+		if hashes == nil {
+			event.ChainsRemoved = append(event.ChainsRemoved, chainName)
+		} else if !existed {
+			event.ChainsCreated = append(event.ChainsCreated, chainName)
+		}
+		added, deleted := diffHashes(oldHashes, hashes)
+		for _, hash := range added {
+			event.RulesAdded = append(event.RulesAdded, AuditRule{ChainName: chainName, Hash: hash})
+		}
+		for _, hash := range deleted {
+			event.RulesDeleted = append(event.RulesDeleted, AuditRule{ChainName: chainName, Hash: hash})
+		}
+	}
+	if event.Empty() {
+		return
+	}
+	t.auditSink.OnApply(event)
+}
+
+// diffHashes returns the non-empty hashes in newHashes that aren't in oldHashes and vice versa,
+// taking repeats into account.  Empty hashes are other processes' rules.
+func diffHashes(oldHashes, newHashes []string) (added, deleted []string) {
+	counts := map[string]int{}
+	for _, hash := range oldHashes {
+		if hash != "" {
+			counts[hash]++
+		}
+	}
+	for _, hash := range newHashes {
+		if hash == "" {
+			continue
+		}
+		if counts[hash] > 0 {
+			counts[hash]--
+			continue
+		}
+		added = append(added, hash)
+	}
+	for _, hash := range oldHashes {
+		if hash != "" && counts[hash] > 0 {
+			counts[hash]--
+			deleted = append(deleted, hash)
+		}
+	}
+	return
+}
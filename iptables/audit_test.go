@@ -0,0 +1,110 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/projectcalico/felix/iptables"
+)
+
+type recordingAuditSink struct {
+	events []AuditEvent
+}
+
+func (s *recordingAuditSink) OnApply(event AuditEvent) {
+	s.events = append(s.events, event)
+}
+
+func auditChainNames(rules []AuditRule) (names []string) {
+	for _, r := range rules {
+		Expect(r.Hash).NotTo(BeEmpty())
+		names = append(names, r.ChainName)
+	}
+	return
+}
+
+var _ = Describe("Table AuditSink", func() {
+	var dataplane *mockDataplane
+	var table *Table
+	var sink *recordingAuditSink
+
+	BeforeEach(func() {
+		dataplane = newMockDataplane("filter", map[string][]string{
+			"FORWARD": {"-j kube-forward"},
+			"INPUT":   {},
+			"OUTPUT":  {},
+		})
+		sink = &recordingAuditSink{}
+		table = dataplane.newTable(func(options *TableOptions) {
+			options.AuditSink = sink
+		})
+		table.SetRuleInsertions("FORWARD", []Rule{{Action: JumpAction{Target: "cali-FORWARD"}}})
+		table.UpdateChain(&Chain{Name: "cali-FORWARD", Rules: []Rule{{Action: AcceptAction{}}}})
+		table.Apply()
+	})
+
+	It("should describe the first write", func() {
+		Expect(sink.events).To(HaveLen(1))
+		event := sink.events[0]
+		Expect(event.Table).To(Equal("filter"))
+		Expect(event.IPVersion).To(Equal(uint8(4)))
+		Expect(event.ChainsCreated).To(Equal([]string{"cali-FORWARD"}))
+		Expect(event.ChainsRemoved).To(BeEmpty())
+		Expect(auditChainNames(event.RulesAdded)).To(Equal([]string{"FORWARD", "cali-FORWARD"}))
+		Expect(event.RulesDeleted).To(BeEmpty())
+	})
+
+	It("should not emit an event if nothing changed", func() {
+		table.InvalidateDataplaneCache("test")
+		table.Apply()
+		table.UpdateChain(&Chain{Name: "cali-FORWARD", Rules: []Rule{{Action: AcceptAction{}}}})
+		table.Apply()
+		Expect(sink.events).To(HaveLen(1))
+	})
+
+	It("should describe a modified rule as a deletion and an addition", func() {
+		oldHash := sink.events[0].RulesAdded[1].Hash
+		table.UpdateChain(&Chain{Name: "cali-FORWARD", Rules: []Rule{{Action: DropAction{}}}})
+		table.Apply()
+		Expect(sink.events).To(HaveLen(2))
+		event := sink.events[1]
+		Expect(event.ChainsCreated).To(BeEmpty())
+		Expect(event.RulesDeleted).To(Equal([]AuditRule{{ChainName: "cali-FORWARD", Hash: oldHash}}))
+		Expect(auditChainNames(event.RulesAdded)).To(Equal([]string{"cali-FORWARD"}))
+		Expect(event.RulesAdded[0].Hash).NotTo(Equal(oldHash))
+	})
+
+	It("should describe the removal of a chain", func() {
+		table.SetRuleInsertions("FORWARD", nil)
+		table.RemoveChainByName("cali-FORWARD")
+		table.Apply()
+		Expect(sink.events).To(HaveLen(2))
+		event := sink.events[1]
+		Expect(event.ChainsRemoved).To(Equal([]string{"cali-FORWARD"}))
+		Expect(auditChainNames(event.RulesDeleted)).To(Equal([]string{"FORWARD", "cali-FORWARD"}))
+		Expect(event.RulesAdded).To(BeEmpty())
+	})
+
+	It("should describe the repair of rules that another process removed", func() {
+		dataplane.Chains["FORWARD"] = []string{"-j kube-forward"}
+		table.InvalidateDataplaneCache("test")
+		table.Apply()
+		Expect(sink.events).To(HaveLen(2))
+		Expect(auditChainNames(sink.events[1].RulesAdded)).To(Equal([]string{"FORWARD"}))
+		Expect(sink.events[1].RulesDeleted).To(BeEmpty())
+	})
+})
@@ -0,0 +1,329 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// iptables backends.  Hosts may have both the legacy (x_tables) and nft variants of the iptables
+// binaries installed; only the one that the rest of the host uses actually takes effect.
+const (
+	BackendLegacy = "legacy"
+	BackendNFT    = "nft"
+	// BackendAuto is only meaningful to the BackendDetector, a Table must be given a concrete
+	// backend.
+	BackendAuto = "auto"
+)
+
+// backendCleanupRetryInterval is how soon we retry a failed clean up of the old backend after a
+// switch.
+const backendCleanupRetryInterval = 10 * time.Second
+
+// BackendDetector detects which iptables backend the host is using by comparing the number of
+// rules that each backend's iptables-save reports.
+type BackendDetector struct {
+	// IgnoreChainPrefixes lists the prefixes of chains whose rules aren't counted.  This should
+	// include our own prefixes, otherwise our rules would keep us on the old backend after the
+	// rest of the host moves.
+	IgnoreChainPrefixes []string
+
+	// Factories for making commands and looking up binaries, used by UTs to shim exec.
+	NewCmd   cmdFactory
+	LookPath func(file string) (string, error)
+}
+
+func NewBackendDetector(ignoreChainPrefixes []string) *BackendDetector {
+	return &BackendDetector{
+		IgnoreChainPrefixes: ignoreChainPrefixes,
+		NewCmd:              newRealCmd,
+		LookPath:            exec.LookPath,
+	}
+}
+
+// Detect returns the backend that has more (non-ignored) rules.  If the backends tie, for
+// example, because neither has any rules, it returns current, which may be empty, to avoid
+// flapping; if current is empty, it returns BackendLegacy.
+func (d *BackendDetector) Detect(current string) string {
+	legacyRules := d.countRules(BackendLegacy)
+	nftRules := d.countRules(BackendNFT)
+	logCxt := log.WithFields(log.Fields{
+		"legacyRules": legacyRules,
+		"nftRules":    nftRules,
+		"current":     current,
+	})
+	detected := current
+	if nftRules > legacyRules {
+		detected = BackendNFT
+	} else if legacyRules > nftRules {
+		detected = BackendLegacy
+	} else if detected == "" {
+		detected = BackendLegacy
+	}
+	logCxt.WithField("detected", detected).Debug("Detected iptables backend")
+	return detected
+}
+
+// countRules counts the rules that the given backend's iptables-save reports, excluding those in
+// ignored chains.  Returns -1 if the backend isn't available.
+func (d *BackendDetector) countRules(backend string) int {
+	saveCmd := "iptables-" + backend + "-save"
+	if _, err := d.LookPath(saveCmd); err != nil {
+		log.WithField("command", saveCmd).Debug("iptables backend not available")
+		return -1
+	}
+	out, err := d.NewCmd(saveCmd).Output()
+	if err != nil {
+		log.WithError(err).WithField("command", saveCmd).Warn("Failed to read iptables backend state")
+		return -1
+	}
+	count := 0
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "-A ") {
+			continue
+		}
+		chainName := strings.SplitN(line[3:], " ", 2)[0]
+		if d.ignoreChain(chainName) {
+			continue
+		}
+		count++
+	}
+	return count
+}
+
+func (d *BackendDetector) ignoreChain(chainName string) bool {
+	for _, prefix := range d.IgnoreChainPrefixes {
+		if strings.HasPrefix(chainName, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// normaliseBackendMode checks that mode is a backend that a Table can program.
+func normaliseBackendMode(mode string) (string, error) {
+	mode = strings.ToLower(mode)
+	if mode != BackendLegacy && mode != BackendNFT {
+		return "", fmt.Errorf("unknown iptables backend %q", mode)
+	}
+	return mode, nil
+}
+
+// backendBinaries records a backend and its binaries; for example, the backend that we've
+// switched away from, so that we can clean up our rules there.
+type backendBinaries struct {
+	mode       string
+	saveCmd    string
+	restoreCmd string
+}
+
+// BackendMode returns the iptables backend that the Table is currently programming.
+func (t *Table) BackendMode() string {
+	t.opLock.Lock()
+	defer t.opLock.Unlock()
+	return t.backendMode
+}
+
+// SwitchBackend moves the Table to the given backend, BackendLegacy or BackendNFT.  The next
+// Apply() programs all our chains and inserts in the new backend and then removes them from the
+// old one, so there's no gap in policy.  Returns an error if the backend isn't known.
+func (t *Table) SwitchBackend(mode string) error {
+	mode, err := normaliseBackendMode(mode)
+	if err != nil {
+		return err
+	}
+
+	t.opLock.Lock()
+	defer t.opLock.Unlock()
+
+	if mode == t.backendMode {
+		return nil
+	}
+	t.logCxt.WithFields(log.Fields{
+		"oldBackend": t.backendMode,
+		"newBackend": mode,
+	}).Warn("Switching iptables backend")
+
+	if t.oldBackend == nil {
+		t.oldBackend = t.currentBackend()
+	} else if t.oldBackend.mode == mode {
+		// Switching back before we cleaned up; the rules that we'd have cleaned up are now the
+		// ones that we want.
+		t.oldBackend = nil
+	}
+	t.resetForBackend(mode)
+	return nil
+}
+
+// resetForBackend moves the Table to the given backend and resets our picture of the dataplane
+// so that the next apply writes everything to the new backend.
+func (t *Table) resetForBackend(mode string) {
+	t.setBackendMode(mode)
+
+	// Start from scratch, as if we'd just started up: everything we want needs to be written
+	// to the new backend and we don't want the missing state to be reported as out-of-sync.
+	t.chainToDataplaneHashes = map[string][]string{}
+	t.preloadedHashes = nil
+	t.unknownChainFirstSeen = map[string]time.Time{}
+	for chainName := range t.chainNameToChain {
+		t.dirtyChains.Add(chainName)
+	}
+	for chainName := range t.chainToInsertedRules {
+		t.dirtyInserts.Add(chainName)
+	}
+	t.invalidateDataplaneCache("iptables backend changed")
+}
+
+func (t *Table) currentBackend() *backendBinaries {
+	return &backendBinaries{
+		mode:       t.backendMode,
+		saveCmd:    t.iptablesSaveCmd,
+		restoreCmd: t.iptablesRestoreCmd,
+	}
+}
+
+// setBackendMode sets the backend and the binaries that we use for it.
+func (t *Table) setBackendMode(mode string) {
+	t.backendMode = mode
+	t.nftablesMode = mode == BackendNFT
+	if t.nftablesMode {
+		log.Info("Enabling iptables-in-nftables-mode workarounds.")
+	}
+	t.iptablesCmd = t.findBestBinary(t.IPVersion, mode, "")
+	t.iptablesRestoreCmd, t.restorePerRule = t.findRestoreOrSaveBinary(mode, "restore")
+	t.iptablesSaveCmd, t.saveByListing = t.findRestoreOrSaveBinary(mode, "save")
+}
+
+// cleanUpOldBackend removes our chains and inserted rules from the backend that we switched away
+// from.
+func (t *Table) cleanUpOldBackend(ctx context.Context) error {
+	return t.cleanUpBackend(ctx, t.oldBackend, true)
+}
+
+// cleanUpBackend removes our inserted rules and, if removeChains is set, our chains from the given
+// backend, which must not be the one that the Table is programming.  Rules in unmanaged chains
+// are left alone.
+func (t *Table) cleanUpBackend(ctx context.Context, old *backendBinaries, removeChains bool) error {
+	logCxt := t.logCxt.WithField("backend", old.mode)
+	out, err := t.newCmd(old.saveCmd, "-t", t.Name).Output()
+	if err != nil {
+		logCxt.WithError(err).Warn("Failed to read iptables backend for clean up")
+		return err
+	}
+
+	ourChains := []string{}
+	ruleNums := map[string]int{}
+	deletes := map[string][]int{}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, ":") {
+			chainName := strings.SplitN(line[1:], " ", 2)[0]
+			if removeChains && t.ourChainsRegexp.MatchString(chainName) {
+				ourChains = append(ourChains, chainName)
+			}
+			continue
+		}
+		if !strings.HasPrefix(line, "-A ") {
+			continue
+		}
+		chainName := strings.SplitN(line[3:], " ", 2)[0]
+		ruleNums[chainName]++
+		if t.ourChainsRegexp.MatchString(chainName) || t.isUnmanagedChain(chainName) {
+			continue
+		}
+		if t.hashCommentRegexp.MatchString(line) || t.oldInsertRegexp.MatchString(line) {
+			deletes[chainName] = append(deletes[chainName], ruleNums[chainName])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if len(ourChains) == 0 && len(deletes) == 0 {
+		logCxt.Info("Nothing to clean up in iptables backend")
+		return nil
+	}
+
+	// Remove our inserts and flush our chains first; in nft mode, iptables-restore can only
+	// delete chains that are unreferenced at the start of the transaction.
+	var buf bytes.Buffer
+	buf.WriteString(fmt.Sprintf("*%s\n", t.Name))
+	for _, chainName := range sortedKeys(deletes) {
+		nums := deletes[chainName]
+		for i := len(nums) - 1; i >= 0; i-- {
+			buf.WriteString(fmt.Sprintf("-D %s %d\n", chainName, nums[i]))
+		}
+	}
+	sort.Strings(ourChains)
+	for _, chainName := range ourChains {
+		buf.WriteString(fmt.Sprintf(":%s - -\n", chainName))
+	}
+	buf.WriteString("COMMIT\n")
+	inputs := []string{buf.String()}
+	if len(ourChains) > 0 {
+		buf.Reset()
+		buf.WriteString(fmt.Sprintf("*%s\n", t.Name))
+		for _, chainName := range ourChains {
+			buf.WriteString(fmt.Sprintf("-X %s\n", chainName))
+		}
+		buf.WriteString("COMMIT\n")
+		inputs = append(inputs, buf.String())
+	}
+
+	features := t.featureDetector.GetFeatures()
+	for _, input := range inputs {
+		var outputBuf, errBuf bytes.Buffer
+		cmd := t.newCmd(old.restoreCmd, t.restoreArgs(features)...)
+		cmd.SetStdin(strings.NewReader(input))
+		cmd.SetStdout(&outputBuf)
+		cmd.SetStderr(&errBuf)
+		lock := t.xtablesLock(ctx)
+		lock.Lock()
+		err := runCmd(ctx, cmd)
+		lock.Unlock()
+		if err != nil {
+			logCxt.WithError(err).WithFields(log.Fields{
+				"input":       input,
+				"errorOutput": errBuf.String(),
+			}).Warn("Failed to clean up iptables backend")
+			return err
+		}
+	}
+	logCxt.WithFields(log.Fields{
+		"chains":          ourChains,
+		"chainsWithRules": len(deletes),
+	}).Info("Cleaned up iptables backend")
+	return nil
+}
+
+func sortedKeys(m map[string][]int) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
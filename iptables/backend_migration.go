@@ -0,0 +1,179 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"context"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Stages of a guided backend migration, see MigrateBackend().
+const (
+	MigrationStagePrepare = "prepare"
+	MigrationStageStage   = "stage"
+	MigrationStageVerify  = "verify"
+	MigrationStageHook    = "hook"
+	MigrationStageUnhook  = "unhook"
+)
+
+// MigrationError is returned by MigrateBackend if the migration fails.  Unless the failure was
+// in the prepare stage, before anything was written to the new backend, the Table has been
+// rolled back to the old backend.
+type MigrationError struct {
+	Table    string
+	From, To string
+	// Stage is the stage that failed, one of the MigrationStage... constants.
+	Stage string
+	Err   error
+	// RollbackErr is set if we failed to remove our rules from the new backend during the
+	// rollback.  Our rules in the old backend are restored by the next Apply() regardless.
+	RollbackErr error
+}
+
+func (e *MigrationError) Error() string {
+	msg := fmt.Sprintf("failed to migrate iptables table %s from %s to %s backend at %s stage: %v",
+		e.Table, e.From, e.To, e.Stage, e.Err)
+	if e.RollbackErr != nil {
+		msg += fmt.Sprintf(" (rollback also failed: %v)", e.RollbackErr)
+	}
+	return msg
+}
+
+// MigrateBackend moves the Table to the given backend, BackendLegacy or BackendNFT, more
+// carefully than SwitchBackend():
+//
+// - prepare: brings the old backend up to date.
+// - stage: programs our chains in the new backend without hooking them into the kernel chains.
+// - verify: re-reads the new backend and checks that our chains are all present and correct.
+// - hook: programs our inserts into the new backend's kernel chains.
+// - unhook: removes our inserts from the old backend.
+//
+// Finally, it removes our chains from the old backend; if that fails, it is retried by Apply().
+// Between the hook and unhook stages, both backends are hooked, so there is no point at which
+// our policy isn't in force.  If any stage fails, MigrateBackend removes our rules from the new
+// backend, switches back to the old backend and returns a *MigrationError; the next Apply()
+// repairs any damage to the old backend.  It doesn't panic, even if
+// TableOptions.ReturnErrorOnFailure isn't set.
+func (t *Table) MigrateBackend(ctx context.Context, mode string) error {
+	mode, err := normaliseBackendMode(mode)
+	if err != nil {
+		return err
+	}
+
+	t.opLock.Lock()
+	defer t.opLock.Unlock()
+
+	if mode == t.backendMode {
+		return nil
+	}
+	if t.oldBackend != nil {
+		return fmt.Errorf("still cleaning up after switch from %s backend", t.oldBackend.mode)
+	}
+
+	from := t.currentBackend()
+	logCxt := t.logCxt.WithFields(log.Fields{
+		"oldBackend": from.mode,
+		"newBackend": mode,
+	})
+	logCxt.Warn("Migrating iptables backend")
+
+	panicOnFailure := t.panicOnFailure
+	t.panicOnFailure = false
+	defer func() {
+		t.panicOnFailure = panicOnFailure
+	}()
+	ownsInserts := t.ownsInserts
+
+	if _, err := t.apply(ctx, true); err != nil {
+		logCxt.WithError(err).Error("Failed to update old backend, not migrating")
+		return &MigrationError{Table: t.Name, From: from.mode, To: mode, Stage: MigrationStagePrepare, Err: err}
+	}
+	fail := func(stage string, err error) error {
+		migErr := &MigrationError{Table: t.Name, From: from.mode, To: mode, Stage: stage, Err: err}
+		migErr.RollbackErr = t.rollBackMigration(ctx, from, ownsInserts)
+		logCxt.WithError(migErr).Error("Failed to migrate iptables backend, rolled back")
+		return migErr
+	}
+
+	t.resetForBackend(mode)
+	t.ownsInserts = false
+	if _, err := t.apply(ctx, true); err != nil {
+		return fail(MigrationStageStage, err)
+	}
+
+	if err := t.verifyChainsInDataplane(ctx); err != nil {
+		return fail(MigrationStageVerify, err)
+	}
+
+	t.ownsInserts = ownsInserts
+	for chainName := range t.chainToInsertedRules {
+		t.dirtyInserts.Add(chainName)
+	}
+	if _, err := t.apply(ctx, true); err != nil {
+		return fail(MigrationStageHook, err)
+	}
+
+	if err := t.cleanUpBackend(ctx, from, false); err != nil {
+		return fail(MigrationStageUnhook, err)
+	}
+
+	if err := t.cleanUpBackend(ctx, from, true); err != nil {
+		logCxt.WithError(err).Warn("Failed to remove our chains from old backend, will retry")
+		t.oldBackend = from
+	}
+	logCxt.Info("Migrated iptables backend")
+	return nil
+}
+
+// verifyChainsInDataplane re-reads the dataplane and checks that it contains all our chains with
+// the expected rules.  Unlike loadDataplaneState, it doesn't update our picture of the dataplane.
+func (t *Table) verifyChainsInDataplane(ctx context.Context) error {
+	dataplaneHashes, err := t.getHashesFromDataplane(ctx)
+	if err != nil {
+		return err
+	}
+	features := t.featureDetector.GetFeatures()
+	for chainName, chain := range t.chainNameToChain {
+		if t.isQuarantined(chainName) {
+			continue
+		}
+		dpHashes, ok := dataplaneHashes[chainName]
+		if !ok {
+			return fmt.Errorf("chain %s missing", chainName)
+		}
+		expectedHashes := t.ruleHashes(chain, features)
+		if len(dpHashes) != len(expectedHashes) {
+			return fmt.Errorf("chain %s has %d rules, expected %d", chainName, len(dpHashes), len(expectedHashes))
+		}
+		for i := range expectedHashes {
+			if dpHashes[i] != expectedHashes[i] {
+				return fmt.Errorf("chain %s rule %d differs", chainName, i+1)
+			}
+		}
+	}
+	return nil
+}
+
+// rollBackMigration removes our rules from the backend that we were migrating to and moves the
+// Table back to the old one.  Returns an error if the clean up fails, in which case some of our
+// rules may be left in the new backend.
+func (t *Table) rollBackMigration(ctx context.Context, from *backendBinaries, ownsInserts bool) error {
+	to := t.currentBackend()
+	t.resetForBackend(from.mode)
+	t.ownsInserts = ownsInserts
+	return t.cleanUpBackend(ctx, to, true)
+}
@@ -0,0 +1,119 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables_test
+
+import (
+	"context"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/projectcalico/felix/iptables"
+)
+
+var _ = Describe("Table guided backend migration", func() {
+	var legacy, nft *mockDataplane
+	var table *Table
+
+	newCmd := func(name string, arg ...string) CmdIface {
+		if strings.Contains(name, "-nft-") {
+			return nft.newCmd(strings.Replace(name, "-nft", "", 1), arg...)
+		}
+		return legacy.newCmd(strings.Replace(name, "-legacy", "", 1), arg...)
+	}
+
+	expectLegacyIntact := func() {
+		Expect(table.BackendMode()).To(Equal(BackendLegacy))
+		Expect(legacy.Chains).To(HaveKey("cali-foo"))
+		Expect(legacy.Chains["FORWARD"]).To(HaveLen(2))
+		Expect(nft.Chains).NotTo(HaveKey("cali-foo"))
+		Expect(nft.Chains["FORWARD"]).To(BeEmpty())
+	}
+
+	BeforeEach(func() {
+		legacy = newMockDataplane("filter", map[string][]string{
+			"FORWARD": {"-j other-rule"},
+		})
+		nft = newMockDataplane("filter", map[string][]string{
+			"FORWARD": {},
+		})
+		table = legacy.newTable(func(options *TableOptions) {
+			options.NewCmdOverride = newCmd
+			options.LookPathOverride = func(file string) (string, error) {
+				return file, nil
+			}
+			options.BackendMode = "legacy"
+		})
+		table.UpdateChain(&Chain{Name: "cali-foo", Rules: []Rule{{Action: DropAction{}}}})
+		table.SetRuleInsertions("FORWARD", []Rule{{Action: JumpAction{Target: "cali-foo"}}})
+		table.Apply()
+	})
+
+	It("should hook the new backend before unhooking the old one", func() {
+		nftHooksWhenUnhooking := -1
+		legacy.OnPreRestore = func() {
+			nftHooksWhenUnhooking = len(nft.Chains["FORWARD"])
+		}
+		Expect(table.MigrateBackend(context.Background(), "nft")).To(Succeed())
+		Expect(nftHooksWhenUnhooking).To(Equal(1))
+
+		Expect(table.BackendMode()).To(Equal(BackendNFT))
+		Expect(nft.Chains["cali-foo"]).To(HaveLen(1))
+		Expect(nft.Chains["FORWARD"]).To(HaveLen(1))
+		Expect(legacy.Chains).NotTo(HaveKey("cali-foo"))
+		Expect(legacy.Chains["FORWARD"]).To(Equal([]string{"-j other-rule"}))
+	})
+
+	It("should roll back if verification fails", func() {
+		nft.OnPostRestore = func() {
+			nft.Chains["cali-foo"] = []string{"-j ACCEPT"}
+		}
+		err := table.MigrateBackend(context.Background(), "nft")
+		Expect(err).To(HaveOccurred())
+		Expect(err.(*MigrationError).Stage).To(Equal(MigrationStageVerify))
+		Expect(err.(*MigrationError).RollbackErr).NotTo(HaveOccurred())
+		expectLegacyIntact()
+	})
+
+	It("should roll back if unhooking the old backend fails", func() {
+		legacy.FailNextRestore = true
+		err := table.MigrateBackend(context.Background(), "nft")
+		Expect(err).To(HaveOccurred())
+		Expect(err.(*MigrationError).Stage).To(Equal(MigrationStageUnhook))
+		expectLegacyIntact()
+		table.Apply()
+		expectLegacyIntact()
+	})
+
+	It("should report a failed rollback", func() {
+		nft.OnPostRestore = func() {
+			nft.FailAllRestores = true
+		}
+		err := table.MigrateBackend(context.Background(), "nft")
+		Expect(err).To(HaveOccurred())
+		Expect(err.(*MigrationError).Stage).To(Equal(MigrationStageHook))
+		Expect(err.(*MigrationError).RollbackErr).To(HaveOccurred())
+		Expect(table.BackendMode()).To(Equal(BackendLegacy))
+		Expect(legacy.Chains["FORWARD"]).To(HaveLen(2))
+	})
+
+	It("should do nothing when migrating to the current backend", func() {
+		legacy.ResetCmds()
+		Expect(table.MigrateBackend(context.Background(), "legacy")).To(Succeed())
+		Expect(legacy.CmdNames).To(BeEmpty())
+		Expect(nft.CmdNames).To(BeEmpty())
+	})
+})
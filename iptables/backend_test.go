@@ -0,0 +1,159 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables_test
+
+import (
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/projectcalico/felix/iptables"
+)
+
+var _ = Describe("Table backend switching", func() {
+	var legacy, nft *mockDataplane
+	var table *Table
+
+	// newCmd routes each backend's commands to its own mock dataplane.
+	newCmd := func(name string, arg ...string) CmdIface {
+		if strings.Contains(name, "-nft-") {
+			return nft.newCmd(strings.Replace(name, "-nft", "", 1), arg...)
+		}
+		Expect(name).To(ContainSubstring("-legacy-"))
+		return legacy.newCmd(strings.Replace(name, "-legacy", "", 1), arg...)
+	}
+	lookPath := func(file string) (string, error) {
+		return file, nil
+	}
+
+	BeforeEach(func() {
+		legacy = newMockDataplane("filter", map[string][]string{
+			"FORWARD": {"-j other-rule"},
+		})
+		nft = newMockDataplane("filter", map[string][]string{
+			"FORWARD": {},
+		})
+		table = legacy.newTable(func(options *TableOptions) {
+			options.NewCmdOverride = newCmd
+			options.LookPathOverride = lookPath
+			options.BackendMode = "legacy"
+		})
+		table.UpdateChain(&Chain{Name: "cali-foo", Rules: []Rule{{Action: DropAction{}}}})
+		table.SetRuleInsertions("FORWARD", []Rule{{Action: JumpAction{Target: "cali-foo"}}})
+		table.Apply()
+		Expect(legacy.Chains).To(HaveKey("cali-foo"))
+		Expect(legacy.Chains["FORWARD"]).To(HaveLen(2))
+		Expect(table.BackendMode()).To(Equal(BackendLegacy))
+	})
+
+	It("should move our rules to the new backend", func() {
+		Expect(table.SwitchBackend("nft")).To(Succeed())
+		Expect(table.BackendMode()).To(Equal(BackendNFT))
+		table.Apply()
+
+		Expect(nft.Chains).To(HaveKey("cali-foo"))
+		Expect(nft.Chains["cali-foo"]).To(HaveLen(1))
+		Expect(nft.Chains["FORWARD"]).To(HaveLen(1))
+		Expect(nft.Chains["FORWARD"][0]).To(ContainSubstring("--jump cali-foo"))
+
+		Expect(legacy.Chains).NotTo(HaveKey("cali-foo"))
+		Expect(legacy.Chains["FORWARD"]).To(Equal([]string{"-j other-rule"}))
+	})
+
+	It("should retry a failed clean up", func() {
+		Expect(table.SwitchBackend("nft")).To(Succeed())
+		legacy.FailNextRestore = true
+		Expect(rescheduleAfterOf(table.Apply())).To(BeNumerically("<=", 10*time.Second))
+		Expect(nft.Chains).To(HaveKey("cali-foo"))
+		Expect(legacy.Chains).To(HaveKey("cali-foo"))
+
+		table.Apply()
+		Expect(legacy.Chains).NotTo(HaveKey("cali-foo"))
+	})
+
+	It("should do nothing when switching to the current backend", func() {
+		legacy.ResetCmds()
+		Expect(table.SwitchBackend("legacy")).To(Succeed())
+		table.Apply()
+		Expect(legacy.CmdNames).To(BeEmpty())
+		Expect(nft.CmdNames).To(BeEmpty())
+	})
+
+	It("should leave the old backend alone after switching back", func() {
+		Expect(table.SwitchBackend("nft")).To(Succeed())
+		Expect(table.SwitchBackend("legacy")).To(Succeed())
+		table.Apply()
+		Expect(nft.CmdNames).To(BeEmpty())
+		Expect(legacy.Chains).To(HaveKey("cali-foo"))
+		Expect(legacy.Chains["FORWARD"]).To(HaveLen(2))
+	})
+
+	It("should reject an unknown backend", func() {
+		Expect(table.SwitchBackend("ebpf")).NotTo(Succeed())
+		Expect(table.BackendMode()).To(Equal(BackendLegacy))
+	})
+})
+
+var _ = Describe("BackendDetector", func() {
+	var legacy, nft *multiTableSave
+	var detector *BackendDetector
+
+	BeforeEach(func() {
+		legacy = &multiTableSave{Dataplanes: []*mockDataplane{
+			newMockDataplane("filter", map[string][]string{
+				"FORWARD":  {"-j cali-FORWARD"},
+				"cali-foo": {"-j DROP", "-j DROP"},
+			}),
+		}}
+		nft = &multiTableSave{Dataplanes: []*mockDataplane{
+			newMockDataplane("filter", map[string][]string{
+				"FORWARD":      {"-j KUBE-FORWARD"},
+				"KUBE-FORWARD": {"-j ACCEPT"},
+			}),
+		}}
+		detector = NewBackendDetector([]string{"cali-"})
+		detector.LookPath = func(file string) (string, error) {
+			return file, nil
+		}
+		detector.NewCmd = func(name string, arg ...string) CmdIface {
+			switch name {
+			case "iptables-legacy-save":
+				return legacy.newCmd("iptables-save", arg...)
+			case "iptables-nft-save":
+				return nft.newCmd("iptables-save", arg...)
+			}
+			Fail("Unexpected command " + name)
+			return nil
+		}
+	})
+
+	It("should ignore our own chains", func() {
+		Expect(detector.Detect(BackendLegacy)).To(Equal(BackendNFT))
+	})
+
+	It("should stick with the current backend on a tie", func() {
+		nft.Dataplanes[0].Chains = map[string][]string{"FORWARD": {"-j KUBE-FORWARD"}}
+		Expect(detector.Detect(BackendNFT)).To(Equal(BackendNFT))
+		Expect(detector.Detect(BackendLegacy)).To(Equal(BackendLegacy))
+		Expect(detector.Detect("")).To(Equal(BackendLegacy))
+	})
+
+	It("should handle a missing backend", func() {
+		nft.FailAll = true
+		Expect(detector.Detect(BackendNFT)).To(Equal(BackendLegacy))
+	})
+})
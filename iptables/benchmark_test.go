@@ -0,0 +1,130 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables_test
+
+import (
+	"fmt"
+	"testing"
+
+	. "github.com/onsi/gomega"
+	log "github.com/sirupsen/logrus"
+
+	. "github.com/projectcalico/felix/iptables"
+)
+
+// Benchmarks for the hot paths of the package.  Run them with "make bench", which records the
+// results, in the standard "go test -bench" format, in bench_output.txt so that runs can be
+// compared with benchstat.
+
+const (
+	benchNumChains        = 100
+	benchNumRulesPerChain = 20
+)
+
+// benchChain returns a synthetic chain that looks like a rendered policy.
+func benchChain(name string, numRules int) *Chain {
+	chain := &Chain{Name: name}
+	for i := 0; i < numRules; i++ {
+		chain.Rules = append(chain.Rules, Rule{
+			Match: Match().
+				Protocol("tcp").
+				SourceNet(fmt.Sprintf("10.%d.%d.0/24", i/256, i%256)).
+				DestIPSet(fmt.Sprintf("cali40s:set-%d", i)).
+				DestPorts(80, 443, uint16(8000+i)),
+			Action:  AcceptAction{},
+			Comment: fmt.Sprintf("Policy default/policy-%d ingress rule", i),
+		})
+	}
+	return chain
+}
+
+func benchChains() []*Chain {
+	chains := make([]*Chain, benchNumChains)
+	for i := range chains {
+		chains[i] = benchChain(fmt.Sprintf("cali-bench-%d", i), benchNumRulesPerChain)
+	}
+	return chains
+}
+
+// quietLogs turns down the log level, since the mock dataplane logs every line that it
+// processes.  It returns a function that restores the previous level.
+func quietLogs() func() {
+	level := log.GetLevel()
+	log.SetLevel(log.WarnLevel)
+	return func() {
+		log.SetLevel(level)
+	}
+}
+
+func BenchmarkRuleHashes(b *testing.B) {
+	chain := benchChain("cali-bench", 100)
+	features := &Features{}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		chain.RuleHashes(features)
+	}
+}
+
+func BenchmarkRenderAppend(b *testing.B) {
+	rule := benchChain("cali-bench", 1).Rules[0]
+	features := &Features{}
+	prefixFrag := `-m comment --comment "cali:0123456789abcdef"`
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rule.RenderAppend("cali-bench", prefixFrag, features)
+	}
+}
+
+func newBenchTable(dataplane *mockDataplane) *Table {
+	return dataplane.newTable(nil)
+}
+
+// BenchmarkTableApply measures programming a batch of chains from scratch.
+func BenchmarkTableApply(b *testing.B) {
+	RegisterTestingT(b)
+	defer quietLogs()()
+	chains := benchChains()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		dataplane := newMockDataplane("filter", map[string][]string{"FORWARD": {}})
+		table := newBenchTable(dataplane)
+		b.StartTimer()
+
+		table.UpdateChains(chains)
+		table.SetRuleInsertions("FORWARD", []Rule{{Action: JumpAction{Target: "cali-bench-0"}}})
+		table.Apply()
+	}
+}
+
+// BenchmarkTableResync measures a resync against a dataplane that is already correct, which
+// is what Felix does periodically.
+func BenchmarkTableResync(b *testing.B) {
+	RegisterTestingT(b)
+	defer quietLogs()()
+	dataplane := newMockDataplane("filter", map[string][]string{"FORWARD": {}})
+	table := newBenchTable(dataplane)
+	table.UpdateChains(benchChains())
+	table.Apply()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		table.InvalidateDataplaneCache("benchmark")
+		table.Apply()
+	}
+}
@@ -0,0 +1,144 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// MaxBPFInstructions is the longest classic BPF program that the xt_bpf match accepts.
+const MaxBPFInstructions = 64
+
+// BPFInstruction is a classic BPF instruction, in the form that "tcpdump -ddd" and nfbpf_compile
+// print.
+type BPFInstruction struct {
+	Code uint16
+	Jt   uint8
+	Jf   uint8
+	K    uint32
+}
+
+// BPFMatch is the filter of the xt_bpf match, for matches that the other matches can't express,
+// such as on the contents of the packet's payload.  Either Program is a classic BPF program,
+// which sees the packet from its IP header onwards and matches the packet if it returns
+// non-zero, or PinnedPath is the path of an eBPF program pinned in the BPF filesystem.
+type BPFMatch struct {
+	Program    []BPFInstruction
+	PinnedPath string
+}
+
+// BPFTerm matches packets that the BPF filter matches, or doesn't if Negate is set.
+type BPFTerm struct {
+	BPFMatch
+	Negate bool
+}
+
+func (t BPFTerm) validate() {
+	if t.PinnedPath != "" {
+		if len(t.Program) != 0 || strings.ContainsAny(t.PinnedPath, " \t\n\"'\\") {
+			log.WithField("bpf", t.BPFMatch).Panic("Probably bug: BPF match with a program and a path, or a bad path")
+		}
+		return
+	}
+	if len(t.Program) == 0 || len(t.Program) > MaxBPFInstructions {
+		log.WithField("bpf", t.BPFMatch).Panic("Probably bug: BPF match with no program or too long a program")
+	}
+}
+
+func (t BPFTerm) String() string {
+	if t.PinnedPath != "" {
+		return notPrefix(t.Negate) + "BPF(" + t.PinnedPath + ")"
+	}
+	return notPrefix(t.Negate) + "BPF(" + FormatBPFBytecode(t.Program) + ")"
+}
+
+// BPF matches packets that the BPF filter matches.  Needs the xt_bpf kernel module.
+func (m MatchCriteria) BPF(bpf BPFMatch) MatchCriteria {
+	return m.with(BPFTerm{BPFMatch: bpf})
+}
+
+// NotBPF matches packets that the BPF filter doesn't match.  Needs the xt_bpf kernel module.
+func (m MatchCriteria) NotBPF(bpf BPFMatch) MatchCriteria {
+	return m.with(BPFTerm{BPFMatch: bpf, Negate: true})
+}
+
+// FormatBPFBytecode formats a classic BPF program as the xt_bpf match's --bytecode option
+// expects: the number of instructions followed by the instructions, separated by commas.
+func FormatBPFBytecode(program []BPFInstruction) string {
+	parts := make([]string, 0, len(program)+1)
+	parts = append(parts, strconv.Itoa(len(program)))
+	for _, insn := range program {
+		parts = append(parts, fmt.Sprintf("%d %d %d %d", insn.Code, insn.Jt, insn.Jf, insn.K))
+	}
+	return strings.Join(parts, ",")
+}
+
+// ParseBPFBytecode parses the output of nfbpf_compile, which is in the same format as the
+// --bytecode option, back into instructions.
+func ParseBPFBytecode(bytecode string) ([]BPFInstruction, error) {
+	parts := strings.Split(strings.TrimSpace(bytecode), ",")
+	count, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("bad BPF instruction count %q: %v", parts[0], err)
+	}
+	if count != len(parts)-1 {
+		return nil, fmt.Errorf("BPF bytecode has %d instructions but should have %d", len(parts)-1, count)
+	}
+	program := make([]BPFInstruction, 0, count)
+	for _, part := range parts[1:] {
+		fields := strings.Fields(part)
+		if len(fields) != 4 {
+			return nil, fmt.Errorf("bad BPF instruction %q", part)
+		}
+		var values [4]uint64
+		for i, bits := range []int{16, 8, 8, 32} {
+			values[i], err = strconv.ParseUint(fields[i], 10, bits)
+			if err != nil {
+				return nil, fmt.Errorf("bad BPF instruction %q: %v", part, err)
+			}
+		}
+		program = append(program, BPFInstruction{
+			Code: uint16(values[0]),
+			Jt:   uint8(values[1]),
+			Jf:   uint8(values[2]),
+			K:    uint32(values[3]),
+		})
+	}
+	return program, nil
+}
+
+// CompileBPF compiles a tcpdump-style filter expression, such as "udp dst port 53", into a
+// classic BPF program for BPFMatch, using the nfbpf_compile tool that comes with iptables.
+func CompileBPF(expr string) ([]BPFInstruction, error) {
+	// Packets reach xt_bpf without a link-layer header, hence the RAW link type.
+	cmd := newRealCmd("nfbpf_compile", "RAW", expr)
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to compile BPF expression %q: %v", expr, err)
+	}
+	program, err := ParseBPFBytecode(string(out))
+	if err != nil {
+		return nil, err
+	}
+	if len(program) > MaxBPFInstructions {
+		return nil, fmt.Errorf("BPF expression %q compiles to %d instructions, more than the maximum %d",
+			expr, len(program), MaxBPFInstructions)
+	}
+	return program, nil
+}
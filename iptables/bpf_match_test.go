@@ -0,0 +1,70 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/projectcalico/felix/iptables"
+)
+
+var _ = Describe("BPF match", func() {
+	// A program for "udp dst port 53" on IPv4 packets without a link-layer header.
+	const dnsBytecode = "12,48 0 0 0,84 0 0 240,21 0 8 64,48 0 0 9,21 0 6 17,40 0 0 6,69 4 0 8191," +
+		"177 0 0 0,72 0 0 2,21 0 1 53,6 0 0 65535,6 0 0 0"
+
+	It("should round trip bytecode", func() {
+		program, err := ParseBPFBytecode(dnsBytecode + "\n")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(program).To(HaveLen(12))
+		Expect(program[0]).To(Equal(BPFInstruction{Code: 48}))
+		Expect(program[6]).To(Equal(BPFInstruction{Code: 69, Jt: 4, K: 8191}))
+		Expect(FormatBPFBytecode(program)).To(Equal(dnsBytecode))
+	})
+
+	It("should render a program", func() {
+		program, err := ParseBPFBytecode(dnsBytecode)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(Match().BPF(BPFMatch{Program: program}).Render()).To(Equal(
+			`-m bpf --bytecode "` + dnsBytecode + `"`))
+		Expect(Match().NotBPF(BPFMatch{Program: program}).Render()).To(Equal(
+			`-m bpf ! --bytecode "` + dnsBytecode + `"`))
+	})
+
+	It("should render a pinned program", func() {
+		Expect(Match().BPF(BPFMatch{PinnedPath: "/sys/fs/bpf/calico/dns"}).Render()).To(Equal(
+			"-m bpf --object-pinned /sys/fs/bpf/calico/dns"))
+	})
+
+	It("should panic on a bad match", func() {
+		Expect(func() { Match().BPF(BPFMatch{}) }).To(Panic())
+		Expect(func() { Match().BPF(BPFMatch{PinnedPath: "/sys/fs/bpf/a b"}) }).To(Panic())
+		Expect(func() { Match().BPF(BPFMatch{Program: make([]BPFInstruction, MaxBPFInstructions+1)}) }).To(Panic())
+	})
+
+	It("should reject bad bytecode", func() {
+		for _, bytecode := range []string{
+			"",
+			"2,6 0 0 0",
+			"1,6 0 0",
+			"1,6 0 256 0",
+			"1,6 0 0 0 --jump ACCEPT",
+		} {
+			_, err := ParseBPFBytecode(bytecode)
+			Expect(err).To(HaveOccurred(), bytecode)
+		}
+	})
+})
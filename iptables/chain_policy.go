@@ -0,0 +1,107 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Kernel chain policies, for use with SetChainPolicy.
+const (
+	PolicyAccept = "ACCEPT"
+	PolicyDrop   = "DROP"
+)
+
+// SetChainPolicy asks the Table to maintain the default policy of one of the kernel's chains
+// (for example, "FORWARD") in this table.  Apply() programs the policy and resync repairs it if
+// another process changes it.  Passing an empty policy stops the Table from managing the
+// chain's policy; the policy in the dataplane is left as it is.  Panics if the chain isn't a
+// kernel chain in this table or the policy isn't PolicyAccept or PolicyDrop.
+func (t *Table) SetChainPolicy(chainName string, policy string) {
+	t.opLock.Lock()
+	defer t.opLock.Unlock()
+	logCxt := t.logCxt.WithFields(log.Fields{
+		"chainName": chainName,
+		"policy":    policy,
+	})
+	if !t.isKernelChain(chainName) {
+		logCxt.Panic("Policy can only be set on kernel chains")
+	}
+	switch policy {
+	case "":
+		logCxt.Info("No longer managing chain policy")
+		delete(t.chainToPolicy, chainName)
+		t.dirtyPolicies.Discard(chainName)
+		return
+	case PolicyAccept, PolicyDrop:
+	default:
+		logCxt.Panic("Unknown chain policy")
+	}
+	if t.chainToPolicy[chainName] == policy {
+		return
+	}
+	logCxt.Info("Queueing update of chain policy")
+	t.chainToPolicy[chainName] = policy
+	t.dirtyPolicies.Add(chainName)
+	t.noteUpdate()
+}
+
+func (t *Table) isKernelChain(chainName string) bool {
+	for _, name := range tableToKernelChains[t.Name] {
+		if name == chainName {
+			return true
+		}
+	}
+	return false
+}
+
+// checkChainPolicies compares the policies that we manage with those that we loaded from the
+// dataplane and marks any that differ for repair.
+func (t *Table) checkChainPolicies() {
+	for chainName, policy := range t.chainToPolicy {
+		if t.dirtyPolicies.Contains(chainName) {
+			continue
+		}
+		if dpPolicy := t.chainToDataplanePolicy[chainName]; dpPolicy != policy {
+			t.logCxt.WithFields(log.Fields{
+				"chainName":      chainName,
+				"expectedPolicy": policy,
+				"actualPolicy":   dpPolicy,
+			}).Warn("Detected out-of-sync chain policy, marking for resync")
+			t.dirtyPolicies.Add(chainName)
+			t.reportOutOfSync(chainName, OutOfSyncPolicyModified)
+		}
+	}
+}
+
+// writeChainPolicies writes a "-P" line for each dirty chain policy that differs from the
+// dataplane.  Returns the policies that will be in place once the update is committed.
+func (t *Table) writeChainPolicies(buf *RestoreInputBuilder) map[string]string {
+	newPolicies := map[string]string{}
+	t.dirtyPolicies.Iter(func(item interface{}) error {
+		chainName := item.(string)
+		policy, ok := t.chainToPolicy[chainName]
+		if !ok || t.chainToDataplanePolicy[chainName] == policy {
+			return nil
+		}
+		buf.MaybeStartNewChunk(t.maxLinesPerRestore)
+		buf.WriteLineForChain(chainName, fmt.Sprintf("-P %s %s", chainName, policy))
+		newPolicies[chainName] = policy
+		return nil // Delay clearing the set until we've programmed iptables.
+	})
+	return newPolicies
+}
@@ -0,0 +1,102 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/projectcalico/felix/iptables"
+)
+
+var _ = Describe("Table chain policies", func() {
+	var dataplane *mockDataplane
+	var table *Table
+	var reports []string
+
+	BeforeEach(func() {
+		dataplane = newMockDataplane("filter", map[string][]string{
+			"FORWARD": {},
+			"INPUT":   {},
+			"OUTPUT":  {},
+		})
+		dataplane.Policies = map[string]string{
+			"FORWARD": "ACCEPT",
+			"INPUT":   "ACCEPT",
+			"OUTPUT":  "ACCEPT",
+		}
+		reports = nil
+		table = dataplane.newTable(func(options *TableOptions) {
+			options.OnOutOfSync = func(chainName string, reason string) {
+				reports = append(reports, chainName+" "+reason)
+			}
+		})
+	})
+
+	It("should leave policies alone by default", func() {
+		table.Apply()
+		Expect(dataplane.CmdNames).NotTo(ContainElement("iptables-restore"))
+	})
+
+	It("should reject non-kernel chains and unknown policies", func() {
+		Expect(func() { table.SetChainPolicy("cali-foo", PolicyDrop) }).To(Panic())
+		Expect(func() { table.SetChainPolicy("PREROUTING", PolicyDrop) }).To(Panic())
+		Expect(func() { table.SetChainPolicy("FORWARD", "REJECT") }).To(Panic())
+	})
+
+	Describe("with FORWARD set to DROP", func() {
+		BeforeEach(func() {
+			table.SetChainPolicy("FORWARD", PolicyDrop)
+			table.Apply()
+		})
+
+		It("should program the policy", func() {
+			Expect(dataplane.Policies["FORWARD"]).To(Equal("DROP"))
+			Expect(dataplane.Policies["INPUT"]).To(Equal("ACCEPT"))
+			Expect(reports).To(BeEmpty())
+		})
+
+		It("should do nothing if the policy is already correct", func() {
+			numCmds := len(dataplane.CmdNames)
+			table.SetChainPolicy("FORWARD", PolicyDrop)
+			table.InvalidateDataplaneCache("test")
+			table.Apply()
+			Expect(dataplane.CmdNames[numCmds:]).NotTo(ContainElement("iptables-restore"))
+		})
+
+		It("should repair the policy on resync", func() {
+			dataplane.Policies["FORWARD"] = "ACCEPT"
+			table.InvalidateDataplaneCache("test")
+			table.Apply()
+			Expect(dataplane.Policies["FORWARD"]).To(Equal("DROP"))
+			Expect(reports).To(Equal([]string{"FORWARD " + OutOfSyncPolicyModified}))
+		})
+
+		It("should update the policy", func() {
+			table.SetChainPolicy("FORWARD", PolicyAccept)
+			table.Apply()
+			Expect(dataplane.Policies["FORWARD"]).To(Equal("ACCEPT"))
+		})
+
+		It("should stop managing the policy when it's cleared", func() {
+			table.SetChainPolicy("FORWARD", "")
+			dataplane.Policies["FORWARD"] = "ACCEPT"
+			table.InvalidateDataplaneCache("test")
+			table.Apply()
+			Expect(dataplane.Policies["FORWARD"]).To(Equal("ACCEPT"))
+			Expect(reports).To(BeEmpty())
+		})
+	})
+})
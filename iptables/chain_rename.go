@@ -0,0 +1,171 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Chain renaming.  Re-sharding a dispatch chain moves its rules to a chain with a new name.
+// Creating the new chain and removing the old one would reset the rules' counters and, unless
+// the caller is careful with ordering, leave a window in which jumps to the chain have nowhere
+// to go.  Instead, RenameChain records a rename, which the next update writes as an iptables
+// "--rename-chain" (-E).  The kernel renames the chain in place, keeping its rules, their
+// counters and the jumps to it, which then refer to the new name.
+//
+// Our rule hashes include the chain name so the same update rewrites the renamed chain's rules
+// with their new hashes.  The rewrite would reset the counters so we read them first and
+// carry them over to each rule that is unchanged apart from its hash, as counter preservation
+// does.
+//
+// The rename is only written if, at the time of the update, the old chain is in the dataplane
+// and the new one isn't.  Otherwise, the update falls back to creating the new chain and
+// deleting the old one.
+
+// RenameChain renames one of our chains, which must have been passed to UpdateChain, keeping
+// its rules.  The next Apply() renames the chain in the dataplane without disturbing its
+// counters.  Jumps to the chain in the dataplane follow the rename but the caller should still
+// update the chains that refer to it, since the hashes of their rules are for the old name.
+// Returns an error, without changing the table, if the old chain is unknown, split or
+// quarantined, or if the new name is invalid or already in use.
+func (t *Table) RenameChain(oldName, newName string) error {
+	t.opLock.Lock()
+	defer t.opLock.Unlock()
+
+	chain := t.chainNameToChain[oldName]
+	if chain == nil {
+		return fmt.Errorf("unknown chain %q", oldName)
+	}
+	if len(t.chainToSubChains[oldName]) > 0 {
+		return fmt.Errorf("chain %q is split into sub-chains so it can't be renamed", oldName)
+	}
+	if t.isQuarantined(oldName) {
+		return fmt.Errorf("chain %q is quarantined so it can't be renamed", oldName)
+	}
+	if newName == "" || len(newName) > MaxChainNameLength || strings.ContainsAny(newName, " \t\n\"") {
+		return fmt.Errorf("invalid chain name %q", newName)
+	}
+	if _, ok := t.chainNameToChain[newName]; ok {
+		return fmt.Errorf("chain %q already exists", newName)
+	}
+	if _, ok := t.chainToDataplaneHashes[newName]; ok {
+		return fmt.Errorf("chain %q already exists in the dataplane", newName)
+	}
+
+	t.logCxt.WithFields(log.Fields{
+		"oldName": oldName,
+		"newName": newName,
+	}).Info("Queueing rename of chain.")
+	// If the chain was itself renamed since the last update, the dataplane still has it under
+	// its original name.
+	dpName := oldName
+	for from, to := range t.chainRenames {
+		if to == oldName {
+			dpName = from
+			break
+		}
+	}
+	t.chainRenames[dpName] = newName
+
+	t.updateChain(&Chain{Name: newName, Rules: chain.Rules})
+	t.removeChainByName(oldName)
+	return nil
+}
+
+// canRenameInDataplane returns true if the pending rename can be written as a rename: the old
+// chain must be in the dataplane and no longer wanted and the new chain must be wanted and not
+// yet in the dataplane.
+func (t *Table) canRenameInDataplane(oldName, newName string) bool {
+	if _, ok := t.chainNameToChain[oldName]; ok {
+		return false
+	}
+	if _, ok := t.chainNameToChain[newName]; !ok {
+		return false
+	}
+	if _, ok := t.chainToDataplaneHashes[oldName]; !ok {
+		return false
+	}
+	_, ok := t.chainToDataplaneHashes[newName]
+	return !ok
+}
+
+// renamedChainCounters adds the counters of the rules in the chains that we're about to rename
+// to the given counters, keyed on the hashes that the rules will have after the update.  Only
+// rules that are otherwise unchanged keep their counters.  Returns the updated map, which may
+// be newly allocated.
+func (t *Table) renamedChainCounters(
+	counters map[string]RuleCounters,
+	features *Features,
+) map[string]RuleCounters {
+	for oldName, newName := range t.chainRenames {
+		if !t.canRenameInDataplane(oldName, newName) || len(t.chainToDataplaneHashes[oldName]) == 0 {
+			continue
+		}
+		if counters == nil {
+			var err error
+			counters, err = t.readCounters()
+			if err != nil {
+				t.logCxt.WithError(err).Warn(
+					"Failed to read counters; renamed chains' rules will start from zero")
+				return nil
+			}
+		}
+		chain := t.chainNameToChain[newName]
+		dpHashes := t.chainToDataplaneHashes[oldName]
+		hashesUnderOldName := (&Chain{Name: oldName, Rules: chain.Rules}).RuleHashesWithFormat(
+			features, t.hashFormat)
+		newHashes := t.ruleHashes(chain, features)
+		for i := range newHashes {
+			if i >= len(dpHashes) || dpHashes[i] != hashesUnderOldName[i] {
+				continue
+			}
+			if c, ok := counters[dpHashes[i]]; ok {
+				c.Chain = newName
+				counters[newHashes[i]] = c
+			}
+		}
+	}
+	return counters
+}
+
+// writeChainRenames writes the pending renames that can be done in the dataplane.  Since the
+// renamed chain's rules are then in the dataplane under its new name, it moves the chain's
+// dataplane hashes over to the new name so that the rest of the update only rewrites the rules.
+func (t *Table) writeChainRenames(buf *RestoreInputBuilder) {
+	oldNames := make([]string, 0, len(t.chainRenames))
+	for oldName := range t.chainRenames {
+		oldNames = append(oldNames, oldName)
+	}
+	sort.Strings(oldNames)
+	for _, oldName := range oldNames {
+		newName := t.chainRenames[oldName]
+		if !t.canRenameInDataplane(oldName, newName) {
+			t.logCxt.WithFields(log.Fields{
+				"oldName": oldName,
+				"newName": newName,
+			}).Debug("Can't rename chain in dataplane, will create and delete instead.")
+			continue
+		}
+		buf.MaybeStartNewChunk(t.maxLinesPerRestore)
+		buf.WriteLineForChain(newName, fmt.Sprintf("--rename-chain %s %s", oldName, newName))
+		t.chainToDataplaneHashes[newName] = t.chainToDataplaneHashes[oldName]
+		delete(t.chainToDataplaneHashes, oldName)
+		t.dirtyChains.Discard(oldName)
+	}
+}
@@ -0,0 +1,136 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables_test
+
+import (
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/projectcalico/felix/iptables"
+	"github.com/projectcalico/libcalico-go/lib/set"
+)
+
+var _ = Describe("Table chain renaming", func() {
+	var dataplane *mockDataplane
+	var table *Table
+
+	fooRules := []Rule{
+		{Match: Match().Protocol("tcp"), Action: AcceptAction{}},
+		{Match: Match().Protocol("udp"), Action: AcceptAction{}},
+	}
+
+	BeforeEach(func() {
+		dataplane = newMockDataplane("filter", map[string][]string{
+			"FORWARD": {},
+			"INPUT":   {},
+			"OUTPUT":  {},
+		})
+		table = dataplane.newTable(nil)
+	})
+
+	Describe("with a chain in the dataplane", func() {
+		BeforeEach(func() {
+			table.UpdateChain(&Chain{Name: "cali-foo", Rules: fooRules})
+			table.SetRuleInsertions("FORWARD", []Rule{{Action: JumpAction{Target: "cali-foo"}}})
+			table.Apply()
+			dataplane.Counters = map[string]string{
+				dataplane.Chains["cali-foo"][0]: "[5:300]",
+				dataplane.Chains["cali-foo"][1]: "[7:420]",
+			}
+			dataplane.FlushedChains = set.New()
+		})
+
+		rename := func() {
+			Expect(table.RenameChain("cali-foo", "cali-bar")).To(Succeed())
+			table.SetRuleInsertions("FORWARD", []Rule{{Action: JumpAction{Target: "cali-bar"}}})
+			table.Apply()
+		}
+
+		It("should rename the chain rather than recreating it", func() {
+			rename()
+			Expect(dataplane.RenamedChains.Contains("cali-foo")).To(BeTrue())
+			Expect(dataplane.FlushedChains.Contains("cali-bar")).To(BeFalse())
+			Expect(dataplane.Chains).NotTo(HaveKey("cali-foo"))
+			Expect(dataplane.Chains["cali-bar"]).To(HaveLen(2))
+			Expect(dataplane.Chains["FORWARD"]).To(HaveLen(1))
+			Expect(dataplane.Chains["FORWARD"][0]).To(HaveSuffix("--jump cali-bar"))
+		})
+
+		It("should rewrite the rules' hashes for the new name", func() {
+			rename()
+			newHashes := (&Chain{Name: "cali-bar", Rules: fooRules}).RuleHashes(nil)
+			for i, rule := range dataplane.Chains["cali-bar"] {
+				Expect(rule).To(ContainSubstring("cali:" + newHashes[i]))
+			}
+		})
+
+		It("should preserve the rules' counters", func() {
+			rename()
+			chain := dataplane.Chains["cali-bar"]
+			Expect(dataplane.Counters[chain[0]]).To(Equal("[5:300]"))
+			Expect(dataplane.Counters[chain[1]]).To(Equal("[7:420]"))
+		})
+
+		It("should only preserve the counters of unchanged rules", func() {
+			Expect(table.RenameChain("cali-foo", "cali-bar")).To(Succeed())
+			table.UpdateChain(&Chain{Name: "cali-bar", Rules: []Rule{
+				fooRules[0],
+				{Action: DropAction{}},
+			}})
+			table.SetRuleInsertions("FORWARD", []Rule{{Action: JumpAction{Target: "cali-bar"}}})
+			table.Apply()
+			chain := dataplane.Chains["cali-bar"]
+			Expect(dataplane.Counters[chain[0]]).To(Equal("[5:300]"))
+			Expect(dataplane.Counters).NotTo(HaveKey(chain[1]))
+		})
+
+		It("should collapse successive renames into one", func() {
+			Expect(table.RenameChain("cali-foo", "cali-bar")).To(Succeed())
+			Expect(table.RenameChain("cali-bar", "cali-baz")).To(Succeed())
+			table.SetRuleInsertions("FORWARD", []Rule{{Action: JumpAction{Target: "cali-baz"}}})
+			table.Apply()
+			Expect(dataplane.RenamedChains.Contains("cali-foo")).To(BeTrue())
+			Expect(dataplane.Chains).NotTo(HaveKey("cali-foo"))
+			Expect(dataplane.Chains).NotTo(HaveKey("cali-bar"))
+			Expect(dataplane.Chains["cali-baz"]).To(HaveLen(2))
+		})
+
+		It("should reject a name that's in use", func() {
+			table.UpdateChain(&Chain{Name: "cali-bar"})
+			Expect(table.RenameChain("cali-foo", "cali-bar")).NotTo(Succeed())
+			Expect(table.RenameChain("cali-foo", "FORWARD")).NotTo(Succeed())
+		})
+
+		It("should reject an invalid name", func() {
+			Expect(table.RenameChain("cali-foo", "")).NotTo(Succeed())
+			Expect(table.RenameChain("cali-foo", strings.Repeat("x", 29))).NotTo(Succeed())
+		})
+	})
+
+	It("should reject an unknown chain", func() {
+		Expect(table.RenameChain("cali-foo", "cali-bar")).NotTo(Succeed())
+	})
+
+	It("should create the chain if the old chain isn't in the dataplane yet", func() {
+		table.UpdateChain(&Chain{Name: "cali-foo", Rules: fooRules})
+		Expect(table.RenameChain("cali-foo", "cali-bar")).To(Succeed())
+		table.Apply()
+		Expect(dataplane.RenamedChains.Len()).To(BeZero())
+		Expect(dataplane.Chains).NotTo(HaveKey("cali-foo"))
+		Expect(dataplane.Chains["cali-bar"]).To(HaveLen(2))
+	})
+})
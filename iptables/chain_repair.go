@@ -0,0 +1,100 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	log "github.com/sirupsen/logrus"
+)
+
+// repairMissingChains is called before we render an update.  It checks that every one of our
+// chains that the update's rules jump to will exist once the update is committed.
+//
+// If another process half-deletes our chains (for example, by flushing and deleting chains
+// without regard to which ones are still in use), we can be left with rules that refer to a
+// chain that we think is in the dataplane but isn't.  Rather than letting iptables-restore
+// reject the update and relying on the retry, we mark the missing chains as dirty so that they
+// get recreated, ahead of the rules that refer to them, in the same transaction.  Recreated
+// chains are checked in turn, in case they refer to other missing chains.
+//
+// References to chains that we don't have at all can't be repaired (the caller is responsible
+// for those); since iptables-restore would reject the update, we return them as a
+// *DanglingReferencesError rather than writing it.
+func (t *Table) repairMissingChains() error {
+	var toCheck []string
+	t.dirtyChains.Iter(func(item interface{}) error {
+		toCheck = append(toCheck, item.(string))
+		return nil
+	})
+
+	var dangling []DanglingReference
+	checkRules := func(chainName string, rules []Rule, inserted bool) {
+		for i, rule := range rules {
+			target := actionTarget(rule.Action)
+			if target == "" || !t.ourChainsRegexp.MatchString(target) {
+				continue
+			}
+			_, inDataplane := t.chainToDataplaneHashes[target]
+			if _, ok := t.chainNameToChain[target]; ok {
+				if inDataplane || t.dirtyChains.Contains(target) {
+					// Already there, or about to be written.
+					continue
+				}
+				t.logCxt.WithFields(log.Fields{
+					"chainName":      target,
+					"referencedFrom": chainName,
+				}).Warn("Referenced chain is missing from the dataplane, recreating it")
+				t.dirtyChains.Add(target)
+				t.reportOutOfSync(target, OutOfSyncChainMissing)
+				toCheck = append(toCheck, target)
+				continue
+			}
+			if inDataplane && !t.dirtyChains.Contains(target) {
+				// Not one of our chains any more but it's still in the dataplane and we're
+				// not about to delete it (for example, a chain in its grace period).
+				continue
+			}
+			dangling = append(dangling, DanglingReference{
+				Chain:     chainName,
+				RuleIndex: i,
+				Inserted:  inserted,
+				Target:    target,
+			})
+		}
+	}
+
+	if t.ownsInserts {
+		t.dirtyInserts.Iter(func(item interface{}) error {
+			chainName := item.(string)
+			checkRules(chainName, t.chainToInsertedRules[chainName], true)
+			return nil
+		})
+	}
+	for len(toCheck) > 0 {
+		chainName := toCheck[0]
+		toCheck = toCheck[1:]
+		if t.isQuarantined(chainName) {
+			// We won't be writing the chain's rules.
+			continue
+		}
+		if chain, ok := t.chainNameToChain[chainName]; ok {
+			checkRules(chainName, chain.Rules, false)
+		}
+	}
+
+	if len(dangling) > 0 {
+		return t.newDanglingReferencesError(dangling)
+	}
+	return nil
+}
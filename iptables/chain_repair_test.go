@@ -0,0 +1,92 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/projectcalico/felix/iptables"
+	"github.com/projectcalico/libcalico-go/lib/set"
+)
+
+var _ = Describe("Table missing chain repair", func() {
+	var dataplane *mockDataplane
+	var table *Table
+	var reports []string
+
+	BeforeEach(func() {
+		dataplane = newMockDataplane("filter", map[string][]string{
+			"FORWARD": {},
+		})
+		reports = nil
+		table = dataplane.newTable(func(options *TableOptions) {
+			options.OnOutOfSync = func(chainName string, reason string) {
+				reports = append(reports, chainName+" "+reason)
+			}
+		})
+		table.SetRuleInsertions("FORWARD", []Rule{{Action: JumpAction{Target: "cali-FORWARD"}}})
+		table.UpdateChain(&Chain{Name: "cali-FORWARD", Rules: []Rule{
+			{Action: JumpAction{Target: "cali-from-wl"}},
+		}})
+		table.UpdateChain(&Chain{Name: "cali-from-wl", Rules: []Rule{
+			{Action: GotoAction{Target: "cali-pol"}},
+		}})
+		table.UpdateChain(&Chain{Name: "cali-pol"})
+		table.Apply()
+		Expect(dataplane.Chains).To(HaveKey("cali-pol"))
+	})
+
+	It("should recreate a missing chain that an update refers to", func() {
+		// Another process deletes a chain behind our back; we don't know until we write
+		// a rule that refers to it.
+		delete(dataplane.Chains, "cali-pol")
+		delete(dataplane.Chains, "cali-from-wl")
+		table.UpdateChain(&Chain{Name: "cali-FORWARD", Rules: []Rule{
+			{Action: DropAction{}},
+			{Action: JumpAction{Target: "cali-from-wl"}},
+		}})
+		table.Apply()
+
+		Expect(dataplane.Chains).To(HaveKey("cali-from-wl"))
+		Expect(dataplane.Chains["cali-from-wl"]).To(HaveLen(1))
+		Expect(dataplane.Chains).To(HaveKey("cali-pol"))
+		Expect(reports).To(ConsistOf(
+			"cali-from-wl "+OutOfSyncChainMissing,
+			"cali-pol "+OutOfSyncChainMissing,
+		))
+	})
+
+	It("should report missing chains found on resync", func() {
+		delete(dataplane.Chains, "cali-pol")
+		table.InvalidateDataplaneCache("test")
+		table.Apply()
+
+		Expect(dataplane.Chains).To(HaveKey("cali-pol"))
+		Expect(reports).To(Equal([]string{"cali-pol " + OutOfSyncChainMissing}))
+	})
+
+	It("should leave chains that are already there alone", func() {
+		dataplane.FlushedChains = set.New()
+		dataplane.ChainMods = set.New()
+		table.UpdateChain(&Chain{Name: "cali-FORWARD", Rules: []Rule{
+			{Action: JumpAction{Target: "cali-from-wl"}},
+			{Action: DropAction{}},
+		}})
+		table.Apply()
+		Expect(reports).To(BeEmpty())
+		Expect(dataplane.RuleTouched("cali-from-wl", 1)).To(BeFalse())
+	})
+})
@@ -0,0 +1,142 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/projectcalico/felix/hashutils"
+)
+
+// Chain splitting (TableOptions.MaxRulesPerChain).  Policies with tens of thousands of CIDRs
+// render to very long chains, which make for very long restore inputs whenever the chain is
+// rewritten, and which some kernels and tools handle badly.  We split such chains as they are
+// passed to UpdateChain: the chain keeps the first maxRulesPerChain-1 rules followed by a goto
+// to its first sub-chain, which holds the next rules, and so on.  Since each link is a goto,
+// a RETURN or falling off the end of any sub-chain returns to the chain's caller, as it would
+// have from the original chain.
+//
+// From then on, the sub-chains are ordinary chains of ours: their rules are hashed and diffed
+// individually so updating part of a split chain only rewrites the sub-chains that change.
+// The exported methods take care of the sub-chains: removing the chain removes them and
+// appending to the chain appends to the last of them.
+
+// subChainHashLength is the number of characters of hash in the name of a sub-chain of a chain
+// whose name is too long to take the sub-chain suffix.
+const subChainHashLength = 10
+
+// subChainName returns the name of the n-th sub-chain of the given chain, n >= 1.  If the
+// chain's name is too long to take the suffix, we keep the start of the name, so that the
+// sub-chain still has our chain prefix, and replace the rest with a hash of it, so that long
+// names that only differ at the end still get different sub-chains.
+func subChainName(chainName string, n int) string {
+	suffix := fmt.Sprintf("-s%d", n)
+	if len(chainName)+len(suffix) <= MaxChainNameLength {
+		return chainName + suffix
+	}
+	maxLength := MaxChainNameLength - len(suffix)
+	keep := maxLength - 1 - subChainHashLength
+	return hashutils.GetLengthLimitedID(chainName[:keep], chainName[keep:], maxLength) + suffix
+}
+
+func (t *Table) splitLimit() int {
+	if t.maxRulesPerChain == 1 {
+		return 2
+	}
+	return t.maxRulesPerChain
+}
+
+// updateSplitChain is the splitting version of updateChain; it updates the chain and its
+// sub-chains, removing any sub-chains that are no longer needed.
+func (t *Table) updateSplitChain(chain *Chain) {
+	chain = chain.ForIPVersion(t.IPVersion)
+	limit := t.splitLimit()
+	oldSubChains := t.chainToSubChains[chain.Name]
+	var subChains []string
+	if limit > 0 && len(chain.Rules) > limit {
+		// Carve off segments of limit-1 rules, each followed by a goto to the next, until the
+		// rest fits in one chain.
+		rules := chain.Rules
+		name := chain.Name
+		for len(rules) > limit {
+			next := subChainName(chain.Name, len(subChains)+1)
+			if i := len(subChains); i >= len(oldSubChains) || oldSubChains[i] != next {
+				if _, ok := t.chainNameToChain[next]; ok {
+					// Sharing the chain would give one of the two the other's rules.
+					t.logCxt.WithFields(log.Fields{
+						"chainName": chain.Name,
+						"subChain":  next,
+					}).Panic("Probably bug: sub-chain name clashes with an existing chain")
+				}
+			}
+			segment := make([]Rule, limit-1, limit)
+			copy(segment, rules[:limit-1])
+			segment = append(segment, Rule{Action: GotoAction{Target: next}})
+			t.updateChain(&Chain{Name: name, Rules: segment})
+			subChains = append(subChains, next)
+			rules = rules[limit-1:]
+			name = next
+		}
+		t.updateChain(&Chain{Name: name, Rules: rules})
+		t.logCxt.WithFields(log.Fields{
+			"chainName": chain.Name,
+			"numRules":  len(chain.Rules),
+			"subChains": subChains,
+		}).Debug("Split long chain into sub-chains")
+	} else {
+		t.updateChain(chain)
+	}
+
+	for i := len(subChains); i < len(oldSubChains); i++ {
+		t.removeChainByName(oldSubChains[i])
+	}
+	if len(subChains) > 0 {
+		t.chainToSubChains[chain.Name] = subChains
+	} else {
+		delete(t.chainToSubChains, chain.Name)
+	}
+}
+
+// removeSplitChain is the splitting version of removeChainByName; it also removes the chain's
+// sub-chains.
+func (t *Table) removeSplitChain(name string) {
+	for _, subChain := range t.chainToSubChains[name] {
+		t.removeChainByName(subChain)
+	}
+	delete(t.chainToSubChains, name)
+	t.removeChainByName(name)
+}
+
+// unsplitRules returns a copy of the rules of the given chain as they were passed to UpdateChain,
+// that is, with the rules of its sub-chains in place of the gotos.
+func (t *Table) unsplitRules(chainName string) []Rule {
+	chain := t.chainNameToChain[chainName]
+	subChains := t.chainToSubChains[chainName]
+	if len(subChains) == 0 {
+		return append([]Rule(nil), chain.Rules...)
+	}
+	var rules []Rule
+	rules = append(rules, chain.Rules[:len(chain.Rules)-1]...)
+	for i, name := range subChains {
+		subRules := t.chainNameToChain[name].Rules
+		if i < len(subChains)-1 {
+			subRules = subRules[:len(subRules)-1]
+		}
+		rules = append(rules, subRules...)
+	}
+	return rules
+}
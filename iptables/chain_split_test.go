@@ -0,0 +1,167 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables_test
+
+import (
+	"fmt"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/projectcalico/felix/iptables"
+	"github.com/projectcalico/libcalico-go/lib/set"
+)
+
+var _ = Describe("Table chain splitting", func() {
+	var dataplane *mockDataplane
+	var table *Table
+
+	// cidrRules returns n rules that each match a different CIDR.
+	cidrRules := func(first, n int) []Rule {
+		var rules []Rule
+		for i := first; i < first+n; i++ {
+			rules = append(rules, Rule{
+				Match:  Match().SourceNet(fmt.Sprintf("10.0.%d.%d/32", i/256, i%256)),
+				Action: AcceptAction{},
+			})
+		}
+		return rules
+	}
+
+	BeforeEach(func() {
+		dataplane = newMockDataplane("filter", map[string][]string{
+			"FORWARD": {},
+			"INPUT":   {},
+			"OUTPUT":  {},
+		})
+		table = dataplane.newTable(func(options *TableOptions) {
+			options.MaxRulesPerChain = 4
+		})
+	})
+
+	It("should leave short chains alone", func() {
+		table.UpdateChain(&Chain{Name: "cali-short", Rules: cidrRules(0, 4)})
+		table.Apply()
+		Expect(dataplane.Chains["cali-short"]).To(HaveLen(4))
+		Expect(dataplane.Chains).NotTo(HaveKey("cali-short-s1"))
+	})
+
+	Describe("with a long chain", func() {
+		BeforeEach(func() {
+			table.UpdateChain(&Chain{Name: "cali-long", Rules: cidrRules(0, 10)})
+			table.Apply()
+		})
+
+		It("should split it into linked sub-chains", func() {
+			Expect(dataplane.Chains["cali-long"]).To(HaveLen(4))
+			Expect(dataplane.Chains["cali-long"][3]).To(HaveSuffix("--goto cali-long-s1"))
+			Expect(dataplane.Chains["cali-long-s1"]).To(HaveLen(4))
+			Expect(dataplane.Chains["cali-long-s1"][3]).To(HaveSuffix("--goto cali-long-s2"))
+			Expect(dataplane.Chains["cali-long-s2"]).To(HaveLen(4))
+			Expect(dataplane.Chains["cali-long-s2"][0]).To(ContainSubstring("10.0.0.6/32"))
+			Expect(dataplane.Chains["cali-long-s2"][3]).To(ContainSubstring("10.0.0.9/32"))
+		})
+
+		It("should only rewrite the sub-chains that change", func() {
+			rules := cidrRules(0, 10)
+			rules[8] = cidrRules(100, 1)[0]
+			table.UpdateChain(&Chain{Name: "cali-long", Rules: rules})
+			dataplane.ChainMods = set.New()
+			table.Apply()
+			Expect(dataplane.ChainMods.Contains(chainMod{name: "cali-long-s2", ruleNum: 3})).To(BeTrue())
+			Expect(dataplane.ChainMods.Contains(chainMod{name: "cali-long", ruleNum: 1})).To(BeFalse())
+			Expect(dataplane.Chains["cali-long-s2"][2]).To(ContainSubstring("10.0.0.100/32"))
+		})
+
+		It("should remove sub-chains that are no longer needed", func() {
+			table.UpdateChain(&Chain{Name: "cali-long", Rules: cidrRules(0, 5)})
+			table.Apply()
+			Expect(dataplane.Chains).To(HaveKey("cali-long-s1"))
+			Expect(dataplane.Chains).NotTo(HaveKey("cali-long-s2"))
+			Expect(dataplane.Chains["cali-long-s1"]).To(HaveLen(2))
+		})
+
+		It("should remove the sub-chains along with the chain", func() {
+			table.RemoveChainByName("cali-long")
+			table.Apply()
+			Expect(dataplane.Chains).NotTo(HaveKey("cali-long"))
+			Expect(dataplane.Chains).NotTo(HaveKey("cali-long-s1"))
+			Expect(dataplane.Chains).NotTo(HaveKey("cali-long-s2"))
+		})
+
+		It("should append to the last sub-chain", func() {
+			table.AppendToChain("cali-long", cidrRules(10, 2))
+			table.Apply()
+			Expect(dataplane.Chains["cali-long-s2"]).To(HaveLen(4))
+			Expect(dataplane.Chains["cali-long-s2"][3]).To(HaveSuffix("--goto cali-long-s3"))
+			Expect(dataplane.Chains["cali-long-s3"]).To(HaveLen(3))
+			Expect(dataplane.Chains["cali-long-s3"][2]).To(ContainSubstring("10.0.0.11/32"))
+		})
+
+		It("should split a chain that grows by appending", func() {
+			table.UpdateChain(&Chain{Name: "cali-grow", Rules: cidrRules(0, 3)})
+			table.AppendToChain("cali-grow", cidrRules(3, 2))
+			table.Apply()
+			Expect(dataplane.Chains["cali-grow"]).To(HaveLen(4))
+			Expect(dataplane.Chains["cali-grow-s1"]).To(HaveLen(2))
+		})
+
+		It("should roll back to a checkpoint from before the split", func() {
+			table.RemoveChainByName("cali-long")
+			table.Apply()
+			cp := table.Checkpoint()
+			table.UpdateChain(&Chain{Name: "cali-long", Rules: cidrRules(0, 10)})
+			table.Rollback(cp)
+			table.Apply()
+			Expect(dataplane.Chains).NotTo(HaveKey("cali-long"))
+			Expect(dataplane.Chains).NotTo(HaveKey("cali-long-s1"))
+		})
+	})
+
+	It("should shorten long names to make room for the suffix", func() {
+		name := "cali-pi-_0123456789abcdefghi"
+		Expect(len(name)).To(Equal(MaxChainNameLength))
+		table.UpdateChain(&Chain{Name: name, Rules: cidrRules(0, 5)})
+		table.Apply()
+		gotoRule := dataplane.Chains[name][3]
+		subChain := gotoRule[strings.LastIndex(gotoRule, " ")+1:]
+		Expect(subChain).To(HavePrefix("cali-pi-_01234_"))
+		Expect(subChain).To(HaveSuffix("-s1"))
+		Expect(len(subChain)).To(Equal(MaxChainNameLength))
+		Expect(dataplane.Chains).To(HaveKey(subChain))
+	})
+
+	It("should give long names with the same prefix different sub-chains", func() {
+		table.UpdateChain(&Chain{Name: "cali-pi-default.policy-aaaa1", Rules: cidrRules(0, 5)})
+		table.UpdateChain(&Chain{Name: "cali-pi-default.policy-aaaa2", Rules: cidrRules(100, 5)})
+		table.Apply()
+		Expect(dataplane.Chains).To(HaveLen(3 + 4))
+		goto1 := dataplane.Chains["cali-pi-default.policy-aaaa1"][3]
+		goto2 := dataplane.Chains["cali-pi-default.policy-aaaa2"][3]
+		subChain1 := goto1[strings.LastIndex(goto1, " ")+1:]
+		subChain2 := goto2[strings.LastIndex(goto2, " ")+1:]
+		Expect(subChain1).NotTo(Equal(subChain2))
+		Expect(dataplane.Chains[subChain1][1]).To(ContainSubstring("10.0.0.4/32"))
+		Expect(dataplane.Chains[subChain2][1]).To(ContainSubstring("10.0.0.104/32"))
+	})
+
+	It("should panic if a sub-chain would clash with an existing chain", func() {
+		table.UpdateChain(&Chain{Name: "cali-long-s1", Rules: cidrRules(0, 1)})
+		Expect(func() {
+			table.UpdateChain(&Chain{Name: "cali-long", Rules: cidrRules(0, 5)})
+		}).To(Panic())
+	})
+})
@@ -0,0 +1,184 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"reflect"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Checkpoint records the desired state of a Table, as set by UpdateChain, AppendToChain,
+// RemoveChains, SetRuleInsertions(At), SetChainPolicy and SetTraceRules, so that a batch of
+// updates can be abandoned with Rollback.  It doesn't record the dataplane state.
+type Checkpoint struct {
+	table *Table
+	// chains maps from chain name to the Chain that the Table held and its rules at the time
+	// of the checkpoint.  The rules slice is capped so that later appends to the chain don't
+	// show through.
+	chains          map[string]checkpointChain
+	subChains       map[string][]string
+	inserts         map[string][]Rule
+	insertPositions map[string]int
+	insertAnchors   map[string]*insertAnchor
+	policies        map[string]string
+	traceRules      map[string][]Rule
+}
+
+type checkpointChain struct {
+	chain *Chain
+	rules []Rule
+}
+
+// Checkpoint returns a Checkpoint of the Table's current desired state.  It is cheap: it
+// copies the Table's maps but not the chains' rules, which the Table never modifies in place.
+func (t *Table) Checkpoint() *Checkpoint {
+	t.opLock.Lock()
+	defer t.opLock.Unlock()
+
+	cp := &Checkpoint{
+		table:           t,
+		chains:          make(map[string]checkpointChain, len(t.chainNameToChain)),
+		subChains:       make(map[string][]string, len(t.chainToSubChains)),
+		inserts:         make(map[string][]Rule, len(t.chainToRequestedInserts)),
+		insertPositions: make(map[string]int, len(t.chainToInsertPosition)),
+		insertAnchors:   make(map[string]*insertAnchor, len(t.chainToInsertAnchor)),
+		policies:        make(map[string]string, len(t.chainToPolicy)),
+		traceRules:      make(map[string][]Rule, len(t.chainToTraceRules)),
+	}
+	for name, chain := range t.chainNameToChain {
+		n := len(chain.Rules)
+		cp.chains[name] = checkpointChain{chain: chain, rules: chain.Rules[:n:n]}
+	}
+	for name, subChains := range t.chainToSubChains {
+		cp.subChains[name] = subChains
+	}
+	for name, rules := range t.chainToRequestedInserts {
+		cp.inserts[name] = rules
+	}
+	for name, pos := range t.chainToInsertPosition {
+		cp.insertPositions[name] = pos
+	}
+	for name, anchor := range t.chainToInsertAnchor {
+		cp.insertAnchors[name] = anchor
+	}
+	for name, policy := range t.chainToPolicy {
+		cp.policies[name] = policy
+	}
+	for name, rules := range t.chainToTraceRules {
+		cp.traceRules[name] = rules
+	}
+	return cp
+}
+
+// Rollback restores the desired state that was recorded by the given Checkpoint, queueing
+// updates for the chains, inserts and policies that have changed since.  Like the updates
+// that it reverts, it only takes effect in the dataplane on the next Apply().  A Checkpoint
+// can be rolled back to more than once.  Panics if the Checkpoint is for a different Table.
+func (t *Table) Rollback(cp *Checkpoint) {
+	if cp.table != t {
+		t.logCxt.Panic("Rollback called with another table's checkpoint")
+	}
+	t.opLock.Lock()
+	defer t.opLock.Unlock()
+	t.logCxt.Info("Rolling back to checkpoint")
+
+	// Chains.  UpdateChain always stores a new Chain and AppendToChain only adds rules so the
+	// chain is unchanged if it's the same Chain with the same number of rules.  Split chains'
+	// sub-chains are recorded as chains in their own right so they're restored like any other.
+	for name := range t.chainNameToChain {
+		if _, ok := cp.chains[name]; !ok {
+			t.removeChainByName(name)
+		}
+	}
+	for name, c := range cp.chains {
+		if chain := t.chainNameToChain[name]; chain == c.chain && len(chain.Rules) == len(c.rules) {
+			continue
+		}
+		t.updateChain(&Chain{Name: name, Rules: c.rules})
+	}
+	t.chainToSubChains = make(map[string][]string, len(cp.subChains))
+	for name, subChains := range cp.subChains {
+		t.chainToSubChains[name] = subChains
+	}
+
+	// Inserts and trace rules.
+	insertChains := map[string]bool{}
+	for name := range t.chainToRequestedInserts {
+		insertChains[name] = true
+	}
+	for name := range t.chainToTraceRules {
+		insertChains[name] = true
+	}
+	for name := range cp.inserts {
+		insertChains[name] = true
+	}
+	for name := range cp.traceRules {
+		insertChains[name] = true
+	}
+	for name := range insertChains {
+		oldPos, oldHasPos := cp.insertPositions[name]
+		pos, hasPos := t.chainToInsertPosition[name]
+		oldAnchor, oldHasAnchor := cp.insertAnchors[name]
+		if oldPos == pos && oldHasPos == hasPos && oldAnchor == t.chainToInsertAnchor[name] &&
+			reflect.DeepEqual(cp.inserts[name], t.chainToRequestedInserts[name]) &&
+			reflect.DeepEqual(cp.traceRules[name], t.chainToTraceRules[name]) {
+			continue
+		}
+		t.logCxt.WithField("chainName", name).Debug("Rolling back rule insertions")
+		if oldHasPos {
+			t.chainToInsertPosition[name] = oldPos
+		} else {
+			delete(t.chainToInsertPosition, name)
+		}
+		if oldHasAnchor {
+			t.chainToInsertAnchor[name] = oldAnchor
+		} else {
+			delete(t.chainToInsertAnchor, name)
+		}
+		if rules, ok := cp.inserts[name]; ok {
+			t.chainToRequestedInserts[name] = rules
+		} else {
+			delete(t.chainToRequestedInserts, name)
+		}
+		if rules, ok := cp.traceRules[name]; ok {
+			t.chainToTraceRules[name] = rules
+		} else {
+			delete(t.chainToTraceRules, name)
+		}
+		t.updateInsertedRules(name, "rollback")
+	}
+
+	// Kernel chain policies.
+	for name := range t.chainToPolicy {
+		if _, ok := cp.policies[name]; !ok {
+			t.logCxt.WithField("chainName", name).Info("No longer managing chain policy")
+			delete(t.chainToPolicy, name)
+			t.dirtyPolicies.Discard(name)
+		}
+	}
+	for name, policy := range cp.policies {
+		if t.chainToPolicy[name] == policy {
+			continue
+		}
+		t.logCxt.WithFields(log.Fields{
+			"chainName": name,
+			"policy":    policy,
+		}).Info("Rolling back chain policy")
+		t.chainToPolicy[name] = policy
+		t.dirtyPolicies.Add(name)
+		t.noteUpdate()
+	}
+}
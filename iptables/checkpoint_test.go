@@ -0,0 +1,115 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/projectcalico/felix/iptables"
+)
+
+var _ = Describe("Table checkpoints", func() {
+	var dataplane *mockDataplane
+	var table *Table
+	var cp *Checkpoint
+	var initialChains map[string][]string
+
+	BeforeEach(func() {
+		dataplane = newMockDataplane("filter", map[string][]string{
+			"FORWARD": {},
+			"INPUT":   {},
+			"OUTPUT":  {},
+		})
+		table = dataplane.newTable(nil)
+		table.SetRuleInsertions("FORWARD", []Rule{{Action: JumpAction{Target: "cali-FORWARD"}}})
+		table.UpdateChain(&Chain{
+			Name:  "cali-FORWARD",
+			Rules: []Rule{{Action: JumpAction{Target: "cali-a"}}},
+		})
+		table.UpdateChain(&Chain{
+			Name:  "cali-a",
+			Rules: []Rule{{Action: AcceptAction{}}},
+		})
+		table.Apply()
+		cp = table.Checkpoint()
+		dataplane.ResetCmds()
+		initialChains = map[string][]string{}
+		for name, rules := range dataplane.Chains {
+			initialChains[name] = append([]string{}, rules...)
+		}
+	})
+
+	expectInitialState := func() {
+		Expect(dataplane.Chains).To(Equal(initialChains))
+		Expect(dataplane.Policies["FORWARD"]).NotTo(Equal(PolicyDrop))
+	}
+
+	It("should do nothing if there are no updates", func() {
+		table.Rollback(cp)
+		table.Apply()
+		Expect(dataplane.CmdNames).To(BeEmpty())
+		expectInitialState()
+	})
+
+	It("should abandon a batch of updates", func() {
+		table.UpdateChain(&Chain{
+			Name:  "cali-FORWARD",
+			Rules: []Rule{{Action: JumpAction{Target: "cali-b"}}},
+		})
+		table.UpdateChain(&Chain{
+			Name:  "cali-b",
+			Rules: []Rule{{Action: DropAction{}}},
+		})
+		table.AppendToChain("cali-a", []Rule{{Action: DropAction{}}})
+		table.SetRuleInsertions("FORWARD", nil)
+		table.SetChainPolicy("FORWARD", PolicyDrop)
+		table.Rollback(cp)
+		table.Apply()
+		expectInitialState()
+	})
+
+	It("should revert updates that were already applied", func() {
+		table.RemoveChainByName("cali-a")
+		table.UpdateChain(&Chain{
+			Name:  "cali-FORWARD",
+			Rules: []Rule{{Action: DropAction{}}},
+		})
+		table.SetRuleInsertionsAt("FORWARD", 1, []Rule{{Action: DropAction{}}})
+		table.Apply()
+		Expect(dataplane.Chains).NotTo(HaveKey("cali-a"))
+
+		table.Rollback(cp)
+		table.Apply()
+		expectInitialState()
+	})
+
+	It("should allow rolling back to the same checkpoint twice", func() {
+		table.AppendToChain("cali-a", []Rule{{Action: DropAction{}}})
+		table.Rollback(cp)
+		table.AppendToChain("cali-a", []Rule{{Action: DropAction{}}, {Action: DropAction{}}})
+		table.Apply()
+		Expect(dataplane.Chains["cali-a"]).To(HaveLen(3))
+
+		table.Rollback(cp)
+		table.Apply()
+		expectInitialState()
+	})
+
+	It("should panic if given another table's checkpoint", func() {
+		other := dataplane.newTable(nil)
+		Expect(func() { other.Rollback(cp) }).To(Panic())
+	})
+})
@@ -0,0 +1,97 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"context"
+	"sort"
+	"time"
+)
+
+// CleanupAll removes all of our state from the table.  It forgets the desired state that the
+// Table was given and then, in a single iptables-restore transaction (unless
+// TableOptions.MaxLinesPerRestore splits it), it removes our inserted rules from all chains,
+// including those left behind by older versions of Felix, and deletes all of our chains,
+// including any that we weren't asked to program.  The changes are made immediately, ignoring
+// any coalesce window or unknown chain grace period.  Kernel chain policies that we manage are
+// reset to ACCEPT and then left alone.  Unmanaged chains are left as they are, as are the
+// inserts if another agent owns them (see TableOptions.InsertOwner).
+//
+// It is intended for an uninstall command or for a mode in which Calico policy is disabled;
+// the Table can be given new state afterwards.  Errors are as for ApplyContext; after an error,
+// the remaining updates stay queued for the next Apply().
+func (t *Table) CleanupAll() error {
+	t.opLock.Lock()
+	defer t.opLock.Unlock()
+	return t.cleanupAll(context.Background())
+}
+
+func (t *Table) cleanupAll(ctx context.Context) error {
+	t.logCxt.Info("Removing all of our state from the table")
+
+	// Chains.  Removing the parents also removes any split chains' sub-chains.
+	chainNames := make([]string, 0, len(t.chainNameToChain))
+	for name := range t.chainNameToChain {
+		chainNames = append(chainNames, name)
+	}
+	sort.Strings(chainNames)
+	for _, name := range chainNames {
+		t.removeSplitChain(name)
+	}
+	t.chainRenames = map[string]string{}
+
+	// Inserts.  We keep an empty entry for each chain so that resync keeps checking that the
+	// inserts stay gone.
+	for name := range t.chainToInsertedRules {
+		delete(t.chainToRequestedInserts, name)
+		delete(t.chainToTraceRules, name)
+		delete(t.chainToInsertPosition, name)
+		delete(t.chainToInsertAnchor, name)
+		t.updateInsertedRules(name, "cleanup")
+	}
+
+	// Policies.  We write ACCEPT, which is the kernel's default, as part of the cleanup
+	// transaction and then stop managing the policies.
+	for name, policy := range t.chainToPolicy {
+		if policy == PolicyAccept {
+			delete(t.chainToPolicy, name)
+			t.dirtyPolicies.Discard(name)
+			continue
+		}
+		t.chainToPolicy[name] = PolicyAccept
+		t.dirtyPolicies.Add(name)
+	}
+
+	// Reload the dataplane state so that we find (and remove) any chains and inserts that we
+	// weren't told about.  Forgetting our previous picture of the dataplane makes the reload
+	// treat every chain as new, so that it checks all of them for our rules.  Our chains are
+	// normally given a grace period before we remove them; skip that for the cleanup.
+	t.invalidateDataplaneCache("cleanup")
+	t.chainToDataplaneHashes = map[string][]string{}
+	t.unknownChainFirstSeen = map[string]time.Time{}
+	gracePeriod := t.unknownChainGracePeriod
+	t.unknownChainGracePeriod = 0
+	defer func() {
+		t.unknownChainGracePeriod = gracePeriod
+	}()
+
+	if _, err := t.apply(ctx, true); err != nil {
+		return err
+	}
+	for name := range t.chainToPolicy {
+		delete(t.chainToPolicy, name)
+	}
+	return nil
+}
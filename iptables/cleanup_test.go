@@ -0,0 +1,126 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables_test
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/projectcalico/felix/iptables"
+)
+
+var _ = Describe("Table CleanupAll", func() {
+	var dataplane *mockDataplane
+	var table *Table
+
+	BeforeEach(func() {
+		dataplane = newMockDataplane("filter", map[string][]string{
+			"FORWARD": {
+				"-m comment --comment \"foreign\" -j ACCEPT",
+				"-j felix-FORWARD",
+			},
+			"INPUT":  {},
+			"OUTPUT": {},
+			"felix-FORWARD": {
+				"-j ACCEPT",
+			},
+			"cali-stale": {
+				"-m comment --comment \"cali:abcdefghij1234-_\" -j ACCEPT",
+			},
+			"other": {
+				"-j ACCEPT",
+			},
+		})
+		dataplane.Policies = map[string]string{
+			"FORWARD": "ACCEPT",
+			"INPUT":   "ACCEPT",
+			"OUTPUT":  "ACCEPT",
+		}
+		table = dataplane.newTable(func(options *TableOptions) {
+			options.HistoricChainPrefixes = []string{"cali-", "felix-"}
+			options.ReturnErrorOnFailure = true
+			options.UnknownChainGracePeriod = time.Minute
+		})
+		table.SetRuleInsertions("FORWARD", []Rule{
+			{Action: JumpAction{Target: "cali-FORWARD"}},
+		})
+		table.SetRuleInsertions("INPUT", []Rule{
+			{Action: JumpAction{Target: "cali-INPUT"}},
+		})
+		table.UpdateChains([]*Chain{
+			{Name: "cali-FORWARD", Rules: []Rule{{Action: JumpAction{Target: "cali-foo"}}}},
+			{Name: "cali-INPUT", Rules: []Rule{{Action: DropAction{}}}},
+			{Name: "cali-foo", Rules: []Rule{{Action: AcceptAction{}}}},
+		})
+		table.SetChainPolicy("FORWARD", PolicyDrop)
+		table.Apply()
+		Expect(dataplane.Chains).To(HaveKey("cali-FORWARD"))
+		Expect(dataplane.Chains).To(HaveKey("cali-stale"))
+		Expect(dataplane.Policies["FORWARD"]).To(Equal("DROP"))
+	})
+
+	It("should remove all of our state in one restore", func() {
+		dataplane.ResetCmds()
+		Expect(table.CleanupAll()).To(Succeed())
+
+		Expect(dataplane.CmdNames).To(Equal([]string{"iptables-save", "iptables-restore"}))
+		Expect(dataplane.Chains).To(Equal(map[string][]string{
+			"FORWARD": {"-m comment --comment \"foreign\" -j ACCEPT"},
+			"INPUT":   {},
+			"OUTPUT":  {},
+			"other":   {"-j ACCEPT"},
+		}))
+		Expect(dataplane.Policies["FORWARD"]).To(Equal("ACCEPT"))
+	})
+
+	It("should stop managing the chain policies", func() {
+		Expect(table.CleanupAll()).To(Succeed())
+		dataplane.Policies["FORWARD"] = "DROP"
+		table.InvalidateDataplaneCache("test")
+		table.Apply()
+		Expect(dataplane.Policies["FORWARD"]).To(Equal("DROP"))
+	})
+
+	It("should keep our inserts out after the cleanup", func() {
+		Expect(table.CleanupAll()).To(Succeed())
+		dataplane.Chains["INPUT"] = append(dataplane.Chains["INPUT"],
+			"-m comment --comment \"cali:abcdefghij1234-_\" -j ACCEPT")
+		table.InvalidateDataplaneCache("test")
+		table.Apply()
+		Expect(dataplane.Chains["INPUT"]).To(BeEmpty())
+	})
+
+	It("should accept new state after the cleanup", func() {
+		Expect(table.CleanupAll()).To(Succeed())
+		table.UpdateChain(&Chain{Name: "cali-foo", Rules: []Rule{{Action: DropAction{}}}})
+		table.Apply()
+		Expect(dataplane.Chains).To(HaveKey("cali-foo"))
+	})
+
+	It("should return an error and keep the updates queued if the restore fails", func() {
+		dataplane.FailAllRestores = true
+		Expect(table.CleanupAll()).To(HaveOccurred())
+		Expect(dataplane.Chains).To(HaveKey("cali-FORWARD"))
+
+		dataplane.FailAllRestores = false
+		table.Apply()
+		Expect(dataplane.Chains).NotTo(HaveKey("cali-FORWARD"))
+		Expect(dataplane.Chains["FORWARD"]).To(Equal([]string{
+			"-m comment --comment \"foreign\" -j ACCEPT",
+		}))
+	})
+})
@@ -0,0 +1,122 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables_test
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/projectcalico/felix/iptables"
+)
+
+var _ = Describe("Table update coalescing", func() {
+	var dataplane *mockDataplane
+	var table *Table
+
+	newTable := func(window time.Duration) {
+		table = dataplane.newTable(func(options *TableOptions) {
+			options.CoalesceWindow = window
+		})
+	}
+
+	numRestores := func() int {
+		n := 0
+		for _, name := range dataplane.CmdNames {
+			if name == "iptables-restore" {
+				n++
+			}
+		}
+		return n
+	}
+
+	BeforeEach(func() {
+		dataplane = newMockDataplane("filter", map[string][]string{
+			"FORWARD": {},
+			"INPUT":   {},
+			"OUTPUT":  {},
+		})
+	})
+
+	Describe("with a 100ms window", func() {
+		BeforeEach(func() {
+			newTable(100 * time.Millisecond)
+			table.UpdateChain(&Chain{Name: "cali-foo", Rules: []Rule{{Action: DropAction{}}}})
+		})
+
+		It("should hold back the first update until the window expires", func() {
+			rescheduleAfter, err := table.ApplyContext(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(rescheduleAfter).To(Equal(100 * time.Millisecond))
+			Expect(dataplane.CmdNames).To(BeEmpty())
+			Expect(dataplane.Chains).NotTo(HaveKey("cali-foo"))
+		})
+
+		It("should batch updates within the window into one restore", func() {
+			dataplane.AdvanceTimeBy(50 * time.Millisecond)
+			table.UpdateChain(&Chain{Name: "cali-bar", Rules: []Rule{{Action: AcceptAction{}}}})
+			table.SetRuleInsertions("FORWARD", []Rule{{Action: JumpAction{Target: "cali-foo"}}})
+			rescheduleAfter, err := table.ApplyContext(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(rescheduleAfter).To(Equal(50 * time.Millisecond))
+			Expect(numRestores()).To(Equal(0))
+
+			dataplane.AdvanceTimeBy(50 * time.Millisecond)
+			_, err = table.ApplyContext(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(numRestores()).To(Equal(1))
+			Expect(dataplane.Chains["cali-foo"]).To(HaveLen(1))
+			Expect(dataplane.Chains["cali-bar"]).To(HaveLen(1))
+			Expect(dataplane.Chains["FORWARD"]).To(HaveLen(1))
+		})
+
+		It("should start a new window for updates after a write", func() {
+			dataplane.AdvanceTimeBy(100 * time.Millisecond)
+			_, err := table.ApplyContext(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(numRestores()).To(Equal(1))
+
+			dataplane.AdvanceTimeBy(time.Second)
+			table.UpdateChain(&Chain{Name: "cali-bar", Rules: []Rule{{Action: AcceptAction{}}}})
+			rescheduleAfter, err := table.ApplyContext(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(rescheduleAfter).To(Equal(100 * time.Millisecond))
+			Expect(numRestores()).To(Equal(1))
+		})
+
+		It("should write immediately on Flush", func() {
+			_, err := table.Flush(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(numRestores()).To(Equal(1))
+			Expect(dataplane.Chains["cali-foo"]).To(HaveLen(1))
+
+			// Nothing left pending so a normal apply shouldn't be held back.
+			rescheduleAfter, err := table.ApplyContext(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(rescheduleAfter).NotTo(Equal(100 * time.Millisecond))
+		})
+	})
+
+	It("should write immediately with coalescing disabled", func() {
+		newTable(0)
+		table.UpdateChain(&Chain{Name: "cali-foo", Rules: []Rule{{Action: DropAction{}}}})
+		_, err := table.ApplyContext(context.Background())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(numRestores()).To(Equal(1))
+		Expect(dataplane.Chains["cali-foo"]).To(HaveLen(1))
+	})
+})
@@ -0,0 +1,224 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// matchNothingRegexp is used in place of an empty alternation, which would match everything.
+var matchNothingRegexp = regexp.MustCompile(`a^`)
+
+// CleanupStrategy says what the Table should clean up for a legacy chain name prefix.
+type CleanupStrategy int
+
+const (
+	// CleanupChainsAndJumps treats chains with the prefix as ours, deleting any that we haven't
+	// been asked to program, and removes rules that jump to such chains from other chains.
+	CleanupChainsAndJumps CleanupStrategy = iota
+	// CleanupChainsOnly treats chains with the prefix as ours but leaves rules that jump to
+	// them alone.  Useful if the prefix is short enough that the jump pattern would match
+	// other processes' rules.
+	CleanupChainsOnly
+	// CleanupJumpsOnly removes rules that jump to chains with the prefix but otherwise leaves
+	// the chains alone.
+	CleanupJumpsOnly
+)
+
+func (s CleanupStrategy) String() string {
+	switch s {
+	case CleanupChainsAndJumps:
+		return "chains-and-jumps"
+	case CleanupChainsOnly:
+		return "chains-only"
+	case CleanupJumpsOnly:
+		return "jumps-only"
+	}
+	return fmt.Sprintf("CleanupStrategy(%d)", int(s))
+}
+
+func (s CleanupStrategy) cleansChains() bool {
+	return s == CleanupChainsAndJumps || s == CleanupChainsOnly
+}
+
+func (s CleanupStrategy) cleansJumps() bool {
+	return s == CleanupChainsAndJumps || s == CleanupJumpsOnly
+}
+
+// LegacyChainPrefix describes a chain name prefix that this, or an earlier, version of Felix
+// used.
+type LegacyChainPrefix struct {
+	// Prefix is the literal chain name prefix, for example, "cali-".
+	Prefix string
+	// Since and Until give the range of versions that used the prefix; Until is the first
+	// version that no longer used it.  Either may be empty if the range is open-ended.  They
+	// are only used for logging.
+	Since, Until string
+	// Cleanup says what to clean up.
+	Cleanup CleanupStrategy
+}
+
+func (p LegacyChainPrefix) versions() string {
+	return fmt.Sprintf("[%s, %s)", p.Since, p.Until)
+}
+
+// LegacyRule describes a rule that an earlier version of Felix inserted into a chain that we
+// don't own.  Matching rules are removed.
+type LegacyRule struct {
+	// Table restricts the pattern to one table, for example, "nat".  Empty for all tables.
+	Table string
+	// Pattern is a regular expression that matches the rule as printed by iptables-save,
+	// including the leading "-A <chain>".
+	Pattern string
+	// Since and Until give the range of versions that inserted the rule, as for
+	// LegacyChainPrefix.
+	Since, Until string
+}
+
+// CompatTable lists the chain name prefixes and inserted rules that current and previous
+// versions of Felix used, so that the Table can clean them up.
+type CompatTable struct {
+	ChainPrefixes []LegacyChainPrefix
+	Rules         []LegacyRule
+}
+
+// CompatTableFromPrefixes converts a flat list of chain name prefixes, as used by
+// TableOptions.HistoricChainPrefixes, into a CompatTable that cleans up chains and jumps for
+// each prefix.
+func CompatTableFromPrefixes(prefixes []string) *CompatTable {
+	c := &CompatTable{}
+	for _, prefix := range prefixes {
+		c.ChainPrefixes = append(c.ChainPrefixes, LegacyChainPrefix{Prefix: prefix})
+	}
+	return c
+}
+
+// Copy returns a deep copy of the CompatTable.
+func (c *CompatTable) Copy() *CompatTable {
+	return &CompatTable{
+		ChainPrefixes: append([]LegacyChainPrefix(nil), c.ChainPrefixes...),
+		Rules:         append([]LegacyRule(nil), c.Rules...),
+	}
+}
+
+// Prefixes returns the chain name prefixes in the table, in order.
+func (c *CompatTable) Prefixes() []string {
+	prefixes := make([]string, 0, len(c.ChainPrefixes))
+	for _, p := range c.ChainPrefixes {
+		prefixes = append(prefixes, p.Prefix)
+	}
+	return prefixes
+}
+
+// compileCompatRegexps calculates the regexps that the Table uses to recognise our chains and
+// legacy inserts in the given iptables table.  Panics if one of the rule patterns is invalid.
+func compileCompatRegexps(tableName string, c *CompatTable) (ourChains, oldInserts *regexp.Regexp) {
+	ourChainParts := []string{}
+	oldInsertParts := []string{}
+	for _, p := range c.ChainPrefixes {
+		if p.Prefix == "" {
+			log.WithField("versions", p.versions()).Warn("Ignoring empty legacy chain prefix")
+			continue
+		}
+		quoted := regexp.QuoteMeta(p.Prefix)
+		if p.Cleanup.cleansChains() {
+			ourChainParts = append(ourChainParts, quoted)
+		}
+		if p.Cleanup.cleansJumps() {
+			oldInsertParts = append(oldInsertParts, fmt.Sprintf("(?:-j|--jump) %s", quoted))
+		}
+	}
+	for _, r := range c.Rules {
+		if r.Table != "" && r.Table != tableName {
+			continue
+		}
+		oldInsertParts = append(oldInsertParts, "(?:"+r.Pattern+")")
+	}
+	ourChains, oldInserts = matchNothingRegexp, matchNothingRegexp
+	if len(ourChainParts) > 0 {
+		ourChains = regexp.MustCompile("^(" + strings.Join(ourChainParts, "|") + ")")
+	}
+	if len(oldInsertParts) > 0 {
+		oldInserts = regexp.MustCompile(strings.Join(oldInsertParts, "|"))
+	}
+	return
+}
+
+// RegisterLegacyChainPrefix adds a legacy chain name prefix to the Table's compat table.  The
+// next Apply() re-reads the dataplane and cleans up according to the new table.
+func (t *Table) RegisterLegacyChainPrefix(prefix LegacyChainPrefix) {
+	t.opLock.Lock()
+	defer t.opLock.Unlock()
+
+	t.compat.ChainPrefixes = append(t.compat.ChainPrefixes, prefix)
+	t.recompileCompat()
+	t.logCxt.WithFields(log.Fields{
+		"prefix":   prefix.Prefix,
+		"versions": prefix.versions(),
+		"cleanup":  prefix.Cleanup,
+	}).Info("Registered legacy chain prefix")
+}
+
+// RegisterLegacyRule adds a legacy inserted rule to the Table's compat table.  Returns an error,
+// without changing the table, if the rule's pattern is not a valid regular expression.
+func (t *Table) RegisterLegacyRule(rule LegacyRule) error {
+	if _, err := regexp.Compile(rule.Pattern); err != nil {
+		return err
+	}
+
+	t.opLock.Lock()
+	defer t.opLock.Unlock()
+
+	t.compat.Rules = append(t.compat.Rules, rule)
+	t.recompileCompat()
+	t.logCxt.WithFields(log.Fields{
+		"pattern":   rule.Pattern,
+		"ruleTable": rule.Table,
+	}).Info("Registered legacy rule")
+	return nil
+}
+
+func (t *Table) recompileCompat() {
+	t.ourChainsRegexp, t.oldInsertRegexp = compileCompatRegexps(t.Name, t.compat)
+	// Forget the chains that we're neither programming nor inserting into so that the next
+	// load rescans them for unexpected chains and inserts under the new patterns.
+	for chainName := range t.chainToDataplaneHashes {
+		if _, ok := t.chainNameToChain[chainName]; ok {
+			continue
+		}
+		if _, ok := t.chainToInsertedRules[chainName]; ok {
+			continue
+		}
+		delete(t.chainToDataplaneHashes, chainName)
+	}
+	t.invalidateDataplaneCache("legacy patterns changed")
+}
+
+// legacyChainPrefix returns the entry for the given chain in the compat table, if any.
+func (t *Table) legacyChainPrefix(chainName string) (LegacyChainPrefix, bool) {
+	var best LegacyChainPrefix
+	found := false
+	for _, p := range t.compat.ChainPrefixes {
+		if p.Prefix != "" && strings.HasPrefix(chainName, p.Prefix) && len(p.Prefix) > len(best.Prefix) {
+			best = p
+			found = true
+		}
+	}
+	return best, found
+}
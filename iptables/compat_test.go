@@ -0,0 +1,117 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/projectcalico/felix/iptables"
+)
+
+var _ = Describe("Table legacy compat table", func() {
+	var dataplane *mockDataplane
+	var table *Table
+
+	newTable := func(compat *CompatTable) {
+		table = dataplane.newTable(func(options *TableOptions) {
+			options.HistoricChainPrefixes = nil
+			options.CompatTable = compat
+		})
+	}
+
+	BeforeEach(func() {
+		dataplane = newMockDataplane("filter", map[string][]string{
+			"FORWARD": {
+				"-j fork-old",
+				"-j vendor-old",
+				"-m comment --comment old-fork-marker -j ACCEPT",
+			},
+			"fork-old":   {"-j DROP"},
+			"vendor-old": {"-j DROP"},
+		})
+	})
+
+	It("should clean up chains and jumps for a prefix", func() {
+		newTable(&CompatTable{ChainPrefixes: []LegacyChainPrefix{
+			{Prefix: "cali-"},
+			{Prefix: "fork-", Until: "v1.0.0"},
+		}})
+		table.Apply()
+		Expect(dataplane.Chains).NotTo(HaveKey("fork-old"))
+		Expect(dataplane.Chains).To(HaveKey("vendor-old"))
+		Expect(dataplane.Chains["FORWARD"]).To(Equal([]string{
+			"-j vendor-old",
+			"-m comment --comment old-fork-marker -j ACCEPT",
+		}))
+	})
+
+	It("should only clean up jumps for a jumps-only prefix", func() {
+		newTable(&CompatTable{ChainPrefixes: []LegacyChainPrefix{
+			{Prefix: "fork-", Cleanup: CleanupJumpsOnly},
+		}})
+		table.Apply()
+		Expect(dataplane.Chains).To(HaveKey("fork-old"))
+		Expect(dataplane.Chains["FORWARD"]).NotTo(ContainElement("-j fork-old"))
+	})
+
+	It("should clean up legacy rules for the right table only", func() {
+		newTable(&CompatTable{Rules: []LegacyRule{
+			{Table: "filter", Pattern: `-A FORWARD .* old-fork-marker `},
+			{Table: "nat", Pattern: `-A FORWARD -j vendor-old`},
+		}})
+		table.Apply()
+		Expect(dataplane.Chains["FORWARD"]).To(Equal([]string{
+			"-j fork-old",
+			"-j vendor-old",
+		}))
+	})
+
+	It("should not modify the caller's compat table", func() {
+		compat := &CompatTable{ChainPrefixes: []LegacyChainPrefix{{Prefix: "cali-"}}}
+		newTable(compat)
+		table.RegisterLegacyChainPrefix(LegacyChainPrefix{Prefix: "fork-"})
+		Expect(compat.Prefixes()).To(Equal([]string{"cali-"}))
+	})
+
+	Describe("with entries registered at runtime", func() {
+		BeforeEach(func() {
+			newTable(CompatTableFromPrefixes([]string{"cali-"}))
+			table.Apply()
+			Expect(dataplane.Chains).To(HaveKey("fork-old"))
+			Expect(dataplane.Chains["FORWARD"]).To(HaveLen(3))
+		})
+
+		It("should clean up a registered prefix on the next Apply()", func() {
+			table.RegisterLegacyChainPrefix(LegacyChainPrefix{Prefix: "fork-", Since: "v0.1.0"})
+			table.Apply()
+			Expect(dataplane.Chains).NotTo(HaveKey("fork-old"))
+			Expect(dataplane.Chains["FORWARD"]).To(HaveLen(2))
+		})
+
+		It("should clean up a registered rule on the next Apply()", func() {
+			Expect(table.RegisterLegacyRule(LegacyRule{Pattern: `old-fork-marker`})).To(Succeed())
+			table.Apply()
+			Expect(dataplane.Chains["FORWARD"]).To(Equal([]string{
+				"-j fork-old",
+				"-j vendor-old",
+			}))
+		})
+
+		It("should reject an invalid rule pattern", func() {
+			Expect(table.RegisterLegacyRule(LegacyRule{Pattern: `(`})).NotTo(Succeed())
+		})
+	})
+})
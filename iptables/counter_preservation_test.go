@@ -0,0 +1,127 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/projectcalico/felix/iptables"
+)
+
+var _ = Describe("Table counter preservation", func() {
+	var dataplane *mockDataplane
+	var table *Table
+
+	newTable := func(backendMode string, preserve bool) {
+		dataplane = newMockDataplane("filter", map[string][]string{
+			"FORWARD": {},
+			"INPUT":   {},
+			"OUTPUT":  {},
+		})
+		table = dataplane.newTable(func(options *TableOptions) {
+			options.BackendMode = backendMode
+			options.PreserveCounters = preserve
+		})
+		table.SetRuleInsertions("FORWARD", []Rule{{Action: JumpAction{Target: "cali-foo"}}})
+		table.UpdateChain(&Chain{Name: "cali-foo", Rules: []Rule{
+			{Match: Match().Protocol("tcp"), Action: AcceptAction{}},
+			{Match: Match().Protocol("udp"), Action: AcceptAction{}},
+		}})
+		table.Apply()
+		dataplane.Counters = map[string]string{
+			dataplane.Chains["FORWARD"][0]:  "[9:900]",
+			dataplane.Chains["cali-foo"][0]: "[5:300]",
+			dataplane.Chains["cali-foo"][1]: "[7:420]",
+		}
+	}
+
+	numCounterReads := func() (n int) {
+		for _, cmd := range dataplane.Cmds {
+			if save, ok := cmd.(*saveCmd); ok && save.Counters {
+				n++
+			}
+		}
+		return
+	}
+
+	appendRule := func() {
+		table.UpdateChain(&Chain{Name: "cali-foo", Rules: []Rule{
+			{Match: Match().Protocol("tcp"), Action: AcceptAction{}},
+			{Match: Match().Protocol("udp"), Action: AcceptAction{}},
+			{Action: DropAction{}},
+		}})
+		table.Apply()
+		Expect(dataplane.Chains["cali-foo"]).To(HaveLen(3))
+	}
+
+	Describe("in nftables mode", func() {
+		BeforeEach(func() {
+			newTable("nft", true)
+		})
+
+		It("should restore the counters of rewritten rules", func() {
+			appendRule()
+			Expect(numCounterReads()).To(Equal(1))
+			Expect(dataplane.FlushedChains.Contains("cali-foo")).To(BeTrue())
+			chain := dataplane.Chains["cali-foo"]
+			Expect(dataplane.Counters[chain[0]]).To(Equal("[5:300]"))
+			Expect(dataplane.Counters[chain[1]]).To(Equal("[7:420]"))
+			Expect(dataplane.Counters).NotTo(HaveKey(chain[2]))
+		})
+
+		It("should restore the counters of re-inserted rules", func() {
+			ourRule := dataplane.Chains["FORWARD"][0]
+			dataplane.Chains["FORWARD"] = []string{"-j foreign", ourRule}
+			table.InvalidateDataplaneCache("test")
+			table.Apply()
+			Expect(dataplane.Chains["FORWARD"]).To(Equal([]string{ourRule, "-j foreign"}))
+			Expect(dataplane.Counters[ourRule]).To(Equal("[9:900]"))
+		})
+
+		It("should not read the counters if nothing is rewritten", func() {
+			dataplane.ResetCmds()
+			table.UpdateChain(&Chain{Name: "cali-bar", Rules: []Rule{{Action: DropAction{}}}})
+			table.Apply()
+			Expect(numCounterReads()).To(BeZero())
+		})
+	})
+
+	Describe("with counter preservation disabled", func() {
+		BeforeEach(func() {
+			newTable("nft", false)
+		})
+
+		It("should zero the counters of rewritten rules", func() {
+			dataplane.ResetCmds()
+			appendRule()
+			Expect(numCounterReads()).To(BeZero())
+			Expect(dataplane.Counters).NotTo(HaveKey(dataplane.Chains["cali-foo"][0]))
+		})
+	})
+
+	Describe("in legacy mode", func() {
+		BeforeEach(func() {
+			newTable("legacy", true)
+		})
+
+		It("should leave unchanged rules alone when appending", func() {
+			dataplane.ResetCmds()
+			appendRule()
+			Expect(numCounterReads()).To(BeZero())
+			Expect(dataplane.Counters[dataplane.Chains["cali-foo"][0]]).To(Equal("[5:300]"))
+		})
+	})
+})
@@ -0,0 +1,284 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/projectcalico/libcalico-go/lib/set"
+)
+
+var (
+	// counterAppendRegexp matches an iptables-save -c output line for an append operation,
+	// capturing the packet count, byte count and chain name.  For example:
+	// "[12:3456] -A cali-foo -m comment --comment "cali:abcd" -j ACCEPT"
+	counterAppendRegexp = regexp.MustCompile(`^\[(\d+):(\d+)\] -A (\S+)`)
+)
+
+// RuleCounters holds the kernel's packet and byte counters for a single rule.
+type RuleCounters struct {
+	Chain string
+	// RuleNum is the 1-based position of the rule in its chain at the time it was read.
+	RuleNum int
+	Packets uint64
+	Bytes   uint64
+}
+
+// ReadCounters runs iptables-save -c and returns the packet/byte counters of the rules that
+// we own in this table, indexed by rule hash.  Rules without one of our hashes are skipped.
+func (t *Table) ReadCounters() (map[string]RuleCounters, error) {
+	t.opLock.Lock()
+	defer t.opLock.Unlock()
+	return t.readCounters()
+}
+
+func (t *Table) readCounters() (map[string]RuleCounters, error) {
+	counters, _, err := t.readCountersAndChainLengths()
+	return counters, err
+}
+
+// readCountersAndChainLengths runs iptables-save -c and returns the counters of our rules along
+// with the number of rules (ours or not) in each chain.
+func (t *Table) readCountersAndChainLengths() (map[string]RuleCounters, map[string]int, error) {
+	if t.saveByListing {
+		return nil, nil, errCountersNeedSave
+	}
+	cmd := t.newCmd(t.iptablesSaveCmd, "-c", "-t", t.Name)
+	t.metrics.Add(MetricSaveCalls, 1)
+	output, err := cmd.Output()
+	if err != nil {
+		t.metrics.Add(MetricSaveErrors, 1)
+		t.logCxt.WithError(err).Warnf("%s -c command failed", t.iptablesSaveCmd)
+		return nil, nil, err
+	}
+	return t.readCountersFrom(bytes.NewReader(output))
+}
+
+// ReadAndZeroCounters reads the counters of the rules in our own chains and then zeros them so
+// that the next call returns only the packets and bytes seen in the interval between the two
+// calls.  This allows exact per-interval accounting without subtracting successive readings
+// (which goes wrong whenever a rule is rewritten and its counters reset).
+//
+// iptables-restore can't report counters so the read (iptables-save -c) and the zero are
+// separate commands.  To make sure that the zero can't hit a different rule from the one we
+// read, we zero whole chains rather than numbered rules and we only zero chains that contain
+// nothing but our rules.  Since only this Table writes to our chains, and we hold the opLock
+// throughout, such a chain can't change between the read and the zero.  Packets that hit a
+// rule between the read and the zero aren't counted in either interval, so the intervals are
+// only exact to within the time that it takes to run the two commands.
+//
+// Our rules in shared kernel chains and chains containing foreign rules can't be zeroed safely;
+// other processes can renumber them at any time.  Their counters aren't returned; instead, the
+// names of those chains are returned, sorted, as unzeroedChains so that the caller can fall back
+// to ReadCounters for them.
+//
+// Like the other Table methods, it must be called from the same goroutine as Apply() unless
+// TableOptions.ThreadSafe is set.
+func (t *Table) ReadAndZeroCounters() (counters map[string]RuleCounters, unzeroedChains []string, err error) {
+	t.opLock.Lock()
+	defer t.opLock.Unlock()
+	t.calicoXtablesLock.Lock()
+	defer t.calicoXtablesLock.Unlock()
+
+	counters, chainLengths, err := t.readCountersAndChainLengths()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Count our rules in each of our chains so we can skip chains that have foreign rules.
+	numOurRules := map[string]int{}
+	for _, c := range counters {
+		numOurRules[c.Chain]++
+	}
+	var chainsToZero []string
+	for chainName, n := range numOurRules {
+		if !t.ourChainsRegexp.MatchString(chainName) || n != chainLengths[chainName] {
+			unzeroedChains = append(unzeroedChains, chainName)
+			continue
+		}
+		chainsToZero = append(chainsToZero, chainName)
+	}
+	sort.Strings(unzeroedChains)
+	zeroable := set.FromArray(chainsToZero)
+	for hash, c := range counters {
+		if !zeroable.Contains(c.Chain) {
+			delete(counters, hash)
+		}
+	}
+	if len(chainsToZero) == 0 {
+		return counters, unzeroedChains, nil
+	}
+
+	// Sort for determinism (and to keep the restore input readable in the logs).
+	sort.Strings(chainsToZero)
+	var buf RestoreInputBuilder
+	buf.StartTransaction(t.Name)
+	for _, chainName := range chainsToZero {
+		buf.WriteLine(fmt.Sprintf("--zero %s", chainName))
+	}
+	buf.EndTransaction()
+	inputBytes := buf.GetBytesAndReset()
+
+	if t.restorePerRule {
+		features := t.featureDetector.GetFeatures()
+		if _, errOutput, err := t.runRestoreInputPerRule(context.Background(), features, inputBytes); err != nil {
+			t.logCxt.WithError(err).WithField("errorOutput", errOutput).Warn("Failed to zero counters")
+			return nil, nil, err
+		}
+		return counters, unzeroedChains, nil
+	}
+
+	var outputBuf, errBuf bytes.Buffer
+	cmd := t.newCmd(t.iptablesRestoreCmd, t.restoreArgs(t.featureDetector.GetFeatures())...)
+	cmd.SetStdin(bytes.NewReader(inputBytes))
+	cmd.SetStdout(&outputBuf)
+	cmd.SetStderr(&errBuf)
+	t.metrics.Add(MetricRestoreCalls, 1)
+	if err := cmd.Run(); err != nil {
+		t.logCxt.WithFields(log.Fields{
+			"output":      outputBuf.String(),
+			"errorOutput": errBuf.String(),
+			"error":       err,
+			"input":       string(inputBytes),
+		}).Warn("Failed to zero counters")
+		t.metrics.Add(MetricRestoreErrors, 1)
+		return nil, nil, err
+	}
+	return counters, unzeroedChains, nil
+}
+
+// readCountersFrom scans the given reader containing iptables-save -c output for this table,
+// extracting the counters of rules that have our hash comment and the length of each chain.
+func (t *Table) readCountersFrom(r io.Reader) (map[string]RuleCounters, map[string]int, error) {
+	counters := map[string]RuleCounters{}
+	chainToRuleNum := map[string]int{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		captures := counterAppendRegexp.FindSubmatch(line)
+		if captures == nil {
+			// Chain forward reference, comment or other non-rule line.
+			continue
+		}
+		chainName := string(captures[3])
+		chainToRuleNum[chainName]++
+		hash, ok := t.ruleHashFrom(line)
+		if !ok {
+			// Not one of our rules.
+			continue
+		}
+		packets, err := strconv.ParseUint(string(captures[1]), 10, 64)
+		if err != nil {
+			return nil, nil, err
+		}
+		numBytes, err := strconv.ParseUint(string(captures[2]), 10, 64)
+		if err != nil {
+			return nil, nil, err
+		}
+		counters[hash] = RuleCounters{
+			Chain:   chainName,
+			RuleNum: chainToRuleNum[chainName],
+			Packets: packets,
+			Bytes:   numBytes,
+		}
+	}
+	if scanner.Err() != nil {
+		log.WithError(scanner.Err()).Error("Failed to read counters from dataplane")
+		return nil, nil, scanner.Err()
+	}
+	return counters, chainToRuleNum, nil
+}
+
+// Counter preservation (TableOptions.PreserveCounters).  Some updates delete and recreate rules
+// that haven't changed: in nftables mode, we rewrite a whole chain whenever any of its rules
+// changes and, in any mode, we remove and re-insert all our rules in a kernel chain if we find
+// them out of sync.  The kernel starts the recreated rules' counters from zero.  To avoid that,
+// we read the counters before such an update and give them back to iptables-restore
+// --counters as "[packets:bytes]" prefixes on the recreated rules, which we match up by hash.
+
+// countersToPreserve returns the counters of our rules if counter preservation is enabled and
+// the pending update may recreate rules that are already in the dataplane.  Returns nil if
+// there's nothing to preserve or if the counters can't be read; losing the counters isn't
+// worth failing the update for.
+func (t *Table) countersToPreserve() map[string]RuleCounters {
+	if !t.preserveCounters || !t.mayRecreateRules() {
+		return nil
+	}
+	counters, err := t.readCounters()
+	if err != nil {
+		t.logCxt.WithError(err).Warn("Failed to read counters; rewritten rules will start from zero")
+		return nil
+	}
+	return counters
+}
+
+// mayRecreateRules returns true if the pending update will delete and recreate our rules in a
+// chain that already has some of them.
+func (t *Table) mayRecreateRules() bool {
+	features := t.featureDetector.GetFeatures()
+	recreates := false
+	if t.nftablesMode || t.foreignRulePolicy == ForeignRulesPreserve {
+		t.dirtyChains.Iter(func(item interface{}) error {
+			chainName := item.(string)
+			chain, ok := t.chainNameToChain[chainName]
+			if !ok || t.isQuarantined(chainName) {
+				return nil
+			}
+			previousHashes := t.chainToDataplaneHashes[chainName]
+			if !t.nftablesMode && !t.appendsAfterForeignRules(chainName, previousHashes) {
+				// We'll update our rules in place.
+				return nil
+			}
+			previousHashes, _ = t.ourRuleHashes(chainName, previousHashes)
+			if len(previousHashes) > 0 && !reflect.DeepEqual(t.ruleHashes(chain, features), previousHashes) {
+				recreates = true
+				return set.StopIteration
+			}
+			return nil
+		})
+	}
+	if recreates || !t.ownsInserts {
+		return recreates
+	}
+	t.dirtyInserts.Iter(func(item interface{}) error {
+		chainName := item.(string)
+		previousHashes := t.chainToDataplaneHashes[chainName]
+		if numEmptyStrings(previousHashes) < len(previousHashes) && !t.insertsInSync(chainName, previousHashes) {
+			recreates = true
+			return set.StopIteration
+		}
+		return nil
+	})
+	return recreates
+}
+
+// withCounters prefixes the given rule line with the rule's counters, if we have them.
+func withCounters(counters map[string]RuleCounters, hash, line string) string {
+	c, ok := counters[hash]
+	if !ok {
+		return line
+	}
+	return fmt.Sprintf("[%d:%d] %s", c.Packets, c.Bytes, line)
+}
@@ -0,0 +1,163 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/projectcalico/felix/iptables"
+)
+
+var _ = Describe("Counter readback", func() {
+	var table *Table
+	var cmds []*counterTestCmd
+	var saveOutput string
+	var restoreErr error
+
+	BeforeEach(func() {
+		cmds = nil
+		restoreErr = nil
+		saveOutput = "# Generated by iptables-save\n" +
+			"*filter\n" +
+			":INPUT ACCEPT [10:1000]\n" +
+			":cali-foo - [0:0]\n" +
+			":cali-bar - [0:0]\n" +
+			"[7:420] -A INPUT -j ACCEPT\n" +
+			"[5:300] -A INPUT -m comment --comment \"cali:abcdefghij1234-_\" -j cali-foo\n" +
+			"[123456789012:98765432109876] -A cali-foo -m comment --comment \"cali:0123456789abcdef\" -j DROP\n" +
+			"[2:120] -A cali-bar -m comment --comment \"cali:fedcba9876543210\" -j DROP\n" +
+			"[3:180] -A cali-bar -j ACCEPT\n" +
+			"COMMIT\n"
+		factory := func(name string, arg ...string) CmdIface {
+			c := &counterTestCmd{name: name, args: arg}
+			switch {
+			case name == "iptables":
+				c.output = "iptables v1.6.2\n"
+			case strings.HasSuffix(name, "-save"):
+				c.output = saveOutput
+			case strings.HasSuffix(name, "-restore"):
+				c.runErr = restoreErr
+			}
+			cmds = append(cmds, c)
+			return c
+		}
+		detector := NewFeatureDetector()
+		detector.NewCmd = factory
+		table = NewTable(
+			"filter",
+			4,
+			"cali:",
+			&sync.Mutex{},
+			detector,
+			TableOptions{
+				HistoricChainPrefixes: []string{"cali-"},
+				NewCmdOverride:        factory,
+				LookPathOverride: func(file string) (string, error) {
+					return file, nil
+				},
+			},
+		)
+	})
+
+	It("should parse counters of our rules only", func() {
+		counters, err := table.ReadCounters()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(counters).To(Equal(map[string]RuleCounters{
+			"abcdefghij1234-_": {Chain: "INPUT", RuleNum: 2, Packets: 5, Bytes: 300},
+			"0123456789abcdef": {Chain: "cali-foo", RuleNum: 1, Packets: 123456789012, Bytes: 98765432109876},
+			"fedcba9876543210": {Chain: "cali-bar", RuleNum: 1, Packets: 2, Bytes: 120},
+		}))
+	})
+
+	It("should zero only whole chains that contain nothing but our rules", func() {
+		counters, unzeroedChains, err := table.ReadAndZeroCounters()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(counters).To(Equal(map[string]RuleCounters{
+			"0123456789abcdef": {Chain: "cali-foo", RuleNum: 1, Packets: 123456789012, Bytes: 98765432109876},
+		}))
+		Expect(unzeroedChains).To(Equal([]string{"INPUT", "cali-bar"}))
+
+		last := cmds[len(cmds)-1]
+		Expect(last.name).To(ContainSubstring("restore"))
+		Expect(last.stdin).To(Equal("*filter\n" +
+			"--zero cali-foo\n" +
+			"COMMIT\n"))
+	})
+
+	It("should not run iptables-restore if there's nothing to zero", func() {
+		saveOutput = "*filter\n" +
+			"[5:300] -A INPUT -m comment --comment \"cali:abcdefghij1234-_\" -j cali-foo\n" +
+			"COMMIT\n"
+		counters, unzeroedChains, err := table.ReadAndZeroCounters()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(counters).To(BeEmpty())
+		Expect(unzeroedChains).To(Equal([]string{"INPUT"}))
+		for _, c := range cmds {
+			Expect(c.name).NotTo(ContainSubstring("restore"))
+		}
+	})
+
+	It("should return the error if the zeroing fails", func() {
+		restoreErr = errors.New("dummy error")
+		_, _, err := table.ReadAndZeroCounters()
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+// counterTestCmd is a minimal CmdIface that returns canned output and records its input.
+type counterTestCmd struct {
+	name   string
+	args   []string
+	output string
+	stdin  string
+	runErr error
+	in     io.Reader
+}
+
+func (c *counterTestCmd) SetStdin(r io.Reader)  { c.in = r }
+func (c *counterTestCmd) SetStdout(w io.Writer) {}
+func (c *counterTestCmd) SetStderr(w io.Writer) {}
+
+func (c *counterTestCmd) Run() error {
+	if c.in != nil {
+		var buf bytes.Buffer
+		_, _ = buf.ReadFrom(c.in)
+		c.stdin = buf.String()
+	}
+	return c.runErr
+}
+
+func (c *counterTestCmd) Start() error { return c.Run() }
+func (c *counterTestCmd) Kill() error  { return nil }
+func (c *counterTestCmd) Wait() error  { return nil }
+
+func (c *counterTestCmd) Output() ([]byte, error) {
+	return []byte(c.output), nil
+}
+
+func (c *counterTestCmd) StdoutPipe() (io.ReadCloser, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (c *counterTestCmd) String() string {
+	return c.name + " " + strings.Join(c.args, " ")
+}
@@ -0,0 +1,66 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables_test
+
+import (
+	"regexp"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/projectcalico/felix/iptables"
+)
+
+var _ = Describe("Rule extra comments", func() {
+	rule := Rule{
+		Action:        AcceptAction{},
+		Comment:       "Allow web",
+		ExtraComments: []string{"policy default/web", "namespace prod"},
+	}
+
+	It("should render the extra comments after the hash and comment", func() {
+		Expect(rule.RenderAppend("cali-foo", `-m comment --comment "cali:abcd"`, &Features{})).To(Equal(
+			`-A cali-foo -m comment --comment "cali:abcd" -m comment --comment "Allow web" ` +
+				`-m comment --comment "policy default/web" -m comment --comment "namespace prod" --jump ACCEPT`))
+	})
+
+	It("should include the extra comments in the hash, in order", func() {
+		hashOf := func(r Rule) string {
+			return (&Chain{Name: "cali-foo", Rules: []Rule{r}}).RuleHashes(nil)[0]
+		}
+		plain := Rule{Action: AcceptAction{}, Comment: "Allow web"}
+		reordered := rule
+		reordered.ExtraComments = []string{"namespace prod", "policy default/web"}
+		Expect(hashOf(rule)).To(Equal(hashOf(rule)))
+		Expect(hashOf(rule)).NotTo(Equal(hashOf(plain)))
+		Expect(hashOf(rule)).NotTo(Equal(hashOf(reordered)))
+	})
+
+	It("should program and recognise rules with extra comments", func() {
+		dataplane := newMockDataplane("filter", map[string][]string{"FORWARD": {}})
+		table := dataplane.newTable(nil)
+		table.UpdateChain(&Chain{Name: "cali-foo", Rules: []Rule{rule}})
+		table.Apply()
+		Expect(dataplane.Chains["cali-foo"]).To(HaveLen(1))
+		Expect(dataplane.Chains["cali-foo"][0]).To(MatchRegexp(
+			`^-m comment --comment "cali:[^"]+" -m comment --comment "Allow web" ` +
+				regexp.QuoteMeta(`-m comment --comment "policy default/web"`)))
+
+		numCmds := len(dataplane.CmdNames)
+		table.InvalidateDataplaneCache("test")
+		table.Apply()
+		Expect(dataplane.CmdNames[numCmds:]).NotTo(ContainElement("iptables-restore"))
+	})
+})
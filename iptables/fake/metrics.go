@@ -0,0 +1,63 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fake
+
+import (
+	"sync"
+
+	"github.com/projectcalico/felix/iptables"
+)
+
+// Metrics is an iptables.MetricsRecorder that records the metric updates that a Table makes so
+// that tests can check them without reading the global Prometheus registry.  Pass it in
+// iptables.TableOptions.MetricsRecorder.
+type Metrics struct {
+	lock   sync.Mutex
+	values map[iptables.Metric]float64
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		values: map[iptables.Metric]float64{},
+	}
+}
+
+func (m *Metrics) Add(metric iptables.Metric, delta float64) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.values[metric] += delta
+}
+
+func (m *Metrics) Set(metric iptables.Metric, value float64) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.values[metric] = value
+}
+
+// Value returns the current value of the metric; 0 if it has never been updated.
+func (m *Metrics) Value(metric iptables.Metric) float64 {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.values[metric]
+}
+
+// Reset zeros all the metrics so that a test can check the updates made by a single operation.
+func (m *Metrics) Reset() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.values = map[iptables.Metric]float64{}
+}
+
+var _ iptables.MetricsRecorder = (*Metrics)(nil)
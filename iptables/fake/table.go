@@ -0,0 +1,152 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package fake provides an in-memory implementation of iptables.TableIface for testing
+// dataplane drivers.
+package fake
+
+import (
+	"sort"
+	"time"
+
+	"github.com/projectcalico/felix/iptables"
+)
+
+// Table is a fake iptables.TableIface.  It records the calls made to it and simulates the
+// dataplane: updates are held as pending until Apply() is called, as with the real Table.  It
+// is not thread safe.
+type Table struct {
+	Name string
+
+	// Calls records the name of each TableIface method called, in order.
+	Calls []string
+	// InvalidationReasons records the reason passed to each InvalidateDataplaneCache() call.
+	InvalidationReasons []string
+	// NumApplies counts the calls to Apply().
+	NumApplies int
+	// RescheduleAfter and ApplyResult are returned from Apply().
+	RescheduleAfter time.Duration
+	ApplyResult     iptables.ApplyResult
+
+	// DataplaneChains and DataplaneInserts simulate the state of the dataplane.  They are only
+	// updated by Apply().  Tests may modify them to simulate another process changing the
+	// dataplane; as with the real Table, the change is only corrected by the next Apply()
+	// after InvalidateDataplaneCache().
+	DataplaneChains  map[string]*iptables.Chain
+	DataplaneInserts map[string][]iptables.Rule
+
+	chains      map[string]*iptables.Chain
+	inserts     map[string][]iptables.Rule
+	dirty       bool
+	invalidated bool
+}
+
+var _ iptables.TableIface = (*Table)(nil)
+
+// NewTable creates an empty fake Table.
+func NewTable(name string) *Table {
+	return &Table{
+		Name:             name,
+		DataplaneChains:  map[string]*iptables.Chain{},
+		DataplaneInserts: map[string][]iptables.Rule{},
+		chains:           map[string]*iptables.Chain{},
+		inserts:          map[string][]iptables.Rule{},
+	}
+}
+
+func (t *Table) UpdateChain(chain *iptables.Chain) {
+	t.Calls = append(t.Calls, "UpdateChain")
+	t.chains[chain.Name] = chain
+	t.dirty = true
+}
+
+func (t *Table) UpdateChains(chains []*iptables.Chain) {
+	t.Calls = append(t.Calls, "UpdateChains")
+	for _, chain := range chains {
+		t.chains[chain.Name] = chain
+	}
+	t.dirty = true
+}
+
+func (t *Table) RemoveChains(chains []*iptables.Chain) {
+	t.Calls = append(t.Calls, "RemoveChains")
+	for _, chain := range chains {
+		delete(t.chains, chain.Name)
+	}
+	t.dirty = true
+}
+
+func (t *Table) RemoveChainByName(name string) {
+	t.Calls = append(t.Calls, "RemoveChainByName")
+	delete(t.chains, name)
+	t.dirty = true
+}
+
+func (t *Table) SetRuleInsertions(chainName string, rules []iptables.Rule) {
+	t.Calls = append(t.Calls, "SetRuleInsertions")
+	if len(rules) == 0 {
+		delete(t.inserts, chainName)
+	} else {
+		t.inserts[chainName] = append([]iptables.Rule(nil), rules...)
+	}
+	t.dirty = true
+}
+
+// Apply copies the pending state to DataplaneChains and DataplaneInserts, if anything has
+// changed or the cache has been invalidated since the last Apply().
+func (t *Table) Apply() (time.Duration, iptables.ApplyResult) {
+	t.Calls = append(t.Calls, "Apply")
+	t.NumApplies++
+	if t.dirty || t.invalidated {
+		t.DataplaneChains = map[string]*iptables.Chain{}
+		for name, chain := range t.chains {
+			t.DataplaneChains[name] = chain
+		}
+		t.DataplaneInserts = map[string][]iptables.Rule{}
+		for name, rules := range t.inserts {
+			t.DataplaneInserts[name] = rules
+		}
+		t.dirty = false
+		t.invalidated = false
+	}
+	return t.RescheduleAfter, t.ApplyResult
+}
+
+func (t *Table) InvalidateDataplaneCache(reason string) {
+	t.Calls = append(t.Calls, "InvalidateDataplaneCache")
+	t.InvalidationReasons = append(t.InvalidationReasons, reason)
+	t.invalidated = true
+}
+
+// PendingUpdates returns true if there are updates that the next Apply() would program.
+func (t *Table) PendingUpdates() bool {
+	return t.dirty || t.invalidated
+}
+
+// ChainNames returns the names of the chains in the simulated dataplane, sorted.
+func (t *Table) ChainNames() []string {
+	names := make([]string, 0, len(t.DataplaneChains))
+	for name := range t.DataplaneChains {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ResetCalls clears the recorded calls.
+func (t *Table) ResetCalls() {
+	t.Calls = nil
+	t.InvalidationReasons = nil
+	t.NumApplies = 0
+}
@@ -0,0 +1,86 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fake_test
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/projectcalico/felix/iptables"
+	. "github.com/projectcalico/felix/iptables/fake"
+)
+
+var _ = Describe("Fake Table", func() {
+	var table *Table
+	chainA := &iptables.Chain{Name: "cali-a", Rules: []iptables.Rule{{Action: iptables.DropAction{}}}}
+	chainB := &iptables.Chain{Name: "cali-b"}
+
+	BeforeEach(func() {
+		table = NewTable("filter")
+	})
+
+	It("should only update the dataplane on Apply", func() {
+		table.UpdateChains([]*iptables.Chain{chainA, chainB})
+		Expect(table.DataplaneChains).To(BeEmpty())
+		Expect(table.PendingUpdates()).To(BeTrue())
+		table.Apply()
+		Expect(table.ChainNames()).To(Equal([]string{"cali-a", "cali-b"}))
+		Expect(table.DataplaneChains["cali-a"]).To(Equal(chainA))
+		Expect(table.PendingUpdates()).To(BeFalse())
+	})
+
+	It("should remove chains", func() {
+		table.UpdateChains([]*iptables.Chain{chainA, chainB})
+		table.RemoveChains([]*iptables.Chain{chainA})
+		table.RemoveChainByName("cali-b")
+		table.Apply()
+		Expect(table.DataplaneChains).To(BeEmpty())
+	})
+
+	It("should track insertions", func() {
+		table.SetRuleInsertions("FORWARD", chainA.Rules)
+		table.Apply()
+		Expect(table.DataplaneInserts).To(Equal(map[string][]iptables.Rule{"FORWARD": chainA.Rules}))
+		table.SetRuleInsertions("FORWARD", nil)
+		table.Apply()
+		Expect(table.DataplaneInserts).To(BeEmpty())
+	})
+
+	It("should record calls", func() {
+		table.RescheduleAfter = time.Second
+		table.UpdateChain(chainA)
+		table.InvalidateDataplaneCache("test")
+		Expect(table.Apply()).To(Equal(time.Second))
+		Expect(table.Calls).To(Equal([]string{"UpdateChain", "InvalidateDataplaneCache", "Apply"}))
+		Expect(table.InvalidationReasons).To(Equal([]string{"test"}))
+		Expect(table.NumApplies).To(Equal(1))
+		table.ResetCalls()
+		Expect(table.Calls).To(BeEmpty())
+		Expect(table.NumApplies).To(Equal(0))
+	})
+
+	It("should only correct dataplane changes after invalidation", func() {
+		table.UpdateChain(chainA)
+		table.Apply()
+		delete(table.DataplaneChains, "cali-a")
+		table.Apply()
+		Expect(table.DataplaneChains).To(BeEmpty())
+		table.InvalidateDataplaneCache("test")
+		table.Apply()
+		Expect(table.ChainNames()).To(Equal([]string{"cali-a"}))
+	})
+})
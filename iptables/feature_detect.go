@@ -15,8 +15,14 @@
 package iptables
 
 import (
+	"bufio"
+	"bytes"
 	"io"
+	"io/ioutil"
+	"os"
+	"path"
 	"regexp"
+	"strings"
 	"sync"
 
 	version "github.com/hashicorp/go-version"
@@ -52,6 +58,16 @@ type Features struct {
 	// RestoreSupportsLock is true if the iptables-restore command supports taking the xtables lock and the
 	// associated -w and -W arguments.
 	RestoreSupportsLock bool
+	// TPROXY is true if the kernel has the xt_TPROXY module, which the TPROXY action needs.
+	TPROXY bool
+	// HashLimit is true if the kernel has the xt_hashlimit module, which the hashlimit match
+	// needs.
+	HashLimit bool
+	// TTL is true if the kernel has the xt_HL module, which the TTL action needs.
+	TTL bool
+	// CT is true if the kernel has the xt_CT module, which the CT action needs to set
+	// conntrack zones and helpers.
+	CT bool
 }
 
 type FeatureDetector struct {
@@ -62,12 +78,15 @@ type FeatureDetector struct {
 	GetKernelVersionReader func() (io.Reader, error)
 	// Factory for making commands, used by UTs to shim exec.Command().
 	NewCmd cmdFactory
+	// Checks whether a kernel module is available, used by UTs to shim the filesystem.
+	KernelModuleAvailable func(module string) bool
 }
 
 func NewFeatureDetector() *FeatureDetector {
 	return &FeatureDetector{
 		GetKernelVersionReader: versionparse.GetKernelVersionReader,
 		NewCmd:                 newRealCmd,
+		KernelModuleAvailable:  kernelModuleAvailable,
 	}
 }
 
@@ -100,6 +119,10 @@ func (d *FeatureDetector) refreshFeaturesLockHeld() {
 		SNATFullyRandom:     iptV.Compare(v1Dot6Dot0) >= 0 && kerV.Compare(v3Dot14Dot0) >= 0,
 		MASQFullyRandom:     iptV.Compare(v1Dot6Dot2) >= 0 && kerV.Compare(v3Dot14Dot0) >= 0,
 		RestoreSupportsLock: iptV.Compare(v1Dot6Dot2) >= 0,
+		TPROXY:              d.KernelModuleAvailable("xt_TPROXY"),
+		HashLimit:           d.KernelModuleAvailable("xt_hashlimit"),
+		TTL:                 d.KernelModuleAvailable("xt_HL"),
+		CT:                  d.KernelModuleAvailable("xt_CT"),
 	}
 
 	if d.featureCache == nil || *d.featureCache != features {
@@ -149,4 +172,47 @@ func (d *FeatureDetector) getKernelVersion() *version.Version {
 		return v3Dot10Dot0
 	}
 	return kernVersion
-}
\ No newline at end of file
+}
+
+// kernelModuleAvailable returns true if the given kernel module is loaded, built in or
+// installed, in which case the kernel loads it when a rule first uses it.  Built-in modules
+// only appear in /sys/module if they have parameters so we also check modules.builtin.
+func kernelModuleAvailable(module string) bool {
+	if _, err := os.Stat(path.Join("/sys/module", module)); err == nil {
+		return true
+	}
+	release, err := ioutil.ReadFile("/proc/sys/kernel/osrelease")
+	if err != nil {
+		log.WithError(err).Warn("Failed to read kernel release, assuming module is missing")
+		return false
+	}
+	modulesDir := path.Join("/lib/modules", strings.TrimSpace(string(release)))
+	for _, list := range []string{"modules.builtin", "modules.dep"} {
+		data, err := ioutil.ReadFile(path.Join(modulesDir, list))
+		if err != nil {
+			log.WithError(err).WithField("list", list).Debug("Failed to read module list")
+			continue
+		}
+		if moduleListed(data, module) {
+			return true
+		}
+	}
+	return false
+}
+
+// moduleListed returns true if the given contents of a modules.builtin or modules.dep file list
+// the module.  Both have the module's path at the start of each line; modules.dep follows it
+// with a colon.
+func moduleListed(data []byte, module string) bool {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		name := path.Base(strings.SplitN(scanner.Text(), ":", 2)[0])
+		for _, ext := range []string{".xz", ".gz", ".zst", ".ko"} {
+			name = strings.TrimSuffix(name, ext)
+		}
+		if name == module {
+			return true
+		}
+	}
+	return false
+}
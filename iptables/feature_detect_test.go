@@ -0,0 +1,66 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/projectcalico/felix/iptables"
+)
+
+var _ = Describe("FeatureDetector kernel module probes", func() {
+	var dataplane *mockDataplane
+	var detector *FeatureDetector
+	var probedModules []string
+	var available bool
+
+	BeforeEach(func() {
+		dataplane = newMockDataplane("mangle", map[string][]string{})
+		detector = dataplane.newFeatureDetector()
+		probedModules = nil
+		detector.KernelModuleAvailable = func(module string) bool {
+			probedModules = append(probedModules, module)
+			return available
+		}
+	})
+
+	It("should report the features if the modules are available", func() {
+		available = true
+		features := detector.GetFeatures()
+		Expect(features.TPROXY).To(BeTrue())
+		Expect(features.HashLimit).To(BeTrue())
+		Expect(features.TTL).To(BeTrue())
+		Expect(features.CT).To(BeTrue())
+		Expect(probedModules).To(ConsistOf("xt_TPROXY", "xt_hashlimit", "xt_HL", "xt_CT"))
+	})
+
+	It("should not report the features if the modules are missing", func() {
+		available = false
+		features := detector.GetFeatures()
+		Expect(features.TPROXY).To(BeFalse())
+		Expect(features.HashLimit).To(BeFalse())
+		Expect(features.TTL).To(BeFalse())
+		Expect(features.CT).To(BeFalse())
+	})
+
+	It("should pick up a newly-installed module on refresh", func() {
+		available = false
+		Expect(detector.GetFeatures().TPROXY).To(BeFalse())
+		available = true
+		detector.RefreshFeatures()
+		Expect(detector.GetFeatures().TPROXY).To(BeTrue())
+	})
+})
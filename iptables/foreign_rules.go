@@ -0,0 +1,173 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"regexp"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ForeignRulePolicy is what the Table does when it finds rules without one of our hashes in one
+// of our chains (other than at the end of a chain that matches
+// TableOptions.ForeignTailChainPrefixes, which are always left alone).
+type ForeignRulePolicy string
+
+const (
+	// ForeignRulesRewrite, the default, rewrites the chain, removing the foreign rules.
+	ForeignRulesRewrite ForeignRulePolicy = "rewrite"
+	// ForeignRulesPreserve leaves the foreign rules in place.  When we update the chain, we
+	// remove our old rules and append our new rules after the foreign rules.
+	ForeignRulesPreserve ForeignRulePolicy = "preserve"
+	// ForeignRulesQuarantine reports the foreign rules, via TableOptions.OnOutOfSync, and
+	// quarantines the chain, leaving it as it is in the dataplane, until they're removed.
+	ForeignRulesQuarantine ForeignRulePolicy = "quarantine"
+)
+
+// foreignTailChainsRegexp returns a regexp that matches chain names that start with one of the
+// given prefixes, or nil if there are no prefixes.
+func foreignTailChainsRegexp(prefixes []string) *regexp.Regexp {
+	if len(prefixes) == 0 {
+		return nil
+	}
+	quoted := make([]string, len(prefixes))
+	for i, prefix := range prefixes {
+		quoted[i] = regexp.QuoteMeta(prefix)
+	}
+	return regexp.MustCompile("^(" + strings.Join(quoted, "|") + ")")
+}
+
+// preservesForeignTail returns true if the named chain is one of ours that may have rules added
+// to the end of it by another process; see TableOptions.ForeignTailChainPrefixes.
+func (t *Table) preservesForeignTail(chainName string) bool {
+	return t.foreignTailChainsRegexp != nil && t.foreignTailChainsRegexp.MatchString(chainName)
+}
+
+// splitForeignTail splits the hashes of one of our chains into our rules and the number of
+// rules, without one of our hashes, that follow them.  Those trailing rules are treated as
+// opaque: we don't compare them, replace them or delete them.
+func splitForeignTail(hashes []string) (ours []string, numForeign int) {
+	end := len(hashes)
+	for end > 0 && hashes[end-1] == "" {
+		end--
+	}
+	return hashes[:end], len(hashes) - end
+}
+
+// ourRuleHashes returns the hashes of our rules in the given dataplane hashes of one of our
+// chains, leaving out the foreign rules that we leave in place, along with the number of those
+// foreign rules.
+func (t *Table) ourRuleHashes(chainName string, hashes []string) (ours []string, numForeign int) {
+	if t.preservesForeignTail(chainName) {
+		return splitForeignTail(hashes)
+	}
+	if t.foreignRulePolicy != ForeignRulesPreserve {
+		return hashes, 0
+	}
+	numForeign = numEmptyStrings(hashes)
+	if numForeign == 0 {
+		return hashes, 0
+	}
+	ours = make([]string, 0, len(hashes)-numForeign)
+	for _, hash := range hashes {
+		if hash != "" {
+			ours = append(ours, hash)
+		}
+	}
+	return ours, numForeign
+}
+
+// appendsAfterForeignRules returns true if, when we update the given chain, we need to remove
+// our rules and append them after the foreign rules that it has in the dataplane, rather than
+// update our rules in place.
+func (t *Table) appendsAfterForeignRules(chainName string, dataplaneHashes []string) bool {
+	return t.foreignRulePolicy == ForeignRulesPreserve &&
+		!t.preservesForeignTail(chainName) &&
+		numEmptyStrings(dataplaneHashes) > 0
+}
+
+// writeAppendAfterForeignRules writes the update to one of our chains that has foreign rules
+// that we're preserving: it deletes our old rules, leaving the foreign rules in place, and then
+// appends our new rules.  It returns the chain's hashes after the update.
+func (t *Table) writeAppendAfterForeignRules(
+	buf *RestoreInputBuilder,
+	chain *Chain,
+	dataplaneHashes []string,
+	currentHashes []string,
+	counters map[string]RuleCounters,
+	features *Features,
+) []string {
+	numForeign := numEmptyStrings(dataplaneHashes)
+	// Remove in reverse order so that we don't disturb the rule numbers of rules we're about
+	// to remove.
+	for i := len(dataplaneHashes) - 1; i >= 0; i-- {
+		if dataplaneHashes[i] != "" {
+			buf.WriteRuleLine(chain.Name, -1, deleteRule(chain.Name, i+1))
+		}
+	}
+	for i, hash := range currentHashes {
+		line := t.renderer.RenderAppend(chain.Rules[i], chain.Name, t.commentFrag(hash), features)
+		buf.WriteRuleLine(chain.Name, i, withCounters(counters, hash, line))
+	}
+	return append(make([]string, numForeign), currentHashes...)
+}
+
+// checkForeignRules, if our policy is to quarantine chains with foreign rules, quarantines
+// the chains that we're programming that have foreign rules in the dataplane and releases
+// the quarantined chains that no longer have any.
+func (t *Table) checkForeignRules(dataplaneHashes map[string][]string) {
+	if t.foreignRulePolicy != ForeignRulesQuarantine {
+		return
+	}
+	for chainName, qc := range t.quarantinedChains {
+		if qc.ForeignRules == 0 {
+			continue
+		}
+		hashes, _ := t.ourRuleHashes(chainName, dataplaneHashes[chainName])
+		if numForeign := numEmptyStrings(hashes); numForeign > 0 {
+			qc.ForeignRules = numForeign
+			continue
+		}
+		// Now that the foreign rules have gone, bring the chain up to date.
+		t.releaseQuarantine(chainName, "foreign rules removed")
+		t.dirtyChains.Add(chainName)
+	}
+	for chainName, chain := range t.chainNameToChain {
+		if t.isQuarantined(chainName) {
+			continue
+		}
+		hashes, ok := dataplaneHashes[chainName]
+		if !ok {
+			continue
+		}
+		hashes, _ = t.ourRuleHashes(chainName, hashes)
+		numForeign := numEmptyStrings(hashes)
+		if numForeign == 0 {
+			continue
+		}
+		t.quarantinedChains[chainName] = &QuarantinedChain{
+			Name:         chainName,
+			ForeignRules: numForeign,
+			ruleHashes:   t.ruleHashes(chain, t.featureDetector.GetFeatures()),
+		}
+		t.metrics.Set(MetricQuarantinedChains, float64(len(t.quarantinedChains)))
+		t.logCxt.WithFields(log.Fields{
+			"chainName":       chainName,
+			"numForeignRules": numForeign,
+		}).Error("Found rules that aren't ours in chain, quarantining it until they are removed")
+		t.reportOutOfSync(chainName, OutOfSyncForeignRules)
+	}
+}
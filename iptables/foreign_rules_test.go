@@ -0,0 +1,230 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/projectcalico/felix/iptables"
+)
+
+var _ = Describe("Table foreign rules at the end of our chains", func() {
+	var dataplane *mockDataplane
+	var table *Table
+
+	newTable := func(backendMode string, prefixes []string) {
+		table = dataplane.newTable(func(options *TableOptions) {
+			options.BackendMode = backendMode
+			options.ForeignTailChainPrefixes = prefixes
+		})
+	}
+
+	numRestores := func() int {
+		n := 0
+		for _, name := range dataplane.CmdNames {
+			if name == "iptables-restore" {
+				n++
+			}
+		}
+		return n
+	}
+
+	BeforeEach(func() {
+		dataplane = newMockDataplane("filter", map[string][]string{
+			"FORWARD": {},
+			"INPUT":   {},
+			"OUTPUT":  {},
+		})
+	})
+
+	for _, backendMode := range []string{"legacy", "nft"} {
+		backendMode := backendMode
+
+		Describe("in "+backendMode+" mode with the option enabled", func() {
+			BeforeEach(func() {
+				newTable(backendMode, []string{"cali-fw-"})
+				table.UpdateChain(&Chain{Name: "cali-fw-foo", Rules: []Rule{{Action: DropAction{}}}})
+				table.UpdateChain(&Chain{Name: "cali-other", Rules: []Rule{{Action: DropAction{}}}})
+				table.Apply()
+				dataplane.Chains["cali-fw-foo"] = append(dataplane.Chains["cali-fw-foo"], "-j LOG")
+				dataplane.Chains["cali-other"] = append(dataplane.Chains["cali-other"], "-j LOG")
+				table.InvalidateDataplaneCache("test")
+			})
+
+			It("should leave the foreign rules in the chain alone on resync", func() {
+				table.Apply()
+				Expect(dataplane.Chains["cali-fw-foo"]).To(HaveLen(2))
+				Expect(dataplane.Chains["cali-fw-foo"][1]).To(Equal("-j LOG"))
+			})
+
+			It("should still remove foreign rules from other chains", func() {
+				table.Apply()
+				Expect(dataplane.Chains["cali-other"]).To(HaveLen(1))
+			})
+
+			It("should insert new rules in front of the foreign rules", func() {
+				table.UpdateChain(&Chain{Name: "cali-fw-foo", Rules: []Rule{
+					{Action: AcceptAction{}},
+					{Action: DropAction{}},
+				}})
+				table.Apply()
+				Expect(dataplane.Chains["cali-fw-foo"]).To(HaveLen(3))
+				Expect(dataplane.Chains["cali-fw-foo"][0]).To(HaveSuffix("--jump ACCEPT"))
+				Expect(dataplane.Chains["cali-fw-foo"][1]).To(HaveSuffix("--jump DROP"))
+				Expect(dataplane.Chains["cali-fw-foo"][2]).To(Equal("-j LOG"))
+
+				// And the result should be stable.
+				restoresBefore := numRestores()
+				table.InvalidateDataplaneCache("test")
+				table.Apply()
+				Expect(numRestores()).To(Equal(restoresBefore))
+			})
+
+			It("should remove our rules but not the foreign ones", func() {
+				table.UpdateChain(&Chain{Name: "cali-fw-foo", Rules: nil})
+				table.Apply()
+				Expect(dataplane.Chains["cali-fw-foo"]).To(Equal([]string{"-j LOG"}))
+			})
+		})
+	}
+
+	Describe("with the option disabled", func() {
+		BeforeEach(func() {
+			newTable("legacy", nil)
+			table.UpdateChain(&Chain{Name: "cali-fw-foo", Rules: []Rule{{Action: DropAction{}}}})
+			table.Apply()
+			dataplane.Chains["cali-fw-foo"] = append(dataplane.Chains["cali-fw-foo"], "-j LOG")
+			table.InvalidateDataplaneCache("test")
+		})
+
+		It("should remove the foreign rules", func() {
+			table.Apply()
+			Expect(dataplane.Chains["cali-fw-foo"]).To(HaveLen(1))
+			Expect(dataplane.Chains["cali-fw-foo"][0]).To(HaveSuffix("--jump DROP"))
+		})
+	})
+})
+
+var _ = Describe("Table foreign rule policy", func() {
+	var dataplane *mockDataplane
+	var table *Table
+	var outOfSync []string
+
+	newTable := func(backendMode string, policy ForeignRulePolicy) {
+		table = dataplane.newTable(func(options *TableOptions) {
+			options.BackendMode = backendMode
+			options.ForeignRulePolicy = policy
+			options.OnOutOfSync = func(chainName string, reason string) {
+				outOfSync = append(outOfSync, chainName+":"+reason)
+			}
+		})
+		table.UpdateChain(&Chain{Name: "cali-foo", Rules: []Rule{{Action: DropAction{}}}})
+		table.Apply()
+		// Simulate a debugging rule, inserted at the top of the chain by hand.
+		dataplane.Chains["cali-foo"] = append([]string{"-j LOG"}, dataplane.Chains["cali-foo"]...)
+		table.InvalidateDataplaneCache("test")
+		outOfSync = nil
+	}
+
+	numRestores := func() int {
+		n := 0
+		for _, name := range dataplane.CmdNames {
+			if name == "iptables-restore" {
+				n++
+			}
+		}
+		return n
+	}
+
+	BeforeEach(func() {
+		dataplane = newMockDataplane("filter", map[string][]string{
+			"FORWARD": {},
+			"INPUT":   {},
+			"OUTPUT":  {},
+		})
+	})
+
+	for _, backendMode := range []string{"legacy", "nft"} {
+		backendMode := backendMode
+
+		Describe("preserving foreign rules in "+backendMode+" mode", func() {
+			BeforeEach(func() {
+				newTable(backendMode, ForeignRulesPreserve)
+			})
+
+			It("should leave the chain alone on resync", func() {
+				restoresBefore := numRestores()
+				table.Apply()
+				Expect(numRestores()).To(Equal(restoresBefore))
+				Expect(dataplane.Chains["cali-foo"]).To(HaveLen(2))
+				Expect(dataplane.Chains["cali-foo"][0]).To(Equal("-j LOG"))
+			})
+
+			It("should append our updated rules after the foreign rules", func() {
+				table.UpdateChain(&Chain{Name: "cali-foo", Rules: []Rule{
+					{Action: AcceptAction{}},
+					{Action: DropAction{}},
+				}})
+				table.Apply()
+				Expect(dataplane.Chains["cali-foo"]).To(HaveLen(3))
+				Expect(dataplane.Chains["cali-foo"][0]).To(Equal("-j LOG"))
+				Expect(dataplane.Chains["cali-foo"][1]).To(HaveSuffix("--jump ACCEPT"))
+				Expect(dataplane.Chains["cali-foo"][2]).To(HaveSuffix("--jump DROP"))
+
+				// And the result should be stable.
+				restoresBefore := numRestores()
+				table.InvalidateDataplaneCache("test")
+				table.Apply()
+				Expect(numRestores()).To(Equal(restoresBefore))
+			})
+		})
+	}
+
+	Describe("quarantining chains with foreign rules", func() {
+		BeforeEach(func() {
+			newTable("legacy", ForeignRulesQuarantine)
+			table.Apply()
+		})
+
+		It("should quarantine and report the chain", func() {
+			Expect(outOfSync).To(ContainElement("cali-foo:" + OutOfSyncForeignRules))
+			quarantined := table.QuarantinedChains()
+			Expect(quarantined).To(HaveLen(1))
+			Expect(quarantined[0].Name).To(Equal("cali-foo"))
+			Expect(quarantined[0].ForeignRules).To(Equal(1))
+			Expect(dataplane.Chains["cali-foo"]).To(HaveLen(2))
+		})
+
+		It("should not program updates to the chain", func() {
+			table.UpdateChain(&Chain{Name: "cali-foo", Rules: []Rule{{Action: AcceptAction{}}}})
+			table.Apply()
+			Expect(table.QuarantinedChains()).To(HaveLen(1))
+			Expect(dataplane.Chains["cali-foo"]).To(HaveLen(2))
+			Expect(dataplane.Chains["cali-foo"][1]).To(HaveSuffix("--jump DROP"))
+		})
+
+		It("should release and resync the chain once the foreign rules are removed", func() {
+			table.UpdateChain(&Chain{Name: "cali-foo", Rules: []Rule{{Action: AcceptAction{}}}})
+			table.Apply()
+			dataplane.Chains["cali-foo"] = dataplane.Chains["cali-foo"][1:]
+			table.InvalidateDataplaneCache("test")
+			table.Apply()
+			Expect(table.QuarantinedChains()).To(BeEmpty())
+			Expect(dataplane.Chains["cali-foo"]).To(HaveLen(1))
+			Expect(dataplane.Chains["cali-foo"][0]).To(HaveSuffix("--jump ACCEPT"))
+		})
+	})
+})
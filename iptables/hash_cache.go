@@ -0,0 +1,57 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+// PrecomputeHashes renders and hashes any queued chains whose hashes we haven't already
+// calculated, so that the next Apply() only needs to compare them with the dataplane.  It is
+// intended to be called while the caller is waiting to apply, for example while waiting for
+// the datastore to sync at start of day.  It doesn't touch the dataplane.
+func (t *Table) PrecomputeHashes() {
+	t.opLock.Lock()
+	defer t.opLock.Unlock()
+	features := t.featureDetector.GetFeatures()
+	numHashed := 0
+	for _, chain := range t.chainNameToChain {
+		if _, ok := t.chainToRuleHashes[chain.Name]; ok && features == t.ruleHashesFeatures {
+			continue
+		}
+		t.ruleHashes(chain, features)
+		numHashed++
+	}
+	if numHashed > 0 {
+		t.logCxt.WithField("numChains", numHashed).Debug("Precomputed rule hashes")
+	}
+}
+
+// ruleHashes returns the rule hashes of the given chain, which must be the chain that we hold
+// under that name, using our cache where possible.  Like Chain.RuleHashes, it returns nil for a
+// nil chain.  The returned slice is shared so it must not be modified.
+func (t *Table) ruleHashes(chain *Chain, features *Features) []string {
+	if chain == nil {
+		return nil
+	}
+	if features != t.ruleHashesFeatures {
+		// First use or the features have been re-detected, which may change how rules
+		// render, so start again.
+		t.chainToRuleHashes = map[string][]string{}
+		t.ruleHashesFeatures = features
+	}
+	if hashes, ok := t.chainToRuleHashes[chain.Name]; ok {
+		return hashes
+	}
+	hashes := chain.RuleHashesWithFormat(features, t.hashFormat)
+	t.chainToRuleHashes[chain.Name] = hashes
+	return hashes
+}
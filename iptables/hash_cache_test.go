@@ -0,0 +1,73 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/projectcalico/felix/iptables"
+)
+
+var _ = Describe("Table rule hash precomputation", func() {
+	var dataplane *mockDataplane
+	var table *Table
+
+	BeforeEach(func() {
+		dataplane = newMockDataplane("filter", map[string][]string{
+			"FORWARD": {},
+			"INPUT":   {},
+			"OUTPUT":  {},
+		})
+		table = dataplane.newTable(nil)
+		table.UpdateChain(&Chain{Name: "cali-foo", Rules: []Rule{{Action: DropAction{}}}})
+		table.SetRuleInsertions("FORWARD", []Rule{{Action: JumpAction{Target: "cali-foo"}}})
+		table.PrecomputeHashes()
+	})
+
+	It("should not touch the dataplane", func() {
+		Expect(dataplane.CmdNames).To(BeEmpty())
+	})
+
+	It("should program the same rules as without precomputation", func() {
+		table.Apply()
+		Expect(dataplane.Chains["cali-foo"]).To(Equal([]string{
+			`-m comment --comment "cali:` + (&Chain{Name: "cali-foo", Rules: []Rule{{Action: DropAction{}}}}).RuleHashes(nil)[0] + `" --jump DROP`,
+		}))
+	})
+
+	It("should use the new rules if the chain is updated after precomputation", func() {
+		table.UpdateChain(&Chain{Name: "cali-foo", Rules: []Rule{{Action: AcceptAction{}}}})
+		table.Apply()
+		Expect(dataplane.Chains["cali-foo"]).To(HaveLen(1))
+		Expect(dataplane.Chains["cali-foo"][0]).To(HaveSuffix("--jump ACCEPT"))
+	})
+
+	It("should include rules appended after precomputation", func() {
+		table.AppendToChain("cali-foo", []Rule{{Action: AcceptAction{}}})
+		table.Apply()
+		Expect(dataplane.Chains["cali-foo"]).To(HaveLen(2))
+		Expect(dataplane.Chains["cali-foo"][1]).To(HaveSuffix("--jump ACCEPT"))
+	})
+
+	It("should delete a chain that is removed after precomputation", func() {
+		table.Apply()
+		table.SetRuleInsertions("FORWARD", nil)
+		table.RemoveChainByName("cali-foo")
+		table.PrecomputeHashes()
+		table.Apply()
+		Expect(dataplane.Chains).NotTo(HaveKey("cali-foo"))
+	})
+})
@@ -0,0 +1,201 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// hashEncodingVersion is the first byte of an encoded hash cache.  Bump it if the format changes.
+const hashEncodingVersion = 1
+
+// maxDecodedRules limits the total number of rules, across all chains, that DecodeHashes will
+// allocate for.  Rules that aren't ours take no space in the encoding, so the length of the
+// input doesn't bound the number of rules; this is far more than any real node has.
+const maxDecodedRules = 1 << 22
+
+var errTruncatedHashes = errors.New("truncated hash encoding")
+
+// EncodeHashes encodes a map from chain name to rule hashes (as used in the Table's cache,
+// where "" represents a rule that we don't own); see TableSnapshot.CompactDataplaneHashes.  The
+// encoding is designed for nodes with very large numbers of rules:
+//
+//   - Chains are sorted by name and each name is stored as the length of the prefix that it
+//     shares with the previous name, followed by the remaining suffix.  Our chain names share
+//     long prefixes, such as "cali-fw-" and "cali-pi-".
+//   - Within a chain, only the non-empty hashes are stored, each preceded by its position,
+//     encoded as a varint delta from the previous non-empty hash.  Runs of other rules in
+//     kernel chains therefore cost almost nothing.
+//   - Each hash is likewise stored as a shared prefix length and suffix, relative to the
+//     previous hash in the chain.
+//
+// All integers are unsigned varints.
+func EncodeHashes(hashes map[string][]string) []byte {
+	chainNames := make([]string, 0, len(hashes))
+	for chainName := range hashes {
+		chainNames = append(chainNames, chainName)
+	}
+	sort.Strings(chainNames)
+
+	var buf bytes.Buffer
+	var scratch [binary.MaxVarintLen64]byte
+	writeUvarint := func(v int) {
+		n := binary.PutUvarint(scratch[:], uint64(v))
+		buf.Write(scratch[:n])
+	}
+	writePrefixCompressed := func(prev, s string) {
+		shared := sharedPrefixLen(prev, s)
+		writeUvarint(shared)
+		writeUvarint(len(s) - shared)
+		buf.WriteString(s[shared:])
+	}
+
+	buf.WriteByte(hashEncodingVersion)
+	writeUvarint(len(chainNames))
+	prevChainName := ""
+	for _, chainName := range chainNames {
+		writePrefixCompressed(prevChainName, chainName)
+		prevChainName = chainName
+
+		chainHashes := hashes[chainName]
+		writeUvarint(len(chainHashes))
+		writeUvarint(len(chainHashes) - numEmptyStrings(chainHashes))
+		prevPos := 0
+		prevHash := ""
+		for pos, hash := range chainHashes {
+			if hash == "" {
+				continue
+			}
+			writeUvarint(pos - prevPos)
+			prevPos = pos
+			writePrefixCompressed(prevHash, hash)
+			prevHash = hash
+		}
+	}
+	return buf.Bytes()
+}
+
+// DecodeHashes decodes the output of EncodeHashes.
+func DecodeHashes(data []byte) (map[string][]string, error) {
+	r := bytes.NewReader(data)
+	version, err := r.ReadByte()
+	if err != nil {
+		return nil, errTruncatedHashes
+	}
+	if version != hashEncodingVersion {
+		return nil, fmt.Errorf("unknown hash encoding version %d", version)
+	}
+	readUvarint := func() (int, error) {
+		v, err := binary.ReadUvarint(r)
+		if err != nil {
+			return 0, errTruncatedHashes
+		}
+		if v > math.MaxInt32 {
+			return 0, fmt.Errorf("value %d out of range in hash encoding", v)
+		}
+		return int(v), nil
+	}
+	readPrefixCompressed := func(prev string) (string, error) {
+		shared, err := readUvarint()
+		if err != nil {
+			return "", err
+		}
+		if shared > len(prev) {
+			return "", fmt.Errorf("shared prefix length %d longer than previous value %q", shared, prev)
+		}
+		suffixLen, err := readUvarint()
+		if err != nil {
+			return "", err
+		}
+		if suffixLen > r.Len() {
+			return "", errTruncatedHashes
+		}
+		suffix := make([]byte, suffixLen)
+		_, _ = r.Read(suffix)
+		return prev[:shared] + string(suffix), nil
+	}
+
+	numChains, err := readUvarint()
+	if err != nil {
+		return nil, err
+	}
+	if numChains > r.Len() {
+		// Each chain takes at least one byte.
+		return nil, errTruncatedHashes
+	}
+	hashes := make(map[string][]string, numChains)
+	numRulesLeft := maxDecodedRules
+	prevChainName := ""
+	for i := 0; i < numChains; i++ {
+		chainName, err := readPrefixCompressed(prevChainName)
+		if err != nil {
+			return nil, err
+		}
+		prevChainName = chainName
+
+		numRules, err := readUvarint()
+		if err != nil {
+			return nil, err
+		}
+		numOurs, err := readUvarint()
+		if err != nil {
+			return nil, err
+		}
+		if numOurs > numRules {
+			return nil, fmt.Errorf("chain %s has more hashes (%d) than rules (%d)", chainName, numOurs, numRules)
+		}
+		if numRules > numRulesLeft {
+			return nil, fmt.Errorf("hash encoding has more than %d rules", maxDecodedRules)
+		}
+		numRulesLeft -= numRules
+		chainHashes := make([]string, numRules)
+		pos := 0
+		prevHash := ""
+		for j := 0; j < numOurs; j++ {
+			delta, err := readUvarint()
+			if err != nil {
+				return nil, err
+			}
+			pos += delta
+			if pos >= numRules || (j > 0 && delta == 0) {
+				return nil, fmt.Errorf("chain %s has invalid rule position %d", chainName, pos)
+			}
+			hash, err := readPrefixCompressed(prevHash)
+			if err != nil {
+				return nil, err
+			}
+			chainHashes[pos] = hash
+			prevHash = hash
+		}
+		hashes[chainName] = chainHashes
+	}
+	if r.Len() != 0 {
+		return nil, fmt.Errorf("%d unexpected trailing bytes in hash encoding", r.Len())
+	}
+	return hashes, nil
+}
+
+func sharedPrefixLen(a, b string) int {
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+	return n
+}
@@ -0,0 +1,125 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables_test
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/projectcalico/felix/iptables"
+)
+
+var _ = Describe("Hash cache encoding", func() {
+	It("should round-trip", func() {
+		hashes := map[string][]string{
+			"FORWARD":            {"", "", "abcdefghij1234-_", ""},
+			"INPUT":              {},
+			"cali-fw-cali1234":   {"0123456789abcdef", "0123456789abcdeg", "OLD INSERT RULE"},
+			"cali-fw-cali123456": {"zzzzzzzzzzzzzzzz"},
+			"cali-empty":         {"", ""},
+		}
+		decoded, err := DecodeHashes(EncodeHashes(hashes))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(decoded).To(Equal(hashes))
+	})
+
+	It("should round-trip an empty cache", func() {
+		decoded, err := DecodeHashes(EncodeHashes(map[string][]string{}))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(decoded).To(BeEmpty())
+	})
+
+	It("should be compact for long runs of other rules", func() {
+		forward := make([]string, 100000)
+		forward[99999] = "abcdefghij1234-_"
+		encoded := EncodeHashes(map[string][]string{"FORWARD": forward})
+		Expect(len(encoded)).To(BeNumerically("<", 40))
+		decoded, err := DecodeHashes(encoded)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(decoded["FORWARD"]).To(Equal(forward))
+	})
+
+	It("should be smaller than the naive encoding for many similar chains", func() {
+		hashes := map[string][]string{}
+		naiveSize := 0
+		for i := 0; i < 1000; i++ {
+			chainName := fmt.Sprintf("cali-fw-cali%08x", i)
+			hash := fmt.Sprintf("%016x", i*7919)
+			hashes[chainName] = []string{hash}
+			naiveSize += len(chainName) + len(hash)
+		}
+		// Hashes are random so the saving comes from the chain names.
+		Expect(len(EncodeHashes(hashes))).To(BeNumerically("<", naiveSize*3/4))
+	})
+
+	It("should reject truncated input", func() {
+		encoded := EncodeHashes(map[string][]string{"cali-foo": {"0123456789abcdef"}})
+		for i := 0; i < len(encoded); i++ {
+			_, err := DecodeHashes(encoded[:i])
+			Expect(err).To(HaveOccurred(), fmt.Sprintf("truncated to %d bytes", i))
+		}
+	})
+
+	It("should reject implausible rule counts without allocating for them", func() {
+		encodeChain := func(numRules uint64) []byte {
+			encoded := []byte{1, 1, 0, 1, 'a'}
+			var scratch [binary.MaxVarintLen64]byte
+			n := binary.PutUvarint(scratch[:], numRules)
+			encoded = append(encoded, scratch[:n]...)
+			return append(encoded, 0)
+		}
+		decoded, err := DecodeHashes(encodeChain(3))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(decoded).To(Equal(map[string][]string{"a": {"", "", ""}}))
+		for _, numRules := range []uint64{1 << 30, 1 << 40, 1<<64 - 1} {
+			_, err = DecodeHashes(encodeChain(numRules))
+			Expect(err).To(HaveOccurred(), fmt.Sprintf("%d rules", numRules))
+		}
+	})
+
+	It("should reject trailing bytes and unknown versions", func() {
+		encoded := EncodeHashes(map[string][]string{"cali-foo": {"0123456789abcdef"}})
+		_, err := DecodeHashes(append(encoded, 0))
+		Expect(err).To(HaveOccurred())
+		encoded[0] = 99
+		_, err = DecodeHashes(encoded)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should compact a snapshot of the Table's view of the dataplane", func() {
+		dataplane := newMockDataplane("filter", map[string][]string{
+			"FORWARD": {"-j ACCEPT"},
+			"INPUT":   {},
+			"OUTPUT":  {},
+		})
+		table := dataplane.newTable(nil)
+		table.UpdateChain(&Chain{Name: "cali-foo", Rules: []Rule{{Action: DropAction{}}}})
+		table.SetRuleInsertions("FORWARD", []Rule{{Action: JumpAction{Target: "cali-foo"}}})
+		table.Apply()
+
+		snap := table.Snapshot()
+		snap.CompactDataplaneHashes()
+		Expect(snap.DataplaneHashes).To(BeNil())
+		decoded, err := DecodeHashes(snap.EncodedDataplaneHashes)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(decoded["cali-foo"]).To(HaveLen(1))
+		Expect(decoded["FORWARD"]).To(HaveLen(2))
+		Expect(decoded["FORWARD"][0]).NotTo(BeEmpty())
+		Expect(decoded["FORWARD"][1]).To(BeEmpty())
+	})
+})
@@ -0,0 +1,225 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"regexp"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// MinHashEntropyBits is the minimum number of bits of entropy that we allow in a rule hash.
+// Collisions between hashes in the same chain would cause us to miss updates so we don't allow
+// the hash to be shortened below this, whatever the configuration.
+const MinHashEntropyBits = 64
+
+// HashAlphabet is the character set used to encode rule hashes in the rule comments.
+type HashAlphabet string
+
+const (
+	// HashAlphabetBase64URL is the URL-safe base64 alphabet ("A-Za-z0-9-_"), which gives 6
+	// bits per character.  This is the default.
+	HashAlphabetBase64URL HashAlphabet = "base64url"
+	// HashAlphabetHex is lower-case hex, which gives only 4 bits per character but survives
+	// tools that fold case or that only pass through alphanumerics.
+	HashAlphabetHex HashAlphabet = "hex"
+)
+
+// allHashAlphabets lists the alphabets that we support; the hash comment regexp recognises
+// hashes written in any of them so that we can clean up after a change of format.
+var allHashAlphabets = []HashAlphabet{HashAlphabetBase64URL, HashAlphabetHex}
+
+// HashAlgorithm is the hash function used to calculate rule hashes.
+type HashAlgorithm string
+
+const (
+	// HashAlgorithmSHA224 is the algorithm that we've always used.  This is the default.
+	HashAlgorithmSHA224 HashAlgorithm = "sha224"
+	// HashAlgorithmSHA256 gives slightly longer hashes than SHA-224.
+	HashAlgorithmSHA256 HashAlgorithm = "sha256"
+	// HashAlgorithmSHA512 gives the longest hashes, for very large clusters that want to use
+	// long hashes to make collisions even less likely.
+	HashAlgorithmSHA512 HashAlgorithm = "sha512"
+)
+
+// allHashAlgorithms lists the algorithms that we support; the hash comment regexp recognises
+// hashes of the lengths that any of them can produce.
+var allHashAlgorithms = []HashAlgorithm{HashAlgorithmSHA224, HashAlgorithmSHA256, HashAlgorithmSHA512}
+
+// newHash returns a new hash.Hash that calculates the algorithm's hash.
+func (h HashAlgorithm) newHash() hash.Hash {
+	switch h {
+	case HashAlgorithmSHA224:
+		return sha256.New224()
+	case HashAlgorithmSHA256:
+		return sha256.New()
+	case HashAlgorithmSHA512:
+		return sha512.New()
+	}
+	log.WithField("algorithm", h).Panic("Unknown hash algorithm")
+	return nil
+}
+
+// size returns the number of bytes in the algorithm's hashes.
+func (h HashAlgorithm) size() int {
+	switch h {
+	case HashAlgorithmSHA224:
+		return sha256.Size224
+	case HashAlgorithmSHA256:
+		return sha256.Size
+	case HashAlgorithmSHA512:
+		return sha512.Size
+	}
+	log.WithField("algorithm", h).Panic("Unknown hash algorithm")
+	return 0
+}
+
+// HashFormat describes how rule hashes are calculated and encoded into the rule comments.
+type HashFormat struct {
+	// Length is the number of characters in each hash.  Zero means the alphabet's default
+	// (HashLength for base64url).
+	Length int
+	// Alphabet is the character set to use; empty means HashAlphabetBase64URL.
+	Alphabet HashAlphabet
+	// Algorithm is the hash function to use; empty means HashAlgorithmSHA224.
+	Algorithm HashAlgorithm
+	// Salt, if non-empty, is mixed into every hash so that the hashes of our rules can't be
+	// predicted (or deliberately collided with) without knowing it.  Changing it rewrites all
+	// our rules.
+	Salt string
+}
+
+// DefaultHashFormat is the format that we've always used: 16 characters of URL-safe base64,
+// giving 96 bits of entropy, taken from an unsalted SHA-224 hash.
+var DefaultHashFormat = HashFormat{
+	Length:    HashLength,
+	Alphabet:  HashAlphabetBase64URL,
+	Algorithm: HashAlgorithmSHA224,
+}
+
+// bitsPerChar returns the number of bits of entropy in each character of the hash.
+func (a HashAlphabet) bitsPerChar() int {
+	switch a {
+	case HashAlphabetBase64URL:
+		return 6
+	case HashAlphabetHex:
+		return 4
+	}
+	log.WithField("alphabet", a).Panic("Unknown hash alphabet")
+	return 0
+}
+
+// charClass returns the regexp character class that matches the alphabet's characters.
+func (a HashAlphabet) charClass() string {
+	switch a {
+	case HashAlphabetBase64URL:
+		return `a-zA-Z0-9_\-`
+	case HashAlphabetHex:
+		return "0-9a-f"
+	}
+	log.WithField("alphabet", a).Panic("Unknown hash alphabet")
+	return ""
+}
+
+// minLength returns the shortest hash, in the alphabet, that has at least MinHashEntropyBits
+// of entropy.
+func (a HashAlphabet) minLength() int {
+	bits := a.bitsPerChar()
+	return (MinHashEntropyBits + bits - 1) / bits
+}
+
+// maxLength returns the length of a whole (untruncated) hash of the given algorithm, in the
+// alphabet.
+func (a HashAlphabet) maxLength(h HashAlgorithm) int {
+	bits := a.bitsPerChar()
+	return (h.size()*8 + bits - 1) / bits
+}
+
+// encode encodes the given hash in the alphabet, truncating it to the given length.
+func (a HashAlphabet) encode(hash []byte, length int) string {
+	switch a {
+	case HashAlphabetBase64URL:
+		// We use the URL-safe base64 variant because it uses '-' and '_', which are more
+		// shell-friendly.
+		return base64.RawURLEncoding.EncodeToString(hash)[:length]
+	case HashAlphabetHex:
+		return hex.EncodeToString(hash)[:length]
+	}
+	log.WithField("alphabet", a).Panic("Unknown hash alphabet")
+	return ""
+}
+
+// withDefaults returns a copy of the HashFormat with its defaults filled in and its length
+// clamped to the range that the alphabet and algorithm support.  It panics if the alphabet or
+// algorithm is unknown.
+func (f HashFormat) withDefaults() HashFormat {
+	if f.Alphabet == "" {
+		f.Alphabet = HashAlphabetBase64URL
+	}
+	if f.Algorithm == "" {
+		f.Algorithm = HashAlgorithmSHA224
+	}
+	if f.Length == 0 {
+		// Default to the same entropy as the default format.
+		bits := f.Alphabet.bitsPerChar()
+		f.Length = (HashLength*6 + bits - 1) / bits
+	} else if f.Length < f.Alphabet.minLength() {
+		f.Length = f.Alphabet.minLength()
+	} else if f.Length > f.Alphabet.maxLength(f.Algorithm) {
+		f.Length = f.Alphabet.maxLength(f.Algorithm)
+	}
+	return f
+}
+
+// hashCommentPattern returns the pattern for a regexp that matches the rule-tracking comment
+// with any of the given prefixes, capturing the prefix and then the hash.  The comment looks
+// like this: --comment "cali:abcd1234_-".
+//
+// Rather than only matching the configured format, the pattern matches hashes of any length,
+// alphabet and algorithm that we could have written, so that rules written by a Felix with a
+// different hash format are still recognised as ours and rewritten.
+func hashCommentPattern(hashPrefixes ...string) string {
+	var charClasses []string
+	minLength, maxLength := 0, 0
+	for _, a := range allHashAlphabets {
+		charClasses = append(charClasses, a.charClass())
+		if minLength == 0 || a.minLength() < minLength {
+			minLength = a.minLength()
+		}
+		for _, h := range allHashAlgorithms {
+			if a.maxLength(h) > maxLength {
+				maxLength = a.maxLength(h)
+			}
+		}
+	}
+	// Try the longest prefix first so that a prefix that extends another is matched in full.
+	quoted := make([]string, len(hashPrefixes))
+	for i, prefix := range hashPrefixes {
+		quoted[i] = regexp.QuoteMeta(prefix)
+	}
+	sort.SliceStable(quoted, func(i, j int) bool {
+		return len(quoted[i]) > len(quoted[j])
+	})
+	return fmt.Sprintf(`--comment "?(%s)([%s]{%d,%d})(?:"|\s|$)`,
+		strings.Join(quoted, "|"), strings.Join(charClasses, ""), minLength, maxLength)
+}
@@ -0,0 +1,137 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/projectcalico/felix/iptables"
+)
+
+var _ = Describe("Rule hash formats", func() {
+	chain := &Chain{Name: "cali-foo", Rules: []Rule{{Action: DropAction{}}, {Action: AcceptAction{}}}}
+
+	It("should default to 16 characters of base64", func() {
+		hashes := chain.RuleHashesWithFormat(nil, HashFormat{})
+		Expect(hashes).To(Equal(chain.RuleHashes(nil)))
+		Expect(hashes[0]).To(MatchRegexp("^[a-zA-Z0-9_-]{16}$"))
+	})
+
+	It("should support hex with the same default entropy", func() {
+		hashes := chain.RuleHashesWithFormat(nil, HashFormat{Alphabet: HashAlphabetHex})
+		Expect(hashes[0]).To(MatchRegexp("^[0-9a-f]{24}$"))
+		Expect(hashes[1]).NotTo(Equal(hashes[0]))
+	})
+
+	It("should honour a configured length", func() {
+		hashes := chain.RuleHashesWithFormat(nil, HashFormat{Length: 12})
+		Expect(hashes[0]).To(HaveLen(12))
+		Expect(chain.RuleHashes(nil)[0]).To(HavePrefix(hashes[0]))
+	})
+
+	It("should enforce the minimum entropy", func() {
+		Expect(chain.RuleHashesWithFormat(nil, HashFormat{Length: 4})[0]).To(HaveLen(11))
+		Expect(chain.RuleHashesWithFormat(nil, HashFormat{Length: 4, Alphabet: HashAlphabetHex})[0]).To(HaveLen(16))
+	})
+
+	It("should cap the length at the length of the whole hash", func() {
+		Expect(chain.RuleHashesWithFormat(nil, HashFormat{Length: 100})[0]).To(HaveLen(38))
+		Expect(chain.RuleHashesWithFormat(nil, HashFormat{Length: 100, Alphabet: HashAlphabetHex})[0]).To(HaveLen(56))
+	})
+
+	It("should support other algorithms", func() {
+		Expect(chain.RuleHashesWithFormat(nil, HashFormat{Algorithm: HashAlgorithmSHA224})).To(
+			Equal(chain.RuleHashes(nil)))
+		sha256Hashes := chain.RuleHashesWithFormat(nil, HashFormat{Algorithm: HashAlgorithmSHA256})
+		Expect(sha256Hashes[0]).To(HaveLen(16))
+		Expect(sha256Hashes[0]).NotTo(Equal(chain.RuleHashes(nil)[0]))
+		Expect(chain.RuleHashesWithFormat(nil, HashFormat{Length: 200, Algorithm: HashAlgorithmSHA256})[0]).To(HaveLen(43))
+		Expect(chain.RuleHashesWithFormat(nil, HashFormat{Length: 200, Algorithm: HashAlgorithmSHA512})[0]).To(HaveLen(86))
+	})
+
+	It("should mix in the salt", func() {
+		salted := chain.RuleHashesWithFormat(nil, HashFormat{Salt: "secret"})
+		Expect(salted[0]).NotTo(Equal(chain.RuleHashes(nil)[0]))
+		Expect(salted[1]).NotTo(Equal(chain.RuleHashes(nil)[1]))
+		Expect(chain.RuleHashesWithFormat(nil, HashFormat{Salt: "secret"})).To(Equal(salted))
+		Expect(chain.RuleHashesWithFormat(nil, HashFormat{Salt: "other"})[0]).NotTo(Equal(salted[0]))
+	})
+
+	Describe("with a Table", func() {
+		var dataplane *mockDataplane
+
+		newTable := func(format HashFormat) *Table {
+			return dataplane.newTable(func(options *TableOptions) {
+				options.HashFormat = format
+			})
+		}
+
+		program := func(table *Table) {
+			table.UpdateChain(&Chain{Name: "cali-foo", Rules: []Rule{{Action: DropAction{}}}})
+			table.SetRuleInsertions("FORWARD", []Rule{{Action: JumpAction{Target: "cali-foo"}}})
+			table.Apply()
+		}
+
+		BeforeEach(func() {
+			dataplane = newMockDataplane("filter", map[string][]string{
+				"FORWARD": {"-j ACCEPT"},
+				"INPUT":   {},
+				"OUTPUT":  {},
+			})
+		})
+
+		It("should write hashes in the configured format", func() {
+			program(newTable(HashFormat{Alphabet: HashAlphabetHex, Length: 20}))
+			Expect(dataplane.Chains["cali-foo"][0]).To(MatchRegexp(`--comment "cali:[0-9a-f]{20}"`))
+			Expect(dataplane.Chains["FORWARD"][0]).To(MatchRegexp(`--comment "cali:[0-9a-f]{20}"`))
+		})
+
+		It("should replace rules written in a different format", func() {
+			program(newTable(HashFormat{Alphabet: HashAlphabetHex}))
+			hexForward := append([]string(nil), dataplane.Chains["FORWARD"]...)
+
+			program(newTable(HashFormat{}))
+			Expect(dataplane.Chains["FORWARD"]).To(HaveLen(2))
+			Expect(dataplane.Chains["FORWARD"][0]).NotTo(Equal(hexForward[0]))
+			Expect(dataplane.Chains["FORWARD"][0]).To(MatchRegexp(`--comment "cali:[a-zA-Z0-9_-]{16}"`))
+			Expect(dataplane.Chains["FORWARD"][1]).To(Equal("-j ACCEPT"))
+			Expect(dataplane.Chains["cali-foo"]).To(HaveLen(1))
+			Expect(dataplane.Chains["cali-foo"][0]).To(MatchRegexp(`--comment "cali:[a-zA-Z0-9_-]{16}"`))
+		})
+
+		It("should replace long hashes written with a different algorithm", func() {
+			program(newTable(HashFormat{Algorithm: HashAlgorithmSHA512, Alphabet: HashAlphabetHex, Length: 128}))
+			Expect(dataplane.Chains["cali-foo"][0]).To(MatchRegexp(`--comment "cali:[0-9a-f]{128}"`))
+
+			program(newTable(HashFormat{}))
+			Expect(dataplane.Chains["FORWARD"]).To(HaveLen(2))
+			Expect(dataplane.Chains["FORWARD"][0]).To(MatchRegexp(`--comment "cali:[a-zA-Z0-9_-]{16}"`))
+			Expect(dataplane.Chains["FORWARD"][1]).To(Equal("-j ACCEPT"))
+			Expect(dataplane.Chains["cali-foo"]).To(HaveLen(1))
+			Expect(dataplane.Chains["cali-foo"][0]).To(MatchRegexp(`--comment "cali:[a-zA-Z0-9_-]{16}"`))
+		})
+
+		It("should replace rules written with a different salt", func() {
+			program(newTable(HashFormat{Salt: "old"}))
+			oldForward := dataplane.Chains["FORWARD"][0]
+
+			program(newTable(HashFormat{Salt: "new"}))
+			Expect(dataplane.Chains["FORWARD"]).To(HaveLen(2))
+			Expect(dataplane.Chains["FORWARD"][0]).NotTo(Equal(oldForward))
+			Expect(dataplane.Chains["FORWARD"][1]).To(Equal("-j ACCEPT"))
+		})
+	})
+})
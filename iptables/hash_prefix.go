@@ -0,0 +1,87 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"regexp"
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Changing the hash comment prefix
+//
+// A deployment can change the prefix of our rule-tracking comments, for example, to rebrand its
+// rules, without restarting and without leaving the rules with the old prefix behind:
+//
+// - We write the new prefix straight away and "retire" the old one.  Rules that carry a retired
+//   prefix look like out-of-date rules of ours.
+// - Rather than rewriting all our chains at once, which could be a very large write, we leave
+//   the old rules in place until the next read of the dataplane (the periodic refresh or an
+//   invalidation) marks their chains and inserts for resync.
+// - Once a read finds no rules with a retired prefix, we stop recognising it so that we don't
+//   touch rules that another agent writes with that prefix.
+
+// setHashCommentPrefix changes the prefix that we write on our rule-tracking comments, retiring
+// the old prefix.
+func (t *Table) setHashCommentPrefix(prefix string) {
+	if prefix == t.hashCommentPrefix {
+		return
+	}
+	t.logCxt.WithFields(log.Fields{
+		"oldPrefix": t.hashCommentPrefix,
+		"newPrefix": prefix,
+	}).Info("Changing hash comment prefix, rules with the old prefix will be replaced")
+	t.retiredHashPrefixes[t.hashCommentPrefix] = true
+	delete(t.retiredHashPrefixes, prefix)
+	t.hashCommentPrefix = prefix
+	t.updateHashCommentRegexp()
+	if t.refreshInterval <= 0 {
+		// No periodic refresh to find the old rules for us.
+		t.requestInvalidation("hash comment prefix changed")
+	}
+}
+
+// finishHashPrefixTransitions stops recognising any retired prefixes that the last read of the
+// dataplane found no rules for.
+func (t *Table) finishHashPrefixTransitions() {
+	changed := false
+	for prefix, count := range t.retiredHashPrefixCounts {
+		if count > 0 || !t.retiredHashPrefixes[prefix] {
+			continue
+		}
+		t.logCxt.WithField("prefix", prefix).Info(
+			"No rules left with retired hash comment prefix, no longer recognising it")
+		delete(t.retiredHashPrefixes, prefix)
+		changed = true
+	}
+	t.retiredHashPrefixCounts = nil
+	if changed {
+		t.updateHashCommentRegexp()
+	}
+}
+
+// updateHashCommentRegexp recalculates hashCommentRegexp from our current, secondary and
+// retired prefixes.
+func (t *Table) updateHashCommentRegexp() {
+	prefixes := append([]string{t.hashCommentPrefix}, t.secondaryHashPrefixes...)
+	var retired []string
+	for prefix := range t.retiredHashPrefixes {
+		retired = append(retired, prefix)
+	}
+	sort.Strings(retired)
+	prefixes = append(prefixes, retired...)
+	t.hashCommentRegexp = regexp.MustCompile(hashCommentPattern(prefixes...))
+}
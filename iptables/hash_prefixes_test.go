@@ -0,0 +1,222 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables_test
+
+import (
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/projectcalico/felix/iptables"
+)
+
+var _ = Describe("Table with secondary hash prefixes", func() {
+	// A rule inserted by another agent that uses its own hash prefix.
+	const otherAgentRule = `-m comment --comment "other:abcdefghij1234-_" --jump other-agent`
+
+	var dataplane *mockDataplane
+
+	newTable := func(hashPrefix string, secondaryPrefixes ...string) *Table {
+		return dataplane.newCustomTable(4, hashPrefix, func(options *TableOptions) {
+			options.SecondaryHashPrefixes = secondaryPrefixes
+		})
+	}
+
+	program := func(table *Table) {
+		table.SetRuleInsertions("FORWARD", []Rule{{Action: JumpAction{Target: "cali-FORWARD"}}})
+		table.UpdateChain(&Chain{
+			Name:  "cali-FORWARD",
+			Rules: []Rule{{Action: AcceptAction{}}},
+		})
+		table.Apply()
+	}
+
+	countWithPrefix := func(rules []string, prefix string) int {
+		n := 0
+		for _, r := range rules {
+			if strings.Contains(r, `"`+prefix) {
+				n++
+			}
+		}
+		return n
+	}
+
+	BeforeEach(func() {
+		dataplane = newMockDataplane("filter", map[string][]string{
+			"FORWARD": {otherAgentRule},
+			"INPUT":   {},
+			"OUTPUT":  {},
+		})
+		// Program the dataplane as an older Felix that used a different prefix.
+		program(newTable("old:"))
+		Expect(countWithPrefix(dataplane.Chains["FORWARD"], "old:")).To(Equal(1))
+		Expect(countWithPrefix(dataplane.Chains["cali-FORWARD"], "old:")).To(Equal(1))
+	})
+
+	It("should take over rules with a secondary prefix", func() {
+		program(newTable("cali:", "old:"))
+		Expect(dataplane.Chains["FORWARD"]).To(HaveLen(2))
+		Expect(countWithPrefix(dataplane.Chains["FORWARD"], "old:")).To(BeZero())
+		Expect(countWithPrefix(dataplane.Chains["FORWARD"], "cali:")).To(Equal(1))
+		Expect(dataplane.Chains["cali-FORWARD"]).To(HaveLen(1))
+		Expect(countWithPrefix(dataplane.Chains["cali-FORWARD"], "cali:")).To(Equal(1))
+	})
+
+	It("should leave rules with other prefixes alone", func() {
+		program(newTable("cali:", "old:"))
+		Expect(dataplane.Chains["FORWARD"]).To(ContainElement(otherAgentRule))
+	})
+
+	It("should remove rules with a secondary prefix that we no longer want", func() {
+		table := newTable("cali:", "old:")
+		table.Apply()
+		Expect(dataplane.Chains["FORWARD"]).To(Equal([]string{otherAgentRule}))
+		Expect(dataplane.Chains).NotTo(HaveKey("cali-FORWARD"))
+	})
+})
+
+var _ = Describe("Table hash comment prefix changes", func() {
+	// A rule that another agent writes with the prefix that we used to use.
+	const otherAgentRule = `-m comment --comment "cali:abcdefghij1234-_" --jump other-agent`
+
+	var dataplane *mockDataplane
+	var table *Table
+
+	newTable := func(hashPrefix string, refreshInterval time.Duration, retiredPrefixes ...string) *Table {
+		return dataplane.newCustomTable(4, hashPrefix, func(options *TableOptions) {
+			options.RefreshInterval = refreshInterval
+			options.DisablePostWriteChecks = true
+			options.RetiredHashPrefixes = retiredPrefixes
+		})
+	}
+
+	program := func(table *Table) {
+		table.SetRuleInsertions("FORWARD", []Rule{{Action: JumpAction{Target: "cali-FORWARD"}}})
+		table.UpdateChain(&Chain{
+			Name:  "cali-FORWARD",
+			Rules: []Rule{{Action: AcceptAction{}}},
+		})
+		table.Apply()
+	}
+
+	countWithPrefix := func(prefix string) int {
+		n := 0
+		for _, chain := range []string{"FORWARD", "cali-FORWARD"} {
+			for _, r := range dataplane.Chains[chain] {
+				if strings.Contains(r, `"`+prefix) {
+					n++
+				}
+			}
+		}
+		return n
+	}
+
+	// expectOtherAgentRuleLeftAlone checks that we no longer recognise the old prefix.
+	expectOtherAgentRuleLeftAlone := func() {
+		dataplane.Chains["FORWARD"] = append(dataplane.Chains["FORWARD"], otherAgentRule)
+		table.InvalidateDataplaneCache("test")
+		table.Apply()
+		Expect(dataplane.Chains["FORWARD"]).To(ContainElement(otherAgentRule))
+	}
+
+	BeforeEach(func() {
+		dataplane = newMockDataplane("filter", map[string][]string{
+			"FORWARD": {},
+			"INPUT":   {},
+			"OUTPUT":  {},
+		})
+	})
+
+	Describe("after a change at runtime", func() {
+		BeforeEach(func() {
+			table = newTable("cali:", time.Minute)
+			program(table)
+			Expect(countWithPrefix("cali:")).To(Equal(2))
+
+			Expect(table.UpdateTuning(Tuning{
+				RefreshInterval:   time.Minute,
+				HashCommentPrefix: "acme:",
+			})).To(Succeed())
+			Expect(table.Tuning().HashCommentPrefix).To(Equal("acme:"))
+		})
+
+		It("should leave the old rules until the next refresh", func() {
+			dataplane.ResetCmds()
+			table.Apply()
+			Expect(dataplane.CmdNames).To(BeEmpty())
+			Expect(countWithPrefix("cali:")).To(Equal(2))
+		})
+
+		It("should write new rules with the new prefix", func() {
+			table.UpdateChain(&Chain{
+				Name:  "cali-INPUT",
+				Rules: []Rule{{Action: DropAction{}}},
+			})
+			table.Apply()
+			Expect(dataplane.Chains["cali-INPUT"]).To(HaveLen(1))
+			Expect(dataplane.Chains["cali-INPUT"][0]).To(ContainSubstring(`"acme:`))
+		})
+
+		Describe("after the next refresh", func() {
+			BeforeEach(func() {
+				dataplane.AdvanceTimeBy(2 * time.Minute)
+				table.Apply()
+			})
+
+			It("should have replaced the old rules", func() {
+				Expect(countWithPrefix("cali:")).To(BeZero())
+				Expect(countWithPrefix("acme:")).To(Equal(2))
+				Expect(dataplane.Chains["FORWARD"]).To(HaveLen(1))
+				Expect(dataplane.Chains["cali-FORWARD"]).To(HaveLen(1))
+			})
+
+			It("should stop recognising the old prefix once its rules are gone", func() {
+				dataplane.AdvanceTimeBy(2 * time.Minute)
+				table.Apply()
+				expectOtherAgentRuleLeftAlone()
+				Expect(countWithPrefix("acme:")).To(Equal(2))
+			})
+		})
+	})
+
+	It("should replace the old rules on the next Apply() if periodic refresh is disabled", func() {
+		table = newTable("cali:", 0)
+		program(table)
+		Expect(table.UpdateTuning(Tuning{HashCommentPrefix: "acme:"})).To(Succeed())
+		table.Apply()
+		Expect(countWithPrefix("cali:")).To(BeZero())
+		Expect(countWithPrefix("acme:")).To(Equal(2))
+	})
+
+	It("should reject a prefix that can't be written in a comment", func() {
+		table = newTable("cali:", time.Minute)
+		Expect(table.UpdateTuning(Tuning{RefreshInterval: time.Minute, HashCommentPrefix: `acme"`})).NotTo(Succeed())
+		Expect(table.Tuning().HashCommentPrefix).To(Equal("cali:"))
+	})
+
+	It("should take over rules with a retired prefix at start of day", func() {
+		program(newTable("cali:", time.Minute))
+		table = newTable("acme:", time.Minute, "cali:")
+		program(table)
+		Expect(countWithPrefix("cali:")).To(BeZero())
+		Expect(countWithPrefix("acme:")).To(Equal(2))
+
+		dataplane.AdvanceTimeBy(2 * time.Minute)
+		table.Apply()
+		expectOtherAgentRuleLeftAlone()
+	})
+})
@@ -0,0 +1,102 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"sort"
+	"time"
+)
+
+// Hook chains are chains that belong to another program, such as Docker's DOCKER-USER or
+// kube-proxy's KUBE-FORWARD, that we insert rules into as we do for the kernel chains.  Unlike
+// the kernel chains, they may not exist yet, or their owner may delete and recreate them, and
+// inserting into a missing chain would fail the whole iptables-restore.  So, while a chain is
+// missing, we hold back its inserts and re-read the dataplane every hookChainRecheckInterval
+// until it appears.
+
+const hookChainRecheckInterval = 10 * time.Second
+
+// hookChainMissing returns true, and records the chain as missing, if we have inserts for the
+// given chain but it isn't a kernel chain and it isn't in the dataplane.
+func (t *Table) hookChainMissing(chainName string) bool {
+	if t.isKernelChain(chainName) {
+		return false
+	}
+	if _, ok := t.chainToDataplaneHashes[chainName]; ok {
+		return false
+	}
+	if len(t.chainToInsertedRules[chainName]) == 0 {
+		// Nothing to insert and nothing to clean up.
+		return true
+	}
+	if !t.missingHookChains[chainName] {
+		t.logCxt.WithField("chainName", chainName).Warn(
+			"Chain that we insert rules into doesn't exist, will program inserts once it appears")
+		t.missingHookChains[chainName] = true
+		t.reportOutOfSync(chainName, OutOfSyncHookChainMissing)
+	}
+	return true
+}
+
+// checkHookChains is called after loading the dataplane; it queues the inserts for any missing
+// hook chains that have appeared.
+func (t *Table) checkHookChains(dataplaneHashes map[string][]string) {
+	for chainName := range t.missingHookChains {
+		if len(t.chainToInsertedRules[chainName]) == 0 {
+			delete(t.missingHookChains, chainName)
+			continue
+		}
+		if _, ok := dataplaneHashes[chainName]; !ok {
+			continue
+		}
+		t.logCxt.WithField("chainName", chainName).Info("Chain that we insert rules into has appeared")
+		delete(t.missingHookChains, chainName)
+		t.dirtyInserts.Add(chainName)
+	}
+}
+
+// maybeRecheckHookChains invalidates the dataplane cache if we're waiting for a hook chain to
+// appear and it's time to look again.
+func (t *Table) maybeRecheckHookChains(now time.Time) {
+	if len(t.missingHookChains) == 0 {
+		return
+	}
+	if now.Sub(t.lastReadTime) >= hookChainRecheckInterval {
+		t.invalidateDataplaneCache("waiting for hook chain")
+	}
+}
+
+// nextHookChainRecheck returns the time until we should next look for missing hook chains, if
+// there are any.
+func (t *Table) nextHookChainRecheck(now time.Time) (time.Duration, bool) {
+	if len(t.missingHookChains) == 0 {
+		return 0, false
+	}
+	remaining := t.lastReadTime.Add(hookChainRecheckInterval).Sub(now)
+	if remaining <= 0 {
+		remaining = 1 * time.Millisecond
+	}
+	return remaining, true
+}
+
+// sortedMissingHookChains returns the hook chains that we're waiting for, sorted by name.
+func (t *Table) sortedMissingHookChains() []string {
+	chains := make([]string, 0, len(t.missingHookChains))
+	for chainName := range t.missingHookChains {
+		chains = append(chains, chainName)
+	}
+	sort.Strings(chains)
+	return chains
+}
@@ -0,0 +1,119 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables_test
+
+import (
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/projectcalico/felix/iptables"
+)
+
+var _ = Describe("Table hook chains", func() {
+	var dataplane *mockDataplane
+	var table *Table
+	var outOfSync []string
+
+	ourInsert := []Rule{{Action: DropAction{}}}
+
+	BeforeEach(func() {
+		outOfSync = nil
+		dataplane = newMockDataplane("filter", map[string][]string{
+			"FORWARD": {},
+			"INPUT":   {},
+			"OUTPUT":  {},
+			// Left over from a previous run.
+			"KUBE-FORWARD": {"-m comment --comment \"cali:abcdefghij1234-_\" --jump DROP", "-j ACCEPT"},
+		})
+		table = dataplane.newTable(func(options *TableOptions) {
+			options.HookChains = []string{"filter/DOCKER-USER", "filter/KUBE-FORWARD"}
+			options.OnOutOfSync = func(chainName, reason string) {
+				outOfSync = append(outOfSync, chainName+":"+reason)
+			}
+		})
+		table.Apply()
+	})
+
+	It("should clean up old inserts in a hook chain", func() {
+		Expect(dataplane.Chains["KUBE-FORWARD"]).To(Equal([]string{"-j ACCEPT"}))
+	})
+
+	It("should insert into an existing hook chain", func() {
+		table.SetRuleInsertions("KUBE-FORWARD", ourInsert)
+		table.Apply()
+		Expect(dataplane.Chains["KUBE-FORWARD"]).To(HaveLen(2))
+		Expect(dataplane.Chains["KUBE-FORWARD"][0]).To(ContainSubstring("DROP"))
+	})
+
+	Describe("with inserts for a missing chain", func() {
+		var rescheduleAfter time.Duration
+
+		BeforeEach(func() {
+			table.SetRuleInsertions("DOCKER-USER", ourInsert)
+			rescheduleAfter, _ = table.Apply()
+		})
+
+		It("should hold back the inserts", func() {
+			Expect(dataplane.Chains).NotTo(HaveKey("DOCKER-USER"))
+			Expect(outOfSync).To(Equal([]string{"DOCKER-USER:" + OutOfSyncHookChainMissing}))
+			Expect(table.Snapshot().MissingHookChains).To(Equal([]string{"DOCKER-USER"}))
+		})
+
+		It("should reschedule to look for the chain", func() {
+			Expect(rescheduleAfter).To(BeNumerically(">", 0))
+			Expect(rescheduleAfter).To(BeNumerically("<=", 10*time.Second))
+		})
+
+		It("should program the inserts once the chain appears", func() {
+			dataplane.Chains["DOCKER-USER"] = []string{"-j RETURN"}
+			table.Apply()
+			Expect(dataplane.Chains["DOCKER-USER"]).To(HaveLen(1))
+
+			dataplane.AdvanceTimeBy(11 * time.Second)
+			table.Apply()
+			Expect(dataplane.Chains["DOCKER-USER"]).To(HaveLen(2))
+			Expect(dataplane.Chains["DOCKER-USER"][0]).To(ContainSubstring("DROP"))
+			Expect(dataplane.Chains["DOCKER-USER"][1]).To(Equal("-j RETURN"))
+			Expect(table.Snapshot().MissingHookChains).To(BeEmpty())
+		})
+
+		It("should cope with the chain being recreated", func() {
+			dataplane.Chains["DOCKER-USER"] = []string{"-j RETURN"}
+			dataplane.AdvanceTimeBy(11 * time.Second)
+			table.Apply()
+			Expect(dataplane.Chains["DOCKER-USER"]).To(HaveLen(2))
+
+			delete(dataplane.Chains, "DOCKER-USER")
+			table.InvalidateDataplaneCache("test")
+			table.Apply()
+			Expect(dataplane.Chains).NotTo(HaveKey("DOCKER-USER"))
+
+			dataplane.Chains["DOCKER-USER"] = []string{"-j RETURN"}
+			dataplane.AdvanceTimeBy(11 * time.Second)
+			table.Apply()
+			Expect(dataplane.Chains["DOCKER-USER"]).To(HaveLen(2))
+			Expect(strings.Join(outOfSync, ",")).To(ContainSubstring("DOCKER-USER:" + OutOfSyncInsertsModified))
+		})
+
+		It("should forget the chain if the inserts are removed", func() {
+			table.SetRuleInsertions("DOCKER-USER", nil)
+			table.Apply()
+			Expect(table.Snapshot().MissingHookChains).To(BeEmpty())
+		})
+	})
+})
@@ -0,0 +1,93 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"bytes"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// MissingHook describes one of the rules that we insert into a kernel chain that
+// CheckKernelHooks couldn't find in the dataplane.
+type MissingHook struct {
+	Chain string
+	// Rule is the rule as we'd render it, including our hash comment.
+	Rule string
+}
+
+// CheckKernelHooks checks that each of the rules that we insert into the kernel chains (see
+// SetRuleInsertions) is present in the dataplane, using "iptables -C".  Unlike the hash
+// comparison that Apply() does, it doesn't rely on our cache of the dataplane state so it can be
+// used to confirm that our hooks really are in place, for example, before reporting ready after
+// a restart: if the jump from FORWARD into our chains is missing, none of our policy is
+// enforced.  A rule for which the check fails for any reason is reported as missing.
+//
+// Returns nil if we don't own the inserts (see TableOptions.InsertOwner).
+func (t *Table) CheckKernelHooks() []MissingHook {
+	t.opLock.Lock()
+	defer t.opLock.Unlock()
+
+	if !t.ownsInserts {
+		return nil
+	}
+
+	features := t.featureDetector.GetFeatures()
+	var missing []MissingHook
+	for _, chainName := range tableToKernelChains[t.Name] {
+		rules := t.chainToInsertedRules[chainName]
+		if len(rules) == 0 {
+			continue
+		}
+		hashes := t.calculateRuleInsertHashes(chainName, rules, features)
+		for i, rule := range rules {
+			line := t.renderer.RenderAppend(rule, chainName, t.commentFrag(hashes[i]), features)
+			if err := t.checkRule(line, features); err != nil {
+				t.logCxt.WithError(err).WithFields(log.Fields{
+					"chainName": chainName,
+					"rule":      line,
+				}).Warn("Rule missing from kernel chain")
+				missing = append(missing, MissingHook{Chain: chainName, Rule: line})
+			}
+		}
+	}
+	return missing
+}
+
+// checkRule runs "iptables -C" for the given rule, which should be rendered as an append.
+// Returns an error if the rule isn't present or if the check fails.
+func (t *Table) checkRule(appendLine string, features *Features) error {
+	// Our rules are rendered for iptables-restore so they need to be split into arguments,
+	// removing the quotes, and the "-A" needs to become "-C".
+	args := []string{"-t", t.Name}
+	if features.RestoreSupportsLock {
+		// Any iptables that is new enough for the restore command to take the xtables lock
+		// can wait for it here too.
+		args = append(args, "-w")
+	}
+	args = append(args, "-C")
+	args = append(args, splitRuleTokens(appendLine)[1:]...)
+	var errBuf bytes.Buffer
+	cmd := t.newCmd(t.iptablesCmd, args...)
+	cmd.SetStderr(&errBuf)
+
+	t.calicoXtablesLock.Lock()
+	defer t.calicoXtablesLock.Unlock()
+	if err := cmd.Run(); err != nil {
+		t.logCxt.WithField("stderr", errBuf.String()).Debug("iptables -C failed")
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/projectcalico/felix/iptables"
+)
+
+var _ = Describe("Table kernel hook checks", func() {
+	var dataplane *mockDataplane
+	var table *Table
+	var insertOwner *fakeInsertOwner
+
+	BeforeEach(func() {
+		dataplane = newMockDataplane("filter", map[string][]string{
+			"FORWARD": {"-j some-other-rule"},
+			"INPUT":   {},
+			"OUTPUT":  {},
+		})
+		insertOwner = &fakeInsertOwner{owns: true}
+		table = dataplane.newTable(func(options *TableOptions) {
+			options.InsertOwner = insertOwner
+		})
+		table.SetRuleInsertions("FORWARD", []Rule{
+			{Action: JumpAction{Target: "cali-FORWARD"}},
+			{Action: JumpAction{Target: "cali-from-hep-forward"}},
+		})
+		table.SetRuleInsertions("INPUT", []Rule{{Action: JumpAction{Target: "cali-INPUT"}}})
+		table.UpdateChains([]*Chain{
+			{Name: "cali-FORWARD"},
+			{Name: "cali-from-hep-forward"},
+			{Name: "cali-INPUT"},
+		})
+		table.Apply()
+	})
+
+	It("should find hooks that are in place", func() {
+		Expect(table.CheckKernelHooks()).To(BeEmpty())
+		Expect(dataplane.NumChecks).To(Equal(3))
+	})
+
+	It("should report a hook that was removed behind our back", func() {
+		dataplane.Chains["FORWARD"] = dataplane.Chains["FORWARD"][1:]
+		missing := table.CheckKernelHooks()
+		Expect(missing).To(HaveLen(1))
+		Expect(missing[0].Chain).To(Equal("FORWARD"))
+		Expect(missing[0].Rule).To(ContainSubstring("--jump cali-FORWARD"))
+	})
+
+	It("should report all the hooks if a chain was flushed", func() {
+		dataplane.Chains["INPUT"] = nil
+		dataplane.Chains["FORWARD"] = []string{"-j some-other-rule"}
+		Expect(table.CheckKernelHooks()).To(HaveLen(3))
+	})
+
+	It("should not check hooks when we don't own the inserts", func() {
+		insertOwner.owns = false
+		table.Apply()
+		dataplane.Chains["FORWARD"] = nil
+		Expect(table.CheckKernelHooks()).To(BeNil())
+		Expect(dataplane.NumChecks).To(BeZero())
+	})
+})
@@ -0,0 +1,126 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"errors"
+	"regexp"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// InsertAnchor identifies a rule of another agent, such as kube-proxy or firewalld, in a chain
+// that we insert rules into, that our inserted rules should be placed next to; see
+// SetRuleInsertionsAnchored.
+type InsertAnchor struct {
+	// Pattern is a regular expression that matches the anchor rule as printed by
+	// iptables-save, including the leading "-A <chain>".  For example, `-j KUBE-FIREWALL$`.
+	Pattern string
+	// Comment, if Pattern is empty, matches the rule with exactly this comment, such as the
+	// hash or ID that the other agent tags its rules with.
+	Comment string
+	// Before places our rules immediately before the anchor rule, rather than immediately
+	// after it.
+	Before bool
+}
+
+// insertAnchor is an InsertAnchor with its pattern compiled.
+type insertAnchor struct {
+	InsertAnchor
+	regexp *regexp.Regexp
+}
+
+func (a InsertAnchor) compile() (*insertAnchor, error) {
+	pattern := a.Pattern
+	if pattern == "" {
+		if a.Comment == "" {
+			return nil, errors.New("insert anchor needs a pattern or a comment")
+		}
+		pattern = `--comment "?` + regexp.QuoteMeta(a.Comment) + `(?:"|\s|$)`
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	return &insertAnchor{InsertAnchor: a, regexp: re}, nil
+}
+
+// SetRuleInsertionsAnchored is like SetRuleInsertions but, rather than following the insert
+// mode, it places our rules immediately before or after the first rule in the chain that
+// matches the anchor.  Resync moves our rules if other processes move the anchor rule, or our
+// rules, so that they stay next to it.  While the chain has no rule that matches the anchor, our
+// rules follow the insert mode.  Returns an error, without changing the insertions, if the
+// anchor is invalid.
+//
+// We only keep the text of other processes' rules in chains that have an anchor, so adding or
+// changing an anchor makes the next Apply re-read the dataplane to find the anchor rule.
+func (t *Table) SetRuleInsertionsAnchored(chainName string, anchor InsertAnchor, rules []Rule) error {
+	logCxt := t.logCxt.WithFields(log.Fields{
+		"chainName": chainName,
+		"anchor":    anchor,
+	})
+	logCxt.Debug("Updating anchored rule insertions")
+	compiled, err := anchor.compile()
+	if err != nil {
+		logCxt.WithError(err).Error("Invalid insert anchor")
+		return err
+	}
+	t.opLock.Lock()
+	defer t.opLock.Unlock()
+	delete(t.chainToInsertPosition, chainName)
+	if old := t.chainToInsertAnchor[chainName]; old == nil || old.InsertAnchor != anchor {
+		// Not rate limited: our rules would be out of place until the next refresh.
+		t.invalidateDataplaneCache("insert anchor changed")
+	}
+	t.chainToInsertAnchor[chainName] = compiled
+	t.setRuleInsertions(chainName, rules)
+	return nil
+}
+
+// anchorPosition returns the position, counted in non-Calico rules, at which our rules are next
+// to the anchor rule of the given chain, as of the last read of the dataplane.  Returns false if
+// the chain doesn't have an anchor or the anchor rule isn't in the chain.
+func (t *Table) anchorPosition(chainName string) (int, bool) {
+	anchor := t.chainToInsertAnchor[chainName]
+	if anchor == nil {
+		return 0, false
+	}
+	for i, line := range t.chainToDataplaneForeignRules[chainName] {
+		if !anchor.regexp.MatchString(line) {
+			continue
+		}
+		if anchor.Before {
+			return i, true
+		}
+		return i + 1, true
+	}
+	t.logCxt.WithField("chainName", chainName).Debug(
+		"Anchor rule not found, falling back to insert mode")
+	return 0, false
+}
+
+// insertPosition returns the position, counted in non-Calico rules, at which our inserted rules
+// should be placed in the given chain, if it has an anchor rule or an explicit position.
+// Returns false if our rules should follow the insert mode.
+func (t *Table) insertPosition(chainName string) (int, bool) {
+	if position, ok := t.anchorPosition(chainName); ok {
+		return position, true
+	}
+	if _, ok := t.chainToInsertAnchor[chainName]; ok {
+		return 0, false
+	}
+	position, ok := t.chainToInsertPosition[chainName]
+	return position, ok
+}
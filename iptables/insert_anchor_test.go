@@ -0,0 +1,176 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables_test
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/projectcalico/felix/iptables"
+)
+
+var _ = Describe("Table with anchored insertions", func() {
+	var dataplane *mockDataplane
+	var table *Table
+
+	ourRules := []Rule{
+		{Action: AcceptAction{}},
+		{Action: ReturnAction{}},
+	}
+
+	resync := func() {
+		dataplane.ResetCmds()
+		table.InvalidateDataplaneCache("test")
+		table.Apply()
+	}
+
+	expectOurRulesAt := func(chain []string, index int) {
+		Expect(chain[index]).To(MatchRegexp(`^-m comment --comment "cali:[^"]+" --jump ACCEPT$`))
+		Expect(chain[index+1]).To(MatchRegexp(`^-m comment --comment "cali:[^"]+" --jump RETURN$`))
+	}
+
+	BeforeEach(func() {
+		dataplane = newMockDataplane("filter", map[string][]string{
+			"FORWARD": {
+				`-m comment --comment "kubernetes forwarding rules" -j KUBE-FORWARD`,
+				"-j DOCKER-USER",
+			},
+			"INPUT":  {"-j KUBE-FIREWALL", "-j DROP"},
+			"OUTPUT": {},
+		})
+		table = dataplane.newTable(nil)
+	})
+
+	Describe("after the anchor", func() {
+		BeforeEach(func() {
+			Expect(table.SetRuleInsertionsAnchored("INPUT",
+				InsertAnchor{Pattern: `-j KUBE-FIREWALL$`}, ourRules)).To(Succeed())
+			table.Apply()
+		})
+
+		It("should insert our rules right after the anchor rule", func() {
+			input := dataplane.Chains["INPUT"]
+			Expect(input).To(HaveLen(4))
+			Expect(input[0]).To(Equal("-j KUBE-FIREWALL"))
+			expectOurRulesAt(input, 1)
+			Expect(input[3]).To(Equal("-j DROP"))
+		})
+
+		It("should leave our rules alone if another process inserts a rule above the anchor", func() {
+			dataplane.Chains["INPUT"] = append([]string{"-j OTHER"}, dataplane.Chains["INPUT"]...)
+			resync()
+			Expect(dataplane.CmdNames).To(Equal([]string{"iptables-save"}))
+		})
+
+		It("should follow the anchor rule if another process moves it", func() {
+			input := dataplane.Chains["INPUT"]
+			dataplane.Chains["INPUT"] = []string{input[1], input[2], input[3], input[0]}
+			resync()
+			input = dataplane.Chains["INPUT"]
+			Expect(input).To(HaveLen(4))
+			Expect(input[0]).To(Equal("-j DROP"))
+			Expect(input[1]).To(Equal("-j KUBE-FIREWALL"))
+			expectOurRulesAt(input, 2)
+		})
+
+		It("should move our rules back next to the anchor if another process separates them", func() {
+			input := dataplane.Chains["INPUT"]
+			dataplane.Chains["INPUT"] = []string{input[0], "-j OTHER", input[1], input[2], input[3]}
+			resync()
+			input = dataplane.Chains["INPUT"]
+			Expect(input).To(HaveLen(5))
+			Expect(input[0]).To(Equal("-j KUBE-FIREWALL"))
+			expectOurRulesAt(input, 1)
+			Expect(input[3]).To(Equal("-j OTHER"))
+		})
+
+		It("should fall back to the insert mode if the anchor rule goes away", func() {
+			dataplane.Chains["INPUT"] = dataplane.Chains["INPUT"][1:]
+			resync()
+			input := dataplane.Chains["INPUT"]
+			Expect(input).To(HaveLen(3))
+			expectOurRulesAt(input, 0)
+
+			By("moving our rules back when the anchor rule returns")
+			dataplane.Chains["INPUT"] = append(input, "-j KUBE-FIREWALL")
+			resync()
+			input = dataplane.Chains["INPUT"]
+			Expect(input).To(HaveLen(4))
+			Expect(input[0]).To(Equal("-j DROP"))
+			Expect(input[1]).To(Equal("-j KUBE-FIREWALL"))
+			expectOurRulesAt(input, 2)
+		})
+
+		It("should revert to the insert mode after SetRuleInsertions", func() {
+			table.SetRuleInsertions("INPUT", ourRules)
+			table.Apply()
+			input := dataplane.Chains["INPUT"]
+			Expect(input).To(HaveLen(4))
+			expectOurRulesAt(input, 0)
+		})
+	})
+
+	It("should find the anchor rule if the anchor is set while invalidations are rate limited", func() {
+		table = dataplane.newTable(func(options *TableOptions) {
+			options.PostWriteInterval = time.Hour
+			options.InvalidationBurst = 1
+			options.InvalidationRefillInterval = time.Minute
+		})
+		table.Apply()
+		table.SetRuleInsertions("OUTPUT", ourRules)
+		table.Apply()
+		dataplane.ResetCmds()
+
+		Expect(table.SetRuleInsertionsAnchored("INPUT",
+			InsertAnchor{Pattern: `-j KUBE-FIREWALL$`}, ourRules)).To(Succeed())
+		table.Apply()
+		Expect(dataplane.CmdNames[0]).To(Equal("iptables-save"))
+		input := dataplane.Chains["INPUT"]
+		Expect(input).To(HaveLen(4))
+		Expect(input[0]).To(Equal("-j KUBE-FIREWALL"))
+		expectOurRulesAt(input, 1)
+	})
+
+	It("should insert our rules right before the anchor rule", func() {
+		Expect(table.SetRuleInsertionsAnchored("INPUT",
+			InsertAnchor{Pattern: `-j DROP$`, Before: true}, ourRules)).To(Succeed())
+		table.Apply()
+		input := dataplane.Chains["INPUT"]
+		Expect(input).To(HaveLen(4))
+		Expect(input[0]).To(Equal("-j KUBE-FIREWALL"))
+		expectOurRulesAt(input, 1)
+		Expect(input[3]).To(Equal("-j DROP"))
+	})
+
+	It("should find the anchor rule by its comment", func() {
+		Expect(table.SetRuleInsertionsAnchored("FORWARD",
+			InsertAnchor{Comment: "kubernetes forwarding rules"}, ourRules)).To(Succeed())
+		table.Apply()
+		forward := dataplane.Chains["FORWARD"]
+		Expect(forward).To(HaveLen(4))
+		Expect(forward[0]).To(ContainSubstring("-j KUBE-FORWARD"))
+		expectOurRulesAt(forward, 1)
+		Expect(forward[3]).To(Equal("-j DOCKER-USER"))
+	})
+
+	It("should reject invalid anchors", func() {
+		Expect(table.SetRuleInsertionsAnchored("INPUT", InsertAnchor{}, ourRules)).NotTo(Succeed())
+		Expect(table.SetRuleInsertionsAnchored("INPUT", InsertAnchor{Pattern: "("}, ourRules)).NotTo(Succeed())
+		table.Apply()
+		Expect(dataplane.Chains["INPUT"]).To(Equal([]string{"-j KUBE-FIREWALL", "-j DROP"}))
+	})
+})
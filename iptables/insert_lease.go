@@ -0,0 +1,228 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// TakeoverLeaseDuration is the length of the lease granted by TakeOverInsertLease.  It is
+// long enough for the new owner to be (re)started and to start renewing the lease itself.
+const TakeoverLeaseDuration = 2 * time.Minute
+
+// InsertOwner decides whether a Table may program its rule insertions into the kernel chains
+// (INPUT, FORWARD and so on).  It allows two agents that share the same kernel chains, for
+// example, two Felix-derived agents during a migration, to agree which of them owns the inserts
+// rather than each repeatedly "repairing" the other's rules.
+type InsertOwner interface {
+	// OwnsInserts returns true if the Table should program its inserts.  It is called at the
+	// start of each Apply().
+	OwnsInserts() bool
+	// CheckInterval returns the maximum time between calls to OwnsInserts; the Table
+	// reschedules itself so that a lease is renewed (or taken up) in good time.
+	CheckInterval() time.Duration
+}
+
+// checkInsertOwnership asks our InsertOwner (if any) whether we own the inserts and returns
+// true if we've just gained ownership.
+func (t *Table) checkInsertOwnership() (gained bool) {
+	if t.insertOwner == nil {
+		return false
+	}
+	owns := t.insertOwner.OwnsInserts()
+	if owns == t.ownsInserts {
+		return false
+	}
+	t.ownsInserts = owns
+	if owns {
+		t.logCxt.Info("Gained ownership of inserts, will reprogram them")
+		return true
+	}
+	t.logCxt.Info("Lost ownership of inserts, leaving them to their new owner")
+	return false
+}
+
+// insertLeaseRecord is the content of an insert lease file.
+type insertLeaseRecord struct {
+	Owner  string    `json:"owner"`
+	Expiry time.Time `json:"expiry"`
+}
+
+type InsertLeaseOptions struct {
+	// NowOverride for tests, if non-nil, replacement for time.Now().
+	NowOverride func() time.Time
+}
+
+// InsertLease is an InsertOwner that is backed by an advisory lease file, shared by all the
+// agents on the host.  The lease names its owner and an expiry time.  The owner renews the
+// lease each time that it checks it; other agents leave the inserts alone until the lease
+// expires, at which point the first agent to check takes it over.  The file is only ever
+// accessed under an exclusive flock(), so agents never see a partially written lease; a lease
+// that can't be parsed (for example, after a crash mid-write) is treated as expired.
+//
+// An administrator can hand the lease to a particular agent with TakeOverInsertLease (the
+// "calico-felix take-over-inserts" command).
+type InsertLease struct {
+	path     string
+	owner    string
+	duration time.Duration
+
+	lock sync.Mutex
+	// owned is the result of the last check.  We start out assuming that we own the inserts
+	// and, if the lease file can't be used, we stick with the previous result so that a
+	// missing directory doesn't stop a lone agent from programming its inserts.
+	owned     bool
+	lastCheck time.Time
+
+	timeNow func() time.Time
+	logCxt  *log.Entry
+}
+
+// NewInsertLease creates an InsertLease for the given owner, which must be unique among the
+// agents that share the lease file.  duration is the length of the lease; it is renewed every
+// third of that.
+func NewInsertLease(path, owner string, duration time.Duration, options InsertLeaseOptions) *InsertLease {
+	timeNow := time.Now
+	if options.NowOverride != nil {
+		timeNow = options.NowOverride
+	}
+	return &InsertLease{
+		path:     path,
+		owner:    owner,
+		duration: duration,
+		owned:    true,
+		timeNow:  timeNow,
+		logCxt: log.WithFields(log.Fields{
+			"leaseFile": path,
+			"owner":     owner,
+		}),
+	}
+}
+
+// CheckInterval implements InsertOwner.
+func (l *InsertLease) CheckInterval() time.Duration {
+	return l.duration / 3
+}
+
+// OwnsInserts implements InsertOwner.  It acquires or renews the lease if it's free or
+// already ours.  Since every Table calls it on each Apply(), the result is cached briefly so
+// that we don't hit the lease file once per table.
+func (l *InsertLease) OwnsInserts() bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := l.timeNow()
+	if !l.lastCheck.IsZero() && now.Sub(l.lastCheck) < l.duration/10 {
+		return l.owned
+	}
+
+	owned := false
+	var holder insertLeaseRecord
+	err := updateInsertLeaseFile(l.path, func(current *insertLeaseRecord) *insertLeaseRecord {
+		if current != nil && current.Owner != l.owner && now.Before(current.Expiry) {
+			holder = *current
+			return nil
+		}
+		owned = true
+		return &insertLeaseRecord{Owner: l.owner, Expiry: now.Add(l.duration)}
+	})
+	if err != nil {
+		l.logCxt.WithError(err).Warn("Failed to check insert lease, assuming no change in ownership")
+		return l.owned
+	}
+	l.lastCheck = now
+
+	if owned != l.owned {
+		if owned {
+			l.logCxt.Info("Acquired insert lease, taking ownership of kernel chain inserts")
+		} else {
+			l.logCxt.WithFields(log.Fields{
+				"holder": holder.Owner,
+				"expiry": holder.Expiry,
+			}).Warn("Insert lease held by another agent, no longer programming kernel chain inserts")
+		}
+		l.owned = owned
+	}
+	return owned
+}
+
+// TakeOverInsertLease unconditionally grants the lease in the given file to the given owner,
+// for TakeoverLeaseDuration.  The previous owner stops programming its inserts the next time
+// that it checks the lease.
+func TakeOverInsertLease(path, owner string) error {
+	expiry := time.Now().Add(TakeoverLeaseDuration)
+	return updateInsertLeaseFile(path, func(current *insertLeaseRecord) *insertLeaseRecord {
+		if current != nil {
+			log.WithFields(log.Fields{
+				"leaseFile":     path,
+				"previousOwner": current.Owner,
+				"newOwner":      owner,
+			}).Info("Taking over insert lease")
+		}
+		return &insertLeaseRecord{Owner: owner, Expiry: expiry}
+	})
+}
+
+// updateInsertLeaseFile calls update with the current content of the lease file (nil if
+// there's no valid lease) while holding an exclusive lock on the file.  If update returns a
+// non-nil record, it is written back to the file before the lock is released.
+func updateInsertLeaseFile(path string, update func(current *insertLeaseRecord) *insertLeaseRecord) error {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_EX); err != nil {
+		return err
+	}
+	// Closing the file releases the lock.
+
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return err
+	}
+	var current *insertLeaseRecord
+	if len(data) > 0 {
+		var record insertLeaseRecord
+		if err := json.Unmarshal(data, &record); err != nil {
+			log.WithError(err).WithField("leaseFile", path).Warn("Ignoring invalid insert lease")
+		} else {
+			current = &record
+		}
+	}
+
+	newRecord := update(current)
+	if newRecord == nil {
+		return nil
+	}
+	data, err = json.Marshal(newRecord)
+	if err != nil {
+		return err
+	}
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := f.WriteAt(data, 0); err != nil {
+		return err
+	}
+	return f.Sync()
+}
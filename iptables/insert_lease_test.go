@@ -0,0 +1,172 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/projectcalico/felix/iptables"
+)
+
+type fakeInsertOwner struct {
+	owns bool
+}
+
+func (o *fakeInsertOwner) OwnsInserts() bool {
+	return o.owns
+}
+
+func (o *fakeInsertOwner) CheckInterval() time.Duration {
+	return 10 * time.Second
+}
+
+var _ = Describe("Insert lease", func() {
+	var dir, leaseFile string
+	var now time.Time
+	var agentA, agentB *InsertLease
+
+	timeNow := func() time.Time {
+		return now
+	}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "felix-insert-lease")
+		Expect(err).NotTo(HaveOccurred())
+		leaseFile = filepath.Join(dir, "inserts.lease")
+		now = time.Now()
+		agentA = NewInsertLease(leaseFile, "agent-a", 30*time.Second, InsertLeaseOptions{NowOverride: timeNow})
+		agentB = NewInsertLease(leaseFile, "agent-b", 30*time.Second, InsertLeaseOptions{NowOverride: timeNow})
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("should renew every third of the lease", func() {
+		Expect(agentA.CheckInterval()).To(Equal(10 * time.Second))
+	})
+
+	It("should give the lease to the first agent to ask", func() {
+		Expect(agentA.OwnsInserts()).To(BeTrue())
+		Expect(agentB.OwnsInserts()).To(BeFalse())
+	})
+
+	It("should keep the lease while its owner renews it", func() {
+		Expect(agentA.OwnsInserts()).To(BeTrue())
+		for i := 0; i < 5; i++ {
+			now = now.Add(10 * time.Second)
+			Expect(agentA.OwnsInserts()).To(BeTrue())
+			Expect(agentB.OwnsInserts()).To(BeFalse())
+		}
+	})
+
+	It("should hand the lease over once it expires", func() {
+		Expect(agentA.OwnsInserts()).To(BeTrue())
+		Expect(agentB.OwnsInserts()).To(BeFalse())
+		now = now.Add(31 * time.Second)
+		Expect(agentB.OwnsInserts()).To(BeTrue())
+		Expect(agentA.OwnsInserts()).To(BeFalse())
+	})
+
+	It("should hand the lease over on takeover", func() {
+		Expect(agentA.OwnsInserts()).To(BeTrue())
+		Expect(TakeOverInsertLease(leaseFile, "agent-b")).To(Succeed())
+		now = now.Add(10 * time.Second)
+		Expect(agentA.OwnsInserts()).To(BeFalse())
+		Expect(agentB.OwnsInserts()).To(BeTrue())
+	})
+
+	It("should treat an invalid lease as expired", func() {
+		Expect(ioutil.WriteFile(leaseFile, []byte("{\"owner\": \"agent-b\", \"exp"), 0644)).To(Succeed())
+		Expect(agentA.OwnsInserts()).To(BeTrue())
+		Expect(agentB.OwnsInserts()).To(BeFalse())
+	})
+
+	It("should stick with the previous result if the lease file can't be used", func() {
+		agent := NewInsertLease(filepath.Join(dir, "missing", "inserts.lease"), "agent-a",
+			30*time.Second, InsertLeaseOptions{NowOverride: timeNow})
+		Expect(agent.OwnsInserts()).To(BeTrue())
+	})
+})
+
+var _ = Describe("Table with an InsertOwner", func() {
+	var dataplane *mockDataplane
+	var owner *fakeInsertOwner
+	var table *Table
+
+	apply := func() time.Duration {
+		rescheduleAfter, err := table.ApplyContext(context.Background())
+		Expect(err).NotTo(HaveOccurred())
+		return rescheduleAfter
+	}
+
+	BeforeEach(func() {
+		dataplane = newMockDataplane("filter", map[string][]string{
+			"FORWARD": {},
+			"INPUT":   {},
+			"OUTPUT":  {},
+		})
+		owner = &fakeInsertOwner{owns: true}
+		table = dataplane.newTable(func(options *TableOptions) {
+			options.PostWriteInterval = time.Hour
+			options.InsertOwner = owner
+		})
+		table.UpdateChain(&Chain{Name: "cali-foo", Rules: []Rule{{Action: DropAction{}}}})
+		table.SetRuleInsertions("FORWARD", []Rule{{Action: JumpAction{Target: "cali-foo"}}})
+	})
+
+	It("should program the inserts while it owns them", func() {
+		Expect(apply()).To(Equal(10 * time.Second))
+		Expect(dataplane.Chains["FORWARD"]).To(HaveLen(1))
+		Expect(dataplane.Chains["cali-foo"]).To(HaveLen(1))
+	})
+
+	It("should only program its chains if it doesn't own the inserts", func() {
+		owner.owns = false
+		apply()
+		Expect(dataplane.Chains["FORWARD"]).To(BeEmpty())
+		Expect(dataplane.Chains["cali-foo"]).To(HaveLen(1))
+	})
+
+	Describe("after losing ownership", func() {
+		BeforeEach(func() {
+			apply()
+			owner.owns = false
+			// The new owner replaces our insert with its own.
+			dataplane.Chains["FORWARD"] = []string{"-j other-agent"}
+			table.InvalidateDataplaneCache("test")
+			apply()
+		})
+
+		It("should leave the new owner's inserts alone", func() {
+			Expect(dataplane.Chains["FORWARD"]).To(Equal([]string{"-j other-agent"}))
+		})
+
+		It("should reprogram its inserts when it regains ownership", func() {
+			owner.owns = true
+			apply()
+			Expect(dataplane.Chains["FORWARD"]).To(HaveLen(2))
+			Expect(dataplane.Chains["FORWARD"][0]).To(ContainSubstring("cali-foo"))
+		})
+	})
+})
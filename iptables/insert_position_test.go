@@ -0,0 +1,87 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/projectcalico/felix/iptables"
+)
+
+var _ = Describe("Table with positional insertions", func() {
+	var dataplane *mockDataplane
+	var table *Table
+
+	BeforeEach(func() {
+		dataplane = newMockDataplane("filter", map[string][]string{
+			"FORWARD": {},
+			"INPUT":   {"-j KUBE-FIREWALL", "-j DROP"},
+			"OUTPUT":  {},
+		})
+		table = dataplane.newTable(nil)
+		table.SetRuleInsertionsAt("INPUT", 1, []Rule{
+			{Action: AcceptAction{}},
+			{Action: ReturnAction{}},
+		})
+		table.Apply()
+	})
+
+	expectOurRulesAfterKubeProxy := func() {
+		input := dataplane.Chains["INPUT"]
+		Expect(input).To(HaveLen(4))
+		Expect(input[0]).To(Equal("-j KUBE-FIREWALL"))
+		Expect(input[1]).To(MatchRegexp(`^-m comment --comment "cali:[^"]+" --jump ACCEPT$`))
+		Expect(input[2]).To(MatchRegexp(`^-m comment --comment "cali:[^"]+" --jump RETURN$`))
+		Expect(input[3]).To(Equal("-j DROP"))
+	}
+
+	It("should insert our rules at the requested position", func() {
+		expectOurRulesAfterKubeProxy()
+	})
+
+	It("should repair the position if another process moves our rules", func() {
+		input := dataplane.Chains["INPUT"]
+		dataplane.Chains["INPUT"] = []string{input[0], input[1], input[3], input[2]}
+		table.InvalidateDataplaneCache("test")
+		table.Apply()
+		Expect(dataplane.Chains["INPUT"]).To(HaveLen(4))
+		Expect(dataplane.Chains["INPUT"][1]).To(ContainSubstring("--jump ACCEPT"))
+		Expect(dataplane.Chains["INPUT"][2]).To(ContainSubstring("--jump RETURN"))
+		Expect(dataplane.Chains["INPUT"][3]).To(Equal("-j DROP"))
+	})
+
+	It("should leave our rules alone if another process appends a rule", func() {
+		dataplane.Chains["INPUT"] = append(dataplane.Chains["INPUT"], "-j LOG")
+		dataplane.ResetCmds()
+		table.InvalidateDataplaneCache("test")
+		table.Apply()
+		Expect(dataplane.CmdNames).To(Equal([]string{"iptables-save"}))
+	})
+
+	It("should append our rules if the chain is too short", func() {
+		table.SetRuleInsertionsAt("INPUT", 5, []Rule{{Action: AcceptAction{}}})
+		table.Apply()
+		Expect(dataplane.Chains["INPUT"]).To(HaveLen(3))
+		Expect(dataplane.Chains["INPUT"][2]).To(ContainSubstring("--jump ACCEPT"))
+	})
+
+	It("should revert to the insert mode after SetRuleInsertions", func() {
+		table.SetRuleInsertions("INPUT", []Rule{{Action: AcceptAction{}}})
+		table.Apply()
+		Expect(dataplane.Chains["INPUT"]).To(HaveLen(3))
+		Expect(dataplane.Chains["INPUT"][0]).To(ContainSubstring("--jump ACCEPT"))
+	})
+})
@@ -0,0 +1,101 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	log "github.com/sirupsen/logrus"
+)
+
+// planInsertRepair checks whether we can bring our inserted rules in the given chain up to date
+// in place, rather than deleting them all and re-inserting them, which leaves the chain without
+// our hook for a moment.  That's possible if our rules in the dataplane are still one block, and
+// putting our new rules in place of that block would give them the right precedence (see
+// insertsInSync).  For example, if our rules are out of order, or one of them has been
+// modified.  If so, it returns the index of the block and the expected hashes of the whole chain
+// after the repair.
+func (t *Table) planInsertRepair(
+	chainName string,
+	dpHashes []string,
+	ourHashes []string,
+) (start int, newChainHashes []string, ok bool) {
+	start, end := -1, -1
+	for i, hash := range dpHashes {
+		if hash == "" {
+			continue
+		}
+		if start < 0 {
+			start = i
+		} else if i != end {
+			// A non-Calico rule in the middle of our rules.
+			return 0, nil, false
+		}
+		end = i + 1
+	}
+	if start < 0 || len(ourHashes) == 0 {
+		// Nothing to repair, or nothing to repair it with; a plain insert or delete is all
+		// that's needed.
+		return 0, nil, false
+	}
+	newChainHashes = make([]string, 0, len(dpHashes)-(end-start)+len(ourHashes))
+	newChainHashes = append(newChainHashes, dpHashes[:start]...)
+	newChainHashes = append(newChainHashes, ourHashes...)
+	newChainHashes = append(newChainHashes, dpHashes[end:]...)
+	if !t.insertsInSync(chainName, newChainHashes) {
+		// Our rules need to move relative to the non-Calico rules.
+		return 0, nil, false
+	}
+	return start, newChainHashes, true
+}
+
+// writeInsertRepair writes the updates that replace the block of our rules at index start in
+// the given chain with our current inserted rules: a replace ("-R") for each rule that has
+// changed, then inserts after the block if it has grown, or deletes from the end of it if it has
+// shrunk.  Our hook is in place throughout.
+func (t *Table) writeInsertRepair(
+	buf *RestoreInputBuilder,
+	chainName string,
+	start int,
+	dpHashes []string,
+	ourHashes []string,
+	counters map[string]RuleCounters,
+	features *Features,
+) {
+	numOld := len(dpHashes) - numEmptyStrings(dpHashes)
+	rules := t.chainToInsertedRules[chainName]
+	t.logCxt.WithFields(log.Fields{
+		"chainName": chainName,
+		"numOld":    numOld,
+		"numNew":    len(rules),
+	}).Debug("Repairing inserted rules in place.")
+	for i := range rules {
+		ruleNum := start + i + 1
+		prefixFrag := t.commentFrag(ourHashes[i])
+		var line string
+		if i < numOld {
+			if dpHashes[start+i] == ourHashes[i] {
+				continue
+			}
+			line = t.renderer.RenderReplace(rules[i], chainName, ruleNum, prefixFrag, features)
+		} else {
+			line = t.renderer.RenderInsertAt(rules[i], chainName, ruleNum, prefixFrag, features)
+		}
+		buf.WriteRuleLine(chainName, i, withCounters(counters, ourHashes[i], line))
+	}
+	// Remove in reverse order so that we don't disturb the rule numbers of rules we're about
+	// to remove.
+	for i := numOld - 1; i >= len(rules); i-- {
+		buf.WriteLineForChain(chainName, deleteRule(chainName, start+i+1))
+	}
+}
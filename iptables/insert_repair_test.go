@@ -0,0 +1,152 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables_test
+
+import (
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/projectcalico/libcalico-go/lib/set"
+
+	. "github.com/projectcalico/felix/iptables"
+)
+
+var _ = Describe("Table in-place repair of inserted rules", func() {
+	var dataplane *mockDataplane
+	var table *Table
+	var ours []string
+
+	newTable := func(insertMode string) {
+		table = dataplane.newTable(func(options *TableOptions) {
+			options.InsertMode = insertMode
+		})
+	}
+
+	restoreInput := func() string {
+		var inputs []string
+		for _, cmd := range dataplane.Cmds {
+			if restore, ok := cmd.(*restoreCmd); ok && !restore.Test {
+				inputs = append(inputs, restore.CapturedStdin)
+			}
+		}
+		return strings.Join(inputs, "")
+	}
+
+	resync := func(forward []string) {
+		dataplane.Chains["FORWARD"] = forward
+		dataplane.ResetCmds()
+		dataplane.ChainMods = set.New()
+		table.InvalidateDataplaneCache("test")
+		table.Apply()
+	}
+
+	BeforeEach(func() {
+		dataplane = newMockDataplane("filter", map[string][]string{
+			"FORWARD": {"-j foreign"},
+			"INPUT":   {},
+			"OUTPUT":  {},
+		})
+	})
+
+	Describe("in insert mode", func() {
+		BeforeEach(func() {
+			newTable("insert")
+			table.SetRuleInsertions("FORWARD", []Rule{
+				{Action: DropAction{}},
+				{Action: AcceptAction{}},
+			})
+			table.Apply()
+			ours = dataplane.Chains["FORWARD"][:2]
+			Expect(dataplane.Chains["FORWARD"]).To(Equal([]string{ours[0], ours[1], "-j foreign"}))
+		})
+
+		It("should replace our rules if they're out of order", func() {
+			resync([]string{ours[1], ours[0], "-j foreign"})
+			Expect(dataplane.Chains["FORWARD"]).To(Equal([]string{ours[0], ours[1], "-j foreign"}))
+			Expect(restoreInput()).To(ContainSubstring("-R FORWARD 1 "))
+			Expect(restoreInput()).To(ContainSubstring("-R FORWARD 2 "))
+			Expect(restoreInput()).NotTo(ContainSubstring("-D FORWARD"))
+		})
+
+		It("should only replace the rules that are wrong", func() {
+			resync([]string{ours[0], ours[0], "-j foreign"})
+			Expect(dataplane.Chains["FORWARD"]).To(Equal([]string{ours[0], ours[1], "-j foreign"}))
+			Expect(dataplane.RuleTouched("FORWARD", 1)).To(BeFalse())
+			Expect(restoreInput()).To(ContainSubstring("-R FORWARD 2 "))
+		})
+
+		It("should add rules after the existing ones when the insertions grow", func() {
+			table.SetRuleInsertions("FORWARD", []Rule{
+				{Action: DropAction{}},
+				{Action: AcceptAction{}},
+				{Action: DropAction{}},
+			})
+			resync(dataplane.Chains["FORWARD"])
+			Expect(dataplane.Chains["FORWARD"]).To(HaveLen(4))
+			Expect(dataplane.Chains["FORWARD"][:2]).To(Equal(ours))
+			Expect(dataplane.Chains["FORWARD"][3]).To(Equal("-j foreign"))
+			Expect(dataplane.RuleTouched("FORWARD", 1)).To(BeFalse())
+			Expect(dataplane.RuleTouched("FORWARD", 2)).To(BeFalse())
+			Expect(restoreInput()).To(ContainSubstring("-I FORWARD 3 "))
+		})
+
+		It("should delete rules from the end when the insertions shrink", func() {
+			table.SetRuleInsertions("FORWARD", []Rule{
+				{Action: DropAction{}},
+			})
+			resync(dataplane.Chains["FORWARD"])
+			Expect(dataplane.Chains["FORWARD"]).To(Equal([]string{ours[0], "-j foreign"}))
+			Expect(dataplane.RuleTouched("FORWARD", 1)).To(BeFalse())
+			Expect(restoreInput()).To(ContainSubstring("-D FORWARD 2\n"))
+		})
+
+		It("should rewrite our rules if another rule has been inserted between them", func() {
+			resync([]string{ours[0], "-j other", ours[1], "-j foreign"})
+			Expect(dataplane.Chains["FORWARD"]).To(Equal(
+				[]string{ours[0], ours[1], "-j other", "-j foreign"}))
+			Expect(restoreInput()).To(ContainSubstring("-D FORWARD"))
+		})
+
+		It("should rewrite our rules if another rule has been inserted above them", func() {
+			resync([]string{"-j other", ours[0], ours[1], "-j foreign"})
+			Expect(dataplane.Chains["FORWARD"]).To(Equal(
+				[]string{ours[0], ours[1], "-j other", "-j foreign"}))
+			Expect(restoreInput()).To(ContainSubstring("-D FORWARD"))
+		})
+	})
+
+	Describe("in append mode", func() {
+		BeforeEach(func() {
+			newTable("append")
+			table.SetRuleInsertions("FORWARD", []Rule{
+				{Action: DropAction{}},
+				{Action: AcceptAction{}},
+			})
+			table.Apply()
+			ours = dataplane.Chains["FORWARD"][1:]
+			Expect(dataplane.Chains["FORWARD"]).To(Equal([]string{"-j foreign", ours[0], ours[1]}))
+		})
+
+		It("should replace our rules if they're out of order", func() {
+			resync([]string{"-j foreign", ours[1], ours[0]})
+			Expect(dataplane.Chains["FORWARD"]).To(Equal([]string{"-j foreign", ours[0], ours[1]}))
+			Expect(restoreInput()).To(ContainSubstring("-R FORWARD 2 "))
+			Expect(restoreInput()).To(ContainSubstring("-R FORWARD 3 "))
+			Expect(restoreInput()).NotTo(ContainSubstring("-D FORWARD"))
+		})
+	})
+})
@@ -0,0 +1,134 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/projectcalico/felix/iptables"
+)
+
+var _ = Describe("Table insert sync checks", func() {
+	var dataplane *mockDataplane
+	var table *Table
+	var outOfSync []string
+
+	newTable := func(insertMode string) {
+		table = dataplane.newTable(func(options *TableOptions) {
+			options.InsertMode = insertMode
+			options.OnOutOfSync = func(chainName string, reason string) {
+				outOfSync = append(outOfSync, chainName)
+			}
+		})
+	}
+
+	resync := func() {
+		table.InvalidateDataplaneCache("test")
+		table.Apply()
+	}
+
+	BeforeEach(func() {
+		dataplane = newMockDataplane("filter", map[string][]string{
+			"FORWARD": {"-j kube-forward"},
+			"INPUT":   {"-j KUBE-FIREWALL", "-j DROP"},
+			"OUTPUT":  {},
+		})
+		outOfSync = nil
+	})
+
+	Describe("in append mode", func() {
+		BeforeEach(func() {
+			newTable("append")
+			table.SetRuleInsertions("FORWARD", []Rule{
+				{Action: JumpAction{Target: "cali-a"}},
+				{Action: JumpAction{Target: "cali-b"}},
+			})
+			table.UpdateChain(&Chain{Name: "cali-a"})
+			table.UpdateChain(&Chain{Name: "cali-b"})
+			table.Apply()
+			Expect(dataplane.Chains["FORWARD"]).To(HaveLen(3))
+			Expect(dataplane.Chains["FORWARD"][0]).To(Equal("-j kube-forward"))
+		})
+
+		It("should leave our rules alone when another process appends after them", func() {
+			dataplane.Chains["FORWARD"] = append(dataplane.Chains["FORWARD"], "-j other-agent")
+			numCmds := len(dataplane.CmdNames)
+			resync()
+			Expect(outOfSync).To(BeEmpty())
+			Expect(dataplane.CmdNames[numCmds:]).NotTo(ContainElement("iptables-restore"))
+			Expect(dataplane.Chains["FORWARD"][3]).To(Equal("-j other-agent"))
+		})
+
+		It("should repair our rules if another process splits them up", func() {
+			fwd := dataplane.Chains["FORWARD"]
+			dataplane.Chains["FORWARD"] = []string{fwd[0], fwd[1], "-j other-agent", fwd[2]}
+			resync()
+			Expect(outOfSync).To(Equal([]string{"FORWARD"}))
+			Expect(dataplane.Chains["FORWARD"]).To(HaveLen(4))
+			Expect(dataplane.Chains["FORWARD"][1]).To(Equal("-j other-agent"))
+			Expect(dataplane.Chains["FORWARD"][2]).To(ContainSubstring("--jump cali-a"))
+			Expect(dataplane.Chains["FORWARD"][3]).To(ContainSubstring("--jump cali-b"))
+		})
+	})
+
+	Describe("in insert mode", func() {
+		BeforeEach(func() {
+			newTable("insert")
+			table.SetRuleInsertions("FORWARD", []Rule{{Action: JumpAction{Target: "cali-a"}}})
+			table.UpdateChain(&Chain{Name: "cali-a"})
+			table.Apply()
+		})
+
+		It("should tolerate changes to the rules after ours", func() {
+			dataplane.Chains["FORWARD"] = append(dataplane.Chains["FORWARD"], "-j other-agent")
+			dataplane.Chains["FORWARD"] = append(dataplane.Chains["FORWARD"][:1], dataplane.Chains["FORWARD"][2:]...)
+			resync()
+			Expect(outOfSync).To(BeEmpty())
+			Expect(dataplane.Chains["FORWARD"]).To(HaveLen(2))
+		})
+
+		It("should move our rules back to the top if another process inserts above them", func() {
+			dataplane.Chains["FORWARD"] = append([]string{"-j other-agent"}, dataplane.Chains["FORWARD"]...)
+			resync()
+			Expect(outOfSync).To(Equal([]string{"FORWARD"}))
+			Expect(dataplane.Chains["FORWARD"][0]).To(ContainSubstring("--jump cali-a"))
+		})
+	})
+
+	Describe("with an insert position", func() {
+		BeforeEach(func() {
+			newTable("insert")
+			table.SetRuleInsertionsAt("INPUT", 1, []Rule{{Action: AcceptAction{}}})
+			table.Apply()
+			Expect(dataplane.Chains["INPUT"][1]).To(ContainSubstring("--jump ACCEPT"))
+		})
+
+		It("should tolerate another process inserting rules above ours", func() {
+			dataplane.Chains["INPUT"] = append([]string{"-j other-agent"}, dataplane.Chains["INPUT"]...)
+			resync()
+			Expect(outOfSync).To(BeEmpty())
+			Expect(dataplane.Chains["INPUT"][2]).To(ContainSubstring("--jump ACCEPT"))
+		})
+
+		It("should repair our rules if there are too few rules above them", func() {
+			input := dataplane.Chains["INPUT"]
+			dataplane.Chains["INPUT"] = []string{input[1], input[0], input[2]}
+			resync()
+			Expect(outOfSync).To(Equal([]string{"INPUT"}))
+			Expect(dataplane.Chains["INPUT"][1]).To(ContainSubstring("--jump ACCEPT"))
+		})
+	})
+})
@@ -0,0 +1,98 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"time"
+
+	"github.com/projectcalico/felix/throttle"
+)
+
+// newInvalidationThrottle returns a full token bucket for TableOptions.InvalidationBurst, or nil
+// if the limit is disabled.
+func newInvalidationThrottle(burst int, refillInterval time.Duration) *throttle.Throttle {
+	if burst <= 0 || refillInterval <= 0 {
+		return nil
+	}
+	t := throttle.New(burst)
+	for i := 0; i < burst; i++ {
+		t.Refill()
+	}
+	return t
+}
+
+// requestInvalidation is used in place of invalidateDataplaneCache for the invalidations that
+// callers cause.  If the rate limit is enabled and has been reached, it records the
+// invalidation for maybeApplyDeferredInvalidation rather than doing it.
+func (t *Table) requestInvalidation(reason string) {
+	if t.invalidationThrottle == nil || !t.inSyncWithDataPlane {
+		t.invalidateDataplaneCache(reason)
+		return
+	}
+	t.refillInvalidationTokens(t.timeNow())
+	if t.invalidationThrottle.Admit() {
+		t.invalidateDataplaneCache(reason)
+		return
+	}
+	if t.deferredInvalidation == "" {
+		t.logCxt.WithField("reason", reason).Debug("Invalidation rate limit reached, deferring invalidation")
+		t.metrics.Add(MetricDeferredInvalidations, 1)
+	}
+	t.deferredInvalidation = reason
+}
+
+// maybeApplyDeferredInvalidation does the deferred invalidation, if there is one, once the
+// rate limit allows it.  It's dropped if something else has invalidated the cache since.
+func (t *Table) maybeApplyDeferredInvalidation(now time.Time) {
+	if t.deferredInvalidation == "" {
+		return
+	}
+	if !t.inSyncWithDataPlane {
+		t.deferredInvalidation = ""
+		return
+	}
+	t.refillInvalidationTokens(now)
+	if !t.invalidationThrottle.Admit() {
+		return
+	}
+	t.invalidateDataplaneCache(t.deferredInvalidation + " (deferred)")
+	t.deferredInvalidation = ""
+}
+
+// refillInvalidationTokens adds a token to the bucket for each refill interval since the last
+// refill.
+func (t *Table) refillInvalidationTokens(now time.Time) {
+	n := int64(now.Sub(t.lastInvalidationRefill) / t.invalidationRefillInterval)
+	if n <= 0 {
+		return
+	}
+	t.lastInvalidationRefill = t.lastInvalidationRefill.Add(time.Duration(n) * t.invalidationRefillInterval)
+	for i := int64(0); i < n && i < int64(t.invalidationBurst); i++ {
+		t.invalidationThrottle.Refill()
+	}
+}
+
+// nextInvalidationToken returns the time until the deferred invalidation, if there is one,
+// can be done.
+func (t *Table) nextInvalidationToken(now time.Time) (time.Duration, bool) {
+	if t.deferredInvalidation == "" {
+		return 0, false
+	}
+	remaining := t.lastInvalidationRefill.Add(t.invalidationRefillInterval).Sub(now)
+	if remaining <= 0 {
+		remaining = 1 * time.Millisecond
+	}
+	return remaining, true
+}
@@ -0,0 +1,131 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables_test
+
+import (
+	"fmt"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/projectcalico/felix/iptables"
+)
+
+var _ = Describe("Table invalidation rate limit", func() {
+	var dataplane *mockDataplane
+	var table *Table
+	var numUpdates int
+
+	numSaves := func() int {
+		n := 0
+		for _, name := range dataplane.CmdNames {
+			if name == "iptables-save" {
+				n++
+			}
+		}
+		return n
+	}
+
+	update := func() {
+		numUpdates++
+		target := fmt.Sprintf("cali-%d", numUpdates)
+		table.UpdateChains([]*Chain{
+			{Name: "cali-foobar", Rules: []Rule{{Action: JumpAction{Target: target}}}},
+			{Name: target},
+		})
+	}
+
+	BeforeEach(func() {
+		numUpdates = 0
+		dataplane = newMockDataplane("filter", map[string][]string{
+			"FORWARD": {},
+			"INPUT":   {},
+			"OUTPUT":  {},
+		})
+		table = dataplane.newTable(func(options *TableOptions) {
+			options.PostWriteInterval = time.Hour
+			options.InvalidationBurst = 2
+			options.InvalidationRefillInterval = 10 * time.Second
+		})
+		table.Apply()
+		dataplane.ResetCmds()
+	})
+
+	It("should allow a burst of invalidations", func() {
+		update()
+		table.Apply()
+		update()
+		table.Apply()
+		Expect(numSaves()).To(Equal(2))
+	})
+
+	Describe("after the burst", func() {
+		var reschedule time.Duration
+
+		BeforeEach(func() {
+			update()
+			table.Apply()
+			update()
+			table.Apply()
+			dataplane.ResetCmds()
+			update()
+			reschedule, _ = table.Apply()
+		})
+
+		It("should write the update without re-reading the dataplane", func() {
+			Expect(numSaves()).To(BeZero())
+			Expect(dataplane.Chains["cali-foobar"]).To(HaveLen(1))
+			Expect(dataplane.Chains["cali-foobar"][0]).To(HaveSuffix("--jump cali-3"))
+		})
+
+		It("should reschedule for the next token", func() {
+			Expect(reschedule).To(Equal(10 * time.Second))
+		})
+
+		It("should do the deferred invalidation once a token is available", func() {
+			dataplane.AdvanceTimeBy(5 * time.Second)
+			table.Apply()
+			Expect(numSaves()).To(BeZero())
+
+			dataplane.AdvanceTimeBy(5 * time.Second)
+			table.Apply()
+			Expect(numSaves()).To(Equal(1))
+
+			// Deferred invalidation has been done.
+			dataplane.ResetCmds()
+			Expect(rescheduleAfterOf(table.Apply())).To(BeZero())
+			Expect(numSaves()).To(BeZero())
+		})
+
+		It("should limit explicit invalidations too", func() {
+			table.InvalidateDataplaneCache("test")
+			table.Apply()
+			Expect(numSaves()).To(BeZero())
+		})
+
+		It("should refill the bucket over time", func() {
+			dataplane.AdvanceTimeBy(time.Minute)
+			update()
+			table.Apply()
+			update()
+			table.Apply()
+			update()
+			table.Apply()
+			// The first update's invalidation stands in for the deferred one.
+			Expect(numSaves()).To(Equal(2))
+		})
+	})
+})
@@ -0,0 +1,56 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+// AppliesToIPVersion returns true if the rule should be programmed into Tables of the given IP
+// version; that is, if its IPVersion is zero or matches.
+func (r Rule) AppliesToIPVersion(ipVersion uint8) bool {
+	return r.IPVersion == 0 || r.IPVersion == ipVersion
+}
+
+// ForIPVersion returns the chain as it should be programmed for the given IP version, without
+// any rules that are limited to the other IP version.  It returns the chain itself, rather than
+// a copy, if all its rules apply.  The Table calls this from UpdateChain() so callers that
+// program both IP versions can build one Chain and pass it to both Tables.
+func (c *Chain) ForIPVersion(ipVersion uint8) *Chain {
+	rules := rulesForIPVersion(c.Rules, ipVersion)
+	if len(rules) == len(c.Rules) {
+		return c
+	}
+	return &Chain{
+		Name:  c.Name,
+		Rules: rules,
+	}
+}
+
+// rulesForIPVersion returns the rules that apply to the given IP version.  It returns the input
+// slice if they all apply.
+func rulesForIPVersion(rules []Rule, ipVersion uint8) []Rule {
+	for i, rule := range rules {
+		if rule.AppliesToIPVersion(ipVersion) {
+			continue
+		}
+		// Found a rule to drop, copy the ones that apply.
+		filtered := make([]Rule, i, len(rules)-1)
+		copy(filtered, rules[:i])
+		for _, rule := range rules[i+1:] {
+			if rule.AppliesToIPVersion(ipVersion) {
+				filtered = append(filtered, rule)
+			}
+		}
+		return filtered
+	}
+	return rules
+}
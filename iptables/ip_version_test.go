@@ -0,0 +1,96 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/projectcalico/felix/iptables"
+)
+
+var _ = Describe("Per-IP-version rules", func() {
+	sharedChain := &Chain{Name: "cali-shared", Rules: []Rule{
+		{Action: AcceptAction{}, Comment: "both"},
+		{Match: Match().SourceNet("10.0.0.0/8"), Action: DropAction{}, IPVersion: 4},
+		{Match: Match().SourceNet("fd00::/8"), Action: DropAction{}, IPVersion: 6},
+		{Action: ReturnAction{}, Comment: "both again"},
+	}}
+
+	It("should filter a chain by IP version", func() {
+		v4 := sharedChain.ForIPVersion(4)
+		Expect(v4.Name).To(Equal("cali-shared"))
+		Expect(v4.Rules).To(Equal([]Rule{sharedChain.Rules[0], sharedChain.Rules[1], sharedChain.Rules[3]}))
+		v6 := sharedChain.ForIPVersion(6)
+		Expect(v6.Rules).To(Equal([]Rule{sharedChain.Rules[0], sharedChain.Rules[2], sharedChain.Rules[3]}))
+		Expect(sharedChain.Rules).To(HaveLen(4), "Original chain shouldn't be modified")
+	})
+
+	It("should return the chain itself if all its rules apply", func() {
+		chain := &Chain{Name: "cali-foo", Rules: []Rule{{Action: AcceptAction{}}, {Action: DropAction{}, IPVersion: 6}}}
+		Expect(chain.ForIPVersion(6)).To(BeIdenticalTo(chain))
+	})
+
+	It("should reject invalid IP versions", func() {
+		Expect(Rule{Action: AcceptAction{}, IPVersion: 5}.Validate()).To(HaveOccurred())
+		Expect(Rule{Action: AcceptAction{}, IPVersion: 6}.Validate()).To(Succeed())
+	})
+
+	Describe("with a Table for each IP version", func() {
+		var v4Dataplane, v6Dataplane *mockDataplane
+		var v4Table, v6Table *Table
+
+		BeforeEach(func() {
+			v4Dataplane = newMockDataplane("filter", map[string][]string{"FORWARD": {}})
+			v6Dataplane = newMockDataplane("filter", map[string][]string{"FORWARD": {}})
+			v4Table = v4Dataplane.newCustomTable(4, "cali:", nil)
+			v6Table = v6Dataplane.newCustomTable(6, "cali:", nil)
+
+			inserts := []Rule{
+				{Action: JumpAction{Target: "cali-shared"}},
+				{Action: JumpAction{Target: "cali-v6-only"}, IPVersion: 6},
+			}
+			for _, t := range []*Table{v4Table, v6Table} {
+				t.UpdateChain(sharedChain)
+				t.UpdateChain(&Chain{Name: "cali-v6-only"})
+				t.SetRuleInsertions("FORWARD", inserts)
+				t.Apply()
+			}
+		})
+
+		It("should program each family's rules", func() {
+			Expect(v4Dataplane.Chains["cali-shared"]).To(HaveLen(3))
+			Expect(v4Dataplane.Chains["cali-shared"][1]).To(ContainSubstring("--source 10.0.0.0/8"))
+			Expect(v6Dataplane.Chains["cali-shared"]).To(HaveLen(3))
+			Expect(v6Dataplane.Chains["cali-shared"][1]).To(ContainSubstring("--source fd00::/8"))
+		})
+
+		It("should filter inserted rules", func() {
+			Expect(v4Dataplane.Chains["FORWARD"]).To(HaveLen(1))
+			Expect(v6Dataplane.Chains["FORWARD"]).To(HaveLen(2))
+			Expect(v6Dataplane.Chains["FORWARD"][1]).To(ContainSubstring("--jump cali-v6-only"))
+		})
+
+		It("should filter appended rules", func() {
+			for _, t := range []*Table{v4Table, v6Table} {
+				t.AppendToChain("cali-shared", []Rule{{Action: DropAction{}, IPVersion: 4}})
+				t.Apply()
+			}
+			Expect(v4Dataplane.Chains["cali-shared"]).To(HaveLen(4))
+			Expect(v6Dataplane.Chains["cali-shared"]).To(HaveLen(3))
+			Expect(sharedChain.Rules).To(HaveLen(4), "Caller's chain shouldn't be modified")
+		})
+	})
+})
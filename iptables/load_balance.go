@@ -0,0 +1,75 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"sort"
+)
+
+// DNATBackend is one of the destinations of a load-balancing DNAT chain.
+type DNATBackend struct {
+	Addr string
+	Port uint16
+}
+
+// LoadBalanceMode is how a load-balancing DNAT chain picks a backend for each new connection.
+type LoadBalanceMode string
+
+const (
+	// LoadBalanceRandom picks a backend at random, like kube-proxy does.
+	LoadBalanceRandom LoadBalanceMode = "random"
+	// LoadBalanceRoundRobin picks the backends in turn.
+	LoadBalanceRoundRobin LoadBalanceMode = "round-robin"
+)
+
+// LoadBalancedDNATChain returns a nat table chain that DNATs each new connection to one of the
+// backends, spreading the connections evenly over them.
+//
+// The chain has a rule per backend.  Since each rule only sees the connections that weren't
+// picked by the rules before it, the i'th of n rules (counting from 0) has to pick 1/(n-i) of
+// the connections that reach it: in random mode, with a statistic match of that probability,
+// and, in round-robin mode, by picking every (n-i)'th connection.  The last rule has no match
+// and picks the remaining connections.
+//
+// The backends are sorted first so that the chain, and hence its rule hashes, only depends on
+// the set of backends and not on their order.  A chain with no backends has no rules.
+func LoadBalancedDNATChain(name string, backends []DNATBackend, mode LoadBalanceMode) *Chain {
+	sorted := make([]DNATBackend, len(backends))
+	copy(sorted, backends)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Addr != sorted[j].Addr {
+			return sorted[i].Addr < sorted[j].Addr
+		}
+		return sorted[i].Port < sorted[j].Port
+	})
+
+	chain := &Chain{Name: name}
+	for i, backend := range sorted {
+		remaining := len(sorted) - i
+		var match MatchCriteria
+		if remaining > 1 {
+			if mode == LoadBalanceRoundRobin {
+				match = Match().StatisticNth(remaining, 0)
+			} else {
+				match = Match().StatisticRandom(1.0 / float64(remaining))
+			}
+		}
+		chain.Rules = append(chain.Rules, Rule{
+			Match:  match,
+			Action: DNATAction{DestAddr: backend.Addr, DestPort: backend.Port},
+		})
+	}
+	return chain
+}
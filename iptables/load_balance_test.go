@@ -0,0 +1,72 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/projectcalico/felix/iptables"
+)
+
+var _ = Describe("LoadBalancedDNATChain", func() {
+	backends := []DNATBackend{
+		{Addr: "10.0.0.3", Port: 80},
+		{Addr: "10.0.0.1", Port: 8080},
+		{Addr: "10.0.0.2", Port: 80},
+	}
+
+	render := func(chain *Chain) []string {
+		var rules []string
+		for _, r := range chain.Rules {
+			rules = append(rules, r.RenderAppend(chain.Name, "", &Features{}))
+		}
+		return rules
+	}
+
+	It("should pick each backend with equal probability", func() {
+		chain := LoadBalancedDNATChain("cali-lb", backends, LoadBalanceRandom)
+		Expect(render(chain)).To(Equal([]string{
+			"-A cali-lb -m statistic --mode random --probability 0.3333333333 --jump DNAT --to-destination 10.0.0.1:8080",
+			"-A cali-lb -m statistic --mode random --probability 0.5000000000 --jump DNAT --to-destination 10.0.0.2:80",
+			"-A cali-lb --jump DNAT --to-destination 10.0.0.3:80",
+		}))
+	})
+
+	It("should pick each backend in turn", func() {
+		chain := LoadBalancedDNATChain("cali-lb", backends, LoadBalanceRoundRobin)
+		Expect(render(chain)).To(Equal([]string{
+			"-A cali-lb -m statistic --mode nth --every 3 --packet 0 --jump DNAT --to-destination 10.0.0.1:8080",
+			"-A cali-lb -m statistic --mode nth --every 2 --packet 0 --jump DNAT --to-destination 10.0.0.2:80",
+			"-A cali-lb --jump DNAT --to-destination 10.0.0.3:80",
+		}))
+	})
+
+	It("should render the same rules whatever the order of the backends", func() {
+		reversed := []DNATBackend{backends[2], backends[1], backends[0]}
+		Expect(LoadBalancedDNATChain("cali-lb", reversed, LoadBalanceRandom).RuleHashes(&Features{})).To(Equal(
+			LoadBalancedDNATChain("cali-lb", backends, LoadBalanceRandom).RuleHashes(&Features{})))
+		Expect(backends[0].Addr).To(Equal("10.0.0.3"), "input should not be sorted in place")
+	})
+
+	It("should DNAT everything to a single backend", func() {
+		chain := LoadBalancedDNATChain("cali-lb", backends[:1], LoadBalanceRandom)
+		Expect(render(chain)).To(Equal([]string{"-A cali-lb --jump DNAT --to-destination 10.0.0.3:80"}))
+	})
+
+	It("should have no rules with no backends", func() {
+		Expect(LoadBalancedDNATChain("cali-lb", nil, LoadBalanceRandom).Rules).To(BeEmpty())
+	})
+})
@@ -77,11 +77,21 @@ type SharedLock struct {
 	GrabIptablesLocks func(lockFilePath, socketName string, timeout, probeInterval time.Duration) (io.Closer, error)
 }
 
+// SetTimeouts changes the timeout and probe interval used when acquiring the lock.  A timeout of
+// zero or less disables the lock.  Takes effect the next time the lock is acquired.
+func (l *SharedLock) SetTimeouts(lockTimeout, lockProbeInterval time.Duration) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.lockTimeout = lockTimeout
+	l.lockProbeInterval = lockProbeInterval
+}
+
 func (l *SharedLock) Lock() {
 	l.lock.Lock()
 	defer l.lock.Unlock()
 
-	if l.referenceCount == 0 {
+	if l.referenceCount == 0 && l.lockTimeout > 0 {
 		// The lock isn't currently held.  Acquire it.
 		lockHandle, err := l.GrabIptablesLocks(
 			l.lockFilePath,
@@ -107,7 +117,7 @@ func (l *SharedLock) Unlock() {
 	if l.referenceCount < 0 {
 		log.Panic("Unmatched Unlock()")
 	}
-	if l.referenceCount == 0 {
+	if l.referenceCount == 0 && l.iptablesLockHandle != nil {
 		log.Debug("Releasing iptables lock.")
 		err := l.iptablesLockHandle.Close()
 		if err != nil {
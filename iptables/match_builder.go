@@ -16,201 +16,389 @@ package iptables
 
 import (
 	"fmt"
+	"strconv"
 	"strings"
-
-	log "github.com/sirupsen/logrus"
+	"time"
 
 	"github.com/projectcalico/felix/proto"
 )
 
-type MatchCriteria []string
+// MatchCriteria is the list of MatchTerms of a rule, all of which a packet must match.  The
+// builder methods below each append a term, for example,
+// Match().Protocol("tcp").DestPorts(80).
+type MatchCriteria []MatchTerm
 
 func Match() MatchCriteria {
 	return nil
 }
 
+// Render renders the match criteria in iptables syntax.  It is a convenience wrapper around the
+// iptables Renderer.
 func (m MatchCriteria) Render() string {
-	return strings.Join([]string(m), " ")
+	return IptablesRenderer{}.RenderMatch(m, nil)
 }
 
 func (m MatchCriteria) String() string {
-	return fmt.Sprintf("MatchCriteria[%s]", m.Render())
+	terms := make([]string, len(m))
+	for i, term := range m {
+		terms[i] = term.String()
+	}
+	return fmt.Sprintf("MatchCriteria[%s]", strings.Join(terms, " "))
 }
 
-func (m MatchCriteria) MarkClear(mark uint32) MatchCriteria {
-	if mark == 0 {
-		log.Panic("Probably bug: zero mark")
+// with appends the term, which is validated first so that a bad term panics where it's built
+// rather than when the rule is rendered.
+func (m MatchCriteria) with(term MatchTerm) MatchCriteria {
+	if v, ok := term.(matchTermValidator); ok {
+		v.validate()
 	}
-	return append(m, fmt.Sprintf("-m mark --mark 0/%#x", mark))
+	return append(m, term)
+}
+
+func (m MatchCriteria) MarkClear(mark uint32) MatchCriteria {
+	return m.with(MarkBitsTerm{Bits: mark})
 }
 
 func (m MatchCriteria) MarkSet(mark uint32) MatchCriteria {
-	if mark == 0 {
-		log.Panic("Probably bug: zero mark")
-	}
-	return append(m, fmt.Sprintf("-m mark --mark %#x/%#x", mark, mark))
+	return m.with(MarkBitsTerm{Bits: mark, Set: true})
+}
+
+// MarkMatch matches packets whose mark, masked with Mask, equals Value.  A zero Mask compares
+// the whole mark.
+type MarkMatch struct {
+	Value uint32
+	Mask  uint32
+}
+
+// ConnMarkMatch matches packets whose connection's mark, masked with Mask, equals Value.  A zero
+// Mask compares the whole mark.
+type ConnMarkMatch struct {
+	Value uint32
+	Mask  uint32
+}
+
+func (m MatchCriteria) Mark(match MarkMatch) MatchCriteria {
+	return m.with(MarkTerm{MarkMatch: match})
+}
+
+func (m MatchCriteria) NotMark(match MarkMatch) MatchCriteria {
+	return m.with(MarkTerm{MarkMatch: match, Negate: true})
+}
+
+func (m MatchCriteria) ConnMark(match ConnMarkMatch) MatchCriteria {
+	return m.with(ConnMarkTerm{ConnMarkMatch: match})
+}
+
+func (m MatchCriteria) NotConnMark(match ConnMarkMatch) MatchCriteria {
+	return m.with(ConnMarkTerm{ConnMarkMatch: match, Negate: true})
 }
 
 func (m MatchCriteria) InInterface(ifaceMatch string) MatchCriteria {
-	return append(m, fmt.Sprintf("--in-interface %s", ifaceMatch))
+	return m.with(InterfaceTerm{Name: ifaceMatch})
 }
 
 func (m MatchCriteria) OutInterface(ifaceMatch string) MatchCriteria {
-	return append(m, fmt.Sprintf("--out-interface %s", ifaceMatch))
+	return m.with(InterfaceTerm{Name: ifaceMatch, Out: true})
 }
 
 func (m MatchCriteria) RPFCheckPassed() MatchCriteria {
-	return append(m, "-m rpfilter")
+	return m.with(RPFilterTerm{})
 }
 
 func (m MatchCriteria) RPFCheckFailed() MatchCriteria {
-	return append(m, "-m rpfilter --invert")
+	return m.with(RPFilterTerm{Failed: true})
 }
 
 type AddrType string
 
 const (
-	AddrTypeLocal AddrType = "LOCAL"
+	AddrTypeUnspec      AddrType = "UNSPEC"
+	AddrTypeUnicast     AddrType = "UNICAST"
+	AddrTypeLocal       AddrType = "LOCAL"
+	AddrTypeBroadcast   AddrType = "BROADCAST"
+	AddrTypeAnycast     AddrType = "ANYCAST"
+	AddrTypeMulticast   AddrType = "MULTICAST"
+	AddrTypeBlackhole   AddrType = "BLACKHOLE"
+	AddrTypeUnreachable AddrType = "UNREACHABLE"
+	AddrTypeProhibit    AddrType = "PROHIBIT"
+	AddrTypeThrow       AddrType = "THROW"
+	AddrTypeNAT         AddrType = "NAT"
+	AddrTypeXResolve    AddrType = "XRESOLVE"
 )
 
+// AddrTypeMatch matches packets by the routing type of their source and/or destination
+// addresses, for example, AddrTypeLocal for the host's own addresses.  An empty SrcType or
+// DstType isn't checked.  LimitIfaceIn and LimitIfaceOut only consider the routes via the
+// packet's incoming or outgoing interface; LimitIfaceIn is only valid in the PREROUTING, INPUT
+// and FORWARD chains and LimitIfaceOut in the OUTPUT, FORWARD and POSTROUTING chains.
+type AddrTypeMatch struct {
+	SrcType       AddrType
+	DstType       AddrType
+	LimitIfaceIn  bool
+	LimitIfaceOut bool
+}
+
+func (m MatchCriteria) AddrType(match AddrTypeMatch) MatchCriteria {
+	return m.with(AddrTypeTerm{AddrTypeMatch: match})
+}
+
+// NotAddrType matches packets that don't match the addrtype match, which must only have one
+// type.
+func (m MatchCriteria) NotAddrType(match AddrTypeMatch) MatchCriteria {
+	return m.with(AddrTypeTerm{AddrTypeMatch: match, Negate: true})
+}
+
 func (m MatchCriteria) NotSrcAddrType(addrType AddrType, limitIfaceOut bool) MatchCriteria {
-	if limitIfaceOut {
-		return append(m, fmt.Sprintf("-m addrtype ! --src-type %s --limit-iface-out", addrType))
-	} else {
-		return append(m, fmt.Sprintf("-m addrtype ! --src-type %s", addrType))
-	}
+	return m.NotAddrType(AddrTypeMatch{SrcType: addrType, LimitIfaceOut: limitIfaceOut})
 }
 
 func (m MatchCriteria) SrcAddrType(addrType AddrType, limitIfaceOut bool) MatchCriteria {
-	if limitIfaceOut {
-		return append(m, fmt.Sprintf("-m addrtype --src-type %s --limit-iface-out", addrType))
-	} else {
-		return append(m, fmt.Sprintf("-m addrtype --src-type %s", addrType))
-	}
+	return m.AddrType(AddrTypeMatch{SrcType: addrType, LimitIfaceOut: limitIfaceOut})
 }
 
 func (m MatchCriteria) ConntrackState(stateNames string) MatchCriteria {
-	return append(m, fmt.Sprintf("-m conntrack --ctstate %s", stateNames))
+	return m.with(ConntrackStateTerm{States: stateNames})
 }
 
 func (m MatchCriteria) Protocol(name string) MatchCriteria {
-	return append(m, fmt.Sprintf("-p %s", name))
+	return m.with(ProtocolTerm{Protocol: name})
 }
 
 func (m MatchCriteria) NotProtocol(name string) MatchCriteria {
-	return append(m, fmt.Sprintf("! -p %s", name))
+	return m.with(ProtocolTerm{Protocol: name, Negate: true})
 }
 
 func (m MatchCriteria) ProtocolNum(num uint8) MatchCriteria {
-	return append(m, fmt.Sprintf("-p %d", num))
+	return m.with(ProtocolTerm{Protocol: strconv.Itoa(int(num))})
 }
 
 func (m MatchCriteria) NotProtocolNum(num uint8) MatchCriteria {
-	return append(m, fmt.Sprintf("! -p %d", num))
+	return m.with(ProtocolTerm{Protocol: strconv.Itoa(int(num)), Negate: true})
+}
+
+// TCPSyn matches TCP packets with SYN set and RST clear, which is what the TCPMSS target needs.
+func (m MatchCriteria) TCPSyn() MatchCriteria {
+	return m.with(TCPSynTerm{})
+}
+
+// StatisticRandom matches packets at random with the given probability, between 0 and 1.
+func (m MatchCriteria) StatisticRandom(probability float64) MatchCriteria {
+	return m.with(StatisticRandomTerm{Probability: probability})
+}
+
+// StatisticNth matches one in every "every" packets that reach the rule; packet is which one,
+// counting from 0.
+func (m MatchCriteria) StatisticNth(every, packet int) MatchCriteria {
+	return m.with(StatisticNthTerm{Every: every, Packet: packet})
 }
 
 func (m MatchCriteria) SourceNet(net string) MatchCriteria {
-	return append(m, fmt.Sprintf("--source %s", net))
+	return m.with(NetTerm{Net: net})
 }
 
 func (m MatchCriteria) NotSourceNet(net string) MatchCriteria {
-	return append(m, fmt.Sprintf("! --source %s", net))
+	return m.with(NetTerm{Net: net, Negate: true})
 }
 
 func (m MatchCriteria) DestNet(net string) MatchCriteria {
-	return append(m, fmt.Sprintf("--destination %s", net))
+	return m.with(NetTerm{Net: net, Dest: true})
 }
 
 func (m MatchCriteria) NotDestNet(net string) MatchCriteria {
-	return append(m, fmt.Sprintf("! --destination %s", net))
+	return m.with(NetTerm{Net: net, Dest: true, Negate: true})
 }
 
 func (m MatchCriteria) SourceIPSet(name string) MatchCriteria {
-	return append(m, fmt.Sprintf("-m set --match-set %s src", name))
+	return m.with(IPSetTerm{Name: name})
 }
 
 func (m MatchCriteria) NotSourceIPSet(name string) MatchCriteria {
-	return append(m, fmt.Sprintf("-m set ! --match-set %s src", name))
+	return m.with(IPSetTerm{Name: name, Negate: true})
 }
 
 func (m MatchCriteria) DestIPSet(name string) MatchCriteria {
-	return append(m, fmt.Sprintf("-m set --match-set %s dst", name))
+	return m.with(IPSetTerm{Name: name, Dest: true})
 }
 
 func (m MatchCriteria) NotDestIPSet(name string) MatchCriteria {
-	return append(m, fmt.Sprintf("-m set ! --match-set %s dst", name))
+	return m.with(IPSetTerm{Name: name, Dest: true, Negate: true})
 }
 
 func (m MatchCriteria) SourcePorts(ports ...uint16) MatchCriteria {
-	portsString := PortsToMultiport(ports)
-	return append(m, fmt.Sprintf("-m multiport --source-ports %s", portsString))
+	return m.with(PortsTerm{Ports: uint16sToPortRanges(ports)})
 }
 
 func (m MatchCriteria) NotSourcePorts(ports ...uint16) MatchCriteria {
-	portsString := PortsToMultiport(ports)
-	return append(m, fmt.Sprintf("-m multiport ! --source-ports %s", portsString))
+	return m.with(PortsTerm{Ports: uint16sToPortRanges(ports), Negate: true})
 }
 
 func (m MatchCriteria) DestPorts(ports ...uint16) MatchCriteria {
-	portsString := PortsToMultiport(ports)
-	return append(m, fmt.Sprintf("-m multiport --destination-ports %s", portsString))
+	return m.with(PortsTerm{Ports: uint16sToPortRanges(ports), Dest: true})
 }
 
 func (m MatchCriteria) NotDestPorts(ports ...uint16) MatchCriteria {
-	portsString := PortsToMultiport(ports)
-	return append(m, fmt.Sprintf("-m multiport ! --destination-ports %s", portsString))
+	return m.with(PortsTerm{Ports: uint16sToPortRanges(ports), Dest: true, Negate: true})
 }
 
 func (m MatchCriteria) SourcePortRanges(ports []*proto.PortRange) MatchCriteria {
-	portsString := PortRangessToMultiport(ports)
-	return append(m, fmt.Sprintf("-m multiport --source-ports %s", portsString))
+	return m.with(PortsTerm{Ports: ports})
 }
 
 func (m MatchCriteria) NotSourcePortRanges(ports []*proto.PortRange) MatchCriteria {
-	portsString := PortRangessToMultiport(ports)
-	return append(m, fmt.Sprintf("-m multiport ! --source-ports %s", portsString))
+	return m.with(PortsTerm{Ports: ports, Negate: true})
 }
 
 func (m MatchCriteria) DestPortRanges(ports []*proto.PortRange) MatchCriteria {
-	portsString := PortRangessToMultiport(ports)
-	return append(m, fmt.Sprintf("-m multiport --destination-ports %s", portsString))
+	return m.with(PortsTerm{Ports: ports, Dest: true})
 }
 
 func (m MatchCriteria) NotDestPortRanges(ports []*proto.PortRange) MatchCriteria {
-	portsString := PortRangessToMultiport(ports)
-	return append(m, fmt.Sprintf("-m multiport ! --destination-ports %s", portsString))
+	return m.with(PortsTerm{Ports: ports, Dest: true, Negate: true})
 }
 
 func (m MatchCriteria) ICMPType(t uint8) MatchCriteria {
-	return append(m, fmt.Sprintf("-m icmp --icmp-type %d", t))
+	return m.with(ICMPTypeTerm{Type: t})
 }
 
 func (m MatchCriteria) NotICMPType(t uint8) MatchCriteria {
-	return append(m, fmt.Sprintf("-m icmp ! --icmp-type %d", t))
+	return m.with(ICMPTypeTerm{Type: t, Negate: true})
 }
 
 func (m MatchCriteria) ICMPTypeAndCode(t, c uint8) MatchCriteria {
-	return append(m, fmt.Sprintf("-m icmp --icmp-type %d/%d", t, c))
+	return m.with(ICMPTypeTerm{Type: t, Code: c, HasCode: true})
 }
 
 func (m MatchCriteria) NotICMPTypeAndCode(t, c uint8) MatchCriteria {
-	return append(m, fmt.Sprintf("-m icmp ! --icmp-type %d/%d", t, c))
+	return m.with(ICMPTypeTerm{Type: t, Code: c, HasCode: true, Negate: true})
 }
 
 func (m MatchCriteria) ICMPV6Type(t uint8) MatchCriteria {
-	return append(m, fmt.Sprintf("-m icmp6 --icmpv6-type %d", t))
+	return m.with(ICMPTypeTerm{IPv6: true, Type: t})
 }
 
 func (m MatchCriteria) NotICMPV6Type(t uint8) MatchCriteria {
-	return append(m, fmt.Sprintf("-m icmp6 ! --icmpv6-type %d", t))
+	return m.with(ICMPTypeTerm{IPv6: true, Type: t, Negate: true})
 }
 
 func (m MatchCriteria) ICMPV6TypeAndCode(t, c uint8) MatchCriteria {
-	return append(m, fmt.Sprintf("-m icmp6 --icmpv6-type %d/%d", t, c))
+	return m.with(ICMPTypeTerm{IPv6: true, Type: t, Code: c, HasCode: true})
 }
 
 func (m MatchCriteria) NotICMPV6TypeAndCode(t, c uint8) MatchCriteria {
-	return append(m, fmt.Sprintf("-m icmp6 ! --icmpv6-type %d/%d", t, c))
+	return m.with(ICMPTypeTerm{IPv6: true, Type: t, Code: c, HasCode: true, Negate: true})
+}
+
+// DSCP matches packets with the given value in their DSCP field.
+func (m MatchCriteria) DSCP(value uint8) MatchCriteria {
+	return m.with(DSCPTerm{Value: value})
+}
+
+func (m MatchCriteria) NotDSCP(value uint8) MatchCriteria {
+	return m.with(DSCPTerm{Value: value, Negate: true})
+}
+
+// TOS matches packets whose TOS (IPv4) or traffic class (IPv6) byte, masked with mask, equals
+// value.
+func (m MatchCriteria) TOS(value, mask uint8) MatchCriteria {
+	return m.with(TOSTerm{Value: value, Mask: mask})
+}
+
+func (m MatchCriteria) NotTOS(value, mask uint8) MatchCriteria {
+	return m.with(TOSTerm{Value: value, Mask: mask, Negate: true})
+}
+
+// HashLimit is a rate limit for the hashlimit match, which tracks a separate rate for each
+// group of packets.  The groups are set by Mode, a comma-separated list of "srcip", "dstip",
+// "srcport" and "dstport", with the addresses masked to SrcMask and DstMask bits if those are
+// set.  For example, Mode "srcip" with SrcMask 24 limits each IPv4 /24.  An empty Mode applies
+// the limit to all matching packets as one group.
+type HashLimit struct {
+	// Name names the kernel's hash table, which is shown in /proc/net/ipt_hashlimit (or
+	// ip6t_hashlimit).  Rules with the same name share their counters.  At most
+	// MaxHashLimitNameLength characters.
+	Name string
+	// Rate is the average number of packets per Unit ("second", "minute", "hour" or "day").
+	Rate uint32
+	Unit string
+	// Burst, if non-zero, is the maximum burst, in packets; the kernel's default is 5.
+	Burst   uint32
+	Mode    string
+	SrcMask int
+	DstMask int
+	// Expire, if non-zero, is how long the kernel keeps the state of an idle group.
+	Expire time.Duration
+}
+
+// HashLimitAbove matches packets in a group that is over the rate limit, for example, to drop
+// them.  Needs the xt_hashlimit kernel module (see Features.HashLimit).
+func (m MatchCriteria) HashLimitAbove(limit HashLimit) MatchCriteria {
+	return m.with(HashLimitTerm{Limit: limit, Above: true})
+}
+
+// HashLimitUpTo matches packets in a group that is within the rate limit.  Needs the
+// xt_hashlimit kernel module (see Features.HashLimit).
+func (m MatchCriteria) HashLimitUpTo(limit HashLimit) MatchCriteria {
+	return m.with(HashLimitTerm{Limit: limit})
+}
+
+// RecentList is a list of the xt_recent match, which records the time that it last saw each
+// address, for example, to implement port knocking or to throttle the connections from each
+// source.  The list is named Name, which is shown in /proc/net/xt_recent, and records the
+// packets' source addresses or, if Dest is set, their destination addresses.
+type RecentList struct {
+	Name string
+	Dest bool
+}
+
+// RecentCheck matches packets whose address is in the recent list.  If Seconds is non-zero,
+// the address must have been seen in the last Seconds seconds and, if HitCount is non-zero, it
+// must have been seen at least HitCount times (at most the kernel's ip_pkt_list_tot, 20 by
+// default).  Update also refreshes the time that the address was last seen, so that, for
+// example, a source that keeps sending is throttled until it stops for Seconds.  Reap, which
+// needs Seconds, removes older entries for the address.
+type RecentCheck struct {
+	List     RecentList
+	Seconds  uint32
+	HitCount uint32
+	Update   bool
+	Reap     bool
+}
+
+// RecentSet adds, or refreshes, the packet's address in the recent list; it always matches.
+func (m MatchCriteria) RecentSet(list RecentList) MatchCriteria {
+	return m.with(RecentUpdateTerm{List: list})
+}
+
+// RecentRemove removes the packet's address from the recent list; it matches if the address
+// was in the list.
+func (m MatchCriteria) RecentRemove(list RecentList) MatchCriteria {
+	return m.with(RecentUpdateTerm{List: list, Remove: true})
+}
+
+// RecentCheck matches packets that pass the check.
+func (m MatchCriteria) RecentCheck(check RecentCheck) MatchCriteria {
+	return m.with(RecentCheckTerm{Check: check})
+}
+
+func (m MatchCriteria) NotRecentCheck(check RecentCheck) MatchCriteria {
+	return m.with(RecentCheckTerm{Check: check, Negate: true})
+}
+
+// TimeMatch matches packets that arrive in a time window.  StartTime and StopTime are the times
+// of day, as offsets from midnight; a zero StopTime means the end of the day.  If StartTime is
+// after StopTime, the window wraps over midnight.  If DaysOfWeek is set, the packet must also
+// arrive on one of those days.  The times are in UTC if UTC is set, otherwise in the kernel's
+// time zone, which the kernel doesn't adjust for daylight saving.
+type TimeMatch struct {
+	DaysOfWeek []time.Weekday
+	StartTime  time.Duration
+	StopTime   time.Duration
+	UTC        bool
+}
+
+// Time matches packets that arrive in the time window.  Needs the xt_time kernel module.
+func (m MatchCriteria) Time(t TimeMatch) MatchCriteria {
+	return m.with(TimeTerm{TimeMatch: t})
 }
 
 func PortsToMultiport(ports []uint16) string {
@@ -222,6 +410,14 @@ func PortsToMultiport(ports []uint16) string {
 	return portsString
 }
 
+func uint16sToPortRanges(ports []uint16) []*proto.PortRange {
+	ranges := make([]*proto.PortRange, len(ports))
+	for i, port := range ports {
+		ranges[i] = &proto.PortRange{First: int32(port), Last: int32(port)}
+	}
+	return ranges
+}
+
 func PortRangessToMultiport(ports []*proto.PortRange) string {
 	portFragments := make([]string, len(ports))
 	for i, port := range ports {
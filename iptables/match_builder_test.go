@@ -15,8 +15,11 @@
 package iptables_test
 
 import (
+	"time"
+
 	. "github.com/projectcalico/felix/iptables"
 
+	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/ginkgo/extensions/table"
 	. "github.com/onsi/gomega"
 
@@ -35,6 +38,11 @@ var _ = DescribeTable("MatchBuilder",
 	// Marks.
 	Entry("MarkClear", Match().MarkClear(0x400a), "-m mark --mark 0/0x400a"),
 	Entry("MarkSet", Match().MarkSet(0x400a), "-m mark --mark 0x400a/0x400a"),
+	Entry("Mark", Match().Mark(MarkMatch{Value: 0x1000, Mask: 0xf000}), "-m mark --mark 0x1000/0xf000"),
+	Entry("Mark without mask", Match().Mark(MarkMatch{Value: 0x5}), "-m mark --mark 0x5"),
+	Entry("NotMark", Match().NotMark(MarkMatch{Value: 0, Mask: 0x10}), "-m mark ! --mark 0x0/0x10"),
+	Entry("ConnMark", Match().ConnMark(ConnMarkMatch{Value: 0x20, Mask: 0x30}), "-m connmark --mark 0x20/0x30"),
+	Entry("NotConnMark", Match().NotConnMark(ConnMarkMatch{Value: 0x20}), "-m connmark ! --mark 0x20"),
 	// Conntrack.
 	Entry("ConntrackState", Match().ConntrackState("INVALID"), "-m conntrack --ctstate INVALID"),
 	// Interfaces.
@@ -45,9 +53,19 @@ var _ = DescribeTable("MatchBuilder",
 	Entry("SrcAddrType no limit iface", Match().SrcAddrType(AddrTypeLocal, false), "-m addrtype --src-type LOCAL"),
 	Entry("NotSrcAddrType limit iface", Match().NotSrcAddrType(AddrTypeLocal, true), "-m addrtype ! --src-type LOCAL --limit-iface-out"),
 	Entry("NotSrcAddrType no limit iface", Match().NotSrcAddrType(AddrTypeLocal, false), "-m addrtype ! --src-type LOCAL"),
+	Entry("AddrType", Match().AddrType(AddrTypeMatch{SrcType: AddrTypeLocal, DstType: AddrTypeMulticast}),
+		"-m addrtype --src-type LOCAL --dst-type MULTICAST"),
+	Entry("AddrType limit iface in", Match().AddrType(AddrTypeMatch{DstType: AddrTypeLocal, LimitIfaceIn: true}),
+		"-m addrtype --dst-type LOCAL --limit-iface-in"),
+	Entry("NotAddrType", Match().NotAddrType(AddrTypeMatch{DstType: AddrTypeUnicast}),
+		"-m addrtype ! --dst-type UNICAST"),
 	// Protocol.
 	Entry("Protocol", Match().Protocol("tcp"), "-p tcp"),
 	Entry("NotProtocol", Match().NotProtocol("tcp"), "! -p tcp"),
+	Entry("TCPSyn", Match().TCPSyn(), "-p tcp --tcp-flags SYN,RST SYN"),
+	// Statistic.
+	Entry("StatisticRandom", Match().StatisticRandom(0.25), "-m statistic --mode random --probability 0.2500000000"),
+	Entry("StatisticNth", Match().StatisticNth(3, 0), "-m statistic --mode nth --every 3 --packet 0"),
 	Entry("ProtocolNum", Match().ProtocolNum(123), "-p 123"),
 	Entry("NotProtocolNum", Match().NotProtocolNum(123), "! -p 123"),
 	// CIDRs.
@@ -78,7 +96,87 @@ var _ = DescribeTable("MatchBuilder",
 	Entry("NotICMPV6Type", Match().NotICMPV6Type(123), "-m icmp6 ! --icmpv6-type 123"),
 	Entry("ICMPV6TypeAndCode", Match().ICMPV6TypeAndCode(123, 5), "-m icmp6 --icmpv6-type 123/5"),
 	Entry("NotICMPV6TypeAndCode", Match().NotICMPV6TypeAndCode(123, 5), "-m icmp6 ! --icmpv6-type 123/5"),
+	Entry("DSCP", Match().DSCP(46), "-m dscp --dscp 0x2e"),
+	Entry("NotDSCP", Match().NotDSCP(0), "-m dscp ! --dscp 0x00"),
+	Entry("TOS", Match().TOS(0x10, 0x3f), "-m tos --tos 0x10/0x3f"),
+	Entry("NotTOS", Match().NotTOS(0x08, 0xff), "-m tos ! --tos 0x08/0xff"),
+	Entry("HashLimitAbove", Match().HashLimitAbove(HashLimit{
+		Name:    "cali-new-conns",
+		Rate:    10,
+		Unit:    "second",
+		Burst:   20,
+		Mode:    "srcip",
+		SrcMask: 32,
+		Expire:  time.Minute,
+	}), "-m hashlimit --hashlimit-above 10/second --hashlimit-burst 20 --hashlimit-mode srcip "+
+		"--hashlimit-srcmask 32 --hashlimit-htable-expire 60000 --hashlimit-name cali-new-conns"),
+	Entry("HashLimitUpTo", Match().HashLimitUpTo(HashLimit{Name: "limit", Rate: 100, Unit: "minute"}),
+		"-m hashlimit --hashlimit-upto 100/minute --hashlimit-name limit"),
+	Entry("RecentSet", Match().RecentSet(RecentList{Name: "knock1"}),
+		"-m recent --set --name knock1 --rsource"),
+	Entry("RecentRemove", Match().RecentRemove(RecentList{Name: "knock1", Dest: true}),
+		"-m recent --remove --name knock1 --rdest"),
+	Entry("RecentCheck", Match().RecentCheck(RecentCheck{List: RecentList{Name: "knock1"}, Seconds: 10}),
+		"-m recent --rcheck --seconds 10 --name knock1 --rsource"),
+	Entry("RecentCheck with update", Match().RecentCheck(RecentCheck{
+		List:     RecentList{Name: "ssh"},
+		Seconds:  60,
+		HitCount: 4,
+		Update:   true,
+		Reap:     true,
+	}), "-m recent --update --seconds 60 --reap --hitcount 4 --name ssh --rsource"),
+	Entry("NotRecentCheck", Match().NotRecentCheck(RecentCheck{List: RecentList{Name: "knock1"}}),
+		"-m recent ! --rcheck --name knock1 --rsource"),
+	Entry("Time", Match().Time(TimeMatch{
+		DaysOfWeek: []time.Weekday{time.Sunday, time.Saturday, time.Monday},
+		StartTime:  22*time.Hour + 30*time.Minute,
+		StopTime:   6 * time.Hour,
+		UTC:        true,
+	}), "-m time --timestart 22:30:00 --timestop 06:00:00 --weekdays Mon,Sat,Sun"),
+	Entry("Time in kernel time zone", Match().Time(TimeMatch{StartTime: 9*time.Hour + 5*time.Second}),
+		"-m time --timestart 09:00:05 --kerneltz"),
+	Entry("Time on days", Match().Time(TimeMatch{DaysOfWeek: []time.Weekday{time.Wednesday}, UTC: true}),
+		"-m time --weekdays Wed"),
 	// Check multiple match criteria are joined correctly.
 	Entry("Protocol and ports", Match().Protocol("tcp").SourcePorts(1234).DestPorts(8080),
 		"-p tcp -m multiport --source-ports 1234 -m multiport --destination-ports 8080"),
 )
+
+var _ = DescribeTable("MatchBuilder with an invalid IP set name",
+	func(build func(name string) MatchCriteria) {
+		Expect(func() { build("cali40s:abcd -j ACCEPT") }).To(Panic())
+		Expect(func() { build("cali40s:abcd\nCOMMIT") }).To(Panic())
+		Expect(func() { build("cali40s:abcd1234_-") }).NotTo(Panic())
+	},
+	Entry("SourceIPSet", Match().SourceIPSet),
+	Entry("NotSourceIPSet", Match().NotSourceIPSet),
+	Entry("DestIPSet", Match().DestIPSet),
+	Entry("NotDestIPSet", Match().NotDestIPSet),
+)
+
+type unsupportedTerm struct{}
+
+func (unsupportedTerm) String() string {
+	return "Unsupported"
+}
+
+var _ = Describe("MatchCriteria terms", func() {
+	It("should describe the terms without iptables syntax", func() {
+		match := Match().Protocol("tcp").NotSourceNet("10.0.0.0/8").DestPorts(80, 443)
+		Expect(match.String()).To(Equal("MatchCriteria[Protocol(tcp) NotSourceNet(10.0.0.0/8) DestPorts(80,443)]"))
+	})
+	It("should render through the iptables renderer", func() {
+		match := MatchCriteria{ProtocolTerm{Protocol: "udp"}, NetTerm{Net: "10.0.0.1", Dest: true}}
+		Expect(IptablesRenderer{}.RenderMatch(match, &Features{})).To(Equal("-p udp --destination 10.0.0.1"))
+		Expect(match.Render()).To(Equal("-p udp --destination 10.0.0.1"))
+	})
+	It("should validate terms that weren't made by the builder", func() {
+		match := MatchCriteria{IPSetTerm{Name: "cali40s:abcd -j ACCEPT"}}
+		Expect(func() { match.Render() }).To(Panic())
+	})
+	It("should panic on a term that iptables can't render", func() {
+		match := Match().Protocol("tcp")
+		match = append(match, unsupportedTerm{})
+		Expect(func() { match.Render() }).To(Panic())
+	})
+})
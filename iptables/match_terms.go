@@ -0,0 +1,384 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/projectcalico/felix/proto"
+)
+
+// MatchTerm is the backend-agnostic model of one of the conditions in a rule's MatchCriteria.
+// Like Actions, terms don't render themselves; a Renderer converts them to the syntax of a
+// particular backend.
+// Terms are normally built with the MatchCriteria builder methods, such as
+// Match().SourceNet(...).
+type MatchTerm interface {
+	String() string
+}
+
+// matchTermValidator is implemented by terms whose fields are constrained, for example, IP set
+// names.  A term that fails validation is a bug so validate panics.
+type matchTermValidator interface {
+	validate()
+}
+
+func notPrefix(negate bool) string {
+	if negate {
+		return "Not"
+	}
+	return ""
+}
+
+func notFragment(negate bool) string {
+	if negate {
+		return "! "
+	}
+	return ""
+}
+
+// MarkBitsTerm matches packets that have all of the mark bits in Bits clear or, if Set is set,
+// all of them set.
+type MarkBitsTerm struct {
+	Bits uint32
+	Set  bool
+}
+
+func (t MarkBitsTerm) validate() {
+	if t.Bits == 0 {
+		log.Panic("Probably bug: zero mark")
+	}
+}
+
+func (t MarkBitsTerm) String() string {
+	if t.Set {
+		return fmt.Sprintf("MarkSet(%#x)", t.Bits)
+	}
+	return fmt.Sprintf("MarkClear(%#x)", t.Bits)
+}
+
+// MarkTerm matches packets whose mark, masked with Mask, equals Value, or doesn't if Negate is
+// set.
+type MarkTerm struct {
+	MarkMatch
+	Negate bool
+}
+
+func (t MarkTerm) validate() {
+	validateMarkMatch(t.Value, t.Mask)
+}
+
+func (t MarkTerm) String() string {
+	return fmt.Sprintf("%sMark(%#x/%#x)", notPrefix(t.Negate), t.Value, t.Mask)
+}
+
+// ConnMarkTerm matches packets whose connection's mark, masked with Mask, equals Value, or
+// doesn't if Negate is set.
+type ConnMarkTerm struct {
+	ConnMarkMatch
+	Negate bool
+}
+
+func (t ConnMarkTerm) validate() {
+	validateMarkMatch(t.Value, t.Mask)
+}
+
+func (t ConnMarkTerm) String() string {
+	return fmt.Sprintf("%sConnMark(%#x/%#x)", notPrefix(t.Negate), t.Value, t.Mask)
+}
+
+func validateMarkMatch(value, mask uint32) {
+	if mask != 0 && value&^mask != 0 {
+		log.WithFields(log.Fields{
+			"value": value,
+			"mask":  mask,
+		}).Panic("Probably bug: mark match that can never match")
+	}
+}
+
+// InterfaceTerm matches packets that arrive on, or, if Out is set, leave by, an interface
+// matching Name, which may end with a "+" wildcard.
+type InterfaceTerm struct {
+	Name string
+	Out  bool
+}
+
+func (t InterfaceTerm) String() string {
+	if t.Out {
+		return "OutInterface(" + t.Name + ")"
+	}
+	return "InInterface(" + t.Name + ")"
+}
+
+// RPFilterTerm matches packets that pass the reverse path filter check, or that fail it if
+// Failed is set.
+type RPFilterTerm struct {
+	Failed bool
+}
+
+func (t RPFilterTerm) String() string {
+	if t.Failed {
+		return "RPFCheckFailed"
+	}
+	return "RPFCheckPassed"
+}
+
+// AddrTypeTerm matches packets that match the addrtype match, or don't if Negate is set.  A
+// negated match must only have one type.
+type AddrTypeTerm struct {
+	AddrTypeMatch
+	Negate bool
+}
+
+func (t AddrTypeTerm) validate() {
+	if t.SrcType == "" && t.DstType == "" || t.LimitIfaceIn && t.LimitIfaceOut {
+		log.WithField("match", t.AddrTypeMatch).Panic("Probably bug: addrtype match with no types or both interface limits")
+	}
+	if t.Negate && t.SrcType != "" && t.DstType != "" {
+		// "! --src-type A ! --dst-type B" would be the negation of each type, not of the match.
+		log.WithField("match", t.AddrTypeMatch).Panic("Probably bug: negated addrtype match with two types")
+	}
+}
+
+func (t AddrTypeTerm) String() string {
+	return fmt.Sprintf("%sAddrType%+v", notPrefix(t.Negate), t.AddrTypeMatch)
+}
+
+// ConntrackStateTerm matches packets whose connection is in one of the conntrack states in
+// States, a comma-separated list such as "RELATED,ESTABLISHED".
+type ConntrackStateTerm struct {
+	States string
+}
+
+func (t ConntrackStateTerm) String() string {
+	return "ConntrackState(" + t.States + ")"
+}
+
+// ProtocolTerm matches packets of the IP protocol, which is a name, such as "tcp", or a
+// number, or doesn't if Negate is set.
+type ProtocolTerm struct {
+	Protocol string
+	Negate   bool
+}
+
+func (t ProtocolTerm) String() string {
+	return notPrefix(t.Negate) + "Protocol(" + t.Protocol + ")"
+}
+
+// TCPSynTerm matches TCP packets with SYN set and RST clear.
+type TCPSynTerm struct{}
+
+func (t TCPSynTerm) String() string {
+	return "TCPSyn"
+}
+
+// StatisticRandomTerm matches packets at random with the given probability, between 0 and 1.
+type StatisticRandomTerm struct {
+	Probability float64
+}
+
+func (t StatisticRandomTerm) String() string {
+	return fmt.Sprintf("StatisticRandom(%0.10f)", t.Probability)
+}
+
+// StatisticNthTerm matches one in every Every packets that reach the rule; Packet is which
+// one, counting from 0.
+type StatisticNthTerm struct {
+	Every  int
+	Packet int
+}
+
+func (t StatisticNthTerm) String() string {
+	return fmt.Sprintf("StatisticNth(%d, %d)", t.Every, t.Packet)
+}
+
+// NetTerm matches packets whose source, or, if Dest is set, destination, address is in the
+// CIDR, or isn't if Negate is set.
+type NetTerm struct {
+	Net    string
+	Dest   bool
+	Negate bool
+}
+
+func (t NetTerm) String() string {
+	if t.Dest {
+		return notPrefix(t.Negate) + "DestNet(" + t.Net + ")"
+	}
+	return notPrefix(t.Negate) + "SourceNet(" + t.Net + ")"
+}
+
+// IPSetTerm matches packets whose source, or, if Dest is set, destination, address is in the
+// IP set, or isn't if Negate is set.
+type IPSetTerm struct {
+	Name   string
+	Dest   bool
+	Negate bool
+}
+
+func (t IPSetTerm) validate() {
+	// Our IP set names are generated so an invalid one is a bug; rendering it could corrupt
+	// the iptables-restore input.
+	if err := ValidateIPSetName(t.Name); err != nil {
+		log.WithError(err).Panic("Probably bug: invalid IP set name")
+	}
+}
+
+func (t IPSetTerm) String() string {
+	if t.Dest {
+		return notPrefix(t.Negate) + "DestIPSet(" + t.Name + ")"
+	}
+	return notPrefix(t.Negate) + "SourceIPSet(" + t.Name + ")"
+}
+
+// PortsTerm matches packets whose source, or, if Dest is set, destination, port is in one of
+// the ranges, or isn't if Negate is set.  The ranges must fit in a single multiport match; see
+// MultiPortMatch for longer lists.
+type PortsTerm struct {
+	Ports  []*proto.PortRange
+	Dest   bool
+	Negate bool
+}
+
+func (t PortsTerm) String() string {
+	if t.Dest {
+		return notPrefix(t.Negate) + "DestPorts(" + PortRangessToMultiport(t.Ports) + ")"
+	}
+	return notPrefix(t.Negate) + "SourcePorts(" + PortRangessToMultiport(t.Ports) + ")"
+}
+
+// ICMPTypeTerm matches ICMP, or, if IPv6 is set, ICMPv6, packets of the type and, if HasCode
+// is set, code, or doesn't if Negate is set.
+type ICMPTypeTerm struct {
+	IPv6    bool
+	Type    uint8
+	Code    uint8
+	HasCode bool
+	Negate  bool
+}
+
+func (t ICMPTypeTerm) String() string {
+	name := "ICMPType"
+	if t.IPv6 {
+		name = "ICMPV6Type"
+	}
+	if t.HasCode {
+		return fmt.Sprintf("%s%sAndCode(%d, %d)", notPrefix(t.Negate), name, t.Type, t.Code)
+	}
+	return fmt.Sprintf("%s%s(%d)", notPrefix(t.Negate), name, t.Type)
+}
+
+// DSCPTerm matches packets with the given value in their DSCP field, or without it if Negate
+// is set.
+type DSCPTerm struct {
+	Value  uint8
+	Negate bool
+}
+
+func (t DSCPTerm) String() string {
+	return fmt.Sprintf("%sDSCP(0x%02x)", notPrefix(t.Negate), t.Value)
+}
+
+// TOSTerm matches packets whose TOS (IPv4) or traffic class (IPv6) byte, masked with Mask,
+// equals Value, or doesn't if Negate is set.
+type TOSTerm struct {
+	Value  uint8
+	Mask   uint8
+	Negate bool
+}
+
+func (t TOSTerm) String() string {
+	return fmt.Sprintf("%sTOS(0x%02x/0x%02x)", notPrefix(t.Negate), t.Value, t.Mask)
+}
+
+// HashLimitTerm matches packets in a group that is within the rate limit or, if Above is set,
+// over it.
+type HashLimitTerm struct {
+	Limit HashLimit
+	Above bool
+}
+
+func (t HashLimitTerm) validate() {
+	l := t.Limit
+	if l.Name == "" || len(l.Name) > MaxHashLimitNameLength || l.Rate == 0 {
+		log.WithField("limit", l).Panic("Probably bug: hashlimit with a bad name or no rate")
+	}
+}
+
+func (t HashLimitTerm) String() string {
+	if t.Above {
+		return fmt.Sprintf("HashLimitAbove%+v", t.Limit)
+	}
+	return fmt.Sprintf("HashLimitUpTo%+v", t.Limit)
+}
+
+// RecentUpdateTerm adds, or refreshes, the packet's address in the recent list, in which case
+// it always matches, or, if Remove is set, removes it, in which case it matches if the address
+// was in the list.
+type RecentUpdateTerm struct {
+	List   RecentList
+	Remove bool
+}
+
+func (t RecentUpdateTerm) validate() {
+	t.List.validate()
+}
+
+func (t RecentUpdateTerm) String() string {
+	if t.Remove {
+		return fmt.Sprintf("RecentRemove%+v", t.List)
+	}
+	return fmt.Sprintf("RecentSet%+v", t.List)
+}
+
+// RecentCheckTerm matches packets that pass the check, or that fail it if Negate is set.
+type RecentCheckTerm struct {
+	Check  RecentCheck
+	Negate bool
+}
+
+func (t RecentCheckTerm) validate() {
+	t.Check.List.validate()
+	if t.Check.Reap && t.Check.Seconds == 0 {
+		log.WithField("check", t.Check).Panic("Probably bug: recent check reaps without seconds")
+	}
+}
+
+func (t RecentCheckTerm) String() string {
+	return fmt.Sprintf("%sRecentCheck%+v", notPrefix(t.Negate), t.Check)
+}
+
+func (l RecentList) validate() {
+	if !recentNameRegexp.MatchString(l.Name) || len(l.Name) > MaxRecentNameLength {
+		log.WithField("list", l).Panic("Probably bug: recent list with a bad name")
+	}
+}
+
+// TimeTerm matches packets that arrive in the time window.
+type TimeTerm struct {
+	TimeMatch
+}
+
+func (t TimeTerm) validate() {
+	if t.StartTime < 0 || t.StartTime >= 24*time.Hour || t.StopTime < 0 || t.StopTime >= 24*time.Hour {
+		log.WithField("time", t.TimeMatch).Panic("Probably bug: time match outside of the day")
+	}
+}
+
+func (t TimeTerm) String() string {
+	return fmt.Sprintf("Time%+v", t.TimeMatch)
+}
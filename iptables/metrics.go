@@ -0,0 +1,106 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Metric identifies one of the metrics that the Table updates.  Its value is the name of the
+// Prometheus metric.
+type Metric string
+
+const (
+	MetricRestoreCalls             Metric = "felix_iptables_restore_calls"
+	MetricRestoreErrors            Metric = "felix_iptables_restore_errors"
+	MetricSaveCalls                Metric = "felix_iptables_save_calls"
+	MetricSaveErrors               Metric = "felix_iptables_save_errors"
+	MetricVerifyFailures           Metric = "felix_iptables_verify_failures"
+	MetricRestorePreflightFailures Metric = "felix_iptables_restore_preflight_failures"
+	MetricRuleTextMismatches       Metric = "felix_iptables_rule_text_mismatches"
+	MetricChains                   Metric = "felix_iptables_chains"
+	MetricRules                    Metric = "felix_iptables_rules"
+	MetricQuarantinedChains        Metric = "felix_iptables_quarantined_chains"
+	MetricTamperDetected           Metric = "felix_iptables_tamper_detected"
+	MetricLinesExecuted            Metric = "felix_iptables_lines_executed"
+	MetricDeferredInvalidations    Metric = "felix_iptables_deferred_invalidations"
+)
+
+// MetricsRecorder receives the Table's metric updates.  By default, the Table updates our
+// Prometheus metrics, labelled with its IP version and table name where the metric has those
+// labels.  Tests can pass a recorder, such as fake.Metrics, in TableOptions.MetricsRecorder to
+// check the updates that a Table makes without reading the global Prometheus registry.
+//
+// If the Table is ThreadSafe, the recorder may be called from multiple goroutines.
+type MetricsRecorder interface {
+	// Add adds delta, which may be negative for a gauge, to the metric.
+	Add(metric Metric, delta float64)
+	// Set sets a gauge.
+	Set(metric Metric, value float64)
+}
+
+// prometheusRecorder is the default MetricsRecorder; it updates our Prometheus metrics.
+type prometheusRecorder struct {
+	counters map[Metric]prometheus.Counter
+	gauges   map[Metric]prometheus.Gauge
+}
+
+func newPrometheusRecorder(ipVersion uint8, tableName string) *prometheusRecorder {
+	ipVersionLabel := fmt.Sprintf("%d", ipVersion)
+	return &prometheusRecorder{
+		counters: map[Metric]prometheus.Counter{
+			MetricRestoreCalls:             countNumRestoreCalls,
+			MetricRestoreErrors:            countNumRestoreErrors,
+			MetricSaveCalls:                countNumSaveCalls,
+			MetricSaveErrors:               countNumSaveErrors,
+			MetricVerifyFailures:           countNumVerifyFailures,
+			MetricRestorePreflightFailures: countNumRestorePreflightFailures,
+			MetricRuleTextMismatches:       countNumRuleTextMismatches,
+			MetricTamperDetected:           countNumTamperDetected.WithLabelValues(ipVersionLabel, tableName),
+			MetricLinesExecuted:            countNumLinesExecuted.WithLabelValues(ipVersionLabel, tableName),
+			MetricDeferredInvalidations:    countNumDeferredInvalidations,
+		},
+		gauges: map[Metric]prometheus.Gauge{
+			MetricChains:            gaugeNumChains.WithLabelValues(ipVersionLabel, tableName),
+			MetricRules:             gaugeNumRules.WithLabelValues(ipVersionLabel, tableName),
+			MetricQuarantinedChains: gaugeNumQuarantined.WithLabelValues(ipVersionLabel, tableName),
+		},
+	}
+}
+
+func (r *prometheusRecorder) Add(metric Metric, delta float64) {
+	if c, ok := r.counters[metric]; ok {
+		c.Add(delta)
+		return
+	}
+	r.gauges[metric].Add(delta)
+}
+
+func (r *prometheusRecorder) Set(metric Metric, value float64) {
+	r.gauges[metric].Set(value)
+}
+
+// metricCounter adapts a MetricsRecorder's counter to the counter interface that the
+// RestoreInputBuilder uses.
+type metricCounter struct {
+	recorder MetricsRecorder
+	metric   Metric
+}
+
+func (c metricCounter) Inc() {
+	c.recorder.Add(c.metric, 1)
+}
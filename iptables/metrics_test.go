@@ -0,0 +1,80 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/projectcalico/felix/iptables"
+	"github.com/projectcalico/felix/iptables/fake"
+)
+
+var _ = Describe("Table metrics", func() {
+	var dataplane *mockDataplane
+	var metrics *fake.Metrics
+	var table *Table
+
+	fooRules := []Rule{
+		{Match: Match().Protocol("tcp"), Action: AcceptAction{}},
+		{Match: Match().Protocol("udp"), Action: AcceptAction{}},
+	}
+
+	BeforeEach(func() {
+		dataplane = newMockDataplane("filter", map[string][]string{
+			"FORWARD": {},
+			"INPUT":   {},
+			"OUTPUT":  {},
+		})
+		metrics = fake.NewMetrics()
+		table = dataplane.newTable(func(options *TableOptions) {
+			options.MetricsRecorder = metrics
+		})
+		table.UpdateChain(&Chain{Name: "cali-foo", Rules: fooRules})
+		table.SetRuleInsertions("FORWARD", []Rule{{Action: JumpAction{Target: "cali-foo"}}})
+	})
+
+	It("should track the rules that we've been given", func() {
+		Expect(metrics.Value(MetricRules)).To(Equal(3.0))
+		table.RemoveChainByName("cali-foo")
+		Expect(metrics.Value(MetricRules)).To(Equal(1.0))
+	})
+
+	It("should record a single save and restore for the first write", func() {
+		table.Apply()
+		Expect(metrics.Value(MetricSaveCalls)).To(Equal(1.0))
+		Expect(metrics.Value(MetricRestoreCalls)).To(Equal(1.0))
+		Expect(metrics.Value(MetricRestoreErrors)).To(BeZero())
+		// *filter, the forward reference, two appends, the insert and COMMIT.
+		Expect(metrics.Value(MetricLinesExecuted)).To(Equal(6.0))
+		Expect(metrics.Value(MetricChains)).To(Equal(1.0))
+	})
+
+	It("should record nothing for an Apply() with nothing to do", func() {
+		table.Apply()
+		metrics.Reset()
+		table.Apply()
+		Expect(metrics.Value(MetricSaveCalls)).To(BeZero())
+		Expect(metrics.Value(MetricRestoreCalls)).To(BeZero())
+		Expect(metrics.Value(MetricLinesExecuted)).To(BeZero())
+	})
+
+	It("should record a failed restore and its retry", func() {
+		dataplane.FailNextRestore = true
+		table.Apply()
+		Expect(metrics.Value(MetricRestoreCalls)).To(Equal(2.0))
+		Expect(metrics.Value(MetricRestoreErrors)).To(Equal(1.0))
+	})
+})
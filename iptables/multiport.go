@@ -0,0 +1,125 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"sort"
+
+	"github.com/projectcalico/felix/proto"
+)
+
+// MaxMultiportSlots is the number of port "slots" in a multiport match.  A single port takes up
+// one slot, a range of ports requires 2.
+const MaxMultiportSlots = 15
+
+// MultiPortMatch matches packets on lists of ports and port ranges of any length.  A packet
+// must match one of the SrcPorts and one of the DstPorts, if those are set, and none of the
+// NotSrcPorts and NotDstPorts.
+//
+// Since a multiport match only has MaxMultiportSlots slots, a long list may not fit in one
+// rule.  Matches returns the match criteria of as many rules as are needed: the positive lists
+// are split into blocks, with a rule for each combination of a source block and a destination
+// block, whereas the negated lists are split into several multiport matches in each rule,
+// since the matches in a rule are ANDed together.
+//
+// The lists are sorted and overlapping or adjacent ranges are merged before they're split, so
+// the rules, and hence their hashes, only depend on the set of ports and not on the order or
+// grouping in which they were given.
+type MultiPortMatch struct {
+	SrcPorts    []*proto.PortRange
+	DstPorts    []*proto.PortRange
+	NotSrcPorts []*proto.PortRange
+	NotDstPorts []*proto.PortRange
+}
+
+// Matches returns the match criteria of the rules that implement the match, each starting with
+// base, which should include a protocol match for TCP, UDP or SCTP.
+func (p MultiPortMatch) Matches(base MatchCriteria) []MatchCriteria {
+	notSrcSplits := splitPortRanges(normalisePortRanges(p.NotSrcPorts))
+	notDstSplits := splitPortRanges(normalisePortRanges(p.NotDstPorts))
+
+	var matches []MatchCriteria
+	for _, srcPorts := range splitPortRanges(normalisePortRanges(p.SrcPorts)) {
+		for _, dstPorts := range splitPortRanges(normalisePortRanges(p.DstPorts)) {
+			// Copy base so that the rules don't share its backing array.
+			match := append(MatchCriteria(nil), base...)
+			if len(srcPorts) > 0 {
+				match = match.SourcePortRanges(srcPorts)
+			}
+			if len(dstPorts) > 0 {
+				match = match.DestPortRanges(dstPorts)
+			}
+			for _, ports := range notSrcSplits {
+				if len(ports) > 0 {
+					match = match.NotSourcePortRanges(ports)
+				}
+			}
+			for _, ports := range notDstSplits {
+				if len(ports) > 0 {
+					match = match.NotDestPortRanges(ports)
+				}
+			}
+			matches = append(matches, match)
+		}
+	}
+	return matches
+}
+
+// normalisePortRanges returns a sorted copy of the list of port ranges, with overlapping and
+// adjacent ranges merged.
+func normalisePortRanges(ports []*proto.PortRange) []*proto.PortRange {
+	sorted := make([]*proto.PortRange, len(ports))
+	copy(sorted, ports)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].First != sorted[j].First {
+			return sorted[i].First < sorted[j].First
+		}
+		return sorted[i].Last < sorted[j].Last
+	})
+	var merged []*proto.PortRange
+	for _, portRange := range sorted {
+		if len(merged) > 0 {
+			last := merged[len(merged)-1]
+			if portRange.First <= last.Last+1 {
+				if portRange.Last > last.Last {
+					last.Last = portRange.Last
+				}
+				continue
+			}
+		}
+		merged = append(merged, &proto.PortRange{First: portRange.First, Last: portRange.Last})
+	}
+	return merged
+}
+
+// splitPortRanges splits the list of port ranges into blocks that each fit in a multiport
+// match.  It always returns at least one (possibly empty) block.
+func splitPortRanges(ports []*proto.PortRange) [][]*proto.PortRange {
+	splits := [][]*proto.PortRange{nil}
+	slotsAvailable := MaxMultiportSlots
+	for _, portRange := range ports {
+		slotsRequired := 1
+		if portRange.First != portRange.Last {
+			slotsRequired = 2
+		}
+		if slotsAvailable < slotsRequired {
+			splits = append(splits, nil)
+			slotsAvailable = MaxMultiportSlots
+		}
+		splits[len(splits)-1] = append(splits[len(splits)-1], portRange)
+		slotsAvailable -= slotsRequired
+	}
+	return splits
+}
@@ -0,0 +1,110 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/projectcalico/felix/iptables"
+
+	"github.com/projectcalico/felix/proto"
+)
+
+func portList(first, count int32) []*proto.PortRange {
+	var ports []*proto.PortRange
+	for p := first; p < first+count; p++ {
+		ports = append(ports, &proto.PortRange{First: p * 2, Last: p * 2})
+	}
+	return ports
+}
+
+func renderMatches(matches []MatchCriteria) []string {
+	var rendered []string
+	for _, m := range matches {
+		rendered = append(rendered, m.Render())
+	}
+	return rendered
+}
+
+var _ = Describe("MultiPortMatch", func() {
+	base := Match().Protocol("tcp")
+
+	It("should render a short list as a single rule", func() {
+		matches := MultiPortMatch{
+			SrcPorts:    []*proto.PortRange{{First: 1000, Last: 2000}},
+			DstPorts:    []*proto.PortRange{{First: 80, Last: 80}, {First: 443, Last: 443}},
+			NotDstPorts: []*proto.PortRange{{First: 444, Last: 444}},
+		}.Matches(base)
+		Expect(renderMatches(matches)).To(Equal([]string{
+			"-p tcp -m multiport --source-ports 1000:2000 -m multiport --destination-ports 80,443 " +
+				"-m multiport ! --destination-ports 444",
+		}))
+	})
+
+	It("should render only the base with no ports", func() {
+		Expect(renderMatches(MultiPortMatch{}.Matches(base))).To(Equal([]string{"-p tcp"}))
+	})
+
+	It("should split long positive lists into the cross-product of rules", func() {
+		matches := MultiPortMatch{
+			SrcPorts: portList(1, 16),
+			DstPorts: append(portList(100, 14), &proto.PortRange{First: 1000, Last: 1010}),
+		}.Matches(base)
+		Expect(renderMatches(matches)).To(Equal([]string{
+			"-p tcp -m multiport --source-ports 2,4,6,8,10,12,14,16,18,20,22,24,26,28,30 " +
+				"-m multiport --destination-ports 200,202,204,206,208,210,212,214,216,218,220,222,224,226",
+			"-p tcp -m multiport --source-ports 2,4,6,8,10,12,14,16,18,20,22,24,26,28,30 " +
+				"-m multiport --destination-ports 1000:1010",
+			"-p tcp -m multiport --source-ports 32 " +
+				"-m multiport --destination-ports 200,202,204,206,208,210,212,214,216,218,220,222,224,226",
+			"-p tcp -m multiport --source-ports 32 -m multiport --destination-ports 1000:1010",
+		}))
+	})
+
+	It("should split long negated lists within each rule", func() {
+		matches := MultiPortMatch{NotSrcPorts: portList(1, 16)}.Matches(base)
+		Expect(renderMatches(matches)).To(Equal([]string{
+			"-p tcp -m multiport ! --source-ports 2,4,6,8,10,12,14,16,18,20,22,24,26,28,30 " +
+				"-m multiport ! --source-ports 32",
+		}))
+	})
+
+	It("should render the same rules whatever the order and grouping of the ports", func() {
+		ports := portList(1, 20)
+		reordered := []*proto.PortRange{{First: 1, Last: 1}}
+		for i := len(ports) - 1; i >= 0; i-- {
+			reordered = append(reordered, ports[i])
+		}
+		merged := []*proto.PortRange{{First: 1, Last: 2}}
+		merged = append(merged, ports[1:]...)
+		reordered = append(reordered, &proto.PortRange{First: 2, Last: 2})
+
+		expected := renderMatches(MultiPortMatch{DstPorts: merged}.Matches(base))
+		Expect(renderMatches(MultiPortMatch{DstPorts: reordered}.Matches(base))).To(Equal(expected))
+		Expect(expected[0]).To(HavePrefix("-p tcp -m multiport --destination-ports 1:2,4,6,"))
+		Expect(ports[0]).To(Equal(&proto.PortRange{First: 2, Last: 2}), "input should not be modified")
+	})
+
+	It("should not share the base's backing array between rules", func() {
+		base := make(MatchCriteria, 1, 10)
+		base[0] = ProtocolTerm{Protocol: "udp"}
+		matches := MultiPortMatch{DstPorts: portList(1, 16)}.Matches(base)
+		Expect(renderMatches(matches)).To(Equal([]string{
+			"-p udp -m multiport --destination-ports 2,4,6,8,10,12,14,16,18,20,22,24,26,28,30",
+			"-p udp -m multiport --destination-ports 32",
+		}))
+	})
+})
@@ -0,0 +1,49 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+// Reasons passed to TableOptions.OnOutOfSync.
+const (
+	// OutOfSyncUnexpectedInserts means that a kernel chain that we shouldn't have any inserts
+	// in has rules with our hashes.
+	OutOfSyncUnexpectedInserts = "unexpected-inserts"
+	// OutOfSyncInsertsModified means that our inserts in a kernel chain have been removed,
+	// reordered or moved.
+	OutOfSyncInsertsModified = "inserts-modified"
+	// OutOfSyncChainModified means that the contents of one of our chains have changed.
+	OutOfSyncChainModified = "chain-modified"
+	// OutOfSyncChainMissing means that one of our chains has been deleted from the dataplane.
+	OutOfSyncChainMissing = "chain-missing"
+	// OutOfSyncPolicyModified means that the default policy of a kernel chain whose policy we
+	// manage has changed.
+	OutOfSyncPolicyModified = "policy-modified"
+	// OutOfSyncRuleAltered means that one of our rules was modified in place, keeping its hash
+	// comment.  Only detected if TableOptions.StrictVerify is set.
+	OutOfSyncRuleAltered = "rule-altered"
+	// OutOfSyncHookChainMissing means that a non-kernel chain that we have inserts for, such as
+	// DOCKER-USER, doesn't exist.  Our inserts are programmed once it appears.
+	OutOfSyncHookChainMissing = "hook-chain-missing"
+	// OutOfSyncForeignRules means that one of our chains contains rules that aren't ours and
+	// that we've quarantined it.  Only reported if TableOptions.ForeignRulePolicy is
+	// ForeignRulesQuarantine.
+	OutOfSyncForeignRules = "foreign-rules"
+)
+
+func (t *Table) reportOutOfSync(chainName string, reason string) {
+	if t.onOutOfSync == nil {
+		return
+	}
+	t.onOutOfSync(chainName, reason)
+}
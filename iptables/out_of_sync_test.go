@@ -0,0 +1,86 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/projectcalico/felix/iptables"
+)
+
+var _ = Describe("Table OnOutOfSync callback", func() {
+	var dataplane *mockDataplane
+	var table *Table
+	var reports []string
+
+	BeforeEach(func() {
+		dataplane = newMockDataplane("filter", map[string][]string{
+			"FORWARD": {"-j kube-forward"},
+			"INPUT":   {},
+			"OUTPUT":  {},
+		})
+		reports = nil
+		table = dataplane.newTable(func(options *TableOptions) {
+			options.OnOutOfSync = func(chainName string, reason string) {
+				reports = append(reports, chainName+" "+reason)
+			}
+		})
+		table.SetRuleInsertions("FORWARD", []Rule{{Action: JumpAction{Target: "cali-FORWARD"}}})
+		table.UpdateChain(&Chain{Name: "cali-FORWARD", Rules: []Rule{{Action: AcceptAction{}}}})
+		table.Apply()
+	})
+
+	resync := func() {
+		table.InvalidateDataplaneCache("test")
+		table.Apply()
+	}
+
+	It("should not report anything if the dataplane is intact", func() {
+		resync()
+		Expect(reports).To(BeEmpty())
+	})
+
+	It("should not report our own first write", func() {
+		Expect(reports).To(BeEmpty())
+	})
+
+	It("should report removal of our inserts", func() {
+		dataplane.Chains["FORWARD"] = []string{"-j kube-forward"}
+		resync()
+		Expect(reports).To(Equal([]string{"FORWARD " + OutOfSyncInsertsModified}))
+
+		// Once repaired, there's nothing more to report.
+		resync()
+		Expect(reports).To(HaveLen(1))
+	})
+
+	It("should report modification of one of our chains", func() {
+		dataplane.Chains["cali-FORWARD"] = append(dataplane.Chains["cali-FORWARD"], "-j DROP")
+		resync()
+		Expect(reports).To(Equal([]string{"cali-FORWARD " + OutOfSyncChainModified}))
+	})
+
+	It("should report inserts that reappear after we removed them", func() {
+		ourInsert := dataplane.Chains["FORWARD"][0]
+		table.SetRuleInsertions("FORWARD", nil)
+		table.Apply()
+		Expect(reports).To(BeEmpty())
+
+		dataplane.Chains["FORWARD"] = []string{ourInsert, "-j kube-forward"}
+		resync()
+		Expect(reports).To(Equal([]string{"FORWARD " + OutOfSyncUnexpectedInserts}))
+	})
+})
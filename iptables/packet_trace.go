@@ -0,0 +1,150 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Kinds of TraceEvent, as logged by the kernel.
+const (
+	// TraceKindRule means that the packet matched the rule.
+	TraceKindRule = "rule"
+	// TraceKindReturn means that the packet reached the end of a user-defined chain.
+	TraceKindReturn = "return"
+	// TraceKindPolicy means that the packet reached the end of a built-in chain and got the
+	// chain's policy.
+	TraceKindPolicy = "policy"
+)
+
+// SetTraceRules sets rules, typically a TraceAction rule that matches the packets of interest,
+// to be inserted into the given kernel chain ahead of the rules passed to SetRuleInsertions.
+// They are written and cleaned up along with our other inserted rules.  Pass nil to remove
+// them.
+func (t *Table) SetTraceRules(chainName string, rules []Rule) {
+	t.opLock.Lock()
+	defer t.opLock.Unlock()
+	t.logCxt.WithFields(log.Fields{
+		"chainName": chainName,
+		"numRules":  len(rules),
+	}).Info("Updating trace rules")
+	if len(rules) == 0 {
+		delete(t.chainToTraceRules, chainName)
+	} else {
+		t.chainToTraceRules[chainName] = rules
+	}
+	t.updateInsertedRules(chainName, "trace rules")
+}
+
+func (t *Table) withTraceRules(chainName string, rules []Rule) []Rule {
+	traceRules := t.chainToTraceRules[chainName]
+	if len(traceRules) == 0 {
+		return rules
+	}
+	rulesWithTrace := make([]Rule, 0, len(traceRules)+len(rules))
+	rulesWithTrace = append(rulesWithTrace, traceRules...)
+	return append(rulesWithTrace, rules...)
+}
+
+// RuleAt returns the rule that we programmed at the given (1-based) position of the given
+// chain, according to our cache of the dataplane.  It's intended for interpreting the rule
+// numbers in the kernel's trace output.  Returns false if the position holds a rule that isn't
+// ours, or if the chain has changed since our last write.
+func (t *Table) RuleAt(chainName string, ruleNum int) (Rule, bool) {
+	t.opLock.Lock()
+	defer t.opLock.Unlock()
+
+	hashes := t.chainToDataplaneHashes[chainName]
+	if ruleNum < 1 || ruleNum > len(hashes) || hashes[ruleNum-1] == "" {
+		return Rule{}, false
+	}
+	hash := hashes[ruleNum-1]
+
+	features := t.featureDetector.GetFeatures()
+	var rules []Rule
+	var ourHashes []string
+	if chain := t.chainNameToChain[chainName]; chain != nil {
+		rules = chain.Rules
+		ourHashes = t.ruleHashes(chain, features)
+	} else {
+		rules = t.chainToInsertedRules[chainName]
+		ourHashes = t.calculateRuleInsertHashes(chainName, rules, features)
+	}
+	for i, h := range ourHashes {
+		if h == hash {
+			return rules[i], true
+		}
+	}
+	return Rule{}, false
+}
+
+// TraceEvent is one line of the kernel's packet trace output, which it logs for each rule that
+// a packet marked by a TraceAction hits.
+type TraceEvent struct {
+	Table string
+	Chain string
+	// Kind is one of TraceKindRule, TraceKindReturn or TraceKindPolicy.
+	Kind    string
+	RuleNum int
+	// Packet holds the fields of the packet, as logged by the kernel, for example, "SRC",
+	// "DST", "PROTO", "SPT" and "DPT".
+	Packet map[string]string
+}
+
+// ParseTraceLine parses a kernel log line of the form
+//
+//	TRACE: filter:cali-fw-cali1234:rule:3 IN=cali1234 OUT=eth0 SRC=10.0.0.1 ...
+//
+// as read from /dev/kmsg or syslog (anything before "TRACE: " is ignored).  Returns false if
+// the line isn't a trace line.
+func ParseTraceLine(line string) (TraceEvent, bool) {
+	idx := strings.Index(line, "TRACE: ")
+	if idx < 0 {
+		return TraceEvent{}, false
+	}
+	fields := strings.Fields(line[idx+len("TRACE: "):])
+	if len(fields) == 0 {
+		return TraceEvent{}, false
+	}
+	// Chain names can't contain colons so the location is always table:chain:kind:num.
+	location := strings.Split(fields[0], ":")
+	if len(location) != 4 {
+		return TraceEvent{}, false
+	}
+	ruleNum, err := strconv.Atoi(location[3])
+	if err != nil {
+		return TraceEvent{}, false
+	}
+	event := TraceEvent{
+		Table:   location[0],
+		Chain:   location[1],
+		Kind:    location[2],
+		RuleNum: ruleNum,
+		Packet:  map[string]string{},
+	}
+	for _, field := range fields[1:] {
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) != 2 {
+			// Flags, such as "SYN" or "DF".
+			event.Packet[field] = ""
+			continue
+		}
+		event.Packet[parts[0]] = parts[1]
+	}
+	return event, true
+}
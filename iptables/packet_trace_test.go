@@ -0,0 +1,127 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/projectcalico/felix/iptables"
+)
+
+var _ = Describe("Packet trace support", func() {
+	Describe("ParseTraceLine", func() {
+		It("should parse a line from /dev/kmsg", func() {
+			event, ok := ParseTraceLine("4,1234,5678,-;TRACE: filter:cali-fw-cali1234:rule:3 " +
+				"IN=cali1234 OUT=eth0 SRC=10.0.0.1 DST=10.0.0.2 LEN=60 ID=4321 DF PROTO=TCP SPT=1234 DPT=80 SYN")
+			Expect(ok).To(BeTrue())
+			Expect(event.Table).To(Equal("filter"))
+			Expect(event.Chain).To(Equal("cali-fw-cali1234"))
+			Expect(event.Kind).To(Equal(TraceKindRule))
+			Expect(event.RuleNum).To(Equal(3))
+			Expect(event.Packet).To(HaveKeyWithValue("SRC", "10.0.0.1"))
+			Expect(event.Packet).To(HaveKeyWithValue("DPT", "80"))
+			Expect(event.Packet).To(HaveKeyWithValue("OUT", "eth0"))
+			Expect(event.Packet).To(HaveKey("SYN"))
+		})
+
+		It("should parse a syslog-style policy line", func() {
+			event, ok := ParseTraceLine("[ 123.456] TRACE: raw:PREROUTING:policy:7 IN=eth0 OUT= SRC=10.0.0.1")
+			Expect(ok).To(BeTrue())
+			Expect(event.Table).To(Equal("raw"))
+			Expect(event.Chain).To(Equal("PREROUTING"))
+			Expect(event.Kind).To(Equal(TraceKindPolicy))
+			Expect(event.RuleNum).To(Equal(7))
+			Expect(event.Packet).To(HaveKeyWithValue("OUT", ""))
+		})
+
+		It("should reject other lines", func() {
+			for _, line := range []string{
+				"",
+				"6,1,2,-;eth0: link up",
+				"TRACE: ",
+				"TRACE: filter:FORWARD:rule",
+				"TRACE: filter:FORWARD:rule:x SRC=10.0.0.1",
+			} {
+				_, ok := ParseTraceLine(line)
+				Expect(ok).To(BeFalse(), line)
+			}
+		})
+	})
+
+	Describe("with a table", func() {
+		var dataplane *mockDataplane
+		var table *Table
+
+		traceRule := Rule{
+			Match:  Match().Protocol("tcp").DestNet("10.0.0.2"),
+			Action: TraceAction{},
+		}
+
+		BeforeEach(func() {
+			dataplane = newMockDataplane("raw", map[string][]string{
+				"PREROUTING": {"-j other-rule"},
+				"OUTPUT":     {},
+			})
+			table = dataplane.newTable(nil)
+			table.UpdateChain(&Chain{Name: "cali-PREROUTING", Rules: []Rule{
+				{Action: ReturnAction{}, Comment: "first"},
+				{Action: AcceptAction{}, Comment: "second"},
+			}})
+			table.SetRuleInsertions("PREROUTING", []Rule{{Action: JumpAction{Target: "cali-PREROUTING"}}})
+			table.Apply()
+		})
+
+		It("should insert trace rules ahead of our inserts and remove them again", func() {
+			table.SetTraceRules("PREROUTING", []Rule{traceRule})
+			table.Apply()
+			Expect(dataplane.Chains["PREROUTING"]).To(HaveLen(3))
+			Expect(dataplane.Chains["PREROUTING"][0]).To(ContainSubstring("--jump TRACE"))
+			Expect(dataplane.Chains["PREROUTING"][1]).To(ContainSubstring("--jump cali-PREROUTING"))
+			Expect(dataplane.Chains["PREROUTING"][2]).To(Equal("-j other-rule"))
+
+			table.SetTraceRules("PREROUTING", nil)
+			table.Apply()
+			Expect(dataplane.Chains["PREROUTING"]).To(HaveLen(2))
+			Expect(dataplane.Chains["PREROUTING"][0]).To(ContainSubstring("--jump cali-PREROUTING"))
+		})
+
+		It("should keep trace rules across changes to the inserts", func() {
+			table.SetTraceRules("PREROUTING", []Rule{traceRule})
+			table.SetRuleInsertions("PREROUTING", []Rule{{Action: JumpAction{Target: "cali-other"}}})
+			table.UpdateChain(&Chain{Name: "cali-other"})
+			table.Apply()
+			Expect(dataplane.Chains["PREROUTING"][0]).To(ContainSubstring("--jump TRACE"))
+			Expect(dataplane.Chains["PREROUTING"][1]).To(ContainSubstring("--jump cali-other"))
+		})
+
+		It("should map rule numbers back to our rules", func() {
+			rule, ok := table.RuleAt("cali-PREROUTING", 2)
+			Expect(ok).To(BeTrue())
+			Expect(rule.Comment).To(Equal("second"))
+
+			rule, ok = table.RuleAt("PREROUTING", 1)
+			Expect(ok).To(BeTrue())
+			Expect(rule.Action).To(Equal(JumpAction{Target: "cali-PREROUTING"}))
+
+			_, ok = table.RuleAt("PREROUTING", 2)
+			Expect(ok).To(BeFalse(), "Rule isn't ours")
+			_, ok = table.RuleAt("cali-PREROUTING", 3)
+			Expect(ok).To(BeFalse(), "No such rule")
+			_, ok = table.RuleAt("cali-unknown", 1)
+			Expect(ok).To(BeFalse(), "No such chain")
+		})
+	})
+})
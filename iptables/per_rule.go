@@ -0,0 +1,158 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Degraded mode.
+//
+// Some minimal container images ship the iptables binary but not iptables-restore or
+// iptables-save.  Rather than refusing to start, the Table falls back to the iptables binary:
+// without iptables-save, it reads the table with "iptables -S", whose output readHashesFrom
+// understands; without iptables-restore, it executes its iptables-restore input one line at a
+// time.  In the latter case, updates are no longer atomic.  If a command fails, the earlier ones
+// have already taken effect so, as when a chunked update fails part way through, we mark
+// ourselves out of sync and reload the dataplane before retrying.
+
+var errCountersNeedSave = errors.New("reading counters requires iptables-save")
+
+// findRestoreOrSaveBinary is like findBestBinary but, if there's no iptables-restore or
+// iptables-save binary, it returns the main iptables binary, which must already have been
+// looked up, and true to indicate that we need to use degraded mode.
+func (t *Table) findRestoreOrSaveBinary(backendMode, saveOrRestore string) (cmd string, degraded bool) {
+	if cmd, ok := t.lookUpBinary(t.IPVersion, backendMode, saveOrRestore); ok {
+		return cmd, false
+	}
+	t.logCxt.WithFields(log.Fields{
+		"backendMode":   backendMode,
+		"saveOrRestore": saveOrRestore,
+		"command":       t.iptablesCmd,
+	}).Warn("Failed to find iptables-" + saveOrRestore + " command, falling back to the slower, " +
+		"non-atomic iptables command")
+	return t.iptablesCmd, true
+}
+
+// DegradedMode returns true if the Table is using the iptables binary because iptables-restore
+// or iptables-save is missing.
+func (t *Table) DegradedMode() bool {
+	t.opLock.Lock()
+	defer t.opLock.Unlock()
+	return t.restorePerRule || t.saveByListing
+}
+
+// newSaveCmd creates a command that prints the current state of our table: iptables-save or, in
+// degraded mode, "iptables -S".
+func (t *Table) newSaveCmd() CmdIface {
+	if t.saveByListing {
+		return t.newCmd(t.iptablesCmd, "-t", t.Name, "-S")
+	}
+	return t.newCmd(t.iptablesSaveCmd, "-t", t.Name)
+}
+
+// execRestorePerRule executes a chunk of iptables-restore input one line at a time with the
+// iptables binary.
+func (t *Table) execRestorePerRule(ctx context.Context, features *Features, chunk RestoreChunk) error {
+	lock := t.xtablesLock(ctx)
+	lock.Lock()
+	lineNum, errOutput, err := t.runRestoreInputPerRule(ctx, features, chunk.Input)
+	lock.Unlock()
+	if err != nil {
+		// Report the failing line in the same way as iptables-restore does so that the
+		// failure can be traced back to its chain.
+		errOutput = fmt.Sprintf("Error occurred at line: %d\n%s", lineNum, errOutput)
+		return t.onRestoreFailure(err, string(chunk.Input), "", errOutput, chunk.LineOrigins)
+	}
+	return nil
+}
+
+// runRestoreInputPerRule executes the given iptables-restore input one line at a time with the
+// iptables binary.  If a command fails, it returns the (1-based) number of the line and the
+// command's error output along with the error.
+func (t *Table) runRestoreInputPerRule(
+	ctx context.Context,
+	features *Features,
+	input []byte,
+) (lineNum int, errOutput string, err error) {
+	run := func(args ...string) (string, error) {
+		var errBuf bytes.Buffer
+		args = append(append(t.lockArgs(features), "-t", t.Name), args...)
+		cmd := t.newCmd(t.iptablesCmd, args...)
+		cmd.SetStderr(&errBuf)
+		err := runCmd(ctx, cmd)
+		return errBuf.String(), err
+	}
+
+	for i, line := range strings.Split(string(input), "\n") {
+		lineNum = i + 1
+		switch {
+		case line == "", line == "COMMIT", strings.HasPrefix(line, "*"), strings.HasPrefix(line, "#"):
+			continue
+		case strings.HasPrefix(line, ":"):
+			// Forward reference: make sure that the chain exists and that it's empty.
+			chainName := strings.Fields(line[1:])[0]
+			if _, err = run("-N", chainName); err == nil {
+				continue
+			}
+			if errOutput, err = run("-F", chainName); err != nil {
+				return
+			}
+		default:
+			if errOutput, err = run(perRuleArgs(line)...); err != nil {
+				return
+			}
+		}
+	}
+	return 0, "", nil
+}
+
+// perRuleArgs converts a line of iptables-restore input into the equivalent arguments for the
+// iptables binary.  Counters, which iptables-restore takes as a "[packets:bytes]" prefix, are
+// passed with the -c option.
+func perRuleArgs(line string) []string {
+	var counters []string
+	if strings.HasPrefix(line, "[") {
+		parts := strings.SplitN(line, " ", 2)
+		counters = strings.Split(strings.Trim(parts[0], "[]"), ":")
+		line = ""
+		if len(parts) > 1 {
+			line = parts[1]
+		}
+	}
+	args := splitRuleTokens(line)
+	if len(counters) != 2 || len(args) < 2 {
+		return args
+	}
+	// Put the counters after the command, the chain and, for inserts and replaces, the rule
+	// number.
+	pos := 2
+	switch args[0] {
+	case "-I", "--insert", "-R", "--replace":
+		if len(args) > 2 && len(args[2]) > 0 && args[2][0] >= '0' && args[2][0] <= '9' {
+			pos = 3
+		}
+	}
+	withCounters := make([]string, 0, len(args)+3)
+	withCounters = append(withCounters, args[:pos]...)
+	withCounters = append(withCounters, "-c", counters[0], counters[1])
+	return append(withCounters, args[pos:]...)
+}
@@ -0,0 +1,141 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables_test
+
+import (
+	"errors"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/projectcalico/felix/iptables"
+)
+
+var _ = Describe("Table without iptables-restore", func() {
+	var dataplane *mockDataplane
+	var table *Table
+
+	newTable := func(missing ...string) {
+		table = dataplane.newTable(func(options *TableOptions) {
+			options.LookPathOverride = func(file string) (string, error) {
+				for _, suffix := range missing {
+					if strings.HasSuffix(file, suffix) {
+						return "", errors.New("not found")
+					}
+				}
+				return dataplane.lookPath(file)
+			}
+		})
+		table.UpdateChain(&Chain{Name: "cali-foo", Rules: []Rule{
+			{Match: Match().Protocol("tcp"), Action: AcceptAction{}},
+			{Action: DropAction{}},
+		}})
+		table.SetRuleInsertions("FORWARD", []Rule{{Action: JumpAction{Target: "cali-foo"}}})
+	}
+
+	numCmds := func(name string) int {
+		n := 0
+		for _, cmdName := range dataplane.CmdNames {
+			if cmdName == name {
+				n++
+			}
+		}
+		return n
+	}
+
+	BeforeEach(func() {
+		dataplane = newMockDataplane("filter", map[string][]string{
+			"FORWARD": {},
+			"INPUT":   {},
+			"OUTPUT":  {},
+		})
+	})
+
+	Describe("or iptables-save", func() {
+		BeforeEach(func() {
+			newTable("-restore", "-save")
+			table.Apply()
+		})
+
+		It("should be in degraded mode", func() {
+			Expect(table.DegradedMode()).To(BeTrue())
+		})
+
+		It("should program the dataplane with the iptables command", func() {
+			Expect(numCmds("iptables-restore")).To(BeZero())
+			Expect(numCmds("iptables-save")).To(BeZero())
+			Expect(dataplane.Chains["cali-foo"]).To(HaveLen(2))
+			Expect(dataplane.Chains["cali-foo"][0]).To(HaveSuffix("--jump ACCEPT"))
+			Expect(dataplane.Chains["cali-foo"][1]).To(HaveSuffix("--jump DROP"))
+			Expect(dataplane.Chains["FORWARD"]).To(HaveLen(1))
+			Expect(dataplane.Chains["FORWARD"][0]).To(HaveSuffix("--jump cali-foo"))
+		})
+
+		It("should find nothing to do on resync", func() {
+			commandsBefore := numCmds("iptables")
+			table.InvalidateDataplaneCache("test")
+			table.Apply()
+			// Just the listing.
+			Expect(numCmds("iptables")).To(Equal(commandsBefore + 1))
+		})
+
+		It("should update the chain in place", func() {
+			table.UpdateChain(&Chain{Name: "cali-foo", Rules: []Rule{
+				{Match: Match().Protocol("udp"), Action: AcceptAction{}},
+			}})
+			table.Apply()
+			Expect(dataplane.Chains["cali-foo"]).To(HaveLen(1))
+			Expect(dataplane.Chains["cali-foo"][0]).To(ContainSubstring("udp"))
+			Expect(dataplane.FlushedChains.Contains("cali-foo")).To(BeFalse())
+		})
+
+		It("should repair interference that it finds when listing the table", func() {
+			dataplane.Chains["cali-foo"] = dataplane.Chains["cali-foo"][:1]
+			table.InvalidateDataplaneCache("test")
+			table.Apply()
+			Expect(dataplane.Chains["cali-foo"]).To(HaveLen(2))
+		})
+
+		It("should delete chains", func() {
+			table.SetRuleInsertions("FORWARD", nil)
+			table.RemoveChainByName("cali-foo")
+			table.Apply()
+			Expect(dataplane.Chains).NotTo(HaveKey("cali-foo"))
+			Expect(dataplane.Chains["FORWARD"]).To(BeEmpty())
+		})
+	})
+
+	Describe("with iptables-save", func() {
+		BeforeEach(func() {
+			newTable("-restore")
+			table.Apply()
+		})
+
+		It("should read the dataplane with iptables-save and write it with iptables", func() {
+			Expect(table.DegradedMode()).To(BeTrue())
+			Expect(numCmds("iptables-save")).To(Equal(1))
+			Expect(numCmds("iptables-restore")).To(BeZero())
+			Expect(dataplane.Chains["cali-foo"]).To(HaveLen(2))
+		})
+	})
+
+	It("should use iptables-restore and iptables-save if they're available", func() {
+		newTable()
+		table.Apply()
+		Expect(table.DegradedMode()).To(BeFalse())
+		Expect(numCmds("iptables-restore")).To(Equal(1))
+	})
+})
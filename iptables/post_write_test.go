@@ -0,0 +1,118 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables_test
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/projectcalico/felix/iptables"
+)
+
+var _ = Describe("Table post-write check schedule", func() {
+	var dataplane *mockDataplane
+	var table *Table
+
+	newTable := func(setOptions func(options *TableOptions)) {
+		table = dataplane.newTable(setOptions)
+		table.UpdateChain(&Chain{Name: "cali-foo", Rules: []Rule{{Action: AcceptAction{}}}})
+	}
+
+	// advanceAndApply advances time and calls Apply(), returning whether Apply() re-read the
+	// dataplane and the delay that it asked for.
+	advanceAndApply := func(d time.Duration) (bool, time.Duration) {
+		dataplane.AdvanceTimeBy(d)
+		numCmds := len(dataplane.CmdNames)
+		delay, _ := table.Apply()
+		for _, name := range dataplane.CmdNames[numCmds:] {
+			if name == "iptables-save" {
+				return true, delay
+			}
+		}
+		return false, delay
+	}
+
+	BeforeEach(func() {
+		dataplane = newMockDataplane("filter", map[string][]string{"FORWARD": {}})
+	})
+
+	It("should follow a custom schedule", func() {
+		newTable(func(options *TableOptions) {
+			options.PostWriteInterval = 100 * time.Millisecond
+			options.PostWriteBackoffFactor = 3
+			options.PostWriteMaxInterval = time.Second
+		})
+		Expect(rescheduleAfterOf(table.Apply())).To(Equal(100 * time.Millisecond))
+
+		for _, step := range []struct {
+			advance, delay time.Duration
+		}{
+			{100 * time.Millisecond, 200 * time.Millisecond}, // Checked at 100ms, next at 300ms.
+			{200 * time.Millisecond, 600 * time.Millisecond}, // Checked at 300ms, next at 900ms.
+			{600 * time.Millisecond, 0},                      // Checked at 900ms, 2.7s is past the max.
+		} {
+			rechecked, delay := advanceAndApply(step.advance)
+			Expect(rechecked).To(BeTrue())
+			Expect(delay).To(Equal(step.delay))
+		}
+		rechecked, _ := advanceAndApply(time.Hour)
+		Expect(rechecked).To(BeFalse())
+	})
+
+	It("should restart the schedule after the next write", func() {
+		newTable(func(options *TableOptions) {
+			options.PostWriteInterval = 100 * time.Millisecond
+			options.PostWriteBackoffFactor = 3
+			options.PostWriteMaxInterval = time.Second
+		})
+		table.Apply()
+		advanceAndApply(time.Hour)
+
+		table.UpdateChain(&Chain{Name: "cali-foo", Rules: []Rule{{Action: DropAction{}}}})
+		Expect(rescheduleAfterOf(table.Apply())).To(Equal(100 * time.Millisecond))
+	})
+
+	It("should default a backoff factor that is too small", func() {
+		newTable(func(options *TableOptions) {
+			options.PostWriteInterval = 100 * time.Millisecond
+			options.PostWriteBackoffFactor = 1
+		})
+		table.Apply()
+		_, delay := advanceAndApply(100 * time.Millisecond)
+		Expect(delay).To(Equal(100 * time.Millisecond))
+	})
+
+	It("should do no post-write checks if disabled", func() {
+		newTable(func(options *TableOptions) {
+			options.PostWriteInterval = 100 * time.Millisecond
+			options.DisablePostWriteChecks = true
+		})
+		Expect(rescheduleAfterOf(table.Apply())).To(BeZero())
+		rechecked, _ := advanceAndApply(time.Second)
+		Expect(rechecked).To(BeFalse())
+	})
+
+	It("should still do periodic refreshes if post-write checks are disabled", func() {
+		newTable(func(options *TableOptions) {
+			options.RefreshInterval = 10 * time.Second
+			options.DisablePostWriteChecks = true
+		})
+		Expect(rescheduleAfterOf(table.Apply())).To(Equal(10 * time.Second))
+		rechecked, _ := advanceAndApply(10*time.Second + time.Millisecond)
+		Expect(rechecked).To(BeTrue())
+	})
+})
@@ -0,0 +1,133 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// QuarantinedChain describes a chain that the Table has stopped programming because
+// iptables-restore repeatedly rejected it or, with ForeignRulesQuarantine, because it contains
+// rules that aren't ours.
+type QuarantinedChain struct {
+	Name string
+	// Failures is the number of restore failures that were traced to the chain.
+	Failures int
+	// FailedLine is the iptables-restore input line that was rejected, which shows the rule
+	// (including any comment identifying the policy that it came from).
+	FailedLine string
+	// ErrorOutput is iptables-restore's error output from the last failure.
+	ErrorOutput string
+	// ForeignRules is the number of rules without one of our hashes in the chain, if it was
+	// quarantined for those.  Such chains are released once the rules are removed.
+	ForeignRules int
+
+	// ruleHashes records the chain's rules at the time it was quarantined, so that we can
+	// release it if it changes.
+	ruleHashes []string
+}
+
+// QuarantinedChains returns the chains that are currently quarantined, sorted by name.  Like
+// the other Table methods, it must be called from the same goroutine as Apply() unless
+// TableOptions.ThreadSafe is set.
+func (t *Table) QuarantinedChains() []QuarantinedChain {
+	t.opLock.Lock()
+	defer t.opLock.Unlock()
+	chains := make([]QuarantinedChain, 0, len(t.quarantinedChains))
+	for _, qc := range t.quarantinedChains {
+		chains = append(chains, *qc)
+	}
+	sort.Slice(chains, func(i, j int) bool {
+		return chains[i].Name < chains[j].Name
+	})
+	return chains
+}
+
+func (t *Table) isQuarantined(chainName string) bool {
+	_, ok := t.quarantinedChains[chainName]
+	return ok
+}
+
+// recordRestoreFailure checks whether a restore failure was traced back to one of our chains
+// and, if that chain has now failed too many times, quarantines it.
+func (t *Table) recordRestoreFailure(restoreErr *RestoreError) {
+	chainName := restoreErr.Chain
+	if chainName == "" {
+		t.logCxt.WithField("errorOutput", restoreErr.Stderr).Debug(
+			"Couldn't identify the failing chain from iptables-restore's output")
+		return
+	}
+	chain := t.chainNameToChain[chainName]
+	if chain == nil {
+		// A failure in a kernel chain (i.e. one of our inserts) or a chain deletion, we
+		// can't safely skip those.
+		return
+	}
+	t.chainToRestoreFailures[chainName]++
+	failures := t.chainToRestoreFailures[chainName]
+	logCxt := t.logCxt.WithFields(log.Fields{
+		"chainName": chainName,
+		"ruleIndex": restoreErr.RuleIndex,
+		"failures":  failures,
+	})
+	if failures < t.quarantineThreshold {
+		logCxt.Warn("iptables-restore failure traced to chain")
+		return
+	}
+	t.quarantinedChains[chainName] = &QuarantinedChain{
+		Name:        chainName,
+		Failures:    failures,
+		FailedLine:  restoreErr.Fragment,
+		ErrorOutput: restoreErr.Stderr,
+		ruleHashes:  t.ruleHashes(chain, t.featureDetector.GetFeatures()),
+	}
+	t.metrics.Set(MetricQuarantinedChains, float64(len(t.quarantinedChains)))
+	logCxt.WithField("failedLine", restoreErr.Fragment).Error(
+		"Chain repeatedly rejected by iptables-restore, quarantining it until it is updated")
+}
+
+// maybeReleaseQuarantine releases the given chain from quarantine if its rules have changed
+// since it was quarantined.
+func (t *Table) maybeReleaseQuarantine(chain *Chain) {
+	qc := t.quarantinedChains[chain.Name]
+	if qc == nil {
+		return
+	}
+	if qc.ForeignRules > 0 {
+		// Updating the chain would remove the foreign rules, wait for them to be removed.
+		t.logCxt.WithField("chainName", chain.Name).Debug("Chain with foreign rules updated, leaving it quarantined")
+		return
+	}
+	if hashesEqual(qc.ruleHashes, t.ruleHashes(chain, t.featureDetector.GetFeatures())) {
+		t.logCxt.WithField("chainName", chain.Name).Debug("Quarantined chain updated but unchanged")
+		return
+	}
+	t.releaseQuarantine(chain.Name, "chain updated")
+}
+
+func (t *Table) releaseQuarantine(chainName string, reason string) {
+	delete(t.chainToRestoreFailures, chainName)
+	if _, ok := t.quarantinedChains[chainName]; !ok {
+		return
+	}
+	t.logCxt.WithFields(log.Fields{
+		"chainName": chainName,
+		"reason":    reason,
+	}).Info("Releasing chain from quarantine")
+	delete(t.quarantinedChains, chainName)
+	t.metrics.Set(MetricQuarantinedChains, float64(len(t.quarantinedChains)))
+}
@@ -0,0 +1,110 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables_test
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/projectcalico/felix/iptables"
+)
+
+var _ = Describe("Table chain quarantine", func() {
+	var dataplane *mockDataplane
+	var table *Table
+
+	badChain := &Chain{Name: "cali-bad", Rules: []Rule{{Action: DropAction{}, Comment: "bad-rule"}}}
+	goodChain := &Chain{Name: "cali-good", Rules: []Rule{{Action: AcceptAction{}}}}
+
+	newTable := func(threshold int) {
+		table = dataplane.newTable(func(options *TableOptions) {
+			options.ReturnErrorOnFailure = true
+			options.QuarantineThreshold = threshold
+		})
+		table.UpdateChains([]*Chain{badChain, goodChain})
+		table.SetRuleInsertions("FORWARD", []Rule{{Action: JumpAction{Target: "cali-bad"}}})
+	}
+
+	BeforeEach(func() {
+		dataplane = newMockDataplane("filter", map[string][]string{
+			"FORWARD": {},
+			"INPUT":   {},
+			"OUTPUT":  {},
+		})
+		dataplane.RejectLinesContaining = "bad-rule"
+	})
+
+	Describe("with quarantining enabled", func() {
+		BeforeEach(func() {
+			newTable(2)
+			_, err := table.ApplyContext(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("should quarantine the bad chain and program the rest", func() {
+			Expect(dataplane.Chains["cali-good"]).To(HaveLen(1))
+			Expect(dataplane.Chains["FORWARD"]).To(HaveLen(1))
+			Expect(dataplane.Chains).To(HaveKey("cali-bad"))
+			Expect(dataplane.Chains["cali-bad"]).To(BeEmpty())
+
+			quarantined := table.QuarantinedChains()
+			Expect(quarantined).To(HaveLen(1))
+			Expect(quarantined[0].Name).To(Equal("cali-bad"))
+			Expect(quarantined[0].Failures).To(Equal(2))
+			Expect(quarantined[0].FailedLine).To(ContainSubstring("bad-rule"))
+			Expect(quarantined[0].ErrorOutput).To(ContainSubstring("failed"))
+		})
+
+		It("should keep the chain quarantined if it is re-sent unchanged", func() {
+			table.UpdateChain(&Chain{Name: "cali-bad", Rules: []Rule{{Action: DropAction{}, Comment: "bad-rule"}}})
+			_, err := table.ApplyContext(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(table.QuarantinedChains()).To(HaveLen(1))
+			Expect(dataplane.Chains["cali-bad"]).To(BeEmpty())
+		})
+
+		It("should release and program the chain once it is fixed", func() {
+			table.UpdateChain(&Chain{Name: "cali-bad", Rules: []Rule{{Action: DropAction{}, Comment: "fixed-rule"}}})
+			Expect(table.QuarantinedChains()).To(BeEmpty())
+			_, err := table.ApplyContext(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(dataplane.Chains["cali-bad"]).To(HaveLen(1))
+		})
+
+		It("should release the chain when it is removed", func() {
+			table.SetRuleInsertions("FORWARD", nil)
+			table.RemoveChainByName("cali-bad")
+			Expect(table.QuarantinedChains()).To(BeEmpty())
+			_, err := table.ApplyContext(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(dataplane.Chains).NotTo(HaveKey("cali-bad"))
+		})
+	})
+
+	Describe("with quarantining disabled", func() {
+		BeforeEach(func() {
+			newTable(0)
+		})
+
+		It("should fail the whole update", func() {
+			_, err := table.ApplyContext(context.Background())
+			Expect(err).To(BeAssignableToTypeOf(&ApplyError{}))
+			Expect(table.QuarantinedChains()).To(BeEmpty())
+			Expect(dataplane.Chains).NotTo(HaveKey("cali-good"))
+		})
+	})
+})
@@ -0,0 +1,81 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// syntheticSaveOutput generates iptables-save output for a table with the given number of our
+// chains, each with the given number of rules, plus some rules from other processes.
+func syntheticSaveOutput(numChains, numRulesPerChain int) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("# Generated by iptables-save\n*filter\n")
+	buf.WriteString(":INPUT ACCEPT [0:0]\n:FORWARD DROP [0:0]\n:OUTPUT ACCEPT [0:0]\n")
+	for c := 0; c < numChains; c++ {
+		fmt.Fprintf(&buf, ":cali-bench-%d - [0:0]\n", c)
+	}
+	buf.WriteString("-A INPUT -j KUBE-FIREWALL\n")
+	buf.WriteString("-A FORWARD -m comment --comment \"cali:abcdefghij1234-_\" -j cali-bench-0\n")
+	for c := 0; c < numChains; c++ {
+		for r := 0; r < numRulesPerChain; r++ {
+			fmt.Fprintf(&buf, "-A cali-bench-%d -p tcp -s 10.%d.%d.0/24 "+
+				"-m set --match-set cali40s:set-%d dst -m multiport --dports 80,443 "+
+				"-m comment --comment \"cali:%016x\" -j cali-pi-policy-%d\n", c, r/256, r%256, r, c*1000+r, r)
+		}
+	}
+	buf.WriteString("COMMIT\n# Completed\n")
+	return buf.Bytes()
+}
+
+func BenchmarkReadHashesFrom(b *testing.B) {
+	// Keep the results readable; NewTable logs at info level.
+	level := log.GetLevel()
+	log.SetLevel(log.WarnLevel)
+	defer log.SetLevel(level)
+
+	table := NewTable(
+		"filter",
+		4,
+		"cali:",
+		&sync.Mutex{},
+		NewFeatureDetector(),
+		TableOptions{
+			HistoricChainPrefixes: []string{"cali-"},
+			LookPathOverride: func(file string) (string, error) {
+				return file, nil
+			},
+		},
+	)
+	input := syntheticSaveOutput(1000, 20)
+	b.SetBytes(int64(len(input)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		hashes, err := table.readHashesFrom(ioutil.NopCloser(bytes.NewReader(input)))
+		if err != nil {
+			b.Fatal(err)
+		}
+		if len(hashes["cali-bench-0"]) != 20 {
+			b.Fatalf("Unexpected hashes: %v", hashes["cali-bench-0"])
+		}
+	}
+}
@@ -0,0 +1,129 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// DanglingReference describes a rule that jumps (or goes) to one of our chains that won't
+// exist after the next Apply().
+type DanglingReference struct {
+	// Chain is the chain containing the rule.
+	Chain string
+	// RuleIndex is the index of the rule in the chain (or in the chain's inserted rules, if
+	// Inserted is true).
+	RuleIndex int
+	// Inserted is true if the rule is one of our rule insertions rather than part of one of
+	// our chains.
+	Inserted bool
+	// Target is the name of the missing chain.
+	Target string
+}
+
+func (r DanglingReference) String() string {
+	kind := "rule"
+	if r.Inserted {
+		kind = "inserted rule"
+	}
+	return fmt.Sprintf("%s %d in chain %s references missing chain %s", kind, r.RuleIndex, r.Chain, r.Target)
+}
+
+// DanglingReferencesError is returned by CheckReferences if any rules reference chains that
+// won't exist.  ApplyContext returns it, without writing anything, if the queued updates
+// reference such chains.
+type DanglingReferencesError struct {
+	Table      string
+	References []DanglingReference
+}
+
+func (e *DanglingReferencesError) Error() string {
+	parts := make([]string, len(e.References))
+	for i, r := range e.References {
+		parts[i] = r.String()
+	}
+	return fmt.Sprintf("table %s has %d dangling chain reference(s): %s",
+		e.Table, len(e.References), strings.Join(parts, "; "))
+}
+
+// CheckReferences walks the queued chains and rule insertions and checks that every jump or
+// goto to one of our chains targets a chain that will exist after Apply().  Jumps to chains
+// owned by other processes can't be checked and are ignored.  Returns a
+// *DanglingReferencesError listing the problems, if any.
+func (t *Table) CheckReferences() error {
+	t.opLock.Lock()
+	defer t.opLock.Unlock()
+	return t.checkReferences()
+}
+
+func (t *Table) checkReferences() error {
+	var dangling []DanglingReference
+	checkRules := func(chainName string, rules []Rule, inserted bool) {
+		for i, rule := range rules {
+			target := actionTarget(rule.Action)
+			if target == "" || !t.ourChainsRegexp.MatchString(target) {
+				continue
+			}
+			if _, ok := t.chainNameToChain[target]; ok {
+				continue
+			}
+			dangling = append(dangling, DanglingReference{
+				Chain:     chainName,
+				RuleIndex: i,
+				Inserted:  inserted,
+				Target:    target,
+			})
+		}
+	}
+	for chainName, chain := range t.chainNameToChain {
+		checkRules(chainName, chain.Rules, false)
+	}
+	for chainName, rules := range t.chainToInsertedRules {
+		checkRules(chainName, rules, true)
+	}
+	if len(dangling) == 0 {
+		return nil
+	}
+	return t.newDanglingReferencesError(dangling)
+}
+
+// newDanglingReferencesError returns a *DanglingReferencesError for the given references, sorted
+// by chain and then by rule.
+func (t *Table) newDanglingReferencesError(dangling []DanglingReference) *DanglingReferencesError {
+	sort.Slice(dangling, func(i, j int) bool {
+		if dangling[i].Chain != dangling[j].Chain {
+			return dangling[i].Chain < dangling[j].Chain
+		}
+		if dangling[i].Inserted != dangling[j].Inserted {
+			return dangling[i].Inserted
+		}
+		return dangling[i].RuleIndex < dangling[j].RuleIndex
+	})
+	return &DanglingReferencesError{Table: t.Name, References: dangling}
+}
+
+// actionTarget returns the chain that the given action jumps or goes to, or "" if the action
+// doesn't reference a chain.
+func actionTarget(action Action) string {
+	switch a := action.(type) {
+	case JumpAction:
+		return a.Target
+	case GotoAction:
+		return a.Target
+	}
+	return ""
+}
@@ -0,0 +1,92 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables_test
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/projectcalico/felix/iptables"
+)
+
+var _ = Describe("Table.CheckReferences", func() {
+	var dataplane *mockDataplane
+	var table *Table
+
+	BeforeEach(func() {
+		dataplane = newMockDataplane("filter", map[string][]string{
+			"FORWARD": {},
+			"INPUT":   {},
+			"OUTPUT":  {},
+		})
+		table = dataplane.newTable(func(options *TableOptions) {
+			options.ReturnErrorOnFailure = true
+		})
+		table.SetRuleInsertions("INPUT", []Rule{{Action: JumpAction{Target: "cali-INPUT"}}})
+		table.UpdateChain(&Chain{Name: "cali-INPUT", Rules: []Rule{
+			{Action: JumpAction{Target: "KUBE-SERVICES"}},
+			{Action: GotoAction{Target: "cali-from-wl"}},
+		}})
+	})
+
+	It("should pass when all our chains exist", func() {
+		table.UpdateChain(&Chain{Name: "cali-from-wl"})
+		Expect(table.CheckReferences()).To(Succeed())
+	})
+
+	It("should list dangling references", func() {
+		table.SetRuleInsertions("FORWARD", []Rule{{Action: JumpAction{Target: "cali-FORWARD"}}})
+		err := table.CheckReferences()
+		Expect(err).To(HaveOccurred())
+		Expect(err.(*DanglingReferencesError).References).To(Equal([]DanglingReference{
+			{Chain: "FORWARD", RuleIndex: 0, Inserted: true, Target: "cali-FORWARD"},
+			{Chain: "cali-INPUT", RuleIndex: 1, Target: "cali-from-wl"},
+		}))
+		Expect(err.Error()).To(ContainSubstring(
+			"inserted rule 0 in chain FORWARD references missing chain cali-FORWARD"))
+	})
+
+	It("should detect references to a chain that is about to be removed", func() {
+		table.UpdateChain(&Chain{Name: "cali-from-wl"})
+		table.RemoveChainByName("cali-INPUT")
+		err := table.CheckReferences()
+		Expect(err).To(HaveOccurred())
+		Expect(err.(*DanglingReferencesError).References).To(ConsistOf(
+			DanglingReference{Chain: "INPUT", RuleIndex: 0, Inserted: true, Target: "cali-INPUT"},
+		))
+	})
+
+	It("should fail ApplyContext without writing anything", func() {
+		_, err := table.ApplyContext(context.Background())
+		Expect(err).To(BeAssignableToTypeOf(&DanglingReferencesError{}))
+		Expect(err.(*DanglingReferencesError).References).To(Equal([]DanglingReference{
+			{Chain: "cali-INPUT", RuleIndex: 1, Target: "cali-from-wl"},
+		}))
+		Expect(dataplane.CmdNames).To(Equal([]string{"iptables-save"}))
+		Expect(dataplane.Chains).NotTo(HaveKey("cali-INPUT"))
+	})
+
+	It("should write the updates once the missing chain is supplied", func() {
+		_, err := table.ApplyContext(context.Background())
+		Expect(err).To(HaveOccurred())
+		table.UpdateChain(&Chain{Name: "cali-from-wl"})
+		_, err = table.ApplyContext(context.Background())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(dataplane.Chains).To(HaveKey("cali-INPUT"))
+		Expect(dataplane.Chains).To(HaveKey("cali-from-wl"))
+	})
+})
@@ -0,0 +1,107 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Renderer converts the Rule model into the syntax of a particular dataplane backend.  Rule,
+// MatchTerm and Action describe what a rule should do; the renderer decides how that is
+// expressed, which allows other backends (nftables, eBPF, HNS) to consume the same policy model
+// without string munging.  Table uses IptablesRenderer.
+type Renderer interface {
+	RenderAppend(rule Rule, chainName, prefixFragment string, features *Features) string
+	RenderInsert(rule Rule, chainName, prefixFragment string, features *Features) string
+	RenderInsertAt(rule Rule, chainName string, ruleNum int, prefixFragment string, features *Features) string
+	RenderReplace(rule Rule, chainName string, ruleNum int, prefixFragment string, features *Features) string
+	RenderMatch(match MatchCriteria, features *Features) string
+	RenderAction(action Action, features *Features) string
+}
+
+// IptablesRenderer is the Renderer for iptables-restore input.
+type IptablesRenderer struct{}
+
+func (r IptablesRenderer) RenderAppend(rule Rule, chainName, prefixFragment string, features *Features) string {
+	fragments := make([]string, 0, 6)
+	fragments = append(fragments, "-A", chainName)
+	return r.renderInner(rule, fragments, prefixFragment, features)
+}
+
+func (r IptablesRenderer) RenderInsert(rule Rule, chainName, prefixFragment string, features *Features) string {
+	fragments := make([]string, 0, 6)
+	fragments = append(fragments, "-I", chainName)
+	return r.renderInner(rule, fragments, prefixFragment, features)
+}
+
+func (r IptablesRenderer) RenderInsertAt(rule Rule, chainName string, ruleNum int, prefixFragment string, features *Features) string {
+	fragments := make([]string, 0, 7)
+	fragments = append(fragments, "-I", chainName, fmt.Sprintf("%d", ruleNum))
+	return r.renderInner(rule, fragments, prefixFragment, features)
+}
+
+func (r IptablesRenderer) RenderReplace(rule Rule, chainName string, ruleNum int, prefixFragment string, features *Features) string {
+	fragments := make([]string, 0, 7)
+	fragments = append(fragments, "-R", chainName, fmt.Sprintf("%d", ruleNum))
+	return r.renderInner(rule, fragments, prefixFragment, features)
+}
+
+// RenderMatch returns the iptables fragment for the given match criteria, for example
+// "-p tcp -m multiport --destination-ports 80".  Panics if a term has no iptables equivalent
+// since that indicates a bug in the caller.
+func (r IptablesRenderer) RenderMatch(match MatchCriteria, features *Features) string {
+	fragments := make([]string, 0, len(match))
+	for _, term := range match {
+		fragments = append(fragments, r.renderTerm(term))
+	}
+	return strings.Join(fragments, " ")
+}
+
+// RenderAction returns the iptables fragment for the given action, for example
+// "--jump ACCEPT".  Panics if the action has no iptables equivalent since that indicates a
+// bug in the caller.
+func (r IptablesRenderer) RenderAction(action Action, features *Features) string {
+	if action == nil {
+		return ""
+	}
+	return r.renderAction(action, 0, features)
+}
+
+func (r IptablesRenderer) renderInner(rule Rule, fragments []string, prefixFragment string, features *Features) string {
+	if prefixFragment != "" {
+		fragments = append(fragments, prefixFragment)
+	}
+	if rule.Comment != "" {
+		commentFragment := fmt.Sprintf("-m comment --comment \"%s\"", escapeQuoted(rule.Comment))
+		fragments = append(fragments, commentFragment)
+	}
+	for _, comment := range rule.ExtraComments {
+		commentFragment := fmt.Sprintf("-m comment --comment \"%s\"", escapeQuoted(comment))
+		fragments = append(fragments, commentFragment)
+	}
+	matchFragment := r.RenderMatch(rule.Match, features)
+	if matchFragment != "" {
+		fragments = append(fragments, matchFragment)
+	}
+	var actionFragment string
+	if rule.Action != nil {
+		actionFragment = r.renderAction(rule.Action, rule.IPVersion, features)
+	}
+	if actionFragment != "" {
+		fragments = append(fragments, actionFragment)
+	}
+	return strings.Join(fragments, " ")
+}
@@ -0,0 +1,165 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"fmt"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// renderAction returns the iptables fragment for the action.  Some targets differ between the IP
+// versions; for those, ipVersion selects the target, with 0 meaning IPv4.
+func (r IptablesRenderer) renderAction(action Action, ipVersion uint8, features *Features) string {
+	switch g := action.(type) {
+	case GotoAction:
+		return "--goto " + g.Target
+	case JumpAction:
+		return "--jump " + g.Target
+	case ReturnAction:
+		return "--jump RETURN"
+	case DropAction:
+		return "--jump DROP"
+	case RejectAction:
+		if g.With == "" {
+			return "--jump REJECT"
+		}
+		return "--jump REJECT --reject-with " + g.With
+	case LogAction:
+		return r.renderLogAction(g)
+	case NflogAction:
+		return r.renderNflogAction(g)
+	case SetMemberAction:
+		return fmt.Sprintf("--jump SET --%s-set %s %s", g.Op, g.Set, g.Flags)
+	case TTLAction:
+		if ipVersion == 6 {
+			return fmt.Sprintf("--jump HL --hl-%s %d", g.Op, g.Value)
+		}
+		return fmt.Sprintf("--jump TTL --ttl-%s %d", g.Op, g.Value)
+	case TraceAction:
+		return "--jump TRACE"
+	case TproxyAction:
+		return fmt.Sprintf("--jump TPROXY --on-port %d --tproxy-mark %#x/%#x", g.Port, g.Mark, g.Mark)
+	case AcceptAction:
+		return "--jump ACCEPT"
+	case DNATAction:
+		if g.DestPort == 0 {
+			return fmt.Sprintf("--jump DNAT --to-destination %s", g.DestAddr)
+		} else if strings.Contains(g.DestAddr, ":") {
+			// IPv6 addresses need brackets to separate them from the port.
+			return fmt.Sprintf("--jump DNAT --to-destination [%s]:%d", g.DestAddr, g.DestPort)
+		} else {
+			return fmt.Sprintf("--jump DNAT --to-destination %s:%d", g.DestAddr, g.DestPort)
+		}
+	case RedirectAction:
+		if g.ToPorts == "" {
+			return "--jump REDIRECT"
+		}
+		return "--jump REDIRECT --to-ports " + g.ToPorts
+	case SNATAction:
+		fullyRand := ""
+		if features.SNATFullyRandom {
+			fullyRand = " --random-fully"
+		}
+		return fmt.Sprintf("--jump SNAT --to-source %s%s", g.ToAddr, fullyRand)
+	case MasqAction:
+		fullyRand := ""
+		if features.MASQFullyRandom {
+			fullyRand = " --random-fully"
+		}
+		if g.ToPorts != "" {
+			return fmt.Sprintf("--jump MASQUERADE --to-ports %s"+fullyRand, g.ToPorts)
+		}
+		return "--jump MASQUERADE" + fullyRand
+	case ClearMarkAction:
+		return fmt.Sprintf("--jump MARK --set-mark 0/%#x", g.Mark)
+	case SetMarkAction:
+		return fmt.Sprintf("--jump MARK --set-mark %#x/%#x", g.Mark, g.Mark)
+	case SetMaskedMarkAction:
+		return fmt.Sprintf("--jump MARK --set-mark %#x/%#x", g.Mark, g.Mask)
+	case NoTrackAction:
+		return "--jump NOTRACK"
+	case CTAction:
+		return r.renderCTAction(g)
+	case ChecksumAction:
+		return "--jump CHECKSUM --checksum-fill"
+	case ClampMSSAction:
+		if g.ToPMTU {
+			return "--jump TCPMSS --clamp-mss-to-pmtu"
+		}
+		return fmt.Sprintf("--jump TCPMSS --set-mss %d", g.MSS)
+	case DSCPAction:
+		return fmt.Sprintf("--jump DSCP --set-dscp 0x%02x", g.Value)
+	case TOSAction:
+		mask := g.Mask
+		if mask == 0 {
+			mask = 0xff
+		}
+		return fmt.Sprintf("--jump TOS --set-tos 0x%02x/0x%02x", g.Value, mask)
+	}
+	log.WithField("action", action).Panic("Action not supported by iptables backend")
+	return ""
+}
+
+func (r IptablesRenderer) renderLogAction(g LogAction) string {
+	var fragment string
+	if g.Limit != nil {
+		fragment = fmt.Sprintf("-m limit --limit %d/%s ", g.Limit.Rate, g.Limit.Unit)
+		if g.Limit.Burst != 0 {
+			fragment += fmt.Sprintf("--limit-burst %d ", g.Limit.Burst)
+		}
+	}
+	fragment += fmt.Sprintf(`--jump LOG --log-prefix "%s: " --log-level %d`,
+		escapeQuoted(g.Prefix), g.Level.syslogLevel())
+	if g.TCPOptions {
+		fragment += " --log-tcp-options"
+	}
+	if g.IPOptions {
+		fragment += " --log-ip-options"
+	}
+	if g.UID {
+		fragment += " --log-uid"
+	}
+	return fragment
+}
+
+func (r IptablesRenderer) renderNflogAction(g NflogAction) string {
+	fragment := fmt.Sprintf("--jump NFLOG --nflog-group %d", g.Group)
+	if g.Prefix != "" {
+		fragment += fmt.Sprintf(` --nflog-prefix "%s"`, escapeQuoted(g.Prefix))
+	}
+	if g.Size != 0 {
+		fragment += fmt.Sprintf(" --nflog-size %d", g.Size)
+	}
+	if g.Threshold != 0 {
+		fragment += fmt.Sprintf(" --nflog-threshold %d", g.Threshold)
+	}
+	return fragment
+}
+
+func (r IptablesRenderer) renderCTAction(g CTAction) string {
+	if g.NoTrack {
+		return "--jump CT --notrack"
+	}
+	fragment := "--jump CT"
+	if g.Helper != "" {
+		fragment += " --helper " + g.Helper
+	}
+	if g.Zone != 0 {
+		fragment += fmt.Sprintf(" --zone %d", g.Zone)
+	}
+	return fragment
+}
@@ -0,0 +1,222 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// renderTerm returns the iptables fragment for one term of a MatchCriteria.  Terms with
+// constrained fields are validated first; an invalid term is a bug so that panics.
+func (r IptablesRenderer) renderTerm(term MatchTerm) string {
+	if v, ok := term.(matchTermValidator); ok {
+		v.validate()
+	}
+	switch t := term.(type) {
+	case MarkBitsTerm:
+		if t.Set {
+			return fmt.Sprintf("-m mark --mark %#x/%#x", t.Bits, t.Bits)
+		}
+		return fmt.Sprintf("-m mark --mark 0/%#x", t.Bits)
+	case MarkTerm:
+		return r.renderMarkMatch("mark", t.Negate, t.Value, t.Mask)
+	case ConnMarkTerm:
+		return r.renderMarkMatch("connmark", t.Negate, t.Value, t.Mask)
+	case InterfaceTerm:
+		if t.Out {
+			return "--out-interface " + t.Name
+		}
+		return "--in-interface " + t.Name
+	case RPFilterTerm:
+		if t.Failed {
+			return "-m rpfilter --invert"
+		}
+		return "-m rpfilter"
+	case AddrTypeTerm:
+		return r.renderAddrTypeTerm(t)
+	case ConntrackStateTerm:
+		return "-m conntrack --ctstate " + t.States
+	case ProtocolTerm:
+		return notFragment(t.Negate) + "-p " + t.Protocol
+	case TCPSynTerm:
+		return "-p tcp --tcp-flags SYN,RST SYN"
+	case StatisticRandomTerm:
+		return fmt.Sprintf("-m statistic --mode random --probability %0.10f", t.Probability)
+	case StatisticNthTerm:
+		return fmt.Sprintf("-m statistic --mode nth --every %d --packet %d", t.Every, t.Packet)
+	case NetTerm:
+		if t.Dest {
+			return notFragment(t.Negate) + "--destination " + t.Net
+		}
+		return notFragment(t.Negate) + "--source " + t.Net
+	case IPSetTerm:
+		dir := "src"
+		if t.Dest {
+			dir = "dst"
+		}
+		return fmt.Sprintf("-m set %s--match-set %s %s", notFragment(t.Negate), t.Name, dir)
+	case PortsTerm:
+		option := "--source-ports"
+		if t.Dest {
+			option = "--destination-ports"
+		}
+		return fmt.Sprintf("-m multiport %s%s %s", notFragment(t.Negate), option, PortRangessToMultiport(t.Ports))
+	case ICMPTypeTerm:
+		typeAndCode := fmt.Sprintf("%d", t.Type)
+		if t.HasCode {
+			typeAndCode += fmt.Sprintf("/%d", t.Code)
+		}
+		if t.IPv6 {
+			return fmt.Sprintf("-m icmp6 %s--icmpv6-type %s", notFragment(t.Negate), typeAndCode)
+		}
+		return fmt.Sprintf("-m icmp %s--icmp-type %s", notFragment(t.Negate), typeAndCode)
+	case DSCPTerm:
+		return fmt.Sprintf("-m dscp %s--dscp 0x%02x", notFragment(t.Negate), t.Value)
+	case TOSTerm:
+		return fmt.Sprintf("-m tos %s--tos 0x%02x/0x%02x", notFragment(t.Negate), t.Value, t.Mask)
+	case HashLimitTerm:
+		return r.renderHashLimitTerm(t)
+	case RecentUpdateTerm:
+		if t.Remove {
+			return r.renderRecentList(t.List, "", "--remove")
+		}
+		return r.renderRecentList(t.List, "", "--set")
+	case RecentCheckTerm:
+		return r.renderRecentCheckTerm(t)
+	case TimeTerm:
+		return r.renderTimeTerm(t)
+	case BPFTerm:
+		if t.PinnedPath != "" {
+			return "-m bpf " + notFragment(t.Negate) + "--object-pinned " + t.PinnedPath
+		}
+		return fmt.Sprintf(`-m bpf %s--bytecode "%s"`, notFragment(t.Negate), FormatBPFBytecode(t.Program))
+	}
+	log.WithField("term", term).Panic("Match not supported by iptables backend")
+	return ""
+}
+
+func (r IptablesRenderer) renderMarkMatch(module string, negate bool, value, mask uint32) string {
+	if mask == 0 {
+		return fmt.Sprintf("-m %s %s--mark %#x", module, notFragment(negate), value)
+	}
+	return fmt.Sprintf("-m %s %s--mark %#x/%#x", module, notFragment(negate), value, mask)
+}
+
+func (r IptablesRenderer) renderAddrTypeTerm(t AddrTypeTerm) string {
+	not := notFragment(t.Negate)
+	fragment := "-m addrtype"
+	if t.SrcType != "" {
+		fragment += fmt.Sprintf(" %s--src-type %s", not, t.SrcType)
+	}
+	if t.DstType != "" {
+		fragment += fmt.Sprintf(" %s--dst-type %s", not, t.DstType)
+	}
+	if t.LimitIfaceIn {
+		fragment += " --limit-iface-in"
+	}
+	if t.LimitIfaceOut {
+		fragment += " --limit-iface-out"
+	}
+	return fragment
+}
+
+func (r IptablesRenderer) renderHashLimitTerm(t HashLimitTerm) string {
+	l := t.Limit
+	limitOption := "hashlimit-upto"
+	if t.Above {
+		limitOption = "hashlimit-above"
+	}
+	fragment := fmt.Sprintf("-m hashlimit --%s %d/%s", limitOption, l.Rate, l.Unit)
+	if l.Burst != 0 {
+		fragment += fmt.Sprintf(" --hashlimit-burst %d", l.Burst)
+	}
+	if l.Mode != "" {
+		fragment += " --hashlimit-mode " + l.Mode
+	}
+	if l.SrcMask != 0 {
+		fragment += fmt.Sprintf(" --hashlimit-srcmask %d", l.SrcMask)
+	}
+	if l.DstMask != 0 {
+		fragment += fmt.Sprintf(" --hashlimit-dstmask %d", l.DstMask)
+	}
+	if l.Expire != 0 {
+		fragment += fmt.Sprintf(" --hashlimit-htable-expire %d", l.Expire/time.Millisecond)
+	}
+	return fragment + " --hashlimit-name " + l.Name
+}
+
+func (r IptablesRenderer) renderRecentCheckTerm(t RecentCheckTerm) string {
+	c := t.Check
+	command := "--rcheck"
+	if c.Update {
+		command = "--update"
+	}
+	if c.Seconds != 0 {
+		command += fmt.Sprintf(" --seconds %d", c.Seconds)
+	}
+	if c.Reap {
+		command += " --reap"
+	}
+	if c.HitCount != 0 {
+		command += fmt.Sprintf(" --hitcount %d", c.HitCount)
+	}
+	return r.renderRecentList(c.List, notFragment(t.Negate), command)
+}
+
+func (r IptablesRenderer) renderRecentList(l RecentList, not, command string) string {
+	side := "--rsource"
+	if l.Dest {
+		side = "--rdest"
+	}
+	return fmt.Sprintf("-m recent %s%s --name %s %s", not, command, l.Name, side)
+}
+
+func (r IptablesRenderer) renderTimeTerm(t TimeTerm) string {
+	fragment := "-m time"
+	if t.StartTime != 0 {
+		fragment += " --timestart " + formatTimeOfDay(t.StartTime)
+	}
+	if t.StopTime != 0 {
+		fragment += " --timestop " + formatTimeOfDay(t.StopTime)
+	}
+	if len(t.DaysOfWeek) > 0 {
+		// Sort the days into the order that iptables-save uses, Monday first, so that the
+		// rule (and its hash) doesn't depend on the order of DaysOfWeek.
+		days := make([]time.Weekday, len(t.DaysOfWeek))
+		copy(days, t.DaysOfWeek)
+		sort.Slice(days, func(i, j int) bool {
+			return (days[i]+6)%7 < (days[j]+6)%7
+		})
+		names := make([]string, len(days))
+		for i, day := range days {
+			names[i] = day.String()[:3]
+		}
+		fragment += " --weekdays " + strings.Join(names, ",")
+	}
+	if !t.UTC {
+		fragment += " --kerneltz"
+	}
+	return fragment
+}
+
+func formatTimeOfDay(d time.Duration) string {
+	d = d.Truncate(time.Second)
+	return fmt.Sprintf("%02d:%02d:%02d", d/time.Hour, d%time.Hour/time.Minute, d%time.Minute/time.Second)
+}
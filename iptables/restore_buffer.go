@@ -17,6 +17,7 @@ package iptables
 import (
 	"bytes"
 	"fmt"
+	"io"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -37,23 +38,72 @@ import (
 //
 // Transactions are ignored completely if there are no writes between the StartTransaction()
 // and EndTransaction() calls.
+//
+// Alternatively, StreamTo() makes the builder write each line straight to an io.Writer, such
+// as a pipe to iptables-restore, instead of buffering it.
+//
+// To bound the size of each iptables-restore invocation, the input can be split into chunks
+// with MaybeStartNewChunk() and retrieved with GetChunksAndReset().
 type RestoreInputBuilder struct {
 	buf              bytes.Buffer
+	stream           io.Writer
 	currentTableName string
 	txnOpenerWritten bool
 	NumLinesWritten  counter
+	// lineOrigins records, for each line in the buffer, the chain (and rule) that the line
+	// came from.
+	lineOrigins []RestoreLineOrigin
+
+	// chunkStarts records the position of the start of each chunk after the first.
+	chunkStarts []chunkStart
+	// chunkSplitPending is set by MaybeStartNewChunk; the next write starts a new chunk.
+	chunkSplitPending bool
+}
+
+type chunkStart struct {
+	offset int
+	line   int
+}
+
+// RestoreChunk is a part of the input that should be passed to its own invocation of
+// iptables-restore.
+type RestoreChunk struct {
+	Input []byte
+	// LineOrigins holds the origin of each line of Input; see LineOrigins().
+	LineOrigins []RestoreLineOrigin
+}
+
+// RestoreLineOrigin records where a line of iptables-restore input came from.
+type RestoreLineOrigin struct {
+	// Chain is the chain that the line modifies, or "" for lines such as "*filter" and "COMMIT".
+	Chain string
+	// RuleIndex is the index of the Rule that the line was rendered from, or -1 if the line
+	// wasn't rendered from a Rule.
+	RuleIndex int
 }
 
 // Empty returns true if there is nothing in the buffer (i.e. all the transactions stored in the buffer were no-ops).
+// If the builder is streaming, returns true if nothing has been written to the stream.
 func (b *RestoreInputBuilder) Empty() bool {
-	return b.buf.Len() == 0
+	return len(b.lineOrigins) == 0
+}
+
+// StreamTo makes the builder write each line to w as it is generated rather than buffering it.  Should be
+// called before the first transaction; the stream is cleared by Reset.  Errors from w are ignored; the owner
+// of w is expected to report them (for example, when it closes the stream).
+func (b *RestoreInputBuilder) StreamTo(w io.Writer) {
+	b.stream = w
 }
 
 // Reset the builder completely, any pending transaction is discarded.
 func (b *RestoreInputBuilder) Reset() {
 	b.buf.Reset()
+	b.stream = nil
 	b.currentTableName = ""
 	b.txnOpenerWritten = false
+	b.lineOrigins = nil
+	b.chunkStarts = nil
+	b.chunkSplitPending = false
 }
 
 // StartTransaction opens a new transaction context for the named table.
@@ -73,18 +123,24 @@ func (b *RestoreInputBuilder) EndTransaction() {
 		log.Panic("EndTransaction() called without active transaction.")
 	}
 	if b.txnOpenerWritten {
-		b.writeFormattedLine("COMMIT")
+		b.writeFormattedLine(RestoreLineOrigin{RuleIndex: -1}, "COMMIT")
 	}
 	b.currentTableName = ""
 }
 
-// writeFormattedLine writes a line to the internal buffer, appending a new line.
-func (b *RestoreInputBuilder) writeFormattedLine(format string, args ...interface{}) {
-	_, err := fmt.Fprintf(&b.buf, format, args...)
-	if err != nil {
-		log.WithError(err).Panic("Failed to write to in-memory buffer")
+// writeFormattedLine writes a line to the internal buffer, appending a new line.  origin records
+// where the line came from.
+func (b *RestoreInputBuilder) writeFormattedLine(origin RestoreLineOrigin, format string, args ...interface{}) {
+	if b.stream != nil {
+		_, _ = fmt.Fprintf(b.stream, format+"\n", args...)
+	} else {
+		_, err := fmt.Fprintf(&b.buf, format, args...)
+		if err != nil {
+			log.WithError(err).Panic("Failed to write to in-memory buffer")
+		}
+		b.buf.WriteString("\n")
 	}
-	b.buf.WriteString("\n")
+	b.lineOrigins = append(b.lineOrigins, origin)
 	if b.NumLinesWritten != nil {
 		b.NumLinesWritten.Inc()
 	}
@@ -96,8 +152,18 @@ func (b *RestoreInputBuilder) maybeWriteTransactionOpener() {
 	if b.currentTableName == "" {
 		log.Panic("maybeWriteTransactionOpener() called without active transaction.")
 	}
+	if b.chunkSplitPending {
+		// Close the current chunk's transaction (if it has one open); the new chunk will
+		// re-open it.
+		b.chunkSplitPending = false
+		if b.txnOpenerWritten {
+			b.writeFormattedLine(RestoreLineOrigin{RuleIndex: -1}, "COMMIT")
+			b.txnOpenerWritten = false
+		}
+		b.chunkStarts = append(b.chunkStarts, chunkStart{offset: b.buf.Len(), line: len(b.lineOrigins)})
+	}
 	if !b.txnOpenerWritten {
-		b.writeFormattedLine("*%s", b.currentTableName)
+		b.writeFormattedLine(RestoreLineOrigin{RuleIndex: -1}, "*%s", b.currentTableName)
 		b.txnOpenerWritten = true
 	}
 }
@@ -107,14 +173,51 @@ func (b *RestoreInputBuilder) maybeWriteTransactionOpener() {
 // transaction.
 func (b *RestoreInputBuilder) WriteForwardReference(chainName string) {
 	b.maybeWriteTransactionOpener()
-	b.writeFormattedLine(":%s - -", chainName)
+	b.writeFormattedLine(RestoreLineOrigin{Chain: chainName, RuleIndex: -1}, ":%s - -", chainName)
 }
 
 // WriteLine writes a line of iptables instructions to the buffer.  Intended for writing the actual rules.
 // Panics if there is no open transaction.
 func (b *RestoreInputBuilder) WriteLine(line string) {
+	b.WriteLineForChain("", line)
+}
+
+// WriteLineForChain is like WriteLine but it records that the line modifies the given chain, so
+// that a failure reported against the line can be traced back to the chain.
+func (b *RestoreInputBuilder) WriteLineForChain(chainName string, line string) {
+	b.WriteRuleLine(chainName, -1, line)
+}
+
+// WriteRuleLine is like WriteLineForChain but it also records the index of the Rule that the
+// line was rendered from.
+func (b *RestoreInputBuilder) WriteRuleLine(chainName string, ruleIndex int, line string) {
 	b.maybeWriteTransactionOpener()
-	b.writeFormattedLine(line)
+	b.writeFormattedLine(RestoreLineOrigin{Chain: chainName, RuleIndex: ruleIndex}, "%s", line)
+}
+
+// MaybeStartNewChunk starts a new chunk, at the next write, if the current chunk already has
+// at least maxLines lines.  Callers should call it between groups of lines that need to be
+// applied together, so chunks may exceed maxLines by up to one group.  Each chunk is a
+// complete set of transactions, which is committed independently of the other chunks.  Does
+// nothing if maxLines is 0 or if the builder is streaming.
+func (b *RestoreInputBuilder) MaybeStartNewChunk(maxLines int) {
+	if maxLines <= 0 || b.stream != nil {
+		return
+	}
+	chunkStartLine := 0
+	if len(b.chunkStarts) > 0 {
+		chunkStartLine = b.chunkStarts[len(b.chunkStarts)-1].line
+	}
+	if len(b.lineOrigins)-chunkStartLine >= maxLines {
+		b.chunkSplitPending = true
+	}
+}
+
+// LineOrigins returns the origin of each line in the buffer, as recorded by
+// WriteForwardReference, WriteLineForChain and WriteRuleLine; index 0 corresponds to line 1.
+// Should be called before GetBytesAndReset; the returned slice is not modified by later writes.
+func (b *RestoreInputBuilder) LineOrigins() []RestoreLineOrigin {
+	return b.lineOrigins
 }
 
 // GetBytesAndReset returns the contents of the buffer and, as a side effect, resets the buffer.  For performance,
@@ -131,4 +234,28 @@ func (b *RestoreInputBuilder) GetBytesAndReset() []byte {
 
 type counter interface {
 	Inc()
+}
+
+// GetChunksAndReset is like GetBytesAndReset but it returns the input split into the chunks
+// started by MaybeStartNewChunk.  As for GetBytesAndReset, the returned slices are only
+// valid until the next write operation on the builder.
+func (b *RestoreInputBuilder) GetChunksAndReset() []RestoreChunk {
+	if b.currentTableName != "" {
+		log.Panic("GetChunksAndReset() called inside transaction.")
+	}
+	data := b.buf.Bytes()
+	ends := append(b.chunkStarts, chunkStart{offset: len(data), line: len(b.lineOrigins)})
+	chunks := make([]RestoreChunk, 0, len(ends))
+	prev := chunkStart{}
+	for _, end := range ends {
+		if end.line > prev.line {
+			chunks = append(chunks, RestoreChunk{
+				Input:       data[prev.offset:end.offset],
+				LineOrigins: b.lineOrigins[prev.line:end.line],
+			})
+		}
+		prev = end
+	}
+	b.Reset()
+	return chunks
 }
\ No newline at end of file
@@ -0,0 +1,218 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables_test
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/projectcalico/felix/iptables"
+)
+
+var _ = Describe("RestoreInputBuilder chunking", func() {
+	var buf RestoreInputBuilder
+
+	BeforeEach(func() {
+		buf.Reset()
+	})
+
+	It("should return a single chunk if it is never split", func() {
+		buf.StartTransaction("filter")
+		buf.WriteForwardReference("cali-foo")
+		buf.WriteLine("-A cali-foo --jump ACCEPT")
+		buf.EndTransaction()
+		chunks := buf.GetChunksAndReset()
+		Expect(chunks).To(HaveLen(1))
+		Expect(string(chunks[0].Input)).To(Equal("*filter\n:cali-foo - -\n-A cali-foo --jump ACCEPT\nCOMMIT\n"))
+		Expect(chunks[0].LineOrigins).To(HaveLen(4))
+	})
+
+	It("should split at the next write once the limit is reached", func() {
+		buf.StartTransaction("filter")
+		buf.MaybeStartNewChunk(3)
+		buf.WriteForwardReference("cali-foo")
+		buf.MaybeStartNewChunk(3)
+		buf.WriteForwardReference("cali-bar")
+		buf.MaybeStartNewChunk(3)
+		buf.WriteLineForChain("cali-foo", "-A cali-foo --jump ACCEPT")
+		buf.EndTransaction()
+		chunks := buf.GetChunksAndReset()
+		Expect(chunks).To(HaveLen(2))
+		Expect(string(chunks[0].Input)).To(Equal("*filter\n:cali-foo - -\n:cali-bar - -\nCOMMIT\n"))
+		Expect(string(chunks[1].Input)).To(Equal("*filter\n-A cali-foo --jump ACCEPT\nCOMMIT\n"))
+		Expect(chunks[1].LineOrigins).To(Equal([]RestoreLineOrigin{
+			{RuleIndex: -1},
+			{Chain: "cali-foo", RuleIndex: -1},
+			{RuleIndex: -1},
+		}))
+	})
+
+	It("should not produce an empty chunk if nothing follows the split", func() {
+		buf.StartTransaction("filter")
+		buf.WriteForwardReference("cali-foo")
+		buf.WriteForwardReference("cali-bar")
+		buf.MaybeStartNewChunk(2)
+		buf.EndTransaction()
+		Expect(buf.GetChunksAndReset()).To(HaveLen(1))
+	})
+})
+
+var _ = Describe("Table with a limit on lines per restore", func() {
+	var dataplane *mockDataplane
+	var table *Table
+
+	restoreInputs := func() (inputs []string) {
+		for _, cmd := range dataplane.Cmds {
+			if s := cmd.String(); strings.HasPrefix(s, "restoreCmd ") {
+				var input string
+				_, err := fmt.Sscanf(s, "restoreCmd %q", &input)
+				Expect(err).NotTo(HaveOccurred())
+				inputs = append(inputs, input)
+			}
+		}
+		return
+	}
+
+	BeforeEach(func() {
+		dataplane = newMockDataplane("filter", map[string][]string{
+			"FORWARD": {},
+			"INPUT":   {},
+			"OUTPUT":  {},
+		})
+		table = dataplane.newTable(func(options *TableOptions) {
+			options.ReturnErrorOnFailure = true
+			options.MaxLinesPerRestore = 4
+			options.ApplyRetries = 1
+		})
+		var jumps []Rule
+		for i := 0; i < 5; i++ {
+			chainName := fmt.Sprintf("cali-chain-%d", i)
+			table.UpdateChain(&Chain{Name: chainName, Rules: []Rule{
+				{Action: DropAction{}, Comment: fmt.Sprintf("rule-%d-0", i)},
+				{Action: AcceptAction{}, Comment: fmt.Sprintf("rule-%d-1", i)},
+			}})
+			jumps = append(jumps, Rule{Action: JumpAction{Target: chainName}})
+		}
+		table.SetRuleInsertions("FORWARD", jumps)
+	})
+
+	It("should split the update into several restores", func() {
+		_, err := table.ApplyContext(context.Background())
+		Expect(err).NotTo(HaveOccurred())
+		inputs := restoreInputs()
+		Expect(len(inputs)).To(BeNumerically(">", 1))
+		for _, input := range inputs {
+			Expect(input).To(HavePrefix("*filter\n"))
+			Expect(input).To(HaveSuffix("COMMIT\n"))
+		}
+		for i := 0; i < 5; i++ {
+			Expect(dataplane.Chains[fmt.Sprintf("cali-chain-%d", i)]).To(HaveLen(2))
+		}
+		Expect(dataplane.Chains["FORWARD"]).To(HaveLen(5))
+	})
+
+	It("should create each chain before it is referenced", func() {
+		_, err := table.ApplyContext(context.Background())
+		Expect(err).NotTo(HaveOccurred())
+		created := map[string]bool{}
+		for _, input := range restoreInputs() {
+			for _, line := range strings.Split(input, "\n") {
+				if strings.HasPrefix(line, ":") {
+					created[strings.Fields(line[1:])[0]] = true
+				} else if strings.HasPrefix(line, "-A cali-") || strings.Contains(line, "--jump cali-") {
+					for _, field := range strings.Fields(line) {
+						if strings.HasPrefix(field, "cali-chain-") {
+							Expect(created).To(HaveKey(field), line)
+						}
+					}
+				}
+			}
+		}
+	})
+
+	It("should recover if a later chunk fails", func() {
+		dataplane.RejectLinesContaining = "rule-4-1"
+		_, err := table.ApplyContext(context.Background())
+		Expect(err).To(BeAssignableToTypeOf(&ApplyError{}))
+		Expect(err.(*ApplyError).Err.(*RestoreError).Chain).To(Equal("cali-chain-4"))
+
+		dataplane.RejectLinesContaining = ""
+		_, err = table.ApplyContext(context.Background())
+		Expect(err).NotTo(HaveOccurred())
+		for i := 0; i < 5; i++ {
+			Expect(dataplane.Chains[fmt.Sprintf("cali-chain-%d", i)]).To(HaveLen(2))
+		}
+		Expect(dataplane.Chains["FORWARD"]).To(HaveLen(5))
+	})
+})
+
+var _ = Describe("Table in nftables mode with a limit on lines per restore", func() {
+	var dataplane *mockDataplane
+	var table *Table
+
+	BeforeEach(func() {
+		initialChains := map[string][]string{
+			"FORWARD": {},
+			"INPUT":   {},
+			"OUTPUT":  {},
+		}
+		for i := 0; i < 5; i++ {
+			initialChains[fmt.Sprintf("cali-chain-%d", i)] = []string{"-j DROP", "-j ACCEPT"}
+		}
+		dataplane = newMockDataplane("filter", initialChains)
+		table = dataplane.newTable(func(options *TableOptions) {
+			options.ReturnErrorOnFailure = true
+			options.BackendMode = "nft"
+			options.MaxLinesPerRestore = 4
+			options.ApplyRetries = 1
+		})
+		for i := 0; i < 5; i++ {
+			table.UpdateChain(&Chain{Name: fmt.Sprintf("cali-chain-%d", i), Rules: []Rule{
+				{Action: DropAction{}, Comment: fmt.Sprintf("rule-%d-0", i)},
+				{Action: AcceptAction{}, Comment: fmt.Sprintf("rule-%d-1", i)},
+			}})
+		}
+	})
+
+	It("should flush each chain in the same restore as its new rules", func() {
+		_, err := table.ApplyContext(context.Background())
+		Expect(err).NotTo(HaveOccurred())
+		for _, cmd := range dataplane.Cmds {
+			s := cmd.String()
+			if !strings.HasPrefix(s, "restoreCmd ") {
+				continue
+			}
+			var input string
+			_, err := fmt.Sscanf(s, "restoreCmd %q", &input)
+			Expect(err).NotTo(HaveOccurred())
+			for i := 0; i < 5; i++ {
+				chainName := fmt.Sprintf("cali-chain-%d", i)
+				Expect(strings.Contains(input, ":"+chainName+" ")).To(Equal(
+					strings.Contains(input, "-A "+chainName+" ")), input)
+			}
+		}
+	})
+
+	It("should leave the chains in a failed chunk as they were", func() {
+		dataplane.RejectLinesContaining = "rule-4-1"
+		_, err := table.ApplyContext(context.Background())
+		Expect(err).To(BeAssignableToTypeOf(&ApplyError{}))
+		Expect(dataplane.Chains["cali-chain-4"]).To(Equal([]string{"-j DROP", "-j ACCEPT"}))
+	})
+})
@@ -0,0 +1,105 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// restoreFailedLineRegexp matches the part of iptables-restore's error output that identifies
+// the failing line.  Older versions say "iptables-restore: line 5 failed"; newer versions say
+// "Error occurred at line: 5".
+var restoreFailedLineRegexp = regexp.MustCompile(`(?:line (\d+) failed|Error occurred at line: (\d+))`)
+
+// RestoreError is returned (or, after retries, wrapped in an ApplyError) when iptables-restore
+// rejects our input.  Where iptables-restore reports the number of the failing line, the line
+// is mapped back to the chain and rule that it was rendered from.
+type RestoreError struct {
+	// Chain is the chain that the failing line modified, or "" if iptables-restore didn't
+	// report the failing line or the line didn't belong to a chain (for example, "COMMIT").
+	Chain string
+	// RuleIndex is the index of the failing rule in the Chain's Rules or, for a kernel chain,
+	// in the rules that we insert into it.  -1 if the line wasn't rendered from a Rule (for
+	// example, a chain creation or a deletion of an old rule).
+	RuleIndex int
+	// Fragment is the failing line of iptables-restore input, or "" if it isn't known.
+	Fragment string
+	// Stderr is iptables-restore's error output.
+	Stderr string
+	// Err is the error returned from running the command.
+	Err error
+
+	// input is the complete iptables-restore input, which we report via ApplyError.
+	input string
+}
+
+func newRestoreError(err error, input string, stderr string, lineOrigins []RestoreLineOrigin) *RestoreError {
+	restoreErr := &RestoreError{
+		RuleIndex: -1,
+		Stderr:    stderr,
+		Err:       err,
+		input:     input,
+	}
+	lineNum := parseRestoreFailedLine(stderr)
+	if lineNum <= 0 {
+		return restoreErr
+	}
+	lines := strings.Split(input, "\n")
+	if lineNum <= len(lines) {
+		restoreErr.Fragment = lines[lineNum-1]
+	}
+	if lineNum <= len(lineOrigins) {
+		origin := lineOrigins[lineNum-1]
+		restoreErr.Chain = origin.Chain
+		restoreErr.RuleIndex = origin.RuleIndex
+	}
+	return restoreErr
+}
+
+func (e *RestoreError) Error() string {
+	if e.Chain == "" {
+		if e.Fragment != "" {
+			return fmt.Sprintf("iptables-restore rejected %q: %v", e.Fragment, e.Err)
+		}
+		return e.Err.Error()
+	}
+	if e.RuleIndex < 0 {
+		return fmt.Sprintf("iptables-restore rejected update to chain %s (%q): %v",
+			e.Chain, e.Fragment, e.Err)
+	}
+	return fmt.Sprintf("iptables-restore rejected rule %d of chain %s (%q): %v",
+		e.RuleIndex, e.Chain, e.Fragment, e.Err)
+}
+
+// parseRestoreFailedLine extracts the (1-based) number of the failing line from
+// iptables-restore's error output.  Returns 0 if the output doesn't say.
+func parseRestoreFailedLine(errorOutput string) int {
+	captures := restoreFailedLineRegexp.FindStringSubmatch(errorOutput)
+	if captures == nil {
+		return 0
+	}
+	numStr := captures[1]
+	if numStr == "" {
+		numStr = captures[2]
+	}
+	lineNum, err := strconv.Atoi(numStr)
+	if err != nil {
+		return 0
+	}
+	return lineNum
+}
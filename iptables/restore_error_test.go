@@ -0,0 +1,89 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables_test
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/projectcalico/felix/iptables"
+)
+
+var _ = Describe("Table restore errors", func() {
+	var dataplane *mockDataplane
+	var table *Table
+
+	BeforeEach(func() {
+		dataplane = newMockDataplane("filter", map[string][]string{
+			"FORWARD": {},
+			"INPUT":   {},
+			"OUTPUT":  {},
+		})
+		table = dataplane.newTable(func(options *TableOptions) {
+			options.ReturnErrorOnFailure = true
+			options.ApplyRetries = 1
+		})
+		dataplane.RejectLinesContaining = "bad-rule"
+	})
+
+	applyAndGetRestoreError := func() *RestoreError {
+		_, err := table.ApplyContext(context.Background())
+		Expect(err).To(BeAssignableToTypeOf(&ApplyError{}))
+		applyErr := err.(*ApplyError)
+		Expect(applyErr.Input).To(ContainSubstring("bad-rule"))
+		restoreErr, ok := applyErr.Err.(*RestoreError)
+		Expect(ok).To(BeTrue(), "expected a RestoreError, got %v", applyErr.Err)
+		return restoreErr
+	}
+
+	It("should trace a failure back to the rule in the chain", func() {
+		table.UpdateChain(&Chain{Name: "cali-foo", Rules: []Rule{
+			{Action: AcceptAction{}},
+			{Action: DropAction{}, Comment: "bad-rule"},
+		}})
+		restoreErr := applyAndGetRestoreError()
+		Expect(restoreErr.Chain).To(Equal("cali-foo"))
+		Expect(restoreErr.RuleIndex).To(Equal(1))
+		Expect(restoreErr.Fragment).To(HavePrefix("-A cali-foo"))
+		Expect(restoreErr.Fragment).To(ContainSubstring("bad-rule"))
+		Expect(restoreErr.Stderr).To(ContainSubstring("failed"))
+		Expect(restoreErr.Error()).To(ContainSubstring("rule 1 of chain cali-foo"))
+	})
+
+	It("should trace a failure back to an inserted rule", func() {
+		table.SetRuleInsertions("FORWARD", []Rule{
+			{Action: AcceptAction{}},
+			{Action: AcceptAction{}},
+			{Action: DropAction{}, Comment: "bad-rule"},
+		})
+		restoreErr := applyAndGetRestoreError()
+		Expect(restoreErr.Chain).To(Equal("FORWARD"))
+		Expect(restoreErr.RuleIndex).To(Equal(2))
+		Expect(restoreErr.Fragment).To(ContainSubstring("bad-rule"))
+	})
+
+	It("should leave the chain unset if the failing line isn't known", func() {
+		dataplane.RejectLinesContaining = ""
+		dataplane.FailAllRestores = true
+		table.UpdateChain(&Chain{Name: "cali-foo", Rules: []Rule{{Action: DropAction{}, Comment: "bad-rule"}}})
+		restoreErr := applyAndGetRestoreError()
+		Expect(restoreErr.Chain).To(BeEmpty())
+		Expect(restoreErr.RuleIndex).To(Equal(-1))
+		Expect(restoreErr.Fragment).To(BeEmpty())
+		Expect(restoreErr.Err).To(HaveOccurred())
+	})
+})
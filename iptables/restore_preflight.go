@@ -0,0 +1,62 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"bytes"
+	"context"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// preflightRestore runs the given chunk through "iptables-restore --test", which parses and
+// validates the input without committing it.  Returns a *RestoreError if the input is rejected.
+// If iptables-restore doesn't support --test, logs a warning, disables further preflight
+// checks and returns nil so that the caller falls back to committing directly.
+func (t *Table) preflightRestore(ctx context.Context, features *Features, chunk RestoreChunk) error {
+	var outputBuf, errBuf bytes.Buffer
+	cmd := t.newCmd(t.iptablesRestoreCmd, append(t.restoreArgs(features), "--test")...)
+	cmd.SetStdout(&outputBuf)
+	cmd.SetStderr(&errBuf)
+	cmd.SetStdin(bytes.NewReader(chunk.Input))
+	lock := t.xtablesLock(ctx)
+	lock.Lock()
+	err := runCmd(ctx, cmd)
+	lock.Unlock()
+	if err == nil {
+		return nil
+	}
+	if testModeUnsupported(errBuf.String()) {
+		t.logCxt.WithFields(log.Fields{
+			"errorOutput": errBuf.String(),
+			"error":       err,
+		}).Warn("iptables-restore doesn't support --test, disabling restore preflight checks")
+		t.restorePreflight = false
+		return nil
+	}
+	t.logCxt.Warn("iptables-restore --test rejected our update, not committing it")
+	t.metrics.Add(MetricRestorePreflightFailures, 1)
+	return t.onRestoreFailure(err, string(chunk.Input), outputBuf.String(), errBuf.String(), chunk.LineOrigins)
+}
+
+// testModeUnsupported returns true if iptables-restore's error output shows that it failed
+// because it doesn't recognise the --test option.
+func testModeUnsupported(errorOutput string) bool {
+	return strings.Contains(errorOutput, "--test") &&
+		(strings.Contains(errorOutput, "unrecognized option") ||
+			strings.Contains(errorOutput, "invalid option") ||
+			strings.Contains(errorOutput, "unknown option"))
+}
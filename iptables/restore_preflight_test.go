@@ -0,0 +1,102 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables_test
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/projectcalico/felix/iptables"
+)
+
+var _ = Describe("Table restore preflight", func() {
+	var dataplane *mockDataplane
+	var table *Table
+
+	newTable := func(preflight bool) {
+		table = dataplane.newTable(func(options *TableOptions) {
+			options.ReturnErrorOnFailure = true
+			options.ApplyRetries = 1
+			options.RestorePreflight = preflight
+		})
+	}
+
+	// numCommits counts the iptables-restore runs that weren't just tests.
+	numCommits := func() int {
+		n := 0
+		for _, cmd := range dataplane.Cmds {
+			if restore, ok := cmd.(*restoreCmd); ok && !restore.Test {
+				n++
+			}
+		}
+		return n
+	}
+
+	BeforeEach(func() {
+		dataplane = newMockDataplane("filter", map[string][]string{"FORWARD": {}})
+	})
+
+	It("should test, then commit, a valid update", func() {
+		newTable(true)
+		table.UpdateChain(&Chain{Name: "cali-foo", Rules: []Rule{{Action: AcceptAction{}}}})
+		table.Apply()
+		Expect(dataplane.NumTestRestores).To(Equal(1))
+		Expect(numCommits()).To(Equal(1))
+		Expect(dataplane.Chains["cali-foo"]).To(HaveLen(1))
+	})
+
+	It("should not commit an update that fails the test", func() {
+		newTable(true)
+		dataplane.RejectLinesContaining = "bad-rule"
+		table.UpdateChain(&Chain{Name: "cali-foo", Rules: []Rule{
+			{Action: AcceptAction{}},
+			{Action: DropAction{}, Comment: "bad-rule"},
+		}})
+		_, err := table.ApplyContext(context.Background())
+		Expect(err).To(HaveOccurred())
+		restoreErr, ok := err.(*ApplyError).Err.(*RestoreError)
+		Expect(ok).To(BeTrue(), "expected a RestoreError, got %v", err)
+		Expect(restoreErr.Chain).To(Equal("cali-foo"))
+		Expect(restoreErr.RuleIndex).To(Equal(1))
+
+		Expect(dataplane.NumTestRestores).To(BeNumerically(">", 0))
+		Expect(numCommits()).To(BeZero())
+		Expect(dataplane.Chains).NotTo(HaveKey("cali-foo"))
+	})
+
+	It("should fall back to committing directly if --test is unsupported", func() {
+		newTable(true)
+		dataplane.TestModeUnsupported = true
+		table.UpdateChain(&Chain{Name: "cali-foo", Rules: []Rule{{Action: AcceptAction{}}}})
+		table.Apply()
+		Expect(dataplane.Chains["cali-foo"]).To(HaveLen(1))
+
+		table.UpdateChain(&Chain{Name: "cali-bar", Rules: []Rule{{Action: AcceptAction{}}}})
+		table.Apply()
+		Expect(dataplane.Chains["cali-bar"]).To(HaveLen(1))
+		Expect(dataplane.NumTestRestores).To(Equal(1))
+		Expect(numCommits()).To(Equal(2))
+	})
+
+	It("should not test updates by default", func() {
+		newTable(false)
+		table.UpdateChain(&Chain{Name: "cali-foo", Rules: []Rule{{Action: AcceptAction{}}}})
+		table.Apply()
+		Expect(dataplane.NumTestRestores).To(BeZero())
+		Expect(numCommits()).To(Equal(1))
+	})
+})
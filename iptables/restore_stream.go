@@ -0,0 +1,98 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"sync"
+)
+
+// restoreStreamBufferSize is the size of the buffer between the RestoreInputBuilder and the
+// pipe to iptables-restore.  It saves us from doing a pipe write for every line.
+const restoreStreamBufferSize = 64 * 1024
+
+var errRestoreExited = errors.New("iptables-restore exited before reading all of its input")
+
+// restoreStream streams input to an iptables-restore subprocess through a pipe, so that we
+// don't need to hold the whole input in memory.  It starts the subprocess on the first write
+// so that a no-op update doesn't run iptables-restore at all.  The lock is held from the first
+// write until Wait returns.
+type restoreStream struct {
+	ctx    context.Context
+	newCmd func() CmdIface
+	lock   sync.Locker
+
+	pipeReader *io.PipeReader
+	pipeWriter *io.PipeWriter
+	bufWriter  *bufio.Writer
+	result     chan error
+}
+
+func newRestoreStream(ctx context.Context, newCmd func() CmdIface, lock sync.Locker) *restoreStream {
+	return &restoreStream{
+		ctx:    ctx,
+		newCmd: newCmd,
+		lock:   lock,
+	}
+}
+
+func (s *restoreStream) Write(p []byte) (int, error) {
+	if s.bufWriter == nil {
+		s.start()
+	}
+	return s.bufWriter.Write(p)
+}
+
+func (s *restoreStream) start() {
+	s.pipeReader, s.pipeWriter = io.Pipe()
+	s.bufWriter = bufio.NewWriterSize(s.pipeWriter, restoreStreamBufferSize)
+	cmd := s.newCmd()
+	cmd.SetStdin(s.pipeReader)
+	s.result = make(chan error, 1)
+	s.lock.Lock()
+	go func() {
+		err := runCmd(s.ctx, cmd)
+		// If iptables-restore exited without reading all of its input, make sure that our
+		// writes fail rather than blocking.
+		s.pipeReader.CloseWithError(errRestoreExited)
+		s.result <- err
+	}()
+}
+
+// Started returns true if anything has been written to the stream (and hence iptables-restore
+// has been started).
+func (s *restoreStream) Started() bool {
+	return s.bufWriter != nil
+}
+
+// Wait closes iptables-restore's input and waits for it to finish.  It returns the error from
+// iptables-restore or, if iptables-restore succeeded but we failed to write some of its input,
+// the write error.
+func (s *restoreStream) Wait() error {
+	if !s.Started() {
+		return nil
+	}
+	writeErr := s.bufWriter.Flush()
+	_ = s.pipeWriter.Close()
+	err := <-s.result
+	s.lock.Unlock()
+	if err == nil {
+		err = writeErr
+	}
+	return err
+}
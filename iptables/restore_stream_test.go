@@ -0,0 +1,94 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables_test
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/projectcalico/felix/iptables"
+)
+
+var _ = Describe("Table with streamed restore input", func() {
+	var dataplane *mockDataplane
+	var table *Table
+
+	numRestores := func() int {
+		n := 0
+		for _, name := range dataplane.CmdNames {
+			if name == "iptables-restore" {
+				n++
+			}
+		}
+		return n
+	}
+
+	BeforeEach(func() {
+		dataplane = newMockDataplane("filter", map[string][]string{
+			"FORWARD": {},
+			"INPUT":   {},
+			"OUTPUT":  {},
+		})
+		table = dataplane.newTable(func(options *TableOptions) {
+			options.ReturnErrorOnFailure = true
+			options.StreamRestoreInput = true
+			options.ApplyRetries = 1
+		})
+		table.UpdateChain(&Chain{Name: "cali-foo", Rules: []Rule{
+			{Action: DropAction{}},
+			{Action: AcceptAction{}, Comment: "second-rule"},
+		}})
+		table.SetRuleInsertions("FORWARD", []Rule{{Action: JumpAction{Target: "cali-foo"}}})
+	})
+
+	It("should program the dataplane", func() {
+		_, err := table.ApplyContext(context.Background())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(numRestores()).To(Equal(1))
+		Expect(dataplane.Chains["cali-foo"]).To(HaveLen(2))
+		Expect(dataplane.Chains["FORWARD"]).To(HaveLen(1))
+	})
+
+	It("should program the dataplane with a cancellable context", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		_, err := table.ApplyContext(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(dataplane.Chains["cali-foo"]).To(HaveLen(2))
+	})
+
+	It("should not run iptables-restore for a no-op update", func() {
+		table.Apply()
+		table.UpdateChain(&Chain{Name: "cali-foo", Rules: []Rule{
+			{Action: DropAction{}},
+			{Action: AcceptAction{}, Comment: "second-rule"},
+		}})
+		table.Apply()
+		Expect(numRestores()).To(Equal(1))
+	})
+
+	It("should trace a failure back to the rule", func() {
+		dataplane.RejectLinesContaining = "second-rule"
+		_, err := table.ApplyContext(context.Background())
+		Expect(err).To(BeAssignableToTypeOf(&ApplyError{}))
+		restoreErr, ok := err.(*ApplyError).Err.(*RestoreError)
+		Expect(ok).To(BeTrue())
+		Expect(restoreErr.Chain).To(Equal("cali-foo"))
+		Expect(restoreErr.RuleIndex).To(Equal(1))
+		Expect(dataplane.Chains).NotTo(HaveKey("cali-foo"))
+	})
+})
@@ -0,0 +1,99 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables_test
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/projectcalico/felix/iptables"
+)
+
+var _ = Describe("Table retry policy", func() {
+	var dataplane *mockDataplane
+
+	newTable := func(setOptions func(options *TableOptions)) *Table {
+		table := dataplane.newTable(func(options *TableOptions) {
+			options.ReturnErrorOnFailure = true
+			if setOptions != nil {
+				setOptions(options)
+			}
+		})
+		table.UpdateChain(&Chain{Name: "cali-foo", Rules: []Rule{{Action: DropAction{}}}})
+		return table
+	}
+
+	numRestores := func() int {
+		n := 0
+		for _, name := range dataplane.CmdNames {
+			if name == "iptables-restore" {
+				n++
+			}
+		}
+		return n
+	}
+
+	BeforeEach(func() {
+		dataplane = newMockDataplane("filter", map[string][]string{
+			"FORWARD": {},
+			"INPUT":   {},
+			"OUTPUT":  {},
+		})
+		dataplane.FailAllRestores = true
+	})
+
+	It("should default to 10 retries with exponential backoff from 1ms", func() {
+		table := newTable(nil)
+		_, err := table.ApplyContext(context.Background())
+		Expect(err).To(HaveOccurred())
+		Expect(numRestores()).To(Equal(11))
+		Expect(dataplane.CumulativeSleep).To(Equal(1023 * time.Millisecond))
+	})
+
+	It("should honour the configured retries and backoff limits", func() {
+		table := newTable(func(options *TableOptions) {
+			options.ApplyRetries = 3
+			options.InitialBackoff = 10 * time.Millisecond
+			options.MaxBackoff = 25 * time.Millisecond
+		})
+		_, err := table.ApplyContext(context.Background())
+		Expect(err).To(HaveOccurred())
+		Expect(numRestores()).To(Equal(4))
+		Expect(dataplane.CumulativeSleep).To(Equal((10 + 20 + 25) * time.Millisecond))
+	})
+
+	It("should add jitter to each retry", func() {
+		table := newTable(func(options *TableOptions) {
+			options.ApplyRetries = 2
+			options.InitialBackoff = 10 * time.Millisecond
+			options.BackoffMaxJitter = 5 * time.Millisecond
+		})
+		_, err := table.ApplyContext(context.Background())
+		Expect(err).To(HaveOccurred())
+		Expect(dataplane.CumulativeSleep).To(BeNumerically(">=", 30*time.Millisecond))
+		Expect(dataplane.CumulativeSleep).To(BeNumerically("<", 40*time.Millisecond))
+	})
+
+	It("should reject a negative number of retries", func() {
+		Expect(func() {
+			newTable(func(options *TableOptions) {
+				options.ApplyRetries = -1
+			})
+		}).To(Panic())
+	})
+})
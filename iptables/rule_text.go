@@ -0,0 +1,180 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"bytes"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Strict verification (TableOptions.StrictVerify) catches in-place edits to our rules that keep
+// the rule's hash comment, which the hash comparison can't see.  When strict verification is
+// enabled, readHashesFrom records the text of each rule in our chains and, after each load of
+// the dataplane, we compare it with the re-rendered rule.  Both sides are canonicalised first
+// since iptables-save doesn't print rules exactly as we write them.
+//
+// Canonicalisation is necessarily approximate.  To avoid rewriting a rule over and over because
+// of a formatting difference that we don't know about, a rule that still differs straight after
+// we've rewritten it is assumed to be a formatting difference: we remember its text and only
+// flag the rule again if the text changes.
+
+// canonicalOptions maps the long forms of iptables options to the forms that iptables-save
+// uses.
+var canonicalOptions = map[string]string{
+	"--append":            "-A",
+	"--jump":              "-j",
+	"--goto":              "-g",
+	"--source":            "-s",
+	"--destination":       "-d",
+	"--protocol":          "-p",
+	"--in-interface":      "-i",
+	"--out-interface":     "-o",
+	"--match":             "-m",
+	"--source-port":       "--sport",
+	"--destination-port":  "--dport",
+	"--source-ports":      "--sports",
+	"--destination-ports": "--dports",
+}
+
+// canonicaliseRule converts a rule, either as we render it or as iptables-save prints it, to a
+// canonical form for comparison.
+func canonicaliseRule(rule string) string {
+	tokens := splitRuleTokens(rule)
+	out := make([]string, 0, len(tokens))
+	for i := 0; i < len(tokens); i++ {
+		token := tokens[i]
+		if canon, ok := canonicalOptions[token]; ok {
+			token = canon
+		}
+		switch token {
+		case "-m":
+			// iptables-save adds an implicit protocol match after "-p <proto>".
+			if i+1 < len(tokens) && len(out) >= 2 && out[len(out)-2] == "-p" && tokens[i+1] == out[len(out)-1] {
+				i++
+				continue
+			}
+		case "-s", "-d":
+			// iptables-save always includes the prefix length.
+			if i+1 < len(tokens) && !strings.Contains(tokens[i+1], "/") {
+				out = append(out, token)
+				i++
+				if strings.Contains(tokens[i], ":") {
+					out = append(out, tokens[i]+"/128")
+				} else {
+					out = append(out, tokens[i]+"/32")
+				}
+				continue
+			}
+		}
+		out = append(out, token)
+	}
+	return strings.Join(out, " ")
+}
+
+// splitRuleTokens splits a rule into whitespace-separated tokens, treating double-quoted
+// strings (such as comments) as single tokens and removing the quotes.
+func splitRuleTokens(rule string) []string {
+	var tokens []string
+	var current bytes.Buffer
+	inToken := false
+	inQuotes := false
+	for i := 0; i < len(rule); i++ {
+		c := rule[i]
+		switch {
+		case c == '\\' && inQuotes && i+1 < len(rule):
+			i++
+			current.WriteByte(rule[i])
+		case c == '"':
+			inQuotes = !inQuotes
+			inToken = true
+		case (c == ' ' || c == '\t') && !inQuotes:
+			if inToken {
+				tokens = append(tokens, current.String())
+				current.Reset()
+				inToken = false
+			}
+		default:
+			current.WriteByte(c)
+			inToken = true
+		}
+	}
+	if inToken {
+		tokens = append(tokens, current.String())
+	}
+	return tokens
+}
+
+// checkRuleText compares the text of the rules in our chains with the re-rendered rules.  Any
+// rule that has been altered has its entry in dataplaneHashes blanked, so that the chain's
+// next update replaces it, and its chain is marked dirty.
+func (t *Table) checkRuleText(dataplaneHashes map[string][]string) {
+	features := t.featureDetector.GetFeatures()
+	seenHashes := map[string]bool{}
+	for chainName, chain := range t.chainNameToChain {
+		if t.dirtyChains.Contains(chainName) || t.isQuarantined(chainName) {
+			continue
+		}
+		dpHashes := dataplaneHashes[chainName]
+		dpText := t.dataplaneRuleText[chainName]
+		hashes := t.ruleHashes(chain, features)
+		for i, hash := range hashes {
+			seenHashes[hash] = true
+			if i >= len(dpHashes) || i >= len(dpText) || dpHashes[i] != hash {
+				// Hash comparison will already have caught this.
+				continue
+			}
+			expected := canonicaliseRule(t.renderer.RenderAppend(chain.Rules[i], chainName, t.commentFrag(hash), features))
+			actual := canonicaliseRule(dpText[i])
+			if expected == actual || t.ruleTextBaseline[hash] == actual {
+				delete(t.ruleTextRewritten, hash)
+				continue
+			}
+			logCxt := t.logCxt.WithFields(log.Fields{
+				"chainName": chainName,
+				"ruleNum":   i + 1,
+				"expected":  expected,
+				"actual":    actual,
+			})
+			if t.ruleTextRewritten[hash] {
+				// We've just rewritten this rule and it still doesn't match so it's
+				// most likely a formatting difference.
+				logCxt.Info("Rule text still differs after rewrite, assuming a formatting difference")
+				delete(t.ruleTextRewritten, hash)
+				t.ruleTextBaseline[hash] = actual
+				continue
+			}
+			logCxt.Warn("Detected rule that was modified in place, marking for resync")
+			t.metrics.Add(MetricRuleTextMismatches, 1)
+			t.ruleTextRewritten[hash] = true
+			dpHashes[i] = ""
+			t.dirtyChains.Add(chainName)
+			t.reportOutOfSync(chainName, OutOfSyncRuleAltered)
+		}
+	}
+
+	// Forget about rules that have gone.
+	for hash := range t.ruleTextBaseline {
+		if !seenHashes[hash] {
+			delete(t.ruleTextBaseline, hash)
+		}
+	}
+	for hash := range t.ruleTextRewritten {
+		if !seenHashes[hash] {
+			delete(t.ruleTextRewritten, hash)
+		}
+	}
+}
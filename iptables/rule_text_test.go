@@ -0,0 +1,104 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables_test
+
+import (
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/projectcalico/felix/iptables"
+)
+
+var _ = Describe("Table strict verification", func() {
+	var dataplane *mockDataplane
+	var table *Table
+	var reports []string
+	var originalRule string
+
+	newTable := func(strict bool) {
+		table = dataplane.newTable(func(options *TableOptions) {
+			options.StrictVerify = strict
+			options.OnOutOfSync = func(chainName string, reason string) {
+				reports = append(reports, chainName+" "+reason)
+			}
+		})
+		table.UpdateChain(&Chain{Name: "cali-foo", Rules: []Rule{
+			{Match: Match().Protocol("tcp").SourceNet("10.0.0.1"), Action: AcceptAction{}},
+		}})
+		table.Apply()
+		Expect(dataplane.Chains["cali-foo"]).To(HaveLen(1))
+		originalRule = dataplane.Chains["cali-foo"][0]
+	}
+
+	// alterRule edits our rule in place, leaving its hash comment alone, then forces a resync.
+	alterRule := func(old, new string) {
+		Expect(originalRule).To(ContainSubstring(old))
+		dataplane.Chains["cali-foo"][0] = strings.Replace(originalRule, old, new, 1)
+		table.InvalidateDataplaneCache("test")
+		table.Apply()
+	}
+
+	BeforeEach(func() {
+		dataplane = newMockDataplane("filter", map[string][]string{"FORWARD": {}})
+		reports = nil
+	})
+
+	Describe("with strict verification enabled", func() {
+		BeforeEach(func() {
+			newTable(true)
+		})
+
+		It("should rewrite a rule that was modified in place", func() {
+			alterRule("ACCEPT", "DROP")
+			Expect(reports).To(Equal([]string{"cali-foo rule-altered"}))
+			Expect(dataplane.Chains["cali-foo"]).To(Equal([]string{originalRule}))
+		})
+
+		It("should ignore differences in formatting", func() {
+			rule := strings.Replace(originalRule, "--jump", "-j", 1)
+			rule = strings.Replace(rule, "-p tcp", "-p tcp -m tcp", 1)
+			rule = strings.Replace(rule, "10.0.0.1", "10.0.0.1/32", 1)
+			Expect(rule).NotTo(Equal(originalRule))
+			dataplane.Chains["cali-foo"][0] = rule
+			table.InvalidateDataplaneCache("test")
+			table.Apply()
+			Expect(reports).To(BeEmpty())
+			Expect(dataplane.Chains["cali-foo"]).To(Equal([]string{rule}))
+		})
+
+		It("should stop rewriting a rule that still differs after a rewrite", func() {
+			alterRule("ACCEPT", "DROP")
+			// Simulate a formatting difference that we don't know about: the rule comes
+			// back with the same text after we rewrite it.
+			alterRule("ACCEPT", "DROP")
+			Expect(reports).To(Equal([]string{"cali-foo rule-altered"}))
+			Expect(dataplane.Chains["cali-foo"][0]).To(ContainSubstring("DROP"))
+
+			// But a further change is flagged.
+			alterRule("ACCEPT", "RETURN")
+			Expect(reports).To(Equal([]string{"cali-foo rule-altered", "cali-foo rule-altered"}))
+			Expect(dataplane.Chains["cali-foo"]).To(Equal([]string{originalRule}))
+		})
+	})
+
+	It("should not compare rule text by default", func() {
+		newTable(false)
+		alterRule("ACCEPT", "DROP")
+		Expect(reports).To(BeEmpty())
+		Expect(dataplane.Chains["cali-foo"][0]).To(ContainSubstring("DROP"))
+	})
+})
@@ -15,18 +15,13 @@
 package iptables
 
 import (
-	"crypto/sha256"
-	"encoding/base64"
-	"fmt"
-	"strings"
-
 	log "github.com/sirupsen/logrus"
 )
 
 const (
 	// Compromise: shorter is better for table occupancy and readability. Longer is better for
 	// collision-resistance.  16 chars gives us 96 bits of entropy, which is fairly collision
-	// resistant.
+	// resistant.  This is the default; see HashFormat.
 	HashLength = 16
 )
 
@@ -34,43 +29,31 @@ type Rule struct {
 	Match   MatchCriteria
 	Action  Action
 	Comment string
+	// ExtraComments are rendered as further "-m comment" matches after Comment, for example,
+	// to show the name and namespace of the policy that the rule came from in "iptables -L"
+	// output.  Like Comment, they're part of the rule so they're included in its hash, in
+	// order.
+	ExtraComments []string
+	// IPVersion, if non-zero, limits the rule to the Tables of that IP version (4 or 6) so that
+	// the same Chain can be passed to the Tables of both IP versions.  The other IP version's
+	// Tables drop the rule.  See Chain.ForIPVersion.
+	IPVersion uint8
 }
 
+// RenderAppend renders the rule as an iptables append ("-A") operation.  It is a convenience
+// wrapper around the iptables Renderer.
 func (r Rule) RenderAppend(chainName, prefixFragment string, features *Features) string {
-	fragments := make([]string, 0, 6)
-	fragments = append(fragments, "-A", chainName)
-	return r.renderInner(fragments, prefixFragment, features)
+	return IptablesRenderer{}.RenderAppend(r, chainName, prefixFragment, features)
 }
 
+// RenderInsert renders the rule as an iptables insert ("-I") operation.
 func (r Rule) RenderInsert(chainName, prefixFragment string, features *Features) string {
-	fragments := make([]string, 0, 6)
-	fragments = append(fragments, "-I", chainName)
-	return r.renderInner(fragments, prefixFragment, features)
+	return IptablesRenderer{}.RenderInsert(r, chainName, prefixFragment, features)
 }
 
+// RenderReplace renders the rule as an iptables replace ("-R") operation.
 func (r Rule) RenderReplace(chainName string, ruleNum int, prefixFragment string, features *Features) string {
-	fragments := make([]string, 0, 7)
-	fragments = append(fragments, "-R", chainName, fmt.Sprintf("%d", ruleNum))
-	return r.renderInner(fragments, prefixFragment, features)
-}
-
-func (r Rule) renderInner(fragments []string, prefixFragment string, features *Features) string {
-	if prefixFragment != "" {
-		fragments = append(fragments, prefixFragment)
-	}
-	if r.Comment != "" {
-		commentFragment := fmt.Sprintf("-m comment --comment \"%s\"", r.Comment)
-		fragments = append(fragments, commentFragment)
-	}
-	matchFragment := r.Match.Render()
-	if matchFragment != "" {
-		fragments = append(fragments, matchFragment)
-	}
-	actionFragment := r.Action.ToFragment(features)
-	if actionFragment != "" {
-		fragments = append(fragments, actionFragment)
-	}
-	return strings.Join(fragments, " ")
+	return IptablesRenderer{}.RenderReplace(r, chainName, ruleNum, prefixFragment, features)
 }
 
 type Chain struct {
@@ -78,14 +61,26 @@ type Chain struct {
 	Rules []Rule
 }
 
+// RuleHashes returns the hashes of the chain's rules in the DefaultHashFormat.
 func (c *Chain) RuleHashes(features *Features) []string {
+	return c.RuleHashesWithFormat(features, DefaultHashFormat)
+}
+
+// RuleHashesWithFormat returns the hashes of the chain's rules, encoded in the given format.
+func (c *Chain) RuleHashesWithFormat(features *Features, format HashFormat) []string {
+	format = format.withDefaults()
 	if c == nil {
 		return nil
 	}
 	hashes := make([]string, len(c.Rules))
 	// First hash the chain name so that identical rules in different chains will get different
-	// hashes.
-	s := sha256.New224()
+	// hashes.  The salt, if any, goes first; the separator stops it from running into the
+	// chain name.
+	s := format.Algorithm.newHash()
+	if format.Salt != "" {
+		s.Write([]byte(format.Salt))
+		s.Write([]byte{0})
+	}
 	s.Write([]byte(c.Name))
 	hash := s.Sum(nil)
 	for ii, rule := range c.Rules {
@@ -96,9 +91,7 @@ func (c *Chain) RuleHashes(features *Features) []string {
 		ruleForHashing := rule.RenderAppend(c.Name, "HASH", features)
 		s.Write([]byte(ruleForHashing))
 		hash = s.Sum(hash[0:0])
-		// Encode the hash using a compact character set.  We use the URL-safe base64
-		// variant because it uses '-' and '_', which are more shell-friendly.
-		hashes[ii] = base64.RawURLEncoding.EncodeToString(hash)[:HashLength]
+		hashes[ii] = format.Alphabet.encode(hash, format.Length)
 		if log.GetLevel() >= log.DebugLevel {
 			log.WithFields(log.Fields{
 				"ruleFragment": ruleForHashing,
@@ -25,14 +25,14 @@ import (
 
 var (
 	rules1 = []Rule{
-		{Match: MatchCriteria{"-m foobar --foobar baz"}, Action: JumpAction{Target: "biff"}},
+		{Match: Match().ConntrackState("INVALID"), Action: JumpAction{Target: "biff"}},
 	}
 	rules2 = []Rule{
-		{Match: MatchCriteria{"-m foobar --foobar baz"}, Action: JumpAction{Target: "boff"}},
+		{Match: Match().ConntrackState("INVALID"), Action: JumpAction{Target: "boff"}},
 	}
 	rules3 = []Rule{
-		{Match: MatchCriteria{"-m foobar --foobar baz"}, Action: JumpAction{Target: "biff"}},
-		{Match: MatchCriteria{"-m foobar --foobar baz"}, Action: JumpAction{Target: "boff"}},
+		{Match: Match().ConntrackState("INVALID"), Action: JumpAction{Target: "biff"}},
+		{Match: Match().ConntrackState("INVALID"), Action: JumpAction{Target: "boff"}},
 	}
 )
 
@@ -0,0 +1,202 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	. "github.com/onsi/ginkgo"
+	"github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+// The iptables-save corpus, in testdata/save-corpus, guards our parsing of iptables-save output
+// against differences between iptables versions, backends and distros.  Each capture is named
+// "<binary>-<version>-<backend>-<distro>-<table>.save", or ".list" for "iptables -S" output,
+// and has a ".expected.json" file next to it with what we parse from it.
+//
+// To add a capture, run, from this directory:
+//
+//	go test -args -ingest-save-capture=<file> -save-capture-name=<capture name>
+//
+// That copies the capture into the corpus, normalised, and records what we parse from it; review
+// the result before committing it.  If a change to the parsing is intended, -update-save-corpus
+// rewrites all the expected results.
+var (
+	ingestSaveCapture string
+	saveCaptureName   string
+	updateSaveCorpus  bool
+)
+
+func init() {
+	flag.StringVar(&ingestSaveCapture, "ingest-save-capture", "", "")
+	flag.StringVar(&saveCaptureName, "save-capture-name", "", "")
+	flag.BoolVar(&updateSaveCorpus, "update-save-corpus", false, "")
+}
+
+const saveCorpusDir = "testdata/save-corpus"
+
+var (
+	saveCaptureNameRegexp = regexp.MustCompile(
+		`^(ip6?tables)-[^-]+-(?:legacy|nft)-[^-]+-(filter|nat|mangle|raw)\.(save|list)$`)
+	saveCountersRegexp = regexp.MustCompile(`(?m)^\[\d+:\d+\] `)
+)
+
+// saveCorpusResult is what we parse from a capture.
+type saveCorpusResult struct {
+	Hashes   map[string][]string `json:"hashes"`
+	Policies map[string]string   `json:"policies"`
+	// OurChains lists the chains that we'd clean up if we weren't programming them.
+	OurChains []string `json:"ourChains"`
+}
+
+// parseSaveCapture parses the given capture as a Table for the capture's table and IP version
+// would.
+func parseSaveCapture(fileName string, capture []byte) (*saveCorpusResult, error) {
+	m := saveCaptureNameRegexp.FindStringSubmatch(fileName)
+	if m == nil {
+		return nil, fmt.Errorf("capture name %q doesn't follow the corpus convention", fileName)
+	}
+	ipVersion := uint8(4)
+	if m[1] == "ip6tables" {
+		ipVersion = 6
+	}
+	table := NewTable(
+		m[2],
+		ipVersion,
+		"cali:",
+		&sync.Mutex{},
+		NewFeatureDetector(),
+		TableOptions{
+			HistoricChainPrefixes: []string{"cali-", "felix-"},
+			LookPathOverride: func(file string) (string, error) {
+				return file, nil
+			},
+		},
+	)
+	table.saveByListing = m[3] == "list"
+	hashes, err := table.readHashesFrom(ioutil.NopCloser(bytes.NewReader(capture)))
+	if err != nil {
+		return nil, err
+	}
+	result := &saveCorpusResult{
+		Hashes:    hashes,
+		Policies:  table.chainToDataplanePolicy,
+		OurChains: []string{},
+	}
+	for chainName := range hashes {
+		if table.ourChainsRegexp.MatchString(chainName) {
+			result.OurChains = append(result.OurChains, chainName)
+		}
+	}
+	sort.Strings(result.OurChains)
+	return result, nil
+}
+
+// normaliseSaveCapture removes the differences between captures that don't come from iptables
+// itself: line endings, counters (if captured with "iptables-save -c") and a missing final
+// newline.
+func normaliseSaveCapture(capture []byte) []byte {
+	s := strings.Replace(string(capture), "\r\n", "\n", -1)
+	s = saveCountersRegexp.ReplaceAllString(s, "")
+	if !strings.HasSuffix(s, "\n") {
+		s += "\n"
+	}
+	return []byte(s)
+}
+
+func writeSaveCorpusResult(path string, result *saveCorpusResult) error {
+	out, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path+".expected.json", append(out, '\n'), 0644)
+}
+
+func checkSaveCapture(path string) {
+	capture, err := ioutil.ReadFile(path)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(normaliseSaveCapture(capture)).To(Equal(capture), "Capture isn't normalised")
+	result, err := parseSaveCapture(filepath.Base(path), capture)
+	Expect(err).NotTo(HaveOccurred())
+	if updateSaveCorpus {
+		Expect(writeSaveCorpusResult(path, result)).To(Succeed())
+	}
+	expectedJSON, err := ioutil.ReadFile(path + ".expected.json")
+	Expect(err).NotTo(HaveOccurred(), "Missing expected result; see -update-save-corpus")
+	var expected saveCorpusResult
+	Expect(json.Unmarshal(expectedJSON, &expected)).To(Succeed())
+	Expect(*result).To(Equal(expected))
+}
+
+func saveCorpusEntries() []table.TableEntry {
+	var entries []table.TableEntry
+	for _, pattern := range []string{"*.save", "*.list"} {
+		paths, err := filepath.Glob(filepath.Join(saveCorpusDir, pattern))
+		if err != nil {
+			panic(err)
+		}
+		for _, path := range paths {
+			entries = append(entries, table.Entry(filepath.Base(path), path))
+		}
+	}
+	return entries
+}
+
+var _ = Describe("iptables-save corpus", func() {
+	table.DescribeTable("should parse each capture as expected",
+		checkSaveCapture,
+		saveCorpusEntries()...,
+	)
+
+	It("should ingest a capture given with -ingest-save-capture", func() {
+		if ingestSaveCapture == "" {
+			Skip("No capture to ingest")
+		}
+		Expect(saveCaptureNameRegexp.MatchString(saveCaptureName)).To(BeTrue(),
+			"-save-capture-name should be <binary>-<version>-<backend>-<distro>-<table>.<save|list>")
+		capture, err := ioutil.ReadFile(ingestSaveCapture)
+		Expect(err).NotTo(HaveOccurred())
+		capture = normaliseSaveCapture(capture)
+		path := filepath.Join(saveCorpusDir, saveCaptureName)
+		Expect(ioutil.WriteFile(path, capture, 0644)).To(Succeed())
+		result, err := parseSaveCapture(saveCaptureName, capture)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(writeSaveCorpusResult(path, result)).To(Succeed())
+	})
+
+	It("should normalise captures", func() {
+		Expect(string(normaliseSaveCapture([]byte(
+			"*filter\r\n" +
+				":INPUT ACCEPT [10:1000]\r\n" +
+				"[5:300] -A INPUT -j ACCEPT\r\n" +
+				"COMMIT",
+		)))).To(Equal(
+			"*filter\n" +
+				":INPUT ACCEPT [10:1000]\n" +
+				"-A INPUT -j ACCEPT\n" +
+				"COMMIT\n",
+		))
+	})
+})
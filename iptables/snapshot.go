@@ -0,0 +1,147 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"sort"
+	"time"
+
+	"github.com/projectcalico/libcalico-go/lib/set"
+)
+
+// TableSnapshot is a point-in-time copy of a Table's state, for debugging.  It shares nothing
+// with the Table and it can be serialised to JSON, for example, to attach to a bug report.
+type TableSnapshot struct {
+	Name      string `json:"name"`
+	IPVersion uint8  `json:"ipVersion"`
+	// InSync is false if the Table's cache of the dataplane needs to be reloaded.
+	InSync        bool      `json:"inSync"`
+	LastReadTime  time.Time `json:"lastReadTime"`
+	LastWriteTime time.Time `json:"lastWriteTime"`
+
+	// Chains holds the desired state of our chains, sorted by name.
+	Chains []ChainSnapshot `json:"chains"`
+	// Inserts holds the desired rules that we insert into (or append to) non-Calico chains,
+	// sorted by chain name.
+	Inserts []ChainSnapshot `json:"inserts"`
+	// DataplaneHashes holds the rule hashes that we think are in the dataplane, indexed by
+	// chain name.  Empty strings stand for rules that aren't ours.
+	DataplaneHashes map[string][]string `json:"dataplaneHashes"`
+	// EncodedDataplaneHashes holds DataplaneHashes in the compact encoding of EncodeHashes,
+	// in place of DataplaneHashes, after a call to CompactDataplaneHashes.
+	EncodedDataplaneHashes []byte `json:"encodedDataplaneHashes,omitempty"`
+	// DirtyChains and DirtyInserts list the chains that are due to be written on the next
+	// Apply().
+	DirtyChains  []string `json:"dirtyChains"`
+	DirtyInserts []string `json:"dirtyInserts"`
+
+	QuarantinedChains []QuarantinedChain `json:"quarantinedChains"`
+	// UnmanagedChains lists the kernel chains that we've been told to leave alone.
+	UnmanagedChains []string `json:"unmanagedChains"`
+	// MissingHookChains lists the non-kernel chains that we have inserts for but that don't
+	// exist in the dataplane.
+	MissingHookChains []string `json:"missingHookChains"`
+}
+
+// CompactDataplaneHashes replaces the snapshot's DataplaneHashes with their compact encoding,
+// which is much smaller on nodes with very large numbers of rules.  Decode it with DecodeHashes.
+func (s *TableSnapshot) CompactDataplaneHashes() {
+	s.EncodedDataplaneHashes = EncodeHashes(s.DataplaneHashes)
+	s.DataplaneHashes = nil
+}
+
+// ChainSnapshot is the desired state of one chain, as found in a TableSnapshot.
+type ChainSnapshot struct {
+	Name string `json:"name"`
+	// Rules holds the chain's rules, rendered as we'd pass them to iptables-restore.
+	Rules []string `json:"rules"`
+	// Hashes holds the rule-tracking hashes of the rules.
+	Hashes []string `json:"hashes"`
+}
+
+// Snapshot returns a copy of the Table's state.  Like the other Table methods, it must be
+// called from the same goroutine as Apply() unless TableOptions.ThreadSafe is set.
+func (t *Table) Snapshot() TableSnapshot {
+	t.opLock.Lock()
+	defer t.opLock.Unlock()
+
+	features := t.featureDetector.GetFeatures()
+	snap := TableSnapshot{
+		Name:            t.Name,
+		IPVersion:       t.IPVersion,
+		InSync:          t.inSyncWithDataPlane,
+		LastReadTime:    t.lastReadTime,
+		LastWriteTime:   t.lastWriteTime,
+		Chains:          []ChainSnapshot{},
+		Inserts:         []ChainSnapshot{},
+		DataplaneHashes: map[string][]string{},
+		DirtyChains:     sortedStrings(t.dirtyChains),
+		DirtyInserts:    sortedStrings(t.dirtyInserts),
+		UnmanagedChains: t.sortedUnmanagedChains(),
+	}
+	snap.MissingHookChains = t.sortedMissingHookChains()
+
+	for chainName, chain := range t.chainNameToChain {
+		snap.Chains = append(snap.Chains, t.snapshotChain(chainName, chain.Rules,
+			t.ruleHashes(chain, features), features))
+	}
+	sort.Slice(snap.Chains, func(i, j int) bool {
+		return snap.Chains[i].Name < snap.Chains[j].Name
+	})
+
+	for chainName, rules := range t.chainToInsertedRules {
+		snap.Inserts = append(snap.Inserts, t.snapshotChain(chainName, rules,
+			t.calculateRuleInsertHashes(chainName, rules, features), features))
+	}
+	sort.Slice(snap.Inserts, func(i, j int) bool {
+		return snap.Inserts[i].Name < snap.Inserts[j].Name
+	})
+
+	for chainName, hashes := range t.chainToDataplaneHashes {
+		snap.DataplaneHashes[chainName] = append([]string(nil), hashes...)
+	}
+
+	snap.QuarantinedChains = make([]QuarantinedChain, 0, len(t.quarantinedChains))
+	for _, qc := range t.quarantinedChains {
+		snap.QuarantinedChains = append(snap.QuarantinedChains, *qc)
+	}
+	sort.Slice(snap.QuarantinedChains, func(i, j int) bool {
+		return snap.QuarantinedChains[i].Name < snap.QuarantinedChains[j].Name
+	})
+
+	return snap
+}
+
+func (t *Table) snapshotChain(chainName string, rules []Rule, hashes []string, features *Features) ChainSnapshot {
+	snap := ChainSnapshot{
+		Name:   chainName,
+		Rules:  make([]string, len(rules)),
+		Hashes: append([]string{}, hashes...),
+	}
+	for i, rule := range rules {
+		snap.Rules[i] = t.renderer.RenderAppend(rule, chainName, t.commentFrag(hashes[i]), features)
+	}
+	return snap
+}
+
+func sortedStrings(s set.Set) []string {
+	strs := make([]string, 0, s.Len())
+	s.Iter(func(item interface{}) error {
+		strs = append(strs, item.(string))
+		return nil
+	})
+	sort.Strings(strs)
+	return strs
+}
@@ -0,0 +1,89 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables_test
+
+import (
+	"encoding/json"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/projectcalico/felix/iptables"
+)
+
+var _ = Describe("Table snapshot", func() {
+	var dataplane *mockDataplane
+	var table *Table
+
+	BeforeEach(func() {
+		dataplane = newMockDataplane("filter", map[string][]string{
+			"FORWARD": {"-j other-rule"},
+		})
+		table = dataplane.newTable(nil)
+		table.UpdateChain(&Chain{Name: "cali-b", Rules: []Rule{{Action: DropAction{}}}})
+		table.UpdateChain(&Chain{Name: "cali-a", Rules: []Rule{{Action: AcceptAction{}}}})
+		table.SetRuleInsertions("FORWARD", []Rule{{Action: JumpAction{Target: "cali-a"}}})
+	})
+
+	It("should show the dirty state before the first Apply()", func() {
+		snap := table.Snapshot()
+		Expect(snap.Name).To(Equal("filter"))
+		Expect(snap.IPVersion).To(Equal(uint8(4)))
+		Expect(snap.InSync).To(BeFalse())
+		Expect(snap.DirtyChains).To(Equal([]string{"cali-a", "cali-b"}))
+		Expect(snap.DirtyInserts).To(ContainElement("FORWARD"))
+	})
+
+	Describe("after Apply()", func() {
+		BeforeEach(func() {
+			table.Apply()
+		})
+
+		It("should show the desired and dataplane state", func() {
+			snap := table.Snapshot()
+			Expect(snap.InSync).To(BeTrue())
+			Expect(snap.DirtyChains).To(BeEmpty())
+			Expect(snap.DirtyInserts).To(BeEmpty())
+
+			Expect(snap.Chains).To(HaveLen(2))
+			Expect(snap.Chains[0].Name).To(Equal("cali-a"))
+			Expect(snap.Chains[0].Rules).To(Equal([]string{"-A cali-a " + dataplane.Chains["cali-a"][0]}))
+			Expect(snap.Chains[1].Name).To(Equal("cali-b"))
+			Expect(snap.Chains[1].Rules).To(Equal([]string{"-A cali-b " + dataplane.Chains["cali-b"][0]}))
+
+			Expect(snap.Inserts).NotTo(BeEmpty())
+			Expect(snap.Inserts[0].Name).To(Equal("FORWARD"))
+			Expect(snap.Inserts[0].Rules[0]).To(Equal("-A FORWARD " + dataplane.Chains["FORWARD"][0]))
+			Expect(snap.DataplaneHashes["FORWARD"]).To(Equal([]string{snap.Inserts[0].Hashes[0], ""}))
+			Expect(snap.DataplaneHashes["cali-a"]).To(Equal(snap.Chains[0].Hashes))
+		})
+
+		It("should not share state with the table", func() {
+			snap := table.Snapshot()
+			snap.DataplaneHashes["cali-a"][0] = "modified"
+			snap.Chains[0].Hashes[0] = "modified"
+			Expect(table.Snapshot().DataplaneHashes["cali-a"][0]).NotTo(Equal("modified"))
+			Expect(table.Snapshot().Chains[0].Hashes[0]).NotTo(Equal("modified"))
+		})
+
+		It("should serialise to JSON", func() {
+			data, err := json.Marshal(table.Snapshot())
+			Expect(err).NotTo(HaveOccurred())
+			var decoded TableSnapshot
+			Expect(json.Unmarshal(data, &decoded)).To(Succeed())
+			Expect(decoded.Chains).To(Equal(table.Snapshot().Chains))
+		})
+	})
+})
@@ -17,8 +17,10 @@ package iptables
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"fmt"
 	"io"
+	"math/rand"
 	"os/exec"
 	"reflect"
 	"regexp"
@@ -29,12 +31,20 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
 
+	"github.com/projectcalico/felix/throttle"
 	"github.com/projectcalico/libcalico-go/lib/set"
 )
 
 const (
 	MaxChainNameLength   = 28
 	minPostWriteInterval = 50 * time.Millisecond
+
+	defaultPostWriteMaxInterval   = 1 * time.Hour
+	defaultPostWriteBackoffFactor = 2.0
+	minPostWriteBackoffFactor     = 1.1
+
+	defaultApplyRetries   = 10
+	defaultInitialBackoff = 1 * time.Millisecond
 )
 
 var (
@@ -47,8 +57,11 @@ var (
 	}
 
 	// chainCreateRegexp matches iptables-save output lines for chain forward reference lines.
-	// It captures the name of the chain.
-	chainCreateRegexp = regexp.MustCompile(`^:(\S+)`)
+	// It captures the name of the chain and its policy ("-" for chains that aren't kernel chains).
+	chainCreateRegexp = regexp.MustCompile(`^:(\S+)(?: (\S+))?`)
+	// listChainRegexp matches the lines with which "iptables -S" declares chains: "-N chain" for
+	// our chains and "-P chain policy" for kernel chains.
+	listChainRegexp = regexp.MustCompile(`^-[NP] (\S+)(?: (\S+))?`)
 	// appendRegexp matches an iptables-save output line for an append operation.
 	appendRegexp = regexp.MustCompile(`^-A (\S+)`)
 
@@ -69,6 +82,18 @@ var (
 		Name: "felix_iptables_save_errors",
 		Help: "Number of iptables-save errors.",
 	})
+	countNumVerifyFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "felix_iptables_verify_failures",
+		Help: "Number of successful iptables-restore calls that didn't result in the expected rules.",
+	})
+	countNumRestorePreflightFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "felix_iptables_restore_preflight_failures",
+		Help: "Number of updates rejected by iptables-restore --test.",
+	})
+	countNumRuleTextMismatches = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "felix_iptables_rule_text_mismatches",
+		Help: "Number of our rules found to have been modified in place by strict verification.",
+	})
 	gaugeNumChains = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "felix_iptables_chains",
 		Help: "Number of active iptables chains.",
@@ -77,10 +102,22 @@ var (
 		Name: "felix_iptables_rules",
 		Help: "Number of active iptables rules.",
 	}, []string{"ip_version", "table"})
+	gaugeNumQuarantined = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "felix_iptables_quarantined_chains",
+		Help: "Number of iptables chains that are not being programmed due to repeated failures.",
+	}, []string{"ip_version", "table"})
+	countNumTamperDetected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "felix_iptables_tamper_detected",
+		Help: "Number of times that the tamper canary rule was found to be missing from a chain.",
+	}, []string{"ip_version", "table"})
 	countNumLinesExecuted = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "felix_iptables_lines_executed",
 		Help: "Number of iptables rule updates executed.",
 	}, []string{"ip_version", "table"})
+	countNumDeferredInvalidations = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "felix_iptables_deferred_invalidations",
+		Help: "Number of dataplane cache invalidations deferred by the rate limit.",
+	})
 )
 
 func init() {
@@ -88,9 +125,15 @@ func init() {
 	prometheus.MustRegister(countNumRestoreErrors)
 	prometheus.MustRegister(countNumSaveCalls)
 	prometheus.MustRegister(countNumSaveErrors)
+	prometheus.MustRegister(countNumVerifyFailures)
+	prometheus.MustRegister(countNumRestorePreflightFailures)
+	prometheus.MustRegister(countNumRuleTextMismatches)
 	prometheus.MustRegister(gaugeNumChains)
 	prometheus.MustRegister(gaugeNumRules)
+	prometheus.MustRegister(gaugeNumQuarantined)
+	prometheus.MustRegister(countNumTamperDetected)
 	prometheus.MustRegister(countNumLinesExecuted)
+	prometheus.MustRegister(countNumDeferredInvalidations)
 }
 
 // Table represents a single one of the iptables tables i.e. "raw", "nat", "filter", etc.  It
@@ -175,21 +218,49 @@ func init() {
 //
 // Thread safety
 //
-// Table doesn't do any internal synchronization, its methods should only be called from one
-// thread.  To avoid conflicts in the dataplane itself, there should only be one instance of
-// Table for each iptable table in an application.
+// By default, Table doesn't do any internal synchronization, its methods should only be called
+// from one thread.  If TableOptions.ThreadSafe is set, each of its exported methods holds an
+// internal mutex so that several goroutines can drive the same Table.  To avoid conflicts in the
+// dataplane itself, there should only be one instance of Table for each iptable table in an
+// application.
 type Table struct {
 	Name      string
 	IPVersion uint8
 
 	// featureDetector detects the features of the dataplane.
 	featureDetector *FeatureDetector
+	// renderer converts our Rule model into iptables-restore syntax.
+	renderer Renderer
 
 	// chainToInsertedRules maps from chain name to a list of rules to be inserted at the start
 	// of that chain.  Rules are written with rule hash comments.  The Table cleans up inserted
 	// rules with unknown hashes.
 	chainToInsertedRules map[string][]Rule
 	dirtyInserts         set.Set
+	// chainToRequestedInserts holds the rules passed to SetRuleInsertions, before we add our
+	// trace rules and tamper canary to make chainToInsertedRules.
+	chainToRequestedInserts map[string][]Rule
+	// chainToTraceRules holds the rules passed to SetTraceRules.
+	chainToTraceRules map[string][]Rule
+	// chainToInsertPosition maps from chain name to the position, counted in non-Calico rules,
+	// at which our inserted rules should be placed.  Chains without an entry follow the
+	// insertMode.
+	chainToInsertPosition map[string]int
+	// chainToInsertAnchor maps from chain name to the anchor rule that our inserted rules should
+	// be placed next to; see insert_anchor.go.  chainToDataplaneForeignRules holds the text of
+	// the non-Calico rules in those chains, as read by the last iptables-save.
+	chainToInsertAnchor          map[string]*insertAnchor
+	chainToDataplaneForeignRules map[string][]string
+	// chainToPolicy maps from kernel chain name to the default policy that we've been asked to
+	// maintain for that chain.  Chains without an entry are left alone.
+	chainToPolicy map[string]string
+	dirtyPolicies set.Set
+	// unmanagedChains contains the kernel chains that we've been told to leave alone; see
+	// TableOptions.UnmanagedChains.
+	unmanagedChains map[string]bool
+	// missingHookChains contains the non-kernel chains that we have inserts for but that don't
+	// exist in the dataplane; see hook_chains.go.
+	missingHookChains map[string]bool
 
 	// chainToRuleFragments contains the desired state of our iptables chains, indexed by
 	// chain name.  The values are slices of iptables fragments, such as
@@ -199,26 +270,60 @@ type Table struct {
 	dirtyChains      set.Set
 
 	inSyncWithDataPlane bool
+	// preloadedHashes, if non-nil, holds the hashes from an iptables-save that a TableSet did
+	// on our behalf.  The next dataplane load uses them instead of running iptables-save.
+	preloadedHashes map[string][]string
 
 	// chainToDataplaneHashes contains the rule hashes that we think are in the dataplane.
 	// it is updated when we write to the dataplane but it can also be read back and compared
 	// to what we calculate from chainToContents.
 	chainToDataplaneHashes map[string][]string
+	// chainToDataplanePolicy contains the kernel chain policies that we think are in the
+	// dataplane, as read by the last iptables-save or written by us.
+	chainToDataplanePolicy map[string]string
+
+	// chainToRuleHashes caches the rule hashes of the chains in chainNameToChain, as calculated
+	// with ruleHashesFeatures.  Entries are removed when their chain changes.
+	chainToRuleHashes  map[string][]string
+	ruleHashesFeatures *Features
 
 	// hashCommentPrefix holds the prefix that we prepend to our rule-tracking hashes.
 	hashCommentPrefix string
-	// hashCommentRegexp matches the rule-tracking comment, capturing the rule hash.
+	// hashCommentRegexp matches the rule-tracking comment with our primary or one of our
+	// secondary or retired prefixes, capturing the prefix and the rule hash.
 	hashCommentRegexp *regexp.Regexp
+	// secondaryHashPrefixes holds the SecondaryHashPrefixes option.
+	secondaryHashPrefixes []string
+	// retiredHashPrefixes holds the prefixes that we used to write and still recognise; see
+	// hash_prefix.go.  retiredHashPrefixCounts counts the rules that carry each of them, as
+	// found by the last read of the dataplane.
+	retiredHashPrefixes     map[string]bool
+	retiredHashPrefixCounts map[string]int
+	// hashFormat is the format of the rule hashes that we write.
+	hashFormat HashFormat
+	// compat lists the chain name prefixes and inserted rules that we clean up; see compat.go.
+	// ourChainsRegexp and oldInsertRegexp are calculated from it.
+	compat *CompatTable
 	// ourChainsRegexp matches the names of chains that are "ours", i.e. start with one of our
 	// prefixes.
 	ourChainsRegexp *regexp.Regexp
 	// oldInsertRegexp matches inserted rules from old pre rule-hash versions of felix.
 	oldInsertRegexp *regexp.Regexp
 
+	// backendMode is the iptables backend that we're programming, BackendLegacy or BackendNFT.
+	backendMode string
 	// nftablesMode should be set to true if iptables is using the nftables backend.
 	nftablesMode       bool
 	iptablesRestoreCmd string
 	iptablesSaveCmd    string
+	iptablesCmd        string
+	// restorePerRule and saveByListing are set if we couldn't find iptables-restore or
+	// iptables-save, respectively, and we're using the iptables binary instead.  See
+	// per_rule.go.
+	restorePerRule bool
+	saveByListing  bool
+	// oldBackend is set after SwitchBackend() until we've cleaned up the old backend.
+	oldBackend *backendBinaries
 
 	// insertMode is either "insert" or "append"; whether we insert our rules or append them
 	// to top-level chains.
@@ -230,22 +335,147 @@ type Table struct {
 	lastWriteTime            time.Time
 	initialPostWriteInterval time.Duration
 	postWriteInterval        time.Duration
-	refreshInterval          time.Duration
+	// postWriteMaxInterval and postWriteBackoffFactor control the post-write check
+	// schedule; see TableOptions.
+	postWriteMaxInterval   time.Duration
+	postWriteBackoffFactor float64
+	refreshInterval        time.Duration
 
 	// calicoXtablesLock, if enabled, our implementation of the xtables lock.
 	calicoXtablesLock sync.Locker
 
+	// tracer receives a span for each apply cycle; see TableOptions.Tracer.
+	tracer Tracer
+
+	// opLock is held by each of our exported methods; it's a no-op unless
+	// TableOptions.ThreadSafe is set.
+	opLock sync.Locker
+
 	// lockTimeout is the timeout used for iptables-restore's native xtables lock implementation.
 	lockTimeout time.Duration
 	// lockTimeout is the lock probe interval used for iptables-restore's native xtables lock
 	// implementation.
 	lockProbeInterval time.Duration
 
+	// panicOnFailure is set if we should panic, rather than return an error, when we fail to
+	// read or program the dataplane after retries.
+	panicOnFailure bool
+	// verifyAfterWrite is set if we should re-read the table after each successful write.
+	verifyAfterWrite bool
+	// strictVerify is set if we should compare the text of our rules as well as their hashes;
+	// see rule_text.go.
+	strictVerify bool
+	// dataplaneRuleText holds the text of the rules in our chains, as read by the last
+	// iptables-save.  Only populated if strictVerify is set.
+	dataplaneRuleText map[string][]string
+	// preserveCounters is set if we should carry the counters of our rules over when we
+	// rewrite them; see counters.go.  restoreCounters is set while we're writing an update
+	// that includes counters.
+	preserveCounters bool
+	restoreCounters  bool
+	// lastApplyResult accumulates the statistics of the current, or most recent, apply; see
+	// apply_result.go.
+	lastApplyResult ApplyResult
+	// maxRulesPerChain, if non-zero, is the length above which we split our chains into linked
+	// sub-chains; see chain_split.go.  chainToSubChains maps from the name of each split chain
+	// to the names of its sub-chains, in order.
+	maxRulesPerChain int
+	chainToSubChains map[string][]string
+	// chainRenames maps from the dataplane name of each chain that has been renamed since the
+	// last update to its new name; see chain_rename.go.
+	chainRenames map[string]string
+	// ruleTextBaseline maps from rule hash to the canonicalised text that we've accepted for
+	// that rule despite it differing from what we render.
+	ruleTextBaseline map[string]string
+	// ruleTextRewritten contains the hashes of rules that we've rewritten because their text
+	// differed.
+	ruleTextRewritten map[string]bool
+
+	// quarantineThreshold is the number of restore failures attributed to one of our chains
+	// after which we stop trying to program it; 0 disables quarantining.
+	quarantineThreshold int
+	// chainToRestoreFailures counts the restore failures attributed to each chain since the
+	// last successful restore.
+	chainToRestoreFailures map[string]int
+	// quarantinedChains contains the chains that we've given up on programming.
+	quarantinedChains map[string]*QuarantinedChain
+
+	// tamperDetection is set if we append a canary rule to our inserted rules and report its
+	// disappearance.
+	tamperDetection  bool
+	onTamperDetected func(TamperEvent)
+
+	// onOutOfSync, if non-nil, is called when a resync finds that a chain has been modified
+	// by another process.
+	onOutOfSync func(chainName string, reason string)
+
+	// auditSink, if non-nil, is told about each write to the dataplane.
+	auditSink AuditSink
+
+	// maxLinesPerRestore is the soft limit on the size of each iptables-restore invocation;
+	// see TableOptions.MaxLinesPerRestore.
+	maxLinesPerRestore int
+
+	// streamRestoreInput is set if we stream our input to iptables-restore rather than
+	// buffering it; see TableOptions.StreamRestoreInput.
+	streamRestoreInput bool
+
+	// restorePreflight is set if we run each update through "iptables-restore --test" before
+	// committing it; see TableOptions.RestorePreflight.  Cleared if --test isn't supported.
+	restorePreflight bool
+
+	// foreignTailChainsRegexp matches the names of our chains that may end with rules that
+	// aren't ours; nil if there are none.  See TableOptions.ForeignTailChainPrefixes.
+	foreignTailChainsRegexp *regexp.Regexp
+	// foreignRulePolicy is what we do with other foreign rules in our chains.  See
+	// TableOptions.ForeignRulePolicy.
+	foreignRulePolicy ForeignRulePolicy
+
+	// unknownChainGracePeriod is the time for which we leave a chain that looks like ours, but
+	// that we don't want, before deleting it; see TableOptions.UnknownChainGracePeriod.
+	unknownChainGracePeriod time.Duration
+	// unknownChainFirstSeen contains the chains that we're leaving in place during their grace
+	// period, mapped to the time that we first found each one.
+	unknownChainFirstSeen map[string]time.Time
+	// keepUnknownChains, if set, stops us from removing unknown chains at all; see
+	// KeepUnknownChains.
+	keepUnknownChains bool
+
+	// insertOwner, if non-nil, decides whether we program our inserts; see
+	// TableOptions.InsertOwner.  ownsInserts is the result of the last check.
+	insertOwner InsertOwner
+	ownsInserts bool
+
+	// coalesceWindow is the time for which Apply() holds back updates so that they can be
+	// batched; see TableOptions.CoalesceWindow.
+	coalesceWindow time.Duration
+	// updatesPending is true if there are updates that haven't been applied yet, in which case
+	// firstPendingUpdateTime is the time of the oldest one.  Only maintained if coalesceWindow
+	// is set.
+	updatesPending         bool
+	firstPendingUpdateTime time.Time
+
+	// invalidationThrottle, if non-nil, limits the invalidations that callers cause; see
+	// TableOptions.InvalidationBurst and invalidation_limit.go.
+	invalidationThrottle       *throttle.Throttle
+	invalidationBurst          int
+	invalidationRefillInterval time.Duration
+	lastInvalidationRefill     time.Time
+	// deferredInvalidation holds the reason for an invalidation that the throttle held back,
+	// or "" if there isn't one.
+	deferredInvalidation string
+
+	// Retry policy for Apply().  See the corresponding fields in TableOptions.
+	applyRetries     int
+	initialBackoff   time.Duration
+	maxBackoff       time.Duration
+	backoffMaxJitter time.Duration
+
 	logCxt *log.Entry
 
-	gaugeNumChains        prometheus.Gauge
-	gaugeNumRules         prometheus.Gauge
-	countNumLinesExecuted prometheus.Counter
+	// metrics receives our metric updates; our Prometheus metrics unless overridden by
+	// TableOptions.MetricsRecorder.
+	metrics MetricsRecorder
 
 	// Reusable buffer for writing to iptables.
 	restoreInputBuffer RestoreInputBuilder
@@ -253,25 +483,230 @@ type Table struct {
 	// Factory for making commands, used by UTs to shim exec.Command().
 	newCmd cmdFactory
 	// Shims for time.XXX functions:
-	timeSleep func(d time.Duration)
+	timeSleep func(ctx context.Context, d time.Duration) error
 	timeNow   func() time.Time
 	// lookPath is a shim for exec.LookPath.
 	lookPath func(file string) (string, error)
 }
 
 type TableOptions struct {
-	HistoricChainPrefixes    []string
+	// CompatTable lists the chain name prefixes that we use, or have used, and the rules that
+	// previous versions inserted, so that we can clean them up.  If nil, it is built from
+	// HistoricChainPrefixes instead.  More entries can be added at runtime with
+	// Table.RegisterLegacyChainPrefix() and Table.RegisterLegacyRule().
+	CompatTable *CompatTable
+	// HistoricChainPrefixes is the flat list of our chain name prefixes that was used before
+	// CompatTable.  Deprecated: ignored if CompatTable is set.
+	HistoricChainPrefixes []string
+	// ExtraCleanupRegexPattern matches extra rules to clean up in this table.  Deprecated: use
+	// a LegacyRule in CompatTable instead.
 	ExtraCleanupRegexPattern string
 	BackendMode              string
 	InsertMode               string
 	RefreshInterval          time.Duration
-	PostWriteInterval        time.Duration
+	// PostWriteInterval is the delay, after each write, before we first re-read the dataplane
+	// to check that another process hasn't clobbered our update.  Subsequent checks follow at
+	// intervals that grow by PostWriteBackoffFactor until they reach PostWriteMaxInterval.
+	PostWriteInterval time.Duration
+	// PostWriteMaxInterval, if non-zero, overrides the interval, by default one hour, at which
+	// we stop doing post-write checks.
+	PostWriteMaxInterval time.Duration
+	// PostWriteBackoffFactor, if non-zero, overrides the factor, by default 2, by which the
+	// interval between post-write checks grows.  It must be at least 1.1.
+	PostWriteBackoffFactor float64
+	// DisablePostWriteChecks disables the post-write checks altogether, leaving only the
+	// periodic refresh (see RefreshInterval) to detect interference from other processes.
+	DisablePostWriteChecks bool
 
 	// LockTimeout is the timeout to use for iptables-restore's native xtables lock.
 	LockTimeout time.Duration
 	// LockProbeInterval is the probe interval to use for iptables-restore's native xtables lock.
 	LockProbeInterval time.Duration
 
+	// ReturnErrorOnFailure, if set, stops Apply() and ApplyContext() from panicking if they fail
+	// to update the dataplane after retries.  Instead, ApplyContext() returns an *ApplyError,
+	// leaving the updates queued for the next attempt.
+	ReturnErrorOnFailure bool
+	// VerifyAfterWrite, if set, causes the Table to re-read the dataplane after each successful
+	// iptables-restore and check that the updated chains contain the expected rules.  A
+	// mismatch is counted, logged and treated as a failed write (so it is retried).
+	VerifyAfterWrite bool
+	// StrictVerify, if set, causes the Table to compare the full text of the rules in our
+	// chains with the rules that we'd render, each time it loads the dataplane.  This catches
+	// rules that have been modified in place with their hash comment left intact.  Such rules
+	// are counted, logged and rewritten.  It costs extra memory and CPU on each load.
+	StrictVerify bool
+	// PreserveCounters, if set, causes the Table to read the packet and byte counters of our
+	// rules before an update that rewrites whole chains (as we do in nftables mode) or
+	// re-inserts our rules into a kernel chain, and to restore them on the rewritten rules.
+	// Otherwise, such rewrites zero the counters.  It costs an extra iptables-save.
+	PreserveCounters bool
+
+	// MaxRulesPerChain, if non-zero, limits the number of rules in each of our chains.  Longer
+	// chains are split into a chain of that length that ends with a goto to a sub-chain
+	// containing the next rules, and so on.  The sub-chains are named after the chain with a
+	// "-s<n>" suffix (truncating the name if needed).  The split is transparent to callers
+	// and packets get the same verdict.  A limit of 1 is treated as 2, to leave room for the
+	// goto.
+	MaxRulesPerChain int
+
+	// QuarantineThreshold, if non-zero, enables per-chain quarantining: once this many
+	// iptables-restore failures have been traced to one of our chains, the Table stops
+	// programming that chain (leaving whatever version is in the dataplane, or an empty chain)
+	// so that it doesn't block updates to all the other chains.  The chain is released when it
+	// is updated with different rules or removed.  See QuarantinedChains().
+	QuarantineThreshold int
+
+	// TamperDetection, if set, appends a canary rule, which never matches any packets, to each
+	// block of rules that we insert into a kernel chain.  If a resync finds that the canary has
+	// disappeared since our last write, the Table increments the felix_iptables_tamper_detected
+	// counter, logs an error and calls OnTamperDetected (if set) before repairing the chain.
+	TamperDetection bool
+	// OnTamperDetected is called from Apply() when tampering is detected.
+	OnTamperDetected func(TamperEvent)
+
+	// OnOutOfSync, if non-nil, is called from Apply() whenever a resync finds that another
+	// process has modified one of our chains, or our inserts in a kernel chain, and marks it
+	// for repair.  The reason is one of the OutOfSync... constants.  It's intended for
+	// identifying other agents that keep fighting with us over the dataplane.
+	OnOutOfSync func(chainName string, reason string)
+
+	// AuditSink, if non-nil, is passed an AuditEvent describing the rules and chains that we
+	// added and removed after each successful write to the dataplane.
+	AuditSink AuditSink
+
+	// MaxLinesPerRestore, if non-zero, limits the size of each iptables-restore invocation:
+	// large updates are split into chunks of roughly this many lines, each of which is passed to
+	// its own iptables-restore.  Chunks are ordered so that chains are created before they are
+	// referenced and are only deleted once they are no longer referenced.  However, the update
+	// is no longer atomic: if a later chunk fails, the earlier chunks remain in place until the
+	// retry.  The updates to a single chain are never split so a chunk may exceed the limit by
+	// one chain's worth of lines.  Ignored if StreamRestoreInput is set.
+	MaxLinesPerRestore int
+
+	// StreamRestoreInput, if true, streams the input to iptables-restore through a pipe as it is
+	// generated, rather than building the whole input in memory first.  This avoids large
+	// allocations on hosts with very many rules but it means that the input isn't available to
+	// log, or to include in the returned error, if iptables-restore fails.
+	StreamRestoreInput bool
+
+	// RestorePreflight, if true, runs each update through "iptables-restore --test" before
+	// committing it, and only commits if the test passes.  This avoids partially-applied
+	// updates when a rule fragment is malformed, at the cost of running iptables-restore twice.
+	// If iptables-restore doesn't support --test, we fall back to committing directly.
+	// Ignored if StreamRestoreInput is set.
+	RestorePreflight bool
+
+	// UnknownChainGracePeriod, if non-zero, delays the cleanup of chains that match
+	// HistoricChainPrefixes but that we haven't been asked to program: such a chain is only
+	// deleted once it has been in the dataplane, without us being asked to program it, for this
+	// long.  This avoids deleting the chains of a newer Felix that is taking over from us, for
+	// example, during an upgrade.  Chains that we programmed ourselves and that are then
+	// removed are still deleted immediately.
+	UnknownChainGracePeriod time.Duration
+
+	// ForeignTailChainPrefixes lists the prefixes of our chains that other processes are
+	// allowed to append rules to, for example, debugging or vendor rules.  Rules without one
+	// of our hashes at the end of such a chain are left in place and ignored when comparing
+	// the chain with what we want to program; new rules are inserted before them.  Rules
+	// elsewhere in the chain are still replaced.
+	ForeignTailChainPrefixes []string
+
+	// ForeignRulePolicy controls what we do with other rules without one of our hashes that
+	// we find in our chains, for example, temporary debugging rules that someone has added by
+	// hand.  By default (ForeignRulesRewrite), we rewrite the chain, removing them.
+	ForeignRulePolicy ForeignRulePolicy
+
+	// UnmanagedChains lists kernel chains, as "<table>/<chain>" (for example,
+	// "mangle/POSTROUTING"), that are owned by another agent.  The Table leaves them alone
+	// entirely: it doesn't insert rules into them and it doesn't clean up rules in them that
+	// look like ours.  Entries for other tables are ignored so the same list can be passed to
+	// every Table.
+	UnmanagedChains []string
+
+	// HookChains lists chains owned by other programs, as "<table>/<chain>" (for example,
+	// "filter/DOCKER-USER"), that we may insert rules into with SetRuleInsertions.  Like the
+	// kernel chains, they're tracked from the start so that inserts left over from a previous
+	// run are cleaned up.  Inserts into any non-kernel chain, listed or not, are held back
+	// while the chain doesn't exist and programmed once it appears.
+	HookChains []string
+
+	// InsertOwner, if non-nil, is consulted on each Apply() to decide whether we own the rules
+	// inserted into the kernel chains (see SetRuleInsertions).  While we don't, our inserts are
+	// neither programmed nor repaired, but any that are already in place are left for the new
+	// owner to take over.  When we regain ownership, we re-read the dataplane and reprogram
+	// them.  Our own chains are programmed as normal either way.
+	InsertOwner InsertOwner
+
+	// HashFormat controls the algorithm, salt, length and alphabet of the rule hashes that we
+	// write into the rule comments, for example, to shorten them for tools that truncate
+	// comments, or to lengthen them in very large clusters.  The zero value means
+	// DefaultHashFormat.  Lengths that would give less than MinHashEntropyBits of entropy are
+	// rounded up.  Rules with hashes in any supported format are recognised as ours, so changing
+	// the format rewrites our rules rather than leaving the old ones behind.
+	HashFormat HashFormat
+
+	// SecondaryHashPrefixes lists hash comment prefixes, in addition to the one passed to
+	// NewTable, that mark rules as ours, for example, the prefix used by the Felix that we're
+	// taking over from.  We never write them; rules that carry one are treated as out-of-date
+	// rules of ours and are replaced or removed.  Rules with any other prefix are left alone,
+	// so agents that share a table but use different prefixes don't remove each other's
+	// inserts.
+	SecondaryHashPrefixes []string
+	// RetiredHashPrefixes lists hash comment prefixes that we used to write, for example, the
+	// default prefix after a deployment configures its own.  Like SecondaryHashPrefixes, rules
+	// that carry one are replaced or removed but, once a read of the dataplane finds no such
+	// rules, we stop recognising the prefix.  The prefix can also be changed while we're
+	// running; see Tuning.HashCommentPrefix.
+	RetiredHashPrefixes []string
+
+	// CoalesceWindow, if non-zero, enables coalescing of updates: Apply() doesn't write
+	// anything until this long after the first update (UpdateChain, SetRuleInsertions, etc.)
+	// that is still pending, so that a burst of updates is written in a single
+	// iptables-restore.  While it is holding back updates, Apply() returns the remaining time
+	// as its reschedule time.  Flush() writes pending updates immediately.
+	CoalesceWindow time.Duration
+
+	// InvalidationBurst and InvalidationRefillInterval, if both non-zero, rate limit the
+	// re-reads of the dataplane that callers cause, either by calling InvalidateDataplaneCache
+	// or, since we defensively re-read the dataplane before writing an update, by updating our
+	// chains or inserts.  They are limited by a token bucket that holds InvalidationBurst
+	// tokens and gains one every InvalidationRefillInterval.  An invalidation beyond the limit
+	// is deferred: Apply() writes using its cached view of the dataplane and the re-read is
+	// done by the first Apply() after a token becomes available.  The re-reads that the Table
+	// needs for its own correctness, for example, after a failure, aren't limited.
+	InvalidationBurst          int
+	InvalidationRefillInterval time.Duration
+
+	// ThreadSafe, if set, makes the Table safe for use from several goroutines, for example,
+	// separate policy and NAT managers, without an external serialisation loop.  Each exported
+	// method (including those of a TableSet that the Table belongs to) holds an internal mutex
+	// for its duration.  In particular, Apply() holds the mutex while it retries so updates
+	// from other goroutines block until it finishes.  Callbacks, such as OnTamperDetected, are
+	// called with the mutex held so they must not call back into the Table.
+	ThreadSafe bool
+
+	// Tracer, if non-nil, is used to trace each apply cycle, with child spans for loading the
+	// dataplane state, rendering, iptables-restore and waiting for the xtables lock.  See
+	// SpanApply and friends.
+	Tracer Tracer
+
+	// ApplyRetries is the number of times that Apply() retries a failed update before giving
+	// up.  Zero means use the default (10).
+	ApplyRetries int
+	// InitialBackoff is the delay before the first retry; the delay doubles after each
+	// subsequent failure.  Zero means use the default (1ms).
+	InitialBackoff time.Duration
+	// MaxBackoff, if non-zero, caps the delay between retries.
+	MaxBackoff time.Duration
+	// BackoffMaxJitter, if non-zero, adds a random delay of up to this amount to each retry
+	// so that competing writers don't retry in lock-step.
+	BackoffMaxJitter time.Duration
+
+	// MetricsRecorder, if non-nil, receives the Table's metric updates instead of our
+	// Prometheus metrics.  See fake.Metrics for a recorder for use in tests.
+	MetricsRecorder MetricsRecorder
+
 	// NewCmdOverride for tests, if non-nil, factory to use instead of the real exec.Command()
 	NewCmdOverride cmdFactory
 	// SleepOverride for tests, if non-nil, replacement for time.Sleep()
@@ -290,40 +725,59 @@ func NewTable(
 	detector *FeatureDetector,
 	options TableOptions,
 ) *Table {
-	// Calculate the regex used to match the hash comment.  The comment looks like this:
-	// --comment "cali:abcd1234_-".
-	hashCommentRegexp := regexp.MustCompile(`--comment "?` + hashPrefix + `([a-zA-Z0-9_-]+)"?`)
-	ourChainsPattern := "^(" + strings.Join(options.HistoricChainPrefixes, "|") + ")"
-	ourChainsRegexp := regexp.MustCompile(ourChainsPattern)
-
-	oldInsertRegexpParts := []string{}
-	for _, prefix := range options.HistoricChainPrefixes {
-		part := fmt.Sprintf("(?:-j|--jump) %s", prefix)
-		oldInsertRegexpParts = append(oldInsertRegexpParts, part)
+	retiredHashPrefixes := map[string]bool{}
+	for _, prefix := range options.RetiredHashPrefixes {
+		retiredHashPrefixes[prefix] = true
+	}
+	delete(retiredHashPrefixes, hashPrefix)
+	for _, prefix := range options.SecondaryHashPrefixes {
+		delete(retiredHashPrefixes, prefix)
+	}
+	hashFormat := options.HashFormat.withDefaults()
+	if options.HashFormat.Length != 0 && hashFormat.Length != options.HashFormat.Length {
+		log.WithFields(log.Fields{
+			"alphabet":  hashFormat.Alphabet,
+			"algorithm": hashFormat.Algorithm,
+			"setLength": options.HashFormat.Length,
+			"length":    hashFormat.Length,
+		}).Warn("Rule hash length outside the supported range for its alphabet and algorithm, using nearest supported length.")
+	}
+	var compat *CompatTable
+	if options.CompatTable != nil {
+		compat = options.CompatTable.Copy()
+	} else {
+		compat = CompatTableFromPrefixes(options.HistoricChainPrefixes)
 	}
 	if options.ExtraCleanupRegexPattern != "" {
-		oldInsertRegexpParts = append(oldInsertRegexpParts,
-			options.ExtraCleanupRegexPattern)
+		compat.Rules = append(compat.Rules, LegacyRule{
+			Table:   name,
+			Pattern: options.ExtraCleanupRegexPattern,
+		})
 	}
-	oldInsertPattern := strings.Join(oldInsertRegexpParts, "|")
-	oldInsertRegexp := regexp.MustCompile(oldInsertPattern)
+	ourChainsRegexp, oldInsertRegexp := compileCompatRegexps(name, compat)
 
 	// Pre-populate the insert table with empty lists for each kernel chain.  Ensures that we
 	// clean up any chains that we hooked on a previous run.
+	unmanagedChains := unmanagedChainsForTable(name, options.UnmanagedChains)
 	inserts := map[string][]Rule{}
 	dirtyInserts := set.New()
 	for _, kernelChain := range tableToKernelChains[name] {
+		if unmanagedChains[kernelChain] {
+			continue
+		}
 		inserts[kernelChain] = []Rule{}
 		dirtyInserts.Add(kernelChain)
 	}
+	for hookChain := range chainsForTable(name, options.HookChains, "hook chain") {
+		if unmanagedChains[hookChain] {
+			continue
+		}
+		inserts[hookChain] = []Rule{}
+		dirtyInserts.Add(hookChain)
+	}
 
-	var insertMode string
-	switch options.InsertMode {
-	case "", "insert":
-		insertMode = "insert"
-	case "append":
-		insertMode = "append"
-	default:
+	insertMode, err := normaliseInsertMode(options.InsertMode)
+	if err != nil {
 		log.WithField("insertMode", options.InsertMode).Panic("Unknown insert mode")
 	}
 
@@ -334,15 +788,52 @@ func NewTable(
 		}).Info("PostWriteInterval too small, defaulting.")
 		options.PostWriteInterval = minPostWriteInterval
 	}
+	if options.PostWriteMaxInterval == 0 {
+		options.PostWriteMaxInterval = defaultPostWriteMaxInterval
+	}
+	if options.PostWriteBackoffFactor == 0 {
+		options.PostWriteBackoffFactor = defaultPostWriteBackoffFactor
+	} else if options.PostWriteBackoffFactor < minPostWriteBackoffFactor {
+		log.WithFields(log.Fields{
+			"setValue": options.PostWriteBackoffFactor,
+			"default":  defaultPostWriteBackoffFactor,
+		}).Warn("PostWriteBackoffFactor too small, defaulting.")
+		options.PostWriteBackoffFactor = defaultPostWriteBackoffFactor
+	}
+	if options.DisablePostWriteChecks {
+		// A zero interval means no checks.
+		options.PostWriteInterval = 0
+	}
+
+	if options.ApplyRetries < 0 {
+		log.WithField("applyRetries", options.ApplyRetries).Panic("Negative ApplyRetries")
+	}
+	if options.ApplyRetries == 0 {
+		options.ApplyRetries = defaultApplyRetries
+	}
+	if options.InitialBackoff <= 0 {
+		options.InitialBackoff = defaultInitialBackoff
+	}
+	if options.MaxBackoff > 0 && options.MaxBackoff < options.InitialBackoff {
+		log.WithFields(log.Fields{
+			"maxBackoff":     options.MaxBackoff,
+			"initialBackoff": options.InitialBackoff,
+		}).Info("MaxBackoff smaller than InitialBackoff, using InitialBackoff.")
+		options.MaxBackoff = options.InitialBackoff
+	}
 
 	// Allow override of exec.Command() and time.Sleep() for test purposes.
 	newCmd := newRealCmd
 	if options.NewCmdOverride != nil {
 		newCmd = options.NewCmdOverride
 	}
-	sleep := time.Sleep
+	sleep := sleepContext
 	if options.SleepOverride != nil {
-		sleep = options.SleepOverride
+		sleepOverride := options.SleepOverride
+		sleep = func(ctx context.Context, d time.Duration) error {
+			sleepOverride(d)
+			return ctx.Err()
+		}
 	}
 	now := time.Now
 	if options.NowOverride != nil {
@@ -352,6 +843,15 @@ func NewTable(
 	if options.LookPathOverride != nil {
 		lookPath = options.LookPathOverride
 	}
+	var opLock sync.Locker = noopLocker{}
+	if options.ThreadSafe {
+		opLock = &sync.Mutex{}
+	}
+
+	var tracer Tracer = noopTracer{}
+	if options.Tracer != nil {
+		tracer = options.Tracer
+	}
 
 	table := &Table{
 		Name:                   name,
@@ -359,18 +859,29 @@ func NewTable(
 		featureDetector:        detector,
 		chainToInsertedRules:   inserts,
 		dirtyInserts:           dirtyInserts,
+		chainToInsertPosition:  map[string]int{},
+		chainToInsertAnchor:    map[string]*insertAnchor{},
+		chainToPolicy:          map[string]string{},
+		dirtyPolicies:          set.New(),
 		chainNameToChain:       map[string]*Chain{},
 		dirtyChains:            set.New(),
 		chainToDataplaneHashes: map[string][]string{},
+		chainToDataplanePolicy: map[string]string{},
 		logCxt: log.WithFields(log.Fields{
 			"ipVersion": ipVersion,
 			"table":     name,
 		}),
-		hashCommentPrefix: hashPrefix,
-		hashCommentRegexp: hashCommentRegexp,
-		ourChainsRegexp:   ourChainsRegexp,
-		oldInsertRegexp:   oldInsertRegexp,
-		insertMode:        insertMode,
+		hashCommentPrefix:     hashPrefix,
+		secondaryHashPrefixes: options.SecondaryHashPrefixes,
+		retiredHashPrefixes:   retiredHashPrefixes,
+		hashFormat:            hashFormat,
+		compat:                compat,
+		ourChainsRegexp:       ourChainsRegexp,
+		oldInsertRegexp:       oldInsertRegexp,
+		insertMode:            insertMode,
+
+		chainToRequestedInserts: map[string][]Rule{},
+		chainToTraceRules:       map[string][]Rule{},
 
 		// Initialise the write tracking as if we'd just done a write, this will trigger
 		// us to recheck the dataplane at exponentially increasing intervals at startup.
@@ -379,51 +890,119 @@ func NewTable(
 		lastWriteTime:            now(),
 		initialPostWriteInterval: options.PostWriteInterval,
 		postWriteInterval:        options.PostWriteInterval,
+		postWriteMaxInterval:     options.PostWriteMaxInterval,
+		postWriteBackoffFactor:   options.PostWriteBackoffFactor,
 
 		refreshInterval: options.RefreshInterval,
 
 		calicoXtablesLock: iptablesWriteLock,
+		tracer:            tracer,
+		opLock:            opLock,
 
 		lockTimeout:       options.LockTimeout,
 		lockProbeInterval: options.LockProbeInterval,
 
+		panicOnFailure:   !options.ReturnErrorOnFailure,
+		verifyAfterWrite: options.VerifyAfterWrite,
+		strictVerify:     options.StrictVerify,
+		preserveCounters: options.PreserveCounters,
+		maxRulesPerChain: options.MaxRulesPerChain,
+		chainToSubChains: map[string][]string{},
+		chainRenames:     map[string]string{},
+
+		dataplaneRuleText: map[string][]string{},
+		ruleTextBaseline:  map[string]string{},
+		ruleTextRewritten: map[string]bool{},
+
+		quarantineThreshold:    options.QuarantineThreshold,
+		chainToRestoreFailures: map[string]int{},
+		quarantinedChains:      map[string]*QuarantinedChain{},
+
+		tamperDetection:  options.TamperDetection,
+		onTamperDetected: options.OnTamperDetected,
+		onOutOfSync:      options.OnOutOfSync,
+		auditSink:        options.AuditSink,
+
+		foreignTailChainsRegexp: foreignTailChainsRegexp(options.ForeignTailChainPrefixes),
+		foreignRulePolicy:       options.ForeignRulePolicy,
+		unmanagedChains:         unmanagedChains,
+		missingHookChains:       map[string]bool{},
+
+		unknownChainGracePeriod: options.UnknownChainGracePeriod,
+		unknownChainFirstSeen:   map[string]time.Time{},
+
+		insertOwner: options.InsertOwner,
+		ownsInserts: true,
+
+		coalesceWindow: options.CoalesceWindow,
+
+		invalidationThrottle:       newInvalidationThrottle(options.InvalidationBurst, options.InvalidationRefillInterval),
+		invalidationBurst:          options.InvalidationBurst,
+		invalidationRefillInterval: options.InvalidationRefillInterval,
+		lastInvalidationRefill:     now(),
+
+		maxLinesPerRestore: options.MaxLinesPerRestore,
+		streamRestoreInput: options.StreamRestoreInput,
+		restorePreflight:   options.RestorePreflight,
+
+		applyRetries:     options.ApplyRetries,
+		initialBackoff:   options.InitialBackoff,
+		maxBackoff:       options.MaxBackoff,
+		backoffMaxJitter: options.BackoffMaxJitter,
+
+		renderer: IptablesRenderer{},
+
 		newCmd:    newCmd,
 		timeSleep: sleep,
 		timeNow:   now,
 		lookPath:  lookPath,
 
-		gaugeNumChains:        gaugeNumChains.WithLabelValues(fmt.Sprintf("%d", ipVersion), name),
-		gaugeNumRules:         gaugeNumRules.WithLabelValues(fmt.Sprintf("%d", ipVersion), name),
-		countNumLinesExecuted: countNumLinesExecuted.WithLabelValues(fmt.Sprintf("%d", ipVersion), name),
+		metrics: options.MetricsRecorder,
 	}
-	table.restoreInputBuffer.NumLinesWritten = table.countNumLinesExecuted
+	if table.metrics == nil {
+		table.metrics = newPrometheusRecorder(ipVersion, name)
+	}
+	table.restoreInputBuffer.NumLinesWritten = metricCounter{table.metrics, MetricLinesExecuted}
+	table.updateHashCommentRegexp()
 
 	iptablesVariant := strings.ToLower(options.BackendMode)
 	if iptablesVariant == "" {
-		iptablesVariant = "legacy"
-	}
-	if iptablesVariant == "nft" {
-		log.Info("Enabling iptables-in-nftables-mode workarounds.")
-		table.nftablesMode = true
+		iptablesVariant = BackendLegacy
 	}
-
-	table.iptablesRestoreCmd = table.findBestBinary(ipVersion, iptablesVariant, "restore")
-	table.iptablesSaveCmd = table.findBestBinary(ipVersion, iptablesVariant, "save")
+	table.setBackendMode(iptablesVariant)
 
 	return table
 }
 
 // findBestBinary tries to find an iptables binary for the specific variant (legacy/nftables mode) and returns the name
 // of the binary.  Falls back on iptables-restore/iptables-save if the specific variant isn't available.
-// Panics if no binary can be found.
+// An empty saveOrRestore finds the main iptables binary.  Panics if no binary can be found.
 func (t *Table) findBestBinary(ipVersion uint8, backendMode, saveOrRestore string) string {
+	cmd, ok := t.lookUpBinary(ipVersion, backendMode, saveOrRestore)
+	if !ok {
+		log.WithFields(log.Fields{
+			"ipVersion":     ipVersion,
+			"backendMode":   backendMode,
+			"saveOrRestore": saveOrRestore,
+		}).Panic("Failed to find iptables command")
+	}
+	return cmd
+}
+
+// lookUpBinary is like findBestBinary but it returns false, rather than panicking, if no binary
+// can be found.
+func (t *Table) lookUpBinary(ipVersion uint8, backendMode, saveOrRestore string) (string, bool) {
 	verInfix := ""
 	if ipVersion == 6 {
 		verInfix = "6"
 	}
+	suffix := ""
+	if saveOrRestore != "" {
+		suffix = "-" + saveOrRestore
+	}
 	candidates := []string{
-		"ip" + verInfix + "tables-" + backendMode + "-" + saveOrRestore,
-		"ip" + verInfix + "tables-" + saveOrRestore,
+		"ip" + verInfix + "tables-" + backendMode + suffix,
+		"ip" + verInfix + "tables" + suffix,
 	}
 
 	logCxt := log.WithFields(log.Fields{
@@ -437,82 +1016,192 @@ func (t *Table) findBestBinary(ipVersion uint8, backendMode, saveOrRestore strin
 		_, err := t.lookPath(candidate)
 		if err == nil {
 			logCxt.WithField("command", candidate).Info("Looked up iptables command")
-			return candidate
+			return candidate, true
 		}
 	}
 
-	logCxt.Panic("Failed to find iptables command")
-	return ""
+	logCxt.Debug("Failed to find iptables command")
+	return "", false
 }
 
 func (t *Table) SetRuleInsertions(chainName string, rules []Rule) {
+	t.opLock.Lock()
+	defer t.opLock.Unlock()
 	t.logCxt.WithField("chainName", chainName).Debug("Updating rule insertions")
+	delete(t.chainToInsertPosition, chainName)
+	delete(t.chainToInsertAnchor, chainName)
+	t.setRuleInsertions(chainName, rules)
+}
+
+// SetRuleInsertionsAt is like SetRuleInsertions but, rather than following the insert mode, it
+// places our rules after the first position non-Calico rules in the chain.  For example,
+// position 1 puts our rules after the first rule of another process (such as kube-proxy's
+// jump) but before any rules that follow it.  If the chain has fewer than position non-Calico
+// rules, our rules are appended.  Resync repairs the position if other processes shift it.
+func (t *Table) SetRuleInsertionsAt(chainName string, position int, rules []Rule) {
+	t.logCxt.WithFields(log.Fields{
+		"chainName": chainName,
+		"position":  position,
+	}).Debug("Updating positional rule insertions")
+	t.opLock.Lock()
+	defer t.opLock.Unlock()
+	if position < 0 {
+		t.logCxt.WithField("position", position).Panic("Negative insert position")
+	}
+	delete(t.chainToInsertAnchor, chainName)
+	t.chainToInsertPosition[chainName] = position
+	t.setRuleInsertions(chainName, rules)
+}
+
+func (t *Table) setRuleInsertions(chainName string, rules []Rule) {
+	t.chainToRequestedInserts[chainName], _ = t.validRules(chainName, rulesForIPVersion(rules, t.IPVersion))
+	t.updateInsertedRules(chainName, "insertion")
+}
+
+// updateInsertedRules recalculates the rules that we insert into the given chain from the
+// requested rules, trace rules and tamper canary, and queues an update.
+func (t *Table) updateInsertedRules(chainName string, reason string) {
+	if t.isUnmanagedChain(chainName) {
+		t.logCxt.WithField("chainName", chainName).Warn("Ignoring rule insertions for unmanaged chain")
+		return
+	}
+	rules := t.withTamperCanary(t.withTraceRules(chainName,
+		rulesForIPVersion(t.chainToRequestedInserts[chainName], t.IPVersion)))
 	oldRules := t.chainToInsertedRules[chainName]
 	t.chainToInsertedRules[chainName] = rules
 	numRulesDelta := len(rules) - len(oldRules)
-	t.gaugeNumRules.Add(float64(numRulesDelta))
+	t.metrics.Add(MetricRules, float64(numRulesDelta))
 	t.dirtyInserts.Add(chainName)
-
-	// Defensive: make sure we re-read the dataplane state before we make updates.  While the
-	// code was originally designed not to need this, we found that other users of
-	// iptables-restore can still clobber out updates so it's safest to re-read the state before
-	// each write.
-	t.InvalidateDataplaneCache("insertion")
+	t.noteUpdate()
+	t.invalidateBeforeWrite(reason)
 }
 
 func (t *Table) UpdateChains(chains []*Chain) {
+	t.opLock.Lock()
+	defer t.opLock.Unlock()
 	for _, chain := range chains {
-		t.UpdateChain(chain)
+		t.updateSplitChain(chain)
 	}
 }
 
 func (t *Table) UpdateChain(chain *Chain) {
+	t.opLock.Lock()
+	defer t.opLock.Unlock()
+	t.updateSplitChain(chain)
+}
+
+func (t *Table) updateChain(chain *Chain) {
 	t.logCxt.WithField("chainName", chain.Name).Info("Queueing update of chain.")
+	chain = chain.ForIPVersion(t.IPVersion)
+	if rules, ok := t.validRules(chain.Name, chain.Rules); !ok {
+		chain = &Chain{
+			Name:  chain.Name,
+			Rules: rules,
+		}
+	}
 	oldNumRules := 0
 	if oldChain := t.chainNameToChain[chain.Name]; oldChain != nil {
 		oldNumRules = len(oldChain.Rules)
 	}
 	t.chainNameToChain[chain.Name] = chain
+	delete(t.chainToRuleHashes, chain.Name)
+	delete(t.unknownChainFirstSeen, chain.Name)
+	t.maybeReleaseQuarantine(chain)
 	numRulesDelta := len(chain.Rules) - oldNumRules
-	t.gaugeNumRules.Add(float64(numRulesDelta))
+	t.metrics.Add(MetricRules, float64(numRulesDelta))
 	t.dirtyChains.Add(chain.Name)
+	t.noteUpdate()
+	t.invalidateBeforeWrite("chain update")
+}
 
-	// Defensive: make sure we re-read the dataplane state before we make updates.  While the
-	// code was originally designed not to need this, we found that other users of
-	// iptables-restore can still clobber out updates so it's safest to re-read the state before
-	// each write.
-	t.InvalidateDataplaneCache("chain update")
+// AppendToChain appends the given rules to an existing chain that was previously passed to
+// UpdateChain.  It avoids the need for the caller to rebuild and re-submit very large chains
+// (such as dispatch chains) for a small addition.  Since rules are diffed against the
+// dataplane by position, only the new rules are written on the next Apply().
+//
+// The Table owns the Chain after UpdateChain() so the appended rules are added to that Chain's
+// Rules slice (or to the Table's copy of it, if UpdateChain dropped rules for the other IP
+// version).  If the chain is, or becomes, too long (see TableOptions.MaxRulesPerChain), it is
+// re-split; only the sub-chains that change are rewritten.  Panics if the chain is unknown.
+func (t *Table) AppendToChain(chainName string, rules []Rule) {
+	t.opLock.Lock()
+	defer t.opLock.Unlock()
+	chain := t.chainNameToChain[chainName]
+	if chain == nil {
+		t.logCxt.WithField("chainName", chainName).Panic("AppendToChain called for unknown chain")
+	}
+	t.logCxt.WithFields(log.Fields{
+		"chainName": chainName,
+		"numRules":  len(rules),
+	}).Debug("Queueing append to chain.")
+	rules, _ = t.validRules(chainName, rulesForIPVersion(rules, t.IPVersion))
+	if limit := t.splitLimit(); limit > 0 && (len(t.chainToSubChains[chainName]) > 0 ||
+		len(chain.Rules)+len(rules) > limit) {
+		t.updateSplitChain(&Chain{Name: chainName, Rules: append(t.unsplitRules(chainName), rules...)})
+		return
+	}
+	chain.Rules = append(chain.Rules, rules...)
+	delete(t.chainToRuleHashes, chainName)
+	t.maybeReleaseQuarantine(chain)
+	t.metrics.Add(MetricRules, float64(len(rules)))
+	t.dirtyChains.Add(chainName)
+	t.noteUpdate()
+	t.invalidateBeforeWrite("chain append")
 }
 
 func (t *Table) RemoveChains(chains []*Chain) {
+	t.opLock.Lock()
+	defer t.opLock.Unlock()
 	for _, chain := range chains {
-		t.RemoveChainByName(chain.Name)
+		t.removeSplitChain(chain.Name)
 	}
 }
 
 func (t *Table) RemoveChainByName(name string) {
+	t.opLock.Lock()
+	defer t.opLock.Unlock()
+	t.removeSplitChain(name)
+}
+
+func (t *Table) removeChainByName(name string) {
 	t.logCxt.WithField("chainName", name).Info("Queing deletion of chain.")
 	if oldChain, known := t.chainNameToChain[name]; known {
-		t.gaugeNumRules.Sub(float64(len(oldChain.Rules)))
+		t.metrics.Add(MetricRules, -float64(len(oldChain.Rules)))
 		delete(t.chainNameToChain, name)
+		delete(t.chainToRuleHashes, name)
 		t.dirtyChains.Add(name)
+		t.noteUpdate()
 	}
+	t.releaseQuarantine(name, "chain removed")
+	t.invalidateBeforeWrite("chain removal")
+}
 
-	// Defensive: make sure we re-read the dataplane state before we make updates.  While the
-	// code was originally designed not to need this, we found that other users of
-	// iptables-restore can still clobber out updates so it's safest to re-read the state before
-	// each write.
-	t.InvalidateDataplaneCache("chain removal")
+// invalidateBeforeWrite is called after queueing an update.  Defensive: make sure we re-read the
+// dataplane state before we make updates.  While the code was originally designed not to need
+// this, we found that other users of iptables-restore can still clobber out updates so it's
+// safest to re-read the state before each write.
+func (t *Table) invalidateBeforeWrite(reason string) {
+	t.requestInvalidation(reason)
 }
 
-func (t *Table) loadDataplaneState() {
+func (t *Table) loadDataplaneState(ctx context.Context) error {
 	// Refresh the cache of feature data.
 	t.featureDetector.RefreshFeatures()
 
 	// Load the hashes from the dataplane.
 	t.logCxt.Info("Loading current iptables state and checking it is correct.")
 	t.lastReadTime = t.timeNow()
-	dataplaneHashes := t.getHashesFromDataplane()
+	dataplaneHashes := t.preloadedHashes
+	t.preloadedHashes = nil
+	if dataplaneHashes != nil {
+		t.logCxt.Debug("Using iptables state that was loaded by the TableSet")
+	} else {
+		var err error
+		dataplaneHashes, err = t.getHashesFromDataplane(ctx)
+		if err != nil {
+			return err
+		}
+	}
 
 	// Check that the rules we think we've programmed are still there and mark any inconsistent
 	// chains for refresh.
@@ -524,6 +1213,15 @@ func (t *Table) loadDataplaneState() {
 			logCxt.Debug("Skipping known-dirty chain")
 			continue
 		}
+		if _, ok := t.unknownChainFirstSeen[chainName]; ok {
+			// Not a chain that we want, we'll recheck its grace period below.
+			logCxt.Debug("Skipping unknown chain")
+			continue
+		}
+		if t.isUnmanagedChain(chainName) {
+			logCxt.Debug("Skipping unmanaged chain")
+			continue
+		}
 		dpHashes := dataplaneHashes[chainName]
 		if !t.ourChainsRegexp.MatchString(chainName) {
 			// Not one of our chains so it may be one that we're inserting rules into.
@@ -543,29 +1241,40 @@ func (t *Table) loadDataplaneState() {
 					logCxt.WithField("actualRuleIDs", dpHashes).Warn(
 						"Chain had unexpected inserts, marking for resync")
 					t.dirtyInserts.Add(chainName)
+					t.reportOutOfSync(chainName, OutOfSyncUnexpectedInserts)
 				}
 				continue
 			}
 
-			// Re-calculate the expected rule insertions based on the current length
-			// of the chain (since other processes may have inserted/removed rules
-			// from the chain, throwing off the numbers).
-			expectedHashes, _ = t.expectedHashesForInsertChain(
-				chainName,
-				numEmptyStrings(dpHashes),
-			)
-			if !reflect.DeepEqual(dpHashes, expectedHashes) {
+			t.checkTamperCanary(chainName, expectedHashes, dpHashes)
+
+			if !t.insertsInSync(chainName, dpHashes) {
+				// Only calculated for the log, based on the current length of the chain
+				// (since other processes may have inserted/removed rules from it).
+				expectedHashes, _ = t.expectedHashesForInsertChain(
+					chainName,
+					numEmptyStrings(dpHashes),
+				)
 				logCxt.WithFields(log.Fields{
 					"expectedRuleIDs": expectedHashes,
 					"actualRuleIDs":   dpHashes,
 				}).Warn("Detected out-of-sync inserts, marking for resync")
 				t.dirtyInserts.Add(chainName)
+				t.reportOutOfSync(chainName, OutOfSyncInsertsModified)
 			}
 		} else {
-			// One of our chains, should match exactly.
-			if !reflect.DeepEqual(dpHashes, expectedHashes) {
+			// One of our chains, should match exactly, apart from any foreign rules that
+			// we leave alone.
+			dpHashes, _ = t.ourRuleHashes(chainName, dpHashes)
+			expectedHashes, _ = t.ourRuleHashes(chainName, expectedHashes)
+			if _, ok := dataplaneHashes[chainName]; !ok {
+				logCxt.Warn("Calico chain missing from the dataplane, marking for recreation")
+				t.dirtyChains.Add(chainName)
+				t.reportOutOfSync(chainName, OutOfSyncChainMissing)
+			} else if !reflect.DeepEqual(dpHashes, expectedHashes) {
 				logCxt.Warn("Detected out-of-sync Calico chain, marking for resync")
 				t.dirtyChains.Add(chainName)
+				t.reportOutOfSync(chainName, OutOfSyncChainModified)
 			}
 		}
 	}
@@ -579,11 +1288,16 @@ func (t *Table) loadDataplaneState() {
 			logCxt.Debug("Skipping known-dirty chain")
 			continue
 		}
-		if _, ok := t.chainToDataplaneHashes[chainName]; ok {
+		_, inGracePeriod := t.unknownChainFirstSeen[chainName]
+		if _, ok := t.chainToDataplaneHashes[chainName]; ok && !inGracePeriod {
 			// Chain expected, we'll have checked its contents above.
 			logCxt.Debug("Skipping expected chain")
 			continue
 		}
+		if t.isUnmanagedChain(chainName) {
+			logCxt.Debug("Skipping unmanaged chain")
+			continue
+		}
 		if !t.ourChainsRegexp.MatchString(chainName) {
 			// Non-calico chain that is not tracked in chainToDataplaneHashes. We
 			// haven't seen the chain before and we haven't been asked to insert
@@ -599,19 +1313,55 @@ func (t *Table) loadDataplaneState() {
 			continue
 		}
 		// Chain exists in dataplane but not in memory, mark as dirty so we'll clean it up.
+		if t.keepUnknownChains {
+			// Track the chain as if it were in its grace period so that we recheck it
+			// once we're allowed to remove it.
+			logCxt.Info("Found unexpected chain, leaving it in place")
+			if _, ok := t.unknownChainFirstSeen[chainName]; !ok {
+				t.unknownChainFirstSeen[chainName] = t.timeNow()
+			}
+			continue
+		}
+		if t.unknownChainGraceRemaining(chainName) > 0 {
+			continue
+		}
+		if legacy, ok := t.legacyChainPrefix(chainName); ok {
+			logCxt = logCxt.WithFields(log.Fields{
+				"legacyPrefix": legacy.Prefix,
+				"versions":     legacy.versions(),
+			})
+		}
 		logCxt.Info("Found unexpected chain, marking for cleanup")
+		delete(t.unknownChainFirstSeen, chainName)
 		t.dirtyChains.Add(chainName)
 	}
+	for chainName := range t.unknownChainFirstSeen {
+		if _, ok := dataplaneHashes[chainName]; !ok {
+			t.logCxt.WithField("chainName", chainName).Debug("Unknown chain has been removed")
+			delete(t.unknownChainFirstSeen, chainName)
+		}
+	}
+
+	t.checkChainPolicies()
+	t.checkHookChains(dataplaneHashes)
+	t.checkForeignRules(dataplaneHashes)
+	if t.strictVerify {
+		t.checkRuleText(dataplaneHashes)
+	}
+
+	t.finishHashPrefixTransitions()
 
 	t.logCxt.Debug("Finished loading iptables state")
 	t.chainToDataplaneHashes = dataplaneHashes
 	t.inSyncWithDataPlane = true
+	return nil
 }
 
 // expectedHashesForInsertChain calculates the expected hashes for a whole top-level chain
 // given our inserts.  If we're in append mode, that consists of numNonCalicoRules empty strings
-// followed by our hashes; in insert mode, the opposite way round.  To avoid recalculation, it
-// returns the rule hashes as a second output.
+// followed by our hashes; in insert mode, the opposite way round.  If the chain has an explicit
+// insert position, or an anchor rule, our hashes follow that many empty strings.  To avoid
+// recalculation, it returns the rule hashes as a second output.
 func (t *Table) expectedHashesForInsertChain(
 	chainName string,
 	numNonCalicoRules int,
@@ -619,32 +1369,100 @@ func (t *Table) expectedHashesForInsertChain(
 	insertedRules := t.chainToInsertedRules[chainName]
 	allHashes = make([]string, len(insertedRules)+numNonCalicoRules)
 	features := t.featureDetector.GetFeatures()
-	ourHashes = calculateRuleInsertHashes(chainName, insertedRules, features)
-	offset := 0
-	if t.insertMode == "append" {
-		log.Debug("In append mode, returning our hashes at end.")
-		offset = numNonCalicoRules
-	}
+	ourHashes = t.calculateRuleInsertHashes(chainName, insertedRules, features)
+	offset := t.insertOffset(chainName, numNonCalicoRules)
 	for i, hash := range ourHashes {
 		allHashes[i+offset] = hash
 	}
 	return
 }
 
+// insertsInSync returns true if the given dataplane hashes of a chain that we insert rules into
+// contain exactly our inserted rules, in order and as one block, somewhere that gives them the
+// right precedence.  Unlike comparing with expectedHashesForInsertChain, it doesn't depend on the
+// number of non-Calico rules in the chain, which changes whenever another process adds or
+// removes its own rules.  So we only rewrite our rules if that has affected them:
+//
+// - in insert mode, our rules must come first;
+// - with an explicit insert position, at least that many non-Calico rules (or all of them, if
+//   there are fewer) must come before ours;
+// - with an anchor rule that's present in the chain, ours must be right next to it;
+// - in append mode, other processes may append their rules after ours.
+//
+// The layout that expectedHashesForInsertChain calculates, and that older versions required,
+// always passes these checks so upgrading doesn't rewrite any rules.
+func (t *Table) insertsInSync(chainName string, dpHashes []string) bool {
+	ourHashes := t.calculateRuleInsertHashes(
+		chainName, t.chainToInsertedRules[chainName], t.featureDetector.GetFeatures())
+	start := -1
+	for i, hash := range dpHashes {
+		if hash != "" {
+			start = i
+			break
+		}
+	}
+	if start < 0 {
+		return len(ourHashes) == 0
+	}
+	end := start + len(ourHashes)
+	if end > len(dpHashes) || !reflect.DeepEqual(dpHashes[start:end], ourHashes) {
+		return false
+	}
+	for _, hash := range dpHashes[end:] {
+		if hash != "" {
+			// More of our rules after the block.
+			return false
+		}
+	}
+	numNonCalicoRules := len(dpHashes) - len(ourHashes)
+	if _, ok := t.anchorPosition(chainName); ok {
+		// Our rules must be right next to the anchor rule.
+		return start == t.insertOffset(chainName, numNonCalicoRules)
+	}
+	if _, ok := t.chainToInsertPosition[chainName]; ok {
+		return start >= t.insertOffset(chainName, numNonCalicoRules)
+	}
+	if t.insertMode == "append" {
+		return true
+	}
+	return start == 0
+}
+
+// insertOffset returns the index at which our first inserted rule should be placed in the given
+// chain, given the number of non-Calico rules in the chain.
+func (t *Table) insertOffset(chainName string, numNonCalicoRules int) int {
+	if position, ok := t.insertPosition(chainName); ok {
+		if position > numNonCalicoRules {
+			return numNonCalicoRules
+		}
+		return position
+	}
+	if t.insertMode == "append" {
+		log.Debug("In append mode, returning our hashes at end.")
+		return numNonCalicoRules
+	}
+	return 0
+}
+
 // getHashesFromDataplane loads the current state of our table and parses out the hashes that we
 // add to rules.  It returns a map with an entry for each chain in the table.  Each entry is a slice
 // containing the hashes for the rules in that table.  Rules with no hashes are represented by
-// an empty string.
-func (t *Table) getHashesFromDataplane() map[string][]string {
+// an empty string.  It retries on failure; it returns an error if the context is cancelled or,
+// if ReturnErrorOnFailure is set, if all the retries fail.
+func (t *Table) getHashesFromDataplane(ctx context.Context) (map[string][]string, error) {
 	retries := 3
 	retryDelay := 100 * time.Millisecond
 
 	// Retry a few times before we panic.  This deals with any transient errors and it prevents
 	// us from spamming a panic into the log when we're being gracefully shut down by a SIGTERM.
 	for {
-		hashes, err := t.attemptToGetHashesFromDataplane()
+		hashes, err := t.attemptToGetHashesFromDataplane(ctx)
 		if err != nil {
-			countNumSaveErrors.Inc()
+			if ctx.Err() != nil {
+				t.logCxt.WithError(err).Warnf("%s command interrupted", t.iptablesSaveCmd)
+				return nil, ctx.Err()
+			}
+			t.metrics.Add(MetricSaveErrors, 1)
 			var stderr string
 			if ee, ok := err.(*exec.ExitError); ok {
 				stderr = string(ee.Stderr)
@@ -652,23 +1470,29 @@ func (t *Table) getHashesFromDataplane() map[string][]string {
 			t.logCxt.WithError(err).WithField("stderr", stderr).Warnf("%s command failed", t.iptablesSaveCmd)
 			if retries > 0 {
 				retries--
-				t.timeSleep(retryDelay)
+				if err := t.timeSleep(ctx, retryDelay); err != nil {
+					return nil, err
+				}
 				retryDelay *= 2
-			} else {
+			} else if t.panicOnFailure {
 				t.logCxt.Panicf("%s command failed after retries", t.iptablesSaveCmd)
+			} else {
+				t.logCxt.Errorf("%s command failed after retries", t.iptablesSaveCmd)
+				return nil, &ApplyError{Table: t.Name, Err: err}
 			}
 			continue
 		}
 
-		return hashes
+		return hashes, nil
 	}
 }
 
 // attemptToGetHashesFromDataplane starts an iptables-save subprocess and feeds its output to
-// readHashesFrom() via a pipe.  It handles the various error cases.
-func (t *Table) attemptToGetHashesFromDataplane() (hashes map[string][]string, err error) {
-	cmd := t.newCmd(t.iptablesSaveCmd, "-t", t.Name)
-	countNumSaveCalls.Inc()
+// readHashesFrom() via a pipe.  It handles the various error cases.  If the context is
+// cancelled, the subprocess is killed.
+func (t *Table) attemptToGetHashesFromDataplane(ctx context.Context) (hashes map[string][]string, err error) {
+	cmd := t.newSaveCmd()
+	t.metrics.Add(MetricSaveCalls, 1)
 
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
@@ -686,16 +1510,45 @@ func (t *Table) attemptToGetHashesFromDataplane() (hashes map[string][]string, e
 		}
 		return
 	}
+	// The process may be killed either by the context watcher or after a read failure; make
+	// sure we only try once.
+	var killOnce sync.Once
+	var killErr error
+	kill := func() error {
+		killOnce.Do(func() {
+			killErr = cmd.Kill()
+		})
+		return killErr
+	}
+	if ctx.Done() != nil {
+		readDone := make(chan struct{})
+		defer close(readDone)
+		go func() {
+			select {
+			case <-ctx.Done():
+				log.Warnf("Context cancelled, killing %s process", t.iptablesSaveCmd)
+				if err := kill(); err != nil {
+					log.WithError(err).Warnf("Failed to kill %s process", t.iptablesSaveCmd)
+				}
+			case <-readDone:
+			}
+		}()
+	}
 	hashes, err = t.readHashesFrom(stdout)
 	if err != nil {
 		// In case readHashesFrom() returned due to an error that didn't cause the
 		// process to exit, kill it now.
 		log.WithError(err).Warnf("Killing %s process after a failure", t.iptablesSaveCmd)
-		killErr := cmd.Kill()
+		killErr := kill()
 		if killErr != nil {
 			// If we don't know what state the process is in, we can't Wait() on it.
-			log.WithError(killErr).Panicf(
-				"Failed to kill %s process after failure.", t.iptablesSaveCmd)
+			if t.panicOnFailure {
+				log.WithError(killErr).Panicf(
+					"Failed to kill %s process after failure.", t.iptablesSaveCmd)
+			}
+			log.WithError(killErr).Errorf(
+				"Failed to kill %s process after failure, abandoning it.", t.iptablesSaveCmd)
+			return
 		}
 	}
 	waitErr := cmd.Wait()
@@ -716,6 +1569,16 @@ func (t *Table) attemptToGetHashesFromDataplane() (hashes map[string][]string, e
 // whether written by Felix or not.
 func (t *Table) readHashesFrom(r io.ReadCloser) (hashes map[string][]string, err error) {
 	hashes = map[string][]string{}
+	policies := map[string]string{}
+	var ruleText map[string][]string
+	if t.strictVerify {
+		ruleText = map[string][]string{}
+	}
+	foreignRules := map[string][]string{}
+	retiredPrefixCounts := map[string]int{}
+	for prefix := range t.retiredHashPrefixes {
+		retiredPrefixCounts[prefix] = 0
+	}
 	scanner := bufio.NewScanner(r)
 
 	// Figure out if debug logging is enabled so we can skip some WithFields() calls in the
@@ -736,6 +1599,9 @@ func (t *Table) readHashesFrom(r io.ReadCloser) (hashes map[string][]string, err
 			logCxt.Debug("Parsing line")
 		}
 		captures := chainCreateRegexp.FindSubmatch(line)
+		if captures == nil && t.saveByListing {
+			captures = listChainRegexp.FindSubmatch(line)
+		}
 		if captures != nil {
 			// Chain forward-reference, make sure the chain exists.
 			chainName := string(captures[1])
@@ -743,6 +1609,9 @@ func (t *Table) readHashesFrom(r io.ReadCloser) (hashes map[string][]string, err
 				logCxt.WithField("chainName", chainName).Debug("Found forward-reference")
 			}
 			hashes[chainName] = []string{}
+			if policy := string(captures[2]); policy != "" && policy != "-" {
+				policies[chainName] = policy
+			}
 			continue
 		}
 
@@ -761,12 +1630,14 @@ func (t *Table) readHashesFrom(r io.ReadCloser) (hashes map[string][]string, err
 		// of the regex.  When writing the rules, we ensure that the hash is written as the
 		// first comment.
 		hash := ""
-		captures = t.hashCommentRegexp.FindSubmatch(line)
-		if captures != nil {
-			hash = string(captures[1])
+		if h, prefix, ok := t.ruleHashAndPrefixFrom(line); ok {
+			hash = h
 			if debug {
 				logCxt.WithField("hash", hash).Debug("Found hash in rule")
 			}
+			if _, ok := retiredPrefixCounts[prefix]; ok {
+				retiredPrefixCounts[prefix]++
+			}
 		} else if t.oldInsertRegexp.Find(line) != nil {
 			logCxt.WithFields(log.Fields{
 				"rule":      line,
@@ -775,16 +1646,36 @@ func (t *Table) readHashesFrom(r io.ReadCloser) (hashes map[string][]string, err
 			hash = "OLD INSERT RULE"
 		}
 		hashes[chainName] = append(hashes[chainName], hash)
+		if hash == "" && t.chainToInsertAnchor[chainName] != nil {
+			foreignRules[chainName] = append(foreignRules[chainName], string(line))
+		}
+		if ruleText != nil && t.ourChainsRegexp.MatchString(chainName) {
+			ruleText[chainName] = append(ruleText[chainName], string(line))
+		}
 	}
 	if scanner.Err() != nil {
 		log.WithError(scanner.Err()).Error("Failed to read hashes from dataplane")
 		return nil, scanner.Err()
 	}
 	t.logCxt.Debugf("Read hashes from dataplane: %#v", hashes)
+	t.chainToDataplanePolicy = policies
+	t.chainToDataplaneForeignRules = foreignRules
+	t.retiredHashPrefixCounts = retiredPrefixCounts
+	if ruleText != nil {
+		t.dataplaneRuleText = ruleText
+	}
 	return hashes, nil
 }
 
+// InvalidateDataplaneCache marks our cache of the dataplane state as invalid so that the next
+// Apply() re-reads the dataplane.
 func (t *Table) InvalidateDataplaneCache(reason string) {
+	t.opLock.Lock()
+	defer t.opLock.Unlock()
+	t.requestInvalidation(reason)
+}
+
+func (t *Table) invalidateDataplaneCache(reason string) {
 	logCxt := t.logCxt.WithField("reason", reason)
 	if !t.inSyncWithDataPlane {
 		logCxt.Debug("Would invalidate dataplane cache but it was already invalid.")
@@ -794,31 +1685,132 @@ func (t *Table) InvalidateDataplaneCache(reason string) {
 	t.inSyncWithDataPlane = false
 }
 
-func (t *Table) Apply() (rescheduleAfter time.Duration) {
-	now := t.timeNow()
+// ApplyError is returned by ApplyContext if it fails to update the dataplane after retries (and
+// the Table was created with TableOptions.ReturnErrorOnFailure).
+type ApplyError struct {
+	Table string
+	// Err is the error from the final attempt.
+	Err error
+	// Input is the iptables-restore input of the final attempt.  Empty if we failed before
+	// getting as far as calling iptables-restore.
+	Input string
+	// Diags is the iptables-save output for the table, captured after the final attempt.
+	Diags string
+}
+
+func (e *ApplyError) Error() string {
+	return fmt.Sprintf("failed to program iptables table %s after retries: %v", e.Table, e.Err)
+}
+
+// maybeInvalidateDataplaneCache checks whether it's time to re-read the dataplane, either because
+// the refresh interval has passed or because it's time for one of our post-write checks.
+func (t *Table) maybeInvalidateDataplaneCache(now time.Time) {
 	// We _think_ we're in sync, check if there are any reasons to think we might
 	// not be in sync.
 	lastReadToNow := now.Sub(t.lastReadTime)
 	invalidated := false
 	if t.refreshInterval > 0 && lastReadToNow > t.refreshInterval {
 		// Too long since we've forced a refresh.
-		t.InvalidateDataplaneCache("refresh timer")
+		t.invalidateDataplaneCache("refresh timer")
+		invalidated = true
+	}
+	if t.checkInsertOwnership() && !invalidated {
+		// We've (re)gained ownership of the inserts, the other agent may have changed them.
+		t.invalidateDataplaneCache("gained ownership of inserts")
+		invalidated = true
+	}
+	if remaining, ok := t.nextUnknownChainGraceExpiry(now); ok && remaining <= 0 && !invalidated {
+		// Recheck the unknown chains so that we can clean them up.
+		t.invalidateDataplaneCache("unknown chain grace period expired")
 		invalidated = true
 	}
 	// To workaround the possibility of another process clobbering our updates, we refresh the
 	// dataplane after we do a write at exponentially increasing intervals.  We do a refresh
-	// if the delta from the last write to now is twice the delta from the last read.
-	for t.postWriteInterval != 0 &&
-		t.postWriteInterval < time.Hour &&
-		!now.Before(t.lastWriteTime.Add(t.postWriteInterval)) {
-
-		t.postWriteInterval *= 2
+	// if the delta from the last write to now is postWriteBackoffFactor times the delta from
+	// the last read.
+	for t.postWriteCheckDue() && !now.Before(t.lastWriteTime.Add(t.postWriteInterval)) {
+		t.postWriteInterval = time.Duration(float64(t.postWriteInterval) * t.postWriteBackoffFactor)
 		t.logCxt.WithField("newPostWriteInterval", t.postWriteInterval).Debug("Updating post-write interval")
 		if !invalidated {
-			t.InvalidateDataplaneCache("post update")
+			t.invalidateDataplaneCache("post update")
 			invalidated = true
 		}
 	}
+}
+
+// postWriteCheckDue returns true if we still have a post-write check to do for the most recent
+// write.
+func (t *Table) postWriteCheckDue() bool {
+	return t.postWriteInterval != 0 && t.postWriteInterval < t.postWriteMaxInterval
+}
+
+// sleepContext sleeps for d or until the context is cancelled, whichever comes first.  It returns
+// the context's error if the context was cancelled.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// Apply applies any queued updates to the dataplane, retrying on failure.  It returns the
+// time after which Apply should be called again to check for (and repair) interference from
+// other processes and an ApplyResult that describes what it did.  It panics if the dataplane
+// can't be updated after several retries unless TableOptions.ReturnErrorOnFailure is set, in
+// which case the failure is logged and the updates remain queued; use ApplyContext to receive
+// the error.
+func (t *Table) Apply() (rescheduleAfter time.Duration, result ApplyResult) {
+	t.opLock.Lock()
+	defer t.opLock.Unlock()
+	rescheduleAfter, _ = t.apply(context.Background(), false)
+	return rescheduleAfter, t.lastApplyResult
+}
+
+// ApplyContext is like Apply but it can be interrupted by cancelling the context, for example,
+// to bound the total time spent retrying or to give up on an iptables-restore that is stuck
+// waiting for the xtables lock.  Any running iptables subprocess is killed.  If the context is
+// cancelled, ApplyContext returns the context's error; the interrupted updates remain queued
+// for the next call.  If the retries are exhausted and ReturnErrorOnFailure is set, it returns an
+// *ApplyError.  If the updates refer to chains that won't exist, it doesn't write them or retry;
+// it returns a *DanglingReferencesError (or panics, as for other failures, unless
+// ReturnErrorOnFailure is set).
+func (t *Table) ApplyContext(ctx context.Context) (rescheduleAfter time.Duration, err error) {
+	t.opLock.Lock()
+	defer t.opLock.Unlock()
+	return t.apply(ctx, false)
+}
+
+// Flush is like ApplyContext but, if TableOptions.CoalesceWindow is set, it writes any pending
+// updates immediately rather than waiting for the window to expire.
+func (t *Table) Flush(ctx context.Context) (rescheduleAfter time.Duration, err error) {
+	t.opLock.Lock()
+	defer t.opLock.Unlock()
+	return t.apply(ctx, true)
+}
+
+func (t *Table) apply(ctx context.Context, flush bool) (rescheduleAfter time.Duration, err error) {
+	t.lastApplyResult = ApplyResult{}
+	now := t.timeNow()
+	if !flush {
+		if remaining := t.coalesceTimeRemaining(now); remaining > 0 {
+			t.logCxt.WithField("remaining", remaining).Debug("Coalescing updates, deferring apply")
+			return remaining, nil
+		}
+	}
+	ctx, span := t.tracer.StartSpan(ctx, SpanApply)
+	span.SetAttribute("iptables.table", t.Name)
+	span.SetAttribute("iptables.ip_version", int(t.IPVersion))
+	defer func() {
+		span.End(err)
+	}()
+
+	t.maybeInvalidateDataplaneCache(now)
+	t.maybeApplyDeferredInvalidation(now)
+	t.maybeRecheckHookChains(now)
 
 	// Retry until we succeed.  There are several reasons that updating iptables may fail:
 	//
@@ -831,35 +1823,75 @@ func (t *Table) Apply() (rescheduleAfter time.Duration) {
 	//
 	// It's also possible that we're bugged and trying to write bad data so we give up
 	// eventually.
-	retries := 10
-	backoffTime := 1 * time.Millisecond
+	retries := t.applyRetries
+	backoffTime := t.initialBackoff
 	failedAtLeastOnce := false
 	for {
+		if err := ctx.Err(); err != nil {
+			t.logCxt.WithError(err).Warn("Context cancelled, abandoning iptables update")
+			return 0, err
+		}
+
 		if !t.inSyncWithDataPlane {
 			// We have reason to believe that our picture of the dataplane is out of
 			// sync.  Refresh it.  This may mark more chains as dirty.
-			t.loadDataplaneState()
+			_, saveSpan := t.tracer.StartSpan(ctx, SpanSave)
+			err := t.loadDataplaneState(ctx)
+			saveSpan.End(err)
+			if err != nil {
+				t.logCxt.WithError(err).Warn("Failed to load iptables state")
+				return 0, err
+			}
+			t.lastApplyResult.Resynced = true
 		}
 
-		if err := t.applyUpdates(); err != nil {
+		if err := t.applyUpdates(ctx); err != nil {
+			if ctx.Err() != nil {
+				t.logCxt.WithError(err).Warn("Context cancelled while programming iptables")
+				return 0, ctx.Err()
+			}
+			if refErr, ok := err.(*DanglingReferencesError); ok {
+				// We didn't write anything and retrying won't help until the caller
+				// supplies the missing chains.
+				if t.panicOnFailure {
+					t.logCxt.WithError(refErr).Panic("Update refers to chains that won't exist")
+				}
+				t.logCxt.WithError(refErr).Error("Update refers to chains that won't exist")
+				return 0, refErr
+			}
 			if retries > 0 {
 				retries--
+				t.lastApplyResult.Retries++
 				t.logCxt.WithError(err).Warn("Failed to program iptables, will retry")
-				t.timeSleep(backoffTime)
+				if err := t.timeSleep(ctx, t.addJitter(backoffTime)); err != nil {
+					t.logCxt.WithError(err).Warn("Context cancelled during backoff, abandoning iptables update")
+					return 0, err
+				}
 				backoffTime *= 2
+				if t.maxBackoff > 0 && backoffTime > t.maxBackoff {
+					backoffTime = t.maxBackoff
+				}
 				t.logCxt.WithError(err).Warn("Retrying...")
 				failedAtLeastOnce = true
 				continue
 			} else {
-				t.logCxt.WithError(err).Error("Failed to program iptables, loading diags before panic.")
-				cmd := t.newCmd(t.iptablesSaveCmd, "-t", t.Name)
+				t.logCxt.WithError(err).Error("Failed to program iptables, loading diags.")
+				cmd := t.newSaveCmd()
 				output, err2 := cmd.Output()
 				if err2 != nil {
 					t.logCxt.WithError(err2).Error("Failed to load iptables state")
 				} else {
 					t.logCxt.WithField("iptablesState", string(output)).Error("Current state of iptables")
 				}
-				t.logCxt.WithError(err).Panic("Failed to program iptables, giving up after retries")
+				if t.panicOnFailure {
+					t.logCxt.WithError(err).Panic("Failed to program iptables, giving up after retries")
+				}
+				t.logCxt.WithError(err).Error("Failed to program iptables, giving up after retries")
+				applyErr := &ApplyError{Table: t.Name, Err: err, Diags: string(output)}
+				if restoreErr, ok := err.(*RestoreError); ok {
+					applyErr.Input = restoreErr.input
+				}
+				return 0, applyErr
 			}
 		}
 		if failedAtLeastOnce {
@@ -868,15 +1900,24 @@ func (t *Table) Apply() (rescheduleAfter time.Duration) {
 		break
 	}
 
-	t.gaugeNumChains.Set(float64(len(t.chainNameToChain)))
+	t.metrics.Set(MetricChains, float64(len(t.chainNameToChain)))
+
+	// Now that our rules are in place in the new backend, remove them from the old one.
+	if t.oldBackend != nil {
+		if err := t.cleanUpOldBackend(ctx); err != nil {
+			t.logCxt.WithError(err).Warn("Failed to clean up old iptables backend, will retry")
+		} else {
+			t.oldBackend = nil
+		}
+	}
 
 	// Check whether we need to be rescheduled and how soon.
 	if t.refreshInterval > 0 {
 		// Refresh interval is set, start with that.
-		lastReadToNow = now.Sub(t.lastReadTime)
+		lastReadToNow := now.Sub(t.lastReadTime)
 		rescheduleAfter = t.refreshInterval - lastReadToNow
 	}
-	if t.postWriteInterval < time.Hour {
+	if t.postWriteCheckDue() {
 		postWriteReched := t.lastWriteTime.Add(t.postWriteInterval).Sub(now)
 		if postWriteReched <= 0 {
 			rescheduleAfter = 1 * time.Millisecond
@@ -884,54 +1925,117 @@ func (t *Table) Apply() (rescheduleAfter time.Duration) {
 			rescheduleAfter = postWriteReched
 		}
 	}
+	if graceReched, ok := t.nextUnknownChainGraceExpiry(now); ok {
+		if graceReched <= 0 {
+			graceReched = 1 * time.Millisecond
+		}
+		if rescheduleAfter == 0 || graceReched < rescheduleAfter {
+			rescheduleAfter = graceReched
+		}
+	}
+	if t.insertOwner != nil {
+		ownerReched := t.insertOwner.CheckInterval()
+		if rescheduleAfter == 0 || ownerReched < rescheduleAfter {
+			rescheduleAfter = ownerReched
+		}
+	}
+	if hookReched, ok := t.nextHookChainRecheck(now); ok {
+		if rescheduleAfter == 0 || hookReched < rescheduleAfter {
+			rescheduleAfter = hookReched
+		}
+	}
+	if t.oldBackend != nil {
+		if rescheduleAfter == 0 || backendCleanupRetryInterval < rescheduleAfter {
+			rescheduleAfter = backendCleanupRetryInterval
+		}
+	}
+	if invalReched, ok := t.nextInvalidationToken(now); ok {
+		if rescheduleAfter == 0 || invalReched < rescheduleAfter {
+			rescheduleAfter = invalReched
+		}
+	}
 
 	return
 }
 
-func (t *Table) applyUpdates() error {
+func (t *Table) applyUpdates(ctx context.Context) error {
 	// If needed, detect the dataplane features.
 	features := t.featureDetector.GetFeatures()
 
+	// Make sure that every chain that the update refers to will exist once it's committed,
+	// rather than relying on iptables-restore to reject the update.
+	if err := t.repairMissingChains(); err != nil {
+		return err
+	}
+
+	_, renderSpan := t.tracer.StartSpan(ctx, SpanRender)
+	renderSpan.SetAttribute("iptables.dirty_chains", t.dirtyChains.Len())
+	renderSpan.SetAttribute("iptables.dirty_inserts", t.dirtyInserts.Len())
+
+	// If we're about to rewrite rules that are already in the dataplane, read their counters
+	// so that we can restore them.
+	counters := t.countersToPreserve()
+	counters = t.renamedChainCounters(counters, features)
+	t.restoreCounters = len(counters) > 0
+	defer func() {
+		t.restoreCounters = false
+	}()
+
 	// Build up the iptables-restore input in an in-memory buffer.  This allows us to log out the exact input after
-	// a failure, which has proven to be a very useful diagnostic tool.
+	// a failure, which has proven to be a very useful diagnostic tool.  If streaming is enabled, we trade that
+	// for a smaller memory footprint and stream the input to iptables-restore as we generate it instead.
 	buf := &t.restoreInputBuffer
 	buf.Reset() // Defensive.
+	var outputBuf, errBuf bytes.Buffer
+	var stream *restoreStream
+	if t.streamRestoreInput && !t.restorePerRule {
+		stream = newRestoreStream(ctx, func() CmdIface {
+			t.metrics.Add(MetricRestoreCalls, 1)
+			return t.newRestoreCmd(features, &outputBuf, &errBuf)
+		}, t.xtablesLock(ctx))
+		buf.StreamTo(stream)
+	}
 
 	// iptables-restore commands live in per-table transactions.
 	buf.StartTransaction(t.Name)
 
-	// Make a pass over the dirty chains and generate a forward reference for any that we're about to update.
-	// Writing a forward reference ensures that the chain exists and that it is empty.
+	// Renames go first so that the rest of the update sees the chains under their new names.
+	t.writeChainRenames(buf)
+
+	// Make a pass over the dirty chains and generate a forward reference for any that don't exist
+	// yet so that every chain exists before anything refers to it.  Chains that we flush are
+	// flushed later, in the same chunk as their new rules (or their deletion); chunks are
+	// committed separately and a chain must not be left empty if a later chunk fails.
+	createdChains := set.New()
 	t.dirtyChains.Iter(func(item interface{}) error {
 		chainName := item.(string)
-		chainNeedsToBeFlushed := false
-		if t.nftablesMode {
-			// iptables-nft-restore <v1.8.3 has a bug (https://bugzilla.netfilter.org/show_bug.cgi?id=1348)
-			// where only the first replace command sets the rule index.  Work around that by refreshing the
-			// whole chain using a flush.
-			chain := t.chainNameToChain[chainName]
-			currentHashes := chain.RuleHashes(features)
-			previousHashes := t.chainToDataplaneHashes[chainName]
-			t.logCxt.WithFields(log.Fields{
-				"previous": previousHashes,
-				"current":  currentHashes,
-			}).Debug("Comparing old to new hashes.")
-			if len(previousHashes) > 0 && reflect.DeepEqual(currentHashes, previousHashes) {
-				// Chain is already correct, skip it.
-				log.Debug("Chain already correct")
-				return set.RemoveItem
+		if t.nftablesMode && !t.isQuarantined(chainName) {
+			if chain, ok := t.chainNameToChain[chainName]; ok {
+				currentHashes := t.ruleHashes(chain, features)
+				previousHashes, _ := t.ourRuleHashes(chainName, t.chainToDataplaneHashes[chainName])
+				t.logCxt.WithFields(log.Fields{
+					"previous": previousHashes,
+					"current":  currentHashes,
+				}).Debug("Comparing old to new hashes.")
+				if len(previousHashes) > 0 && reflect.DeepEqual(currentHashes, previousHashes) {
+					// Chain is already correct, skip it.
+					log.Debug("Chain already correct")
+					return set.RemoveItem
+				}
 			}
-			chainNeedsToBeFlushed = true
-		} else if _, ok := t.chainNameToChain[chainName]; !ok {
-			// About to delete this chain, flush it first to sever dependencies.
-			chainNeedsToBeFlushed = true
-		} else if _, ok := t.chainToDataplaneHashes[chainName]; !ok {
-			// Chain doesn't exist in dataplane, mark it for creation.
-			chainNeedsToBeFlushed = true
-		}
-		if chainNeedsToBeFlushed {
-			buf.WriteForwardReference(chainName)
 		}
+		if _, ok := t.chainToDataplaneHashes[chainName]; ok {
+			return nil
+		}
+		if _, ok := t.chainNameToChain[chainName]; !ok && !t.isQuarantined(chainName) {
+			// About to delete this chain; it's flushed with the deletions below.
+			return nil
+		}
+		// Chain doesn't exist in dataplane, create it.  If it's quarantined, we create it
+		// empty so that references to it still work.
+		buf.MaybeStartNewChunk(t.maxLinesPerRestore)
+		buf.WriteForwardReference(chainName)
+		createdChains.Add(chainName)
 		return nil
 	})
 
@@ -939,21 +2043,66 @@ func (t *Table) applyUpdates() error {
 	newHashes := map[string][]string{}
 	t.dirtyChains.Iter(func(item interface{}) error {
 		chainName := item.(string)
+		if t.isQuarantined(chainName) {
+			if _, ok := t.chainToDataplaneHashes[chainName]; !ok {
+				newHashes[chainName] = []string{}
+			}
+			return nil
+		}
 		if chain, ok := t.chainNameToChain[chainName]; ok {
 			// Chain update or creation.  Scan the chain against its previous hashes
-			// and replace/append/delete as appropriate.
-			var previousHashes []string
+			// and replace/append/delete as appropriate.  The chain's updates all go in the
+			// same chunk.
+			buf.MaybeStartNewChunk(t.maxLinesPerRestore)
+			// Compare the rules one by one and apply deltas rule by rule.
+			previousHashes := t.chainToDataplaneHashes[chainName]
+			if t.nftablesMode && !createdChains.Contains(chainName) {
+				// iptables-nft-restore <v1.8.3 has a bug (https://bugzilla.netfilter.org/show_bug.cgi?id=1348)
+				// where only the first replace command sets the rule index.  Work around that by
+				// refreshing the whole chain using a flush.  A flush would remove any foreign
+				// rules in the chain; we rewrite our rules without flushing below instead.
+				if _, numForeign := t.ourRuleHashes(chainName, previousHashes); numForeign == 0 {
+					buf.WriteForwardReference(chainName)
+				}
+			}
+			currentHashes := t.ruleHashes(chain, features)
+			if t.appendsAfterForeignRules(chainName, previousHashes) {
+				if ours, _ := t.ourRuleHashes(chainName, previousHashes); reflect.DeepEqual(ours, currentHashes) {
+					newHashes[chainName] = previousHashes
+					return nil
+				}
+				newHashes[chainName] = t.writeAppendAfterForeignRules(
+					buf, chain, previousHashes, currentHashes, counters, features)
+				return nil
+			}
+			numForeign := 0
+			if t.preservesForeignTail(chainName) {
+				previousHashes, numForeign = splitForeignTail(previousHashes)
+			}
+			newHashes[chainName] = currentHashes
+			if numForeign > 0 {
+				newHashes[chainName] = append(append([]string(nil), currentHashes...), make([]string, numForeign)...)
+			}
 			if t.nftablesMode {
+				if numForeign > 0 {
+					// We didn't flush the chain, to preserve the foreign rules, but we can't
+					// rely on replace either (see above).  Delete our old rules and insert the
+					// new ones in front of the foreign rules.
+					for range previousHashes {
+						buf.WriteRuleLine(chainName, -1, deleteRule(chainName, 1))
+					}
+					for i, hash := range currentHashes {
+						line := t.renderer.RenderInsertAt(chain.Rules[i], chainName, i+1, t.commentFrag(hash), features)
+						buf.WriteRuleLine(chainName, i, withCounters(counters, hash, line))
+					}
+					return nil
+				}
 				// Due to a bug in iptables nft mode, force a whole-chain rewrite.  (See above.)
 				previousHashes = nil
-			} else {
-				// In iptables legacy mode, we compare the rules one by one and apply deltas rule by rule.
-				previousHashes = t.chainToDataplaneHashes[chainName]
 			}
-			currentHashes := chain.RuleHashes(features)
-			newHashes[chainName] = currentHashes
 			for i := 0; i < len(previousHashes) || i < len(currentHashes); i++ {
 				var line string
+				ruleIdx := i
 				if i < len(previousHashes) && i < len(currentHashes) {
 					if previousHashes[i] == currentHashes[i] {
 						continue
@@ -961,17 +2110,25 @@ func (t *Table) applyUpdates() error {
 					// Hash doesn't match, replace the rule.
 					ruleNum := i + 1 // 1-indexed.
 					prefixFrag := t.commentFrag(currentHashes[i])
-					line = chain.Rules[i].RenderReplace(chainName, ruleNum, prefixFrag, features)
+					line = t.renderer.RenderReplace(chain.Rules[i], chainName, ruleNum, prefixFrag, features)
+					line = withCounters(counters, currentHashes[i], line)
 				} else if i < len(previousHashes) {
 					// previousHashes was longer, remove the old rules from the end.
 					ruleNum := len(currentHashes) + 1 // 1-indexed
 					line = deleteRule(chainName, ruleNum)
+					ruleIdx = -1
+				} else if numForeign > 0 {
+					// currentHashes was longer.  Insert the new rule in front of the foreign
+					// rules.
+					prefixFrag := t.commentFrag(currentHashes[i])
+					line = t.renderer.RenderInsertAt(chain.Rules[i], chainName, i+1, prefixFrag, features)
 				} else {
 					// currentHashes was longer.  Append.
 					prefixFrag := t.commentFrag(currentHashes[i])
-					line = chain.Rules[i].RenderAppend(chainName, prefixFrag, features)
+					line = t.renderer.RenderAppend(chain.Rules[i], chainName, prefixFrag, features)
+					line = withCounters(counters, currentHashes[i], line)
 				}
-				buf.WriteLine(line)
+				buf.WriteRuleLine(chainName, ruleIdx, line)
 			}
 		}
 		return nil // Delay clearing the set until we've programmed iptables.
@@ -980,19 +2137,37 @@ func (t *Table) applyUpdates() error {
 	// Now calculate iptables updates for our inserted rules, which are used to hook top-level chains.
 	t.dirtyInserts.Iter(func(item interface{}) error {
 		chainName := item.(string)
+		if !t.ownsInserts {
+			t.logCxt.WithField("chainName", chainName).Debug(
+				"Another agent owns the inserts, skipping inserts into chain")
+			return nil
+		}
+		if t.hookChainMissing(chainName) {
+			return nil
+		}
 		previousHashes := t.chainToDataplaneHashes[chainName]
+		if t.insertsInSync(chainName, previousHashes) {
+			// Chain is in sync, skip to next one.
+			return nil
+		}
 
 		// Calculate the hashes for our inserted rules.
 		newChainHashes, newRuleHashes := t.expectedHashesForInsertChain(
 			chainName, numEmptyStrings(previousHashes))
 
-		if reflect.DeepEqual(newChainHashes, previousHashes) {
-			// Chain is in sync, skip to next one.
+		// If our rules are still in a sensible place, fix them up without removing our hook
+		// from the chain.
+		if start, repairedHashes, ok := t.planInsertRepair(chainName, previousHashes, newRuleHashes); ok {
+			buf.MaybeStartNewChunk(t.maxLinesPerRestore)
+			t.writeInsertRepair(buf, chainName, start, previousHashes, newRuleHashes, counters, features)
+			newHashes[chainName] = repairedHashes
 			return nil
 		}
 
-		// For simplicity, if we've discovered that we're out-of-sync, remove all our
-		// rules from this chain, then re-insert/re-append them below.
+		// Otherwise, for simplicity, remove all our rules from this chain, then
+		// re-insert/re-append them below.  All in the same chunk since the chain is out of
+		// sync in between.
+		buf.MaybeStartNewChunk(t.maxLinesPerRestore)
 		//
 		// Remove in reverse order so that we don't disturb the rule numbers of rules we're
 		// about to remove.
@@ -1000,27 +2175,37 @@ func (t *Table) applyUpdates() error {
 			if previousHashes[i] != "" {
 				ruleNum := i + 1
 				line := deleteRule(chainName, ruleNum)
-				buf.WriteLine(line)
+				buf.WriteLineForChain(chainName, line)
 			}
 		}
 
 		rules := t.chainToInsertedRules[chainName]
-		if t.insertMode == "insert" {
+		if _, ok := t.insertPosition(chainName); ok {
+			t.logCxt.Debug("Rendering positional insert rules.")
+			// Our rules have all been removed above so the chain now contains only the
+			// non-Calico rules.  Insert ours, in order, starting after the requested position.
+			offset := t.insertOffset(chainName, numEmptyStrings(previousHashes))
+			for i := 0; i < len(rules); i++ {
+				prefixFrag := t.commentFrag(newRuleHashes[i])
+				line := t.renderer.RenderInsertAt(rules[i], chainName, offset+i+1, prefixFrag, features)
+				buf.WriteRuleLine(chainName, i, withCounters(counters, newRuleHashes[i], line))
+			}
+		} else if t.insertMode == "insert" {
 			t.logCxt.Debug("Rendering insert rules.")
 			// Since each insert is pushed onto the top of the chain, do the inserts in
 			// reverse order so that they end up in the correct order in the final
 			// state of the chain.
 			for i := len(rules) - 1; i >= 0; i-- {
 				prefixFrag := t.commentFrag(newRuleHashes[i])
-				line := rules[i].RenderInsert(chainName, prefixFrag, features)
-				buf.WriteLine(line)
+				line := t.renderer.RenderInsert(rules[i], chainName, prefixFrag, features)
+				buf.WriteRuleLine(chainName, i, withCounters(counters, newRuleHashes[i], line))
 			}
 		} else {
 			t.logCxt.Debug("Rendering append rules.")
 			for i := 0; i < len(rules); i++ {
 				prefixFrag := t.commentFrag(newRuleHashes[i])
-				line := rules[i].RenderAppend(chainName, prefixFrag, features)
-				buf.WriteLine(line)
+				line := t.renderer.RenderAppend(rules[i], chainName, prefixFrag, features)
+				buf.WriteRuleLine(chainName, i, withCounters(counters, newRuleHashes[i], line))
 			}
 		}
 
@@ -1029,6 +2214,9 @@ func (t *Table) applyUpdates() error {
 		return nil // Delay clearing the set until we've programmed iptables.
 	})
 
+	// Then any kernel chain policies that need to change.
+	newPolicies := t.writeChainPolicies(buf)
+
 	if t.nftablesMode {
 		// The nftables version of iptables-restore requires that chains are unreferenced at the start of the
 		// transaction before they can be deleted (i.e. it doesn't seem to update the reference calculation as
@@ -1037,94 +2225,46 @@ func (t *Table) applyUpdates() error {
 		t.logCxt.Debug("In nftables mode, restarting transaction between updates and deletions.")
 		buf.EndTransaction()
 		buf.StartTransaction(t.Name)
-
-		t.dirtyChains.Iter(func(item interface{}) error {
-			chainName := item.(string)
-			if _, ok := t.chainNameToChain[chainName]; !ok {
-				// Chain deletion
-				buf.WriteForwardReference(chainName)
-			}
-			return nil // Delay clearing the set until we've programmed iptables.
-		})
 	}
 
 	// Do deletions at the end.  This ensures that we don't try to delete any chains that
 	// are still referenced (because we'll have removed the references in the modify pass
-	// above).  Note: if a chain is being deleted at the same time as a chain that it refers to
-	// then we'll issue a create+flush instruction in the very first pass, which will sever the
-	// references.
+	// above).  We flush all the chains that we're deleting first, to sever any references
+	// between them.  Since the flushes come after all the updates, a chain is only emptied
+	// once nothing that we're keeping refers to it.
+	t.dirtyChains.Iter(func(item interface{}) error {
+		chainName := item.(string)
+		if _, ok := t.chainNameToChain[chainName]; !ok && !t.isQuarantined(chainName) {
+			buf.MaybeStartNewChunk(t.maxLinesPerRestore)
+			buf.WriteForwardReference(chainName)
+		}
+		return nil // Delay clearing the set until we've programmed iptables.
+	})
 	t.dirtyChains.Iter(func(item interface{}) error {
 		chainName := item.(string)
 		if _, ok := t.chainNameToChain[chainName]; !ok {
 			// Chain deletion
-			buf.WriteLine(fmt.Sprintf("--delete-chain %s", chainName))
+			buf.MaybeStartNewChunk(t.maxLinesPerRestore)
+			buf.WriteLineForChain(chainName, fmt.Sprintf("--delete-chain %s", chainName))
 			newHashes[chainName] = nil
 		}
 		return nil // Delay clearing the set until we've programmed iptables.
 	})
 
 	buf.EndTransaction()
+	renderSpan.End(nil)
 
-	if buf.Empty() {
+	wroteToDataplane := !buf.Empty()
+	if !wroteToDataplane {
 		t.logCxt.Debug("Update ended up being no-op, skipping call to ip(6)tables-restore.")
 	} else {
-		// Get the contents of the buffer ready to send to iptables-restore.  Warning: for perf, this is directly
-		// accessing the buffer's internal array; don't touch the buffer after this point.
-		inputBytes := buf.GetBytesAndReset()
-
-		if log.GetLevel() >= log.DebugLevel {
-			// Only convert (potentially very large slice) to string at debug level.
-			inputStr := string(inputBytes)
-			t.logCxt.WithField("iptablesInput", inputStr).Debug("Writing to iptables")
-		}
-
-		var outputBuf, errBuf bytes.Buffer
-		args := []string{"--noflush", "--verbose"}
-		if features.RestoreSupportsLock {
-			// Versions of iptables-restore that support the xtables lock also make it impossible to disable.  Make
-			// sure that we configure it to retry and configure for a short retry interval (the default is to try to
-			// acquire the lock only once).
-			lockTimeout := t.lockTimeout.Seconds()
-			if lockTimeout <= 0 {
-				// Before iptables-restore added lock support, we were able to disable the lock completely, which
-				// was indicated by a value <=0 (and was our default).  Newer versions of iptables-restore require the
-				// lock so we override the default and set it to 10s.
-				lockTimeout = 10
-			}
-			lockProbeMicros := t.lockProbeInterval.Nanoseconds() / 1000
-			timeoutStr := fmt.Sprintf("%.0f", lockTimeout)
-			intervalStr := fmt.Sprintf("%d", lockProbeMicros)
-			args = append(args,
-				"--wait", timeoutStr, // seconds
-				"--wait-interval", intervalStr, // microseconds
-			)
-			log.WithFields(log.Fields{
-				"timeoutSecs":         timeoutStr,
-				"probeIntervalMicros": intervalStr,
-			}).Debug("Using native iptables-restore xtables lock.")
-		}
-		cmd := t.newCmd(t.iptablesRestoreCmd, args...)
-		cmd.SetStdin(bytes.NewReader(inputBytes))
-		cmd.SetStdout(&outputBuf)
-		cmd.SetStderr(&errBuf)
-		countNumRestoreCalls.Inc()
-		// Note: calicoXtablesLock will be a dummy lock if our xtables lock is disabled (i.e. if iptables-restore
-		// supports the xtables lock itself, or if our implementation is disabled by config.
-		t.calicoXtablesLock.Lock()
-		err := cmd.Run()
-		t.calicoXtablesLock.Unlock()
+		t.lastApplyResult.LinesWritten += len(buf.LineOrigins())
+		restoreCtx, restoreSpan := t.tracer.StartSpan(ctx, SpanRestore)
+		restoreStart := t.timeNow()
+		err := t.writeRestoreInput(restoreCtx, features, stream, &outputBuf, &errBuf)
+		t.lastApplyResult.RestoreDuration += t.timeNow().Sub(restoreStart)
+		restoreSpan.End(err)
 		if err != nil {
-			// To log out the input, we must convert to string here since, after we return, the buffer can be re-used
-			// (and the logger may convert to string on a background thread).
-			inputStr := string(inputBytes)
-			t.logCxt.WithFields(log.Fields{
-				"output":      outputBuf.String(),
-				"errorOutput": errBuf.String(),
-				"error":       err,
-				"input":       inputStr,
-			}).Warn("Failed to execute ip(6)tables-restore command")
-			t.inSyncWithDataPlane = false
-			countNumRestoreErrors.Inc()
 			return err
 		}
 		t.lastWriteTime = t.timeNow()
@@ -1136,8 +2276,21 @@ func (t *Table) applyUpdates() error {
 	// was actually a no-op update.
 	t.dirtyChains = set.New()
 	t.dirtyInserts = set.New()
+	t.dirtyPolicies = set.New()
+	t.chainToRestoreFailures = map[string]int{}
+	t.chainRenames = map[string]string{}
+	t.updatesPending = false
+
+	// Tell the audit sink what we changed; it needs the old hashes so this must come first.
+	if wroteToDataplane {
+		t.reportAudit(newHashes)
+		t.recordWriteStats(newHashes)
+	}
 
 	// Store off the updates.
+	for chainName, policy := range newPolicies {
+		t.chainToDataplanePolicy[chainName] = policy
+	}
 	for chainName, hashes := range newHashes {
 		if hashes == nil {
 			delete(t.chainToDataplaneHashes, chainName)
@@ -1146,9 +2299,244 @@ func (t *Table) applyUpdates() error {
 		}
 	}
 
+	if t.verifyAfterWrite && wroteToDataplane {
+		return t.verifyDataplane(ctx, newHashes)
+	}
+
 	return nil
 }
 
+// noteUpdate records the time of the first update since the last successful write, for use
+// by coalescing.
+func (t *Table) noteUpdate() {
+	if t.coalesceWindow > 0 && !t.updatesPending {
+		t.updatesPending = true
+		t.firstPendingUpdateTime = t.timeNow()
+	}
+}
+
+// coalesceTimeRemaining returns how much longer Apply() should hold back pending updates, or 0
+// if they should be written now.
+func (t *Table) coalesceTimeRemaining(now time.Time) time.Duration {
+	if t.coalesceWindow <= 0 || !t.updatesPending {
+		return 0
+	}
+	remaining := t.firstPendingUpdateTime.Add(t.coalesceWindow).Sub(now)
+	if remaining < 0 {
+		return 0
+	}
+	return remaining
+}
+
+// addJitter adds a random delay of up to backoffMaxJitter to the given backoff time.
+func (t *Table) addJitter(backoff time.Duration) time.Duration {
+	if t.backoffMaxJitter <= 0 {
+		return backoff
+	}
+	return backoff + time.Duration(rand.Int63n(int64(t.backoffMaxJitter)))
+}
+
+// restoreArgs returns the arguments to pass to iptables-restore, taking into account whether
+// it supports the xtables lock.
+func (t *Table) restoreArgs(features *Features) []string {
+	args := []string{"--noflush", "--verbose"}
+	args = append(args, t.lockArgs(features)...)
+	if t.restoreCounters {
+		args = append(args, "--counters")
+	}
+	return args
+}
+
+// lockArgs returns the arguments that make iptables-restore (or, in degraded mode, iptables)
+// take the xtables lock, if it supports doing so.
+func (t *Table) lockArgs(features *Features) (args []string) {
+	if features.RestoreSupportsLock {
+		// Versions of iptables-restore that support the xtables lock also make it impossible to disable.  Make
+		// sure that we configure it to retry and configure for a short retry interval (the default is to try to
+		// acquire the lock only once).
+		lockTimeout := t.lockTimeout.Seconds()
+		if lockTimeout <= 0 {
+			// Before iptables-restore added lock support, we were able to disable the lock completely, which
+			// was indicated by a value <=0 (and was our default).  Newer versions of iptables-restore require the
+			// lock so we override the default and set it to 10s.
+			lockTimeout = 10
+		}
+		lockProbeMicros := t.lockProbeInterval.Nanoseconds() / 1000
+		timeoutStr := fmt.Sprintf("%.0f", lockTimeout)
+		intervalStr := fmt.Sprintf("%d", lockProbeMicros)
+		args = append(args,
+			"--wait", timeoutStr, // seconds
+			"--wait-interval", intervalStr, // microseconds
+		)
+		log.WithFields(log.Fields{
+			"timeoutSecs":         timeoutStr,
+			"probeIntervalMicros": intervalStr,
+		}).Debug("Using native iptables-restore xtables lock.")
+	}
+	return args
+}
+
+// writeRestoreInput sends the input in our restore buffer to iptables-restore.  If the input is being
+// streamed, it has already been sent to the given stream and this just waits for iptables-restore to
+// finish; outputBuf and errBuf are the streaming iptables-restore's output buffers.
+func (t *Table) writeRestoreInput(
+	ctx context.Context,
+	features *Features,
+	stream *restoreStream,
+	outputBuf, errBuf *bytes.Buffer,
+) error {
+	buf := &t.restoreInputBuffer
+	if stream != nil {
+		// The input has already been streamed, just wait for iptables-restore to finish.
+		lineOrigins := buf.LineOrigins()
+		buf.Reset()
+		if err := stream.Wait(); err != nil {
+			return t.onRestoreFailure(err, "", outputBuf.String(), errBuf.String(), lineOrigins)
+		}
+		return nil
+	}
+
+	// Get the contents of the buffer ready to send to iptables-restore.  Warning: for perf, this is directly
+	// accessing the buffer's internal array; don't touch the buffer after this point.
+	chunks := buf.GetChunksAndReset()
+	for i, chunk := range chunks {
+		if err := t.execRestore(ctx, features, chunk); err != nil {
+			if i > 0 {
+				// Our earlier chunks were committed but we've marked ourselves out of sync
+				// so we'll reload the dataplane state and pick up from there.
+				t.logCxt.WithFields(log.Fields{
+					"chunk":     i + 1,
+					"numChunks": len(chunks),
+				}).Warn("iptables-restore failed part way through a chunked update")
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// execRestore runs iptables-restore with the given chunk of input.
+func (t *Table) execRestore(ctx context.Context, features *Features, chunk RestoreChunk) error {
+	if log.GetLevel() >= log.DebugLevel {
+		// Only convert (potentially very large slice) to string at debug level.
+		inputStr := string(chunk.Input)
+		t.logCxt.WithField("iptablesInput", inputStr).Debug("Writing to iptables")
+	}
+
+	if t.restorePerRule {
+		return t.execRestorePerRule(ctx, features, chunk)
+	}
+
+	if t.restorePreflight {
+		if err := t.preflightRestore(ctx, features, chunk); err != nil {
+			return err
+		}
+	}
+
+	var outputBuf, errBuf bytes.Buffer
+	cmd := t.newRestoreCmd(features, &outputBuf, &errBuf)
+	cmd.SetStdin(bytes.NewReader(chunk.Input))
+	t.metrics.Add(MetricRestoreCalls, 1)
+	// Note: calicoXtablesLock will be a dummy lock if our xtables lock is disabled (i.e. if iptables-restore
+	// supports the xtables lock itself, or if our implementation is disabled by config.
+	lock := t.xtablesLock(ctx)
+	lock.Lock()
+	err := runCmd(ctx, cmd)
+	lock.Unlock()
+	if err != nil {
+		// To log out the input, we must convert to string here since, after we return, the buffer can be re-used
+		// (and the logger may convert to string on a background thread).
+		return t.onRestoreFailure(err, string(chunk.Input), outputBuf.String(), errBuf.String(), chunk.LineOrigins)
+	}
+	return nil
+}
+
+// onRestoreFailure handles a failed iptables-restore, returning a *RestoreError that describes the failure.
+// input is the input that was passed to iptables-restore or "" if it isn't available.
+func (t *Table) onRestoreFailure(
+	err error,
+	input string,
+	output string,
+	errorOutput string,
+	lineOrigins []RestoreLineOrigin,
+) error {
+	t.logCxt.WithFields(log.Fields{
+		"output":      output,
+		"errorOutput": errorOutput,
+		"error":       err,
+		"input":       input,
+	}).Warn("Failed to execute ip(6)tables-restore command")
+	t.inSyncWithDataPlane = false
+	t.metrics.Add(MetricRestoreErrors, 1)
+	restoreErr := newRestoreError(err, input, errorOutput, lineOrigins)
+	if restoreErr.Chain != "" {
+		t.logCxt.WithFields(log.Fields{
+			"chainName": restoreErr.Chain,
+			"ruleIndex": restoreErr.RuleIndex,
+			"fragment":  restoreErr.Fragment,
+		}).Warn("Traced ip(6)tables-restore failure to chain")
+	}
+	if t.quarantineThreshold > 0 {
+		t.recordRestoreFailure(restoreErr)
+	}
+	return restoreErr
+}
+
+// newRestoreCmd creates an iptables-restore command that writes its output to the given buffers.  The
+// caller is responsible for setting its input.
+func (t *Table) newRestoreCmd(features *Features, outputBuf, errBuf io.Writer) CmdIface {
+	cmd := t.newCmd(t.iptablesRestoreCmd, t.restoreArgs(features)...)
+	cmd.SetStdout(outputBuf)
+	cmd.SetStderr(errBuf)
+	return cmd
+}
+
+// runCmd runs the given command to completion, killing it if the context is cancelled first.
+func runCmd(ctx context.Context, cmd CmdIface) error {
+	if ctx.Done() == nil {
+		// Context can't be cancelled, avoid the overhead of the watcher.
+		return cmd.Run()
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	waitResult := make(chan error, 1)
+	go func() {
+		waitResult <- cmd.Wait()
+	}()
+	select {
+	case err := <-waitResult:
+		return err
+	case <-ctx.Done():
+		log.WithField("cmd", cmd.String()).Warn("Context cancelled, killing process")
+		if err := cmd.Kill(); err != nil {
+			log.WithError(err).Warn("Failed to kill process")
+		}
+		<-waitResult
+		return ctx.Err()
+	}
+}
+
+// ruleHashFrom extracts the rule hash from the rule-tracking comment in the given rule, if it
+// has one.  Hashes with one of our secondary or retired prefixes are returned with the prefix
+// attached so that they never match a hash that we'd write.
+func (t *Table) ruleHashFrom(line []byte) (string, bool) {
+	hash, _, ok := t.ruleHashAndPrefixFrom(line)
+	return hash, ok
+}
+
+// ruleHashAndPrefixFrom is like ruleHashFrom but also returns the prefix of the comment.
+func (t *Table) ruleHashAndPrefixFrom(line []byte) (hash, prefix string, ok bool) {
+	captures := t.hashCommentRegexp.FindSubmatch(line)
+	if captures == nil {
+		return "", "", false
+	}
+	if prefix := string(captures[1]); prefix != t.hashCommentPrefix {
+		return prefix + string(captures[2]), prefix, true
+	}
+	return string(captures[2]), t.hashCommentPrefix, true
+}
+
 func (t *Table) commentFrag(hash string) string {
 	return fmt.Sprintf(`-m comment --comment "%s%s"`, t.hashCommentPrefix, hash)
 }
@@ -1157,12 +2545,12 @@ func deleteRule(chainName string, ruleNum int) string {
 	return fmt.Sprintf("-D %s %d", chainName, ruleNum)
 }
 
-func calculateRuleInsertHashes(chainName string, rules []Rule, features *Features) []string {
+func (t *Table) calculateRuleInsertHashes(chainName string, rules []Rule, features *Features) []string {
 	chain := Chain{
 		Name:  chainName,
 		Rules: rules,
 	}
-	return (&chain).RuleHashes(features)
+	return (&chain).RuleHashesWithFormat(features, t.hashFormat)
 }
 
 func numEmptyStrings(strs []string) int {
@@ -1174,3 +2562,9 @@ func numEmptyStrings(strs []string) int {
 	}
 	return count
 }
+
+// noopLocker is the Table's opLock when TableOptions.ThreadSafe isn't set.
+type noopLocker struct{}
+
+func (noopLocker) Lock()   {}
+func (noopLocker) Unlock() {}
@@ -0,0 +1,32 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import "time"
+
+// TableIface is the subset of Table's methods that dataplane drivers use to program a table.
+// Drivers that depend on TableIface, rather than on *Table, can be tested against the in-memory
+// fake.Table.
+type TableIface interface {
+	UpdateChain(chain *Chain)
+	UpdateChains(chains []*Chain)
+	RemoveChains(chains []*Chain)
+	RemoveChainByName(name string)
+	SetRuleInsertions(chainName string, rules []Rule)
+	Apply() (rescheduleAfter time.Duration, result ApplyResult)
+	InvalidateDataplaneCache(reason string)
+}
+
+var _ TableIface = (*Table)(nil)
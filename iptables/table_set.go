@@ -0,0 +1,299 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// tableApplyOrder is the order in which a TableSet applies its tables.  It follows the order in
+// which packets traverse the tables so that, for example, a rule that sets a mark in the mangle
+// table is programmed before a rule in the filter table that matches on that mark.
+var tableApplyOrder = map[string]int{
+	"raw":    0,
+	"mangle": 1,
+	"nat":    2,
+	"filter": 3,
+}
+
+// TableSet coordinates the Tables (typically raw, mangle, nat and filter) for one IP version.
+//
+// When more than one of its Tables needs to re-read the dataplane, the TableSet does a single
+// iptables-save of all tables and shares the output, rather than having each Table run its own
+// iptables-save.  Tables whose periodic refresh is more than half way due are refreshed from
+// the same output so that, once their refresh timers have drifted apart (for example, after one
+// Table re-read the dataplane on its own after a failure), they are brought back into line and
+// share the next iptables-save too.  It also applies the Tables one at a time, in
+// packet-traversal order, so that cross-table dependencies are programmed coherently.
+//
+// Like Table, TableSet doesn't do any internal synchronization of its own.  If its Tables are
+// ThreadSafe, then Apply() holds all of their locks, in apply order, while it runs.  Once a
+// Table has been added to a TableSet, it should only be applied via the TableSet.
+type TableSet struct {
+	IPVersion uint8
+
+	// tables holds our tables, sorted into tableApplyOrder.
+	tables []*Table
+
+	logCxt *log.Entry
+
+	// Shim for exec.Command() for test purposes.
+	newCmd cmdFactory
+}
+
+type TableSetOptions struct {
+	// NewCmdOverride for tests, if non-nil, factory to use instead of the real exec.Command()
+	NewCmdOverride cmdFactory
+}
+
+// NewTableSet creates a TableSet for the given Tables, which must all be for the given IP
+// version and must have distinct names.
+func NewTableSet(ipVersion uint8, tables []*Table, options TableSetOptions) *TableSet {
+	logCxt := log.WithField("ipVersion", ipVersion)
+	sortedTables := make([]*Table, len(tables))
+	copy(sortedTables, tables)
+	seenNames := map[string]bool{}
+	for _, t := range sortedTables {
+		if t.IPVersion != ipVersion {
+			logCxt.WithField("table", t.Name).Panic("Table has wrong IP version for TableSet")
+		}
+		if seenNames[t.Name] {
+			logCxt.WithField("table", t.Name).Panic("Table added to TableSet more than once")
+		}
+		seenNames[t.Name] = true
+	}
+	sort.SliceStable(sortedTables, func(i, j int) bool {
+		return applyOrderOf(sortedTables[i].Name) < applyOrderOf(sortedTables[j].Name)
+	})
+
+	newCmd := newRealCmd
+	if options.NewCmdOverride != nil {
+		newCmd = options.NewCmdOverride
+	}
+
+	return &TableSet{
+		IPVersion: ipVersion,
+		tables:    sortedTables,
+		logCxt:    logCxt,
+		newCmd:    newCmd,
+	}
+}
+
+// applyOrderOf returns the position of the named table in tableApplyOrder; unknown tables are
+// applied last.
+func applyOrderOf(tableName string) int {
+	if order, ok := tableApplyOrder[tableName]; ok {
+		return order
+	}
+	return len(tableApplyOrder)
+}
+
+// Tables returns the TableSet's Tables, in the order in which they are applied.
+func (s *TableSet) Tables() []*Table {
+	return s.tables
+}
+
+// Table returns the named Table, or nil if the TableSet doesn't have one.
+func (s *TableSet) Table(name string) *Table {
+	for _, t := range s.tables {
+		if t.Name == name {
+			return t
+		}
+	}
+	return nil
+}
+
+// InvalidateDataplaneCache invalidates the dataplane cache of all our Tables so that the next
+// Apply re-reads the dataplane (with a single iptables-save).
+func (s *TableSet) InvalidateDataplaneCache(reason string) {
+	for _, t := range s.tables {
+		t.InvalidateDataplaneCache(reason)
+	}
+}
+
+// Apply applies any queued updates to our Tables.  It returns the soonest time after which
+// Apply should be called again.  Failures are handled as for Table.Apply().
+func (s *TableSet) Apply() (rescheduleAfter time.Duration) {
+	rescheduleAfter, _ = s.ApplyContext(context.Background())
+	return
+}
+
+// ApplyContext is like Apply but it can be interrupted by cancelling the context.  Tables are
+// applied in order and ApplyContext stops at the first Table that returns an error, returning
+// that error; the updates for that Table and any later Tables remain queued.  If a Table is
+// still coalescing updates (see TableOptions.CoalesceWindow), it and the Tables after it are
+// held back so that they are still applied in order.
+func (s *TableSet) ApplyContext(ctx context.Context) (rescheduleAfter time.Duration, err error) {
+	return s.apply(ctx, false)
+}
+
+// Flush is like ApplyContext but it writes any updates that our Tables are coalescing
+// immediately.
+func (s *TableSet) Flush(ctx context.Context) (rescheduleAfter time.Duration, err error) {
+	return s.apply(ctx, true)
+}
+
+func (s *TableSet) apply(ctx context.Context, flush bool) (rescheduleAfter time.Duration, err error) {
+	// Hold all our tables' locks for the whole update so that other goroutines can't update
+	// one table between our reading the dataplane and applying it.
+	for _, t := range s.tables {
+		t.opLock.Lock()
+	}
+	defer func() {
+		for _, t := range s.tables {
+			t.opLock.Unlock()
+		}
+	}()
+
+	tablesToApply := s.tables
+	if !flush {
+		for i, t := range s.tables {
+			if remaining := t.coalesceTimeRemaining(t.timeNow()); remaining > 0 {
+				s.logCxt.WithFields(log.Fields{
+					"table":     t.Name,
+					"remaining": remaining,
+				}).Debug("Table is coalescing updates, holding back it and later tables")
+				tablesToApply = s.tables[:i]
+				rescheduleAfter = remaining
+				break
+			}
+		}
+	}
+
+	s.maybePreloadHashes(tablesToApply)
+
+	defer func() {
+		// If we stopped early, don't leave any preloaded hashes lying around, they'd be
+		// stale by the time that they were used.
+		for _, t := range s.tables {
+			t.preloadedHashes = nil
+		}
+	}()
+
+	for _, t := range tablesToApply {
+		tableReschedAfter, err := t.apply(ctx, flush)
+		if err != nil {
+			return 0, err
+		}
+		if tableReschedAfter != 0 && (rescheduleAfter == 0 || tableReschedAfter < rescheduleAfter) {
+			rescheduleAfter = tableReschedAfter
+		}
+	}
+	return
+}
+
+// maybePreloadHashes checks which of the given Tables are going to re-read the dataplane and, if
+// more than one is, loads the state of all tables with a single iptables-save and hands each
+// Table its share, along with any other Tables whose refresh is nearly due.  If that fails, each
+// Table falls back to doing its own iptables-save.
+func (s *TableSet) maybePreloadHashes(tables []*Table) {
+	var tablesToLoad, tablesToRefresh []*Table
+	for _, t := range tables {
+		t.maybeInvalidateDataplaneCache(t.timeNow())
+		if !t.inSyncWithDataPlane {
+			tablesToLoad = append(tablesToLoad, t)
+		} else if refreshNearlyDue(t) {
+			tablesToRefresh = append(tablesToRefresh, t)
+		}
+	}
+	if len(tablesToLoad) < 2 {
+		// No saving to be had.
+		return
+	}
+	if tablesToLoad[0].saveByListing {
+		// No iptables-save, the tables have to list their own state.
+		return
+	}
+	if len(tablesToRefresh) > 0 {
+		s.logCxt.WithField("numTables", len(tablesToRefresh)).Debug(
+			"Refreshing tables that are nearly due a refresh from the shared iptables-save")
+		tablesToLoad = append(tablesToLoad, tablesToRefresh...)
+	}
+
+	// All our tables are for the same IP version and they share the feature detector so
+	// they'll all have picked the same iptables-save binary.
+	saveCmd := tablesToLoad[0].iptablesSaveCmd
+	s.logCxt.WithField("numTables", len(tablesToLoad)).Info(
+		"Loading current iptables state of all tables.")
+	metrics := tablesToLoad[0].metrics
+	metrics.Add(MetricSaveCalls, 1)
+	output, err := s.newCmd(saveCmd).Output()
+	if err != nil {
+		metrics.Add(MetricSaveErrors, 1)
+		s.logCxt.WithError(err).Warnf("%s command failed, tables will load their own state", saveCmd)
+		return
+	}
+	tableToOutput := splitSaveOutputByTable(output)
+
+	for _, t := range tablesToLoad {
+		tableOutput, ok := tableToOutput[t.Name]
+		if !ok {
+			// iptables-save only outputs tables that are loaded into the kernel.  Leave it
+			// to the Table to load its own state, which will load the table.
+			s.logCxt.WithField("table", t.Name).Debug("Table missing from iptables-save output")
+			continue
+		}
+		hashes, err := t.readHashesFrom(ioutil.NopCloser(bytes.NewReader(tableOutput)))
+		if err != nil {
+			t.logCxt.WithError(err).Warn("Failed to parse shared iptables-save output")
+			continue
+		}
+		t.preloadedHashes = hashes
+		// Make sure that the Table uses the hashes, even if it was in sync.
+		t.inSyncWithDataPlane = false
+	}
+}
+
+// refreshNearlyDue returns true if the Table does periodic refreshes and it is more than half
+// way to its next one.
+func refreshNearlyDue(t *Table) bool {
+	return t.refreshInterval > 0 && t.timeNow().Sub(t.lastReadTime) > t.refreshInterval/2
+}
+
+// splitSaveOutputByTable splits the output of iptables-save (for all tables) into one section
+// per table, indexed by table name.  Each section runs from the "*table" line to the "COMMIT"
+// line.
+func splitSaveOutputByTable(output []byte) map[string][]byte {
+	tableToOutput := map[string][]byte{}
+	var currentTable string
+	var currentOutput bytes.Buffer
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "*") {
+			currentTable = strings.TrimSpace(line[1:])
+			currentOutput.Reset()
+		}
+		if currentTable == "" {
+			// Comments between tables.
+			continue
+		}
+		currentOutput.WriteString(line)
+		currentOutput.WriteString("\n")
+		if line == "COMMIT" {
+			tableToOutput[currentTable] = append([]byte(nil), currentOutput.Bytes()...)
+			currentTable = ""
+		}
+	}
+	return tableToOutput
+}
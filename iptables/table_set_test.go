@@ -0,0 +1,251 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables_test
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/projectcalico/felix/iptables"
+)
+
+var _ = Describe("TableSet", func() {
+	var dataplanes map[string]*mockDataplane
+	var save *multiTableSave
+	var tableSet *TableSet
+	var restoreOrder []string
+	var mangleCoalesceWindow time.Duration
+
+	newTable := func(name string) *Table {
+		return dataplanes[name].newTable(func(options *TableOptions) {
+			options.ReturnErrorOnFailure = true
+			options.ApplyRetries = 1
+			options.RefreshInterval = time.Minute
+			options.PostWriteMaxInterval = time.Second
+			if name == "mangle" {
+				options.CoalesceWindow = mangleCoalesceWindow
+			}
+		})
+	}
+
+	numSaves := func(name string) int {
+		n := 0
+		for _, cmdName := range dataplanes[name].CmdNames {
+			if cmdName == "iptables-save" {
+				n++
+			}
+		}
+		return n
+	}
+
+	recordRestores := func() {
+		for name, dataplane := range dataplanes {
+			name := name
+			dataplane.OnPreRestore = func() {
+				restoreOrder = append(restoreOrder, name)
+			}
+		}
+	}
+
+	buildTableSet := func() {
+		tableSet = NewTableSet(4, []*Table{
+			newTable("filter"),
+			newTable("mangle"),
+			newTable("raw"),
+		}, TableSetOptions{NewCmdOverride: save.newCmd})
+		for _, t := range tableSet.Tables() {
+			t.UpdateChain(&Chain{Name: "cali-" + t.Name, Rules: []Rule{{Action: AcceptAction{}}}})
+		}
+		tableSet.Table("mangle").SetRuleInsertions("PREROUTING", []Rule{{Action: SetMarkAction{Mark: 0x10}}})
+		tableSet.Table("filter").SetRuleInsertions("FORWARD", []Rule{
+			{Match: Match().MarkSet(0x10), Action: JumpAction{Target: "cali-filter"}},
+		})
+	}
+
+	BeforeEach(func() {
+		dataplanes = map[string]*mockDataplane{
+			"filter": newMockDataplane("filter", map[string][]string{"FORWARD": {}, "INPUT": {}, "OUTPUT": {}}),
+			"mangle": newMockDataplane("mangle", map[string][]string{"PREROUTING": {}, "OUTPUT": {}}),
+			"raw":    newMockDataplane("raw", map[string][]string{"PREROUTING": {}, "OUTPUT": {}}),
+		}
+		save = &multiTableSave{
+			Dataplanes: []*mockDataplane{dataplanes["mangle"], dataplanes["filter"], dataplanes["raw"]},
+		}
+		restoreOrder = nil
+		mangleCoalesceWindow = 0
+		buildTableSet()
+	})
+
+	It("should sort its tables into packet-traversal order", func() {
+		var names []string
+		for _, t := range tableSet.Tables() {
+			names = append(names, t.Name)
+		}
+		Expect(names).To(Equal([]string{"raw", "mangle", "filter"}))
+		Expect(tableSet.Table("nat")).To(BeNil())
+	})
+
+	It("should reject tables of the wrong IP version", func() {
+		Expect(func() {
+			NewTableSet(6, []*Table{newTable("filter")}, TableSetOptions{})
+		}).To(Panic())
+	})
+
+	Describe("after the first apply", func() {
+		BeforeEach(func() {
+			recordRestores()
+			_, err := tableSet.ApplyContext(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("should load the state of all tables with one iptables-save", func() {
+			Expect(save.NumCalls).To(Equal(1))
+			for name := range dataplanes {
+				Expect(numSaves(name)).To(BeZero(), name)
+			}
+		})
+
+		It("should program all the tables", func() {
+			for name, dataplane := range dataplanes {
+				Expect(dataplane.Chains["cali-"+name]).To(HaveLen(1), name)
+			}
+			Expect(dataplanes["mangle"].Chains["PREROUTING"]).To(HaveLen(1))
+			Expect(dataplanes["filter"].Chains["FORWARD"]).To(HaveLen(1))
+		})
+
+		It("should apply the tables in order", func() {
+			Expect(restoreOrder).To(Equal([]string{"raw", "mangle", "filter"}))
+		})
+
+		It("should share the iptables-save again when the refresh timer pops", func() {
+			for _, dataplane := range dataplanes {
+				dataplane.AdvanceTimeBy(2 * time.Minute)
+			}
+			tableSet.Apply()
+			Expect(save.NumCalls).To(Equal(2))
+			for name := range dataplanes {
+				Expect(numSaves(name)).To(BeZero(), name)
+			}
+		})
+
+		It("should let a lone table load its own state", func() {
+			tableSet.Table("filter").InvalidateDataplaneCache("test")
+			tableSet.Apply()
+			Expect(save.NumCalls).To(Equal(1))
+			Expect(numSaves("filter")).To(Equal(1))
+			Expect(numSaves("mangle")).To(BeZero())
+		})
+
+		Describe("once the tables' post-write checks are done", func() {
+			BeforeEach(func() {
+				for _, dataplane := range dataplanes {
+					dataplane.AdvanceTimeBy(2 * time.Minute)
+				}
+				tableSet.Apply()
+				Expect(save.NumCalls).To(Equal(2))
+			})
+
+			It("should bring a table whose refresh is nearly due into line with the others", func() {
+				dataplanes["raw"].AdvanceTimeBy(2 * time.Minute)
+				dataplanes["mangle"].AdvanceTimeBy(2 * time.Minute)
+				dataplanes["filter"].AdvanceTimeBy(40 * time.Second)
+				tableSet.Apply()
+				Expect(save.NumCalls).To(Equal(3))
+
+				// The filter table's refresh timer should have been reset by the shared save.
+				dataplanes["filter"].AdvanceTimeBy(30 * time.Second)
+				tableSet.Apply()
+				Expect(save.NumCalls).To(Equal(3))
+				Expect(numSaves("filter")).To(BeZero())
+			})
+
+			It("should leave a table that has recently been refreshed alone", func() {
+				dataplanes["raw"].AdvanceTimeBy(2 * time.Minute)
+				dataplanes["mangle"].AdvanceTimeBy(2 * time.Minute)
+				dataplanes["filter"].AdvanceTimeBy(10 * time.Second)
+				tableSet.Apply()
+				Expect(save.NumCalls).To(Equal(3))
+
+				dataplanes["filter"].AdvanceTimeBy(55 * time.Second)
+				tableSet.Apply()
+				Expect(numSaves("filter")).To(Equal(1))
+			})
+		})
+
+		It("should spot and fix interference found by the shared iptables-save", func() {
+			dataplanes["mangle"].Chains["cali-mangle"] = []string{}
+			tableSet.InvalidateDataplaneCache("test")
+			tableSet.Apply()
+			Expect(save.NumCalls).To(Equal(2))
+			Expect(dataplanes["mangle"].Chains["cali-mangle"]).To(HaveLen(1))
+		})
+	})
+
+	It("should fall back to per-table loads if the shared iptables-save fails", func() {
+		save.FailAll = true
+		_, err := tableSet.ApplyContext(context.Background())
+		Expect(err).NotTo(HaveOccurred())
+		for name, dataplane := range dataplanes {
+			Expect(numSaves(name)).To(Equal(1), name)
+			Expect(dataplane.Chains["cali-"+name]).To(HaveLen(1), name)
+		}
+	})
+
+	It("should stop at the first table that fails", func() {
+		dataplanes["mangle"].FailAllRestores = true
+		_, err := tableSet.ApplyContext(context.Background())
+		Expect(err).To(BeAssignableToTypeOf(&ApplyError{}))
+		Expect(err.(*ApplyError).Table).To(Equal("mangle"))
+		Expect(dataplanes["raw"].Chains).To(HaveKey("cali-raw"))
+		Expect(dataplanes["filter"].Chains).NotTo(HaveKey("cali-filter"))
+
+		dataplanes["mangle"].FailAllRestores = false
+		_, err = tableSet.ApplyContext(context.Background())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(dataplanes["filter"].Chains).To(HaveKey("cali-filter"))
+	})
+
+	Describe("with a table that is coalescing updates", func() {
+		BeforeEach(func() {
+			mangleCoalesceWindow = 100 * time.Millisecond
+			buildTableSet()
+			recordRestores()
+		})
+
+		It("should hold back that table and the ones after it", func() {
+			rescheduleAfter, err := tableSet.ApplyContext(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(rescheduleAfter).To(BeNumerically(">", 0))
+			Expect(rescheduleAfter).To(BeNumerically("<=", 100*time.Millisecond))
+			Expect(restoreOrder).To(Equal([]string{"raw"}))
+
+			for _, dataplane := range dataplanes {
+				dataplane.AdvanceTimeBy(100 * time.Millisecond)
+			}
+			_, err = tableSet.ApplyContext(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(restoreOrder).To(Equal([]string{"raw", "mangle", "filter"}))
+		})
+
+		It("should write all the tables on Flush", func() {
+			_, err := tableSet.Flush(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(restoreOrder).To(Equal([]string{"raw", "mangle", "filter"}))
+		})
+	})
+})
@@ -64,7 +64,7 @@ var _ = Describe("Table with an empty dataplane", func() {
 	})
 
 	It("should have a refresh scheduled at start-of-day", func() {
-		Expect(table.Apply()).To(Equal(50 * time.Millisecond))
+		Expect(rescheduleAfterOf(table.Apply())).To(Equal(50 * time.Millisecond))
 	})
 
 	It("Should defer updates until Apply is called", func() {
@@ -450,7 +450,7 @@ func describePostUpdateCheckTests(enableRefresh bool) {
 		return func() {
 			dataplane.ResetCmds()
 			dataplane.AdvanceTimeBy(amount)
-			requestedDelay = table.Apply()
+			requestedDelay, _ = table.Apply()
 		}
 	}
 	assertRecheck := func() {
@@ -0,0 +1,103 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// tamperCanaryMark is the mark bit used by the canary rule's match.  The rule matches on
+	// the bit being both set and clear so it never matches any packets; the bit doesn't need
+	// to be reserved for our use.
+	tamperCanaryMark = 0x1
+	// TamperCanaryLogPrefix is the log prefix of the canary rule, which makes it easy to spot
+	// in iptables-save output.
+	TamperCanaryLogPrefix = "calico-tamper-canary"
+)
+
+// TamperEvent describes the disappearance of the canary rule from one of the kernel chains
+// that we insert rules into.
+type TamperEvent struct {
+	Table     string
+	IPVersion uint8
+	ChainName string
+	Time      time.Time
+}
+
+// tamperCanaryRule returns the rule that we append to each block of inserted rules when tamper
+// detection is enabled.
+func tamperCanaryRule() Rule {
+	return Rule{
+		Match:   Match().MarkSet(tamperCanaryMark).MarkClear(tamperCanaryMark),
+		Action:  LogAction{Prefix: TamperCanaryLogPrefix},
+		Comment: "Tamper canary, never matches",
+	}
+}
+
+// withTamperCanary returns the given inserted rules with the canary rule appended, if tamper
+// detection is enabled.
+func (t *Table) withTamperCanary(rules []Rule) []Rule {
+	if !t.tamperDetection || len(rules) == 0 {
+		return rules
+	}
+	rulesWithCanary := make([]Rule, 0, len(rules)+1)
+	rulesWithCanary = append(rulesWithCanary, rules...)
+	return append(rulesWithCanary, tamperCanaryRule())
+}
+
+// checkTamperCanary is called during resync for each kernel chain that we insert rules into.
+// If the canary rule was in the dataplane after our last write and it has now gone, another
+// process has removed our rules.  Accidental clobbering tends to be repaired without fuss; to
+// help spot deliberate tampering, we count and report it.
+func (t *Table) checkTamperCanary(chainName string, previousHashes, dataplaneHashes []string) {
+	if !t.tamperDetection {
+		return
+	}
+	insertedRules := t.chainToInsertedRules[chainName]
+	if len(insertedRules) == 0 {
+		return
+	}
+	ourHashes := t.calculateRuleInsertHashes(chainName, insertedRules, t.featureDetector.GetFeatures())
+	canaryHash := ourHashes[len(ourHashes)-1]
+	if !containsString(previousHashes, canaryHash) || containsString(dataplaneHashes, canaryHash) {
+		return
+	}
+	t.metrics.Add(MetricTamperDetected, 1)
+	event := TamperEvent{
+		Table:     t.Name,
+		IPVersion: t.IPVersion,
+		ChainName: chainName,
+		Time:      t.timeNow(),
+	}
+	t.logCxt.WithFields(log.Fields{
+		"chainName":     chainName,
+		"dataplaneHash": dataplaneHashes,
+	}).Error("Tamper canary rule is missing; another process removed our rules from the chain")
+	if t.onTamperDetected != nil {
+		t.onTamperDetected(event)
+	}
+}
+
+func containsString(strs []string, s string) bool {
+	for _, s2 := range strs {
+		if s2 == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,115 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/projectcalico/felix/iptables"
+)
+
+var _ = Describe("Table tamper detection", func() {
+	var dataplane *mockDataplane
+	var table *Table
+	var events []TamperEvent
+
+	newTable := func(tamperDetection bool) {
+		table = dataplane.newTable(func(options *TableOptions) {
+			options.TamperDetection = tamperDetection
+			options.OnTamperDetected = func(event TamperEvent) {
+				events = append(events, event)
+			}
+		})
+		table.SetRuleInsertions("FORWARD", []Rule{{Action: JumpAction{Target: "cali-FORWARD"}}})
+		table.UpdateChain(&Chain{Name: "cali-FORWARD", Rules: []Rule{{Action: AcceptAction{}}}})
+		table.Apply()
+	}
+
+	BeforeEach(func() {
+		dataplane = newMockDataplane("filter", map[string][]string{
+			"FORWARD": {"-j kube-forward"},
+			"INPUT":   {},
+			"OUTPUT":  {},
+		})
+		events = nil
+	})
+
+	Describe("when enabled", func() {
+		BeforeEach(func() {
+			newTable(true)
+		})
+
+		It("should append the canary to our inserted rules", func() {
+			Expect(dataplane.Chains["FORWARD"]).To(HaveLen(3))
+			Expect(dataplane.Chains["FORWARD"][0]).To(ContainSubstring("--jump cali-FORWARD"))
+			Expect(dataplane.Chains["FORWARD"][1]).To(ContainSubstring(TamperCanaryLogPrefix))
+			Expect(dataplane.Chains["FORWARD"][2]).To(Equal("-j kube-forward"))
+		})
+
+		It("should not report anything if the dataplane is intact", func() {
+			table.InvalidateDataplaneCache("test")
+			table.Apply()
+			Expect(events).To(BeEmpty())
+		})
+
+		It("should report and repair removal of our rules", func() {
+			dataplane.Chains["FORWARD"] = []string{"-j kube-forward"}
+			table.InvalidateDataplaneCache("test")
+			table.Apply()
+			Expect(events).To(HaveLen(1))
+			Expect(events[0].Table).To(Equal("filter"))
+			Expect(events[0].IPVersion).To(Equal(uint8(4)))
+			Expect(events[0].ChainName).To(Equal("FORWARD"))
+			Expect(dataplane.Chains["FORWARD"]).To(HaveLen(3))
+
+			// Once repaired, there's nothing more to report.
+			table.InvalidateDataplaneCache("test")
+			table.Apply()
+			Expect(events).To(HaveLen(1))
+		})
+
+		It("should report removal of just the canary", func() {
+			dataplane.Chains["FORWARD"] = []string{dataplane.Chains["FORWARD"][0], "-j kube-forward"}
+			table.InvalidateDataplaneCache("test")
+			table.Apply()
+			Expect(events).To(HaveLen(1))
+		})
+
+		It("should not report our own removal of the inserts", func() {
+			table.SetRuleInsertions("FORWARD", nil)
+			table.Apply()
+			Expect(dataplane.Chains["FORWARD"]).To(Equal([]string{"-j kube-forward"}))
+			table.InvalidateDataplaneCache("test")
+			table.Apply()
+			Expect(events).To(BeEmpty())
+		})
+	})
+
+	Describe("when disabled", func() {
+		BeforeEach(func() {
+			newTable(false)
+		})
+
+		It("should not add the canary or report removals", func() {
+			Expect(dataplane.Chains["FORWARD"]).To(HaveLen(2))
+			dataplane.Chains["FORWARD"] = []string{"-j kube-forward"}
+			table.InvalidateDataplaneCache("test")
+			table.Apply()
+			Expect(events).To(BeEmpty())
+			Expect(dataplane.Chains["FORWARD"]).To(HaveLen(2))
+		})
+	})
+})
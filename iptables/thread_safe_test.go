@@ -0,0 +1,99 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables_test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/projectcalico/felix/iptables"
+)
+
+var _ = Describe("ThreadSafe Table", func() {
+	var dataplane *mockDataplane
+	var table *Table
+
+	BeforeEach(func() {
+		dataplane = newMockDataplane("filter", map[string][]string{
+			"FORWARD": {},
+			"INPUT":   {},
+			"OUTPUT":  {},
+		})
+		table = dataplane.newTable(func(options *TableOptions) {
+			options.ThreadSafe = true
+		})
+	})
+
+	It("should handle updates and applies from several goroutines", func() {
+		const numWorkers = 8
+		var wg sync.WaitGroup
+		for i := 0; i < numWorkers; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer GinkgoRecover()
+				defer wg.Done()
+				chainName := fmt.Sprintf("cali-worker-%d", i)
+				for j := 0; j < 10; j++ {
+					table.UpdateChain(&Chain{
+						Name:  chainName,
+						Rules: []Rule{{Action: DropAction{}, Comment: fmt.Sprintf("update-%d", j)}},
+					})
+					_, err := table.ApplyContext(context.Background())
+					Expect(err).NotTo(HaveOccurred())
+					table.QuarantinedChains()
+					table.Snapshot()
+				}
+			}(i)
+		}
+		wg.Wait()
+
+		_, err := table.ApplyContext(context.Background())
+		Expect(err).NotTo(HaveOccurred())
+		for i := 0; i < numWorkers; i++ {
+			chainName := fmt.Sprintf("cali-worker-%d", i)
+			Expect(dataplane.Chains[chainName]).To(HaveLen(1))
+			Expect(dataplane.Chains[chainName][0]).To(ContainSubstring("update-9"))
+		}
+	})
+
+	It("should allow the TableSet to apply it while another goroutine updates it", func() {
+		tableSet := NewTableSet(4, []*Table{table}, TableSetOptions{NewCmdOverride: dataplane.newCmd})
+		done := make(chan struct{})
+		go func() {
+			defer GinkgoRecover()
+			defer close(done)
+			for j := 0; j < 10; j++ {
+				table.UpdateChain(&Chain{
+					Name:  "cali-foo",
+					Rules: []Rule{{Action: DropAction{}, Comment: fmt.Sprintf("update-%d", j)}},
+				})
+			}
+		}()
+		for j := 0; j < 10; j++ {
+			_, err := tableSet.ApplyContext(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+		}
+		<-done
+
+		_, err := tableSet.ApplyContext(context.Background())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(dataplane.Chains["cali-foo"]).To(HaveLen(1))
+		Expect(dataplane.Chains["cali-foo"][0]).To(ContainSubstring("update-9"))
+	})
+})
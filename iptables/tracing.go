@@ -0,0 +1,79 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"context"
+	"sync"
+)
+
+// Names of the spans that the Table reports to its Tracer.  Each apply cycle is a span, with
+// child spans for loading the dataplane state, rendering the iptables-restore input, running
+// iptables-restore and waiting for the xtables lock.
+const (
+	SpanApply    = "iptables.apply"
+	SpanSave     = "iptables.save"
+	SpanRender   = "iptables.render"
+	SpanRestore  = "iptables.restore"
+	SpanLockWait = "iptables.lock-wait"
+)
+
+// Tracer is implemented by tracing backends that want to trace the Table's apply cycles.  The
+// Table passes the span context down through the context that it is given so that a caller can
+// start its own span (for example, covering a whole dataplane update) and the Table's spans
+// will be its children.
+type Tracer interface {
+	// StartSpan starts a span with the given name, as a child of the span in ctx, if any, and
+	// returns a context that contains the new span.
+	StartSpan(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is a span that has been started by a Tracer.
+type Span interface {
+	SetAttribute(key string, value interface{})
+	// End ends the span, recording err, if non-nil, as its status.
+	End(err error)
+}
+
+type noopTracer struct{}
+
+func (noopTracer) StartSpan(ctx context.Context, name string) (context.Context, Span) {
+	return ctx, noopSpan{}
+}
+
+type noopSpan struct{}
+
+func (noopSpan) SetAttribute(key string, value interface{}) {}
+
+func (noopSpan) End(err error) {}
+
+// tracedLocker wraps a lock, reporting the time spent waiting to acquire it as a span.
+type tracedLocker struct {
+	sync.Locker
+	ctx    context.Context
+	tracer Tracer
+}
+
+func (l tracedLocker) Lock() {
+	_, span := l.tracer.StartSpan(l.ctx, SpanLockWait)
+	l.Locker.Lock()
+	span.End(nil)
+}
+
+// xtablesLock returns our xtables lock, wrapped so that waiting for it is traced as a child of
+// the span in ctx.
+func (t *Table) xtablesLock(ctx context.Context) sync.Locker {
+	return tracedLocker{Locker: t.calicoXtablesLock, ctx: ctx, tracer: t.tracer}
+}
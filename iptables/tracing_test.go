@@ -0,0 +1,134 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables_test
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/projectcalico/felix/iptables"
+)
+
+type recordedSpan struct {
+	name       string
+	parent     *recordedSpan
+	attributes map[string]interface{}
+	ended      bool
+	err        error
+}
+
+func (s *recordedSpan) SetAttribute(key string, value interface{}) {
+	s.attributes[key] = value
+}
+
+func (s *recordedSpan) End(err error) {
+	s.ended = true
+	s.err = err
+}
+
+type recordedSpanKey struct{}
+
+type recordingTracer struct {
+	spans []*recordedSpan
+}
+
+func (t *recordingTracer) StartSpan(ctx context.Context, name string) (context.Context, Span) {
+	parent, _ := ctx.Value(recordedSpanKey{}).(*recordedSpan)
+	span := &recordedSpan{name: name, parent: parent, attributes: map[string]interface{}{}}
+	t.spans = append(t.spans, span)
+	return context.WithValue(ctx, recordedSpanKey{}, span), span
+}
+
+func (t *recordingTracer) names() []string {
+	var names []string
+	for _, s := range t.spans {
+		names = append(names, s.name)
+	}
+	return names
+}
+
+var _ = Describe("Table tracing", func() {
+	var dataplane *mockDataplane
+	var table *Table
+	var tracer *recordingTracer
+
+	BeforeEach(func() {
+		dataplane = newMockDataplane("filter", map[string][]string{
+			"FORWARD": {},
+			"INPUT":   {},
+			"OUTPUT":  {},
+		})
+		tracer = &recordingTracer{}
+		table = dataplane.newTable(func(options *TableOptions) {
+			options.Tracer = tracer
+		})
+		table.UpdateChain(&Chain{Name: "cali-foo", Rules: []Rule{{Action: DropAction{}}}})
+	})
+
+	It("should trace each phase of the apply as a child of the caller's span", func() {
+		ctx, parent := tracer.StartSpan(context.Background(), "dataplane.apply")
+		_, err := table.ApplyContext(ctx)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(tracer.names()).To(Equal([]string{
+			"dataplane.apply", SpanApply, SpanSave, SpanRender, SpanRestore, SpanLockWait,
+		}))
+		apply := tracer.spans[1]
+		Expect(apply.parent).To(BeIdenticalTo(parent))
+		Expect(apply.attributes).To(HaveKeyWithValue("iptables.table", "filter"))
+		Expect(apply.attributes).To(HaveKeyWithValue("iptables.ip_version", 4))
+		for _, s := range tracer.spans[1:] {
+			Expect(s.ended).To(BeTrue(), s.name)
+			Expect(s.err).NotTo(HaveOccurred(), s.name)
+		}
+		Expect(tracer.spans[2].parent).To(BeIdenticalTo(apply))
+		Expect(tracer.spans[3].parent).To(BeIdenticalTo(apply))
+		Expect(tracer.spans[3].attributes).To(HaveKeyWithValue("iptables.dirty_chains", 1))
+		Expect(tracer.spans[4].parent).To(BeIdenticalTo(apply))
+		Expect(tracer.spans[5].parent).To(BeIdenticalTo(tracer.spans[4]))
+	})
+
+	It("should only trace the render if there's nothing to write", func() {
+		table.Apply()
+		tracer.spans = nil
+		table.Apply()
+		Expect(tracer.names()).To(Equal([]string{SpanApply, SpanRender}))
+	})
+
+	It("should record the error on a failed restore", func() {
+		dataplane.FailNextRestore = true
+		table.Apply()
+		var restoreSpans []*recordedSpan
+		for _, s := range tracer.spans {
+			if s.name == SpanRestore {
+				restoreSpans = append(restoreSpans, s)
+			}
+		}
+		Expect(restoreSpans).To(HaveLen(2))
+		Expect(restoreSpans[0].err).To(HaveOccurred())
+		Expect(restoreSpans[1].err).NotTo(HaveOccurred())
+	})
+
+	It("should record the error on the apply span", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err := table.ApplyContext(ctx)
+		Expect(err).To(Equal(context.Canceled))
+		Expect(tracer.spans[0].name).To(Equal(SpanApply))
+		Expect(tracer.spans[0].err).To(Equal(err))
+	})
+})
@@ -0,0 +1,99 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Tuning holds the Table parameters that can be changed after the Table has been created.  See
+// the TableOptions fields of the same names.
+type Tuning struct {
+	RefreshInterval   time.Duration
+	InsertMode        string
+	LockTimeout       time.Duration
+	LockProbeInterval time.Duration
+	// HashCommentPrefix is the prefix of our rule-tracking comments, as passed to NewTable.
+	// When updating, empty leaves the prefix unchanged; see hash_prefix.go for how a change
+	// is handled.
+	HashCommentPrefix string
+}
+
+// normaliseInsertMode converts an InsertMode option to "insert" or "append".
+func normaliseInsertMode(mode string) (string, error) {
+	switch mode {
+	case "", "insert":
+		return "insert", nil
+	case "append":
+		return "append", nil
+	}
+	return "", fmt.Errorf("unknown insert mode %q", mode)
+}
+
+// Tuning returns the Table's current tuning parameters.
+func (t *Table) Tuning() Tuning {
+	t.opLock.Lock()
+	defer t.opLock.Unlock()
+
+	return Tuning{
+		RefreshInterval:   t.refreshInterval,
+		InsertMode:        t.insertMode,
+		LockTimeout:       t.lockTimeout,
+		LockProbeInterval: t.lockProbeInterval,
+		HashCommentPrefix: t.hashCommentPrefix,
+	}
+}
+
+// UpdateTuning changes the Table's tuning parameters.  After a change of insert mode, the next
+// Apply() moves our inserted rules if they're no longer in an acceptable position; in append
+// mode, inserted rules at the top of the chain are acceptable so they're left in place.
+// Returns an error, without changing anything, if the insert mode or hash comment prefix is
+// invalid.
+func (t *Table) UpdateTuning(tuning Tuning) error {
+	insertMode, err := normaliseInsertMode(tuning.InsertMode)
+	if err != nil {
+		return err
+	}
+	if err := checkPrintable("HashCommentPrefix", tuning.HashCommentPrefix); err != nil {
+		return err
+	}
+
+	t.opLock.Lock()
+	defer t.opLock.Unlock()
+
+	t.logCxt.WithFields(log.Fields{
+		"refreshInterval":   tuning.RefreshInterval,
+		"insertMode":        insertMode,
+		"lockTimeout":       tuning.LockTimeout,
+		"lockProbeInterval": tuning.LockProbeInterval,
+		"hashCommentPrefix": tuning.HashCommentPrefix,
+	}).Info("Updating tuning parameters")
+	if insertMode != t.insertMode {
+		t.insertMode = insertMode
+		for chainName := range t.chainToInsertedRules {
+			t.dirtyInserts.Add(chainName)
+		}
+	}
+	t.refreshInterval = tuning.RefreshInterval
+	t.lockTimeout = tuning.LockTimeout
+	t.lockProbeInterval = tuning.LockProbeInterval
+	if tuning.HashCommentPrefix != "" {
+		t.setHashCommentPrefix(tuning.HashCommentPrefix)
+	}
+	return nil
+}
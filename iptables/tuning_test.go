@@ -0,0 +1,66 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables_test
+
+import (
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/projectcalico/felix/iptables"
+)
+
+var _ = Describe("Table tuning updates", func() {
+	var dataplane *mockDataplane
+	var table *Table
+
+	BeforeEach(func() {
+		dataplane = newMockDataplane("filter", map[string][]string{
+			"FORWARD": {"-j other-rule"},
+		})
+		table = dataplane.newTable(func(options *TableOptions) {
+			options.RefreshInterval = time.Minute
+			options.InsertMode = "append"
+		})
+		table.SetRuleInsertions("FORWARD", []Rule{{Action: DropAction{}}})
+		table.Apply()
+		Expect(dataplane.Chains["FORWARD"]).To(HaveLen(2))
+		Expect(dataplane.Chains["FORWARD"][0]).To(Equal("-j other-rule"))
+	})
+
+	It("should move our inserts when the insert mode changes", func() {
+		Expect(table.UpdateTuning(Tuning{RefreshInterval: time.Minute, InsertMode: "insert"})).To(Succeed())
+		table.Apply()
+		Expect(dataplane.Chains["FORWARD"]).To(HaveLen(2))
+		Expect(strings.Contains(dataplane.Chains["FORWARD"][0], "DROP")).To(BeTrue())
+		Expect(dataplane.Chains["FORWARD"][1]).To(Equal("-j other-rule"))
+	})
+
+	It("should use the new refresh interval", func() {
+		Expect(table.UpdateTuning(Tuning{RefreshInterval: 10 * time.Second, InsertMode: "append"})).To(Succeed())
+		Expect(rescheduleAfterOf(table.Apply())).To(BeNumerically("<=", 10*time.Second))
+	})
+
+	It("should reject an unknown insert mode", func() {
+		Expect(table.UpdateTuning(Tuning{InsertMode: "sideways"})).NotTo(Succeed())
+		Expect(table.Tuning()).To(Equal(Tuning{
+			RefreshInterval:   time.Minute,
+			InsertMode:        "append",
+			HashCommentPrefix: "cali:",
+		}))
+	})
+})
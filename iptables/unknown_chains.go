@@ -0,0 +1,102 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"context"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// unknownChainGraceRemaining is called when the given chain, which looks like one of ours, is
+// found in the dataplane but we haven't been asked to program it.  It returns how much longer
+// the chain should be left in place, starting the chain's grace period if this is the first
+// time that we've found it.  If the grace period is disabled, it returns 0.
+func (t *Table) unknownChainGraceRemaining(chainName string) time.Duration {
+	if t.unknownChainGracePeriod <= 0 {
+		return 0
+	}
+	now := t.timeNow()
+	firstSeen, ok := t.unknownChainFirstSeen[chainName]
+	if !ok {
+		firstSeen = now
+		t.unknownChainFirstSeen[chainName] = now
+	}
+	remaining := firstSeen.Add(t.unknownChainGracePeriod).Sub(now)
+	if remaining > 0 {
+		t.logCxt.WithFields(log.Fields{
+			"chainName": chainName,
+			"remaining": remaining,
+		}).Info("Found unexpected chain, leaving it in place until its grace period expires")
+	}
+	return remaining
+}
+
+// nextUnknownChainGraceExpiry returns the time until the first of the unknown chains' grace
+// periods expires.  The second return value is false if there are no such chains or if we're
+// keeping them anyway.
+func (t *Table) nextUnknownChainGraceExpiry(now time.Time) (remaining time.Duration, ok bool) {
+	if t.keepUnknownChains {
+		return 0, false
+	}
+	for _, firstSeen := range t.unknownChainFirstSeen {
+		chainRemaining := firstSeen.Add(t.unknownChainGracePeriod).Sub(now)
+		if !ok || chainRemaining < remaining {
+			remaining = chainRemaining
+			ok = true
+		}
+	}
+	return
+}
+
+// KeepUnknownChains stops us from removing the chains that look like ours but that we haven't
+// been asked to program, for example, while we're programming an incomplete picture of the
+// desired state.  Calling it with keep false restarts the removal, from the next Apply().  It
+// doesn't affect the kernel chains that we insert rules into; we rewrite our inserts as usual.
+func (t *Table) KeepUnknownChains(keep bool) {
+	t.opLock.Lock()
+	defer t.opLock.Unlock()
+	if t.keepUnknownChains == keep {
+		return
+	}
+	t.keepUnknownChains = keep
+	if !keep {
+		// Re-scan the dataplane for the chains that we left in place.
+		t.requestInvalidation("removing unknown chains again")
+	}
+}
+
+// HasOurRules reads the dataplane and returns true if it has any of our chains, or any of our
+// rules in other chains, for example, from a previous run of Felix.
+func (t *Table) HasOurRules() (bool, error) {
+	t.opLock.Lock()
+	defer t.opLock.Unlock()
+	hashes, err := t.getHashesFromDataplane(context.Background())
+	if err != nil {
+		return false, err
+	}
+	for chainName, chainHashes := range hashes {
+		if t.ourChainsRegexp.MatchString(chainName) {
+			return true, nil
+		}
+		for _, hash := range chainHashes {
+			if hash != "" {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,132 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables_test
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/projectcalico/felix/iptables"
+)
+
+var _ = Describe("Table unknown chain grace period", func() {
+	var dataplane *mockDataplane
+	var table *Table
+
+	newTable := func(gracePeriod time.Duration) {
+		table = dataplane.newTable(func(options *TableOptions) {
+			// Disable the post-write rechecks so that we only re-read the dataplane when
+			// the grace period expires.
+			options.PostWriteInterval = time.Hour
+			options.UnknownChainGracePeriod = gracePeriod
+		})
+	}
+
+	apply := func() time.Duration {
+		rescheduleAfter, err := table.ApplyContext(context.Background())
+		Expect(err).NotTo(HaveOccurred())
+		return rescheduleAfter
+	}
+
+	BeforeEach(func() {
+		dataplane = newMockDataplane("filter", map[string][]string{
+			"FORWARD":  {},
+			"INPUT":    {},
+			"OUTPUT":   {},
+			"cali-new": {"-m comment --comment \"cali:abcdefghij1234-_\" -j ACCEPT"},
+		})
+	})
+
+	Describe("with a 10s grace period", func() {
+		BeforeEach(func() {
+			newTable(10 * time.Second)
+		})
+
+		It("should leave the unknown chain until the grace period expires", func() {
+			Expect(apply()).To(Equal(10 * time.Second))
+			Expect(dataplane.Chains).To(HaveKey("cali-new"))
+
+			dataplane.AdvanceTimeBy(5 * time.Second)
+			table.InvalidateDataplaneCache("test")
+			Expect(apply()).To(Equal(5 * time.Second))
+			Expect(dataplane.Chains).To(HaveKey("cali-new"))
+
+			dataplane.AdvanceTimeBy(5 * time.Second)
+			Expect(apply()).To(BeZero())
+			Expect(dataplane.Chains).NotTo(HaveKey("cali-new"))
+		})
+
+		It("should take over the chain if asked to program it during the grace period", func() {
+			apply()
+			table.UpdateChain(&Chain{Name: "cali-new", Rules: []Rule{{Action: DropAction{}}}})
+			Expect(apply()).To(BeZero())
+			dataplane.AdvanceTimeBy(20 * time.Second)
+			table.InvalidateDataplaneCache("test")
+			apply()
+			Expect(dataplane.Chains["cali-new"]).To(HaveLen(1))
+			Expect(dataplane.Chains["cali-new"][0]).To(HaveSuffix("--jump DROP"))
+		})
+
+		It("should forget the chain if it is removed by someone else", func() {
+			apply()
+			delete(dataplane.Chains, "cali-new")
+			table.InvalidateDataplaneCache("test")
+			Expect(apply()).To(BeZero())
+		})
+
+		It("should still delete chains that we programmed immediately", func() {
+			table.UpdateChain(&Chain{Name: "cali-ours", Rules: []Rule{{Action: DropAction{}}}})
+			apply()
+			Expect(dataplane.Chains).To(HaveKey("cali-ours"))
+			table.RemoveChainByName("cali-ours")
+			apply()
+			Expect(dataplane.Chains).NotTo(HaveKey("cali-ours"))
+			Expect(dataplane.Chains).To(HaveKey("cali-new"))
+		})
+	})
+
+	Describe("with the grace period disabled", func() {
+		BeforeEach(func() {
+			newTable(0)
+		})
+
+		It("should delete the unknown chain straight away", func() {
+			Expect(apply()).To(BeZero())
+			Expect(dataplane.Chains).NotTo(HaveKey("cali-new"))
+		})
+
+		It("should find our rules in the dataplane", func() {
+			Expect(table.HasOurRules()).To(BeTrue())
+			delete(dataplane.Chains, "cali-new")
+			Expect(table.HasOurRules()).To(BeFalse())
+		})
+
+		It("should keep unknown chains until told to remove them again", func() {
+			table.KeepUnknownChains(true)
+			table.UpdateChain(&Chain{Name: "cali-ours", Rules: []Rule{{Action: DropAction{}}}})
+			apply()
+			Expect(dataplane.Chains).To(HaveKey("cali-new"))
+			Expect(dataplane.Chains).To(HaveKey("cali-ours"))
+
+			table.KeepUnknownChains(false)
+			apply()
+			Expect(dataplane.Chains).NotTo(HaveKey("cali-new"))
+			Expect(dataplane.Chains).To(HaveKey("cali-ours"))
+		})
+	})
+})
@@ -0,0 +1,63 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// unmanagedChainsForTable picks out the chains that belong to the given table from a list of
+// "<table>/<chain>" entries (see TableOptions.UnmanagedChains).
+func unmanagedChainsForTable(tableName string, entries []string) map[string]bool {
+	return chainsForTable(tableName, entries, "unmanaged chain")
+}
+
+// chainsForTable picks out the chains that belong to the given table from a list of
+// "<table>/<chain>" entries.  kind describes the list for logging.
+func chainsForTable(tableName string, entries []string, kind string) map[string]bool {
+	chains := map[string]bool{}
+	for _, entry := range entries {
+		parts := strings.SplitN(entry, "/", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			log.WithFields(log.Fields{"entry": entry, "kind": kind}).Warn(
+				"Ignoring chain entry, expected <table>/<chain>, for example, mangle/POSTROUTING")
+			continue
+		}
+		if parts[0] != tableName {
+			continue
+		}
+		chains[parts[1]] = true
+	}
+	return chains
+}
+
+// isUnmanagedChain returns true if we've been told to leave the given chain alone: we neither
+// insert rules into it nor clean up rules that look like ours.
+func (t *Table) isUnmanagedChain(chainName string) bool {
+	return t.unmanagedChains[chainName]
+}
+
+// sortedUnmanagedChains returns the chains that we leave alone, sorted by name.
+func (t *Table) sortedUnmanagedChains() []string {
+	chains := make([]string, 0, len(t.unmanagedChains))
+	for chainName := range t.unmanagedChains {
+		chains = append(chains, chainName)
+	}
+	sort.Strings(chains)
+	return chains
+}
@@ -0,0 +1,71 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/projectcalico/felix/iptables"
+)
+
+var _ = Describe("Table unmanaged chains", func() {
+	// A rule that looks like one of ours, as written by another agent that uses the same
+	// hash prefix.
+	const otherAgentRule = `-m comment --comment "cali:abcdefghij1234-_" --jump other-agent`
+
+	var dataplane *mockDataplane
+	var table *Table
+
+	BeforeEach(func() {
+		dataplane = newMockDataplane("filter", map[string][]string{
+			"FORWARD": {otherAgentRule},
+			"INPUT":   {otherAgentRule},
+			"OUTPUT":  {},
+		})
+		table = dataplane.newTable(func(options *TableOptions) {
+			options.UnmanagedChains = []string{"filter/FORWARD", "mangle/INPUT", "bad-entry"}
+		})
+		table.Apply()
+	})
+
+	It("should leave rules in an unmanaged chain alone", func() {
+		Expect(dataplane.Chains["FORWARD"]).To(Equal([]string{otherAgentRule}))
+	})
+
+	It("should still clean up managed chains", func() {
+		// The mangle/INPUT entry is for another table.
+		Expect(dataplane.Chains["INPUT"]).To(BeEmpty())
+	})
+
+	It("should ignore inserts into an unmanaged chain", func() {
+		table.SetRuleInsertions("FORWARD", []Rule{{Action: DropAction{}}})
+		table.SetRuleInsertions("INPUT", []Rule{{Action: DropAction{}}})
+		table.Apply()
+		Expect(dataplane.Chains["FORWARD"]).To(Equal([]string{otherAgentRule}))
+		Expect(dataplane.Chains["INPUT"]).To(HaveLen(1))
+	})
+
+	It("should leave the chain alone on resync", func() {
+		dataplane.Chains["FORWARD"] = append(dataplane.Chains["FORWARD"], otherAgentRule)
+		table.InvalidateDataplaneCache("test")
+		table.Apply()
+		Expect(dataplane.Chains["FORWARD"]).To(HaveLen(2))
+	})
+
+	It("should list the unmanaged chains in the snapshot", func() {
+		Expect(table.Snapshot().UnmanagedChains).To(Equal([]string{"FORWARD"}))
+	})
+})
@@ -21,6 +21,7 @@ import (
 	"io"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	. "github.com/onsi/ginkgo"
@@ -37,9 +38,11 @@ func newMockDataplane(table string, chains map[string][]string) *mockDataplane {
 	return &mockDataplane{
 		Table:         table,
 		Chains:        chains,
+		Policies:      map[string]string{},
 		FlushedChains: set.New(),
 		ChainMods:     set.New(),
 		DeletedChains: set.New(),
+		RenamedChains: set.New(),
 	}
 }
 
@@ -51,14 +54,17 @@ type chainMod struct {
 type mockDataplane struct {
 	Table                  string
 	Chains                 map[string][]string
+	Policies               map[string]string
 	FlushedChains          set.Set
 	ChainMods              set.Set
 	DeletedChains          set.Set
+	RenamedChains          set.Set
 	Cmds                   []CmdIface
 	CmdNames               []string
 	FailNextRestore        bool
 	FailAllRestores        bool
 	OnPreRestore           func()
+	OnPostRestore          func()
 	FailNextSaveRead       bool
 	FailNextSaveStdoutPipe bool
 	FailNextKill           bool
@@ -68,6 +74,21 @@ type mockDataplane struct {
 	PipeBuffers            []*closableBuffer
 	CumulativeSleep        time.Duration
 	Time                   time.Time
+
+	// RejectLinesContaining, if set, causes iptables-restore to fail, reporting the number of
+	// the first input line that contains the string, as the real iptables-restore does.
+	RejectLinesContaining string
+	// TestModeUnsupported causes "iptables-restore --test" to fail as if --test isn't a
+	// valid option.
+	TestModeUnsupported bool
+	// NumTestRestores counts the "iptables-restore --test" runs.
+	NumTestRestores int
+	// Counters maps from rule text to the "[packets:bytes]" counters that "iptables-save -c"
+	// reports for it; "[0:0]" if missing.  "iptables-restore --counters" records the counters
+	// of the rules that it writes here.
+	Counters map[string]string
+	// NumChecks counts the "iptables -C" runs.
+	NumChecks int
 }
 
 func (d *mockDataplane) ResetCmds() {
@@ -94,14 +115,52 @@ func (d *mockDataplane) newCmd(name string, arg ...string) CmdIface {
 
 	switch name {
 	case "iptables-restore", "ip6tables-restore":
+		test := len(arg) > 0 && arg[len(arg)-1] == "--test"
+		if test {
+			arg = arg[:len(arg)-1]
+		}
+		counters := len(arg) > 0 && arg[len(arg)-1] == "--counters"
+		if counters {
+			arg = arg[:len(arg)-1]
+		}
 		Expect(arg).To(Equal([]string{"--noflush", "--verbose"}))
 		cmd = &restoreCmd{
 			Dataplane: d,
+			Test:      test,
+			Counters:  counters,
 		}
 	case "iptables-save", "ip6tables-save":
+		counters := len(arg) > 0 && arg[0] == "-c"
+		if counters {
+			arg = arg[1:]
+		}
 		Expect(arg).To(Equal([]string{"-t", d.Table}))
 		cmd = &saveCmd{
 			Dataplane: d,
+			Counters:  counters,
+		}
+	case "iptables", "ip6tables":
+		Expect(len(arg)).To(BeNumerically(">=", 3))
+		Expect(arg[:2]).To(Equal([]string{"-t", d.Table}))
+		switch arg[2] {
+		case "-C":
+			Expect(len(arg)).To(BeNumerically(">=", 4))
+			cmd = &checkCmd{
+				Dataplane: d,
+				Chain:     arg[3],
+				Rule:      strings.Join(arg[4:], " "),
+			}
+		case "-S":
+			Expect(arg).To(HaveLen(3))
+			cmd = &saveCmd{
+				Dataplane: d,
+				List:      true,
+			}
+		default:
+			cmd = &perRuleCmd{
+				Dataplane: d,
+				Args:      arg[2:],
+			}
 		}
 	default:
 		Fail(fmt.Sprintf("Unexpected command %v", name))
@@ -112,6 +171,58 @@ func (d *mockDataplane) newCmd(name string, arg ...string) CmdIface {
 	return cmd
 }
 
+// lookPath only finds the plain iptables, iptables-restore and iptables-save binaries so that
+// the Table under test always uses the command names that newCmd expects.
+func (d *mockDataplane) lookPath(file string) (string, error) {
+	if strings.Contains(file, "-legacy") || strings.Contains(file, "-nft") {
+		return "", errors.New("not found")
+	}
+	return file, nil
+}
+
+// newFeatureDetector returns a FeatureDetector that simulates an iptables version that doesn't
+// support the xtables lock in iptables-restore, so the restore command's arguments are
+// predictable.  Its commands aren't recorded in CmdNames.
+func (d *mockDataplane) newFeatureDetector() *FeatureDetector {
+	detector := NewFeatureDetector()
+	detector.NewCmd = func(name string, arg ...string) CmdIface {
+		Expect(arg).To(Equal([]string{"--version"}))
+		return &versionCmd{}
+	}
+	detector.GetKernelVersionReader = func() (io.Reader, error) {
+		return strings.NewReader("Linux version 4.15.0 (dummy)"), nil
+	}
+	detector.KernelModuleAvailable = func(module string) bool {
+		return false
+	}
+	return detector
+}
+
+// newTable creates an IPv4 Table, with the "cali:" hash prefix, that uses the mock dataplane.
+// setOptions, if not nil, sets the options that the test exercises.
+func (d *mockDataplane) newTable(setOptions func(options *TableOptions)) *Table {
+	return d.newCustomTable(4, "cali:", setOptions)
+}
+
+// newCustomTable is like newTable but for the given IP version and hash prefix.
+func (d *mockDataplane) newCustomTable(
+	ipVersion uint8,
+	hashPrefix string,
+	setOptions func(options *TableOptions),
+) *Table {
+	options := TableOptions{
+		HistoricChainPrefixes: []string{"cali-"},
+		NewCmdOverride:        d.newCmd,
+		SleepOverride:         d.sleep,
+		NowOverride:           d.now,
+		LookPathOverride:      d.lookPath,
+	}
+	if setOptions != nil {
+		setOptions(&options)
+	}
+	return NewTable(d.Table, ipVersion, hashPrefix, &sync.Mutex{}, d.newFeatureDetector(), options)
+}
+
 func (d *mockDataplane) sleep(duration time.Duration) {
 	d.CumulativeSleep += duration
 	d.Time = d.Time.Add(duration)
@@ -139,15 +250,18 @@ func (d *mockDataplane) RuleTouched(chainName string, ruleNum int) bool {
 
 type restoreCmd struct {
 	Dataplane     *mockDataplane
-	Stdin         *bytes.Buffer
+	Test          bool
+	Counters      bool
+	Stdin         io.Reader
 	CapturedStdin string
 	Stdout        io.Writer
 	Stderr        io.Writer
 }
 
+// SetStdin records the input, which is read when the command runs (since the input may be a
+// stream that is still being written).
 func (d *restoreCmd) SetStdin(r io.Reader) {
-	d.Stdin = r.(*bytes.Buffer)
-	d.CapturedStdin = d.Stdin.String()
+	d.Stdin = r
 }
 
 func (d *restoreCmd) SetStdout(w io.Writer) {
@@ -168,14 +282,14 @@ func (d *restoreCmd) StdoutPipe() (io.ReadCloser, error) {
 	return nil, errors.New("Not implemented")
 }
 
+// Start and Wait are used instead of Run when the Table is given a cancellable context.  The
+// simulated restore runs synchronously in Wait.
 func (d *restoreCmd) Start() error {
-	Fail("Not implemented")
-	return errors.New("Not implemented")
+	return nil
 }
 
 func (d *restoreCmd) Wait() error {
-	Fail("Not implemented")
-	return errors.New("Not implemented")
+	return d.Run()
 }
 
 func (d *restoreCmd) Kill() error {
@@ -186,6 +300,29 @@ func (d *restoreCmd) String() string {
 	return fmt.Sprintf("restoreCmd %#v", d.CapturedStdin)
 }
 
+// runTest simulates "iptables-restore --test", which only validates the input.
+func (d *restoreCmd) runTest(input string) error {
+	log.Info("Running simulated iptables-restore --test")
+	d.Dataplane.NumTestRestores++
+	if d.Dataplane.TestModeUnsupported {
+		if d.Stderr != nil {
+			_, _ = fmt.Fprintf(d.Stderr, "iptables-restore: unrecognized option '--test'\n")
+		}
+		return errors.New("Simulated failure")
+	}
+	if d.Dataplane.RejectLinesContaining != "" {
+		for i, line := range strings.Split(input, "\n") {
+			if strings.Contains(line, d.Dataplane.RejectLinesContaining) {
+				if d.Stderr != nil {
+					_, _ = fmt.Fprintf(d.Stderr, "iptables-restore: line %d failed\n", i+1)
+				}
+				return errors.New("Simulated failure")
+			}
+		}
+	}
+	return nil
+}
+
 func (d *restoreCmd) Run() error {
 	log.Info("Running simulated iptables-restore")
 	// Get the input.
@@ -193,6 +330,11 @@ func (d *restoreCmd) Run() error {
 	_, err := buf.ReadFrom(d.Stdin)
 	Expect(err).NotTo(HaveOccurred())
 	input := buf.String()
+	d.CapturedStdin = input
+
+	if d.Test {
+		return d.runTest(input)
+	}
 
 	if d.Dataplane.OnPreRestore != nil {
 		log.Warn("OnPreRestore set, calling it")
@@ -208,6 +350,17 @@ func (d *restoreCmd) Run() error {
 		log.Warn("Simulating an iptables-restore failure")
 		return errors.New("Simulated failure")
 	}
+	if d.Dataplane.RejectLinesContaining != "" {
+		for i, line := range strings.Split(input, "\n") {
+			if strings.Contains(line, d.Dataplane.RejectLinesContaining) {
+				log.WithField("line", line).Warn("Simulating rejection of a line")
+				if d.Stderr != nil {
+					_, _ = fmt.Fprintf(d.Stderr, "iptables-restore: line %d failed\n", i+1)
+				}
+				return errors.New("Simulated failure")
+			}
+		}
+	}
 
 	// Process it line by line.
 	lines := strings.Split(input, "\n")
@@ -239,6 +392,13 @@ func (d *restoreCmd) Run() error {
 
 		chains := d.Dataplane.Chains
 
+		var counters string
+		if strings.HasPrefix(line, "[") {
+			Expect(d.Counters).To(BeTrue(), "Counters in input without --counters")
+			parts := strings.SplitN(line, " ", 2)
+			counters, line = parts[0], parts[1]
+		}
+
 		if strings.HasPrefix(line, ":") {
 			// Chain forward-ref, creates and flushes the chain as needed.
 			parts := strings.Split(line[1:], " ")
@@ -259,17 +419,26 @@ func (d *restoreCmd) Run() error {
 			Expect(chains[chainName]).NotTo(BeNil(), "Append to unknown chain: "+chainName)
 			chains[chainName] = append(chains[chainName], rest)
 			d.Dataplane.ChainMods.Add(chainMod{name: chainName, ruleNum: len(chains[chainName])})
+			d.recordCounters(rest, counters)
 		case "-I", "--insert":
 			chainName = parts[1]
+			ruleNum := 1
 			rest := strings.Join(parts[2:], " ")
+			if n, err := strconv.Atoi(parts[2]); err == nil {
+				// Insert at an explicit (1-indexed) position.
+				ruleNum = n
+				rest = strings.Join(parts[3:], " ")
+			}
 			Expect(chains[chainName]).NotTo(BeNil(), "Insert to unknown chain: "+chainName)
+			Expect(ruleNum).To(BeNumerically("<=", len(chains[chainName])+1), "Insert beyond end of chain")
 			chains[chainName] = append(chains[chainName], "") // Make room
 			chain := chains[chainName]
-			for i := len(chain) - 1; i > 0; i-- {
+			for i := len(chain) - 1; i > ruleNum-1; i-- {
 				chain[i] = chain[i-1]
 			}
-			chain[0] = rest
-			d.Dataplane.ChainMods.Add(chainMod{name: chainName, ruleNum: 1})
+			chain[ruleNum-1] = rest
+			d.Dataplane.ChainMods.Add(chainMod{name: chainName, ruleNum: ruleNum})
+			d.recordCounters(rest, counters)
 		case "-R", "--replace":
 			chainName = parts[1]
 			ruleNum, err := strconv.Atoi(parts[2]) // 1-indexed position of rule.
@@ -280,6 +449,7 @@ func (d *restoreCmd) Run() error {
 			Expect(len(chain)).To(BeNumerically(">", ruleIdx), "Replace of non-existent rule")
 			chain[ruleIdx] = rest
 			d.Dataplane.ChainMods.Add(chainMod{name: chainName, ruleNum: ruleNum})
+			d.recordCounters(rest, counters)
 		case "-D", "--delete":
 			chainName = parts[1]
 			Expect(len(parts)).To(Equal(3), "--delete only expects two arguments")
@@ -293,6 +463,30 @@ func (d *restoreCmd) Run() error {
 			}
 			chains[chainName] = chain[:len(chain)-1]
 			d.Dataplane.ChainMods.Add(chainMod{name: chainName, ruleNum: ruleNum})
+		case "-P", "--policy":
+			chainName = parts[1]
+			Expect(len(parts)).To(Equal(3), "--policy expects two arguments")
+			Expect(chains).To(HaveKey(chainName), "Policy of unknown chain: "+chainName)
+			d.Dataplane.Policies[chainName] = parts[2]
+		case "-E", "--rename-chain":
+			chainName = parts[2]
+			Expect(len(parts)).To(Equal(3), "--rename-chain expects two arguments")
+			Expect(chains).To(HaveKey(parts[1]), "Rename of unknown chain: "+parts[1])
+			Expect(chains).NotTo(HaveKey(chainName), "Rename to existing chain: "+chainName)
+			chains[chainName] = chains[parts[1]]
+			delete(chains, parts[1])
+			// Like the kernel, update the rules that jump to the chain.
+			for name, rules := range chains {
+				for i, rule := range rules {
+					for _, jump := range []string{"--jump ", "-j ", "--goto ", "-g "} {
+						if strings.HasSuffix(rule, jump+parts[1]) {
+							rules[i] = strings.TrimSuffix(rule, parts[1]) + chainName
+						}
+					}
+				}
+				chains[name] = rules
+			}
+			d.Dataplane.RenamedChains.Add(parts[1])
 		case "-X", "--delete-chain":
 			chainName = parts[1]
 			Expect(len(parts)).To(Equal(2), "--delete-chain only has one argument")
@@ -306,11 +500,33 @@ func (d *restoreCmd) Run() error {
 			chainName, len(chains[chainName]), strings.Join(chains[chainName], "\n\t"))
 	}
 	Expect(commitSeen).To(BeTrue())
+	if d.Dataplane.OnPostRestore != nil {
+		// Clear the hook first so that it can re-arm itself.
+		onPostRestore := d.Dataplane.OnPostRestore
+		d.Dataplane.OnPostRestore = nil
+		onPostRestore()
+	}
 	return nil
 }
 
+// recordCounters records the counters of a rule that was written with --counters, or zeros
+// them if the rule was written without any.
+func (d *restoreCmd) recordCounters(rule, counters string) {
+	if d.Dataplane.Counters == nil {
+		d.Dataplane.Counters = map[string]string{}
+	}
+	if counters == "" {
+		delete(d.Dataplane.Counters, rule)
+		return
+	}
+	d.Dataplane.Counters[rule] = counters
+}
+
 type saveCmd struct {
-	Dataplane  *mockDataplane
+	Dataplane *mockDataplane
+	Counters  bool
+	// List simulates "iptables -S" rather than iptables-save.
+	List       bool
 	stdoutPipe *closableBuffer
 }
 
@@ -363,14 +579,41 @@ func (d *saveCmd) Output() ([]byte, error) {
 	}
 	var buf bytes.Buffer
 
+	if d.List {
+		for chainName := range d.Dataplane.Chains {
+			if policy := d.Dataplane.Policies[chainName]; policy != "" {
+				buf.WriteString(fmt.Sprintf("-P %s %s\n", chainName, policy))
+			} else {
+				buf.WriteString(fmt.Sprintf("-N %s\n", chainName))
+			}
+		}
+		for chainName, chain := range d.Dataplane.Chains {
+			for _, rule := range chain {
+				buf.WriteString(fmt.Sprintf("-A %s %s\n", chainName, rule))
+			}
+		}
+		return buf.Bytes(), nil
+	}
+
 	buf.WriteString("# generated by dummy iptables-save\n")
 	buf.WriteString(fmt.Sprintf("*%s\n", d.Dataplane.Table))
 	for chainName := range d.Dataplane.Chains {
-		buf.WriteString(fmt.Sprintf(":%s - [123:456]\n", chainName))
+		policy := d.Dataplane.Policies[chainName]
+		if policy == "" {
+			policy = "-"
+		}
+		buf.WriteString(fmt.Sprintf(":%s %s [123:456]\n", chainName, policy))
 	}
 
 	for chainName, chain := range d.Dataplane.Chains {
 		for _, rule := range chain {
+			if d.Counters {
+				counters := d.Dataplane.Counters[rule]
+				if counters == "" {
+					counters = "[0:0]"
+				}
+				buf.WriteString(counters + " ")
+			}
 			buf.WriteString(fmt.Sprintf("-A %s %s\n", chainName, rule))
 		}
 	}
@@ -440,3 +683,201 @@ func (b *closableBuffer) Close() error {
 func (d *saveCmd) Run() error {
 	return errors.New("Not implemented")
 }
+
+// versionCmd simulates "iptables --version".
+type versionCmd struct{}
+
+func (c *versionCmd) SetStdin(r io.Reader)  {}
+func (c *versionCmd) SetStdout(w io.Writer) {}
+func (c *versionCmd) SetStderr(w io.Writer) {}
+
+func (c *versionCmd) Output() ([]byte, error) {
+	return []byte("iptables v1.6.0\n"), nil
+}
+
+func (c *versionCmd) StdoutPipe() (io.ReadCloser, error) {
+	Fail("Not implemented")
+	return nil, errors.New("Not implemented")
+}
+
+func (c *versionCmd) Run() error   { return nil }
+func (c *versionCmd) Start() error { return nil }
+func (c *versionCmd) Wait() error  { return nil }
+func (c *versionCmd) Kill() error  { return nil }
+
+func (c *versionCmd) String() string {
+	return "versionCmd"
+}
+
+// checkCmd simulates "iptables -t <table> -C <chain> <rule>", which fails if the rule isn't in
+// the chain.  The rule is compared with the dataplane's rules ignoring quotes.
+type checkCmd struct {
+	Dataplane *mockDataplane
+	Chain     string
+	Rule      string
+}
+
+func (c *checkCmd) SetStdin(r io.Reader)  {}
+func (c *checkCmd) SetStdout(w io.Writer) {}
+func (c *checkCmd) SetStderr(w io.Writer) {}
+
+func (c *checkCmd) Output() ([]byte, error) {
+	Fail("Not implemented")
+	return nil, errors.New("Not implemented")
+}
+
+func (c *checkCmd) StdoutPipe() (io.ReadCloser, error) {
+	Fail("Not implemented")
+	return nil, errors.New("Not implemented")
+}
+
+func (c *checkCmd) Run() error {
+	c.Dataplane.NumChecks++
+	for _, rule := range c.Dataplane.Chains[c.Chain] {
+		if strings.Replace(rule, `"`, "", -1) == c.Rule {
+			return nil
+		}
+	}
+	return errors.New("iptables: Bad rule (does a matching rule exist in that chain?)")
+}
+
+func (c *checkCmd) Start() error { return nil }
+func (c *checkCmd) Wait() error  { return c.Run() }
+func (c *checkCmd) Kill() error  { return nil }
+
+func (c *checkCmd) String() string {
+	return fmt.Sprintf("checkCmd %s %s", c.Chain, c.Rule)
+}
+
+// perRuleCmd simulates a single "iptables -t <table> <args>" update, as used when there's no
+// iptables-restore.  Apart from -N and -F, it converts the arguments back into a line of
+// iptables-restore input and runs that through the simulated iptables-restore.
+type perRuleCmd struct {
+	Dataplane *mockDataplane
+	Args      []string
+	Stderr    io.Writer
+}
+
+func (c *perRuleCmd) SetStdin(r io.Reader)  {}
+func (c *perRuleCmd) SetStdout(w io.Writer) {}
+func (c *perRuleCmd) SetStderr(w io.Writer) {
+	c.Stderr = w
+}
+
+func (c *perRuleCmd) Output() ([]byte, error) {
+	Fail("Not implemented")
+	return nil, errors.New("Not implemented")
+}
+
+func (c *perRuleCmd) StdoutPipe() (io.ReadCloser, error) {
+	Fail("Not implemented")
+	return nil, errors.New("Not implemented")
+}
+
+func (c *perRuleCmd) Run() error {
+	chains := c.Dataplane.Chains
+	switch c.Args[0] {
+	case "-N":
+		Expect(c.Args).To(HaveLen(2))
+		if _, ok := chains[c.Args[1]]; ok {
+			return errors.New("iptables: Chain already exists.")
+		}
+		chains[c.Args[1]] = []string{}
+		return nil
+	case "-F":
+		Expect(c.Args).To(HaveLen(2))
+		if _, ok := chains[c.Args[1]]; !ok {
+			return errors.New("iptables: No chain/target/match by that name.")
+		}
+		chains[c.Args[1]] = []string{}
+		c.Dataplane.FlushedChains.Add(c.Args[1])
+		return nil
+	}
+
+	var counters string
+	var parts []string
+	for i := 0; i < len(c.Args); i++ {
+		arg := c.Args[i]
+		switch {
+		case arg == "-c":
+			Expect(len(c.Args)).To(BeNumerically(">", i+2))
+			counters = fmt.Sprintf("[%s:%s] ", c.Args[i+1], c.Args[i+2])
+			i += 2
+			continue
+		case i > 0 && c.Args[i-1] == "--comment":
+			// We always quote comments when we write them.
+			arg = `"` + arg + `"`
+		}
+		parts = append(parts, arg)
+	}
+	restore := &restoreCmd{
+		Dataplane: c.Dataplane,
+		Counters:  counters != "",
+		Stdin: strings.NewReader(fmt.Sprintf("*%s\n%s%s\nCOMMIT\n",
+			c.Dataplane.Table, counters, strings.Join(parts, " "))),
+		Stderr: c.Stderr,
+	}
+	return restore.Run()
+}
+
+func (c *perRuleCmd) Start() error { return nil }
+func (c *perRuleCmd) Wait() error  { return c.Run() }
+func (c *perRuleCmd) Kill() error  { return nil }
+
+func (c *perRuleCmd) String() string {
+	return fmt.Sprintf("perRuleCmd %v", c.Args)
+}
+
+// multiTableSave simulates an iptables-save of all tables by concatenating the output of the
+// per-table mock dataplanes.
+type multiTableSave struct {
+	Dataplanes []*mockDataplane
+	NumCalls   int
+	FailAll    bool
+}
+
+func (m *multiTableSave) newCmd(name string, arg ...string) CmdIface {
+	Expect(name).To(Equal("iptables-save"))
+	Expect(arg).To(BeEmpty())
+	m.NumCalls++
+	return &multiSaveCmd{Save: m}
+}
+
+type multiSaveCmd struct {
+	Save *multiTableSave
+}
+
+func (c *multiSaveCmd) SetStdin(r io.Reader)  {}
+func (c *multiSaveCmd) SetStdout(w io.Writer) {}
+func (c *multiSaveCmd) SetStderr(w io.Writer) {}
+
+func (c *multiSaveCmd) Output() ([]byte, error) {
+	if c.Save.FailAll {
+		return nil, errors.New("Simulated failure")
+	}
+	var buf bytes.Buffer
+	for _, d := range c.Save.Dataplanes {
+		out, err := (&saveCmd{Dataplane: d}).Output()
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(out)
+	}
+	return buf.Bytes(), nil
+}
+
+func (c *multiSaveCmd) StdoutPipe() (io.ReadCloser, error) {
+	Fail("Not implemented")
+	return nil, errors.New("Not implemented")
+}
+
+func (c *multiSaveCmd) Run() error     { return errors.New("Not implemented") }
+func (c *multiSaveCmd) Start() error   { return errors.New("Not implemented") }
+func (c *multiSaveCmd) Wait() error    { return errors.New("Not implemented") }
+func (c *multiSaveCmd) Kill() error    { return nil }
+func (c *multiSaveCmd) String() string { return "multiSaveCmd" }
+
+// rescheduleAfterOf picks the reschedule delay out of Apply's results.
+func rescheduleAfterOf(rescheduleAfter time.Duration, _ ApplyResult) time.Duration {
+	return rescheduleAfter
+}
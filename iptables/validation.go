@@ -0,0 +1,335 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	// MaxCommentLength is the longest comment that the xt_comment module accepts (the kernel
+	// buffer is 256 bytes, including the terminating NUL).
+	MaxCommentLength = 255
+	// MaxLogPrefixLength is the longest prefix that we allow for a LOG rule.  The kernel
+	// limit is 29 characters; LogAction appends ": " to the prefix.
+	MaxLogPrefixLength = 27
+	// MaxNflogPrefixLength is the longest prefix that the NFLOG target accepts.
+	MaxNflogPrefixLength = 64
+	// MaxIPSetNameLength is the longest IP set name that the kernel accepts.
+	MaxIPSetNameLength = 31
+	// MaxDSCP is the largest value that fits in the 6-bit DSCP field.
+	MaxDSCP = 63
+	// MaxHashLimitNameLength is the longest hashlimit table name that all the kernels that we
+	// support accept.
+	MaxHashLimitNameLength = 15
+	// MaxCTHelperLength is the longest conntrack helper name that the kernel accepts (the
+	// kernel buffer is 16 bytes, including the terminating NUL).
+	MaxCTHelperLength = 15
+	// MaxRecentNameLength is the longest xt_recent list name that the kernel accepts.
+	MaxRecentNameLength = 199
+)
+
+var (
+	// ipSetNameRegexp matches the characters that we allow in IP set names.  This is
+	// deliberately stricter than what the ipset tool allows so that names can never escape
+	// from their position in a rule.
+	ipSetNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9_.:+-]+$`)
+	// ctHelperRegexp matches the names of the kernel's conntrack helpers, such as "ftp" and
+	// "RAS".
+	ctHelperRegexp = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+	// recentNameRegexp matches the characters that we allow in xt_recent list names, which
+	// are also file names in /proc/net/xt_recent.
+	recentNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9_.:+-]+$`)
+)
+
+// ValidationError is returned when a user-controlled string can't safely be rendered into an
+// iptables rule.
+type ValidationError struct {
+	// Chain and RuleIndex locate the offending rule, when known.
+	Chain     string
+	RuleIndex int
+	// Field is the name of the field that failed validation, for example "Comment".
+	Field string
+	// Value is the offending value.
+	Value string
+	// Reason explains why the value was rejected.
+	Reason string
+}
+
+func (e ValidationError) Error() string {
+	if e.Chain != "" {
+		return fmt.Sprintf("chain %s rule %d: invalid %s %q: %s",
+			e.Chain, e.RuleIndex, e.Field, e.Value, e.Reason)
+	}
+	return fmt.Sprintf("invalid %s %q: %s", e.Field, e.Value, e.Reason)
+}
+
+// validator is implemented by Actions (and other model types) that contain user-controlled
+// strings.
+type validator interface {
+	Validate() error
+}
+
+// ipVersionValidator is implemented by Actions whose validity depends on the IP version.
+type ipVersionValidator interface {
+	ValidateForIPVersion(ipVersion uint8) error
+}
+
+// featureValidator is implemented by Actions that need optional kernel or iptables features.
+type featureValidator interface {
+	ValidateFeatures(features *Features) error
+}
+
+// ValidateComment checks that the given string is safe to render as the argument of
+// --comment.
+func ValidateComment(comment string) error {
+	if len(comment) > MaxCommentLength {
+		return ValidationError{
+			Field:  "Comment",
+			Value:  comment,
+			Reason: fmt.Sprintf("longer than %d characters", MaxCommentLength),
+		}
+	}
+	return checkPrintable("Comment", comment)
+}
+
+// ValidateLogPrefix checks that the given string is safe to render as the argument of
+// --log-prefix.
+func ValidateLogPrefix(prefix string) error {
+	if len(prefix) > MaxLogPrefixLength {
+		return ValidationError{
+			Field:  "LogPrefix",
+			Value:  prefix,
+			Reason: fmt.Sprintf("longer than %d characters", MaxLogPrefixLength),
+		}
+	}
+	return checkPrintable("LogPrefix", prefix)
+}
+
+// ValidateDSCP checks that the given value fits in the 6-bit DSCP field.
+func ValidateDSCP(value uint8) error {
+	if value > MaxDSCP {
+		return ValidationError{
+			Field:  "DSCP",
+			Value:  fmt.Sprint(value),
+			Reason: fmt.Sprintf("greater than %d", MaxDSCP),
+		}
+	}
+	return nil
+}
+
+// ValidateNflogPrefix checks that the given string is a valid prefix for an NFLOG rule.
+func ValidateNflogPrefix(prefix string) error {
+	if len(prefix) > MaxNflogPrefixLength {
+		return ValidationError{
+			Field:  "NflogPrefix",
+			Value:  prefix,
+			Reason: fmt.Sprintf("longer than %d characters", MaxNflogPrefixLength),
+		}
+	}
+	return checkPrintable("NflogPrefix", prefix)
+}
+
+// ValidateIPSetName checks that the given string is a valid IP set name that can be rendered
+// into a --match-set fragment.
+func ValidateIPSetName(name string) error {
+	if len(name) > MaxIPSetNameLength {
+		return ValidationError{
+			Field:  "IPSetName",
+			Value:  name,
+			Reason: fmt.Sprintf("longer than %d characters", MaxIPSetNameLength),
+		}
+	}
+	if !ipSetNameRegexp.MatchString(name) {
+		return ValidationError{
+			Field:  "IPSetName",
+			Value:  name,
+			Reason: "contains characters other than letters, digits and '_.:+-'",
+		}
+	}
+	return nil
+}
+
+// ValidateCTHelper checks that the given string is a valid conntrack helper name.
+func ValidateCTHelper(helper string) error {
+	if len(helper) > MaxCTHelperLength {
+		return ValidationError{
+			Field:  "CTHelper",
+			Value:  helper,
+			Reason: fmt.Sprintf("longer than %d characters", MaxCTHelperLength),
+		}
+	}
+	if !ctHelperRegexp.MatchString(helper) {
+		return ValidationError{
+			Field:  "CTHelper",
+			Value:  helper,
+			Reason: "contains characters other than letters, digits and '_-'",
+		}
+	}
+	return nil
+}
+
+// ValidatePortRange checks that the given string is a port, such as "53", or a range of ports,
+// such as "8000-8010", as used by the --to-ports option of the REDIRECT target.
+func ValidatePortRange(ports string) error {
+	parts := strings.SplitN(ports, "-", 2)
+	var first, last uint64
+	for i, part := range parts {
+		port, err := strconv.ParseUint(part, 10, 16)
+		if err != nil || port == 0 {
+			return ValidationError{Field: "Ports", Value: ports, Reason: "should be a port or range of ports"}
+		}
+		if i == 0 {
+			first = port
+		}
+		last = port
+	}
+	if first > last {
+		return ValidationError{Field: "Ports", Value: ports, Reason: "range is backwards"}
+	}
+	return nil
+}
+
+// checkPrintable rejects strings that contain quotes, backslashes or non-printable characters,
+// any of which could be used to break out of a quoted iptables-restore argument.
+func checkPrintable(field, value string) error {
+	for _, r := range value {
+		switch {
+		case r == '"' || r == '\\':
+			return ValidationError{Field: field, Value: value, Reason: "contains a quote or backslash"}
+		case r < 0x20 || r > 0x7e:
+			return ValidationError{Field: field, Value: value, Reason: "contains a non-printable character"}
+		}
+	}
+	return nil
+}
+
+// escapeQuoted escapes a string for use inside a double-quoted iptables-restore argument.
+// Values should already have been validated; this is a second line of defense against a
+// value that slipped through producing malformed input.
+func escapeQuoted(s string) string {
+	if !strings.ContainsAny(s, "\"\\\n") {
+		return s
+	}
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, `"`, `\"`, -1)
+	s = strings.Replace(s, "\n", " ", -1)
+	return s
+}
+
+// Validate checks the user-controlled strings in the rule, returning a ValidationError for
+// the first one that is invalid.
+func (r Rule) Validate() error {
+	return r.ValidateForIPVersion(r.IPVersion)
+}
+
+// ValidateForIPVersion is like Validate but for a rule that is rendered for the given IP
+// version, such as a rule in a Table for that version.  An ipVersion of 0 means both.
+func (r Rule) ValidateForIPVersion(ipVersion uint8) error {
+	if r.IPVersion != 0 && r.IPVersion != 4 && r.IPVersion != 6 {
+		return ValidationError{
+			Field:  "IPVersion",
+			Value:  fmt.Sprintf("%d", r.IPVersion),
+			Reason: "must be 4, 6 or 0 (both)",
+		}
+	}
+	if r.Comment != "" {
+		if err := ValidateComment(r.Comment); err != nil {
+			return err
+		}
+	}
+	for _, comment := range r.ExtraComments {
+		if err := ValidateComment(comment); err != nil {
+			ve := err.(ValidationError)
+			ve.Field = "ExtraComments"
+			return ve
+		}
+	}
+	if v, ok := r.Action.(ipVersionValidator); ok && ipVersion != 0 {
+		// The rule is only rendered for one IP version so the action need only be valid
+		// for that one.
+		if err := v.ValidateForIPVersion(ipVersion); err != nil {
+			return err
+		}
+	} else if v, ok := r.Action.(validator); ok {
+		if err := v.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ValidateFeatures checks that the rule's action is supported by the given features, as
+// detected by a FeatureDetector.
+func (r Rule) ValidateFeatures(features *Features) error {
+	if v, ok := r.Action.(featureValidator); ok {
+		return v.ValidateFeatures(features)
+	}
+	return nil
+}
+
+// Validate checks all the rules in the chain.
+func (c *Chain) Validate() error {
+	for i, rule := range c.Rules {
+		if err := rule.Validate(); err != nil {
+			if ve, ok := err.(ValidationError); ok {
+				ve.Chain = c.Name
+				ve.RuleIndex = i
+				return ve
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// invalidRulesDropRule replaces rules that fail validation: a rule that can't be programmed as
+// written fails closed, rather than letting through the packets that it should have handled.
+var invalidRulesDropRule = Rule{
+	Action:  DropAction{},
+	Comment: "Drop all: invalid rule",
+}
+
+// validRules returns the given rules, which must all apply to the Table's IP version, if they
+// all pass validation for the Table.  Otherwise, it logs the invalid rules and returns
+// invalidRulesDropRule in their place, so that packets that reach the rules are dropped until
+// they are next updated with valid rules.  Rules that need a feature that the dataplane lacks
+// are invalid too.  The bool is false if the rules were replaced.
+func (t *Table) validRules(chainName string, rules []Rule) ([]Rule, bool) {
+	valid := true
+	for i, rule := range rules {
+		err := rule.ValidateForIPVersion(t.IPVersion)
+		if _, ok := rule.Action.(featureValidator); ok && err == nil {
+			err = rule.ValidateFeatures(t.featureDetector.GetFeatures())
+		}
+		if err == nil {
+			continue
+		}
+		if ve, ok := err.(ValidationError); ok {
+			ve.Chain = chainName
+			ve.RuleIndex = i
+			err = ve
+		}
+		t.logCxt.WithError(err).Error("Invalid rule, dropping all packets that reach the rules instead.")
+		valid = false
+	}
+	if !valid {
+		return []Rule{invalidRulesDropRule}, false
+	}
+	return rules, true
+}
@@ -0,0 +1,231 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables_test
+
+import (
+	. "github.com/projectcalico/felix/iptables"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = DescribeTable("Rule validation",
+	func(rule Rule, expectValid bool) {
+		err := rule.Validate()
+		if expectValid {
+			Expect(err).NotTo(HaveOccurred())
+		} else {
+			Expect(err).To(BeAssignableToTypeOf(ValidationError{}))
+		}
+	},
+	Entry("no comment", Rule{Action: AcceptAction{}}, true),
+	Entry("plain comment", Rule{Action: AcceptAction{}, Comment: "Drop if no policies passed packet"}, true),
+	Entry("comment with quote", Rule{Action: AcceptAction{}, Comment: `foo" --jump ACCEPT "`}, false),
+	Entry("comment with backslash", Rule{Action: AcceptAction{}, Comment: `foo\`}, false),
+	Entry("comment with newline", Rule{Action: AcceptAction{}, Comment: "foo\n-A INPUT"}, false),
+	Entry("good log prefix", Rule{Action: LogAction{Prefix: "calico-packet"}}, true),
+	Entry("log prefix with quote", Rule{Action: LogAction{Prefix: `calico"`}}, false),
+	Entry("log level", Rule{Action: LogAction{Level: LogLevelInfo}}, true),
+	Entry("bad log level", Rule{Action: LogAction{Level: LogLevelDebug + 1}}, false),
+	Entry("log limit", Rule{Action: LogAction{Limit: &LogLimit{Rate: 5, Unit: "hour", Burst: 1}}}, true),
+	Entry("log limit without rate", Rule{Action: LogAction{Limit: &LogLimit{Unit: "hour"}}}, false),
+	Entry("log limit with bad unit", Rule{Action: LogAction{Limit: &LogLimit{Rate: 5, Unit: "week"}}}, false),
+	Entry("log prefix too long", Rule{Action: LogAction{Prefix: "0123456789012345678901234567"}}, false),
+	Entry("extra comments", Rule{Action: AcceptAction{}, ExtraComments: []string{"policy default/web", "ns:prod"}}, true),
+	Entry("extra comment with quote", Rule{Action: AcceptAction{}, ExtraComments: []string{"ok", `bad"`}}, false),
+	Entry("good nflog prefix", Rule{Action: NflogAction{Group: 1, Prefix: "A|cali-pi-pol1"}}, true),
+	Entry("nflog prefix with quote", Rule{Action: NflogAction{Group: 1, Prefix: `calico"`}}, false),
+	Entry("nflog prefix too long", Rule{Action: NflogAction{Group: 1, Prefix: "0123456789012345678901234567890123456789012345678901234567890123456789"}}, false),
+	Entry("add to set", Rule{Action: SetMemberAction{Set: "cali40blocked", Flags: "src", Op: SetMemberAdd}}, true),
+	Entry("delete from set", Rule{Action: SetMemberAction{Set: "cali40blocked", Flags: "src,dst", Op: SetMemberDel}}, true),
+	Entry("set member with bad op", Rule{Action: SetMemberAction{Set: "cali40blocked", Flags: "src", Op: "flush"}}, false),
+	Entry("set member with bad set name", Rule{Action: SetMemberAction{Set: "cali40 -j ACCEPT", Flags: "src", Op: SetMemberAdd}}, false),
+	Entry("set member with bad flags", Rule{Action: SetMemberAction{Set: "cali40blocked", Flags: "src dst", Op: SetMemberAdd}}, false),
+	Entry("set member with too many flags", Rule{Action: SetMemberAction{
+		Set: "cali40blocked", Flags: "src,src,src,src,src,src,src", Op: SetMemberAdd}}, false),
+	Entry("good DSCP", Rule{Action: DSCPAction{Value: 63}}, true),
+	Entry("DSCP too large", Rule{Action: DSCPAction{Value: 64}}, false),
+	Entry("TTL set for IPv4", Rule{Action: TTLAction{Op: TTLSet, Value: 64}, IPVersion: 4}, true),
+	Entry("TTL decrement for IPv6", Rule{Action: TTLAction{Op: TTLDec, Value: 1}, IPVersion: 6}, true),
+	Entry("TTL for both versions", Rule{Action: TTLAction{Op: TTLSet, Value: 64}}, false),
+	Entry("TTL increment by 0", Rule{Action: TTLAction{Op: TTLInc}, IPVersion: 4}, false),
+	Entry("TTL with bad op", Rule{Action: TTLAction{Op: "double", Value: 2}, IPVersion: 4}, false),
+	Entry("clamp MSS to PMTU", Rule{Action: ClampMSSAction{ToPMTU: true}}, true),
+	Entry("set MSS", Rule{Action: ClampMSSAction{MSS: 1360}}, true),
+	Entry("set MSS to 0", Rule{Action: ClampMSSAction{}}, false),
+	Entry("set MSS and clamp to PMTU", Rule{Action: ClampMSSAction{ToPMTU: true, MSS: 1360}}, false),
+	Entry("redirect", Rule{Action: RedirectAction{}}, true),
+	Entry("redirect to port", Rule{Action: RedirectAction{ToPorts: "5353"}}, true),
+	Entry("redirect to range", Rule{Action: RedirectAction{ToPorts: "8000-8010"}}, true),
+	Entry("redirect to backwards range", Rule{Action: RedirectAction{ToPorts: "8010-8000"}}, false),
+	Entry("redirect to port 0", Rule{Action: RedirectAction{ToPorts: "0"}}, false),
+	Entry("redirect to big port", Rule{Action: RedirectAction{ToPorts: "65536"}}, false),
+	Entry("redirect with injection", Rule{Action: RedirectAction{ToPorts: "53 --jump ACCEPT"}}, false),
+	Entry("redirect to open range", Rule{Action: RedirectAction{ToPorts: "8000-"}}, false),
+	Entry("CT notrack", Rule{Action: CTAction{NoTrack: true}}, true),
+	Entry("CT zone and helper", Rule{Action: CTAction{Zone: 1, Helper: "tftp"}}, true),
+	Entry("CT notrack with zone", Rule{Action: CTAction{NoTrack: true, Zone: 1}}, false),
+	Entry("CT with nothing to do", Rule{Action: CTAction{}}, false),
+	Entry("CT helper with space", Rule{Action: CTAction{Helper: "ftp --notrack"}}, false),
+	Entry("CT helper too long", Rule{Action: CTAction{Helper: "0123456789abcdef"}}, false),
+	Entry("default reject", Rule{Action: RejectAction{}}, true),
+	Entry("reject with TCP reset", Rule{Action: RejectAction{With: "tcp-reset"}}, true),
+	Entry("reject with IPv4 type for both versions", Rule{Action: RejectAction{With: "icmp-port-unreachable"}}, false),
+	Entry("reject with IPv4 type for IPv4", Rule{Action: RejectAction{With: "icmp-port-unreachable"}, IPVersion: 4}, true),
+	Entry("reject with IPv4 type for IPv6", Rule{Action: RejectAction{With: "icmp-port-unreachable"}, IPVersion: 6}, false),
+	Entry("reject with IPv6 type for IPv6", Rule{Action: RejectAction{With: "icmp6-adm-prohibited"}, IPVersion: 6}, true),
+	Entry("reject with unknown type", Rule{Action: RejectAction{With: "tcp-reset --jump ACCEPT"}, IPVersion: 4}, false),
+)
+
+var _ = DescribeTable("IP set name validation",
+	func(name string, expectValid bool) {
+		err := ValidateIPSetName(name)
+		if expectValid {
+			Expect(err).NotTo(HaveOccurred())
+		} else {
+			Expect(err).To(BeAssignableToTypeOf(ValidationError{}))
+		}
+	},
+	Entry("normal name", "cali40s:abcd1234_-", true),
+	Entry("too long", "cali40s:0123456789012345678901234567890", false),
+	Entry("space", "cali40s foo", false),
+	Entry("quote", `cali40s"`, false),
+)
+
+var _ = Describe("Chain validation", func() {
+	It("should report the position of the bad rule", func() {
+		chain := &Chain{
+			Name: "cali-foo",
+			Rules: []Rule{
+				{Action: AcceptAction{}},
+				{Action: AcceptAction{}, Comment: `bad"comment`},
+			},
+		}
+		err := chain.Validate()
+		Expect(err).To(HaveOccurred())
+		ve := err.(ValidationError)
+		Expect(ve.Chain).To(Equal("cali-foo"))
+		Expect(ve.RuleIndex).To(Equal(1))
+		Expect(ve.Field).To(Equal("Comment"))
+	})
+
+	It("should name the field of a bad extra comment", func() {
+		err := (&Chain{Name: "cali-foo", Rules: []Rule{
+			{Action: AcceptAction{}, ExtraComments: []string{"bad\n"}},
+		}}).Validate()
+		Expect(err).To(HaveOccurred())
+		Expect(err.(ValidationError).Field).To(Equal("ExtraComments"))
+	})
+
+	It("should render TTL actions for the rule's IP version", func() {
+		rule := Rule{Action: TTLAction{Op: TTLDec, Value: 1}, IPVersion: 6}
+		Expect(rule.RenderAppend("cali-foo", "", &Features{})).To(Equal(
+			"-A cali-foo --jump HL --hl-dec 1"))
+		rule.IPVersion = 4
+		Expect(rule.RenderAppend("cali-foo", "", &Features{})).To(Equal(
+			"-A cali-foo --jump TTL --ttl-dec 1"))
+	})
+
+	It("should check the features needed by the action", func() {
+		rule := Rule{Action: TTLAction{Op: TTLSet, Value: 64}, IPVersion: 4}
+		Expect(rule.ValidateFeatures(&Features{})).To(HaveOccurred())
+		Expect(rule.ValidateFeatures(&Features{TTL: true})).NotTo(HaveOccurred())
+		rule = Rule{Action: TproxyAction{Mark: 0x1, Port: 8080}}
+		Expect(rule.ValidateFeatures(&Features{})).To(HaveOccurred())
+		Expect(rule.ValidateFeatures(&Features{TPROXY: true})).NotTo(HaveOccurred())
+		rule = Rule{Action: CTAction{Helper: "ftp"}}
+		Expect(rule.ValidateFeatures(&Features{})).To(HaveOccurred())
+		Expect(rule.ValidateFeatures(&Features{CT: true})).NotTo(HaveOccurred())
+		Expect(Rule{Action: AcceptAction{}}.ValidateFeatures(&Features{})).NotTo(HaveOccurred())
+	})
+
+	It("should escape quotes that slip through validation", func() {
+		rule := Rule{Action: AcceptAction{}, Comment: `a"b`}
+		Expect(rule.RenderAppend("cali-foo", "", &Features{})).To(Equal(
+			`-A cali-foo -m comment --comment "a\"b" --jump ACCEPT`))
+	})
+})
+
+var _ = Describe("Table with invalid rules", func() {
+	var dataplane *mockDataplane
+	var table *Table
+
+	BeforeEach(func() {
+		dataplane = newMockDataplane("filter", map[string][]string{
+			"FORWARD": {},
+			"INPUT":   {},
+			"OUTPUT":  {},
+		})
+		table = dataplane.newTable(nil)
+	})
+
+	It("should drop all packets in a chain with an invalid rule", func() {
+		table.UpdateChain(&Chain{Name: "cali-foo", Rules: []Rule{
+			{Action: AcceptAction{}, Comment: "first"},
+			{Action: AcceptAction{}, Comment: "bad\"comment"},
+			{Action: RejectAction{With: "icmp6-adm-prohibited"}},
+			{Action: RejectAction{With: "tcp-reset"}},
+		}})
+		table.Apply()
+		Expect(dataplane.Chains["cali-foo"]).To(HaveLen(1))
+		Expect(dataplane.Chains["cali-foo"][0]).To(ContainSubstring(
+			`-m comment --comment "Drop all: invalid rule" --jump DROP`))
+	})
+
+	It("should program the chain once its rules are valid", func() {
+		table.UpdateChain(&Chain{Name: "cali-foo", Rules: []Rule{
+			{Action: RejectAction{With: "icmp6-adm-prohibited"}},
+		}})
+		table.Apply()
+		table.UpdateChain(&Chain{Name: "cali-foo", Rules: []Rule{
+			{Action: RejectAction{With: "tcp-reset"}},
+		}})
+		table.Apply()
+		Expect(dataplane.Chains["cali-foo"]).To(HaveLen(1))
+		Expect(dataplane.Chains["cali-foo"][0]).To(ContainSubstring("--reject-with tcp-reset"))
+	})
+
+	It("should validate IP-version-specific actions for the Table's IP version", func() {
+		table.UpdateChain(&Chain{Name: "cali-foo", Rules: []Rule{
+			{Action: RejectAction{With: "icmp-port-unreachable"}},
+		}})
+		table.Apply()
+		Expect(dataplane.Chains["cali-foo"]).To(HaveLen(1))
+	})
+
+	It("should insert a drop rule in place of invalid inserted rules", func() {
+		table.SetRuleInsertions("FORWARD", []Rule{
+			{Action: LogAction{Prefix: "a-log-prefix-that-is-much-too-long"}},
+			{Action: JumpAction{Target: "cali-foo"}},
+		})
+		table.UpdateChain(&Chain{Name: "cali-foo", Rules: []Rule{{Action: AcceptAction{}}}})
+		table.Apply()
+		Expect(dataplane.Chains["FORWARD"]).To(HaveLen(1))
+		Expect(dataplane.Chains["FORWARD"][0]).To(ContainSubstring("--jump DROP"))
+	})
+
+	It("should drop the packets that reach invalid appended rules", func() {
+		table.UpdateChain(&Chain{Name: "cali-foo", Rules: []Rule{{Action: AcceptAction{}, Comment: "first"}}})
+		table.AppendToChain("cali-foo", []Rule{
+			{Action: AcceptAction{}},
+			{Action: NflogAction{Group: 1, Prefix: "bad\"prefix"}},
+		})
+		table.Apply()
+		Expect(dataplane.Chains["cali-foo"]).To(HaveLen(2))
+		Expect(dataplane.Chains["cali-foo"][0]).To(ContainSubstring(`--comment "first"`))
+		Expect(dataplane.Chains["cali-foo"][1]).To(ContainSubstring("--jump DROP"))
+	})
+})
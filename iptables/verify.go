@@ -0,0 +1,89 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// VerifyError is returned (or, after retries, wrapped in an ApplyError) when iptables-restore
+// reported success but reading back the table showed that some chains don't contain the rules
+// that we wrote.  This has been seen with buggy iptables-nft shims.
+type VerifyError struct {
+	Table string
+	// Chains is the sorted list of chains that didn't match.
+	Chains []string
+}
+
+func (e *VerifyError) Error() string {
+	return fmt.Sprintf("iptables table %s did not match after a successful write; mismatched chains: %s",
+		e.Table, strings.Join(e.Chains, ", "))
+}
+
+// verifyDataplane re-reads the table and checks that the given chains have the expected hashes.
+// A nil entry in expectedHashes means that the chain should have been deleted.  On a mismatch,
+// it marks our cache as out of sync (so that the next attempt reloads and repairs the table)
+// and returns a *VerifyError.
+func (t *Table) verifyDataplane(ctx context.Context, expectedHashes map[string][]string) error {
+	dataplaneHashes, err := t.getHashesFromDataplane(ctx)
+	if err != nil {
+		return err
+	}
+	var mismatched []string
+	for chainName, expected := range expectedHashes {
+		actual, present := dataplaneHashes[chainName]
+		if expected == nil {
+			if present {
+				mismatched = append(mismatched, chainName)
+			}
+			continue
+		}
+		if !present || !hashesEqual(expected, actual) {
+			t.logCxt.WithFields(log.Fields{
+				"chainName": chainName,
+				"expected":  expected,
+				"actual":    actual,
+			}).Debug("Chain doesn't match after write")
+			mismatched = append(mismatched, chainName)
+		}
+	}
+	if len(mismatched) == 0 {
+		t.logCxt.Debug("Read-back verification passed")
+		return nil
+	}
+	sort.Strings(mismatched)
+	t.metrics.Add(MetricVerifyFailures, 1)
+	t.logCxt.WithField("chains", mismatched).Error(
+		"iptables-restore succeeded but the chains don't contain the expected rules")
+	t.inSyncWithDataPlane = false
+	return &VerifyError{Table: t.Name, Chains: mismatched}
+}
+
+func hashesEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,86 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iptables_test
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/projectcalico/felix/iptables"
+)
+
+var _ = Describe("Table with VerifyAfterWrite", func() {
+	var dataplane *mockDataplane
+	var table *Table
+
+	BeforeEach(func() {
+		dataplane = newMockDataplane("filter", map[string][]string{
+			"FORWARD": {},
+			"INPUT":   {},
+			"OUTPUT":  {},
+		})
+		table = dataplane.newTable(func(options *TableOptions) {
+			options.VerifyAfterWrite = true
+			options.ReturnErrorOnFailure = true
+		})
+		table.UpdateChain(&Chain{Name: "cali-foo", Rules: []Rule{{Action: DropAction{}}}})
+		table.SetRuleInsertions("FORWARD", []Rule{{Action: JumpAction{Target: "cali-foo"}}})
+	})
+
+	It("should re-read the table after writing", func() {
+		_, err := table.ApplyContext(context.Background())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(dataplane.CmdNames).To(Equal([]string{
+			"iptables-save",
+			"iptables-restore",
+			"iptables-save",
+		}))
+	})
+
+	It("should not re-read the table if there was nothing to write", func() {
+		_, err := table.ApplyContext(context.Background())
+		Expect(err).NotTo(HaveOccurred())
+		dataplane.ResetCmds()
+		_, err = table.ApplyContext(context.Background())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(dataplane.CmdNames).To(BeEmpty())
+	})
+
+	It("should detect and repair a write that didn't take effect", func() {
+		dataplane.OnPostRestore = func() {
+			dataplane.Chains["cali-foo"] = []string{}
+		}
+		_, err := table.ApplyContext(context.Background())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(dataplane.Chains["cali-foo"]).To(HaveLen(1))
+		Expect(dataplane.CumulativeSleep).NotTo(BeZero())
+	})
+
+	It("should return a VerifyError if the mismatch persists", func() {
+		var clobber func()
+		clobber = func() {
+			dataplane.Chains["FORWARD"] = []string{}
+			dataplane.OnPostRestore = clobber
+		}
+		dataplane.OnPostRestore = clobber
+		_, err := table.ApplyContext(context.Background())
+		Expect(err).To(BeAssignableToTypeOf(&ApplyError{}))
+		verifyErr, ok := err.(*ApplyError).Err.(*VerifyError)
+		Expect(ok).To(BeTrue())
+		Expect(verifyErr.Chains).To(Equal([]string{"FORWARD"}))
+	})
+})
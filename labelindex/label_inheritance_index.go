@@ -48,24 +48,22 @@
 package labelindex
 
 import (
-	"reflect"
-
 	log "github.com/sirupsen/logrus"
 
 	"github.com/projectcalico/felix/dispatcher"
 	"github.com/projectcalico/libcalico-go/lib/backend/api"
 	"github.com/projectcalico/libcalico-go/lib/backend/model"
 	"github.com/projectcalico/libcalico-go/lib/selector"
-	"github.com/projectcalico/libcalico-go/lib/selector/parser"
 	"github.com/projectcalico/libcalico-go/lib/set"
 )
 
 // itemData holds the data that we know about a particular item (i.e. a workload or host endpoint).
 // In particular, it holds it current explicitly-assigned labels and a pointer to the parent data
-// for each of its parents.
+// for each of its parents, and the fingerprint of its label set (see labelSetFingerprint).
 type itemData struct {
-	labels  map[string]string
-	parents []*parentData
+	labels      map[string]string
+	parents     []*parentData
+	fingerprint string
 }
 
 // Get implements the Labels interface for itemData.  Combines the item's own labels with those
@@ -114,6 +112,10 @@ type InheritIndex struct {
 	OnMatchStopped MatchCallback
 
 	dirtyItemIDs set.Set
+
+	// labelSetsByFingerprint caches the selectors that match each distinct label set; see
+	// label_set_cache.go.
+	labelSetsByFingerprint map[string]*labelSet
 }
 
 func NewInheritIndex(onMatchStarted, onMatchStopped MatchCallback) *InheritIndex {
@@ -131,6 +133,8 @@ func NewInheritIndex(onMatchStarted, onMatchStopped MatchCallback) *InheritIndex
 		OnMatchStopped: onMatchStopped,
 
 		dirtyItemIDs: set.New(),
+
+		labelSetsByFingerprint: map[string]*labelSet{},
 	}
 	return &inheritIDx
 }
@@ -216,24 +220,29 @@ func (idx *InheritIndex) DeleteSelector(id interface{}) {
 		})
 	}
 	delete(idx.selectorsById, id)
+	for _, ls := range idx.labelSetsByFingerprint {
+		if ls.evaluated {
+			ls.matchingSelIDs.Discard(id)
+		}
+	}
 }
 
 func (idx *InheritIndex) UpdateLabels(id interface{}, labels map[string]string, parentIDs []string) {
 	log.Debug("Inherit index updating labels for ", id)
 	log.Debug("Num dirty items ", idx.dirtyItemIDs.Len(), " items")
 
+	fingerprint := labelSetFingerprint(labels, parentIDs)
 	oldItemData := idx.itemDataByID[id]
 	var oldParents []*parentData
 	if oldItemData != nil {
-		oldParents = oldItemData.parents
-		oldLabels := oldItemData.labels
-		if reflect.DeepEqual(oldLabels, labels) &&
-			reflect.DeepEqual(oldParents, parentIDs) {
+		if oldItemData.fingerprint == fingerprint {
 			log.Debug("No change to labels or parentIDs, ignoring.")
 			return
 		}
+		oldParents = oldItemData.parents
+		idx.removeFromLabelSet(id, oldItemData.fingerprint)
 	}
-	newItemData := &itemData{}
+	newItemData := &itemData{fingerprint: fingerprint}
 	if len(labels) > 0 {
 		newItemData.labels = labels
 	}
@@ -245,6 +254,7 @@ func (idx *InheritIndex) UpdateLabels(id interface{}, labels map[string]string,
 		newItemData.parents = parents
 	}
 	idx.itemDataByID[id] = newItemData
+	idx.addToLabelSet(id, fingerprint, parentIDs)
 
 	idx.onItemParentsUpdate(id, oldParents, newItemData.parents)
 
@@ -259,6 +269,7 @@ func (idx *InheritIndex) DeleteLabels(id interface{}) {
 	var oldParents []*parentData
 	if oldItemData != nil {
 		oldParents = oldItemData.parents
+		idx.removeFromLabelSet(id, oldItemData.fingerprint)
 	}
 	delete(idx.itemDataByID, id)
 	idx.onItemParentsUpdate(id, oldParents, nil)
@@ -354,6 +365,7 @@ func (idx *InheritIndex) DeleteParentTags(parentID string) {
 }
 
 func (idx *InheritIndex) flushChildren(parentID string) {
+	idx.invalidateLabelSetsWithParent(parentID)
 	parentData := idx.parentDataByParentID[parentID]
 	if parentData != nil && parentData.itemIDs != nil {
 		parentData.itemIDs.Iter(func(itemID interface{}) error {
@@ -392,32 +404,50 @@ func (idx *InheritIndex) flushUpdates() {
 func (idx *InheritIndex) scanAllLabels(selId interface{}, sel selector.Selector) {
 	log.Debugf("Scanning all (%v) labels against selector %v",
 		len(idx.itemDataByID), selId)
-	for labelId, labels := range idx.itemDataByID {
-		idx.updateMatches(selId, sel, labelId, labels)
+	// Evaluate the selector once for each distinct label set, then update the matches of the
+	// items that have it.
+	for _, ls := range idx.labelSetsByFingerprint {
+		if !ls.evaluated {
+			// Evaluated, against all the selectors, when one of its items is flushed.
+			continue
+		}
+		ls.itemIDs.Iter(func(labelId interface{}) error {
+			if sel.EvaluateLabels(idx.itemDataByID[labelId]) {
+				ls.matchingSelIDs.Add(selId)
+			} else {
+				ls.matchingSelIDs.Discard(selId)
+			}
+			return set.StopIteration
+		})
+		nowMatches := ls.matchingSelIDs.Contains(selId)
+		ls.itemIDs.Iter(func(labelId interface{}) error {
+			if nowMatches {
+				idx.storeMatch(selId, labelId)
+			} else {
+				idx.deleteMatch(selId, labelId)
+			}
+			return nil
+		})
 	}
 }
 
 func (idx *InheritIndex) scanAllSelectors(labelId interface{}) {
 	log.Debugf("Scanning all (%v) selectors against labels %v",
 		len(idx.selectorsById), labelId)
-	labels := idx.itemDataByID[labelId]
-	for selId, sel := range idx.selectorsById {
-		idx.updateMatches(selId, sel, labelId, labels)
+	matchingSelIDs := idx.matchingSelectors(labelId, idx.itemDataByID[labelId])
+	if oldMatches := idx.selIdsByLabelId[labelId]; oldMatches != nil {
+		oldMatches.Iter(func(selId interface{}) error {
+			if !matchingSelIDs.Contains(selId) {
+				// This modifies the set we're iterating over, but that's safe in Go.
+				idx.deleteMatch(selId, labelId)
+			}
+			return nil
+		})
 	}
-}
-
-func (idx *InheritIndex) updateMatches(
-	selId interface{},
-	sel selector.Selector,
-	labelId interface{},
-	labels parser.Labels,
-) {
-	nowMatches := sel.EvaluateLabels(labels)
-	if nowMatches {
+	matchingSelIDs.Iter(func(selId interface{}) error {
 		idx.storeMatch(selId, labelId)
-	} else {
-		idx.deleteMatch(selId, labelId)
-	}
+		return nil
+	})
 }
 
 func (idx *InheritIndex) storeMatch(selId, labelId interface{}) {
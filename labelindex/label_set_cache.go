@@ -0,0 +1,131 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package labelindex
+
+import (
+	"bytes"
+	"sort"
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/projectcalico/libcalico-go/lib/set"
+)
+
+// labelSet caches the IDs of the selectors that match a particular set of labels, so that
+// items with identical labels, such as the pods of a deployment that are all being restarted at
+// once, only have the selectors evaluated against them once.  Label sets are identified by their
+// fingerprint, see labelSetFingerprint.
+type labelSet struct {
+	// itemIDs contains the items that currently have this label set.  The labelSet is discarded
+	// once it's empty.
+	itemIDs set.Set
+	// parentIDs are the items' parents, in order.
+	parentIDs []string
+	// matchingSelIDs contains the IDs of the selectors that match the label set.  Only valid if
+	// evaluated is set; it's cleared when the labels of one of the parents change.
+	matchingSelIDs set.Set
+	evaluated      bool
+}
+
+// labelSetFingerprint returns a string that uniquely identifies the given labels and
+// parents.  Since inherited labels are looked up in order, the order of the parents matters.
+// Each string is prefixed with its length so that no combination of labels and parents can
+// produce the same fingerprint as another.
+func labelSetFingerprint(labels map[string]string, parentIDs []string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var buf bytes.Buffer
+	writeString := func(s string) {
+		buf.WriteString(strconv.Itoa(len(s)))
+		buf.WriteByte(':')
+		buf.WriteString(s)
+	}
+	for _, k := range keys {
+		writeString(k)
+		writeString(labels[k])
+	}
+	buf.WriteByte('|')
+	for _, id := range parentIDs {
+		writeString(id)
+	}
+	return buf.String()
+}
+
+// addToLabelSet records that the given item has the label set with the given fingerprint.
+func (idx *InheritIndex) addToLabelSet(id interface{}, fingerprint string, parentIDs []string) {
+	ls := idx.labelSetsByFingerprint[fingerprint]
+	if ls == nil {
+		ls = &labelSet{
+			itemIDs:   set.New(),
+			parentIDs: parentIDs,
+		}
+		idx.labelSetsByFingerprint[fingerprint] = ls
+	}
+	ls.itemIDs.Add(id)
+}
+
+// removeFromLabelSet records that the given item no longer has the label set with the given
+// fingerprint, discarding the label set if that was the last item with it.
+func (idx *InheritIndex) removeFromLabelSet(id interface{}, fingerprint string) {
+	ls := idx.labelSetsByFingerprint[fingerprint]
+	if ls == nil {
+		return
+	}
+	ls.itemIDs.Discard(id)
+	if ls.itemIDs.Len() == 0 {
+		delete(idx.labelSetsByFingerprint, fingerprint)
+	}
+}
+
+// invalidateLabelSetsWithParent marks the cached matches of the label sets that inherit from
+// the given parent as invalid, after its labels or tags change.
+func (idx *InheritIndex) invalidateLabelSetsWithParent(parentID string) {
+	for _, ls := range idx.labelSetsByFingerprint {
+		if !ls.evaluated {
+			continue
+		}
+		for _, id := range ls.parentIDs {
+			if id == parentID {
+				ls.evaluated = false
+				ls.matchingSelIDs = nil
+				break
+			}
+		}
+	}
+}
+
+// matchingSelectors returns the IDs of the selectors that match the label set of the given
+// item, evaluating all the selectors against it if they aren't already cached.
+func (idx *InheritIndex) matchingSelectors(itemID interface{}, item *itemData) set.Set {
+	ls := idx.labelSetsByFingerprint[item.fingerprint]
+	if ls == nil {
+		log.WithField("id", itemID).Panic("Item missing from label set cache")
+	}
+	if !ls.evaluated {
+		log.WithField("id", itemID).Debug("Label set cache miss, evaluating all selectors")
+		ls.matchingSelIDs = set.New()
+		for selId, sel := range idx.selectorsById {
+			if sel.EvaluateLabels(item) {
+				ls.matchingSelIDs.Add(selId)
+			}
+		}
+		ls.evaluated = true
+	}
+	return ls.matchingSelIDs
+}
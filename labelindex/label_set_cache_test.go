@@ -0,0 +1,134 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package labelindex_test
+
+import (
+	"fmt"
+
+	. "github.com/projectcalico/felix/labelindex"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/projectcalico/libcalico-go/lib/selector"
+	"github.com/projectcalico/libcalico-go/lib/selector/parser"
+)
+
+// countingSelector counts the number of times it's evaluated.
+type countingSelector struct {
+	selector.Selector
+	numEvals *int
+}
+
+func (s countingSelector) EvaluateLabels(labels parser.Labels) bool {
+	*s.numEvals++
+	return s.Selector.EvaluateLabels(labels)
+}
+
+var _ = Describe("Index label set cache", func() {
+	var (
+		idx      *InheritIndex
+		started  map[interface{}][]interface{}
+		stopped  map[interface{}][]interface{}
+		numEvals int
+	)
+
+	countingSel := func(s string) selector.Selector {
+		sel, err := selector.Parse(s)
+		Expect(err).NotTo(HaveOccurred())
+		return countingSelector{Selector: sel, numEvals: &numEvals}
+	}
+
+	BeforeEach(func() {
+		started = map[interface{}][]interface{}{}
+		stopped = map[interface{}][]interface{}{}
+		numEvals = 0
+		idx = NewInheritIndex(
+			func(selId, labelId interface{}) {
+				started[selId] = append(started[selId], labelId)
+			},
+			func(selId, labelId interface{}) {
+				stopped[selId] = append(stopped[selId], labelId)
+			},
+		)
+	})
+
+	It("should evaluate each selector once for items with identical labels", func() {
+		idx.UpdateSelector("e1", countingSel(`a=="a1"`))
+		idx.UpdateSelector("e2", countingSel(`a=="a2"`))
+		for i := 0; i < 100; i++ {
+			idx.UpdateLabels(fmt.Sprintf("l%d", i), map[string]string{"a": "a1"}, nil)
+		}
+		Expect(numEvals).To(Equal(2))
+		Expect(started["e1"]).To(HaveLen(100))
+		Expect(started["e2"]).To(BeEmpty())
+	})
+
+	It("should evaluate a new selector once per label set", func() {
+		for i := 0; i < 10; i++ {
+			idx.UpdateLabels(fmt.Sprintf("a1-%d", i), map[string]string{"a": "a1"}, nil)
+			idx.UpdateLabels(fmt.Sprintf("a2-%d", i), map[string]string{"a": "a2"}, nil)
+		}
+		idx.UpdateSelector("e1", countingSel(`a=="a1"`))
+		Expect(numEvals).To(Equal(2))
+		Expect(started["e1"]).To(HaveLen(10))
+
+		By("updating the cached matches when the selector changes")
+		idx.UpdateSelector("e1", countingSel(`a=="a2"`))
+		Expect(stopped["e1"]).To(HaveLen(10))
+		Expect(started["e1"]).To(HaveLen(20))
+		numEvals = 0
+		idx.UpdateLabels("new", map[string]string{"a": "a2"}, nil)
+		Expect(numEvals).To(Equal(0))
+		Expect(started["e1"]).To(HaveLen(21))
+	})
+
+	It("should forget deleted selectors", func() {
+		idx.UpdateSelector("e1", countingSel(`a=="a1"`))
+		idx.UpdateLabels("l1", map[string]string{"a": "a1"}, nil)
+		idx.DeleteSelector("e1")
+		Expect(stopped["e1"]).To(ConsistOf("l1"))
+		idx.UpdateLabels("l2", map[string]string{"a": "a1"}, nil)
+		Expect(started["e1"]).To(ConsistOf("l1"))
+	})
+
+	It("should re-evaluate label sets when a parent's labels change", func() {
+		idx.UpdateSelector("e1", countingSel(`c=="d"`))
+		for i := 0; i < 10; i++ {
+			idx.UpdateLabels(fmt.Sprintf("l%d", i), map[string]string{"a": "a1"}, []string{"p1"})
+		}
+		idx.UpdateLabels("other", map[string]string{"a": "a1"}, nil)
+		Expect(started["e1"]).To(BeEmpty())
+		numEvals = 0
+		idx.UpdateParentLabels("p1", map[string]string{"c": "d"})
+		Expect(numEvals).To(Equal(1))
+		Expect(started["e1"]).To(HaveLen(10))
+		Expect(started["e1"]).NotTo(ContainElement("other"))
+
+		By("re-evaluating when the parent's labels are removed")
+		idx.DeleteParentLabels("p1")
+		Expect(stopped["e1"]).To(HaveLen(10))
+	})
+
+	It("should keep the matches of the remaining items when one is deleted", func() {
+		idx.UpdateSelector("e1", countingSel(`a=="a1"`))
+		idx.UpdateLabels("l1", map[string]string{"a": "a1"}, nil)
+		idx.UpdateLabels("l2", map[string]string{"a": "a1"}, nil)
+		idx.DeleteLabels("l1")
+		Expect(stopped["e1"]).To(ConsistOf("l1"))
+		idx.UpdateSelector("e2", countingSel(`a=="a1"`))
+		Expect(started["e2"]).To(ConsistOf("l2"))
+	})
+})
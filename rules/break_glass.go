@@ -0,0 +1,49 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rules
+
+import (
+	"strings"
+
+	"github.com/projectcalico/felix/iptables"
+)
+
+// BreakGlassChains renders the chains used for break-glass access.  The chains are hooked
+// ahead of all other Calico filter chains.  When active, they accept all traffic from/to the
+// given management CIDRs of the matching IP version; otherwise they are empty.
+func (r *DefaultRuleRenderer) BreakGlassChains(cidrs []string, active bool, ipVersion uint8) []*iptables.Chain {
+	var inRules, outRules []iptables.Rule
+	if active {
+		for _, cidr := range cidrs {
+			if strings.Contains(cidr, ":") != (ipVersion == 6) {
+				continue
+			}
+			inRules = append(inRules, iptables.Rule{
+				Match:   iptables.Match().SourceNet(cidr),
+				Action:  iptables.AcceptAction{},
+				Comment: "Break-glass access",
+			})
+			outRules = append(outRules, iptables.Rule{
+				Match:   iptables.Match().DestNet(cidr),
+				Action:  iptables.AcceptAction{},
+				Comment: "Break-glass access",
+			})
+		}
+	}
+	return []*iptables.Chain{
+		{Name: ChainBreakGlassIn, Rules: inRules},
+		{Name: ChainBreakGlassOut, Rules: outRules},
+	}
+}
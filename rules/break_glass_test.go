@@ -0,0 +1,68 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rules_test
+
+import (
+	. "github.com/projectcalico/felix/rules"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/projectcalico/felix/ipsets"
+	. "github.com/projectcalico/felix/iptables"
+)
+
+var _ = Describe("Break-glass", func() {
+	var renderer RuleRenderer
+	BeforeEach(func() {
+		renderer = NewRenderer(Config{
+			IPSetConfigV4:        ipsets.NewIPVersionConfig(ipsets.IPFamilyV4, "cali", nil, nil),
+			IPSetConfigV6:        ipsets.NewIPVersionConfig(ipsets.IPFamilyV6, "cali", nil, nil),
+			IptablesMarkAccept:   0x8,
+			IptablesMarkPass:     0x10,
+			IptablesMarkScratch0: 0x20,
+			IptablesMarkScratch1: 0x40,
+		})
+	})
+
+	It("should accept the management CIDRs of the right IP version when active", func() {
+		chains := renderer.BreakGlassChains([]string{"10.0.0.0/8", "fd00::/64"}, true, 4)
+		Expect(chains).To(Equal([]*Chain{
+			{
+				Name: "cali-break-glass-in",
+				Rules: []Rule{{
+					Match:   Match().SourceNet("10.0.0.0/8"),
+					Action:  AcceptAction{},
+					Comment: "Break-glass access",
+				}},
+			},
+			{
+				Name: "cali-break-glass-out",
+				Rules: []Rule{{
+					Match:   Match().DestNet("10.0.0.0/8"),
+					Action:  AcceptAction{},
+					Comment: "Break-glass access",
+				}},
+			},
+		}))
+	})
+
+	It("should render empty chains when inactive", func() {
+		Expect(renderer.BreakGlassChains([]string{"10.0.0.0/8"}, false, 4)).To(Equal([]*Chain{
+			{Name: "cali-break-glass-in"},
+			{Name: "cali-break-glass-out"},
+		}))
+	})
+})
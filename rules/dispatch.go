@@ -15,6 +15,7 @@
 package rules
 
 import (
+	"fmt"
 	"sort"
 
 	log "github.com/sirupsen/logrus"
@@ -40,6 +41,7 @@ func (r *DefaultRuleRenderer) WorkloadDispatchChains(
 		WorkloadToEndpointPfx,
 		ChainFromWorkloadDispatch,
 		ChainToWorkloadDispatch,
+		nil,
 		true,
 	)
 }
@@ -67,6 +69,15 @@ func (r *DefaultRuleRenderer) hostDispatchChains(
 		names = append(names, ifaceName)
 	}
 
+	// Interfaces such as SR-IOV PFs can carry workload traffic directly, tagged with a VLAN,
+	// rather than via a veth.  The kernel delivers that traffic on the VLAN sub-interfaces,
+	// which don't have host endpoints of their own, so we dispatch them to the chains of the
+	// parent's host endpoint.
+	vlanIfaceToParent := r.vlanSubInterfaces(endpoints)
+	for vlanIface := range vlanIfaceToParent {
+		names = append(names, vlanIface)
+	}
+
 	if fromOnly {
 		return r.dispatchChains(
 			names,
@@ -74,6 +85,7 @@ func (r *DefaultRuleRenderer) hostDispatchChains(
 			"",
 			ChainDispatchFromHostEndpoint,
 			"",
+			vlanIfaceToParent,
 			false,
 		)
 	} else {
@@ -83,19 +95,57 @@ func (r *DefaultRuleRenderer) hostDispatchChains(
 			HostToEndpointPfx,
 			ChainDispatchFromHostEndpoint,
 			ChainDispatchToHostEndpoint,
+			vlanIfaceToParent,
 			false,
 		)
 	}
 }
 
+// vlanSubInterfaces returns a map from the name of each configured VLAN sub-interface of a host
+// endpoint's interface to the name of that interface.  Sub-interfaces that have a host endpoint
+// of their own are skipped; their own endpoint takes precedence.
+func (r *DefaultRuleRenderer) vlanSubInterfaces(
+	endpoints map[string]proto.HostEndpointID,
+) map[string]string {
+	vlanIfaceToParent := map[string]string{}
+	for ifaceName := range endpoints {
+		for _, vlan := range r.HostEndpointVLANs[ifaceName] {
+			vlanIface := VLANSubInterfaceName(ifaceName, vlan)
+			if _, ok := endpoints[vlanIface]; ok {
+				log.WithField("ifaceName", vlanIface).Debug(
+					"VLAN sub-interface has its own host endpoint")
+				continue
+			}
+			vlanIfaceToParent[vlanIface] = ifaceName
+		}
+	}
+	return vlanIfaceToParent
+}
+
+// VLANSubInterfaceName returns the conventional name of the kernel VLAN sub-interface of the
+// given interface, for example "eth0.100".
+func VLANSubInterfaceName(ifaceName string, vlan int) string {
+	return fmt.Sprintf("%s.%d", ifaceName, vlan)
+}
+
 func (r *DefaultRuleRenderer) dispatchChains(
 	names []string,
 	fromEndpointPfx,
 	toEndpointPfx,
 	dispatchFromEndpointChainName,
 	dispatchToEndpointChainName string,
+	ifaceToEndpointName map[string]string,
 	dropAtEndOfChain bool,
 ) []*Chain {
+	// endpointName maps an interface name to the name that its endpoint's chains are named
+	// after; for most interfaces, that is the interface name itself.
+	endpointName := func(ifaceName string) string {
+		if name, ok := ifaceToEndpointName[ifaceName]; ok {
+			return name
+		}
+		return ifaceName
+	}
+
 	// Sort interface names so that rules in the dispatch chain are ordered deterministically.
 	// Otherwise we would reprogram the dispatch chain when there is no real change.
 	sort.Strings(names)
@@ -188,13 +238,13 @@ func (r *DefaultRuleRenderer) dispatchChains(
 				childFromEndpointRules = append(childFromEndpointRules, Rule{
 					Match: Match().InInterface(name),
 					Action: GotoAction{
-						Target: EndpointChainName(fromEndpointPfx, name),
+						Target: EndpointChainName(fromEndpointPfx, endpointName(name)),
 					},
 				})
 				childToEndpointRules = append(childToEndpointRules, Rule{
 					Match: Match().OutInterface(name),
 					Action: GotoAction{
-						Target: EndpointChainName(toEndpointPfx, name),
+						Target: EndpointChainName(toEndpointPfx, endpointName(name)),
 					},
 				})
 			}
@@ -237,13 +287,13 @@ func (r *DefaultRuleRenderer) dispatchChains(
 			rootFromEndpointRules = append(rootFromEndpointRules, Rule{
 				Match: Match().InInterface(ifaceName),
 				Action: GotoAction{
-					Target: EndpointChainName(fromEndpointPfx, ifaceName),
+					Target: EndpointChainName(fromEndpointPfx, endpointName(ifaceName)),
 				},
 			})
 			rootToEndpointRules = append(rootToEndpointRules, Rule{
 				Match: Match().OutInterface(ifaceName),
 				Action: GotoAction{
-					Target: EndpointChainName(toEndpointPfx, ifaceName),
+					Target: EndpointChainName(toEndpointPfx, endpointName(ifaceName)),
 				},
 			})
 		}
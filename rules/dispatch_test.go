@@ -333,6 +333,80 @@ var _ = Describe("Dispatch chains", func() {
 				},
 			}),
 	)
+
+	Describe("with VLANs configured for a host endpoint interface", func() {
+		BeforeEach(func() {
+			config := rrConfigNormal
+			config.HostEndpointVLANs = map[string][]int{"eth0": {100, 200}}
+			renderer = NewRenderer(config)
+		})
+
+		It("should dispatch the VLAN sub-interfaces to the parent's chains", func() {
+			input := map[string]proto.HostEndpointID{"eth0": {}}
+			Expect(renderer.HostDispatchChains(input)).To(Equal([]*iptables.Chain{
+				{
+					Name: "cali-from-host-endpoint-.",
+					Rules: []iptables.Rule{
+						inboundGotoRule("eth0.100", "cali-fh-eth0"),
+						inboundGotoRule("eth0.200", "cali-fh-eth0"),
+					},
+				},
+				{
+					Name: "cali-to-host-endpoint-.",
+					Rules: []iptables.Rule{
+						outboundGotoRule("eth0.100", "cali-th-eth0"),
+						outboundGotoRule("eth0.200", "cali-th-eth0"),
+					},
+				},
+				{
+					Name: "cali-from-host-endpoint",
+					Rules: []iptables.Rule{
+						inboundGotoRule("eth0", "cali-fh-eth0"),
+						inboundGotoRule("eth0.+", "cali-from-host-endpoint-."),
+					},
+				},
+				{
+					Name: "cali-to-host-endpoint",
+					Rules: []iptables.Rule{
+						outboundGotoRule("eth0", "cali-th-eth0"),
+						outboundGotoRule("eth0.+", "cali-to-host-endpoint-."),
+					},
+				},
+			}))
+		})
+
+		It("should prefer a sub-interface's own host endpoint", func() {
+			input := map[string]proto.HostEndpointID{"eth0": {}, "eth0.100": {}}
+			Expect(renderer.FromHostDispatchChains(input)).To(Equal([]*iptables.Chain{
+				{
+					Name: "cali-from-host-endpoint-.",
+					Rules: []iptables.Rule{
+						inboundGotoRule("eth0.100", "cali-fh-eth0.100"),
+						inboundGotoRule("eth0.200", "cali-fh-eth0"),
+					},
+				},
+				{
+					Name: "cali-from-host-endpoint",
+					Rules: []iptables.Rule{
+						inboundGotoRule("eth0", "cali-fh-eth0"),
+						inboundGotoRule("eth0.+", "cali-from-host-endpoint-."),
+					},
+				},
+			}))
+		})
+
+		It("should ignore VLANs of interfaces without a host endpoint", func() {
+			input := map[string]proto.HostEndpointID{"eth1": {}}
+			Expect(renderer.FromHostDispatchChains(input)).To(Equal([]*iptables.Chain{
+				{
+					Name: "cali-from-host-endpoint",
+					Rules: []iptables.Rule{
+						inboundGotoRule("eth1", "cali-fh-eth1"),
+					},
+				},
+			}))
+		})
+	})
 })
 
 func inboundGotoRule(ifaceMatch string, target string) iptables.Rule {
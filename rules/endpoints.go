@@ -292,12 +292,7 @@ func (r *DefaultRuleRenderer) endpointIptablesChain(
 
 func (r *DefaultRuleRenderer) appendConntrackRules(rules []Rule) []Rule {
 	// Allow return packets for established connections.
-	rules = append(rules,
-		Rule{
-			Match:  Match().ConntrackState("RELATED,ESTABLISHED"),
-			Action: AcceptAction{},
-		},
-	)
+	rules = append(rules, r.conntrackRules()...)
 	if !r.Config.DisableConntrackInvalid {
 		// Drop packets that aren't either a valid handshake or part of an established
 		// connection.
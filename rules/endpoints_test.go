@@ -120,6 +120,49 @@ var _ = Describe("Endpoints", func() {
 		})
 	})
 
+	Describe("with ICMPRelatedErrors=Accept", func() {
+		BeforeEach(func() {
+			config := rrConfigNormal
+			config.ICMPRelatedErrors = ICMPRelatedErrorsAccept
+			renderer = NewRenderer(config)
+		})
+
+		It("should accept ICMP errors ahead of the conntrack rules", func() {
+			chains := renderer.WorkloadEndpointToIptablesChains("cali1234", true, nil, nil, nil)
+			Expect(chains[0].Rules[:9]).To(Equal([]Rule{
+				{Match: Match().Protocol("icmp").ICMPType(3), Action: AcceptAction{}, IPVersion: 4},
+				{Match: Match().Protocol("icmp").ICMPType(11), Action: AcceptAction{}, IPVersion: 4},
+				{Match: Match().Protocol("icmp").ICMPType(12), Action: AcceptAction{}, IPVersion: 4},
+				{Match: Match().Protocol("ipv6-icmp").ICMPV6Type(1), Action: AcceptAction{}, IPVersion: 6},
+				{Match: Match().Protocol("ipv6-icmp").ICMPV6Type(2), Action: AcceptAction{}, IPVersion: 6},
+				{Match: Match().Protocol("ipv6-icmp").ICMPV6Type(3), Action: AcceptAction{}, IPVersion: 6},
+				{Match: Match().Protocol("ipv6-icmp").ICMPV6Type(4), Action: AcceptAction{}, IPVersion: 6},
+				{Match: Match().ConntrackState("RELATED,ESTABLISHED"), Action: AcceptAction{}},
+				{Match: Match().ConntrackState("INVALID"), Action: DropAction{}},
+			}))
+			Expect(chains[1].Rules[:9]).To(Equal(chains[0].Rules[:9]))
+		})
+	})
+
+	Describe("with ICMPRelatedErrors=Drop", func() {
+		BeforeEach(func() {
+			config := rrConfigNormal
+			config.ICMPRelatedErrors = ICMPRelatedErrorsDrop
+			renderer = NewRenderer(config)
+		})
+
+		It("should leave related ICMP errors to policy", func() {
+			chains := renderer.WorkloadEndpointToIptablesChains("cali1234", true, nil, nil, nil)
+			Expect(chains[0].Rules[:4]).To(Equal([]Rule{
+				{Match: Match().ConntrackState("ESTABLISHED"), Action: AcceptAction{}},
+				{Match: Match().ConntrackState("RELATED").NotProtocol("icmp"), Action: AcceptAction{}, IPVersion: 4},
+				{Match: Match().ConntrackState("RELATED").NotProtocol("ipv6-icmp"), Action: AcceptAction{}, IPVersion: 6},
+				{Match: Match().ConntrackState("INVALID"), Action: DropAction{}},
+			}))
+			Expect(chains[1].Rules[:4]).To(Equal(chains[0].Rules[:4]))
+		})
+	})
+
 	It("should render a disabled workload endpoint", func() {
 		Expect(renderer.WorkloadEndpointToIptablesChains("cali1234", false, nil, nil, nil)).To(Equal([]*Chain{
 			{
@@ -0,0 +1,129 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rules
+
+import (
+	. "github.com/projectcalico/felix/iptables"
+	"github.com/projectcalico/felix/proto"
+)
+
+// Values of Config.ICMPRelatedErrors.  Per-policy overrides use Accept and Drop.
+const (
+	// ICMPRelatedErrorsConntrack, the default, accepts ICMP errors that conntrack classifies as
+	// related to an allowed connection.  What counts as related depends on the conntrack
+	// configuration so behaviour varies between hosts.
+	ICMPRelatedErrorsConntrack = "Conntrack"
+	// ICMPRelatedErrorsAccept accepts all ICMP errors to and from endpoints, even those about
+	// flows that policy denied or that conntrack doesn't know about.
+	ICMPRelatedErrorsAccept = "Accept"
+	// ICMPRelatedErrorsDrop drops ICMP errors unless policy allows them, even those related
+	// to allowed connections.
+	ICMPRelatedErrorsDrop = "Drop"
+)
+
+// icmpErrorTypes maps from IP version to the ICMP types that carry errors about another packet.
+var icmpErrorTypes = map[uint8][]int32{
+	// Destination unreachable (including "fragmentation needed", which PMTU discovery relies
+	// on), time exceeded and parameter problem.
+	4: {3, 11, 12},
+	// Destination unreachable, packet too big, time exceeded and parameter problem.
+	6: {1, 2, 3, 4},
+}
+
+var icmpProtocolNames = map[uint8]string{
+	4: "icmp",
+	6: "ipv6-icmp",
+}
+
+// conntrackRules returns the rules at the start of each tracked endpoint chain that accept the
+// packets of established connections and drop invalid ones.  Config.ICMPRelatedErrors controls
+// how they treat ICMP errors.
+func (r *DefaultRuleRenderer) conntrackRules() []Rule {
+	var rules []Rule
+	switch r.Config.ICMPRelatedErrors {
+	case ICMPRelatedErrorsAccept:
+		// Accept ICMP errors before conntrack has its say; errors about flows that conntrack
+		// doesn't know would otherwise be dropped as invalid.
+		for _, ipVersion := range []uint8{4, 6} {
+			for _, icmpType := range icmpErrorTypes[ipVersion] {
+				rules = append(rules, Rule{
+					Match:     icmpTypeMatch(ipVersion, uint8(icmpType)),
+					Action:    AcceptAction{},
+					IPVersion: ipVersion,
+				})
+			}
+		}
+		rules = append(rules, Rule{
+			Match:  Match().ConntrackState("RELATED,ESTABLISHED"),
+			Action: AcceptAction{},
+		})
+	case ICMPRelatedErrorsDrop:
+		// Accept related packets, such as FTP data connections, but leave ICMP errors to
+		// policy.
+		rules = append(rules, Rule{
+			Match:  Match().ConntrackState("ESTABLISHED"),
+			Action: AcceptAction{},
+		})
+		for _, ipVersion := range []uint8{4, 6} {
+			rules = append(rules, Rule{
+				Match:     Match().ConntrackState("RELATED").NotProtocol(icmpProtocolNames[ipVersion]),
+				Action:    AcceptAction{},
+				IPVersion: ipVersion,
+			})
+		}
+	default:
+		rules = append(rules, Rule{
+			Match:  Match().ConntrackState("RELATED,ESTABLISHED"),
+			Action: AcceptAction{},
+		})
+	}
+	return rules
+}
+
+func icmpTypeMatch(ipVersion uint8, icmpType uint8) MatchCriteria {
+	match := Match().Protocol(icmpProtocolNames[ipVersion])
+	if ipVersion == 4 {
+		return match.ICMPType(icmpType)
+	}
+	return match.ICMPV6Type(icmpType)
+}
+
+// policyICMPErrorRules returns the rules that implement the policy's ICMPRelatedErrors
+// override, if any, to go ahead of its own rules.  They only see the ICMP errors that reach the
+// policy: with the default Config.ICMPRelatedErrors, conntrack has already accepted those
+// related to allowed connections and dropped those that it doesn't know about.
+func policyICMPErrorRules(policy *proto.Policy, ipVersion uint8) []*proto.Rule {
+	var action string
+	switch policy.IcmpRelatedErrors {
+	case ICMPRelatedErrorsAccept:
+		action = "allow"
+	case ICMPRelatedErrorsDrop:
+		action = "deny"
+	default:
+		return nil
+	}
+	var rules []*proto.Rule
+	for _, icmpType := range icmpErrorTypes[ipVersion] {
+		rules = append(rules, &proto.Rule{
+			Action:    action,
+			IpVersion: proto.IPVersion(ipVersion),
+			Protocol: &proto.Protocol{
+				NumberOrName: &proto.Protocol_Name{Name: icmpProtocolNames[ipVersion]},
+			},
+			Icmp: &proto.Rule_IcmpType{IcmpType: icmpType},
+		})
+	}
+	return rules
+}
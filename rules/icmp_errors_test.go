@@ -0,0 +1,82 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rules_test
+
+import (
+	. "github.com/projectcalico/felix/rules"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/projectcalico/felix/ipsets"
+	. "github.com/projectcalico/felix/iptables"
+	"github.com/projectcalico/felix/proto"
+)
+
+var _ = Describe("Policy ICMP error overrides", func() {
+	var rrConfig = Config{
+		IPSetConfigV4:        ipsets.NewIPVersionConfig(ipsets.IPFamilyV4, "cali", nil, nil),
+		IPSetConfigV6:        ipsets.NewIPVersionConfig(ipsets.IPFamilyV6, "cali", nil, nil),
+		IptablesMarkAccept:   0x8,
+		IptablesMarkPass:     0x10,
+		IptablesMarkScratch0: 0x20,
+		IptablesMarkScratch1: 0x40,
+	}
+	policyID := &proto.PolicyID{Tier: "default", Name: "pol1"}
+
+	var renderer RuleRenderer
+	BeforeEach(func() {
+		renderer = NewRenderer(rrConfig)
+	})
+
+	It("should render a policy without an override unchanged", func() {
+		chains := renderer.PolicyToIptablesChains(policyID, &proto.Policy{
+			InboundRules: []*proto.Rule{{Action: "deny"}},
+		}, 4)
+		Expect(chains[0].Rules).To(Equal([]Rule{{Action: DropAction{}}}))
+		Expect(chains[1].Rules).To(BeEmpty())
+	})
+
+	It("should drop ICMPv4 errors ahead of the rules in both directions", func() {
+		chains := renderer.PolicyToIptablesChains(policyID, &proto.Policy{
+			InboundRules:      []*proto.Rule{{Action: "deny"}},
+			IcmpRelatedErrors: ICMPRelatedErrorsDrop,
+		}, 4)
+		icmpRules := []Rule{
+			{Match: Match().Protocol("icmp").ICMPType(3), Action: DropAction{}},
+			{Match: Match().Protocol("icmp").ICMPType(11), Action: DropAction{}},
+			{Match: Match().Protocol("icmp").ICMPType(12), Action: DropAction{}},
+		}
+		Expect(chains[0].Rules).To(Equal(append(icmpRules, Rule{Action: DropAction{}})))
+		Expect(chains[1].Rules).To(Equal(icmpRules))
+	})
+
+	It("should accept ICMPv6 errors ahead of the rules", func() {
+		chains := renderer.PolicyToIptablesChains(policyID, &proto.Policy{
+			OutboundRules:     []*proto.Rule{{Action: "deny"}},
+			IcmpRelatedErrors: ICMPRelatedErrorsAccept,
+		}, 6)
+		Expect(chains[1].Rules).To(HaveLen(4*2 + 1))
+		Expect(chains[1].Rules[0]).To(Equal(Rule{
+			Match:  Match().Protocol("ipv6-icmp").ICMPV6Type(1),
+			Action: SetMarkAction{Mark: 0x8},
+		}))
+		Expect(chains[1].Rules[1]).To(Equal(Rule{
+			Match:  Match().MarkSet(0x8),
+			Action: ReturnAction{},
+		}))
+		Expect(chains[1].Rules[8]).To(Equal(Rule{Action: DropAction{}}))
+	})
+})
@@ -0,0 +1,84 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rules
+
+import (
+	"strings"
+
+	. "github.com/projectcalico/felix/iptables"
+)
+
+// A node-local DNS cache listens on a link-local address that is assigned to a dummy interface
+// on each host.  Pods and the host itself send DNS requests to that address.  The cache needs
+// that traffic to bypass conntrack, both for performance and to avoid conntrack races that
+// drop UDP DNS packets, and to be accepted even when the host's policy would otherwise block
+// it.  The cache normally installs its own raw and filter rules for that.  If we render them,
+// users don't need to maintain the rules by hand, and they can't be shadowed by our chains.
+
+// nodeLocalDNSAddrs returns the configured node-local DNS addresses of the given IP version.
+func (r *DefaultRuleRenderer) nodeLocalDNSAddrs(ipVersion uint8) (addrs []string) {
+	for _, addr := range r.NodeLocalDNSAddresses {
+		if strings.Contains(addr, ":") != (ipVersion == 6) {
+			continue
+		}
+		addrs = append(addrs, addr)
+	}
+	return
+}
+
+// nodeLocalDNSRules renders a rule for each node-local DNS address and protocol.  If toCache
+// is true, the rules match requests to the cache; otherwise, they match its responses.
+func (r *DefaultRuleRenderer) nodeLocalDNSRules(ipVersion uint8, toCache bool, action Action) (rules []Rule) {
+	for _, addr := range r.nodeLocalDNSAddrs(ipVersion) {
+		for _, protocol := range []string{"udp", "tcp"} {
+			var match MatchCriteria
+			if toCache {
+				match = Match().Protocol(protocol).DestNet(addr).DestPorts(r.NodeLocalDNSPort)
+			} else {
+				match = Match().Protocol(protocol).SourceNet(addr).SourcePorts(r.NodeLocalDNSPort)
+			}
+			rules = append(rules, Rule{
+				Match:   match,
+				Action:  action,
+				Comment: "Node-local DNS cache",
+			})
+		}
+	}
+	return
+}
+
+// rawPreroutingNodeLocalDNSRules disables conntrack for requests to the cache from pods.
+func (r *DefaultRuleRenderer) rawPreroutingNodeLocalDNSRules(ipVersion uint8) []Rule {
+	return r.nodeLocalDNSRules(ipVersion, true, NoTrackAction{})
+}
+
+// rawOutputNodeLocalDNSRules disables conntrack for requests to the cache from the host and
+// for the cache's responses.
+func (r *DefaultRuleRenderer) rawOutputNodeLocalDNSRules(ipVersion uint8) []Rule {
+	rules := r.nodeLocalDNSRules(ipVersion, true, NoTrackAction{})
+	return append(rules, r.nodeLocalDNSRules(ipVersion, false, NoTrackAction{})...)
+}
+
+// filterInputNodeLocalDNSRules accepts requests to the cache.  Since the requests are
+// untracked, they would otherwise be subject to policy in both directions.
+func (r *DefaultRuleRenderer) filterInputNodeLocalDNSRules(ipVersion uint8) []Rule {
+	return r.nodeLocalDNSRules(ipVersion, true, AcceptAction{})
+}
+
+// filterOutputNodeLocalDNSRules accepts the cache's responses and requests from the host.
+func (r *DefaultRuleRenderer) filterOutputNodeLocalDNSRules(ipVersion uint8) []Rule {
+	rules := r.nodeLocalDNSRules(ipVersion, false, AcceptAction{})
+	return append(rules, r.nodeLocalDNSRules(ipVersion, true, AcceptAction{})...)
+}
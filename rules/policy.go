@@ -28,24 +28,37 @@ import (
 // ruleRenderer defined in rules_defs.go.
 
 func (r *DefaultRuleRenderer) PolicyToIptablesChains(policyID *proto.PolicyID, policy *proto.Policy, ipVersion uint8) []*iptables.Chain {
+	inName := PolicyChainName(PolicyInboundPfx, policyID)
+	outName := PolicyChainName(PolicyOutboundPfx, policyID)
+	if err := r.policyLimitError(policyID, policy); err != nil {
+		return RejectedPolicyChains(err, inName, outName)
+	}
+	// Any ICMP error override goes ahead of the policy's own rules, in both directions.
+	inboundRules := append(policyICMPErrorRules(policy, ipVersion), policy.InboundRules...)
+	outboundRules := append(policyICMPErrorRules(policy, ipVersion), policy.OutboundRules...)
 	inbound := iptables.Chain{
-		Name:  PolicyChainName(PolicyInboundPfx, policyID),
-		Rules: r.ProtoRulesToIptablesRules(policy.InboundRules, ipVersion),
+		Name:  inName,
+		Rules: r.ProtoRulesToIptablesRules(inboundRules, ipVersion),
 	}
 	outbound := iptables.Chain{
-		Name:  PolicyChainName(PolicyOutboundPfx, policyID),
-		Rules: r.ProtoRulesToIptablesRules(policy.OutboundRules, ipVersion),
+		Name:  outName,
+		Rules: r.ProtoRulesToIptablesRules(outboundRules, ipVersion),
 	}
 	return []*iptables.Chain{&inbound, &outbound}
 }
 
 func (r *DefaultRuleRenderer) ProfileToIptablesChains(profileID *proto.ProfileID, profile *proto.Profile, ipVersion uint8) []*iptables.Chain {
+	inName := ProfileChainName(ProfileInboundPfx, profileID)
+	outName := ProfileChainName(ProfileOutboundPfx, profileID)
+	if err := r.profileLimitError(profileID, profile); err != nil {
+		return RejectedPolicyChains(err, inName, outName)
+	}
 	inbound := iptables.Chain{
-		Name:  ProfileChainName(ProfileInboundPfx, profileID),
+		Name:  inName,
 		Rules: r.ProtoRulesToIptablesRules(profile.InboundRules, ipVersion),
 	}
 	outbound := iptables.Chain{
-		Name:  ProfileChainName(ProfileOutboundPfx, profileID),
+		Name:  outName,
 		Rules: r.ProtoRulesToIptablesRules(profile.OutboundRules, ipVersion),
 	}
 	return []*iptables.Chain{&inbound, &outbound}
@@ -0,0 +1,125 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rules
+
+import (
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/projectcalico/felix/iptables"
+	"github.com/projectcalico/felix/proto"
+)
+
+// A single pathological policy, for example, one with tens of thousands of CIDRs, can produce
+// an iptables-restore transaction so large that it times out, blocking every other update.
+// The limits in Config let us reject such a policy up front.  A rejected policy is rendered
+// as chains that drop all traffic, so that it fails closed: the endpoint chains still jump to
+// its chains and simply leaving them empty would skip the policy's deny rules.
+
+// Names of the limits, as used in PolicyLimitError.
+const (
+	LimitMaxRulesPerPolicy = "MaxRulesPerPolicy"
+	LimitMaxCIDRsPerRule   = "MaxCIDRsPerRule"
+	LimitMaxPolicyChains   = "MaxPolicyChains"
+)
+
+// PolicyLimitError is returned when a policy or profile exceeds one of the configured limits.
+type PolicyLimitError struct {
+	// Kind is "policy" or "profile".
+	Kind string
+	// Name identifies the policy ("<tier>/<name>") or profile.
+	Name string
+	// Limit is one of the Limit... constants.
+	Limit string
+	// RuleIndex is the index of the offending rule, or -1 if the limit isn't per-rule.
+	RuleIndex int
+	// Max is the configured limit and Actual is the value that exceeded it.
+	Max, Actual int
+}
+
+func (e *PolicyLimitError) Error() string {
+	if e.RuleIndex >= 0 {
+		return fmt.Sprintf("%s %s rule %d exceeds %s: %d > %d",
+			e.Kind, e.Name, e.RuleIndex, e.Limit, e.Actual, e.Max)
+	}
+	return fmt.Sprintf("%s %s exceeds %s: %d > %d", e.Kind, e.Name, e.Limit, e.Actual, e.Max)
+}
+
+// policyLimitError returns a *PolicyLimitError if the policy exceeds MaxRulesPerPolicy or
+// MaxCIDRsPerRule, or nil if it's within the limits.
+func (r *DefaultRuleRenderer) policyLimitError(policyID *proto.PolicyID, policy *proto.Policy) *PolicyLimitError {
+	return r.checkRuleLimits("policy", policyID.Tier+"/"+policyID.Name, policy.InboundRules, policy.OutboundRules)
+}
+
+// profileLimitError is the equivalent of policyLimitError for profiles.
+func (r *DefaultRuleRenderer) profileLimitError(profileID *proto.ProfileID, profile *proto.Profile) *PolicyLimitError {
+	return r.checkRuleLimits("profile", profileID.Name, profile.InboundRules, profile.OutboundRules)
+}
+
+func (r *DefaultRuleRenderer) checkRuleLimits(kind, name string, inbound, outbound []*proto.Rule) *PolicyLimitError {
+	numRules := len(inbound) + len(outbound)
+	if r.MaxRulesPerPolicy > 0 && numRules > r.MaxRulesPerPolicy {
+		return &PolicyLimitError{
+			Kind:      kind,
+			Name:      name,
+			Limit:     LimitMaxRulesPerPolicy,
+			RuleIndex: -1,
+			Max:       r.MaxRulesPerPolicy,
+			Actual:    numRules,
+		}
+	}
+	if r.MaxCIDRsPerRule <= 0 {
+		return nil
+	}
+	// Rules are numbered across both directions, inbound first.
+	for i, pRule := range append(append([]*proto.Rule(nil), inbound...), outbound...) {
+		numCIDRs := len(pRule.SrcNet) + len(pRule.NotSrcNet) + len(pRule.DstNet) + len(pRule.NotDstNet)
+		if numCIDRs > r.MaxCIDRsPerRule {
+			return &PolicyLimitError{
+				Kind:      kind,
+				Name:      name,
+				Limit:     LimitMaxCIDRsPerRule,
+				RuleIndex: i,
+				Max:       r.MaxCIDRsPerRule,
+				Actual:    numCIDRs,
+			}
+		}
+	}
+	return nil
+}
+
+// RejectedPolicyChains returns chains with the given names that drop all traffic, for use in
+// place of the chains of a policy or profile that was rejected with the given error.
+func RejectedPolicyChains(err *PolicyLimitError, chainNames ...string) []*iptables.Chain {
+	log.WithFields(log.Fields{
+		"kind":   err.Kind,
+		"name":   err.Name,
+		"limit":  err.Limit,
+		"max":    err.Max,
+		"actual": err.Actual,
+	}).Error("Rejecting policy that exceeds a configured limit; its chains will drop all traffic")
+	chains := make([]*iptables.Chain, 0, len(chainNames))
+	for _, chainName := range chainNames {
+		chains = append(chains, &iptables.Chain{
+			Name: chainName,
+			Rules: []iptables.Rule{{
+				Action:  iptables.DropAction{},
+				Comment: fmt.Sprintf("Rejected %s, exceeds %s", err.Kind, err.Limit),
+			}},
+		})
+	}
+	return chains
+}
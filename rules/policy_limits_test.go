@@ -0,0 +1,115 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rules_test
+
+import (
+	. "github.com/projectcalico/felix/rules"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/projectcalico/felix/ipsets"
+	. "github.com/projectcalico/felix/iptables"
+	"github.com/projectcalico/felix/proto"
+)
+
+var _ = Describe("Policy limits", func() {
+	var rrConfigLimited = Config{
+		IPSetConfigV4:        ipsets.NewIPVersionConfig(ipsets.IPFamilyV4, "cali", nil, nil),
+		IPSetConfigV6:        ipsets.NewIPVersionConfig(ipsets.IPFamilyV6, "cali", nil, nil),
+		IptablesMarkAccept:   0x8,
+		IptablesMarkPass:     0x10,
+		IptablesMarkScratch0: 0x20,
+		IptablesMarkScratch1: 0x40,
+		MaxRulesPerPolicy:    2,
+		MaxCIDRsPerRule:      2,
+	}
+	policyID := &proto.PolicyID{Tier: "default", Name: "pol1"}
+	profileID := &proto.ProfileID{Name: "prof1"}
+
+	var renderer RuleRenderer
+	BeforeEach(func() {
+		renderer = NewRenderer(rrConfigLimited)
+	})
+
+	rejected := func(name, comment string) *Chain {
+		return &Chain{
+			Name:  name,
+			Rules: []Rule{{Action: DropAction{}, Comment: comment}},
+		}
+	}
+
+	It("should render a policy within the limits", func() {
+		chains := renderer.PolicyToIptablesChains(policyID, &proto.Policy{
+			InboundRules:  []*proto.Rule{{Action: "allow", SrcNet: []string{"10.0.0.0/8", "11.0.0.0/8"}}},
+			OutboundRules: []*proto.Rule{{Action: "deny"}},
+		}, 4)
+		Expect(chains).To(HaveLen(2))
+		Expect(chains[0].Rules).NotTo(BeEmpty())
+		Expect(chains[0].Rules[0].Action).NotTo(Equal(DropAction{}))
+	})
+
+	It("should reject a policy with too many rules", func() {
+		Expect(renderer.PolicyToIptablesChains(policyID, &proto.Policy{
+			InboundRules:  []*proto.Rule{{Action: "allow"}, {Action: "allow"}},
+			OutboundRules: []*proto.Rule{{Action: "allow"}},
+		}, 4)).To(Equal([]*Chain{
+			rejected("cali-pi-pol1", "Rejected policy, exceeds MaxRulesPerPolicy"),
+			rejected("cali-po-pol1", "Rejected policy, exceeds MaxRulesPerPolicy"),
+		}))
+	})
+
+	It("should reject a profile with a rule that has too many CIDRs", func() {
+		Expect(renderer.ProfileToIptablesChains(profileID, &proto.Profile{
+			OutboundRules: []*proto.Rule{{
+				Action:    "allow",
+				DstNet:    []string{"10.0.0.0/8", "11.0.0.0/8"},
+				NotDstNet: []string{"10.0.0.1/32"},
+			}},
+		}, 4)).To(Equal([]*Chain{
+			rejected("cali-pri-prof1", "Rejected profile, exceeds MaxCIDRsPerRule"),
+			rejected("cali-pro-prof1", "Rejected profile, exceeds MaxCIDRsPerRule"),
+		}))
+	})
+
+	It("should name the offending policy and rule in the error", func() {
+		err := &PolicyLimitError{
+			Kind:      "policy",
+			Name:      "default/pol1",
+			Limit:     LimitMaxCIDRsPerRule,
+			RuleIndex: 3,
+			Max:       2,
+			Actual:    5,
+		}
+		Expect(err.Error()).To(Equal("policy default/pol1 rule 3 exceeds MaxCIDRsPerRule: 5 > 2"))
+		err.RuleIndex = -1
+		Expect(err.Error()).To(Equal("policy default/pol1 exceeds MaxCIDRsPerRule: 5 > 2"))
+	})
+
+	It("should not limit anything by default", func() {
+		renderer = NewRenderer(Config{
+			IPSetConfigV4:        ipsets.NewIPVersionConfig(ipsets.IPFamilyV4, "cali", nil, nil),
+			IPSetConfigV6:        ipsets.NewIPVersionConfig(ipsets.IPFamilyV6, "cali", nil, nil),
+			IptablesMarkAccept:   0x8,
+			IptablesMarkPass:     0x10,
+			IptablesMarkScratch0: 0x20,
+			IptablesMarkScratch1: 0x40,
+		})
+		chains := renderer.PolicyToIptablesChains(policyID, &proto.Policy{
+			InboundRules: []*proto.Rule{{Action: "deny"}, {Action: "deny"}, {Action: "deny"}},
+		}, 4)
+		Expect(chains[0].Rules).To(HaveLen(3))
+	})
+})
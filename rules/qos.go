@@ -0,0 +1,122 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rules
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	. "github.com/projectcalico/felix/iptables"
+)
+
+// QoS policies set the DSCP field of traffic from the workload endpoints that they apply to, so
+// that the network can prioritise it.  We set the field in the mangle table, from a chain that
+// the mangle PREROUTING chain jumps to before it accepts workload traffic; the static chains
+// include an empty version of that chain, which is replaced once policies are resolved.
+//
+// A packet can only carry one DSCP value so, if two policies that apply to the same endpoint
+// set different values, we report the conflict and leave the endpoint's traffic alone rather
+// than picking a winner arbitrarily.
+
+// QoSPolicy sets the DSCP field of traffic from the endpoints that it applies to.
+type QoSPolicy struct {
+	Name string
+	DSCP uint8
+}
+
+// Validate returns an error if the policy's DSCP value doesn't fit in the DSCP field.
+func (p QoSPolicy) Validate() error {
+	if p.DSCP > MaxDSCP {
+		return fmt.Errorf("QoS policy %q: DSCP value %d out of range 0-%d", p.Name, p.DSCP, MaxDSCP)
+	}
+	return nil
+}
+
+// QoSConflict records that the named policies set different DSCP values on the same endpoint.
+type QoSConflict struct {
+	IfaceName string
+	Policies  []string
+}
+
+func (c QoSConflict) Error() string {
+	return fmt.Sprintf("conflicting QoS policies on interface %s: %s",
+		c.IfaceName, strings.Join(c.Policies, ", "))
+}
+
+// ResolveEndpointQoS calculates the DSCP value to set on traffic from each workload interface,
+// given the QoS policies that apply to it.  Invalid policies are ignored.  Interfaces whose
+// policies disagree are left out of the result and reported as conflicts, sorted by interface
+// name.
+func ResolveEndpointQoS(ifaceToPolicies map[string][]QoSPolicy) (ifaceToDSCP map[string]uint8, conflicts []QoSConflict) {
+	ifaceToDSCP = map[string]uint8{}
+	for ifaceName, policies := range ifaceToPolicies {
+		dscpToPolicies := map[uint8][]string{}
+		for _, p := range policies {
+			if err := p.Validate(); err != nil {
+				log.WithError(err).WithField("ifaceName", ifaceName).Warn("Ignoring invalid QoS policy")
+				continue
+			}
+			dscpToPolicies[p.DSCP] = append(dscpToPolicies[p.DSCP], p.Name)
+		}
+		switch len(dscpToPolicies) {
+		case 0:
+			continue
+		case 1:
+			for dscp := range dscpToPolicies {
+				ifaceToDSCP[ifaceName] = dscp
+			}
+		default:
+			var names []string
+			for _, n := range dscpToPolicies {
+				names = append(names, n...)
+			}
+			sort.Strings(names)
+			log.WithFields(log.Fields{
+				"ifaceName": ifaceName,
+				"policies":  names,
+			}).Warn("Conflicting QoS policies, not setting DSCP")
+			conflicts = append(conflicts, QoSConflict{IfaceName: ifaceName, Policies: names})
+		}
+	}
+	sort.Slice(conflicts, func(i, j int) bool {
+		return conflicts[i].IfaceName < conflicts[j].IfaceName
+	})
+	return
+}
+
+// WorkloadQoSChains renders the mangle chain that sets the DSCP field of traffic from each
+// workload interface.
+func (r *DefaultRuleRenderer) WorkloadQoSChains(ifaceToDSCP map[string]uint8) []*Chain {
+	ifaceNames := make([]string, 0, len(ifaceToDSCP))
+	for ifaceName := range ifaceToDSCP {
+		ifaceNames = append(ifaceNames, ifaceName)
+	}
+	sort.Strings(ifaceNames)
+
+	rules := []Rule{}
+	for _, ifaceName := range ifaceNames {
+		rules = append(rules, Rule{
+			Match:  Match().InInterface(ifaceName),
+			Action: DSCPAction{Value: ifaceToDSCP[ifaceName]},
+		})
+	}
+	return []*Chain{{
+		Name:  ChainQoSFromWorkload,
+		Rules: rules,
+	}}
+}
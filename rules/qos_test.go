@@ -0,0 +1,103 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rules_test
+
+import (
+	. "github.com/projectcalico/felix/rules"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/projectcalico/felix/ipsets"
+	. "github.com/projectcalico/felix/iptables"
+)
+
+var _ = Describe("QoS", func() {
+	var rrConfigNormal = Config{
+		IPSetConfigV4:         ipsets.NewIPVersionConfig(ipsets.IPFamilyV4, "cali", nil, nil),
+		IPSetConfigV6:         ipsets.NewIPVersionConfig(ipsets.IPFamilyV6, "cali", nil, nil),
+		WorkloadIfacePrefixes: []string{"cali"},
+		IptablesMarkAccept:    0x8,
+		IptablesMarkPass:      0x10,
+		IptablesMarkScratch0:  0x20,
+		IptablesMarkScratch1:  0x40,
+	}
+
+	var renderer RuleRenderer
+	BeforeEach(func() {
+		renderer = NewRenderer(rrConfigNormal)
+	})
+
+	It("should render a DSCP rule per interface, in order", func() {
+		Expect(renderer.WorkloadQoSChains(map[string]uint8{
+			"cali2": 10,
+			"cali1": 46,
+		})).To(Equal([]*Chain{{
+			Name: "cali-qos-from-wl",
+			Rules: []Rule{
+				{Match: Match().InInterface("cali1"), Action: DSCPAction{Value: 46}},
+				{Match: Match().InInterface("cali2"), Action: DSCPAction{Value: 10}},
+			},
+		}}))
+	})
+
+	It("should render an empty chain with no policies", func() {
+		Expect(renderer.WorkloadQoSChains(nil)).To(Equal([]*Chain{{
+			Name:  "cali-qos-from-wl",
+			Rules: []Rule{},
+		}}))
+	})
+
+	It("should jump to the QoS chain before accepting established traffic", func() {
+		chains := renderer.StaticMangleTableChains(4)
+		Expect(chains).To(ContainElement(&Chain{Name: "cali-qos-from-wl", Rules: []Rule{}}))
+		prerouting := chains[1]
+		Expect(prerouting.Name).To(Equal("cali-PREROUTING"))
+		Expect(prerouting.Rules[0]).To(Equal(Rule{Action: JumpAction{Target: "cali-qos-from-wl"}}))
+	})
+
+	Describe("resolving policies", func() {
+		It("should use the value of agreeing policies", func() {
+			dscps, conflicts := ResolveEndpointQoS(map[string][]QoSPolicy{
+				"cali1": {{Name: "a", DSCP: 46}, {Name: "b", DSCP: 46}},
+				"cali2": {{Name: "c", DSCP: 10}},
+				"cali3": nil,
+			})
+			Expect(dscps).To(Equal(map[string]uint8{"cali1": 46, "cali2": 10}))
+			Expect(conflicts).To(BeEmpty())
+		})
+
+		It("should flag competing policies as a conflict", func() {
+			dscps, conflicts := ResolveEndpointQoS(map[string][]QoSPolicy{
+				"cali1": {{Name: "b", DSCP: 46}, {Name: "a", DSCP: 10}, {Name: "c", DSCP: 46}},
+				"cali2": {{Name: "d", DSCP: 10}},
+			})
+			Expect(dscps).To(Equal(map[string]uint8{"cali2": 10}))
+			Expect(conflicts).To(Equal([]QoSConflict{
+				{IfaceName: "cali1", Policies: []string{"a", "b", "c"}},
+			}))
+			Expect(conflicts[0].Error()).To(Equal("conflicting QoS policies on interface cali1: a, b, c"))
+		})
+
+		It("should ignore out-of-range values", func() {
+			Expect(QoSPolicy{Name: "a", DSCP: 64}.Validate()).To(HaveOccurred())
+			dscps, conflicts := ResolveEndpointQoS(map[string][]QoSPolicy{
+				"cali1": {{Name: "a", DSCP: 64}, {Name: "b", DSCP: 46}},
+			})
+			Expect(dscps).To(Equal(map[string]uint8{"cali1": 46}))
+			Expect(conflicts).To(BeEmpty())
+		})
+	})
+})
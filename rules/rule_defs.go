@@ -47,12 +47,16 @@ const (
 	ChainFailsafeIn  = ChainNamePrefix + "failsafe-in"
 	ChainFailsafeOut = ChainNamePrefix + "failsafe-out"
 
+	ChainBreakGlassIn  = ChainNamePrefix + "break-glass-in"
+	ChainBreakGlassOut = ChainNamePrefix + "break-glass-out"
+
 	ChainNATPrerouting  = ChainNamePrefix + "PREROUTING"
 	ChainNATPostrouting = ChainNamePrefix + "POSTROUTING"
 	ChainNATOutput      = ChainNamePrefix + "OUTPUT"
 	ChainNATOutgoing    = ChainNamePrefix + "nat-outgoing"
 
 	ChainManglePrerouting = ChainNamePrefix + "PREROUTING"
+	ChainQoSFromWorkload  = ChainNamePrefix + "qos-from-wl"
 
 	IPSetIDNATOutgoingAllPools  = "all-ipam-pools"
 	IPSetIDNATOutgoingMasqPools = "masq-ipam-pools"
@@ -100,25 +104,36 @@ type PolicyChainNamePrefix string
 type ProfileChainNamePrefix string
 
 var (
-	// AllHistoricChainNamePrefixes lists all the prefixes that we've used for chains.  Keeping
-	// track of the old names lets us clean them up.
-	AllHistoricChainNamePrefixes = []string{
-		// Current.
-		"cali-",
-
-		// Early RCs of Felix 2.1 used "cali" as the prefix for some chains rather than
-		// "cali-".  This led to name clashes with the DHCP agent, which uses "calico-" as
-		// its prefix.  We need to explicitly list these exceptions.
-		"califw-",
-		"calitw-",
-		"califh-",
-		"calith-",
-		"calipi-",
-		"calipo-",
-
-		// Pre Felix v2.1.
-		"felix-",
+	// HistoricCompatTable lists all the prefixes that we've used for chains, and the rules that
+	// old versions inserted into other processes' chains.  Keeping track of them lets us clean
+	// them up.  Forks can add their own entries with Table.RegisterLegacyChainPrefix() and
+	// Table.RegisterLegacyRule().
+	HistoricCompatTable = &iptables.CompatTable{
+		ChainPrefixes: []iptables.LegacyChainPrefix{
+			// Current.
+			{Prefix: ChainNamePrefix},
+
+			// Early RCs of Felix 2.1 used "cali" as the prefix for some chains rather
+			// than "cali-".  This led to name clashes with the DHCP agent, which uses
+			// "calico-" as its prefix.  We need to explicitly list these exceptions.
+			{Prefix: "califw-", Until: "v2.1.0"},
+			{Prefix: "calitw-", Until: "v2.1.0"},
+			{Prefix: "califh-", Until: "v2.1.0"},
+			{Prefix: "calith-", Until: "v2.1.0"},
+			{Prefix: "calipi-", Until: "v2.1.0"},
+			{Prefix: "calipo-", Until: "v2.1.0"},
+
+			// Pre Felix v2.1.
+			{Prefix: "felix-", Until: "v2.1.0"},
+		},
+		Rules: []iptables.LegacyRule{
+			// Python felix.
+			{Table: "nat", Pattern: HistoricInsertedNATRuleRegex, Until: "v2.0.0"},
+		},
 	}
+	// AllHistoricChainNamePrefixes lists all the prefixes that we've used for chains.
+	// Deprecated: use HistoricCompatTable.
+	AllHistoricChainNamePrefixes = HistoricCompatTable.Prefixes()
 	// AllHistoricIPSetNamePrefixes, similarly contains all the prefixes we've ever used for IP
 	// sets.
 	AllHistoricIPSetNamePrefixes = []string{"felix-", "cali"}
@@ -166,6 +181,10 @@ type RuleRenderer interface {
 
 	NATOutgoingChain(active bool, ipVersion uint8) *iptables.Chain
 
+	BreakGlassChains(cidrs []string, active bool, ipVersion uint8) []*iptables.Chain
+
+	WorkloadQoSChains(ifaceToDSCP map[string]uint8) []*iptables.Chain
+
 	DNATsToIptablesChains(dnats map[string]string) []*iptables.Chain
 	SNATsToIptablesChains(snats map[string]string) []*iptables.Chain
 }
@@ -216,6 +235,25 @@ type Config struct {
 	FailsafeOutboundHostPorts []config.ProtoPort
 
 	DisableConntrackInvalid bool
+	// ICMPRelatedErrors is one of the ICMPRelatedErrors... constants; it controls how the
+	// endpoint chains treat ICMP error packets.
+	ICMPRelatedErrors string
+
+	// NodeLocalDNSAddresses are the addresses of the node-local DNS cache, if any.  DNS
+	// traffic to and from them is exempted from conntrack and accepted ahead of policy.
+	NodeLocalDNSAddresses []string
+	NodeLocalDNSPort      uint16
+
+	// MaxRulesPerPolicy and MaxCIDRsPerRule, if non-zero, limit the size of the policies and
+	// profiles that we render.  A policy that exceeds a limit is rendered as chains that drop
+	// all traffic.
+	MaxRulesPerPolicy int
+	MaxCIDRsPerRule   int
+
+	// HostEndpointVLANs maps the name of an interface that carries workload traffic directly,
+	// such as an SR-IOV physical function, to the VLANs of that traffic.  Traffic on the VLAN
+	// sub-interfaces is dispatched to the policy of the interface's host endpoint.
+	HostEndpointVLANs map[string][]int
 }
 
 func (c *Config) validate() {
@@ -245,6 +283,12 @@ func (c *Config) validate() {
 		// Check the reflection found something we were expecting.
 		log.Panic("Didn't find any IptablesMarkXXX fields.")
 	}
+
+	// The log prefix is rendered into our rules so make sure it can't produce malformed
+	// iptables input.
+	if err := iptables.ValidateLogPrefix(c.IptablesLogPrefix); err != nil {
+		log.WithError(err).Panic("Invalid IptablesLogPrefix.")
+	}
 }
 
 func NewRenderer(config Config) RuleRenderer {
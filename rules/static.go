@@ -23,7 +23,7 @@ import (
 func (r *DefaultRuleRenderer) StaticFilterTableChains(ipVersion uint8) (chains []*Chain) {
 	chains = append(chains, r.StaticFilterForwardChains()...)
 	chains = append(chains, r.StaticFilterInputChains(ipVersion)...)
-	chains = append(chains, r.StaticFilterOutputChains()...)
+	chains = append(chains, r.StaticFilterOutputChains(ipVersion)...)
 	return
 }
 
@@ -55,6 +55,9 @@ func (r *DefaultRuleRenderer) filterInputChain(ipVersion uint8) *Chain {
 	// Accept immediately if we've already accepted this packet in the raw or mangle table.
 	inputRules = append(inputRules, r.acceptAlreadyAccepted()...)
 
+	// Accept requests to the node-local DNS cache, if there is one.
+	inputRules = append(inputRules, r.filterInputNodeLocalDNSRules(ipVersion)...)
+
 	if ipVersion == 4 && r.IPIPEnabled {
 		// IPIP is enabled, filter incoming IPIP packets to ensure they come from a
 		// recognised host.  We use the protocol number rather than its name because the
@@ -311,19 +314,22 @@ func (r *DefaultRuleRenderer) StaticFilterForwardChains() []*Chain {
 	}}
 }
 
-func (r *DefaultRuleRenderer) StaticFilterOutputChains() []*Chain {
+func (r *DefaultRuleRenderer) StaticFilterOutputChains(ipVersion uint8) []*Chain {
 	return []*Chain{
-		r.filterOutputChain(),
+		r.filterOutputChain(ipVersion),
 		r.failsafeOutChain(),
 	}
 }
 
-func (r *DefaultRuleRenderer) filterOutputChain() *Chain {
+func (r *DefaultRuleRenderer) filterOutputChain(ipVersion uint8) *Chain {
 	rules := []Rule{}
 
 	// Accept immediately if we've already accepted this packet in the raw or mangle table.
 	rules = append(rules, r.acceptAlreadyAccepted()...)
 
+	// Accept traffic to and from the node-local DNS cache, if there is one.
+	rules = append(rules, r.filterOutputNodeLocalDNSRules(ipVersion)...)
+
 	// We don't currently police host -> endpoint according to the endpoint's ingress policy.
 	// That decision is based on pragmatism; it's generally very useful to be able to contact
 	// any local workload from the host and policing the traffic doesn't really protect
@@ -459,15 +465,25 @@ func (r *DefaultRuleRenderer) StaticNATOutputChains(ipVersion uint8) []*Chain {
 }
 
 func (r *DefaultRuleRenderer) StaticMangleTableChains(ipVersion uint8) (chains []*Chain) {
-	return []*Chain{
+	chains = []*Chain{
 		r.failsafeInChain(),
 		r.StaticManglePreroutingChain(ipVersion),
 	}
+	// Start with no QoS rules; the chain is replaced as QoS policies are resolved.
+	return append(chains, r.WorkloadQoSChains(nil)...)
 }
 
 func (r *DefaultRuleRenderer) StaticManglePreroutingChain(ipVersion uint8) *Chain {
 	rules := []Rule{}
 
+	// Set the DSCP field of traffic from workloads with a QoS policy.  This comes first so that
+	// it applies to every packet of a connection, not just the ones that we police.
+	rules = append(rules,
+		Rule{
+			Action: JumpAction{Target: ChainQoSFromWorkload},
+		},
+	)
+
 	// ACCEPT or RETURN immediately if packet matches an existing connection.  Note that we also
 	// have a rule like this at the start of each pre-endpoint chain; the functional difference
 	// with placing this rule here is that it will also apply to packets that may be unrelated
@@ -532,7 +548,7 @@ func (r *DefaultRuleRenderer) StaticRawTableChains(ipVersion uint8) []*Chain {
 		r.failsafeInChain(),
 		r.failsafeOutChain(),
 		r.StaticRawPreroutingChain(ipVersion),
-		r.StaticRawOutputChain(),
+		r.StaticRawOutputChain(ipVersion),
 	}
 }
 
@@ -545,6 +561,9 @@ func (r *DefaultRuleRenderer) StaticRawPreroutingChain(ipVersion uint8) *Chain {
 		Rule{Action: ClearMarkAction{Mark: r.allCalicoMarkBits()}},
 	)
 
+	// Disable conntrack for requests to the node-local DNS cache, if there is one.
+	rules = append(rules, r.rawPreroutingNodeLocalDNSRules(ipVersion)...)
+
 	// Set a mark on the packet if it's from a workload interface.
 	markFromWorkload := r.IptablesMarkScratch0
 	for _, ifacePrefix := range r.WorkloadIfacePrefixes {
@@ -592,20 +611,25 @@ func (r *DefaultRuleRenderer) allCalicoMarkBits() uint32 {
 		r.IptablesMarkScratch1
 }
 
-func (r *DefaultRuleRenderer) StaticRawOutputChain() *Chain {
+func (r *DefaultRuleRenderer) StaticRawOutputChain(ipVersion uint8) *Chain {
+	rules := []Rule{
+		// For safety, clear all our mark bits before we start.  (We could be in
+		// append mode and another process' rules could have left the mark bit set.)
+		{Action: ClearMarkAction{Mark: r.allCalicoMarkBits()}},
+	}
+	// Disable conntrack for traffic to and from the node-local DNS cache, if there is one.
+	rules = append(rules, r.rawOutputNodeLocalDNSRules(ipVersion)...)
+	rules = append(rules,
+		// Then, jump to the untracked policy chains.
+		Rule{Action: JumpAction{Target: ChainDispatchToHostEndpoint}},
+		// Then, if the packet was marked as allowed, accept it.  Packets also
+		// return here without the mark bit set if the interface wasn't one that
+		// we're policing.
+		Rule{Match: Match().MarkSet(r.IptablesMarkAccept),
+			Action: AcceptAction{}},
+	)
 	return &Chain{
-		Name: ChainRawOutput,
-		Rules: []Rule{
-			// For safety, clear all our mark bits before we start.  (We could be in
-			// append mode and another process' rules could have left the mark bit set.)
-			{Action: ClearMarkAction{Mark: r.allCalicoMarkBits()}},
-			// Then, jump to the untracked policy chains.
-			{Action: JumpAction{Target: ChainDispatchToHostEndpoint}},
-			// Then, if the packet was marked as allowed, accept it.  Packets also
-			// return here without the mark bit set if the interface wasn't one that
-			// we're policing.
-			{Match: Match().MarkSet(r.IptablesMarkAccept),
-				Action: AcceptAction{}},
-		},
+		Name:  ChainRawOutput,
+		Rules: rules,
 	}
 }
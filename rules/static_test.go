@@ -575,6 +575,64 @@ var _ = Describe("Static", func() {
 			})
 		}
 	})
+
+	Describe("with a node-local DNS cache", func() {
+		BeforeEach(func() {
+			conf = Config{
+				WorkloadIfacePrefixes: []string{"cali"},
+				IptablesMarkAccept:    0x10,
+				IptablesMarkPass:      0x20,
+				IptablesMarkScratch0:  0x40,
+				IptablesMarkScratch1:  0x80,
+				NodeLocalDNSAddresses: []string{"169.254.20.10"},
+				NodeLocalDNSPort:      53,
+			}
+		})
+
+		toCache := func(action Action) []Rule {
+			return []Rule{
+				{Match: Match().Protocol("udp").DestNet("169.254.20.10").DestPorts(53),
+					Action: action, Comment: "Node-local DNS cache"},
+				{Match: Match().Protocol("tcp").DestNet("169.254.20.10").DestPorts(53),
+					Action: action, Comment: "Node-local DNS cache"},
+			}
+		}
+		fromCache := func(action Action) []Rule {
+			return []Rule{
+				{Match: Match().Protocol("udp").SourceNet("169.254.20.10").SourcePorts(53),
+					Action: action, Comment: "Node-local DNS cache"},
+				{Match: Match().Protocol("tcp").SourceNet("169.254.20.10").SourcePorts(53),
+					Action: action, Comment: "Node-local DNS cache"},
+			}
+		}
+
+		It("IPv4: should disable conntrack for requests in the raw PREROUTING chain", func() {
+			chain := findChain(rr.StaticRawTableChains(4), "cali-PREROUTING")
+			Expect(chain.Rules[0]).To(Equal(Rule{Action: ClearMarkAction{Mark: 0xf0}}))
+			Expect(chain.Rules[1:3]).To(Equal(toCache(NoTrackAction{})))
+			Expect(chain.Rules).To(HaveLen(6))
+		})
+		It("IPv4: should disable conntrack for requests and responses in the raw OUTPUT chain", func() {
+			chain := findChain(rr.StaticRawTableChains(4), "cali-OUTPUT")
+			Expect(chain.Rules[1:5]).To(Equal(append(toCache(NoTrackAction{}), fromCache(NoTrackAction{})...)))
+			Expect(chain.Rules).To(HaveLen(7))
+		})
+		It("IPv4: should accept requests in the filter INPUT chain", func() {
+			chain := findChain(rr.StaticFilterTableChains(4), "cali-INPUT")
+			Expect(chain.Rules[1:3]).To(Equal(toCache(AcceptAction{})))
+		})
+		It("IPv4: should accept responses and requests in the filter OUTPUT chain", func() {
+			chain := findChain(rr.StaticFilterTableChains(4), "cali-OUTPUT")
+			Expect(chain.Rules[1:5]).To(Equal(append(fromCache(AcceptAction{}), toCache(AcceptAction{})...)))
+		})
+		It("IPv6: should not render rules for IPv4 addresses", func() {
+			for _, chain := range append(rr.StaticRawTableChains(6), rr.StaticFilterTableChains(6)...) {
+				for _, rule := range chain.Rules {
+					Expect(rule.Comment).NotTo(Equal("Node-local DNS cache"))
+				}
+			}
+		})
+	})
 })
 
 func findChain(chains []*Chain, name string) *Chain {
@@ -0,0 +1,207 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package selftest exercises the iptables machinery end-to-end against the real iptables
+// binaries, inside a scratch network namespace so that the host's rules are not touched.  It
+// gives a quick confidence check when bringing up Felix on a new kernel or distribution.
+package selftest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netns"
+
+	"github.com/projectcalico/felix/iptables"
+	"github.com/projectcalico/felix/rules"
+)
+
+const testChainName = rules.ChainNamePrefix + "selftest"
+
+// Result is the outcome of one step of the self test.
+type Result struct {
+	Step string
+	Err  error
+}
+
+// Run runs the self test, writing a line per step to out.  Returns true if all steps passed.
+func Run(out io.Writer) bool {
+	results := RunSteps()
+	passed := true
+	for _, r := range results {
+		if r.Err != nil {
+			passed = false
+			fmt.Fprintf(out, "FAIL %s: %v\n", r.Step, r.Err)
+		} else {
+			fmt.Fprintf(out, "PASS %s\n", r.Step)
+		}
+	}
+	if passed {
+		fmt.Fprintln(out, "Self test passed")
+	} else {
+		fmt.Fprintln(out, "Self test FAILED")
+	}
+	return passed
+}
+
+// RunSteps creates a temporary network namespace and runs each step of the self test in it,
+// stopping at the first failure.
+func RunSteps() (results []Result) {
+	// Network namespaces are per-thread; lock this goroutine to its thread so that we (and
+	// the iptables commands that we fork) stay in the scratch namespace.
+	runtime.LockOSThread()
+	origNS, err := netns.Get()
+	if err != nil {
+		runtime.UnlockOSThread()
+		return []Result{{Step: "create namespace", Err: err}}
+	}
+	defer origNS.Close()
+	scratchNS, err := netns.New()
+	if err != nil {
+		runtime.UnlockOSThread()
+		return []Result{{Step: "create namespace", Err: err}}
+	}
+	results = append(results, Result{Step: "create namespace"})
+	defer func() {
+		scratchNS.Close()
+		if err := netns.Set(origNS); err != nil {
+			// Leave the thread locked so that it is discarded rather than reused in the
+			// wrong namespace.
+			log.WithError(err).Error("Failed to restore network namespace")
+			return
+		}
+		runtime.UnlockOSThread()
+	}()
+
+	table := iptables.NewTable(
+		"filter",
+		4,
+		rules.RuleHashPrefix,
+		&sync.Mutex{},
+		iptables.NewFeatureDetector(),
+		iptables.TableOptions{
+			CompatTable:          rules.HistoricCompatTable,
+			InsertMode:           "insert",
+			ReturnErrorOnFailure: true,
+		},
+	)
+	steps := []struct {
+		name string
+		f    func() error
+	}{
+		{"program", func() error {
+			table.UpdateChain(&iptables.Chain{
+				Name: testChainName,
+				Rules: []iptables.Rule{
+					{Match: iptables.Match().SourceNet("192.0.2.1/32"), Action: iptables.DropAction{}},
+					{Action: iptables.ReturnAction{}},
+				},
+			})
+			table.SetRuleInsertions("INPUT", []iptables.Rule{
+				{Action: iptables.JumpAction{Target: testChainName}},
+			})
+			return apply(table)
+		}},
+		{"verify", func() error {
+			return verify(true)
+		}},
+		{"clobber", func() error {
+			return exec.Command("iptables", "-w", "-t", "filter", "-F", testChainName).Run()
+		}},
+		{"resync", func() error {
+			table.InvalidateDataplaneCache("self test")
+			if err := apply(table); err != nil {
+				return err
+			}
+			return verify(true)
+		}},
+		{"cleanup", func() error {
+			table.RemoveChainByName(testChainName)
+			table.SetRuleInsertions("INPUT", nil)
+			if err := apply(table); err != nil {
+				return err
+			}
+			return verify(false)
+		}},
+	}
+	for _, step := range steps {
+		err := step.f()
+		results = append(results, Result{Step: step.name, Err: err})
+		if err != nil {
+			break
+		}
+	}
+	return
+}
+
+// apply applies any pending updates, returning an *iptables.ApplyError on persistent failure.
+func apply(table *iptables.Table) error {
+	_, err := table.ApplyContext(context.Background())
+	return err
+}
+
+func verify(expectPresent bool) error {
+	output, err := exec.Command("iptables-save", "-t", "filter").Output()
+	if err != nil {
+		return err
+	}
+	return checkSaveOutput(string(output), expectPresent)
+}
+
+// checkSaveOutput checks the iptables-save output of the filter table for the expected state
+// of the self test chain and its hook.
+func checkSaveOutput(output string, expectPresent bool) error {
+	chainFound := false
+	numRules := 0
+	hookFound := false
+	for _, line := range strings.Split(output, "\n") {
+		if !strings.Contains(line, testChainName) {
+			continue
+		}
+		if !expectPresent {
+			return fmt.Errorf("found left-over rule or chain: %q", line)
+		}
+		switch {
+		case strings.HasPrefix(line, ":"+testChainName+" "):
+			chainFound = true
+		case strings.HasPrefix(line, "-A "+testChainName+" "):
+			if !strings.Contains(line, rules.RuleHashPrefix) {
+				return fmt.Errorf("rule missing hash comment: %q", line)
+			}
+			numRules++
+		case strings.HasPrefix(line, "-A INPUT "):
+			hookFound = true
+		}
+	}
+	if !expectPresent {
+		return nil
+	}
+	if !chainFound {
+		return errors.New("chain not found")
+	}
+	if numRules != 2 {
+		return fmt.Errorf("expected 2 rules in chain, found %d", numRules)
+	}
+	if !hookFound {
+		return errors.New("INPUT hook not found")
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package selftest
+
+import (
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+const goodSave = `*filter
+:INPUT ACCEPT [0:0]
+:cali-selftest - [0:0]
+-A INPUT -m comment --comment "cali:abcd" -j cali-selftest
+-A cali-selftest -s 192.0.2.1/32 -m comment --comment "cali:efgh" -j DROP
+-A cali-selftest -m comment --comment "cali:ijkl" -j RETURN
+COMMIT
+`
+
+const emptySave = `*filter
+:INPUT ACCEPT [0:0]
+COMMIT
+`
+
+var _ = DescribeTable("checkSaveOutput",
+	func(output string, expectPresent bool, expectErr bool) {
+		err := checkSaveOutput(output, expectPresent)
+		if expectErr {
+			Expect(err).To(HaveOccurred())
+		} else {
+			Expect(err).NotTo(HaveOccurred())
+		}
+	},
+	Entry("programmed", goodSave, true, false),
+	Entry("left-over state", goodSave, false, true),
+	Entry("cleaned up", emptySave, false, false),
+	Entry("missing", emptySave, true, true),
+	Entry("clobbered", `*filter
+:INPUT ACCEPT [0:0]
+:cali-selftest - [0:0]
+-A INPUT -m comment --comment "cali:abcd" -j cali-selftest
+COMMIT
+`, true, true),
+)
@@ -0,0 +1,321 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package supportmatrix probes the host for the dataplane features that Felix can make use of
+// and reports them as a machine-readable support matrix, so that installers (and support) can
+// pick the dataplane modes for a node automatically.
+package supportmatrix
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"strings"
+
+	version "github.com/hashicorp/go-version"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/projectcalico/felix/iptables"
+	"github.com/projectcalico/felix/rules"
+	"github.com/projectcalico/felix/versionparse"
+)
+
+// Dataplane modes, as reported in Matrix.DataplaneModes.
+const (
+	ModeIptablesLegacy = "iptables-legacy"
+	ModeIptablesNFT    = "iptables-nft"
+	ModeXDP            = "xdp"
+	ModeBPF            = "bpf"
+	ModeWireguard      = "wireguard"
+)
+
+// Kernel module states, as reported in Matrix.KernelModules.
+const (
+	// ModuleLoaded means that the module is loaded or built into the kernel.
+	ModuleLoaded = "loaded"
+	// ModuleAvailable means that the module isn't loaded but it is installed, so it will be
+	// loaded on demand.
+	ModuleAvailable = "available"
+	ModuleMissing   = "missing"
+)
+
+// kernelModules are the modules that we report on.
+var kernelModules = []string{
+	"ip_tables",
+	"ip6_tables",
+	"ip_set",
+	"xt_set",
+	"xt_conntrack",
+	"xt_mark",
+	"xt_multiport",
+	"xt_rpfilter",
+	"ipip",
+	"nf_tables",
+	"nft_compat",
+	"wireguard",
+}
+
+var (
+	iptablesVersionRegexp = regexp.MustCompile(`v(\d+\.\d+\.\d+)`)
+
+	// v4Dot16Dot0 is the oldest kernel with the XDP features that we need.
+	v4Dot16Dot0 = versionparse.MustParseVersion("4.16.0")
+	// v5Dot3Dot0 is the oldest kernel with the BPF features that we need.
+	v5Dot3Dot0 = versionparse.MustParseVersion("5.3.0")
+	// v5Dot6Dot0 has wireguard built in.
+	v5Dot6Dot0 = versionparse.MustParseVersion("5.6.0")
+)
+
+// Matrix is the support matrix for a host.
+type Matrix struct {
+	KernelVersion string `json:"kernelVersion"`
+	// KernelModules maps from the name of each module that we use to its state: ModuleLoaded,
+	// ModuleAvailable or ModuleMissing.
+	KernelModules map[string]string `json:"kernelModules"`
+	Iptables      IptablesSupport   `json:"iptables"`
+	// DataplaneModes maps from each dataplane mode (ModeIptablesLegacy and so on) to whether
+	// the host supports it and, if not, why not.
+	DataplaneModes map[string]ModeSupport `json:"dataplaneModes"`
+}
+
+// IptablesSupport describes the host's iptables.
+type IptablesSupport struct {
+	// Version is the version of the default iptables binary; empty if there isn't one.
+	Version string `json:"version"`
+	// DetectedBackend is the backend that the rest of the host appears to be using, as
+	// detected by iptables.BackendDetector.
+	DetectedBackend     string `json:"detectedBackend"`
+	SNATFullyRandom     bool   `json:"snatFullyRandom"`
+	MASQFullyRandom     bool   `json:"masqFullyRandom"`
+	RestoreSupportsLock bool   `json:"restoreSupportsLock"`
+}
+
+// ModeSupport says whether a dataplane mode is supported.
+type ModeSupport struct {
+	Supported bool   `json:"supported"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+// Write probes the host and writes its support matrix to out as indented JSON.
+func Write(out io.Writer) error {
+	data, err := json.MarshalIndent(Probe(), "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = out.Write(append(data, '\n'))
+	return err
+}
+
+// Probe runs all the feature detectors and returns the host's support matrix.
+func Probe() *Matrix {
+	return newProber().probe()
+}
+
+// prober holds the functions that the probe uses to examine the host, so that the UTs can shim
+// them.
+type prober struct {
+	readFile func(filename string) ([]byte, error)
+	stat     func(name string) (os.FileInfo, error)
+	lookPath func(file string) (string, error)
+	runCmd   func(name string, arg ...string) ([]byte, error)
+
+	iptablesFeatures func() *iptables.Features
+	detectBackend    func() string
+}
+
+func newProber() *prober {
+	return &prober{
+		readFile: ioutil.ReadFile,
+		stat:     os.Stat,
+		lookPath: exec.LookPath,
+		runCmd: func(name string, arg ...string) ([]byte, error) {
+			return exec.Command(name, arg...).Output()
+		},
+		iptablesFeatures: iptables.NewFeatureDetector().GetFeatures,
+		detectBackend: func() string {
+			return iptables.NewBackendDetector([]string{rules.ChainNamePrefix}).Detect("")
+		},
+	}
+}
+
+func (p *prober) probe() *Matrix {
+	kernelVersion := p.kernelVersion()
+	m := &Matrix{
+		KernelModules:  map[string]string{},
+		DataplaneModes: map[string]ModeSupport{},
+	}
+	if kernelVersion != nil {
+		m.KernelVersion = kernelVersion.String()
+	}
+	release := p.kernelRelease()
+	for _, module := range kernelModules {
+		m.KernelModules[module] = p.moduleState(release, module)
+	}
+
+	m.Iptables.Version = p.iptablesVersion()
+	features := p.iptablesFeatures()
+	m.Iptables.SNATFullyRandom = features.SNATFullyRandom
+	m.Iptables.MASQFullyRandom = features.MASQFullyRandom
+	m.Iptables.RestoreSupportsLock = features.RestoreSupportsLock
+	m.Iptables.DetectedBackend = p.detectBackend()
+
+	m.DataplaneModes[ModeIptablesLegacy] = p.iptablesModeSupport(
+		m.KernelModules, "iptables-legacy-restore", "ip_tables")
+	m.DataplaneModes[ModeIptablesNFT] = p.iptablesModeSupport(
+		m.KernelModules, "iptables-nft-restore", "nf_tables")
+	m.DataplaneModes[ModeXDP] = kernelAtLeast(kernelVersion, v4Dot16Dot0)
+	bpf := kernelAtLeast(kernelVersion, v5Dot3Dot0)
+	if bpf.Supported && !p.bpfFSMounted() {
+		bpf = ModeSupport{Reason: "BPF filesystem not mounted at /sys/fs/bpf"}
+	}
+	m.DataplaneModes[ModeBPF] = bpf
+	wireguard := ModeSupport{Supported: true}
+	if m.KernelModules["wireguard"] == ModuleMissing {
+		wireguard = kernelAtLeast(kernelVersion, v5Dot6Dot0)
+		if !wireguard.Supported {
+			wireguard.Reason = "wireguard module not installed and " + wireguard.Reason
+		}
+	}
+	m.DataplaneModes[ModeWireguard] = wireguard
+
+	log.WithField("matrix", m).Debug("Probed support matrix")
+	return m
+}
+
+func (p *prober) kernelVersion() *version.Version {
+	data, err := p.readFile("/proc/version")
+	if err != nil {
+		log.WithError(err).Warn("Failed to read kernel version")
+		return nil
+	}
+	v, err := versionparse.GetKernelVersion(bytes.NewReader(data))
+	if err != nil {
+		return nil
+	}
+	return v
+}
+
+func (p *prober) kernelRelease() string {
+	data, err := p.readFile("/proc/sys/kernel/osrelease")
+	if err != nil {
+		log.WithError(err).Warn("Failed to read kernel release")
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// moduleState returns whether the given module is loaded (or built in), installed or missing.
+// Built-in modules only appear in /sys/module if they have parameters so we also check
+// modules.builtin.
+func (p *prober) moduleState(release, module string) string {
+	if _, err := p.stat(path.Join("/sys/module", module)); err == nil {
+		return ModuleLoaded
+	}
+	if release == "" {
+		return ModuleMissing
+	}
+	modulesDir := path.Join("/lib/modules", release)
+	if p.moduleListed(path.Join(modulesDir, "modules.builtin"), module) {
+		return ModuleLoaded
+	}
+	if p.moduleListed(path.Join(modulesDir, "modules.dep"), module) {
+		return ModuleAvailable
+	}
+	return ModuleMissing
+}
+
+// moduleListed returns true if the given modules.builtin or modules.dep file lists the module.
+// Both have the module's path at the start of each line; modules.dep follows it with a colon.
+func (p *prober) moduleListed(filename, module string) bool {
+	data, err := p.readFile(filename)
+	if err != nil {
+		log.WithError(err).WithField("file", filename).Debug("Failed to read module list")
+		return false
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		modPath := strings.SplitN(scanner.Text(), ":", 2)[0]
+		name := path.Base(modPath)
+		for _, ext := range []string{".xz", ".gz", ".zst", ".ko"} {
+			name = strings.TrimSuffix(name, ext)
+		}
+		// The files use the module's file name, which may have dashes in place of
+		// underscores.
+		if strings.Replace(name, "-", "_", -1) == module {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *prober) iptablesVersion() string {
+	out, err := p.runCmd("iptables", "--version")
+	if err != nil {
+		log.WithError(err).Warn("Failed to get iptables version")
+		return ""
+	}
+	matches := iptablesVersionRegexp.FindStringSubmatch(string(out))
+	if len(matches) == 0 {
+		return ""
+	}
+	return matches[1]
+}
+
+func (p *prober) iptablesModeSupport(modules map[string]string, restoreCmd, module string) ModeSupport {
+	if _, err := p.lookPath(restoreCmd); err != nil {
+		// Older iptables only has the legacy backend and its binaries don't carry a suffix.
+		if restoreCmd != "iptables-legacy-restore" {
+			return ModeSupport{Reason: restoreCmd + " not found"}
+		}
+		if _, err := p.lookPath("iptables-restore"); err != nil {
+			return ModeSupport{Reason: "iptables-restore not found"}
+		}
+	}
+	if modules[module] == ModuleMissing {
+		return ModeSupport{Reason: module + " module not installed"}
+	}
+	return ModeSupport{Supported: true}
+}
+
+func (p *prober) bpfFSMounted() bool {
+	data, err := p.readFile("/proc/mounts")
+	if err != nil {
+		log.WithError(err).Warn("Failed to read mounts")
+		return false
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 3 && fields[1] == "/sys/fs/bpf" && fields[2] == "bpf" {
+			return true
+		}
+	}
+	return false
+}
+
+func kernelAtLeast(kernelVersion, minVersion *version.Version) ModeSupport {
+	if kernelVersion == nil {
+		return ModeSupport{Reason: "kernel version unknown"}
+	}
+	if kernelVersion.Compare(minVersion) < 0 {
+		return ModeSupport{Reason: "kernel older than " + minVersion.String()}
+	}
+	return ModeSupport{Supported: true}
+}
@@ -0,0 +1,170 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package supportmatrix
+
+import (
+	"errors"
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/projectcalico/felix/iptables"
+)
+
+var errNotFound = errors.New("not found")
+
+type mockHost struct {
+	files    map[string]string
+	sysDirs  map[string]bool
+	binaries map[string]bool
+}
+
+func (h *mockHost) prober() *prober {
+	return &prober{
+		readFile: func(filename string) ([]byte, error) {
+			if data, ok := h.files[filename]; ok {
+				return []byte(data), nil
+			}
+			return nil, errNotFound
+		},
+		stat: func(name string) (os.FileInfo, error) {
+			if h.sysDirs[name] {
+				return nil, nil
+			}
+			return nil, errNotFound
+		},
+		lookPath: func(file string) (string, error) {
+			if h.binaries[file] {
+				return "/sbin/" + file, nil
+			}
+			return "", errNotFound
+		},
+		runCmd: func(name string, arg ...string) ([]byte, error) {
+			if name == "iptables" && h.binaries["iptables"] {
+				return []byte("iptables v1.8.4 (nf_tables)\n"), nil
+			}
+			return nil, errNotFound
+		},
+		iptablesFeatures: func() *iptables.Features {
+			return &iptables.Features{MASQFullyRandom: true, RestoreSupportsLock: true}
+		},
+		detectBackend: func() string {
+			return iptables.BackendNFT
+		},
+	}
+}
+
+var _ = Describe("Support matrix", func() {
+	var host *mockHost
+
+	BeforeEach(func() {
+		host = &mockHost{
+			files: map[string]string{
+				"/proc/version":              "Linux version 5.4.0-42-generic (buildd@lgw01-amd64-038) #46-Ubuntu SMP",
+				"/proc/sys/kernel/osrelease": "5.4.0-42-generic\n",
+				"/proc/mounts":               "sysfs /sys sysfs rw 0 0\nnone /sys/fs/bpf bpf rw 0 0\n",
+				"/lib/modules/5.4.0-42-generic/modules.builtin": "kernel/net/ipv4/netfilter/ip_tables.ko\n",
+				"/lib/modules/5.4.0-42-generic/modules.dep": "kernel/net/netfilter/xt_set.ko: kernel/net/netfilter/ipset/ip_set.ko\n" +
+					"kernel/net/netfilter/ipset/ip_set.ko:\n" +
+					"kernel/net/ipv4/ipip.ko.xz: kernel/net/ipv4/ip_tunnel.ko\n",
+			},
+			sysDirs: map[string]bool{
+				"/sys/module/nf_tables":    true,
+				"/sys/module/xt_conntrack": true,
+			},
+			binaries: map[string]bool{
+				"iptables":                true,
+				"iptables-legacy-restore": true,
+				"iptables-nft-restore":    true,
+			},
+		}
+	})
+
+	It("should report a modern host", func() {
+		m := host.prober().probe()
+		Expect(m.KernelVersion).To(Equal("5.4.0"))
+		Expect(m.KernelModules).To(Equal(map[string]string{
+			"ip_tables":    ModuleLoaded,
+			"ip6_tables":   ModuleMissing,
+			"ip_set":       ModuleAvailable,
+			"xt_set":       ModuleAvailable,
+			"xt_conntrack": ModuleLoaded,
+			"xt_mark":      ModuleMissing,
+			"xt_multiport": ModuleMissing,
+			"xt_rpfilter":  ModuleMissing,
+			"ipip":         ModuleAvailable,
+			"nf_tables":    ModuleLoaded,
+			"nft_compat":   ModuleMissing,
+			"wireguard":    ModuleMissing,
+		}))
+		Expect(m.Iptables).To(Equal(IptablesSupport{
+			Version:             "1.8.4",
+			DetectedBackend:     iptables.BackendNFT,
+			MASQFullyRandom:     true,
+			RestoreSupportsLock: true,
+		}))
+		Expect(m.DataplaneModes).To(Equal(map[string]ModeSupport{
+			ModeIptablesLegacy: {Supported: true},
+			ModeIptablesNFT:    {Supported: true},
+			ModeXDP:            {Supported: true},
+			ModeBPF:            {Supported: true},
+			ModeWireguard: {
+				Reason: "wireguard module not installed and kernel older than 5.6.0",
+			},
+		}))
+	})
+
+	It("should report an old host", func() {
+		host.files["/proc/version"] = "Linux version 3.10.0-957.el7.x86_64 (mockbuild@kbuilder)"
+		delete(host.files, "/proc/mounts")
+		delete(host.sysDirs, "/sys/module/nf_tables")
+		host.binaries = map[string]bool{"iptables-restore": true}
+		m := host.prober().probe()
+		Expect(m.KernelVersion).To(Equal("3.10.0"))
+		Expect(m.Iptables.Version).To(BeEmpty())
+		Expect(m.DataplaneModes).To(Equal(map[string]ModeSupport{
+			ModeIptablesLegacy: {Supported: true},
+			ModeIptablesNFT:    {Reason: "iptables-nft-restore not found"},
+			ModeXDP:            {Reason: "kernel older than 4.16.0"},
+			ModeBPF:            {Reason: "kernel older than 5.3.0"},
+			ModeWireguard: {
+				Reason: "wireguard module not installed and kernel older than 5.6.0",
+			},
+		}))
+	})
+
+	It("should require the BPF filesystem for BPF mode", func() {
+		host.files["/proc/mounts"] = "sysfs /sys sysfs rw 0 0\n"
+		m := host.prober().probe()
+		Expect(m.DataplaneModes[ModeBPF]).To(Equal(ModeSupport{
+			Reason: "BPF filesystem not mounted at /sys/fs/bpf",
+		}))
+	})
+
+	It("should report wireguard if the module is installed", func() {
+		host.sysDirs["/sys/module/wireguard"] = true
+		m := host.prober().probe()
+		Expect(m.DataplaneModes[ModeWireguard]).To(Equal(ModeSupport{Supported: true}))
+	})
+
+	It("should cope with an unknown kernel", func() {
+		host.files = map[string]string{}
+		m := host.prober().probe()
+		Expect(m.KernelVersion).To(BeEmpty())
+		Expect(m.KernelModules["ip_set"]).To(Equal(ModuleMissing))
+		Expect(m.DataplaneModes[ModeXDP]).To(Equal(ModeSupport{Reason: "kernel version unknown"}))
+	})
+})
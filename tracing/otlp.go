@@ -0,0 +1,305 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package tracing exports trace spans, such as those reported by the iptables Tables for each
+// apply cycle, to an OpenTelemetry collector.
+//
+// To avoid pulling the OpenTelemetry SDK (and gRPC) into Felix, OTLPTracer speaks OTLP over
+// HTTP using the protocol's JSON encoding, which only needs the standard library.
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/projectcalico/felix/iptables"
+)
+
+const (
+	// ServiceName is the service.name resource attribute of our spans.
+	ServiceName = "calico-felix"
+
+	defaultBatchSize     = 512
+	defaultFlushInterval = 5 * time.Second
+	spanQueueLen         = 2048
+
+	// OTLP span kind and status codes.
+	spanKindInternal = 1
+	statusCodeError  = 2
+)
+
+// OTLPTracer is an iptables.Tracer that batches up finished spans and exports them to an
+// OpenTelemetry collector's OTLP/HTTP endpoint.  Spans that can't be queued or exported are
+// dropped, tracing never blocks the dataplane.
+type OTLPTracer struct {
+	url      string
+	hostname string
+	client   *http.Client
+
+	spans         chan *span
+	batchSize     int
+	flushInterval time.Duration
+}
+
+// NewOTLPTracer creates an OTLPTracer that exports to the given OTLP/HTTP traces URL, for
+// example, "http://otel-collector:4318/v1/traces".  The hostname is recorded as the host.name
+// resource attribute.  Call Start() to start the background exporter.
+func NewOTLPTracer(url string, hostname string) *OTLPTracer {
+	return &OTLPTracer{
+		url:           url,
+		hostname:      hostname,
+		client:        &http.Client{Timeout: 10 * time.Second},
+		spans:         make(chan *span, spanQueueLen),
+		batchSize:     defaultBatchSize,
+		flushInterval: defaultFlushInterval,
+	}
+}
+
+// Start starts the background goroutine that exports spans.
+func (t *OTLPTracer) Start() {
+	go t.loopExportingSpans()
+}
+
+// StartSpan starts a span, as a child of the span in ctx, if any; otherwise the span starts a
+// new trace.  Spans aren't safe for concurrent use but child spans may be started from other
+// goroutines.
+func (t *OTLPTracer) StartSpan(ctx context.Context, name string) (context.Context, iptables.Span) {
+	s := &span{
+		tracer:     t,
+		name:       name,
+		startTime:  time.Now(),
+		attributes: map[string]interface{}{},
+	}
+	if parent, ok := ctx.Value(spanKey{}).(*span); ok {
+		s.traceID = parent.traceID
+		s.parentID = parent.spanID
+	} else {
+		randomBytes(s.traceID[:])
+	}
+	randomBytes(s.spanID[:])
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+type spanKey struct{}
+
+type span struct {
+	tracer *OTLPTracer
+
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+
+	name       string
+	startTime  time.Time
+	endTime    time.Time
+	attributes map[string]interface{}
+	err        error
+}
+
+func (s *span) SetAttribute(key string, value interface{}) {
+	s.attributes[key] = value
+}
+
+func (s *span) End(err error) {
+	s.endTime = time.Now()
+	s.err = err
+	select {
+	case s.tracer.spans <- s:
+	default:
+		log.WithField("span", s.name).Debug("Trace span queue full, dropping span")
+	}
+}
+
+func (t *OTLPTracer) loopExportingSpans() {
+	ticker := time.NewTicker(t.flushInterval)
+	defer ticker.Stop()
+	var batch []*span
+	for {
+		select {
+		case s := <-t.spans:
+			batch = append(batch, s)
+			if len(batch) < t.batchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		if err := t.export(batch); err != nil {
+			log.WithError(err).WithField("numSpans", len(batch)).Warn(
+				"Failed to export trace spans, dropping them")
+		}
+		batch = nil
+	}
+}
+
+// export sends the given spans to the collector as a single OTLP ExportTraceServiceRequest.
+func (t *OTLPTracer) export(spans []*span) error {
+	body, err := json.Marshal(t.exportRequest(spans))
+	if err != nil {
+		return err
+	}
+	resp, err := t.client.Post(t.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("OTLP collector returned %s", resp.Status)
+	}
+	log.WithField("numSpans", len(spans)).Debug("Exported trace spans")
+	return nil
+}
+
+// The following types mirror the JSON encoding of the OTLP trace protobufs.  Note that OTLP
+// encodes trace and span IDs as hex, rather than the usual base64, and 64-bit integers as
+// strings.
+
+type otlpExportRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            *otlpStatus    `json:"status,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+func (t *OTLPTracer) exportRequest(spans []*span) otlpExportRequest {
+	otlpSpans := make([]otlpSpan, 0, len(spans))
+	for _, s := range spans {
+		out := otlpSpan{
+			TraceID:           hex.EncodeToString(s.traceID[:]),
+			SpanID:            hex.EncodeToString(s.spanID[:]),
+			Name:              s.name,
+			Kind:              spanKindInternal,
+			StartTimeUnixNano: strconv.FormatInt(s.startTime.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.endTime.UnixNano(), 10),
+			Attributes:        toKeyValues(s.attributes),
+		}
+		if s.parentID != [8]byte{} {
+			out.ParentSpanID = hex.EncodeToString(s.parentID[:])
+		}
+		if s.err != nil {
+			out.Status = &otlpStatus{Code: statusCodeError, Message: s.err.Error()}
+		}
+		otlpSpans = append(otlpSpans, out)
+	}
+	return otlpExportRequest{
+		ResourceSpans: []otlpResourceSpans{{
+			Resource: otlpResource{Attributes: toKeyValues(map[string]interface{}{
+				"service.name": ServiceName,
+				"host.name":    t.hostname,
+			})},
+			ScopeSpans: []otlpScopeSpans{{
+				Scope: otlpScope{Name: "github.com/projectcalico/felix"},
+				Spans: otlpSpans,
+			}},
+		}},
+	}
+}
+
+// toKeyValues converts the given attributes to OTLP key/values, sorted by key.
+func toKeyValues(attributes map[string]interface{}) []otlpKeyValue {
+	keys := make([]string, 0, len(attributes))
+	for k := range attributes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	kvs := make([]otlpKeyValue, 0, len(attributes))
+	for _, k := range keys {
+		v := attributes[k]
+		var av otlpAnyValue
+		switch v := v.(type) {
+		case string:
+			av.StringValue = &v
+		case bool:
+			av.BoolValue = &v
+		case int:
+			s := strconv.FormatInt(int64(v), 10)
+			av.IntValue = &s
+		case int64:
+			s := strconv.FormatInt(v, 10)
+			av.IntValue = &s
+		case uint64:
+			s := strconv.FormatUint(v, 10)
+			av.IntValue = &s
+		case float64:
+			av.DoubleValue = &v
+		default:
+			s := fmt.Sprint(v)
+			av.StringValue = &s
+		}
+		kvs = append(kvs, otlpKeyValue{Key: k, Value: av})
+	}
+	return kvs
+}
+
+func randomBytes(b []byte) {
+	if _, err := rand.Read(b); err != nil {
+		log.WithError(err).Panic("Failed to generate random trace ID")
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright (c) 2019 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("OTLPTracer", func() {
+	var server *httptest.Server
+	var requests chan otlpExportRequest
+	var tracer *OTLPTracer
+
+	BeforeEach(func() {
+		requests = make(chan otlpExportRequest, 10)
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer GinkgoRecover()
+			Expect(r.URL.Path).To(Equal("/v1/traces"))
+			Expect(r.Header.Get("Content-Type")).To(Equal("application/json"))
+			var req otlpExportRequest
+			Expect(json.NewDecoder(r.Body).Decode(&req)).To(Succeed())
+			requests <- req
+		}))
+		tracer = NewOTLPTracer(server.URL+"/v1/traces", "host1")
+		tracer.batchSize = 3
+		tracer.flushInterval = 50 * time.Millisecond
+		tracer.Start()
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("should export a trace with parent and child spans", func() {
+		ctx, root := tracer.StartSpan(context.Background(), "dataplane.apply")
+		root.SetAttribute("felix.last_revision", "1234")
+		childCtx, child := tracer.StartSpan(ctx, "iptables.apply")
+		child.SetAttribute("iptables.ip_version", 4)
+		_, grandchild := tracer.StartSpan(childCtx, "iptables.restore")
+		grandchild.End(errors.New("restore failed"))
+		child.End(nil)
+		root.End(nil)
+
+		var req otlpExportRequest
+		Eventually(requests).Should(Receive(&req))
+		Expect(req.ResourceSpans).To(HaveLen(1))
+		rs := req.ResourceSpans[0]
+		Expect(*rs.Resource.Attributes[0].Value.StringValue).To(Equal("host1"))
+		Expect(*rs.Resource.Attributes[1].Value.StringValue).To(Equal(ServiceName))
+		spans := rs.ScopeSpans[0].Spans
+		Expect(spans).To(HaveLen(3))
+
+		restore, apply, dpApply := spans[0], spans[1], spans[2]
+		Expect(dpApply.Name).To(Equal("dataplane.apply"))
+		Expect(dpApply.ParentSpanID).To(BeEmpty())
+		Expect(dpApply.TraceID).To(HaveLen(32))
+		Expect(dpApply.SpanID).To(HaveLen(16))
+		Expect(*dpApply.Attributes[0].Value.StringValue).To(Equal("1234"))
+
+		Expect(apply.TraceID).To(Equal(dpApply.TraceID))
+		Expect(apply.ParentSpanID).To(Equal(dpApply.SpanID))
+		Expect(*apply.Attributes[0].Value.IntValue).To(Equal("4"))
+		Expect(apply.Status).To(BeNil())
+
+		Expect(restore.TraceID).To(Equal(dpApply.TraceID))
+		Expect(restore.ParentSpanID).To(Equal(apply.SpanID))
+		Expect(restore.Status.Code).To(Equal(statusCodeError))
+		Expect(restore.Status.Message).To(Equal("restore failed"))
+		Expect(restore.EndTimeUnixNano >= restore.StartTimeUnixNano).To(BeTrue())
+	})
+
+	It("should export a partial batch after the flush interval", func() {
+		_, s := tracer.StartSpan(context.Background(), "iptables.apply")
+		s.End(nil)
+		var req otlpExportRequest
+		Eventually(requests).Should(Receive(&req))
+		Expect(req.ResourceSpans[0].ScopeSpans[0].Spans).To(HaveLen(1))
+	})
+
+	It("should start a new trace for each root span", func() {
+		_, s1 := tracer.StartSpan(context.Background(), "a")
+		_, s2 := tracer.StartSpan(context.Background(), "b")
+		s1.End(nil)
+		s2.End(nil)
+		var req otlpExportRequest
+		Eventually(requests).Should(Receive(&req))
+		spans := req.ResourceSpans[0].ScopeSpans[0].Spans
+		Expect(spans[0].TraceID).NotTo(Equal(spans[1].TraceID))
+	})
+})